@@ -13,7 +13,7 @@ if [ -d "$TEMP" ]; then
 	rm -rf "$TEMP"
 fi
 
-GOBIN="$TEMP/bin" GOPATH="$TEMP" go get github.com/uniqush/uniqush-push
+GOBIN="$TEMP/bin" GOPATH="$TEMP" go get github.com/uniqush/uniqush-push github.com/uniqush/uniqush-push/cmd/uniqushctl
 
 VERSION=`"$TEMP/bin/uniqush-push" --version | sed 's/uniqush-push //'`
 
@@ -24,6 +24,7 @@ mkdir -p "$BUILD/etc/uniqush/"
 ARCH="`uname -m`"
 
 cp "$TEMP/bin/uniqush-push" "$BUILD/usr/bin"
+cp "$TEMP/bin/uniqushctl" "$BUILD/usr/bin"
 cp "$TEMP/src/github.com/uniqush/uniqush-push/conf/uniqush-push.conf" "$BUILD/etc/uniqush"
 cp "$TEMP/src/github.com/uniqush/uniqush-push/LICENSE" "$LICENSE"
 
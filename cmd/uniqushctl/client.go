@@ -0,0 +1,138 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// statusFailure is the status of failed requests in the simple responses of uniqush-push (e.g. of /addpsp and /subscribe).
+const statusFailure = 1
+
+// client sends requests to the API and the admin listener of uniqush-push.
+type client struct {
+	// addr and apiKey are the URL of the API (e.g. http://localhost:9898) and the API key sent with each request to it, if any.
+	addr   string
+	apiKey string
+	// adminAddr and adminToken are the URL of the admin listener (e.g. http://localhost:9899) and its token (or a session token).
+	adminAddr  string
+	adminToken string
+	http       *http.Client
+}
+
+// do sends a request with params (in the query string of GET requests, and in the form of other requests) and returns the response.
+func (c *client) do(method, base, token, path string, params url.Values) (*http.Response, error) {
+	u := strings.TrimRight(base, "/") + path
+	var body io.Reader
+	if method == "GET" {
+		if len(params) > 0 {
+			u += "?" + params.Encode()
+		}
+	} else {
+		body = strings.NewReader(params.Encode())
+	}
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return resp, nil
+}
+
+// api sends a request to the API and returns the JSON response, or an error if the response reports a failure.
+func (c *client) api(method, path string, params url.Values) (json.RawMessage, error) {
+	resp, err := c.do(method, c.addr, c.apiKey, path, params)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return body, checkResponse(path, body)
+}
+
+// apiInto sends a request to the API and decodes the JSON response into v.
+func (c *client) apiInto(method, path string, params url.Values, v interface{}) error {
+	body, err := c.api(method, path, params)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, v)
+}
+
+// admin sends a request to the admin listener and returns the response, which the caller must close.
+func (c *client) admin(method, path string, params url.Values) (*http.Response, error) {
+	return c.do(method, c.adminAddr, c.adminToken, path, params)
+}
+
+// checkResponse returns an error if a response of uniqush-push reports a failure:
+// the status of simple responses, the failures of /push, or the code of queries.
+func checkResponse(path string, body []byte) error {
+	var r struct {
+		Status       *int    `json:"status"`
+		FailureCount int     `json:"failureCount"`
+		Code         string  `json:"code"`
+		ErrorMsg     *string `json:"errorMsg"`
+		Details      struct {
+			Code     string  `json:"code"`
+			ErrorMsg *string `json:"errorMsg"`
+		} `json:"details"`
+	}
+	if err := json.Unmarshal(body, &r); err != nil {
+		// Some queries (e.g. /subscriptions) respond with a list.
+		return nil
+	}
+	switch {
+	case r.Status != nil && *r.Status == statusFailure:
+		return responseError(path, r.Details.Code, r.Details.ErrorMsg)
+	case r.FailureCount > 0:
+		return fmt.Errorf("%s: %d pushes failed", path, r.FailureCount)
+	case r.Code != "" && r.Code != "UNIQUSH_SUCCESS":
+		return responseError(path, r.Code, r.ErrorMsg)
+	}
+	return nil
+}
+
+func responseError(path, code string, msg *string) error {
+	if msg != nil {
+		return fmt.Errorf("%s: %s: %s", path, code, *msg)
+	}
+	return fmt.Errorf("%s: %s", path, code)
+}
@@ -0,0 +1,194 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+)
+
+// exportVersion is the version of the format of exports, for importing exports of later versions of uniqushctl.
+const exportVersion = 1
+
+// export is the JSON document written by uniqushctl export and read by uniqushctl import.
+type export struct {
+	Version  int                       `json:"version"`
+	Services map[string]*serviceExport `json:"services"`
+}
+
+// serviceExport is the data of a service in an export.
+type serviceExport struct {
+	// PushServiceProviders are the fields of each push service provider, as returned by /psps (including their credentials).
+	PushServiceProviders []map[string]string `json:"pushServiceProviders"`
+	// Subscriptions are the fields of the delivery points of each subscriber, as returned by /subscriptions.
+	Subscriptions map[string][]map[string]string `json:"subscriptions"`
+}
+
+// subscriptionExcludedFields are the fields of /subscriptions which /subscribe doesn't accept.
+var subscriptionExcludedFields = []string{"delivery_point_id", "service"}
+
+func runExport(c *client, args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	services := fs.String("services", "", "comma separated services to export (every service by default)")
+	output := fs.String("o", "", "file to write the export to (stdout by default)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	e, err := exportServices(c, *services)
+	if err != nil {
+		return err
+	}
+	if *output != "" {
+		f, err := os.OpenFile(*output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(e)
+}
+
+// exportServices exports the push service providers and the subscriptions of services (a comma separated list, or every service if it is empty).
+func exportServices(c *client, services string) (*export, error) {
+	var psps pspsResponse
+	if err := c.apiInto("GET", "/psps", nil, &psps); err != nil {
+		return nil, err
+	}
+	e := &export{Version: exportVersion, Services: make(map[string]*serviceExport)}
+	var names []string
+	if services != "" {
+		names = strings.Split(services, ",")
+	} else {
+		for name := range psps.Services {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+	for _, name := range names {
+		s := &serviceExport{PushServiceProviders: psps.Services[name], Subscriptions: make(map[string][]map[string]string)}
+		var subscribers struct {
+			Subscribers []struct {
+				Subscriber string `json:"subscriber"`
+			} `json:"subscribers"`
+		}
+		if err := c.apiInto("GET", "/subscribers", url.Values{"service": {name}}, &subscribers); err != nil {
+			return nil, err
+		}
+		for _, sub := range subscribers.Subscribers {
+			// Subscribers are listed with a redis SCAN, so they may be listed more than once.
+			if _, ok := s.Subscriptions[sub.Subscriber]; ok {
+				continue
+			}
+			var subscriptions []map[string]string
+			if err := c.apiInto("GET", "/subscriptions", url.Values{"subscriber": {sub.Subscriber}, "services": {name}}, &subscriptions); err != nil {
+				return nil, err
+			}
+			for _, subscription := range subscriptions {
+				for _, field := range subscriptionExcludedFields {
+					delete(subscription, field)
+				}
+			}
+			s.Subscriptions[sub.Subscriber] = subscriptions
+		}
+		e.Services[name] = s
+	}
+	return e, nil
+}
+
+func runImport(c *client, args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	input := fs.String("i", "", "file to read the export from (stdin by default)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	var r io.Reader = os.Stdin
+	if *input != "" {
+		f, err := os.Open(*input)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	var e export
+	if err := json.NewDecoder(r).Decode(&e); err != nil {
+		return err
+	}
+	if e.Version > exportVersion {
+		return fmt.Errorf("the export is of version %d, which this uniqushctl doesn't support", e.Version)
+	}
+	psps, subscriptions, err := importServices(c, &e)
+	fmt.Fprintf(w, "Imported %d push service providers and %d subscriptions\n", psps, subscriptions)
+	return err
+}
+
+// importServices adds the push service providers and then the subscriptions of an export, and returns how many were added.
+// The credentials of push service providers aren't validated again, since they were already validated when they were exported.
+func importServices(c *client, e *export) (psps int, subscriptions int, err error) {
+	var names []string
+	for name := range e.Services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		s := e.Services[name]
+		for _, psp := range s.PushServiceProviders {
+			params := fieldsToParams(psp)
+			params.Set("service", name)
+			params.Set("validate", "0")
+			if _, err := c.api("POST", "/addpsp", params); err != nil {
+				return psps, subscriptions, err
+			}
+			psps++
+		}
+		var subscribers []string
+		for subscriber := range s.Subscriptions {
+			subscribers = append(subscribers, subscriber)
+		}
+		sort.Strings(subscribers)
+		for _, subscriber := range subscribers {
+			for _, subscription := range s.Subscriptions[subscriber] {
+				params := fieldsToParams(subscription)
+				params.Set("service", name)
+				params.Set("subscriber", subscriber)
+				if _, err := c.api("POST", "/subscribe", params); err != nil {
+					return psps, subscriptions, err
+				}
+				subscriptions++
+			}
+		}
+	}
+	return psps, subscriptions, nil
+}
+
+func fieldsToParams(fields map[string]string) url.Values {
+	params := make(url.Values, len(fields))
+	for key, value := range fields {
+		params.Set(key, value)
+	}
+	return params
+}
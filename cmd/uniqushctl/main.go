@@ -0,0 +1,353 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// uniqushctl manages a uniqush-push instance through its API and admin listener:
+// it lists services, adds and removes push service providers, inspects subscribers, sends test pushes,
+// exports and imports services with their subscriptions, migrates the device tokens exported from
+// OneSignal, Firebase and Amazon SNS, and tails the delivery events.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// command is a subcommand of uniqushctl.
+type command struct {
+	usage string
+	run   func(c *client, args []string, w io.Writer) error
+}
+
+var commands = map[string]command{
+	"services":      {"services [-json]: list the services and their push service providers", runServices},
+	"addpsp":        {"addpsp -service <service> -type <pushservicetype> [-validate=false] <key>=<value>...: add a push service provider", runAddPSP},
+	"rmpsp":         {"rmpsp -service <service> -type <pushservicetype> <key>=<value>...: remove the push service provider with these fields", runRemovePSP},
+	"subscribers":   {"subscribers -service <service> [-match <pattern>] [-dps]: list the subscribers of a service", runSubscribers},
+	"subscriptions": {"subscriptions -subscriber <subscriber> [-services <service,...>]: show the subscriptions of a subscriber", runSubscriptions},
+	"deliveries":    {"deliveries -service <service> -subscriber <subscriber>: show the recent deliveries to a subscriber", runDeliveries},
+	"push":          {"push -service <service> -subscriber <subscriber> <key>=<value>...: send a test push (e.g. msg=hello)", runPush},
+	"testpush":      {"testpush -service <service> [-subscriber <subscriber>] [-delivery-point <id,...>] [<key>=<value>...]: send a push to one delivery point (the canary subscriber by default) and show the response of the push service", runTestPush},
+	"export":        {"export [-services <service,...>] [-o <file>]: export push service providers and subscriptions as JSON", runExport},
+	"import":        {"import [-i <file>]: add the push service providers and subscriptions of an export", runImport},
+	"migrate":       {"migrate -from <onesignal|firebase|sns> [-service <service>] [-i <file>] [-dry-run]: add the subscriptions of device tokens exported from another push service", runMigrate},
+	"tail":          {"tail [-service <service>] [-type <event type>]: stream the delivery and engagement events (admin listener)", runTail},
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: uniqushctl [flags] <command> [command flags]\n\nFlags:\n")
+	flag.PrintDefaults()
+	fmt.Fprintf(os.Stderr, "\nCommands:\n")
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %s\n", commands[name].usage)
+	}
+}
+
+// envOr returns the value of the environment variable name, or def if it isn't set.
+func envOr(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+func main() {
+	addr := flag.String("addr", envOr("UNIQUSH_ADDR", "http://localhost:9898"), "URL of the API of uniqush-push ($UNIQUSH_ADDR)")
+	apiKey := flag.String("api-key", os.Getenv("UNIQUSH_API_KEY"), "API key sent to the API, if [APIKeys] is enabled ($UNIQUSH_API_KEY)")
+	adminAddr := flag.String("admin-addr", envOr("UNIQUSH_ADMIN_ADDR", "http://localhost:9899"), "URL of the [Admin] listener ($UNIQUSH_ADMIN_ADDR)")
+	adminToken := flag.String("admin-token", os.Getenv("UNIQUSH_ADMIN_TOKEN"), "token (or session token) of the [Admin] listener ($UNIQUSH_ADMIN_TOKEN)")
+	timeout := flag.Duration("timeout", time.Minute, "timeout of each request, except tail")
+	flag.Usage = usage
+	flag.Parse()
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+	c := &client{addr: *addr, apiKey: *apiKey, adminAddr: *adminAddr, adminToken: *adminToken, http: &http.Client{Timeout: *timeout}}
+	if flag.Arg(0) == "tail" {
+		c.http = &http.Client{}
+	}
+	if err := cmd.run(c, flag.Args()[1:], os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "uniqushctl %s: %v\n", flag.Arg(0), err)
+		os.Exit(1)
+	}
+}
+
+// parseFields parses the <key>=<value> arguments of a command into params.
+func parseFields(args []string, params url.Values) error {
+	for _, arg := range args {
+		i := strings.IndexByte(arg, '=')
+		if i <= 0 {
+			return fmt.Errorf("invalid field %q: must be <key>=<value>", arg)
+		}
+		params.Set(arg[:i], arg[i+1:])
+	}
+	return nil
+}
+
+// required returns an error naming the first empty flag.
+func required(flags map[string]string) error {
+	var names []string
+	for name := range flags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if flags[name] == "" {
+			return fmt.Errorf("-%s is required", name)
+		}
+	}
+	return nil
+}
+
+// writeJSON writes a JSON response indented, if there is one.
+func writeJSON(w io.Writer, body []byte) {
+	if len(body) == 0 {
+		return
+	}
+	var buf bytes.Buffer
+	if json.Indent(&buf, body, "", "  ") != nil {
+		w.Write(body)
+		fmt.Fprintln(w)
+		return
+	}
+	buf.WriteByte('\n')
+	buf.WriteTo(w)
+}
+
+// pspsResponse is the response of /psps.
+type pspsResponse struct {
+	Services map[string][]map[string]string `json:"services"`
+}
+
+func runServices(c *client, args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("services", flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "print the push service providers of each service as JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	body, err := c.api("GET", "/psps", nil)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		writeJSON(w, body)
+		return nil
+	}
+	var r pspsResponse
+	if err := json.Unmarshal(body, &r); err != nil {
+		return err
+	}
+	var services []string
+	for service := range r.Services {
+		services = append(services, service)
+	}
+	sort.Strings(services)
+	for _, service := range services {
+		var types []string
+		for _, psp := range r.Services[service] {
+			types = append(types, psp["pushservicetype"])
+		}
+		fmt.Fprintf(w, "%s\t%s\n", service, strings.Join(types, ","))
+	}
+	return nil
+}
+
+func runAddPSP(c *client, args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("addpsp", flag.ContinueOnError)
+	service := fs.String("service", "", "service")
+	pushServiceType := fs.String("type", "", "push service type (e.g. apns, fcm, adm)")
+	validate := fs.Bool("validate", true, "validate the credentials with the push service before adding them")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := required(map[string]string{"service": *service, "type": *pushServiceType}); err != nil {
+		return err
+	}
+	params := url.Values{"service": {*service}, "pushservicetype": {*pushServiceType}}
+	if !*validate {
+		params.Set("validate", "0")
+	}
+	if err := parseFields(fs.Args(), params); err != nil {
+		return err
+	}
+	body, err := c.api("POST", "/addpsp", params)
+	writeJSON(w, body)
+	return err
+}
+
+func runRemovePSP(c *client, args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("rmpsp", flag.ContinueOnError)
+	service := fs.String("service", "", "service")
+	pushServiceType := fs.String("type", "", "push service type (e.g. apns, fcm, adm)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := required(map[string]string{"service": *service, "type": *pushServiceType}); err != nil {
+		return err
+	}
+	params := url.Values{"service": {*service}, "pushservicetype": {*pushServiceType}}
+	if err := parseFields(fs.Args(), params); err != nil {
+		return err
+	}
+	body, err := c.api("POST", "/rmpsp", params)
+	writeJSON(w, body)
+	return err
+}
+
+func runSubscribers(c *client, args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("subscribers", flag.ContinueOnError)
+	service := fs.String("service", "", "service")
+	match := fs.String("match", "", "only list the subscribers matching this pattern (e.g. user*)")
+	dps := fs.Bool("dps", false, "include the names of the delivery points of each subscriber")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := required(map[string]string{"service": *service}); err != nil {
+		return err
+	}
+	params := url.Values{"service": {*service}}
+	if *match != "" {
+		params.Set("subscriber", *match)
+	}
+	if *dps {
+		params.Set("include_delivery_points", "1")
+	}
+	body, err := c.api("GET", "/subscribers", params)
+	writeJSON(w, body)
+	return err
+}
+
+func runSubscriptions(c *client, args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("subscriptions", flag.ContinueOnError)
+	subscriber := fs.String("subscriber", "", "subscriber")
+	services := fs.String("services", "", "comma separated services (every service by default)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := required(map[string]string{"subscriber": *subscriber}); err != nil {
+		return err
+	}
+	params := url.Values{"subscriber": {*subscriber}, "include_delivery_point_ids": {"1"}}
+	if *services != "" {
+		params.Set("services", *services)
+	}
+	body, err := c.api("GET", "/subscriptions", params)
+	writeJSON(w, body)
+	return err
+}
+
+func runDeliveries(c *client, args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("deliveries", flag.ContinueOnError)
+	service := fs.String("service", "", "service")
+	subscriber := fs.String("subscriber", "", "subscriber")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := required(map[string]string{"service": *service, "subscriber": *subscriber}); err != nil {
+		return err
+	}
+	body, err := c.api("GET", "/deliveries", url.Values{"service": {*service}, "subscriber": {*subscriber}})
+	writeJSON(w, body)
+	return err
+}
+
+func runPush(c *client, args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("push", flag.ContinueOnError)
+	service := fs.String("service", "", "service")
+	subscriber := fs.String("subscriber", "", "comma separated subscribers")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := required(map[string]string{"service": *service, "subscriber": *subscriber}); err != nil {
+		return err
+	}
+	params := url.Values{"service": {*service}, "subscriber": {*subscriber}}
+	if err := parseFields(fs.Args(), params); err != nil {
+		return err
+	}
+	body, err := c.api("POST", "/push", params)
+	writeJSON(w, body)
+	return err
+}
+
+func runTestPush(c *client, args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("testpush", flag.ContinueOnError)
+	service := fs.String("service", "", "service")
+	subscriber := fs.String("subscriber", "", "subscriber (defaults to the [Canary] subscriber)")
+	deliveryPoint := fs.String("delivery-point", "", "comma separated delivery point ids (defaults to all the delivery points of the subscriber)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := required(map[string]string{"service": *service}); err != nil {
+		return err
+	}
+	params := url.Values{"service": {*service}}
+	if *subscriber != "" {
+		params.Set("subscriber", *subscriber)
+	}
+	if *deliveryPoint != "" {
+		params.Set("delivery_point_id", *deliveryPoint)
+	}
+	if err := parseFields(fs.Args(), params); err != nil {
+		return err
+	}
+	body, err := c.api("POST", "/testpush", params)
+	writeJSON(w, body)
+	return err
+}
+
+func runTail(c *client, args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("tail", flag.ContinueOnError)
+	service := fs.String("service", "", "only stream the events of this service")
+	eventType := fs.String("type", "", "only stream the events of this type (e.g. delivery, opened or clicked)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	params := url.Values{}
+	if *service != "" {
+		params.Set("service", *service)
+	}
+	if *eventType != "" {
+		params.Set("type", *eventType)
+	}
+	resp, err := c.admin("GET", "/events", params)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		fmt.Fprintln(w, scanner.Text())
+	}
+	return scanner.Err()
+}
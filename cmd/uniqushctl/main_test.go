@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/uniqush/uniqush-push/testutil"
+)
+
+// fakeUniqush serves the endpoints of the API used by uniqushctl, and records the forms of the requests adding data.
+type fakeUniqush struct {
+	mutex sync.Mutex
+	added []string
+}
+
+func (f *fakeUniqush) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	switch r.URL.Path {
+	case "/psps":
+		w.Write([]byte(`{"services":{"app":[{"service":"app","pushservicetype":"fcm","apikey":"k"}]},"code":"UNIQUSH_SUCCESS"}`))
+	case "/subscribers":
+		w.Write([]byte(`{"subscribers":[{"subscriber":"u1"},{"subscriber":"u2"},{"subscriber":"u1"}],"code":"UNIQUSH_SUCCESS"}`))
+	case "/subscriptions":
+		w.Write([]byte(`[{"service":"app","pushservicetype":"fcm","regid":"reg-` + r.Form.Get("subscriber") + `","delivery_point_id":"fcm:1"}]`))
+	case "/addpsp", "/subscribe":
+		if r.Method != "POST" {
+			http.Error(w, "POST only", http.StatusMethodNotAllowed)
+			return
+		}
+		f.mutex.Lock()
+		f.added = append(f.added, r.URL.Path+"?"+r.Form.Encode())
+		f.mutex.Unlock()
+		w.Write([]byte(`{"type":"Subscribe","status":0,"details":{"code":"UNIQUSH_SUCCESS"}}`))
+	case "/push":
+		w.Write([]byte(`{"type":"Push","successCount":0,"failureCount":1}`))
+	case "/testpush":
+		if r.Form.Get("delivery_point_id") != "fcm:1" {
+			w.Write([]byte(`{"service":"app","results":[],"code":"UNIQUSH_ERROR_CANNOT_GET_DELIVERY_POINT","errorMsg":"no delivery point"}`))
+			return
+		}
+		w.Write([]byte(`{"service":"app","results":[{"code":"UNIQUSH_SUCCESS","pushServiceProvider":"fcm:k","deliveryPoint":"fcm:1","messageId":"fcm:1:m"}],"code":"UNIQUSH_SUCCESS"}`))
+	case "/rmpsp":
+		w.Write([]byte(`{"type":"RemovePushServiceProvider","status":1,"details":{"code":"UNIQUSH_ERROR_CANNOT_GET_PUSH_SERVICE_PROVIDER","errorMsg":"not found"}}`))
+	case "/events":
+		if r.Header.Get("Authorization") != "Bearer admin" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"type":"delivery","service":"` + r.Form.Get("service") + `"}` + "\n"))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func newTestClient(server *httptest.Server) *client {
+	return &client{addr: server.URL, adminAddr: server.URL, adminToken: "admin", http: server.Client()}
+}
+
+func TestExportImport(t *testing.T) {
+	source := httptest.NewServer(&fakeUniqush{})
+	defer source.Close()
+	e, err := exportServices(newTestClient(source), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectEquals(t, []map[string]string{{"pushservicetype": "fcm", "regid": "reg-u1"}}, e.Services["app"].Subscriptions["u1"], "expected the subscriptions without the fields /subscribe doesn't accept")
+	testutil.ExpectEquals(t, 2, len(e.Services["app"].Subscriptions), "expected each subscriber once")
+
+	target := &fakeUniqush{}
+	server := httptest.NewServer(target)
+	defer server.Close()
+	psps, subscriptions, err := importServices(newTestClient(server), e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectEquals(t, 1, psps, "unexpected number of imported push service providers")
+	testutil.ExpectEquals(t, 2, subscriptions, "unexpected number of imported subscriptions")
+	testutil.ExpectEquals(t, []string{
+		"/addpsp?" + url.Values{"service": {"app"}, "pushservicetype": {"fcm"}, "apikey": {"k"}, "validate": {"0"}}.Encode(),
+		"/subscribe?" + url.Values{"service": {"app"}, "subscriber": {"u1"}, "pushservicetype": {"fcm"}, "regid": {"reg-u1"}}.Encode(),
+		"/subscribe?" + url.Values{"service": {"app"}, "subscriber": {"u2"}, "pushservicetype": {"fcm"}, "regid": {"reg-u2"}}.Encode(),
+	}, target.added, "unexpected requests")
+}
+
+func TestCommandsReportFailures(t *testing.T) {
+	server := httptest.NewServer(&fakeUniqush{})
+	defer server.Close()
+	c := newTestClient(server)
+	var out bytes.Buffer
+	if err := runPush(c, []string{"-service", "app", "-subscriber", "u1", "msg=hello"}, &out); err == nil {
+		t.Error("expected failed pushes to be reported")
+	}
+	testutil.ExpectEquals(t, true, strings.Contains(out.String(), `"failureCount": 1`), "expected the response to be printed")
+	err := runRemovePSP(c, []string{"-service", "app", "-type", "fcm", "apikey=k"}, &out)
+	if err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("expected the error of the response, got %v", err)
+	}
+	if err := runPush(c, []string{"-service", "app"}, &out); err == nil || err.Error() != "-subscriber is required" {
+		t.Errorf("expected the missing flag to be reported, got %v", err)
+	}
+}
+
+func TestTestPush(t *testing.T) {
+	server := httptest.NewServer(&fakeUniqush{})
+	defer server.Close()
+	c := newTestClient(server)
+	var out bytes.Buffer
+	if err := runTestPush(c, []string{"-service", "app", "-delivery-point", "fcm:1"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectEquals(t, true, strings.Contains(out.String(), `"messageId": "fcm:1:m"`), "expected the response of the push service to be printed")
+	err := runTestPush(c, []string{"-service", "app", "-delivery-point", "fcm:2"}, &out)
+	if err == nil || !strings.Contains(err.Error(), "no delivery point") {
+		t.Errorf("expected the error of the test push, got %v", err)
+	}
+}
+
+func TestServicesAndTail(t *testing.T) {
+	server := httptest.NewServer(&fakeUniqush{})
+	defer server.Close()
+	c := newTestClient(server)
+	var out bytes.Buffer
+	if err := runServices(c, nil, &out); err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectStringEquals(t, "app\tfcm\n", out.String(), "unexpected services")
+
+	out.Reset()
+	if err := runTail(c, []string{"-service", "app"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	var event map[string]string
+	if err := json.Unmarshal(out.Bytes(), &event); err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectStringEquals(t, "app", event["service"], "expected the events of the service")
+	c.adminToken = "wrong"
+	if err := runTail(c, nil, &out); err == nil {
+		t.Error("expected the admin listener to reject the token")
+	}
+}
@@ -0,0 +1,337 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// maxMigrationErrors is the number of failed subscriptions of a migration which are printed. The others are only counted.
+const maxMigrationErrors = 20
+
+// migration is a subscription read from the export of another push service, to add with /subscribe.
+type migration struct {
+	service    string
+	subscriber string
+	// params are the fields of the delivery point: pushservicetype, and devtoken or regid.
+	params url.Values
+}
+
+// migrationSource maps a record of an export (with lower case field names) to a subscription of service.
+// It returns an error for records which can't be migrated, e.g. of unsupported platforms.
+type migrationSource func(record map[string]string, service string) (*migration, error)
+
+var migrationSources = map[string]migrationSource{
+	"onesignal": migrateOneSignal,
+	"firebase":  migrateFirebase,
+	"sns":       migrateSNS,
+}
+
+// deliveryPointParams returns the fields of a delivery point of the push service type with the given token.
+func deliveryPointParams(pushServiceType, token string) url.Values {
+	field := "regid"
+	if pushServiceType == "apns" {
+		field = "devtoken"
+	}
+	return url.Values{"pushservicetype": {pushServiceType}, field: {token}}
+}
+
+// firstField returns the first non-empty field of record named by names.
+func firstField(record map[string]string, names ...string) string {
+	for _, name := range names {
+		if v := record[name]; v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// migrateOneSignal maps a player of a OneSignal export (the CSV export of users, or the players of the API) to a subscription.
+// The subscriber is the external user id of the player, or its player id.
+func migrateOneSignal(record map[string]string, service string) (*migration, error) {
+	token := record["identifier"]
+	if token == "" {
+		return nil, errors.New("no identifier")
+	}
+	switch strings.ToLower(record["invalid_identifier"]) {
+	case "true", "t", "1":
+		return nil, errors.New("invalid identifier")
+	}
+	var pushServiceType string
+	switch record["device_type"] {
+	case "0":
+		pushServiceType = "apns"
+	case "1":
+		pushServiceType = "fcm"
+	case "2":
+		pushServiceType = "adm"
+	default:
+		return nil, fmt.Errorf("unsupported device_type %q", record["device_type"])
+	}
+	subscriber := firstField(record, "external_user_id", "id")
+	if subscriber == "" {
+		return nil, errors.New("no external_user_id or id")
+	}
+	return &migration{service: service, subscriber: subscriber, params: deliveryPointParams(pushServiceType, token)}, nil
+}
+
+// migrateFirebase maps a registration token of Firebase Cloud Messaging, as exported by an app (e.g. from Firestore), to a subscription.
+// The token is read from token, fcm_token, fcmtoken or registration_token, and the subscriber from uid, user_id, userid or external_user_id.
+func migrateFirebase(record map[string]string, service string) (*migration, error) {
+	token := firstField(record, "token", "fcm_token", "fcmtoken", "registration_token", "registrationtoken")
+	if token == "" {
+		return nil, errors.New("no token")
+	}
+	subscriber := firstField(record, "uid", "user_id", "userid", "external_user_id")
+	if subscriber == "" {
+		return nil, errors.New("no uid or user_id")
+	}
+	return &migration{service: service, subscriber: subscriber, params: deliveryPointParams("fcm", token)}, nil
+}
+
+// migrateSNS maps a platform endpoint of Amazon SNS (from aws sns list-endpoints-by-platform-application) to a subscription.
+// The push service type is the platform of its ARN, the subscriber is its CustomUserData or endpoint id, and the service is the
+// name of its platform application unless service is set. Disabled endpoints aren't migrated.
+func migrateSNS(record map[string]string, service string) (*migration, error) {
+	arn := record["endpointarn"]
+	// e.g. arn:aws:sns:us-east-1:123456789012:endpoint/APNS/myapp/5e3e9847-3183-3f18-a7e8-671c3a57d4b3
+	i := strings.Index(arn, ":endpoint/")
+	if i < 0 {
+		return nil, fmt.Errorf("invalid EndpointArn %q", arn)
+	}
+	parts := strings.Split(arn[i+1:], "/")
+	if len(parts) != 4 {
+		return nil, fmt.Errorf("invalid EndpointArn %q", arn)
+	}
+	if strings.ToLower(record["enabled"]) == "false" {
+		return nil, errors.New("disabled endpoint")
+	}
+	token := record["token"]
+	if token == "" {
+		return nil, errors.New("no Token")
+	}
+	var pushServiceType string
+	switch parts[1] {
+	case "APNS", "APNS_SANDBOX":
+		pushServiceType = "apns"
+	case "GCM":
+		pushServiceType = "fcm"
+	case "ADM":
+		pushServiceType = "adm"
+	default:
+		return nil, fmt.Errorf("unsupported platform %q", parts[1])
+	}
+	if service == "" {
+		service = parts[2]
+	}
+	subscriber := firstField(record, "customuserdata")
+	if subscriber == "" {
+		subscriber = parts[3]
+	}
+	return &migration{service: service, subscriber: subscriber, params: deliveryPointParams(pushServiceType, token)}, nil
+}
+
+// readExportRecords reads the records of an export, as CSV with a header, or as JSON: a list of objects, or an object with a list of them
+// (e.g. the players of OneSignal or the Endpoints of SNS). Field names are lower cased, and the Attributes of SNS endpoints are flattened.
+func readExportRecords(r io.Reader) ([]map[string]string, error) {
+	br := bufio.NewReader(r)
+	// Skip the byte order mark which spreadsheets put in CSV files, and leading white space.
+	if b, _ := br.Peek(3); bytes.Equal(b, []byte("\xef\xbb\xbf")) {
+		br.Discard(3)
+	}
+	for {
+		b, err := br.Peek(1)
+		if err == io.EOF {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if b[0] != ' ' && b[0] != '\t' && b[0] != '\r' && b[0] != '\n' {
+			break
+		}
+		br.Discard(1)
+	}
+	if b, _ := br.Peek(1); b[0] == '[' || b[0] == '{' {
+		return readJSONExportRecords(br)
+	}
+	return readCSVExportRecords(br)
+}
+
+func readCSVExportRecords(r io.Reader) ([]map[string]string, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err != nil {
+		return nil, err
+	}
+	for i := range header {
+		header[i] = strings.ToLower(strings.TrimSpace(header[i]))
+	}
+	var records []map[string]string
+	for {
+		row, err := cr.Read()
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		record := make(map[string]string, len(header))
+		for i, value := range row {
+			if i < len(header) {
+				record[header[i]] = value
+			}
+		}
+		records = append(records, record)
+	}
+}
+
+func readJSONExportRecords(r io.Reader) ([]map[string]string, error) {
+	decoder := json.NewDecoder(r)
+	decoder.UseNumber()
+	var doc interface{}
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, err
+	}
+	list, ok := doc.([]interface{})
+	if obj, isObject := doc.(map[string]interface{}); isObject {
+		for _, v := range obj {
+			if l, isList := v.([]interface{}); isList {
+				list, ok = l, true
+				break
+			}
+		}
+	}
+	if !ok {
+		return nil, errors.New("the JSON export must be a list of records, or an object with a list of records")
+	}
+	records := make([]map[string]string, 0, len(list))
+	for _, item := range list {
+		obj, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("each record of the JSON export must be an object")
+		}
+		record := make(map[string]string, len(obj))
+		flattenExportRecord(obj, record)
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+func flattenExportRecord(obj map[string]interface{}, record map[string]string) {
+	for key, value := range obj {
+		key = strings.ToLower(key)
+		switch v := value.(type) {
+		case nil:
+		case string:
+			record[key] = v
+		case map[string]interface{}:
+			flattenExportRecord(v, record)
+		default:
+			b, _ := json.Marshal(v)
+			record[key] = string(bytes.Trim(b, `"`))
+		}
+	}
+}
+
+func runMigrate(c *client, args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	from := fs.String("from", "", "push service the export comes from: onesignal, firebase or sns")
+	service := fs.String("service", "", "service to add the subscriptions to (for sns, the name of the platform application by default)")
+	input := fs.String("i", "", "file to read the export from, as CSV or JSON (stdin by default)")
+	dryRun := fs.Bool("dry-run", false, "print the subscriptions instead of adding them")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	source, ok := migrationSources[*from]
+	if !ok {
+		return fmt.Errorf("-from must be onesignal, firebase or sns")
+	}
+	if *service == "" && *from != "sns" {
+		return fmt.Errorf("-service is required")
+	}
+	var r io.Reader = os.Stdin
+	if *input != "" {
+		f, err := os.Open(*input)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	records, err := readExportRecords(r)
+	if err != nil {
+		return fmt.Errorf("cannot read the export: %v", err)
+	}
+	added, skipped, failed := migrateSubscriptions(c, records, source, *service, *dryRun, w)
+	verb := "Added"
+	if *dryRun {
+		verb = "Would add"
+	}
+	fmt.Fprintf(w, "%s %d subscriptions (%d records skipped, %d failed)\n", verb, added, skipped, failed)
+	if failed > 0 {
+		return fmt.Errorf("%d subscriptions couldn't be added", failed)
+	}
+	return nil
+}
+
+// migrateSubscriptions adds the subscriptions of the records of an export, going on after failures, and returns how many were added,
+// how many records couldn't be mapped to subscriptions, and how many subscriptions failed. The first failures are written to w.
+func migrateSubscriptions(c *client, records []map[string]string, source migrationSource, service string, dryRun bool, w io.Writer) (added, skipped, failed int) {
+	reported := 0
+	report := func(format string, args ...interface{}) {
+		if reported < maxMigrationErrors {
+			fmt.Fprintf(w, format+"\n", args...)
+		}
+		reported++
+	}
+	for i, record := range records {
+		m, err := source(record, service)
+		if err != nil {
+			report("Record %d: skipped: %v", i+1, err)
+			skipped++
+			continue
+		}
+		params := url.Values{"service": {m.service}, "subscriber": {m.subscriber}}
+		for key, values := range m.params {
+			params[key] = values
+		}
+		if dryRun {
+			fmt.Fprintf(w, "%s\n", params.Encode())
+			added++
+			continue
+		}
+		if _, err := c.api("POST", "/subscribe", params); err != nil {
+			report("Record %d: service %s, subscriber %s: %v", i+1, m.service, m.subscriber, err)
+			failed++
+			continue
+		}
+		added++
+	}
+	return added, skipped, failed
+}
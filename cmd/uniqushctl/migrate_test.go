@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/uniqush/uniqush-push/testutil"
+)
+
+func runMigrateFile(t *testing.T, export string, args ...string) (*fakeUniqush, string, error) {
+	dir, err := ioutil.TempDir("", "uniqushctl-migrate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "export")
+	if err := ioutil.WriteFile(path, []byte(export), 0600); err != nil {
+		t.Fatal(err)
+	}
+	target := &fakeUniqush{}
+	server := httptest.NewServer(target)
+	defer server.Close()
+	var out bytes.Buffer
+	err = runMigrate(newTestClient(server), append(args, "-i", path), &out)
+	return target, out.String(), err
+}
+
+func TestMigrateOneSignalCSV(t *testing.T) {
+	export := "\xef\xbb\xbfid,identifier,device_type,external_user_id,invalid_identifier\n" +
+		"p1,apnstoken,0,alice,false\n" +
+		"p2,fcmtoken,1,,false\n" +
+		"p3,webtoken,5,carol,false\n" +
+		"p4,oldtoken,1,dave,true\n"
+	target, out, err := runMigrateFile(t, export, "-from", "onesignal", "-service", "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectEquals(t, []string{
+		"/subscribe?devtoken=apnstoken&pushservicetype=apns&service=app&subscriber=alice",
+		"/subscribe?pushservicetype=fcm&regid=fcmtoken&service=app&subscriber=p2",
+	}, target.added, "unexpected subscriptions")
+	testutil.ExpectEquals(t, true, strings.Contains(out, `Record 3: skipped: unsupported device_type "5"`), "expected the unsupported device to be reported")
+	testutil.ExpectEquals(t, true, strings.Contains(out, "Added 2 subscriptions (2 records skipped, 0 failed)"), "unexpected summary")
+}
+
+func TestMigrateFirebaseJSON(t *testing.T) {
+	export := `{"tokens": [{"uid": "alice", "fcmToken": "t1"}, {"user_id": "bob", "token": "t2"}, {"uid": "carol"}]}`
+	target, out, err := runMigrateFile(t, export, "-from", "firebase", "-service", "app", "-dry-run")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectEquals(t, 0, len(target.added), "expected no subscription to be added by a dry run")
+	testutil.ExpectEquals(t, true, strings.Contains(out, "pushservicetype=fcm&regid=t2&service=app&subscriber=bob\n"), "expected the subscriptions to be printed")
+	testutil.ExpectEquals(t, true, strings.Contains(out, "Would add 2 subscriptions (1 records skipped, 0 failed)"), "unexpected summary")
+}
+
+func TestMigrateSNSJSON(t *testing.T) {
+	export := `{"Endpoints": [
+		{"EndpointArn": "arn:aws:sns:us-east-1:123456789012:endpoint/APNS/myapp/e1", "Attributes": {"Enabled": "true", "Token": "apnstoken", "CustomUserData": "alice"}},
+		{"EndpointArn": "arn:aws:sns:us-east-1:123456789012:endpoint/GCM/myapp/e2", "Attributes": {"Enabled": "true", "Token": "gcmtoken"}},
+		{"EndpointArn": "arn:aws:sns:us-east-1:123456789012:endpoint/GCM/myapp/e3", "Attributes": {"Enabled": "false", "Token": "stale"}},
+		{"EndpointArn": "arn:aws:sns:us-east-1:123456789012:endpoint/MPNS/myapp/e4", "Attributes": {"Enabled": "true", "Token": "mpns"}}
+	]}`
+	target, _, err := runMigrateFile(t, export, "-from", "sns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectEquals(t, []string{
+		"/subscribe?devtoken=apnstoken&pushservicetype=apns&service=myapp&subscriber=alice",
+		"/subscribe?pushservicetype=fcm&regid=gcmtoken&service=myapp&subscriber=e2",
+	}, target.added, "unexpected subscriptions")
+}
+
+func TestMigrateFlags(t *testing.T) {
+	if _, _, err := runMigrateFile(t, "", "-from", "pushwoosh", "-service", "app"); err == nil || !strings.Contains(err.Error(), "-from") {
+		t.Errorf("expected the unsupported source to be reported, got %v", err)
+	}
+	if _, _, err := runMigrateFile(t, "", "-from", "firebase"); err == nil || !strings.Contains(err.Error(), "-service") {
+		t.Errorf("expected the missing service to be reported, got %v", err)
+	}
+}
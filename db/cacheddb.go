@@ -0,0 +1,682 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package db
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/uniqush/uniqush-push/push"
+)
+
+// Cache keys are the names of delivery points and push service providers, or service+subscriber pairs, with one of these prefixes.
+// They are also the invalidation messages sent to other instances.
+const (
+	deliveryPointCacheKeyPrefix       = "dp:"
+	pushServiceProviderCacheKeyPrefix = "psp:"
+	subscriberCacheKeyPrefix          = "sub:"
+	servicePSPsCacheKeyPrefix         = "srvpsps:"
+	// allCacheKey evicts every cached entry, e.g. after a data key was shredded.
+	allCacheKey = "*"
+	// keyGenerationStripes is the number of eviction counters of keyGenerations.
+	keyGenerationStripes = 256
+)
+
+// keyGenerations counts the evictions of cache keys, so that a value read from the underlying database while its key was evicted
+// (because it was written at the same time) isn't cached after the eviction.
+// Keys are hashed onto a fixed number of counters, so an eviction may also keep a few other keys from being cached once, which is harmless.
+type keyGenerations struct {
+	counters [keyGenerationStripes]uint64
+}
+
+// get returns the generation of key, which must be read before looking up the value of key in the underlying database.
+func (g *keyGenerations) get(key string) uint64 {
+	return atomic.LoadUint64(&g.counters[hashKey(key)%keyGenerationStripes])
+}
+
+// bump is called when key is evicted, before it is removed from the caches.
+func (g *keyGenerations) bump(key string) {
+	atomic.AddUint64(&g.counters[hashKey(key)%keyGenerationStripes], 1)
+}
+
+func (g *keyGenerations) bumpAll() {
+	for i := range g.counters {
+		atomic.AddUint64(&g.counters[i], 1)
+	}
+}
+
+// cachedPushRawDatabase caches delivery points and push service providers, which are read for every push, in bounded LRU caches
+// split into conf.CacheShards segments.
+// The push service provider names of services are cached as well, since they are read by every subscription.
+// Delivery points and subscribers which don't exist are also remembered for a short time (CacheNotFoundTTL), so that pushes to unknown subscribers are cheap.
+// Other data is read from and written to the underlying database directly.
+// Changes are published to every instance sharing the database, which evict the changed entries.
+// With the write-behind policy, changed delivery points and push service providers are written to the underlying database in batches (see flushDirty).
+// Values are cached serialized (in the binary format of push.PushPeer.AppendBinary), so that each caller gets its own copy (push service types modify push service providers, e.g. when credentials are refreshed).
+type cachedPushRawDatabase struct {
+	pushRawDatabase
+	psm      *push.PushServiceManager
+	dpCache  *shardedCache
+	pspCache *shardedCache
+	// subCache caches the delivery point names of service+subscriber pairs, or is nil if they aren't cached.
+	subCache *shardedCache
+	dpTTL    time.Duration
+	pspTTL   time.Duration
+	subTTL   time.Duration
+	// servicePSPCache caches the push service provider names of services, which are read for every subscription. They expire after pspTTL.
+	servicePSPCache *shardedCache
+	// pairCache caches the push service provider and delivery point pairs of service+subscriber pairs, or is nil if they aren't cached (see cachedpairs.go).
+	pairCache *shardedCache
+	pairTTL   time.Duration
+	pairMutex sync.Mutex
+	// pairDeps maps the cache keys of delivery points and push service providers to the keys of the cached pairs which were built from them.
+	pairDeps map[string]map[string]bool
+	// pairKeyDeps maps the keys of cached pairs to the cache keys of the delivery points and push service providers they were built from.
+	pairKeyDeps map[string][]string
+	// pairGeneration is incremented by every eviction, so that pairs built while their delivery points changed aren't cached.
+	pairGeneration uint64
+	// preloadServices are the services whose subscribers are loaded by preload.
+	preloadServices []string
+	maxEntries      int
+	// flights coalesces concurrent lookups of entries which aren't cached, by cache key.
+	flights *flightGroup
+	// generations keeps entries which were evicted while they were being looked up from being cached (see cacheIfCurrent).
+	generations keyGenerations
+	// notFound caches the delivery points and service+subscriber pairs which weren't found, or is nil if they aren't cached.
+	notFound    *shardedCache
+	notFoundTTL time.Duration
+
+	writeBehind bool
+	leastDirty  int
+	// flushNow asks flushPeriodically to write the dirty entries without waiting for the next period.
+	flushNow chan struct{}
+	// flushMutex is held while dirty entries are written, so that a removal can't be overwritten by an older change.
+	flushMutex sync.Mutex
+	dirtyMutex sync.Mutex
+	// dirtyDPs and dirtyPSPs map the names of delivery points and push service providers which weren't written yet to their serialized values.
+	dirtyDPs  map[string][]byte
+	dirtyPSPs map[string][]byte
+}
+
+var _ pushRawDatabase = &cachedPushRawDatabase{}
+
+// NewCachedUniqushDatabase wraps a database with LRU caches of delivery points and push service providers,
+// each limited to conf.CacheSize entries and (if it isn't 0) conf.CacheMaxBytes bytes.
+// Entries expire after conf.CacheDeliveryPointTTL, conf.CachePushServiceProviderTTL or conf.CacheSubscriberTTL, unless it is 0.
+// The delivery point names of subscribers are only cached if conf.CacheSubscriberTTL isn't 0.
+// If conf.CacheNotFoundTTL isn't 0, delivery points and subscribers which weren't found are cached for that long.
+// If conf.CacheWritePolicy is CacheWriteBehind, changes are written every conf.EverySec seconds, or once conf.LeastDirty changes are waiting.
+func NewCachedUniqushDatabase(db pushRawDatabase, conf *DatabaseConfig) pushRawDatabase {
+	shards := conf.CacheShards
+	if shards <= 0 {
+		shards = DefaultCacheShards
+	}
+	c := &cachedPushRawDatabase{
+		pushRawDatabase: db,
+		psm:             conf.PushServiceManager,
+		dpCache:         newShardedCache("deliveryPoints", shards, conf.CacheSize, conf.CacheMaxBytes),
+		pspCache:        newShardedCache("pushServiceProviders", shards, conf.CacheSize, conf.CacheMaxBytes),
+		servicePSPCache: newShardedCache("servicePushServiceProviders", shards, conf.CacheSize, conf.CacheMaxBytes),
+		dpTTL:           conf.CacheDeliveryPointTTL,
+		pspTTL:          conf.CachePushServiceProviderTTL,
+		flights:         newFlightGroup(),
+		preloadServices: conf.CachePreloadServices,
+		maxEntries:      conf.CacheSize,
+	}
+	if conf.CacheSubscriberTTL > 0 {
+		c.subCache = newShardedCache("subscribers", shards, conf.CacheSize, conf.CacheMaxBytes)
+		c.subTTL = conf.CacheSubscriberTTL
+	}
+	if conf.CachePairTTL > 0 {
+		c.pairCache = newShardedCache("pairs", shards, conf.CacheSize, conf.CacheMaxBytes)
+		c.pairCache.setOnEvict(c.forgetPairDeps)
+		c.pairTTL = conf.CachePairTTL
+		c.pairDeps = make(map[string]map[string]bool)
+		c.pairKeyDeps = make(map[string][]string)
+	}
+	if conf.CacheNotFoundTTL > 0 {
+		c.notFound = newShardedCache("notFound", shards, conf.CacheSize, 0)
+		c.notFoundTTL = conf.CacheNotFoundTTL
+	}
+	if conf.CacheWritePolicy == CacheWriteBehind {
+		c.writeBehind = true
+		c.leastDirty = conf.LeastDirty
+		c.dirtyDPs = make(map[string][]byte)
+		c.dirtyPSPs = make(map[string][]byte)
+		c.flushNow = make(chan struct{}, 1)
+		go c.flushPeriodically(time.Duration(conf.EverySec) * time.Second)
+	}
+	// The subscription lasts as long as the process.
+	db.SubscribeCacheInvalidations(c.evict, c.evictAll)
+	return c
+}
+
+// evict removes the entry with the given cache key from the caches of this instance.
+func (c *cachedPushRawDatabase) evict(key string) {
+	if key == allCacheKey {
+		c.evictAll()
+		return
+	}
+	c.generations.bump(key)
+	c.flights.Forget(key)
+	c.evictPairs(key)
+	switch {
+	case strings.HasPrefix(key, deliveryPointCacheKeyPrefix):
+		c.dpCache.Remove(strings.TrimPrefix(key, deliveryPointCacheKeyPrefix))
+		c.removeNotFound(key)
+	case strings.HasPrefix(key, pushServiceProviderCacheKeyPrefix):
+		c.pspCache.Remove(strings.TrimPrefix(key, pushServiceProviderCacheKeyPrefix))
+	case strings.HasPrefix(key, subscriberCacheKeyPrefix):
+		if c.subCache != nil {
+			c.subCache.Remove(key)
+		}
+		c.removeNotFound(key)
+	case strings.HasPrefix(key, servicePSPsCacheKeyPrefix):
+		c.servicePSPCache.Remove(key)
+	}
+}
+
+func (c *cachedPushRawDatabase) evictAll() {
+	c.generations.bumpAll()
+	c.dpCache.Clear()
+	c.pspCache.Clear()
+	c.servicePSPCache.Clear()
+	if c.subCache != nil {
+		c.subCache.Clear()
+	}
+	c.clearPairs()
+	if c.notFound != nil {
+		c.notFound.Clear()
+	}
+}
+
+// invalidate evicts the entry with the given cache key after writing it, and tells the other instances to evict it.
+// A concurrent lookup may still have read the old value before the write. Evicting bumps the generation of key, so cacheIfCurrent won't keep that value.
+// Returns writeErr, or the error publishing the invalidation.
+func (c *cachedPushRawDatabase) invalidate(key string, writeErr error) error {
+	c.evict(key)
+	if err := c.pushRawDatabase.PublishCacheInvalidation(key); writeErr == nil {
+		return err
+	}
+	return writeErr
+}
+
+// cacheIfCurrent caches value in cache as name, unless key was evicted since its generation was generation.
+// Like setPairs, it checks again after caching the value, since the key may be evicted in between.
+func (c *cachedPushRawDatabase) cacheIfCurrent(cache *shardedCache, name string, value []byte, ttl time.Duration, key string, generation uint64) {
+	if c.generations.get(key) != generation {
+		return
+	}
+	cache.Set(name, value, ttl)
+	if c.generations.get(key) != generation {
+		cache.Remove(name)
+	}
+}
+
+func (c *cachedPushRawDatabase) isNotFound(key string) bool {
+	return c.notFound != nil && c.notFound.Get(key) != nil
+}
+
+func (c *cachedPushRawDatabase) setNotFound(key string, generation uint64) {
+	if c.notFound != nil {
+		c.cacheIfCurrent(c.notFound, key, []byte{}, c.notFoundTTL, key, generation)
+	}
+}
+
+func (c *cachedPushRawDatabase) removeNotFound(key string) {
+	if c.notFound != nil {
+		c.notFound.Remove(key)
+	}
+}
+
+func (c *cachedPushRawDatabase) GetDeliveryPoint(name string) (*push.DeliveryPoint, error) {
+	if value := c.getDirty(c.dirtyDPs, name); value != nil {
+		return c.psm.BuildDeliveryPointFromBytes(value)
+	}
+	if value := c.dpCache.Get(name); value != nil {
+		return c.psm.BuildDeliveryPointFromBytes(value)
+	}
+	key := deliveryPointCacheKeyPrefix + name
+	if c.isNotFound(key) {
+		return nil, nil
+	}
+	value, err := c.flights.Do(key, func() ([]byte, error) {
+		generation := c.generations.get(key)
+		dp, err := c.pushRawDatabase.GetDeliveryPoint(name)
+		if err != nil {
+			return nil, err
+		}
+		if dp == nil {
+			c.setNotFound(key, generation)
+			return nil, nil
+		}
+		value := dp.AppendBinary(nil)
+		c.cacheIfCurrent(c.dpCache, name, value, c.dpTTL, key, generation)
+		return value, nil
+	})
+	if value == nil || err != nil {
+		return nil, err
+	}
+	return c.psm.BuildDeliveryPointFromBytes(value)
+}
+
+func (c *cachedPushRawDatabase) SetDeliveryPoint(dp *push.DeliveryPoint) error {
+	if c.writeBehind {
+		c.setDirty(c.dirtyDPs, deliveryPointCacheKeyPrefix, dp.Name(), dp.AppendBinary(nil))
+		return nil
+	}
+	return c.invalidate(deliveryPointCacheKeyPrefix+dp.Name(), c.pushRawDatabase.SetDeliveryPoint(dp))
+}
+
+func (c *cachedPushRawDatabase) RemoveDeliveryPoint(dp string) error {
+	if c.writeBehind {
+		c.flushMutex.Lock()
+		defer c.flushMutex.Unlock()
+		c.removeDirty(c.dirtyDPs, dp)
+	}
+	return c.invalidate(deliveryPointCacheKeyPrefix+dp, c.pushRawDatabase.RemoveDeliveryPoint(dp))
+}
+
+func (c *cachedPushRawDatabase) GetPushServiceProvider(name string) (*push.PushServiceProvider, error) {
+	if value := c.getDirty(c.dirtyPSPs, name); value != nil {
+		return c.psm.BuildPushServiceProviderFromBytes(value)
+	}
+	if value := c.pspCache.Get(name); value != nil {
+		return c.psm.BuildPushServiceProviderFromBytes(value)
+	}
+	key := pushServiceProviderCacheKeyPrefix + name
+	value, err := c.flights.Do(key, func() ([]byte, error) {
+		generation := c.generations.get(key)
+		psp, err := c.pushRawDatabase.GetPushServiceProvider(name)
+		if psp == nil || err != nil {
+			return nil, err
+		}
+		value := psp.AppendBinary(nil)
+		c.cacheIfCurrent(c.pspCache, name, value, c.pspTTL, key, generation)
+		return value, nil
+	})
+	if value == nil || err != nil {
+		return nil, err
+	}
+	return c.psm.BuildPushServiceProviderFromBytes(value)
+}
+
+// GetPushServiceProviders looks up the push service providers which aren't cached in one batch.
+func (c *cachedPushRawDatabase) GetPushServiceProviders(names []string) (map[string]*push.PushServiceProvider, error) {
+	psps := make(map[string]*push.PushServiceProvider, len(names))
+	var missing []string
+	for _, name := range names {
+		value := c.getDirty(c.dirtyPSPs, name)
+		if value == nil {
+			value = c.pspCache.Get(name)
+		}
+		if value == nil {
+			missing = append(missing, name)
+			continue
+		}
+		psp, err := c.psm.BuildPushServiceProviderFromBytes(value)
+		if err != nil {
+			return nil, err
+		}
+		psps[name] = psp
+	}
+	if len(missing) == 0 {
+		return psps, nil
+	}
+	generations := make([]uint64, len(missing))
+	for i, name := range missing {
+		generations[i] = c.generations.get(pushServiceProviderCacheKeyPrefix + name)
+	}
+	found, err := c.pushRawDatabase.GetPushServiceProviders(missing)
+	if err != nil {
+		return nil, err
+	}
+	for i, name := range missing {
+		if psp, ok := found[name]; ok {
+			c.cacheIfCurrent(c.pspCache, name, psp.AppendBinary(nil), c.pspTTL, pushServiceProviderCacheKeyPrefix+name, generations[i])
+			psps[name] = psp
+		}
+	}
+	return psps, nil
+}
+
+func (c *cachedPushRawDatabase) SetPushServiceProvider(psp *push.PushServiceProvider) error {
+	if c.writeBehind {
+		c.setDirty(c.dirtyPSPs, pushServiceProviderCacheKeyPrefix, psp.Name(), psp.AppendBinary(nil))
+		return nil
+	}
+	return c.invalidate(pushServiceProviderCacheKeyPrefix+psp.Name(), c.pushRawDatabase.SetPushServiceProvider(psp))
+}
+
+func (c *cachedPushRawDatabase) RemovePushServiceProvider(psp string) error {
+	if c.writeBehind {
+		c.flushMutex.Lock()
+		defer c.flushMutex.Unlock()
+		c.removeDirty(c.dirtyPSPs, psp)
+	}
+	return c.invalidate(pushServiceProviderCacheKeyPrefix+psp, c.pushRawDatabase.RemovePushServiceProvider(psp))
+}
+
+// GetPushServiceProvidersByService caches the push service provider names of services, so that subscribing doesn't read them from the underlying database.
+func (c *cachedPushRawDatabase) GetPushServiceProvidersByService(srv string) ([]string, error) {
+	key := servicePSPsCacheKeyPrefix + srv
+	value := c.servicePSPCache.Get(key)
+	if value == nil {
+		var err error
+		value, err = c.flights.Do(key, func() ([]byte, error) {
+			generation := c.generations.get(key)
+			names, err := c.pushRawDatabase.GetPushServiceProvidersByService(srv)
+			if err != nil {
+				return nil, err
+			}
+			value, err := json.Marshal(names)
+			if err != nil {
+				return nil, err
+			}
+			c.cacheIfCurrent(c.servicePSPCache, key, value, c.pspTTL, key, generation)
+			return value, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	var names []string
+	err := json.Unmarshal(value, &names)
+	return names, err
+}
+
+func (c *cachedPushRawDatabase) AddPushServiceProviderToService(srv, psp string) error {
+	return c.invalidate(servicePSPsCacheKeyPrefix+srv, c.pushRawDatabase.AddPushServiceProviderToService(srv, psp))
+}
+
+func (c *cachedPushRawDatabase) RemovePushServiceProviderFromService(srv, psp string) error {
+	return c.invalidate(servicePSPsCacheKeyPrefix+srv, c.pushRawDatabase.RemovePushServiceProviderFromService(srv, psp))
+}
+
+// GetDeliveryPointsNameByServiceSubscriber remembers subscribers without delivery points, and (if subCache isn't nil) the delivery points of other subscribers.
+// Patterns with wildcards aren't cached or coalesced.
+func (c *cachedPushRawDatabase) GetDeliveryPointsNameByServiceSubscriber(srv, sub string) (map[string][]string, error) {
+	cacheable := !strings.Contains(srv, "*") && !strings.Contains(sub, "*")
+	key := subscriberCacheKeyPrefix + srv + ":" + sub
+	if cacheable && c.isNotFound(key) {
+		return map[string][]string{}, nil
+	}
+	if cacheable && c.subCache != nil {
+		if value := c.subCache.Get(key); value != nil {
+			var dps map[string][]string
+			if err := json.Unmarshal(value, &dps); err == nil {
+				return dps, nil
+			}
+		}
+	}
+	if !cacheable {
+		return c.pushRawDatabase.GetDeliveryPointsNameByServiceSubscriber(srv, sub)
+	}
+	value, err := c.flights.Do(key, func() ([]byte, error) {
+		generation := c.generations.get(key)
+		dps, err := c.pushRawDatabase.GetDeliveryPointsNameByServiceSubscriber(srv, sub)
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(dps)
+		if err != nil {
+			return nil, err
+		}
+		if len(dps) == 0 {
+			c.setNotFound(key, generation)
+		} else if c.subCache != nil {
+			c.cacheIfCurrent(c.subCache, key, value, c.subTTL, key, generation)
+		}
+		return value, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	var dps map[string][]string
+	err = json.Unmarshal(value, &dps)
+	return dps, err
+}
+
+func (c *cachedPushRawDatabase) AddDeliveryPointToServiceSubscriber(srv, sub, dp string) error {
+	return c.invalidate(subscriberCacheKeyPrefix+srv+":"+sub, c.pushRawDatabase.AddDeliveryPointToServiceSubscriber(srv, sub, dp))
+}
+
+func (c *cachedPushRawDatabase) RemoveDeliveryPointFromServiceSubscriber(srv, sub, dp string) error {
+	return c.invalidate(subscriberCacheKeyPrefix+srv+":"+sub, c.pushRawDatabase.RemoveDeliveryPointFromServiceSubscriber(srv, sub, dp))
+}
+
+func (c *cachedPushRawDatabase) SetPushServiceProviderOfServiceDeliveryPoint(srv, dp, psp string) error {
+	return c.invalidate(deliveryPointCacheKeyPrefix+dp, c.pushRawDatabase.SetPushServiceProviderOfServiceDeliveryPoint(srv, dp, psp))
+}
+
+func (c *cachedPushRawDatabase) RemovePushServiceProviderOfServiceDeliveryPoint(srv, dp string) error {
+	return c.invalidate(deliveryPointCacheKeyPrefix+dp, c.pushRawDatabase.RemovePushServiceProviderOfServiceDeliveryPoint(srv, dp))
+}
+
+// ShredTenantDataKey evicts every cached delivery point from every instance after shredding, since cached delivery points are decrypted.
+func (c *cachedPushRawDatabase) ShredTenantDataKey(tenant string) error {
+	return c.invalidate(allCacheKey, c.pushRawDatabase.ShredTenantDataKey(tenant))
+}
+
+// FlushCache writes the changes which are waiting to be written (with the write-behind policy), then saves the underlying database.
+func (c *cachedPushRawDatabase) FlushCache() error {
+	flushErr := c.flushDirty()
+	if err := c.pushRawDatabase.FlushCache(); flushErr == nil {
+		return err
+	}
+	return flushErr
+}
+
+func (c *cachedPushRawDatabase) getDirty(dirty map[string][]byte, name string) []byte {
+	if !c.writeBehind {
+		return nil
+	}
+	c.dirtyMutex.Lock()
+	defer c.dirtyMutex.Unlock()
+	return dirty[name]
+}
+
+// setDirty saves a change to be written later, and starts writing the changes if at least leastDirty are waiting.
+func (c *cachedPushRawDatabase) setDirty(dirty map[string][]byte, prefix, name string, value []byte) {
+	c.dirtyMutex.Lock()
+	dirty[name] = value
+	n := len(c.dirtyDPs) + len(c.dirtyPSPs)
+	c.dirtyMutex.Unlock()
+	c.evict(prefix + name)
+	if n >= c.leastDirty {
+		select {
+		case c.flushNow <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (c *cachedPushRawDatabase) removeDirty(dirty map[string][]byte, name string) {
+	c.dirtyMutex.Lock()
+	defer c.dirtyMutex.Unlock()
+	delete(dirty, name)
+}
+
+func (c *cachedPushRawDatabase) flushPeriodically(period time.Duration) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.flushNow:
+		}
+		// Changes which failed to be written stay dirty, and are written again with the next flush.
+		c.flushDirty()
+	}
+}
+
+// flushDirty writes the changes which are waiting to be written, and tells the other instances to evict them.
+// Changes stay readable from the dirty entries until they are written, and are only forgotten if they didn't change again in the meantime.
+// Returns the first error.
+func (c *cachedPushRawDatabase) flushDirty() error {
+	if !c.writeBehind {
+		return nil
+	}
+	c.flushMutex.Lock()
+	defer c.flushMutex.Unlock()
+
+	var firstErr error
+	flush := func(dirty map[string][]byte, prefix string, write func(value []byte) error) {
+		c.dirtyMutex.Lock()
+		pending := make(map[string][]byte, len(dirty))
+		for name, value := range dirty {
+			pending[name] = value
+		}
+		c.dirtyMutex.Unlock()
+
+		for name, value := range pending {
+			err := c.invalidate(prefix+name, write(value))
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				continue
+			}
+			c.dirtyMutex.Lock()
+			if bytes.Equal(dirty[name], value) {
+				delete(dirty, name)
+			}
+			c.dirtyMutex.Unlock()
+		}
+	}
+	flush(c.dirtyPSPs, pushServiceProviderCacheKeyPrefix, func(value []byte) error {
+		psp, err := c.psm.BuildPushServiceProviderFromBytes(value)
+		if err != nil {
+			return err
+		}
+		return c.pushRawDatabase.SetPushServiceProvider(psp)
+	})
+	flush(c.dirtyDPs, deliveryPointCacheKeyPrefix, func(value []byte) error {
+		dp, err := c.psm.BuildDeliveryPointFromBytes(value)
+		if err != nil {
+			return err
+		}
+		return c.pushRawDatabase.SetDeliveryPoint(dp)
+	})
+	return firstErr
+}
+
+// preloadScanCount is the number of subscribers to scan at a time while preloading.
+const preloadScanCount = 100
+
+// preload loads the push service providers (and fallbacks) of every service, then the delivery points of up to maxEntries subscribers of preloadServices.
+// Returns the number of entries loaded.
+func (c *cachedPushRawDatabase) preload() (int, error) {
+	loaded := 0
+	services, err := c.pushRawDatabase.GetServiceNames()
+	if err != nil {
+		return loaded, err
+	}
+	for _, srv := range services {
+		pspNames, err := c.GetPushServiceProvidersByService(srv)
+		if err != nil {
+			return loaded, err
+		}
+		for _, pspName := range pspNames {
+			fallback, err := c.pushRawDatabase.GetFallbackPushServiceProvider(pspName)
+			if err != nil {
+				return loaded, err
+			}
+			for _, name := range []string{pspName, fallback} {
+				if name == "" {
+					continue
+				}
+				if _, err := c.GetPushServiceProvider(name); err != nil {
+					return loaded, err
+				}
+				loaded++
+			}
+		}
+	}
+
+	subscribers := 0
+	for _, srv := range c.preloadServices {
+		cursor := uint64(0)
+		for subscribers < c.maxEntries {
+			subs, next, err := c.pushRawDatabase.ScanSubscribersOfService(srv, "*", cursor, preloadScanCount)
+			if err != nil {
+				return loaded, err
+			}
+			for _, sub := range subs {
+				dpNames, err := c.GetDeliveryPointsNameByServiceSubscriber(srv, sub)
+				if err != nil {
+					return loaded, err
+				}
+				subscribers++
+				loaded++
+				for _, names := range dpNames {
+					for _, name := range names {
+						if _, err := c.GetDeliveryPoint(name); err != nil {
+							return loaded, err
+						}
+						loaded++
+					}
+				}
+			}
+			if next == 0 {
+				break
+			}
+			cursor = next
+		}
+	}
+	return loaded, nil
+}
+
+// resizeCaches changes the limits of every cache (the notFound cache is only limited by entries), evicting the least recently used entries of caches which are too large.
+func (c *cachedPushRawDatabase) resizeCaches(maxEntries int, maxBytes int64) {
+	for _, cache := range []*shardedCache{c.dpCache, c.pspCache, c.subCache, c.pairCache, c.servicePSPCache} {
+		if cache != nil {
+			cache.Resize(maxEntries, maxBytes)
+		}
+	}
+	if c.notFound != nil {
+		c.notFound.Resize(maxEntries, 0)
+	}
+}
+
+// cacheStats returns the counters of every cache, with their hotKeys most hit keys if hotKeys isn't 0.
+func (c *cachedPushRawDatabase) cacheStats(hotKeys int) []CacheStats {
+	caches := []*shardedCache{c.dpCache, c.pspCache}
+	if c.subCache != nil {
+		caches = append(caches, c.subCache)
+	}
+	if c.pairCache != nil {
+		caches = append(caches, c.pairCache)
+	}
+	if c.notFound != nil {
+		caches = append(caches, c.notFound)
+	}
+	caches = append(caches, c.servicePSPCache)
+	stats := make([]CacheStats, len(caches))
+	for i, cache := range caches {
+		stats[i] = cache.Stats()
+		if hotKeys > 0 {
+			stats[i].HotKeys = cache.HotKeys(hotKeys)
+		}
+	}
+	return stats
+}
@@ -0,0 +1,435 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package db
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/uniqush/uniqush-push/push"
+	apns_mocks "github.com/uniqush/uniqush-push/srv/apns/http_api/mocks"
+	"github.com/uniqush/uniqush-push/testutil"
+)
+
+// countingRawDatabase counts the lookups which reach the underlying database, and records the published cache invalidations. Other methods aren't implemented.
+type countingRawDatabase struct {
+	pushRawDatabase
+	dpLookups  int
+	subLookups int
+	pspBatches int
+	pspLists   int
+	subs       map[string][]string
+	published  []string
+	invalidate func(key string)
+	psps       map[string]*push.PushServiceProvider
+	dps        map[string]*push.DeliveryPoint
+	pspOfDP    map[string]string
+}
+
+func (r *countingRawDatabase) PublishCacheInvalidation(key string) error {
+	r.published = append(r.published, key)
+	return nil
+}
+
+func (r *countingRawDatabase) SubscribeCacheInvalidations(invalidate func(key string), invalidateAll func()) func() {
+	r.invalidate = invalidate
+	return func() {}
+}
+
+func (r *countingRawDatabase) RemoveDeliveryPointFromServiceSubscriber(srv, sub, dp string) error {
+	r.subs = map[string][]string{}
+	return nil
+}
+
+func (r *countingRawDatabase) RemoveDeliveryPoint(dp string) error {
+	return nil
+}
+
+func (r *countingRawDatabase) RemovePushServiceProviderOfServiceDeliveryPoint(srv, dp string) error {
+	delete(r.pspOfDP, dp)
+	return nil
+}
+
+func (r *countingRawDatabase) GetPushServiceProvider(name string) (*push.PushServiceProvider, error) {
+	return r.psps[name], nil
+}
+
+func (r *countingRawDatabase) GetPushServiceProviders(names []string) (map[string]*push.PushServiceProvider, error) {
+	r.pspBatches++
+	psps := make(map[string]*push.PushServiceProvider, len(names))
+	for _, name := range names {
+		if psp, ok := r.psps[name]; ok {
+			psps[name] = psp
+		}
+	}
+	return psps, nil
+}
+
+func (r *countingRawDatabase) SetPushServiceProvider(psp *push.PushServiceProvider) error {
+	r.psps[psp.Name()] = psp
+	return nil
+}
+
+func (r *countingRawDatabase) FlushCache() error {
+	return nil
+}
+
+func (r *countingRawDatabase) GetDeliveryPoint(name string) (*push.DeliveryPoint, error) {
+	r.dpLookups++
+	return r.dps[name], nil
+}
+
+func (r *countingRawDatabase) GetServiceNames() ([]string, error) {
+	return []string{"srv"}, nil
+}
+
+func (r *countingRawDatabase) GetPushServiceProvidersByService(srv string) ([]string, error) {
+	r.pspLists++
+	var names []string
+	for name := range r.psps {
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+func (r *countingRawDatabase) AddPushServiceProviderToService(srv, psp string) error {
+	return nil
+}
+
+func (r *countingRawDatabase) GetFallbackPushServiceProvider(psp string) (string, error) {
+	return "", nil
+}
+
+func (r *countingRawDatabase) ScanSubscribersOfService(srv, pattern string, cursor uint64, count int64) ([]string, uint64, error) {
+	var subs []string
+	for sub := range r.subs {
+		subs = append(subs, sub)
+	}
+	return subs, 0, nil
+}
+
+func (r *countingRawDatabase) GetPushServiceProviderNameByServiceDeliveryPoint(srv, dp string) (string, error) {
+	return r.pspOfDP[dp], nil
+}
+
+func (r *countingRawDatabase) GetDeliveryPointsNameByServiceSubscriber(srv, sub string) (map[string][]string, error) {
+	r.subLookups++
+	return r.subs, nil
+}
+
+func (r *countingRawDatabase) AddDeliveryPointToServiceSubscriber(srv, sub, dp string) error {
+	r.subs = map[string][]string{sub: {dp}}
+	return nil
+}
+
+func TestCachedDatabaseRemembersNotFound(t *testing.T) {
+	raw := &countingRawDatabase{subs: map[string][]string{}}
+	c := NewCachedUniqushDatabase(raw, &DatabaseConfig{CacheSize: 10, CacheNotFoundTTL: time.Minute})
+
+	for i := 0; i < 3; i++ {
+		dp, err := c.GetDeliveryPoint("missing")
+		if dp != nil || err != nil {
+			t.Fatalf("Expected no delivery point, got %v, %v", dp, err)
+		}
+		c.GetDeliveryPointsNameByServiceSubscriber("srv", "unknown")
+		c.GetDeliveryPointsNameByServiceSubscriber("srv", "unknown*")
+	}
+	testutil.ExpectEquals(t, 1, raw.dpLookups, "expected a missing delivery point to be looked up once")
+	testutil.ExpectEquals(t, 4, raw.subLookups, "expected an unknown subscriber to be looked up once, and patterns every time")
+
+	if err := c.AddDeliveryPointToServiceSubscriber("srv", "unknown", "dp1"); err != nil {
+		t.Fatal(err)
+	}
+	dps, _ := c.GetDeliveryPointsNameByServiceSubscriber("srv", "unknown")
+	testutil.ExpectEquals(t, map[string][]string{"unknown": {"dp1"}}, dps, "expected subscribing to forget that the subscriber wasn't found")
+}
+
+func TestCachedDatabaseInvalidation(t *testing.T) {
+	raw := &countingRawDatabase{subs: map[string][]string{}}
+	c := NewCachedUniqushDatabase(raw, &DatabaseConfig{CacheSize: 10, CacheNotFoundTTL: time.Minute})
+
+	c.GetDeliveryPoint("dp1")
+	c.GetDeliveryPoint("dp1")
+	testutil.ExpectEquals(t, 1, raw.dpLookups, "expected the missing delivery point to be cached")
+
+	// Another instance added the delivery point.
+	raw.invalidate("dp:dp1")
+	c.GetDeliveryPoint("dp1")
+	testutil.ExpectEquals(t, 2, raw.dpLookups, "expected the invalidation to evict the delivery point")
+
+	if err := c.RemoveDeliveryPoint("dp2"); err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectEquals(t, []string{"dp:dp2"}, raw.published, "expected changes to be published to other instances")
+}
+
+// racingRawDatabase calls duringRead once while a delivery point is being read, after reading it, e.g. to change it concurrently.
+type racingRawDatabase struct {
+	*countingRawDatabase
+	duringRead func()
+}
+
+func (r *racingRawDatabase) GetDeliveryPoint(name string) (*push.DeliveryPoint, error) {
+	dp, err := r.countingRawDatabase.GetDeliveryPoint(name)
+	if f := r.duringRead; f != nil {
+		r.duringRead = nil
+		f()
+	}
+	return dp, err
+}
+
+func (r *racingRawDatabase) GetPushServiceProvidersByService(srv string) ([]string, error) {
+	names, err := r.countingRawDatabase.GetPushServiceProvidersByService(srv)
+	if f := r.duringRead; f != nil {
+		r.duringRead = nil
+		f()
+	}
+	return names, err
+}
+
+func TestCachedDatabaseSkipsStaleReads(t *testing.T) {
+	raw := &racingRawDatabase{countingRawDatabase: &countingRawDatabase{subs: map[string][]string{}}}
+	c := NewCachedUniqushDatabase(raw, &DatabaseConfig{CacheSize: 10, CacheNotFoundTTL: time.Minute})
+	// Another instance adds the delivery point after it was read, but before the lookup finishes.
+	raw.duringRead = func() { raw.invalidate("dp:dp1") }
+
+	c.GetDeliveryPoint("dp1")
+	c.GetDeliveryPoint("dp1")
+	testutil.ExpectEquals(t, 2, raw.dpLookups, "expected a value read before an invalidation not to be cached")
+	c.GetDeliveryPoint("dp1")
+	testutil.ExpectEquals(t, 2, raw.dpLookups, "expected later lookups to be cached")
+
+	// The shared lookup of the names of push service providers also checks for invalidations before caching them.
+	raw.duringRead = func() { raw.invalidate("srvpsps:srv") }
+	c.GetPushServiceProvidersByService("srv")
+	c.GetPushServiceProvidersByService("srv")
+	testutil.ExpectEquals(t, 2, raw.pspLists, "expected names read before an invalidation not to be cached")
+}
+
+func TestCachedDatabaseServicePushServiceProviders(t *testing.T) {
+	raw := &countingRawDatabase{psps: map[string]*push.PushServiceProvider{"psp1": nil}}
+	c := NewCachedUniqushDatabase(raw, &DatabaseConfig{CacheSize: 10})
+
+	for i := 0; i < 2; i++ {
+		names, err := c.GetPushServiceProvidersByService("srv")
+		if err != nil {
+			t.Fatal(err)
+		}
+		testutil.ExpectEquals(t, []string{"psp1"}, names, "unexpected push service providers")
+	}
+	testutil.ExpectEquals(t, 1, raw.pspLists, "expected the push service provider names to be cached")
+
+	if err := c.AddPushServiceProviderToService("srv", "psp2"); err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectEquals(t, []string{"srvpsps:srv"}, raw.published, "expected the change to be published to other instances")
+	c.GetPushServiceProvidersByService("srv")
+	testutil.ExpectEquals(t, 2, raw.pspLists, "expected adding a push service provider to evict the names")
+
+	// Another instance removed a push service provider.
+	raw.invalidate("srvpsps:srv")
+	c.GetPushServiceProvidersByService("srv")
+	testutil.ExpectEquals(t, 3, raw.pspLists, "expected the invalidation to evict the names")
+}
+
+func TestCachedDatabaseWriteBehind(t *testing.T) {
+	psm := initializePushServiceManagerForTest()
+	if err := psm.RegisterPushServiceType(&apns_mocks.MockPushServiceType{}); err != nil {
+		t.Fatal(err)
+	}
+	psp, err := psm.BuildPushServiceProviderFromMap(defaultMockPSPData())
+	if err != nil {
+		t.Fatalf("Could not create a mock PSP: %v", err)
+	}
+
+	raw := &countingRawDatabase{psps: map[string]*push.PushServiceProvider{}}
+	c := NewCachedUniqushDatabase(raw, &DatabaseConfig{
+		CacheSize:          10,
+		CacheWritePolicy:   CacheWriteBehind,
+		EverySec:           600,
+		LeastDirty:         10,
+		PushServiceManager: psm,
+	})
+	if err := c.SetPushServiceProvider(psp); err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectEquals(t, 0, len(raw.psps), "expected the change not to be written yet")
+	cached, err := c.GetPushServiceProvider(psp.Name())
+	if err != nil || cached == nil {
+		t.Fatalf("Expected to read the change before it's written, got %v, %v", cached, err)
+	}
+	testutil.ExpectStringEquals(t, psp.Name(), cached.Name(), "unexpected push service provider")
+
+	if err := c.FlushCache(); err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectEquals(t, 1, len(raw.psps), "expected flushing to write the change")
+	testutil.ExpectEquals(t, []string{"psp:" + psp.Name()}, raw.published, "expected written changes to be published")
+}
+
+func TestCachedDatabaseSubscriberTTL(t *testing.T) {
+	raw := &countingRawDatabase{subs: map[string][]string{"sub": {"dp1"}}}
+	c := NewCachedUniqushDatabase(raw, &DatabaseConfig{CacheSize: 10, CacheSubscriberTTL: time.Minute})
+	subCache := c.(*cachedPushRawDatabase).subCache
+	now := time.Now()
+	subCache.setNow(func() time.Time { return now })
+
+	for i := 0; i < 2; i++ {
+		dps, _ := c.GetDeliveryPointsNameByServiceSubscriber("srv", "sub")
+		testutil.ExpectEquals(t, map[string][]string{"sub": {"dp1"}}, dps, "unexpected delivery points")
+	}
+	testutil.ExpectEquals(t, 1, raw.subLookups, "expected the delivery points of the subscriber to be cached")
+
+	now = now.Add(time.Minute)
+	c.GetDeliveryPointsNameByServiceSubscriber("srv", "sub")
+	testutil.ExpectEquals(t, 2, raw.subLookups, "expected the cached delivery points to expire")
+
+	if err := c.RemoveDeliveryPointFromServiceSubscriber("srv", "sub", "dp1"); err != nil {
+		t.Fatal(err)
+	}
+	dps, _ := c.GetDeliveryPointsNameByServiceSubscriber("srv", "sub")
+	testutil.ExpectEquals(t, map[string][]string{}, dps, "expected unsubscribing to evict the cached delivery points")
+}
+
+func TestCachedDatabasePairs(t *testing.T) {
+	psm := initializePushServiceManagerForTest()
+	if err := psm.RegisterPushServiceType(&apns_mocks.MockPushServiceType{}); err != nil {
+		t.Fatal(err)
+	}
+	psp, err := psm.BuildPushServiceProviderFromMap(defaultMockPSPData())
+	if err != nil {
+		t.Fatalf("Could not create a mock PSP: %v", err)
+	}
+	dp1, _ := psm.BuildDeliveryPointFromBytes([]byte(`apns:[{"devtoken":"1"},{}]`))
+	dp2, _ := psm.BuildDeliveryPointFromBytes([]byte(`apns:[{"devtoken":"2"},{}]`))
+
+	raw := &countingRawDatabase{
+		subs:    map[string][]string{"sub": {dp1.Name(), dp2.Name()}},
+		psps:    map[string]*push.PushServiceProvider{psp.Name(): psp},
+		dps:     map[string]*push.DeliveryPoint{dp1.Name(): dp1, dp2.Name(): dp2},
+		pspOfDP: map[string]string{dp1.Name(): psp.Name(), dp2.Name(): psp.Name()},
+	}
+	f := &pushDatabaseOpts{db: NewCachedUniqushDatabase(raw, &DatabaseConfig{CacheSize: 10, CachePairTTL: time.Minute, PushServiceManager: psm})}
+
+	for i := 0; i < 2; i++ {
+		pairs, err := f.GetPushServiceProviderDeliveryPointPairs("srv", "sub", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testutil.ExpectEquals(t, 2, len(pairs), "unexpected number of pairs")
+	}
+	testutil.ExpectEquals(t, 1, raw.subLookups, "expected the pairs to be cached")
+
+	pairs, _ := f.GetPushServiceProviderDeliveryPointPairs("srv", "sub", []string{dp2.Name()})
+	testutil.ExpectEquals(t, 1, len(pairs), "expected the cached pairs to be filtered")
+	testutil.ExpectStringEquals(t, dp2.Name(), pairs[0].DeliveryPoint.Name(), "unexpected delivery point")
+	testutil.ExpectEquals(t, 1, raw.subLookups, "expected a subset of the pairs to be read from the cache")
+
+	if err := f.db.SetPushServiceProvider(psp); err != nil {
+		t.Fatal(err)
+	}
+	f.GetPushServiceProviderDeliveryPointPairs("srv", "sub", nil)
+	testutil.ExpectEquals(t, 2, raw.subLookups, "expected changing the push service provider to evict the pairs")
+}
+
+func TestPairsOfSubscribersFetchPushServiceProvidersInOneBatch(t *testing.T) {
+	psm := initializePushServiceManagerForTest()
+	if err := psm.RegisterPushServiceType(&apns_mocks.MockPushServiceType{}); err != nil {
+		t.Fatal(err)
+	}
+	psp, err := psm.BuildPushServiceProviderFromMap(defaultMockPSPData())
+	if err != nil {
+		t.Fatalf("Could not create a mock PSP: %v", err)
+	}
+	dp1, _ := psm.BuildDeliveryPointFromBytes([]byte(`apns:[{"devtoken":"1"},{}]`))
+	dp2, _ := psm.BuildDeliveryPointFromBytes([]byte(`apns:[{"devtoken":"2"},{}]`))
+
+	// Every subscriber has the same delivery points, and the second one has no push service provider.
+	raw := &countingRawDatabase{
+		subs:    map[string][]string{"srv": {dp1.Name(), dp2.Name()}},
+		psps:    map[string]*push.PushServiceProvider{psp.Name(): psp},
+		dps:     map[string]*push.DeliveryPoint{dp1.Name(): dp1, dp2.Name(): dp2},
+		pspOfDP: map[string]string{dp1.Name(): psp.Name(), dp2.Name(): "removedpsp"},
+	}
+	f := &pushDatabaseOpts{db: raw}
+
+	subs := []string{"sub1", "sub2", "sub3"}
+	pairs, errs := f.GetPushServiceProviderDeliveryPointPairsOfSubscribers(context.Background(), "srv", subs, nil)
+	testutil.ExpectEquals(t, 0, len(errs), "unexpected errors")
+	for _, sub := range subs {
+		testutil.ExpectEquals(t, 1, len(pairs[sub]), "unexpected number of pairs of "+sub)
+		testutil.ExpectStringEquals(t, dp1.Name(), pairs[sub][0].DeliveryPoint.Name(), "unexpected delivery point of "+sub)
+	}
+	testutil.ExpectEquals(t, 1, raw.pspBatches, "expected the push service providers to be fetched in one batch")
+}
+
+func TestPairsOfSubscribersCanceled(t *testing.T) {
+	psm := initializePushServiceManagerForTest()
+	if err := psm.RegisterPushServiceType(&apns_mocks.MockPushServiceType{}); err != nil {
+		t.Fatal(err)
+	}
+	dp1, _ := psm.BuildDeliveryPointFromBytes([]byte(`apns:[{"devtoken":"1"},{}]`))
+	raw := &countingRawDatabase{
+		subs: map[string][]string{"srv": {dp1.Name()}},
+		dps:  map[string]*push.DeliveryPoint{dp1.Name(): dp1},
+	}
+	f := &pushDatabaseOpts{db: raw}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	pairs, errs := f.GetPushServiceProviderDeliveryPointPairsOfSubscribers(ctx, "srv", []string{"sub1", "sub2"}, nil)
+	testutil.ExpectEquals(t, 0, len(pairs), "expected no pairs")
+	testutil.ExpectEquals(t, context.Canceled, errs["sub1"], "expected the error of the context")
+	testutil.ExpectEquals(t, context.Canceled, errs["sub2"], "expected the error of the context")
+	testutil.ExpectEquals(t, 0, raw.subLookups, "expected the subscribers not to be looked up")
+	testutil.ExpectEquals(t, 0, raw.pspBatches, "expected the push service providers not to be fetched")
+}
+
+func TestCachedDatabasePreload(t *testing.T) {
+	psm := initializePushServiceManagerForTest()
+	if err := psm.RegisterPushServiceType(&apns_mocks.MockPushServiceType{}); err != nil {
+		t.Fatal(err)
+	}
+	psp, err := psm.BuildPushServiceProviderFromMap(defaultMockPSPData())
+	if err != nil {
+		t.Fatalf("Could not create a mock PSP: %v", err)
+	}
+	dp, _ := psm.BuildDeliveryPointFromBytes([]byte(`apns:[{"devtoken":"1"},{}]`))
+	raw := &countingRawDatabase{
+		subs: map[string][]string{"sub": {dp.Name()}},
+		psps: map[string]*push.PushServiceProvider{psp.Name(): psp},
+		dps:  map[string]*push.DeliveryPoint{dp.Name(): dp},
+	}
+	f := &pushDatabaseOpts{db: NewCachedUniqushDatabase(raw, &DatabaseConfig{
+		CacheSize:            10,
+		CacheSubscriberTTL:   time.Minute,
+		CachePreloadServices: []string{"srv"},
+		PushServiceManager:   psm,
+	})}
+
+	loaded, err := f.PreloadCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectEquals(t, 3, loaded, "expected the push service provider, subscriber and delivery point to be loaded")
+	stats := f.CacheStats(0)
+	testutil.ExpectEquals(t, 1, stats[0].Entries, "expected the delivery point to be cached")
+	testutil.ExpectEquals(t, 1, stats[1].Entries, "expected the push service provider to be cached")
+	testutil.ExpectEquals(t, 1, stats[2].Entries, "expected the subscriber to be cached")
+}
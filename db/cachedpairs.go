@@ -0,0 +1,179 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package db
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// pairCacher is implemented by databases which cache the results of GetPushServiceProviderDeliveryPointPairs.
+type pairCacher interface {
+	// getPairs returns copies of the cached pairs of a service+subscriber, or false if they aren't cached.
+	getPairs(srv, sub string) ([]PushServiceProviderDeliveryPointPair, bool)
+	// pairsGeneration returns a value to pass to setPairs, before looking up the pairs.
+	pairsGeneration() uint64
+	// setPairs caches the pairs of a service+subscriber, built from the given delivery points and push service providers,
+	// unless any cached entry was evicted since pairsGeneration returned generation.
+	setPairs(srv, sub string, pairs []PushServiceProviderDeliveryPointPair, dpNames, pspNames []string, generation uint64)
+}
+
+var _ pairCacher = &cachedPushRawDatabase{}
+
+// cachedPair is a serialized PushServiceProviderDeliveryPointPair.
+type cachedPair struct {
+	PushServiceProvider []byte
+	DeliveryPoint       []byte
+}
+
+func (c *cachedPushRawDatabase) getPairs(srv, sub string) ([]PushServiceProviderDeliveryPointPair, bool) {
+	if c.pairCache == nil {
+		return nil, false
+	}
+	value := c.pairCache.Get(subscriberCacheKeyPrefix + srv + ":" + sub)
+	if value == nil {
+		return nil, false
+	}
+	var cached []cachedPair
+	if err := json.Unmarshal(value, &cached); err != nil {
+		return nil, false
+	}
+	pairs := make([]PushServiceProviderDeliveryPointPair, 0, len(cached))
+	for _, pair := range cached {
+		psp, err := c.psm.BuildPushServiceProviderFromBytes(pair.PushServiceProvider)
+		if err != nil {
+			return nil, false
+		}
+		dp, err := c.psm.BuildDeliveryPointFromBytes(pair.DeliveryPoint)
+		if err != nil {
+			return nil, false
+		}
+		pairs = append(pairs, PushServiceProviderDeliveryPointPair{psp, dp})
+	}
+	return pairs, true
+}
+
+func (c *cachedPushRawDatabase) pairsGeneration() uint64 {
+	c.pairMutex.Lock()
+	defer c.pairMutex.Unlock()
+	return c.pairGeneration
+}
+
+func (c *cachedPushRawDatabase) setPairs(srv, sub string, pairs []PushServiceProviderDeliveryPointPair, dpNames, pspNames []string, generation uint64) {
+	if c.pairCache == nil || strings.Contains(srv, "*") || strings.Contains(sub, "*") {
+		return
+	}
+	cached := make([]cachedPair, 0, len(pairs))
+	for _, pair := range pairs {
+		cached = append(cached, cachedPair{pair.PushServiceProvider.AppendBinary(nil), pair.DeliveryPoint.AppendBinary(nil)})
+	}
+	value, err := json.Marshal(cached)
+	if err != nil {
+		return
+	}
+	key := subscriberCacheKeyPrefix + srv + ":" + sub
+	deps := make([]string, 0, len(dpNames)+len(pspNames))
+	for _, name := range dpNames {
+		deps = append(deps, deliveryPointCacheKeyPrefix+name)
+	}
+	for _, name := range pspNames {
+		deps = append(deps, pushServiceProviderCacheKeyPrefix+name)
+	}
+
+	c.pairMutex.Lock()
+	if c.pairGeneration != generation {
+		c.pairMutex.Unlock()
+		return
+	}
+	c.removePairDeps(key)
+	c.pairKeyDeps[key] = deps
+	for _, dep := range deps {
+		if c.pairDeps[dep] == nil {
+			c.pairDeps[dep] = make(map[string]bool)
+		}
+		c.pairDeps[dep][key] = true
+	}
+	c.pairMutex.Unlock()
+	// This may evict other pairs, which calls forgetPairDeps.
+	c.pairCache.Set(key, value, c.pairTTL)
+
+	// Don't keep the pairs if an entry was evicted before they were cached.
+	c.pairMutex.Lock()
+	stale := c.pairGeneration != generation
+	if stale {
+		c.removePairDeps(key)
+	}
+	c.pairMutex.Unlock()
+	if stale {
+		c.pairCache.Remove(key)
+	}
+}
+
+// evictPairs removes the pairs of a service+subscriber (for a subscriber's cache key), or the pairs built from a delivery point or push service provider.
+func (c *cachedPushRawDatabase) evictPairs(key string) {
+	if c.pairCache == nil {
+		return
+	}
+	c.pairMutex.Lock()
+	c.pairGeneration++
+	var keys []string
+	if strings.HasPrefix(key, subscriberCacheKeyPrefix) {
+		keys = []string{key}
+	} else {
+		for pairKey := range c.pairDeps[key] {
+			keys = append(keys, pairKey)
+		}
+	}
+	for _, pairKey := range keys {
+		c.removePairDeps(pairKey)
+	}
+	c.pairMutex.Unlock()
+	for _, pairKey := range keys {
+		c.pairCache.Remove(pairKey)
+	}
+}
+
+func (c *cachedPushRawDatabase) clearPairs() {
+	if c.pairCache == nil {
+		return
+	}
+	c.pairMutex.Lock()
+	c.pairGeneration++
+	c.pairDeps = make(map[string]map[string]bool)
+	c.pairKeyDeps = make(map[string][]string)
+	c.pairMutex.Unlock()
+	c.pairCache.Clear()
+}
+
+// forgetPairDeps is called when cached pairs are evicted or expire.
+func (c *cachedPushRawDatabase) forgetPairDeps(key string) {
+	c.pairMutex.Lock()
+	defer c.pairMutex.Unlock()
+	c.removePairDeps(key)
+}
+
+// removePairDeps must be called with pairMutex held.
+func (c *cachedPushRawDatabase) removePairDeps(key string) {
+	for _, dep := range c.pairKeyDeps[key] {
+		delete(c.pairDeps[dep], key)
+		if len(c.pairDeps[dep]) == 0 {
+			delete(c.pairDeps, dep)
+		}
+	}
+	delete(c.pairKeyDeps, key)
+}
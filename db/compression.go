@@ -0,0 +1,66 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package db
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"sync"
+)
+
+// gzipMagic starts every gzip stream. Uncompressed values start with the name of their push service type, so compressed values can be told apart.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+var gzipWriters = sync.Pool{
+	New: func() interface{} {
+		return gzip.NewWriter(nil)
+	},
+}
+
+// compressValue returns value compressed with gzip, or value itself if compressing doesn't make it smaller (e.g. for small delivery points).
+func compressValue(value []byte) []byte {
+	var buf bytes.Buffer
+	w := gzipWriters.Get().(*gzip.Writer)
+	defer gzipWriters.Put(w)
+	w.Reset(&buf)
+	if _, err := w.Write(value); err != nil {
+		return value
+	}
+	if err := w.Close(); err != nil {
+		return value
+	}
+	if buf.Len() >= len(value) {
+		return value
+	}
+	return buf.Bytes()
+}
+
+// decompressValue returns the uncompressed value of a value saved by compressValue. Values which aren't compressed are returned unchanged,
+// so that values saved before value_compression was changed can still be read.
+func decompressValue(value []byte) ([]byte, error) {
+	if !bytes.HasPrefix(value, gzipMagic) {
+		return value, nil
+	}
+	r, err := gzip.NewReader(bytes.NewReader(value))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
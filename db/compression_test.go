@@ -0,0 +1,48 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package db
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/uniqush/uniqush-push/testutil"
+)
+
+func TestCompressValue(t *testing.T) {
+	value := []byte(`apns:{"devtoken":"1","tags":"` + string(bytes.Repeat([]byte("sports,news,"), 50)) + `"}`)
+	compressed := compressValue(value)
+	if len(compressed) >= len(value) {
+		t.Fatalf("Expected %d bytes to be compressed, got %d bytes", len(value), len(compressed))
+	}
+	decompressed, err := decompressValue(compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectEquals(t, value, decompressed, "expected the compressed value to be decompressed")
+}
+
+func TestCompressValueKeepsSmallValues(t *testing.T) {
+	value := []byte(`apns:{"devtoken":"1"}`)
+	testutil.ExpectEquals(t, value, compressValue(value), "expected values which don't get smaller to be saved uncompressed")
+	decompressed, err := decompressValue(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectEquals(t, value, decompressed, "expected uncompressed values to be read unchanged")
+}
@@ -19,18 +19,82 @@ package db
 
 import (
 	"fmt"
+	"time"
+
+	"github.com/uniqush/log"
 	"github.com/uniqush/uniqush-push/push"
 )
 
+// Cache write policies, for DatabaseConfig.CacheWritePolicy.
+const (
+	// CacheWriteThrough writes every change to the database right away.
+	CacheWriteThrough = "write_through"
+	// CacheWriteBehind saves changes to delivery points and push service providers in memory, and writes them to the database in batches.
+	// Changes which weren't written yet are lost if uniqush-push crashes.
+	CacheWriteBehind = "write_behind"
+)
+
+// Encodings of delivery points and push service providers in the database, for DatabaseConfig.ValueEncoding.
+const (
+	// ValueEncodingJSON saves delivery points and push service providers as JSON, which every uniqush-push version can read.
+	ValueEncodingJSON = "json"
+	// ValueEncodingBinary saves them in a compact binary format (see push.PushPeer.AppendBinary), which uses less memory and is faster to read and write.
+	// Values saved in this format can't be read by older versions of uniqush-push.
+	ValueEncodingBinary = "binary"
+)
+
+// Compressions of delivery points in the database, for DatabaseConfig.ValueCompression.
+const (
+	// ValueCompressionNone saves delivery points uncompressed.
+	ValueCompressionNone = "none"
+	// ValueCompressionGzip compresses delivery points with gzip, which uses less memory (especially with many tags or attributes) but more CPU.
+	// Values which compression wouldn't make smaller are saved uncompressed. Compressed values can't be read by older versions of uniqush-push.
+	ValueCompressionGzip = "gzip"
+)
+
 // DatabaseConfig represents all of the configuration for a database implementation. Currently, the only db implementation is redis.
 type DatabaseConfig struct {
-	Engine    string
-	Name      string
-	User      string
-	Password  string
-	Host      string
-	Port      int
+	Engine   string
+	Name     string
+	User     string
+	Password string
+	Host     string
+	Port     int
+	// ValueEncoding is ValueEncodingJSON or ValueEncodingBinary. Values in either encoding can be read.
+	ValueEncoding string
+	// ValueCompression is ValueCompressionNone or ValueCompressionGzip. Compressed and uncompressed values can be read either way.
+	ValueCompression string
+	// Cache enables caching delivery points and push service providers in memory.
+	Cache bool
+	// CacheSize is the maximum number of delivery points (and of push service providers) to cache.
 	CacheSize int
+	// CacheShards is the number of segments of each cache, each with its own lock. If 0, DefaultCacheShards is used.
+	CacheShards int
+	// CacheMaxBytes is the maximum size of the cached delivery points (and of push service providers), in bytes. If 0, only CacheSize limits the caches.
+	CacheMaxBytes int64
+	// CacheNotFoundTTL is how long to remember delivery points and subscribers which weren't found. If 0, they aren't cached.
+	CacheNotFoundTTL time.Duration
+	// CacheDeliveryPointTTL and CachePushServiceProviderTTL are how long delivery points and push service providers stay cached. If 0, they stay cached until they are evicted or changed.
+	CacheDeliveryPointTTL       time.Duration
+	CachePushServiceProviderTTL time.Duration
+	// CacheSubscriberTTL is how long the delivery point names of a service+subscriber stay cached. If 0, they aren't cached.
+	CacheSubscriberTTL time.Duration
+	// CachePairTTL is how long the push service provider and delivery point pairs of a service+subscriber stay cached. If 0, they aren't cached.
+	CachePairTTL time.Duration
+	// CachePreload enables loading every push service provider into the cache at startup (see PushDatabase.PreloadCache).
+	CachePreload bool
+	// CachePreloadServices are the services whose subscribers and delivery points are also loaded at startup, up to CacheSize subscribers.
+	CachePreloadServices []string
+	// CacheWritePolicy is CacheWriteThrough or CacheWriteBehind. Write-behind uses EverySec and LeastDirty.
+	CacheWritePolicy string
+	// SlowQueryThreshold is the latency above which redis commands are logged to SlowQueryLogger and counted in uniqush_redis_slow_calls_total. If 0, they aren't.
+	SlowQueryThreshold time.Duration
+	// SlowQueryLogger receives the slow redis commands. If nil, they are only counted.
+	SlowQueryLogger log.Logger
+	// CredentialKeys encrypts the credentials of push service providers (e.g. apikey, clientsecret) before they are saved. If nil, they are saved in plaintext.
+	CredentialKeys *CredentialKeyring
+	// TenantEncryption encrypts the delivery points of the services of each tenant with a data key of the tenant, so that they can be crypto-shredded.
+	TenantEncryption bool
 
 	// Config for read-only slave (uses same Name as master db)
 	SlaveHost string
@@ -45,27 +109,6 @@ type DatabaseConfig struct {
 	PushServiceManager *push.PushServiceManager
 }
 
-/*
-const (
-    DEFAULT_DBCONF_FILE string = "/etc/uniqush.conf"
-)
-
-func LoadDatabaseConfig(filename string) (conf *DatabaseConfig, err os.Error) {
-    if len(filename) == 0 {
-        filename = DEFAULT_DBCONF_FILE
-    }
-    content, e := ioutil.ReadFile(filename)
-    if e != nil {
-        err = e
-        conf = nil
-        return
-    }
-    conf = new(DatabaseConfig)
-    err = json.Unmarshal(content, conf)
-    return
-}
-*/
-
 func (c *DatabaseConfig) String() string {
 	ret := fmt.Sprintf("engine: %v;\nname: %v;\nuser: %v;\npassowrd: %v;\nhost: %v\nport: %d\n",
 		c.Engine, c.Name, c.User, c.Password, c.Host, c.Port)
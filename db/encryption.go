@@ -0,0 +1,214 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package db
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// CredentialKeySize is the size of the master keys which encrypt the credentials of push service providers (AES-256).
+const CredentialKeySize = 32
+
+// encryptedCredentialPrefix starts every encrypted credential, followed by "<key id>:<wrapped data key>:<ciphertext>".
+// Credentials without it are plaintext, so that push service providers saved before encryption was enabled can still be read.
+const encryptedCredentialPrefix = "uniqush-enc:v1:"
+
+// IsCredentialField returns true if the field of a push service provider (or of an audit record) is a secret, such as an apikey, clientsecret or token.
+func IsCredentialField(name string) bool {
+	name = strings.ToLower(name)
+	for _, s := range []string{"key", "secret", "token", "password", "credential"} {
+		if strings.Contains(name, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// CredentialKeyring encrypts the credentials of push service providers with envelope encryption: each credential is encrypted
+// with its own random data key, which is encrypted with the primary master key. Previous master keys can still decrypt credentials,
+// until they are re-encrypted with the primary key after a rotation.
+//
+// Credentials are only encrypted at rest: PushRedisDB encrypts them when saving push service providers, and decrypts them when reading them.
+// Everything above the redis layer (the cache of NewCachedUniqushDatabase, push service types and /psps, which uniqushctl export relies on)
+// only ever sees plaintext credentials, and the cache never holds encrypted values.
+// This protects credentials in redis, its dumps and its replicas, but not in the memory of uniqush-push or from callers of /psps.
+type CredentialKeyring struct {
+	primaryID string
+	keys      map[string]cipher.AEAD
+}
+
+// NewCredentialKeyring returns a keyring encrypting with primary, and decrypting with primary or any of previous.
+// Keys are identified by a hash, so that credentials record which key encrypted them without configuring key ids.
+func NewCredentialKeyring(primary []byte, previous ...[]byte) (*CredentialKeyring, error) {
+	k := &CredentialKeyring{keys: make(map[string]cipher.AEAD)}
+	for i, key := range append([][]byte{primary}, previous...) {
+		if len(key) != CredentialKeySize {
+			return nil, fmt.Errorf("Credential keys must be %d bytes, got %d", CredentialKeySize, len(key))
+		}
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		id := credentialKeyID(key)
+		if i == 0 {
+			k.primaryID = id
+		}
+		k.keys[id] = aead
+	}
+	return k, nil
+}
+
+// PrimaryKeyID returns the id of the key which encrypts credentials.
+func (k *CredentialKeyring) PrimaryKeyID() string {
+	return k.primaryID
+}
+
+func credentialKeyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:4])
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts plaintext with aead and a random nonce, which is prepended to the ciphertext.
+// seal encrypts plaintext with a random nonce, which is prepended to the ciphertext.
+// additionalData is authenticated but not encrypted, and must be passed to open again.
+func seal(aead cipher.AEAD, plaintext, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func open(aead cipher.AEAD, sealed, additionalData []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("ciphertext is too short")
+	}
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], additionalData)
+}
+
+// Encrypt returns the encrypted form of a credential.
+func (k *CredentialKeyring) Encrypt(plaintext string) (string, error) {
+	dataKey := make([]byte, CredentialKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return "", err
+	}
+	wrapped, err := seal(k.keys[k.primaryID], dataKey, nil)
+	if err != nil {
+		return "", err
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return "", err
+	}
+	ciphertext, err := seal(aead, []byte(plaintext), nil)
+	if err != nil {
+		return "", err
+	}
+	return encryptedCredentialPrefix + k.primaryID + ":" + base64.RawStdEncoding.EncodeToString(wrapped) + ":" + base64.RawStdEncoding.EncodeToString(ciphertext), nil
+}
+
+// IsEncryptedCredential returns true if value was returned by Encrypt.
+func IsEncryptedCredential(value string) bool {
+	return strings.HasPrefix(value, encryptedCredentialPrefix)
+}
+
+// Decrypt returns the plaintext of a credential returned by Encrypt. Values which aren't encrypted are returned unchanged.
+// A nil keyring can only read values which aren't encrypted.
+func (k *CredentialKeyring) Decrypt(value string) (string, error) {
+	if !IsEncryptedCredential(value) {
+		return value, nil
+	}
+	parts := strings.Split(value[len(encryptedCredentialPrefix):], ":")
+	if len(parts) != 3 {
+		return "", errors.New("invalid encrypted credential")
+	}
+	if k == nil {
+		return "", fmt.Errorf("credential is encrypted with key %s, but no credential key is configured", parts[0])
+	}
+	kek, ok := k.keys[parts[0]]
+	if !ok {
+		return "", fmt.Errorf("credential is encrypted with unknown key %s", parts[0])
+	}
+	wrapped, err := base64.RawStdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", fmt.Errorf("invalid encrypted credential: %v", err)
+	}
+	ciphertext, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", fmt.Errorf("invalid encrypted credential: %v", err)
+	}
+	dataKey, err := open(kek, wrapped, nil)
+	if err != nil {
+		return "", fmt.Errorf("cannot decrypt the data key of a credential with key %s: %v", parts[0], err)
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := open(aead, ciphertext, nil)
+	if err != nil {
+		return "", fmt.Errorf("cannot decrypt credential: %v", err)
+	}
+	return string(plaintext), nil
+}
+
+// encryptFields encrypts the credential fields of a push service provider in place. Fields which are already encrypted are left as they are.
+func (k *CredentialKeyring) encryptFields(fields map[string]string) error {
+	for name, value := range fields {
+		if value == "" || !IsCredentialField(name) || IsEncryptedCredential(value) {
+			continue
+		}
+		encrypted, err := k.Encrypt(value)
+		if err != nil {
+			return fmt.Errorf("cannot encrypt %s: %v", name, err)
+		}
+		fields[name] = encrypted
+	}
+	return nil
+}
+
+// decryptFields decrypts the encrypted fields of a push service provider read from the database, in place.
+func (k *CredentialKeyring) decryptFields(fields map[string]string) error {
+	for name, value := range fields {
+		if !IsEncryptedCredential(value) {
+			continue
+		}
+		plaintext, err := k.Decrypt(value)
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		fields[name] = plaintext
+	}
+	return nil
+}
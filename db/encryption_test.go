@@ -0,0 +1,141 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package db
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/uniqush/uniqush-push/testutil"
+)
+
+func TestCredentialKeyring(t *testing.T) {
+	oldKey := bytes.Repeat([]byte{1}, CredentialKeySize)
+	newKey := bytes.Repeat([]byte{2}, CredentialKeySize)
+	old, err := NewCredentialKeyring(oldKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := old.Encrypt("AIzaSyD-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsEncryptedCredential(encrypted) || strings.Contains(encrypted, "secret") {
+		t.Fatalf("expected an encrypted credential, got %q", encrypted)
+	}
+	again, _ := old.Encrypt("AIzaSyD-secret")
+	if again == encrypted {
+		t.Error("expected each credential to be encrypted with its own data key")
+	}
+
+	rotated, err := NewCredentialKeyring(newKey, oldKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext, err := rotated.Decrypt(encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectStringEquals(t, "AIzaSyD-secret", plaintext, "expected previous keys to decrypt credentials")
+	reencrypted, _ := rotated.Encrypt(plaintext)
+	testutil.ExpectStringEquals(t, encryptedCredentialPrefix+rotated.PrimaryKeyID()+":", reencrypted[:len(encryptedCredentialPrefix)+9], "expected the primary key to encrypt credentials")
+	if _, err := old.Decrypt(reencrypted); err == nil {
+		t.Error("expected credentials encrypted with an unknown key not to be decrypted")
+	}
+	if _, err := (*CredentialKeyring)(nil).Decrypt(encrypted); err == nil {
+		t.Error("expected encrypted credentials not to be read without a key")
+	}
+	tampered := encrypted[:len(encrypted)-2] + "AA"
+	if _, err := old.Decrypt(tampered); err == nil {
+		t.Error("expected tampered credentials to be rejected")
+	}
+
+	plaintext, err = (*CredentialKeyring)(nil).Decrypt("AIzaSyD-plaintext")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectStringEquals(t, "AIzaSyD-plaintext", plaintext, "expected credentials saved before encryption to be read unchanged")
+
+	if _, err := NewCredentialKeyring([]byte("short")); err == nil {
+		t.Error("expected keys of the wrong size to be rejected")
+	}
+}
+
+func TestEncryptCredentialFields(t *testing.T) {
+	k, err := NewCredentialKeyring(bytes.Repeat([]byte{1}, CredentialKeySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := map[string]string{"service": "myapp", "clientid": "amzn1.id", "clientsecret": "s3cr3t", "token": ""}
+	if err := k.encryptFields(fields); err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectStringEquals(t, "myapp", fields["service"], "expected fields other than credentials not to be encrypted")
+	testutil.ExpectStringEquals(t, "", fields["token"], "expected empty credentials not to be encrypted")
+	if !IsEncryptedCredential(fields["clientsecret"]) {
+		t.Fatalf("expected clientsecret to be encrypted, got %q", fields["clientsecret"])
+	}
+	encrypted := fields["clientsecret"]
+	if err := k.encryptFields(fields); err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectStringEquals(t, encrypted, fields["clientsecret"], "expected encrypted credentials not to be encrypted twice")
+	if err := k.decryptFields(fields); err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectStringEquals(t, "s3cr3t", fields["clientsecret"], "expected credentials to be decrypted")
+}
+
+func TestSealTenantValue(t *testing.T) {
+	dataKey, err := newAEAD(bytes.Repeat([]byte{3}, CredentialKeySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	value := []byte(`apns:[{"service":"checkout","subscriber":"user1","devtoken":"abcd"},{}]`)
+	sealed, err := sealTenantValue("payments", dataKey, value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(sealed, []byte("user1")) {
+		t.Fatalf("expected the delivery point to be encrypted, got %q", sealed)
+	}
+	tenant, ciphertext, additionalData, ok := splitTenantValue(sealed)
+	testutil.ExpectEquals(t, true, ok, "expected an encrypted value")
+	testutil.ExpectStringEquals(t, "payments", tenant, "expected the tenant of the data key")
+	plaintext, err := open(dataKey, ciphertext, additionalData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectStringEquals(t, string(value), string(plaintext), "expected the data key to decrypt the delivery point")
+	moved := append([]byte(tenantEncryptedPrefix+"billing:"), ciphertext...)
+	_, ciphertext, additionalData, _ = splitTenantValue(moved)
+	if _, err := open(dataKey, ciphertext, additionalData); err == nil {
+		t.Error("expected a ciphertext moved to another tenant not to decrypt, even with the same data key")
+	}
+	if _, _, _, ok := splitTenantValue(value); ok {
+		t.Error("expected unencrypted values not to be split")
+	}
+
+	r := &PushRedisDB{tenantKeys: newTenantDataKeys()}
+	unencrypted, err := r.deliveryPointValue("checkout", value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectStringEquals(t, string(value), string(unencrypted), "expected delivery points not to be encrypted without tenant_encryption")
+}
@@ -0,0 +1,54 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package db
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+// Error is returned when a database operation fails. It carries the operation and the key it failed on, and the underlying error.
+// Err can be checked with Unwrap (or errors.Is and errors.As, with go 1.13 or newer).
+type Error struct {
+	Op  string
+	Key string
+	Err error
+}
+
+func (e *Error) Error() string {
+	if e.Key == "" {
+		return fmt.Sprintf("%s failed: %v", e.Op, e.Err)
+	}
+	return fmt.Sprintf("%s %q failed: %v", e.Op, e.Key, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Temporary returns true if the operation failed because the database couldn't be reached or timed out, and may succeed if retried.
+func (e *Error) Temporary() bool {
+	var netErr net.Error
+	return errors.As(e.Err, &netErr)
+}
+
+func newError(op, key string, err error) error {
+	return &Error{Op: op, Key: key, Err: err}
+}
@@ -0,0 +1,66 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/uniqush/uniqush-push/testutil"
+)
+
+func TestError(t *testing.T) {
+	cause := errors.New("READONLY You can't write against a read only replica.")
+	err := newError("SetDeliveryPoint", "delivery.point:dp1", cause)
+	testutil.ExpectStringEquals(t, `SetDeliveryPoint "delivery.point:dp1" failed: READONLY You can't write against a read only replica.`, err.Error(), "unexpected message")
+	dbErr, ok := err.(*Error)
+	testutil.ExpectEquals(t, true, ok, "expected a *Error")
+	testutil.ExpectEquals(t, cause, dbErr.Unwrap(), "expected the underlying error")
+	testutil.ExpectEquals(t, false, dbErr.Temporary(), "expected redis errors not to be temporary")
+
+	err = newError("GetServices", "", &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")})
+	testutil.ExpectStringEquals(t, "GetServices failed: dial tcp: connection refused", err.Error(), "unexpected message")
+	testutil.ExpectEquals(t, true, err.(*Error).Temporary(), "expected network errors to be temporary")
+
+	err = newError("HoldPush", HeldPushesKey, fmt.Errorf("write: %w", &net.OpError{Op: "write", Net: "tcp", Err: errors.New("broken pipe")}))
+	testutil.ExpectEquals(t, true, err.(*Error).Temporary(), "expected network errors wrapped by other errors to be temporary")
+}
+
+type failingRawDatabase struct {
+	pushRawDatabase
+	err error
+}
+
+func (r *failingRawDatabase) GetServiceNames() ([]string, error) {
+	return nil, r.err
+}
+
+func (r *failingRawDatabase) HoldPush(data []byte) error {
+	return r.err
+}
+
+func TestPushDatabaseWrapsErrors(t *testing.T) {
+	cause := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	f := &pushDatabaseOpts{db: &failingRawDatabase{err: newError("GetServiceNames", ServicesSet, cause)}}
+	_, err := f.GetPushServiceProviderConfigs()
+	dbErr, ok := err.(*Error)
+	testutil.ExpectEquals(t, true, ok, "expected a *Error")
+	testutil.ExpectStringEquals(t, "GetServiceNames", dbErr.Op, "expected the operation of the front desk")
+	inner, ok := dbErr.Unwrap().(*Error)
+	testutil.ExpectEquals(t, true, ok, "expected the error of the redis database to be wrapped")
+	testutil.ExpectEquals(t, true, inner.Temporary(), "expected the network error to be kept")
+	testutil.ExpectEquals(t, true, dbErr.Temporary(), "expected wrapped network errors to be temporary")
+}
+
+func TestPushDatabaseWrapsErrorsOfOtherOperations(t *testing.T) {
+	cause := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	f := &pushDatabaseOpts{db: &failingRawDatabase{err: newError("HoldPush", HeldPushesKey, cause)}}
+	err := f.HoldPush([]byte("push"))
+	dbErr, ok := err.(*Error)
+	testutil.ExpectEquals(t, true, ok, "expected a *Error")
+	testutil.ExpectStringEquals(t, "HoldPush", dbErr.Op, "expected the operation of the front desk")
+	testutil.ExpectEquals(t, true, dbErr.Temporary(), "expected wrapped network errors to be temporary")
+
+	f = &pushDatabaseOpts{db: &failingRawDatabase{}}
+	testutil.ExpectEquals(t, nil, f.HoldPush([]byte("push")), "expected no error when the operation succeeds")
+}
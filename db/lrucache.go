@@ -0,0 +1,246 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package db
+
+import (
+	"container/list"
+	"sort"
+	"sync"
+	"time"
+)
+
+// CacheStats are the counters of one of the caches of a cached database, for monitoring.
+type CacheStats struct {
+	Name       string `json:"name"`
+	Entries    int    `json:"entries"`
+	Bytes      int64  `json:"bytes"`
+	MaxEntries int    `json:"maxEntries"`
+	MaxBytes   int64  `json:"maxBytes,omitempty"`
+	Hits       uint64 `json:"hits"`
+	Misses     uint64 `json:"misses"`
+	Evictions  uint64 `json:"evictions"`
+	// MemoryBytes estimates the memory used by the cache, including the keys and the bookkeeping of each entry (see lruEntryOverhead).
+	MemoryBytes int64 `json:"memoryBytes"`
+	// HotKeys are the cached keys with the most hits since they were cached, if they were requested.
+	HotKeys []CacheKeyHits `json:"hotKeys,omitempty"`
+}
+
+// CacheKeyHits is the number of hits of a cached key.
+type CacheKeyHits struct {
+	Key  string `json:"key"`
+	Hits uint64 `json:"hits"`
+}
+
+// lruEntryOverhead estimates the memory used by each entry besides its key and value: the list element, the lruEntry and the map entry.
+const lruEntryOverhead = 160
+
+type lruEntry struct {
+	key     string
+	value   []byte
+	expires time.Time
+	hits    uint64
+}
+
+// lruCache is a cache of serialized values bounded by a number of entries and (optionally) by the total size of the values.
+// The least recently used entries are evicted first.
+type lruCache struct {
+	mutex sync.Mutex
+	order *list.List
+	items map[string]*list.Element
+	bytes int64
+	stats CacheStats
+	now   func() time.Time
+	// onEvict, if set, is called with the keys of entries which were evicted or expired (but not removed), after unlocking the cache.
+	onEvict func(key string)
+	// keyBytes is the total length of the keys, to estimate the memory used.
+	keyBytes int64
+}
+
+// newLRUCache creates a cache of at most maxEntries entries. If maxBytes isn't 0, the values are limited to maxBytes in total.
+func newLRUCache(name string, maxEntries int, maxBytes int64) *lruCache {
+	return &lruCache{
+		order: list.New(),
+		items: make(map[string]*list.Element),
+		stats: CacheStats{Name: name, MaxEntries: maxEntries, MaxBytes: maxBytes},
+		now:   time.Now,
+	}
+}
+
+// Get returns the cached value of key, or nil if it isn't cached (or has expired).
+func (c *lruCache) Get(key string) []byte {
+	c.mutex.Lock()
+	elem, ok := c.items[key]
+	expired := ok && c.expired(elem.Value.(*lruEntry))
+	if expired {
+		c.remove(key)
+		ok = false
+	}
+	var value []byte
+	if ok {
+		c.stats.Hits++
+		c.order.MoveToFront(elem)
+		entry := elem.Value.(*lruEntry)
+		entry.hits++
+		value = entry.value
+	} else {
+		c.stats.Misses++
+	}
+	c.mutex.Unlock()
+	if expired {
+		c.evicted([]string{key})
+	}
+	return value
+}
+
+func (c *lruCache) expired(entry *lruEntry) bool {
+	return !entry.expires.IsZero() && !c.now().Before(entry.expires)
+}
+
+// Set caches the value of key for ttl (or until it is evicted, if ttl is 0), evicting the least recently used entries if the cache is full.
+// Values larger than the cache are not cached.
+func (c *lruCache) Set(key string, value []byte, ttl time.Duration) {
+	c.mutex.Lock()
+	evicted := c.set(key, value, ttl)
+	c.mutex.Unlock()
+	c.evicted(evicted)
+}
+
+// set caches the value of key, and returns the keys of the evicted entries.
+func (c *lruCache) set(key string, value []byte, ttl time.Duration) []string {
+	if c.stats.MaxBytes > 0 && int64(len(value)) > c.stats.MaxBytes {
+		if _, ok := c.items[key]; ok {
+			c.remove(key)
+			return []string{key}
+		}
+		return nil
+	}
+	var expires time.Time
+	if ttl > 0 {
+		expires = c.now().Add(ttl)
+	}
+	if elem, ok := c.items[key]; ok {
+		entry := elem.Value.(*lruEntry)
+		c.bytes += int64(len(value) - len(entry.value))
+		entry.value = value
+		entry.expires = expires
+		c.order.MoveToFront(elem)
+	} else {
+		c.items[key] = c.order.PushFront(&lruEntry{key: key, value: value, expires: expires})
+		c.bytes += int64(len(value))
+		c.keyBytes += int64(len(key))
+	}
+	return c.evictOverflow()
+}
+
+// evictOverflow evicts the least recently used entries until the cache is within its limits, and returns their keys.
+func (c *lruCache) evictOverflow() []string {
+	var evicted []string
+	for c.order.Len() > c.stats.MaxEntries || (c.stats.MaxBytes > 0 && c.bytes > c.stats.MaxBytes) {
+		oldest := c.order.Back().Value.(*lruEntry).key
+		c.remove(oldest)
+		c.stats.Evictions++
+		evicted = append(evicted, oldest)
+	}
+	return evicted
+}
+
+// Resize changes the limits of the cache, evicting the least recently used entries if it is now too large.
+func (c *lruCache) Resize(maxEntries int, maxBytes int64) {
+	c.mutex.Lock()
+	c.stats.MaxEntries, c.stats.MaxBytes = maxEntries, maxBytes
+	evicted := c.evictOverflow()
+	c.mutex.Unlock()
+	c.evicted(evicted)
+}
+
+func (c *lruCache) evicted(keys []string) {
+	if c.onEvict == nil {
+		return
+	}
+	for _, key := range keys {
+		c.onEvict(key)
+	}
+}
+
+// Remove removes key from the cache, e.g. because its value changed.
+func (c *lruCache) Remove(key string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.remove(key)
+}
+
+// Clear removes every entry from the cache, e.g. because changes to their values may have been missed.
+func (c *lruCache) Clear() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.order.Init()
+	c.items = make(map[string]*list.Element)
+	c.bytes = 0
+	c.keyBytes = 0
+}
+
+func (c *lruCache) remove(key string) {
+	elem, ok := c.items[key]
+	if !ok {
+		return
+	}
+	c.order.Remove(elem)
+	delete(c.items, key)
+	c.bytes -= int64(len(elem.Value.(*lruEntry).value))
+	c.keyBytes -= int64(len(key))
+}
+
+// Stats returns the current counters of the cache.
+func (c *lruCache) Stats() CacheStats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	stats := c.stats
+	stats.Entries = c.order.Len()
+	stats.Bytes = c.bytes
+	stats.MemoryBytes = c.bytes + c.keyBytes + int64(stats.Entries)*lruEntryOverhead
+	return stats
+}
+
+// HotKeys returns the n cached keys with the most hits, most hit first. This looks at every entry, so it is meant for occasional introspection.
+func (c *lruCache) HotKeys(n int) []CacheKeyHits {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	var top []CacheKeyHits
+	for key, elem := range c.items {
+		if hits := elem.Value.(*lruEntry).hits; hits > 0 {
+			top = addHotKey(top, CacheKeyHits{Key: key, Hits: hits}, n)
+		}
+	}
+	return top
+}
+
+// addHotKey inserts k into top, which is sorted by decreasing hits, keeping at most n keys.
+func addHotKey(top []CacheKeyHits, k CacheKeyHits, n int) []CacheKeyHits {
+	i := sort.Search(len(top), func(i int) bool {
+		return top[i].Hits < k.Hits || (top[i].Hits == k.Hits && top[i].Key > k.Key)
+	})
+	if i >= n {
+		return top
+	}
+	if len(top) < n {
+		top = append(top, CacheKeyHits{})
+	}
+	copy(top[i+1:], top[i:])
+	top[i] = k
+	return top
+}
@@ -0,0 +1,118 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package db
+
+import (
+	"testing"
+	"time"
+
+	"github.com/uniqush/uniqush-push/testutil"
+)
+
+func TestLRUCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := newLRUCache("test", 2, 0)
+	c.Set("a", []byte("1"), 0)
+	c.Set("b", []byte("2"), 0)
+	c.Get("a")
+	c.Set("c", []byte("3"), 0)
+
+	testutil.ExpectEquals(t, []byte(nil), c.Get("b"), "expected the least recently used entry to be evicted")
+	testutil.ExpectEquals(t, []byte("1"), c.Get("a"), "expected a to be cached")
+	testutil.ExpectEquals(t, []byte("3"), c.Get("c"), "expected c to be cached")
+	testutil.ExpectEquals(t, CacheStats{Name: "test", Entries: 2, Bytes: 2, MaxEntries: 2, Hits: 3, Misses: 1, Evictions: 1, MemoryBytes: 4 + 2*lruEntryOverhead}, c.Stats(), "unexpected stats")
+}
+
+func TestLRUCacheMaxBytes(t *testing.T) {
+	c := newLRUCache("test", 10, 5)
+	c.Set("a", []byte("123"), 0)
+	c.Set("b", []byte("45"), 0)
+	c.Set("c", []byte("6"), 0)
+	testutil.ExpectEquals(t, []byte(nil), c.Get("a"), "expected a to be evicted to stay within max bytes")
+
+	c.Set("d", []byte("too large"), 0)
+	testutil.ExpectEquals(t, []byte(nil), c.Get("d"), "expected values larger than the cache not to be cached")
+
+	c.Remove("b")
+	stats := c.Stats()
+	testutil.ExpectEquals(t, 1, stats.Entries, "unexpected number of entries")
+	testutil.ExpectEquals(t, int64(1), stats.Bytes, "unexpected number of bytes")
+}
+
+func TestLRUCacheResize(t *testing.T) {
+	c := newLRUCache("test", 3, 0)
+	c.Set("a", []byte("1"), 0)
+	c.Set("b", []byte("2"), 0)
+	c.Set("c", []byte("3"), 0)
+	c.Get("a")
+	c.Resize(2, 0)
+	testutil.ExpectEquals(t, []byte(nil), c.Get("b"), "expected the least recently used entry to be evicted when shrinking the cache")
+	testutil.ExpectEquals(t, 2, c.Stats().Entries, "unexpected number of entries")
+
+	c.Resize(4, 0)
+	c.Set("d", []byte("4"), 0)
+	c.Set("e", []byte("5"), 0)
+	testutil.ExpectEquals(t, 4, c.Stats().Entries, "expected more entries to be cached after growing the cache")
+	testutil.ExpectEquals(t, 4, c.Stats().MaxEntries, "unexpected limit")
+}
+
+func TestLRUCacheExpiry(t *testing.T) {
+	now := time.Unix(1000, 0)
+	c := newLRUCache("test", 10, 0)
+	c.now = func() time.Time { return now }
+	c.Set("a", []byte{}, 5*time.Second)
+	c.Set("b", []byte("2"), 0)
+
+	now = now.Add(4 * time.Second)
+	testutil.ExpectEquals(t, []byte{}, c.Get("a"), "expected a to be cached until it expires")
+	now = now.Add(time.Second)
+	testutil.ExpectEquals(t, []byte(nil), c.Get("a"), "expected a to expire")
+	testutil.ExpectEquals(t, []byte("2"), c.Get("b"), "expected entries without a ttl not to expire")
+	testutil.ExpectEquals(t, 1, c.Stats().Entries, "expected the expired entry to be removed")
+}
+
+func TestLRUCacheHotKeys(t *testing.T) {
+	c := newLRUCache("test", 10, 0)
+	for _, key := range []string{"a", "b", "c", "d"} {
+		c.Set(key, []byte("1"), 0)
+	}
+	for _, key := range []string{"b", "c", "b", "a", "b", "c"} {
+		c.Get(key)
+	}
+	testutil.ExpectEquals(t, []CacheKeyHits{{"b", 3}, {"c", 2}}, c.HotKeys(2), "unexpected hot keys")
+	testutil.ExpectEquals(t, []CacheKeyHits{{"b", 3}, {"c", 2}, {"a", 1}}, c.HotKeys(10), "expected keys without hits to be left out")
+}
+
+func TestShardedCache(t *testing.T) {
+	c := newShardedCache("test", 4, 100, 0)
+	testutil.ExpectEquals(t, 4, len(c.shards), "unexpected number of segments")
+	for i := 0; i < 100; i++ {
+		c.Set(string(rune('a'+i%26))+string(rune('0'+i/26)), []byte("v"), 0)
+	}
+	c.Get("a0")
+	c.Get("missing")
+	stats := c.Stats()
+	testutil.ExpectEquals(t, "test", stats.Name, "unexpected name")
+	testutil.ExpectEquals(t, 100, stats.MaxEntries, "expected the segments to share the limit")
+	testutil.ExpectEquals(t, uint64(1), stats.Hits, "unexpected hits")
+	testutil.ExpectEquals(t, uint64(1), stats.Misses, "unexpected misses")
+	testutil.ExpectEquals(t, stats.Entries+int(stats.Evictions), 100, "expected every entry to be cached or evicted")
+	testutil.ExpectEquals(t, []CacheKeyHits{{"a0", 1}}, c.HotKeys(5), "expected the hot keys of every segment")
+
+	small := newShardedCache("small", 16, 2, 0)
+	testutil.ExpectEquals(t, 2, len(small.shards), "expected no more segments than entries")
+}
@@ -19,13 +19,16 @@
 package db
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/uniqush/log"
 	"github.com/uniqush/uniqush-push/push"
+	"github.com/uniqush/uniqush-push/tracing"
 )
 
 const (
@@ -39,6 +42,12 @@ type PushServiceProviderDeliveryPointPair struct {
 	DeliveryPoint       *push.DeliveryPoint
 }
 
+// StagedPushServiceProvider is a push service provider with staged credentials, and the state of the staging (a json blob).
+type StagedPushServiceProvider struct {
+	PushServiceProvider *push.PushServiceProvider
+	State               []byte
+}
+
 // isErrCausedByMissingKey checks if an error is caused by a missing redis key. It uses string comparisons because err's type may be erased, and doesn't exist to begin with.
 func isErrCausedByMissingKey(err error) bool {
 	// TODO - fix this check.
@@ -63,6 +72,17 @@ type PushDatabase interface {
 
 	ModifyPushServiceProvider(psp *push.PushServiceProvider) error
 
+	// AddFallbackPushServiceProviderToService registers fallback as the push service provider to fail over to
+	// when the service's existing push service provider of the same push service type rejects a push or is unavailable.
+	// The fallback isn't used for new subscriptions.
+	// Return value: the name of the primary push service provider, error
+	AddFallbackPushServiceProviderToService(service string, fallback *push.PushServiceProvider) (string, error)
+
+	RemoveFallbackPushServiceProviderFromService(service string, fallback *push.PushServiceProvider) error
+
+	// GetFallbackPushServiceProvider returns the fallback of the given push service provider, or nil if there is none.
+	GetFallbackPushServiceProvider(psp *push.PushServiceProvider) (*push.PushServiceProvider, error)
+
 	// Get a set of all push service providers
 	GetPushServiceProviderConfigs() ([]*push.PushServiceProvider, error)
 
@@ -85,11 +105,215 @@ type PushDatabase interface {
 
 	ModifyDeliveryPoint(dp *push.DeliveryPoint) error
 
+	// GetPushServiceProvidersByService returns the names of the push service providers of service.
+	GetPushServiceProvidersByService(service string) ([]string, error)
+
+	// GetPushServiceProviders returns the push service providers with the given names, fetched in one batch.
+	// Names of push service providers which don't exist are absent from the result.
+	GetPushServiceProviders(names []string) (map[string]*push.PushServiceProvider, error)
+
 	GetPushServiceProviderDeliveryPointPairs(service string, subscriber string, dpNamesRequested []string) ([]PushServiceProviderDeliveryPointPair, error)
 
+	// GetPushServiceProviderDeliveryPointPairsOfSubscribers returns the pairs and the errors of each subscriber,
+	// looking up the push service providers of all of the subscribers in one batch. The lookups are traced as children of the span of ctx.
+	GetPushServiceProviderDeliveryPointPairsOfSubscribers(ctx context.Context, service string, subscribers []string, dpNamesRequested []string) (map[string][]PushServiceProviderDeliveryPointPair, map[string]error)
+
 	GetSubscriptions(services []string, user string, logger log.Logger) ([]map[string]string, error)
 
 	FlushCache() error
+
+	// CacheStats returns the counters and estimated memory usage of the in-memory caches, or nil if the database isn't cached.
+	// If hotKeys isn't 0, the hotKeys keys of each cache with the most hits are included.
+	CacheStats(hotKeys int) []CacheStats
+
+	// ResizeCaches changes the limits of the in-memory caches (see DatabaseConfig.CacheSize and CacheMaxBytes), e.g. when the config file is reloaded.
+	// Returns false if the database isn't cached.
+	ResizeCaches(maxEntries int, maxBytes int64) bool
+
+	// Ping returns an error if the database can't be reached, for /readyz.
+	Ping() error
+
+	// Time returns the clock of the database server, to check that the clocks of the instances sharing it agree.
+	Time() (time.Time, error)
+
+	// PreloadCache loads every push service provider (and the subscribers of the services in DatabaseConfig.CachePreloadServices) into the in-memory caches.
+	// Returns the number of entries loaded. Does nothing if the database isn't cached.
+	PreloadCache() (int, error)
+
+	// AcquireLease atomically claims the named lease for owner, which expires after ttl unless renewed.
+	// This lets multiple uniqush-push instances sharing a database agree on which one runs a job.
+	// Returns false if a different owner already holds the lease.
+	AcquireLease(name, owner string, ttl time.Duration) (bool, error)
+
+	// RenewLease extends the named lease to expire ttl from now. Returns false if owner no longer holds it.
+	RenewLease(name, owner string, ttl time.Duration) (bool, error)
+
+	// ReleaseLease gives up the named lease, if owner still holds it.
+	ReleaseLease(name, owner string) error
+
+	// SetClusterMember saves the heartbeat of the uniqush-push instance with the given id, replacing the previous one.
+	SetClusterMember(id string, data []byte) error
+	// GetClusterMembers returns the last heartbeat of every instance in the cluster (including ones which stopped), by id.
+	GetClusterMembers() (map[string][]byte, error)
+	// RemoveClusterMembers removes the heartbeats of the instances with the given ids.
+	RemoveClusterMembers(ids ...string) error
+
+	// SetMaintenance saves the state of maintenance mode, or turns it off if data is nil.
+	SetMaintenance(data []byte) error
+	// GetMaintenance returns the state of maintenance mode, or nil if it is off.
+	GetMaintenance() ([]byte, error)
+	// HoldPush adds a push request to the back of the queue of pushes held during maintenance mode.
+	HoldPush(data []byte) error
+	// ClaimHeldPushes moves up to count push requests from the front of the queue of held pushes to the pushes being sent, and returns them oldest first.
+	// Push requests claimed more than timeout ago which weren't acknowledged with AckHeldPush are first moved back to the front of the queue,
+	// so a push request is sent at least once, even if the instance sending it crashes.
+	ClaimHeldPushes(count int64, timeout time.Duration) ([][]byte, error)
+	// AckHeldPush removes a push request claimed with ClaimHeldPushes from the pushes being sent, once it was sent (or held again).
+	AckHeldPush(data []byte) error
+	// CountHeldPushes returns the number of push requests in the queue of held pushes, including those being sent.
+	CountHeldPushes() (int64, error)
+
+	// SetStagedPushServiceProvider saves psp as the staged credentials of the push service provider with the same name, along with the state of the staging.
+	SetStagedPushServiceProvider(psp *push.PushServiceProvider, state []byte) error
+	// GetStagedPushServiceProviders returns the staged credentials of push service providers, by name.
+	GetStagedPushServiceProviders() (map[string]StagedPushServiceProvider, error)
+	// RemoveStagedPushServiceProvider removes the staged credentials of the push service provider named name.
+	RemoveStagedPushServiceProvider(name string) error
+
+	// SetFeatureFlag enables or disables the feature flag named name ("<flag>:<service>", or "<flag>:*" for every service).
+	SetFeatureFlag(name string, enabled bool) error
+	// GetFeatureFlags returns whether each feature flag which was set is enabled, by name.
+	GetFeatureFlags() (map[string]bool, error)
+	// RemoveFeatureFlag removes the feature flag named name, so that the default applies again.
+	RemoveFeatureFlag(name string) error
+
+	// IncrPayloadFailures counts a rejection of the payload with the given fingerprint, and returns the number of rejections in the last window.
+	IncrPayloadFailures(fingerprint string, window time.Duration) (int64, error)
+	// QuarantinePayload saves a record of why a payload was quarantined. The payload is released after ttl.
+	QuarantinePayload(fingerprint string, record []byte, ttl time.Duration) error
+	// GetQuarantinedPayload returns the record of a quarantined payload, or nil if it isn't quarantined.
+	GetQuarantinedPayload(fingerprint string) ([]byte, error)
+	// GetQuarantinedPayloads returns the records of all quarantined payloads, by fingerprint.
+	GetQuarantinedPayloads() (map[string][]byte, error)
+	// ReleaseQuarantinedPayload releases a quarantined payload before it expires.
+	ReleaseQuarantinedPayload(fingerprint string) error
+
+	// AddDeliveryRecord saves a record of the result of a push to a subscriber, keeping only the newest maxRecords.
+	// The subscriber's records are deleted if no records are added for the retention period.
+	AddDeliveryRecord(service, subscriber string, record []byte, maxRecords int64, retention time.Duration) error
+	// GetDeliveryRecords returns the saved records of pushes to a subscriber, newest first.
+	GetDeliveryRecords(service, subscriber string) ([][]byte, error)
+
+	// AddInboxMessage saves a message to the inbox of a subscriber, keeping only the newest maxMessages.
+	// The subscriber's inbox is deleted if no messages are added for the retention period.
+	AddInboxMessage(service, subscriber string, message []byte, maxMessages int64, retention time.Duration) error
+	// GetInboxMessages returns the messages in the inbox of a subscriber, newest first.
+	GetInboxMessages(service, subscriber string) ([][]byte, error)
+	// RemoveInboxMessage removes a message, as returned by GetInboxMessages, from the inbox of a subscriber.
+	RemoveInboxMessage(service, subscriber string, message []byte) error
+	// CompactDeliveryHistories forgets the histories of subscribers without pushes since idleBefore (a unix timestamp),
+	// then deletes the least recently pushed histories beyond maxSubscribers (unless it is 0). Returns the number of deleted histories.
+	CompactDeliveryHistories(idleBefore int64, maxSubscribers int64) (int64, error)
+
+	// IncrAnalyticsCounts adds counts to the counters (e.g. of sent pushes) of a service for the hour starting at the unix timestamp hour.
+	// The counters of an hour are deleted after the retention period.
+	IncrAnalyticsCounts(service string, hour int64, counts map[string]int64, retention time.Duration) error
+	// GetAnalyticsCounts returns the counters of a service for each of the hours.
+	GetAnalyticsCounts(service string, hours []int64) ([]map[string]int64, error)
+
+	// IncrUsageCounts adds counts to the usage counters (e.g. of the requests of an API key) of the day starting at the unix timestamp day.
+	// The counters of a day are deleted after the retention period.
+	IncrUsageCounts(day int64, counts map[string]int64, retention time.Duration) error
+	// GetUsageCounts returns the usage counters of each of the days.
+	GetUsageCounts(days []int64) ([]map[string]int64, error)
+
+	// AddAuditRecord saves a record of an administrative operation to the audit log, keeping only the newest maxRecords.
+	AddAuditRecord(record []byte, maxRecords int64) error
+	// GetAuditRecords returns the records of the audit log from index start to stop (inclusive, 0 being the newest record), newest first.
+	GetAuditRecords(start, stop int64) ([][]byte, error)
+	// TrimAuditRecords removes the n oldest records of the audit log.
+	TrimAuditRecords(n int64) error
+
+	// SetAPIKey saves the record of an API key, replacing the previous one.
+	SetAPIKey(id string, record []byte) error
+	// GetAPIKey returns the record of an API key, or nil if there is no such key.
+	GetAPIKey(id string) ([]byte, error)
+	// GetAPIKeys returns the records of all API keys, by id.
+	GetAPIKeys() (map[string][]byte, error)
+
+	// SetTenant saves the record of a tenant, replacing the previous one.
+	SetTenant(id string, record []byte) error
+	// RemoveTenant removes the record of a tenant and its subscribers.
+	RemoveTenant(id string) error
+	// SetTenantServices makes the data key of a tenant encrypt the delivery points saved for its services (if tenant encryption is enabled).
+	SetTenantServices(tenant string, services []string) error
+	// ShredTenantDataKey deletes the data key of a tenant, so that the delivery points of its services can no longer be read.
+	ShredTenantDataKey(tenant string) error
+	// EncryptDeliveryPointOfService returns data encrypted the way the delivery points of service are saved (with the data key of its tenant),
+	// or nil if the delivery points of service aren't encrypted. It returns an error if the data key of the tenant was shredded.
+	EncryptDeliveryPointOfService(service string, data []byte) ([]byte, error)
+	// DecryptDeliveryPointOfService returns the plaintext of data returned by EncryptDeliveryPointOfService for service,
+	// or nil if the data key of the tenant was shredded.
+	DecryptDeliveryPointOfService(service string, data []byte) ([]byte, error)
+	// GetTenants returns the records of all tenants, by id.
+	GetTenants() (map[string][]byte, error)
+	// IncrTenantPushes adds n to the pushes of a tenant during the day starting at the unix timestamp day, and returns the new total. The counter expires after ttl.
+	IncrTenantPushes(tenant string, day int64, n int64, ttl time.Duration) (int64, error)
+	// AddTenantSubscriber adds a subscriber to a tenant, unless the tenant would have more than max subscribers (if max isn't 0). Returns false if it wasn't added.
+	AddTenantSubscriber(tenant, subscriber string, max int64) (bool, error)
+	// RemoveTenantSubscriber removes a subscriber from a tenant.
+	RemoveTenantSubscriber(tenant, subscriber string) error
+	// CountTenantSubscribers returns the number of subscribers of a tenant.
+	CountTenantSubscribers(tenant string) (int64, error)
+
+	// ClaimRequestSignature records the signature of a signed request for ttl. Returns false if it was already recorded (i.e. the request is a replay).
+	ClaimRequestSignature(signature string, ttl time.Duration) (bool, error)
+
+	// ScanSubscribersOfService returns some of the subscribers of a service matching pattern (e.g. "*"), starting at cursor.
+	// Returns the cursor to continue from, which is 0 when all subscribers were returned.
+	// Subscribers may be returned more than once.
+	ScanSubscribersOfService(service, pattern string, cursor uint64, count int64) ([]string, uint64, error)
+	// SaveBroadcast saves the state of a broadcast. If active is false, the broadcast is finished, and it is deleted after ttl.
+	SaveBroadcast(id string, data []byte, active bool, ttl time.Duration) error
+	// GetBroadcast returns the state of a broadcast, or nil if it doesn't exist.
+	GetBroadcast(id string) ([]byte, error)
+	// GetActiveBroadcasts returns the ids of broadcasts which haven't finished.
+	GetActiveBroadcasts() ([]string, error)
+	// SetBroadcastControl requests a state change (e.g. pausing) of a broadcast, which is applied by the instance sending it. The request expires after ttl.
+	SetBroadcastControl(id, control string, ttl time.Duration) error
+	// GetBroadcastControl returns the state change requested for a broadcast, or "" if there is none.
+	GetBroadcastControl(id string) (string, error)
+	// RemoveBroadcastControl removes the state change requested for a broadcast.
+	RemoveBroadcastControl(id string) error
+
+	// StageUnsubscribe saves an unsubscribe which will be committed later.
+	StageUnsubscribe(id string, data []byte) error
+	// GetStagedUnsubscribe returns a staged unsubscribe, or nil if it doesn't exist.
+	GetStagedUnsubscribe(id string) ([]byte, error)
+	// GetStagedUnsubscribes returns every staged unsubscribe, by id.
+	GetStagedUnsubscribes() (map[string][]byte, error)
+	// RemoveStagedUnsubscribe removes a staged unsubscribe, returning false if it was already removed.
+	// Only the caller which gets true should commit the unsubscribe.
+	RemoveStagedUnsubscribe(id string) (bool, error)
+
+	// FlagDeliveryPoint saves why a delivery point of a service was flagged by reconciliation with its push service.
+	FlagDeliveryPoint(service, dpName string, data []byte) error
+	// UnflagDeliveryPoints removes the flags of delivery points of a service.
+	UnflagDeliveryPoints(service string, dpNames []string) error
+	// GetFlaggedDeliveryPoints returns the flagged delivery points of a service, by delivery point name.
+	GetFlaggedDeliveryPoints(service string) (map[string][]byte, error)
+
+	// AddReplicationEvent appends a change to the subscriptions of this region to the log read by other regions, keeping roughly maxLen events.
+	AddReplicationEvent(data []byte, maxLen int64) error
+	// GetReplicationEvents returns the ids and data of up to count events of the replication log after the event with id after.
+	GetReplicationEvents(after string, count int64) ([]string, [][]byte, error)
+	// SetReplicationClockIfNewer saves the clock of the latest change to a delivery point of a service+subscriber.
+	// Returns false if a change with a newer clock was already saved, in which case the change should be ignored.
+	SetReplicationClockIfNewer(service, subscriber, dpName, clock string) (bool, error)
+	// GetReplicationOffset returns the id of the last applied event of a peer region's replication log, or "" if none were applied.
+	GetReplicationOffset(peer string) (string, error)
+	// SetReplicationOffset saves the id of the last applied event of a peer region's replication log.
+	SetReplicationOffset(peer, id string) error
 }
 
 type pushDatabaseOpts struct {
@@ -98,21 +322,20 @@ type pushDatabaseOpts struct {
 	dblock sync.RWMutex
 }
 
-/*
-func NewPushDatabaseOpts(conf *DatabaseConfig) (PushDatabase, error) {
-	var err error
+// NewPushDatabase creates a push database implementation communicating with redis.
+// If conf.Cache is true, delivery points and push service providers are cached in memory (see NewCachedUniqushDatabase).
+func NewPushDatabase(conf *DatabaseConfig) (PushDatabase, error) {
+	if !conf.Cache || conf.CacheSize <= 0 {
+		return NewPushDatabaseWithoutCache(conf)
+	}
 	f := new(pushDatabaseOpts)
 	udb, err := newPushRedisDB(conf)
 	if udb == nil || err != nil {
-		return nil, err
-	}
-	f.db = NewCachedUniqushDatabase(udb, udb, conf)
-	if f.db == nil {
-		return nil, errors.New("Cannot create cached database")
+		return nil, newError("NewPushDatabase", "", err)
 	}
+	f.db = NewCachedUniqushDatabase(udb, conf)
 	return f, nil
 }
-*/
 
 // NewPushDatabaseWithoutCache creates a push database implementation communicating with redis without any in-memory caching
 func NewPushDatabaseWithoutCache(conf *DatabaseConfig) (PushDatabase, error) {
@@ -120,7 +343,7 @@ func NewPushDatabaseWithoutCache(conf *DatabaseConfig) (PushDatabase, error) {
 	f := new(pushDatabaseOpts)
 	f.db, err = newPushRedisDB(conf)
 	if f.db == nil || err != nil {
-		return nil, fmt.Errorf("Failed to create database: %v", err)
+		return nil, newError("NewPushDatabase", "", err)
 	}
 	return f, nil
 }
@@ -129,7 +352,44 @@ func NewPushDatabaseWithoutCache(conf *DatabaseConfig) (PushDatabase, error) {
 func (f *pushDatabaseOpts) FlushCache() error {
 	f.dblock.Lock()
 	defer f.dblock.Unlock()
-	return f.db.FlushCache()
+	return addErrorSource("FlushCache", f.db.FlushCache())
+}
+
+func (f *pushDatabaseOpts) Ping() error {
+	return addErrorSource("Ping", f.db.Ping())
+}
+
+func (f *pushDatabaseOpts) Time() (time.Time, error) {
+	t, err := f.db.Time()
+	return t, addErrorSource("Time", err)
+}
+
+func (f *pushDatabaseOpts) PreloadCache() (int, error) {
+	if cached, ok := f.db.(interface {
+		preload() (int, error)
+	}); ok {
+		return cached.preload()
+	}
+	return 0, nil
+}
+
+func (f *pushDatabaseOpts) CacheStats(hotKeys int) []CacheStats {
+	if cached, ok := f.db.(interface {
+		cacheStats(hotKeys int) []CacheStats
+	}); ok {
+		return cached.cacheStats(hotKeys)
+	}
+	return nil
+}
+
+func (f *pushDatabaseOpts) ResizeCaches(maxEntries int, maxBytes int64) bool {
+	if cached, ok := f.db.(interface {
+		resizeCaches(maxEntries int, maxBytes int64)
+	}); ok {
+		cached.resizeCaches(maxEntries, maxBytes)
+		return true
+	}
+	return false
 }
 
 func (f *pushDatabaseOpts) RemovePushServiceProviderFromService(service string, pushServiceProvider *push.PushServiceProvider) error {
@@ -142,15 +402,116 @@ func (f *pushDatabaseOpts) RemovePushServiceProviderFromService(service string,
 	defer f.dblock.Unlock()
 	err := db.RemovePushServiceProviderFromService(service, name)
 	if err != nil {
-		return fmt.Errorf("Error removing the psp: %v", err)
+		return newError("RemovePushServiceProviderFromService", service, err)
 	}
 	err = db.RemovePushServiceProvider(name)
 	if err != nil {
-		return fmt.Errorf("Error removing the psp label: %v", err)
+		return newError("RemovePushServiceProvider", name, err)
+	}
+	fallbackName, err := db.GetFallbackPushServiceProvider(name)
+	if err != nil {
+		return newError("GetFallbackPushServiceProvider", name, err)
+	}
+	if fallbackName != "" {
+		if err = db.RemovePushServiceProvider(fallbackName); err != nil {
+			return newError("RemovePushServiceProvider", fallbackName, err)
+		}
+		if err = db.RemoveFallbackPushServiceProvider(name); err != nil {
+			return newError("RemoveFallbackPushServiceProvider", name, err)
+		}
 	}
 	return nil
 }
 
+// findPushServiceProviderOfType returns the push service provider of the service with the given push service type, or nil. The caller must hold dblock.
+func (f *pushDatabaseOpts) findPushServiceProviderOfType(service string, pushServiceName string) (*push.PushServiceProvider, error) {
+	pspNames, err := f.db.GetPushServiceProvidersByService(service)
+	if err != nil {
+		return nil, newError("GetPushServiceProvidersByService", service, err)
+	}
+	for _, pspName := range pspNames {
+		psp, err := f.db.GetPushServiceProvider(pspName)
+		if err != nil {
+			return nil, newError("GetPushServiceProvider", pspName, err)
+		}
+		if psp.PushServiceName() == pushServiceName {
+			return psp, nil
+		}
+	}
+	return nil, nil
+}
+
+func (f *pushDatabaseOpts) AddFallbackPushServiceProviderToService(service string, fallback *push.PushServiceProvider) (string, error) {
+	name := fallback.Name()
+	if name == "" {
+		return "", errors.New("InvalidPushServiceProvider")
+	}
+	f.dblock.Lock()
+	defer f.dblock.Unlock()
+	primary, err := f.findPushServiceProviderOfType(service, fallback.PushServiceName())
+	if err != nil {
+		return "", newError("AddFallbackPushServiceProviderToService", service, err)
+	}
+	if primary == nil {
+		return "", fmt.Errorf("Service %s has no PSP of push service type %s to add a fallback to", service, fallback.PushServiceName())
+	}
+	primaryName := primary.Name()
+	if primaryName == name {
+		return "", fmt.Errorf("PSP %s can't be the fallback of itself", name)
+	}
+	if err = f.db.SetPushServiceProvider(fallback); err != nil {
+		return "", newError("SetPushServiceProvider", name, err)
+	}
+	if err = f.db.SetFallbackPushServiceProvider(primaryName, name); err != nil {
+		return "", newError("AddFallbackPushServiceProviderToService", service, err)
+	}
+	return primaryName, nil
+}
+
+func (f *pushDatabaseOpts) RemoveFallbackPushServiceProviderFromService(service string, fallback *push.PushServiceProvider) error {
+	name := fallback.Name()
+	if name == "" {
+		return errors.New("InvalidPushServiceProvider")
+	}
+	f.dblock.Lock()
+	defer f.dblock.Unlock()
+	primary, err := f.findPushServiceProviderOfType(service, fallback.PushServiceName())
+	if err != nil {
+		return newError("RemoveFallbackPushServiceProviderFromService", service, err)
+	}
+	if primary == nil {
+		return fmt.Errorf("Service %s has no PSP of push service type %s", service, fallback.PushServiceName())
+	}
+	current, err := f.db.GetFallbackPushServiceProvider(primary.Name())
+	if err != nil {
+		return newError("RemoveFallbackPushServiceProviderFromService", service, err)
+	}
+	if current != name {
+		return fmt.Errorf("PSP %s is not the fallback of %s", name, primary.Name())
+	}
+	if err = f.db.RemoveFallbackPushServiceProvider(primary.Name()); err != nil {
+		return newError("RemoveFallbackPushServiceProviderFromService", service, err)
+	}
+	return addErrorSource("RemoveFallbackPushServiceProviderFromService", f.db.RemovePushServiceProvider(name))
+}
+
+func (f *pushDatabaseOpts) GetFallbackPushServiceProvider(psp *push.PushServiceProvider) (*push.PushServiceProvider, error) {
+	f.dblock.RLock()
+	defer f.dblock.RUnlock()
+	fallbackName, err := f.db.GetFallbackPushServiceProvider(psp.Name())
+	if err != nil {
+		return nil, newError("GetFallbackPushServiceProvider", psp.Name(), err)
+	}
+	if fallbackName == "" {
+		return nil, nil
+	}
+	fallback, err := f.db.GetPushServiceProvider(fallbackName)
+	if err != nil {
+		return nil, newError("GetPushServiceProvider", fallbackName, err)
+	}
+	return fallback, nil
+}
+
 func (f *pushDatabaseOpts) AddPushServiceProviderToService(service string, pushServiceProvider *push.PushServiceProvider) error {
 	if pushServiceProvider == nil {
 		return nil
@@ -172,13 +533,13 @@ func (f *pushDatabaseOpts) AddPushServiceProviderToService(service string, pushS
 	 */
 	expsps, err := f.db.GetPushServiceProvidersByService(service)
 	if err != nil {
-		return fmt.Errorf("Error in AddPushServiceProviderToService querying list of PSPs for service %s: %v", service, err)
+		return newError("AddPushServiceProviderToService", service, err)
 	}
 
 	for _, pspitem := range expsps {
 		pushpsp, perr := f.db.GetPushServiceProvider(pspitem)
 		if perr != nil {
-			return fmt.Errorf("Error in AddPushServiceProviderToService retrieving existing PSP %s for service %s with name: %v", pspitem, service, perr)
+			return newError("GetPushServiceProvider", pspitem, perr)
 		}
 		// Check if the existing PSP has the same push service type
 		if pushpsp.PushServiceName() == pushServiceProvider.PushServiceName() {
@@ -203,9 +564,9 @@ func (f *pushDatabaseOpts) AddPushServiceProviderToService(service string, pushS
 
 	e := f.db.SetPushServiceProvider(pushServiceProvider)
 	if e != nil {
-		return fmt.Errorf("Error associating psp with name: %v", e)
+		return newError("SetPushServiceProvider", name, e)
 	}
-	return f.db.AddPushServiceProviderToService(service, pushServiceProvider.Name())
+	return addErrorSource("AddPushServiceProviderToService", f.db.AddPushServiceProviderToService(service, pushServiceProvider.Name()))
 }
 
 func (f *pushDatabaseOpts) AddDeliveryPointToService(service string,
@@ -221,7 +582,7 @@ func (f *pushDatabaseOpts) AddDeliveryPointToService(service string,
 	defer f.dblock.Unlock()
 	pspnames, err := f.db.GetPushServiceProvidersByService(service)
 	if err != nil {
-		return nil, fmt.Errorf("Cannot list services for %s: %v", service, err)
+		return nil, newError("GetPushServiceProvidersByService", service, err)
 	}
 	if pspnames == nil {
 		return nil, fmt.Errorf("Cannot Find Service %s", service)
@@ -230,7 +591,7 @@ func (f *pushDatabaseOpts) AddDeliveryPointToService(service string,
 	for _, pspname := range pspnames {
 		psp, e := f.db.GetPushServiceProvider(pspname)
 		if e != nil {
-			return nil, fmt.Errorf("Failed to get information for psp %s: %v", pspname, e)
+			return nil, newError("GetPushServiceProvider", pspname, e)
 		}
 		if psp == nil {
 			continue
@@ -238,15 +599,15 @@ func (f *pushDatabaseOpts) AddDeliveryPointToService(service string,
 		if psp.PushServiceName() == deliveryPoint.PushServiceName() {
 			err = f.db.SetDeliveryPoint(deliveryPoint)
 			if err != nil {
-				return nil, fmt.Errorf("Failed to save new info for delivery point: %v", err)
+				return nil, newError("SetDeliveryPoint", deliveryPoint.Name(), err)
 			}
 			err = f.db.AddDeliveryPointToServiceSubscriber(service, subscriber, deliveryPoint.Name())
 			if err != nil {
-				return nil, fmt.Errorf("Failed to add delivery point to subscriber: %v", err)
+				return nil, newError("AddDeliveryPointToServiceSubscriber", subscriber, err)
 			}
 			err = f.db.SetPushServiceProviderOfServiceDeliveryPoint(service, deliveryPoint.Name(), psp.Name())
 			if err != nil {
-				return nil, fmt.Errorf("Failed to set psp of delivery point: %v", err)
+				return nil, newError("SetPushServiceProviderOfServiceDeliveryPoint", deliveryPoint.Name(), err)
 			}
 			return psp, nil
 		}
@@ -264,33 +625,194 @@ func (f *pushDatabaseOpts) RemoveDeliveryPointFromService(service string,
 	defer f.dblock.Unlock()
 	err := f.db.RemoveDeliveryPointFromServiceSubscriber(service, subscriber, deliveryPoint.Name())
 	if err != nil {
-		return fmt.Errorf("Failed to remove delivery point: %v", err)
+		return newError("RemoveDeliveryPointFromServiceSubscriber", subscriber, err)
 	}
 	err = f.db.RemovePushServiceProviderOfServiceDeliveryPoint(service, deliveryPoint.Name())
 	if err != nil {
-		return fmt.Errorf("Failed to remove psp info for delivery point: %v", err)
+		return newError("RemovePushServiceProviderOfServiceDeliveryPoint", deliveryPoint.Name(), err)
 	}
 	return nil
 }
 
+func (f *pushDatabaseOpts) GetPushServiceProvidersByService(service string) ([]string, error) {
+	f.dblock.RLock()
+	defer f.dblock.RUnlock()
+	names, err := f.db.GetPushServiceProvidersByService(service)
+	if err != nil {
+		return nil, newError("GetPushServiceProvidersByService", service, err)
+	}
+	return names, nil
+}
+
+func (f *pushDatabaseOpts) GetPushServiceProviders(names []string) (map[string]*push.PushServiceProvider, error) {
+	f.dblock.RLock()
+	defer f.dblock.RUnlock()
+	psps, err := f.db.GetPushServiceProviders(names)
+	return psps, addErrorSource("GetPushServiceProviders", err)
+}
+
 // Fetch all of the delivery points of subscriber for a given service. If dpNames is not empty, limit the results to fetch to that subset.
 func (f *pushDatabaseOpts) GetPushServiceProviderDeliveryPointPairs(service string,
 	subscriber string, dpNamesRequested []string) ([]PushServiceProviderDeliveryPointPair, error) {
 	f.dblock.RLock()
 	defer f.dblock.RUnlock()
+	pairs, errs := f.getPushServiceProviderDeliveryPointPairs(context.Background(), service, []string{subscriber}, dpNamesRequested)
+	return pairs[subscriber], errs[subscriber]
+}
+
+// GetPushServiceProviderDeliveryPointPairsOfSubscribers is GetPushServiceProviderDeliveryPointPairs for several subscribers,
+// fetching the push service providers of all of their delivery points in one batch.
+func (f *pushDatabaseOpts) GetPushServiceProviderDeliveryPointPairsOfSubscribers(ctx context.Context, service string,
+	subscribers []string, dpNamesRequested []string) (map[string][]PushServiceProviderDeliveryPointPair, map[string]error) {
+	f.dblock.RLock()
+	defer f.dblock.RUnlock()
+	return f.getPushServiceProviderDeliveryPointPairs(ctx, service, subscribers, dpNamesRequested)
+}
+
+// pendingPair is a delivery point of a subscriber whose push service provider hasn't been fetched yet.
+type pendingPair struct {
+	srv     string
+	dp      *push.DeliveryPoint
+	pspName string
+}
+
+// pendingPairs are the delivery points of one subscriber, along with what is needed to cache the resulting pairs.
+type pendingPairs struct {
+	pairs       []pendingPair
+	depDPNames  []string
+	depPSPNames []string
+	generation  uint64
+}
+
+// getPushServiceProviderDeliveryPointPairs must be called with f.dblock held.
+// Once ctx is done, the subscribers which weren't looked up yet get the error of ctx instead of being looked up.
+// ctx isn't passed to the redis client: go-redis v6 only stores the context of WithContext and never cancels a command with it,
+// so ctx is checked between the commands instead, and a command in flight is bounded by the read timeout of the client (3 seconds by default).
+// Its span counts the subscribers whose pairs were in the pair cache, and has a child span for each lookup which wasn't,
+// so that the time spent in the cache can be told apart from the time spent in the database.
+func (f *pushDatabaseOpts) getPushServiceProviderDeliveryPointPairs(ctx context.Context, service string,
+	subscribers []string, dpNamesRequested []string) (map[string][]PushServiceProviderDeliveryPointPair, map[string]error) {
+	ctx, span := tracing.Start(ctx, "db.GetPushServiceProviderDeliveryPointPairs", tracing.KindInternal)
+	defer span.Finish()
+	span.SetAttribute("uniqush.subscribers", len(subscribers))
+	ret := make(map[string][]PushServiceProviderDeliveryPointPair, len(subscribers))
+	errs := make(map[string]error)
+	pairCache, _ := f.db.(pairCacher)
+
+	dpNamesSubset := make(map[string]bool, len(dpNamesRequested))
+	for _, name := range dpNamesRequested {
+		dpNamesSubset[name] = true
+	}
+
+	pending := make(map[string]*pendingPairs, len(subscribers))
+	var pspNames []string
+	seenPSPNames := make(map[string]bool)
+	cacheHits := 0
+	for _, subscriber := range subscribers {
+		if pairCache != nil {
+			if pairs, ok := pairCache.getPairs(service, subscriber); ok {
+				ret[subscriber] = filterPushServiceProviderDeliveryPointPairs(pairs, dpNamesRequested)
+				cacheHits++
+				continue
+			}
+		}
+		if err := ctx.Err(); err != nil {
+			errs[subscriber] = err
+			continue
+		}
+		_, lookupSpan := tracing.Start(ctx, "db.GetDeliveryPoints", tracing.KindInternal)
+		p, err := f.getPendingPairs(service, subscriber, dpNamesSubset, pairCache)
+		lookupSpan.SetError(err)
+		lookupSpan.Finish()
+		if err != nil {
+			errs[subscriber] = err
+			continue
+		}
+		if p == nil {
+			continue
+		}
+		pending[subscriber] = p
+		for _, pair := range p.pairs {
+			if !seenPSPNames[pair.pspName] {
+				seenPSPNames[pair.pspName] = true
+				pspNames = append(pspNames, pair.pspName)
+			}
+		}
+	}
+	span.SetAttribute("uniqush.pair_cache_hits", cacheHits)
+	if len(pending) == 0 {
+		return ret, errs
+	}
+
+	if err := ctx.Err(); err != nil {
+		for subscriber := range pending {
+			errs[subscriber] = err
+		}
+		return ret, errs
+	}
+	_, pspSpan := tracing.Start(ctx, "db.GetPushServiceProviders", tracing.KindInternal)
+	pspSpan.SetAttribute("uniqush.push_service_providers", len(pspNames))
+	psps, err := f.db.GetPushServiceProviders(pspNames)
+	pspSpan.SetError(err)
+	pspSpan.Finish()
+	if err != nil {
+		for subscriber := range pending {
+			errs[subscriber] = newError("GetPushServiceProviders", strings.Join(pspNames, ","), err)
+		}
+		return ret, errs
+	}
+
+	for subscriber, p := range pending {
+		pairs := make([]PushServiceProviderDeliveryPointPair, 0, len(p.pairs))
+		for _, pair := range p.pairs {
+			dpName := pair.dp.Name()
+			psp, ok := psps[pair.pspName]
+			if !ok {
+				// The PSP for the dpName no longer exists, so ignore and remove that delivery point.
+				e2 := f.db.RemoveDeliveryPoint(dpName)
+				e3 := f.db.RemovePushServiceProviderOfServiceDeliveryPoint(pair.srv, dpName)
+				if e2 != nil {
+					err = newError("RemoveDeliveryPoint", dpName, e2)
+					break
+				}
+				if e3 != nil {
+					err = newError("RemovePushServiceProviderOfServiceDeliveryPoint", dpName, e3)
+					break
+				}
+				continue
+			}
+			if psp == nil {
+				continue
+			}
+			pairs = append(pairs, PushServiceProviderDeliveryPointPair{psp, pair.dp})
+		}
+		if err != nil {
+			errs[subscriber] = err
+			err = nil
+			continue
+		}
+		if pairCache != nil && len(dpNamesSubset) == 0 {
+			pairCache.setPairs(service, subscriber, pairs, p.depDPNames, p.depPSPNames, p.generation)
+		}
+		ret[subscriber] = pairs
+	}
+	return ret, errs
+}
+
+// getPendingPairs fetches the delivery points of a subscriber and the names of their push service providers.
+// It returns nil if the subscriber has no delivery points.
+func (f *pushDatabaseOpts) getPendingPairs(service string, subscriber string, dpNamesSubset map[string]bool, pairCache pairCacher) (*pendingPairs, error) {
+	p := &pendingPairs{}
+	if pairCache != nil {
+		p.generation = pairCache.pairsGeneration()
+	}
 	dpnames, err := f.db.GetDeliveryPointsNameByServiceSubscriber(service, subscriber)
 	if err != nil {
-		return nil, fmt.Errorf("Could not list delivery points for service %s, subscriber %s: %v", service, subscriber, err)
+		return nil, newError("GetDeliveryPointsNameByServiceSubscriber", service+":"+subscriber, err)
 	}
 	if dpnames == nil {
 		return nil, nil
 	}
-	ret := make([]PushServiceProviderDeliveryPointPair, 0, len(dpnames))
-
-	dpNamesSubset := make(map[string]bool, len(dpNamesRequested))
-	for _, name := range dpNamesRequested {
-		dpNamesSubset[name] = true
-	}
 
 	for srv, dpList := range dpnames {
 		for _, dpName := range dpList {
@@ -298,13 +820,14 @@ func (f *pushDatabaseOpts) GetPushServiceProviderDeliveryPointPairs(service stri
 				// If we request a subset of delivery points, don't fetch or return data for the ones that weren't requested.
 				continue
 			}
+			p.depDPNames = append(p.depDPNames, dpName)
 			dp, e0 := f.db.GetDeliveryPoint(dpName)
 			if e0 != nil {
 				if isErrCausedByMissingKey(e0) {
 					f.db.RemoveDeliveryPoint(dpName)
 					continue
 				}
-				return nil, fmt.Errorf("Failed to get delivery point info for %s: %v", dpName, e0)
+				return nil, newError("GetDeliveryPoint", dpName, e0)
 			}
 			if dp == nil {
 				continue
@@ -316,38 +839,35 @@ func (f *pushDatabaseOpts) GetPushServiceProviderDeliveryPointPairs(service stri
 					f.db.RemoveDeliveryPoint(dpName)
 					continue
 				}
-				return nil, fmt.Errorf("Failed to get psp name for dp %s: %v", dpName, e)
+				return nil, newError("GetPushServiceProviderNameByServiceDeliveryPoint", dpName, e)
 			}
 
 			if len(pspname) == 0 {
 				continue
 			}
-
-			psp, e1 := f.db.GetPushServiceProvider(pspname)
-			if e1 != nil {
-				// If the error was caused because the PSP for the dpName no longer exists, then ignore and remove that delivery point.
-				if isErrCausedByMissingKey(e1) {
-					e2 := f.db.RemoveDeliveryPoint(dpName)
-					e3 := f.db.RemovePushServiceProviderOfServiceDeliveryPoint(srv, dpName)
-					if e2 != nil {
-						return nil, fmt.Errorf("Failed to remove dp %s with invalid psp %s: %v", dpName, pspname, e2)
-					}
-					if e3 != nil {
-						return nil, fmt.Errorf("Failed to remove pspname %s for dp %s (PSP no longer exists): %v", pspname, dpName, e3)
-					}
-					continue
-				}
-				return nil, fmt.Errorf("Failed to get information about psp %s: %v", pspname, e1)
-			}
-			if psp == nil {
-				continue
-			}
-
-			ret = append(ret, PushServiceProviderDeliveryPointPair{psp, dp})
+			p.depPSPNames = append(p.depPSPNames, pspname)
+			p.pairs = append(p.pairs, pendingPair{srv: srv, dp: dp, pspName: pspname})
 		}
 	}
+	return p, nil
+}
 
-	return ret, nil
+// filterPushServiceProviderDeliveryPointPairs returns the pairs with the given delivery point names, or all of them if dpNames is empty.
+func filterPushServiceProviderDeliveryPointPairs(pairs []PushServiceProviderDeliveryPointPair, dpNames []string) []PushServiceProviderDeliveryPointPair {
+	if len(dpNames) == 0 {
+		return pairs
+	}
+	requested := make(map[string]bool, len(dpNames))
+	for _, name := range dpNames {
+		requested[name] = true
+	}
+	ret := make([]PushServiceProviderDeliveryPointPair, 0, len(pairs))
+	for _, pair := range pairs {
+		if requested[pair.DeliveryPoint.Name()] {
+			ret = append(ret, pair)
+		}
+	}
+	return ret
 }
 
 func (f *pushDatabaseOpts) ModifyPushServiceProvider(psp *push.PushServiceProvider) error {
@@ -364,7 +884,7 @@ func (f *pushDatabaseOpts) GetServiceNames() ([]string, error) {
 	defer f.dblock.RUnlock()
 	serviceNames, err := f.db.GetServiceNames()
 	if err != nil {
-		return nil, fmt.Errorf("GetServiceNames: %v", err)
+		return nil, newError("GetServiceNames", "", err)
 	}
 	return serviceNames, nil
 }
@@ -380,7 +900,7 @@ func (f *pushDatabaseOpts) GetPushServiceProviderConfigs() ([]*push.PushServiceP
 	for _, serviceName := range serviceNames {
 		pspsForService, err := f.db.GetPushServiceProvidersByService(serviceName)
 		if err != nil {
-			return nil, fmt.Errorf("GetPushServiceProvidersByService couldn't get psps for service %q: %v", serviceName, err)
+			return nil, newError("GetPushServiceProvidersByService", serviceName, err)
 		}
 		pspNames = append(pspNames, pspsForService...)
 	}
@@ -414,7 +934,7 @@ func (f *pushDatabaseOpts) GetSubscriptions(services []string, user string, logg
 	// End note.
 	subs, err := f.db.GetSubscriptions(services, user, logger)
 	if err != nil {
-		return nil, fmt.Errorf("GetSubscriptions: %v", err)
+		return nil, newError("GetSubscriptions", user, err)
 	}
 	return subs, nil
 }
@@ -422,12 +942,349 @@ func (f *pushDatabaseOpts) GetSubscriptions(services []string, user string, logg
 func (f *pushDatabaseOpts) RebuildServiceSet() error {
 	f.dblock.Lock()
 	defer f.dblock.Unlock()
-	return f.db.RebuildServiceSet()
+	return addErrorSource("RebuildServiceSet", f.db.RebuildServiceSet())
+}
+
+// Leases, cluster members, maintenance mode, held pushes, quarantined payloads, delivery records and broadcasts are unrelated to changes to subscriptions, so they don't need to take dblock.
+// Staged unsubscribes are only committed through RemoveDeliveryPointFromService, which takes it.
+// Flagged delivery points are only informational.
+// Replication events are applied through AddDeliveryPointToService and RemoveDeliveryPointFromService, which take it.
+
+func (f *pushDatabaseOpts) AcquireLease(name, owner string, ttl time.Duration) (bool, error) {
+	ok, err := f.db.AcquireLease(name, owner, ttl)
+	return ok, addErrorSource("AcquireLease", err)
+}
+
+func (f *pushDatabaseOpts) RenewLease(name, owner string, ttl time.Duration) (bool, error) {
+	ok, err := f.db.RenewLease(name, owner, ttl)
+	return ok, addErrorSource("RenewLease", err)
+}
+
+func (f *pushDatabaseOpts) ReleaseLease(name, owner string) error {
+	return addErrorSource("ReleaseLease", f.db.ReleaseLease(name, owner))
+}
+
+func (f *pushDatabaseOpts) SetClusterMember(id string, data []byte) error {
+	return addErrorSource("SetClusterMember", f.db.SetClusterMember(id, data))
+}
+
+func (f *pushDatabaseOpts) GetClusterMembers() (map[string][]byte, error) {
+	records, err := f.db.GetClusterMembers()
+	return records, addErrorSource("GetClusterMembers", err)
+}
+
+func (f *pushDatabaseOpts) RemoveClusterMembers(ids ...string) error {
+	return addErrorSource("RemoveClusterMembers", f.db.RemoveClusterMembers(ids...))
+}
+
+func (f *pushDatabaseOpts) SetMaintenance(data []byte) error {
+	return addErrorSource("SetMaintenance", f.db.SetMaintenance(data))
+}
+
+func (f *pushDatabaseOpts) GetMaintenance() ([]byte, error) {
+	data, err := f.db.GetMaintenance()
+	return data, addErrorSource("GetMaintenance", err)
+}
+
+func (f *pushDatabaseOpts) HoldPush(data []byte) error {
+	return addErrorSource("HoldPush", f.db.HoldPush(data))
+}
+
+func (f *pushDatabaseOpts) ClaimHeldPushes(count int64, timeout time.Duration) ([][]byte, error) {
+	data, err := f.db.ClaimHeldPushes(count, timeout)
+	return data, addErrorSource("ClaimHeldPushes", err)
+}
+
+func (f *pushDatabaseOpts) AckHeldPush(data []byte) error {
+	return addErrorSource("AckHeldPush", f.db.AckHeldPush(data))
+}
+
+func (f *pushDatabaseOpts) CountHeldPushes() (int64, error) {
+	n, err := f.db.CountHeldPushes()
+	return n, addErrorSource("CountHeldPushes", err)
+}
+
+func (f *pushDatabaseOpts) SetStagedPushServiceProvider(psp *push.PushServiceProvider, state []byte) error {
+	return addErrorSource("SetStagedPushServiceProvider", f.db.SetStagedPushServiceProvider(psp, state))
+}
+
+func (f *pushDatabaseOpts) GetStagedPushServiceProviders() (map[string]StagedPushServiceProvider, error) {
+	records, err := f.db.GetStagedPushServiceProviders()
+	return records, addErrorSource("GetStagedPushServiceProviders", err)
+}
+
+func (f *pushDatabaseOpts) RemoveStagedPushServiceProvider(name string) error {
+	return addErrorSource("RemoveStagedPushServiceProvider", f.db.RemoveStagedPushServiceProvider(name))
+}
+
+func (f *pushDatabaseOpts) SetFeatureFlag(name string, enabled bool) error {
+	return addErrorSource("SetFeatureFlag", f.db.SetFeatureFlag(name, enabled))
+}
+
+func (f *pushDatabaseOpts) GetFeatureFlags() (map[string]bool, error) {
+	records, err := f.db.GetFeatureFlags()
+	return records, addErrorSource("GetFeatureFlags", err)
+}
+
+func (f *pushDatabaseOpts) RemoveFeatureFlag(name string) error {
+	return addErrorSource("RemoveFeatureFlag", f.db.RemoveFeatureFlag(name))
+}
+
+func (f *pushDatabaseOpts) IncrPayloadFailures(fingerprint string, window time.Duration) (int64, error) {
+	n, err := f.db.IncrPayloadFailures(fingerprint, window)
+	return n, addErrorSource("IncrPayloadFailures", err)
+}
+
+func (f *pushDatabaseOpts) QuarantinePayload(fingerprint string, record []byte, ttl time.Duration) error {
+	return addErrorSource("QuarantinePayload", f.db.SetQuarantinedPayload(fingerprint, record, ttl))
+}
+
+func (f *pushDatabaseOpts) GetQuarantinedPayload(fingerprint string) ([]byte, error) {
+	data, err := f.db.GetQuarantinedPayload(fingerprint)
+	return data, addErrorSource("GetQuarantinedPayload", err)
+}
+
+func (f *pushDatabaseOpts) GetQuarantinedPayloads() (map[string][]byte, error) {
+	records, err := f.db.GetQuarantinedPayloads()
+	return records, addErrorSource("GetQuarantinedPayloads", err)
+}
+
+func (f *pushDatabaseOpts) ReleaseQuarantinedPayload(fingerprint string) error {
+	return addErrorSource("ReleaseQuarantinedPayload", f.db.RemoveQuarantinedPayload(fingerprint))
+}
+
+func (f *pushDatabaseOpts) AddDeliveryRecord(service, subscriber string, record []byte, maxRecords int64, retention time.Duration) error {
+	return addErrorSource("AddDeliveryRecord", f.db.AddDeliveryRecord(service, subscriber, record, maxRecords, retention))
+}
+
+func (f *pushDatabaseOpts) GetDeliveryRecords(service, subscriber string) ([][]byte, error) {
+	data, err := f.db.GetDeliveryRecords(service, subscriber)
+	return data, addErrorSource("GetDeliveryRecords", err)
+}
+
+func (f *pushDatabaseOpts) AddInboxMessage(service, subscriber string, message []byte, maxMessages int64, retention time.Duration) error {
+	return addErrorSource("AddInboxMessage", f.db.AddInboxMessage(service, subscriber, message, maxMessages, retention))
+}
+
+func (f *pushDatabaseOpts) GetInboxMessages(service, subscriber string) ([][]byte, error) {
+	data, err := f.db.GetInboxMessages(service, subscriber)
+	return data, addErrorSource("GetInboxMessages", err)
+}
+
+func (f *pushDatabaseOpts) RemoveInboxMessage(service, subscriber string, message []byte) error {
+	return addErrorSource("RemoveInboxMessage", f.db.RemoveInboxMessage(service, subscriber, message))
+}
+
+func (f *pushDatabaseOpts) IncrAnalyticsCounts(service string, hour int64, counts map[string]int64, retention time.Duration) error {
+	return addErrorSource("IncrAnalyticsCounts", f.db.IncrAnalyticsCounts(service, hour, counts, retention))
+}
+
+func (f *pushDatabaseOpts) GetAnalyticsCounts(service string, hours []int64) ([]map[string]int64, error) {
+	data, err := f.db.GetAnalyticsCounts(service, hours)
+	return data, addErrorSource("GetAnalyticsCounts", err)
+}
+
+func (f *pushDatabaseOpts) IncrUsageCounts(day int64, counts map[string]int64, retention time.Duration) error {
+	return addErrorSource("IncrUsageCounts", f.db.IncrUsageCounts(day, counts, retention))
+}
+
+func (f *pushDatabaseOpts) GetUsageCounts(days []int64) ([]map[string]int64, error) {
+	data, err := f.db.GetUsageCounts(days)
+	return data, addErrorSource("GetUsageCounts", err)
+}
+
+func (f *pushDatabaseOpts) AddAuditRecord(record []byte, maxRecords int64) error {
+	return addErrorSource("AddAuditRecord", f.db.AddAuditRecord(record, maxRecords))
+}
+
+func (f *pushDatabaseOpts) GetAuditRecords(start, stop int64) ([][]byte, error) {
+	data, err := f.db.GetAuditRecords(start, stop)
+	return data, addErrorSource("GetAuditRecords", err)
+}
+
+func (f *pushDatabaseOpts) TrimAuditRecords(n int64) error {
+	return addErrorSource("TrimAuditRecords", f.db.TrimAuditRecords(n))
+}
+
+func (f *pushDatabaseOpts) SetAPIKey(id string, record []byte) error {
+	return addErrorSource("SetAPIKey", f.db.SetAPIKey(id, record))
+}
+
+func (f *pushDatabaseOpts) GetAPIKey(id string) ([]byte, error) {
+	data, err := f.db.GetAPIKey(id)
+	return data, addErrorSource("GetAPIKey", err)
+}
+
+func (f *pushDatabaseOpts) GetAPIKeys() (map[string][]byte, error) {
+	records, err := f.db.GetAPIKeys()
+	return records, addErrorSource("GetAPIKeys", err)
+}
+
+func (f *pushDatabaseOpts) SetTenant(id string, record []byte) error {
+	return addErrorSource("SetTenant", f.db.SetTenant(id, record))
+}
+
+func (f *pushDatabaseOpts) RemoveTenant(id string) error {
+	return addErrorSource("RemoveTenant", f.db.RemoveTenant(id))
+}
+
+func (f *pushDatabaseOpts) SetTenantServices(tenant string, services []string) error {
+	return addErrorSource("SetTenantServices", f.db.SetTenantServices(tenant, services))
+}
+
+func (f *pushDatabaseOpts) ShredTenantDataKey(tenant string) error {
+	return addErrorSource("ShredTenantDataKey", f.db.ShredTenantDataKey(tenant))
+}
+
+func (f *pushDatabaseOpts) EncryptDeliveryPointOfService(service string, data []byte) ([]byte, error) {
+	encrypted, err := f.db.EncryptDeliveryPointOfService(service, data)
+	if err != nil {
+		return nil, newError("EncryptDeliveryPointOfService", service, err)
+	}
+	return encrypted, nil
+}
+
+func (f *pushDatabaseOpts) DecryptDeliveryPointOfService(service string, data []byte) ([]byte, error) {
+	plaintext, err := f.db.DecryptDeliveryPointOfService(service, data)
+	if err != nil {
+		return nil, newError("DecryptDeliveryPointOfService", service, err)
+	}
+	return plaintext, nil
+}
+
+func (f *pushDatabaseOpts) GetTenants() (map[string][]byte, error) {
+	records, err := f.db.GetTenants()
+	return records, addErrorSource("GetTenants", err)
+}
+
+func (f *pushDatabaseOpts) IncrTenantPushes(tenant string, day int64, n int64, ttl time.Duration) (int64, error) {
+	n, err := f.db.IncrTenantPushes(tenant, day, n, ttl)
+	return n, addErrorSource("IncrTenantPushes", err)
+}
+
+func (f *pushDatabaseOpts) AddTenantSubscriber(tenant, subscriber string, max int64) (bool, error) {
+	ok, err := f.db.AddTenantSubscriber(tenant, subscriber, max)
+	return ok, addErrorSource("AddTenantSubscriber", err)
+}
+
+func (f *pushDatabaseOpts) RemoveTenantSubscriber(tenant, subscriber string) error {
+	return addErrorSource("RemoveTenantSubscriber", f.db.RemoveTenantSubscriber(tenant, subscriber))
+}
+
+func (f *pushDatabaseOpts) CountTenantSubscribers(tenant string) (int64, error) {
+	n, err := f.db.CountTenantSubscribers(tenant)
+	return n, addErrorSource("CountTenantSubscribers", err)
+}
+
+func (f *pushDatabaseOpts) ClaimRequestSignature(signature string, ttl time.Duration) (bool, error) {
+	ok, err := f.db.ClaimRequestSignature(signature, ttl)
+	return ok, addErrorSource("ClaimRequestSignature", err)
+}
+
+func (f *pushDatabaseOpts) CompactDeliveryHistories(idleBefore int64, maxSubscribers int64) (int64, error) {
+	n, err := f.db.CompactDeliveryHistories(idleBefore, maxSubscribers)
+	return n, addErrorSource("CompactDeliveryHistories", err)
+}
+
+func (f *pushDatabaseOpts) ScanSubscribersOfService(service, pattern string, cursor uint64, count int64) ([]string, uint64, error) {
+	subscribers, next, err := f.db.ScanSubscribersOfService(service, pattern, cursor, count)
+	return subscribers, next, addErrorSource("ScanSubscribersOfService", err)
+}
+
+func (f *pushDatabaseOpts) SaveBroadcast(id string, data []byte, active bool, ttl time.Duration) error {
+	if active {
+		if err := f.db.SetBroadcast(id, data, 0); err != nil {
+			return addErrorSource("SaveBroadcast", err)
+		}
+		return addErrorSource("SaveBroadcast", f.db.AddActiveBroadcast(id))
+	}
+	if err := f.db.SetBroadcast(id, data, ttl); err != nil {
+		return addErrorSource("SaveBroadcast", err)
+	}
+	return addErrorSource("SaveBroadcast", f.db.RemoveActiveBroadcast(id))
+}
+
+func (f *pushDatabaseOpts) GetBroadcast(id string) ([]byte, error) {
+	data, err := f.db.GetBroadcast(id)
+	return data, addErrorSource("GetBroadcast", err)
+}
+
+func (f *pushDatabaseOpts) GetActiveBroadcasts() ([]string, error) {
+	ids, err := f.db.GetActiveBroadcasts()
+	return ids, addErrorSource("GetActiveBroadcasts", err)
+}
+
+func (f *pushDatabaseOpts) SetBroadcastControl(id, control string, ttl time.Duration) error {
+	return addErrorSource("SetBroadcastControl", f.db.SetBroadcastControl(id, control, ttl))
+}
+
+func (f *pushDatabaseOpts) GetBroadcastControl(id string) (string, error) {
+	value, err := f.db.GetBroadcastControl(id)
+	return value, addErrorSource("GetBroadcastControl", err)
+}
+
+func (f *pushDatabaseOpts) RemoveBroadcastControl(id string) error {
+	return addErrorSource("RemoveBroadcastControl", f.db.RemoveBroadcastControl(id))
+}
+
+func (f *pushDatabaseOpts) StageUnsubscribe(id string, data []byte) error {
+	return addErrorSource("StageUnsubscribe", f.db.SetStagedUnsubscribe(id, data))
+}
+
+func (f *pushDatabaseOpts) GetStagedUnsubscribe(id string) ([]byte, error) {
+	data, err := f.db.GetStagedUnsubscribe(id)
+	return data, addErrorSource("GetStagedUnsubscribe", err)
+}
+
+func (f *pushDatabaseOpts) GetStagedUnsubscribes() (map[string][]byte, error) {
+	records, err := f.db.GetStagedUnsubscribes()
+	return records, addErrorSource("GetStagedUnsubscribes", err)
+}
+
+func (f *pushDatabaseOpts) RemoveStagedUnsubscribe(id string) (bool, error) {
+	ok, err := f.db.RemoveStagedUnsubscribe(id)
+	return ok, addErrorSource("RemoveStagedUnsubscribe", err)
 }
 
 func addErrorSource(fnName string, err error) error {
 	if err == nil {
 		return nil
 	}
-	return fmt.Errorf("%s: %v", fnName, err)
+	return newError(fnName, "", err)
+}
+
+func (f *pushDatabaseOpts) FlagDeliveryPoint(service, dpName string, data []byte) error {
+	return addErrorSource("FlagDeliveryPoint", f.db.FlagDeliveryPoint(service, dpName, data))
+}
+
+func (f *pushDatabaseOpts) UnflagDeliveryPoints(service string, dpNames []string) error {
+	return addErrorSource("UnflagDeliveryPoints", f.db.UnflagDeliveryPoints(service, dpNames))
+}
+
+func (f *pushDatabaseOpts) GetFlaggedDeliveryPoints(service string) (map[string][]byte, error) {
+	records, err := f.db.GetFlaggedDeliveryPoints(service)
+	return records, addErrorSource("GetFlaggedDeliveryPoints", err)
+}
+
+func (f *pushDatabaseOpts) AddReplicationEvent(data []byte, maxLen int64) error {
+	return addErrorSource("AddReplicationEvent", f.db.AddReplicationEvent(data, maxLen))
+}
+
+func (f *pushDatabaseOpts) GetReplicationEvents(after string, count int64) ([]string, [][]byte, error) {
+	ids, events, err := f.db.GetReplicationEvents(after, count)
+	return ids, events, addErrorSource("GetReplicationEvents", err)
+}
+
+func (f *pushDatabaseOpts) SetReplicationClockIfNewer(service, subscriber, dpName, clock string) (bool, error) {
+	ok, err := f.db.SetReplicationClockIfNewer(service, subscriber, dpName, clock)
+	return ok, addErrorSource("SetReplicationClockIfNewer", err)
+}
+
+func (f *pushDatabaseOpts) GetReplicationOffset(peer string) (string, error) {
+	value, err := f.db.GetReplicationOffset(peer)
+	return value, addErrorSource("GetReplicationOffset", err)
+}
+
+func (f *pushDatabaseOpts) SetReplicationOffset(peer, id string) error {
+	return addErrorSource("SetReplicationOffset", f.db.SetReplicationOffset(peer, id))
 }
@@ -26,6 +26,7 @@ import (
 
 	"github.com/go-redis/redis"
 	"github.com/uniqush/log"
+	"github.com/uniqush/uniqush-push/metrics"
 	"github.com/uniqush/uniqush-push/push"
 )
 
@@ -34,22 +35,58 @@ import (
 type PushRedisDB struct {
 	client redisClient
 	psm    *push.PushServiceManager
+	// binaryValues is true if delivery points and push service providers are saved in the binary format instead of JSON.
+	binaryValues bool
+	// compressValues is true if delivery points are compressed with gzip before being saved.
+	compressValues bool
+	// credentials encrypts the credentials of push service providers before they are saved. If nil, they are saved in plaintext.
+	credentials *CredentialKeyring
+	// tenantEncryption is true if the delivery points of the services of tenants are encrypted with the data keys of their tenants.
+	tenantEncryption bool
+	tenantKeys       *tenantDataKeys
 }
 
 type redisClient interface {
 	Decr(key string) *redis.IntCmd
 	Del(keys ...string) *redis.IntCmd
+	Eval(script string, keys []string, args ...interface{}) *redis.Cmd
 	Exists(keys ...string) *redis.IntCmd
+	Expire(key string, expiration time.Duration) *redis.BoolCmd
 	FlushDb() *redis.StatusCmd // for tests only
 	Get(key string) *redis.StringCmd
+	HDel(key string, fields ...string) *redis.IntCmd
+	HGet(key, field string) *redis.StringCmd
+	HGetAll(key string) *redis.StringStringMapCmd
+	HIncrBy(key, field string, incr int64) *redis.IntCmd
+	HSet(key, field string, value interface{}) *redis.BoolCmd
 	Incr(key string) *redis.IntCmd
+	IncrBy(key string, value int64) *redis.IntCmd
 	Keys(key string) *redis.StringSliceCmd
+	LPush(key string, values ...interface{}) *redis.IntCmd
+	LLen(key string) *redis.IntCmd
+	LRange(key string, start, stop int64) *redis.StringSliceCmd
+	LRem(key string, count int64, value interface{}) *redis.IntCmd
+	LTrim(key string, start, stop int64) *redis.StatusCmd
 	MGet(keys ...string) *redis.SliceCmd
+	Ping() *redis.StatusCmd
+	Time() *redis.TimeCmd
+	Publish(channel string, message interface{}) *redis.IntCmd
 	Save() *redis.StatusCmd
 	SAdd(key string, members ...interface{}) *redis.IntCmd
+	SCard(key string) *redis.IntCmd
+	Scan(cursor uint64, match string, count int64) *redis.ScanCmd
 	SRem(key string, members ...interface{}) *redis.IntCmd
 	Set(key string, value interface{}, expiration time.Duration) *redis.StatusCmd
+	SetNX(key string, value interface{}, expiration time.Duration) *redis.BoolCmd
 	SMembers(key string) *redis.StringSliceCmd
+	Subscribe(channels ...string) *redis.PubSub
+	XAdd(a *redis.XAddArgs) *redis.StringCmd
+	XRead(a *redis.XReadArgs) *redis.XStreamSliceCmd
+	ZAdd(key string, members ...redis.Z) *redis.IntCmd
+	ZCard(key string) *redis.IntCmd
+	ZRange(key string, start, stop int64) *redis.StringSliceCmd
+	ZRem(key string, members ...interface{}) *redis.IntCmd
+	ZRemRangeByScore(key, min, max string) *redis.IntCmd
 }
 
 type redisMultiClient struct {
@@ -65,10 +102,18 @@ func (mc *redisMultiClient) Del(keys ...string) *redis.IntCmd {
 	return mc.masterClient.Del(keys...)
 }
 
+func (mc *redisMultiClient) Eval(script string, keys []string, args ...interface{}) *redis.Cmd {
+	return mc.masterClient.Eval(script, keys, args...)
+}
+
 func (mc *redisMultiClient) Exists(keys ...string) *redis.IntCmd {
 	return mc.slaveClient.Exists(keys...)
 }
 
+func (mc *redisMultiClient) Expire(key string, expiration time.Duration) *redis.BoolCmd {
+	return mc.masterClient.Expire(key, expiration)
+}
+
 func (mc *redisMultiClient) FlushDb() *redis.StatusCmd {
 	return mc.masterClient.FlushDb()
 }
@@ -77,14 +122,58 @@ func (mc *redisMultiClient) Get(key string) *redis.StringCmd {
 	return mc.slaveClient.Get(key)
 }
 
+func (mc *redisMultiClient) HDel(key string, fields ...string) *redis.IntCmd {
+	return mc.masterClient.HDel(key, fields...)
+}
+
+func (mc *redisMultiClient) HGet(key, field string) *redis.StringCmd {
+	return mc.slaveClient.HGet(key, field)
+}
+
+func (mc *redisMultiClient) HGetAll(key string) *redis.StringStringMapCmd {
+	return mc.slaveClient.HGetAll(key)
+}
+
+func (mc *redisMultiClient) HIncrBy(key, field string, incr int64) *redis.IntCmd {
+	return mc.masterClient.HIncrBy(key, field, incr)
+}
+
+func (mc *redisMultiClient) HSet(key, field string, value interface{}) *redis.BoolCmd {
+	return mc.masterClient.HSet(key, field, value)
+}
+
 func (mc *redisMultiClient) Incr(key string) *redis.IntCmd {
 	return mc.masterClient.Incr(key)
 }
 
+func (mc *redisMultiClient) IncrBy(key string, value int64) *redis.IntCmd {
+	return mc.masterClient.IncrBy(key, value)
+}
+
 func (mc *redisMultiClient) Keys(key string) *redis.StringSliceCmd {
 	return mc.slaveClient.Keys(key)
 }
 
+func (mc *redisMultiClient) LPush(key string, values ...interface{}) *redis.IntCmd {
+	return mc.masterClient.LPush(key, values...)
+}
+
+func (mc *redisMultiClient) LLen(key string) *redis.IntCmd {
+	return mc.slaveClient.LLen(key)
+}
+
+func (mc *redisMultiClient) LRange(key string, start, stop int64) *redis.StringSliceCmd {
+	return mc.slaveClient.LRange(key, start, stop)
+}
+
+func (mc *redisMultiClient) LRem(key string, count int64, value interface{}) *redis.IntCmd {
+	return mc.masterClient.LRem(key, count, value)
+}
+
+func (mc *redisMultiClient) LTrim(key string, start, stop int64) *redis.StatusCmd {
+	return mc.masterClient.LTrim(key, start, stop)
+}
+
 func (mc *redisMultiClient) MGet(keys ...string) *redis.SliceCmd {
 	return mc.slaveClient.MGet(keys...)
 }
@@ -97,6 +186,32 @@ func (mc *redisMultiClient) SAdd(key string, members ...interface{}) *redis.IntC
 	return mc.masterClient.SAdd(key, members...)
 }
 
+// SCard reads from the master, since it is used to enforce quotas right after adding members.
+func (mc *redisMultiClient) SCard(key string) *redis.IntCmd {
+	return mc.masterClient.SCard(key)
+}
+
+// Ping pings the master, then the slave, since both must be reachable to serve pushes and subscriptions.
+func (mc *redisMultiClient) Ping() *redis.StatusCmd {
+	if cmd := mc.masterClient.Ping(); cmd.Err() != nil {
+		return cmd
+	}
+	return mc.slaveClient.Ping()
+}
+
+// Time reads the clock of the master, which every instance writes to.
+func (mc *redisMultiClient) Time() *redis.TimeCmd {
+	return mc.masterClient.Time()
+}
+
+func (mc *redisMultiClient) Publish(channel string, message interface{}) *redis.IntCmd {
+	return mc.masterClient.Publish(channel, message)
+}
+
+func (mc *redisMultiClient) Scan(cursor uint64, match string, count int64) *redis.ScanCmd {
+	return mc.slaveClient.Scan(cursor, match, count)
+}
+
 func (mc *redisMultiClient) SRem(key string, members ...interface{}) *redis.IntCmd {
 	return mc.masterClient.SRem(key, members...)
 }
@@ -105,10 +220,47 @@ func (mc *redisMultiClient) Set(key string, value interface{}, expiration time.D
 	return mc.masterClient.Set(key, value, expiration)
 }
 
+func (mc *redisMultiClient) SetNX(key string, value interface{}, expiration time.Duration) *redis.BoolCmd {
+	return mc.masterClient.SetNX(key, value, expiration)
+}
+
 func (mc *redisMultiClient) SMembers(key string) *redis.StringSliceCmd {
 	return mc.slaveClient.SMembers(key)
 }
 
+func (mc *redisMultiClient) XAdd(a *redis.XAddArgs) *redis.StringCmd {
+	return mc.masterClient.XAdd(a)
+}
+
+// Subscribe uses the master, which receives messages as soon as they are published.
+func (mc *redisMultiClient) Subscribe(channels ...string) *redis.PubSub {
+	return mc.masterClient.Subscribe(channels...)
+}
+
+func (mc *redisMultiClient) XRead(a *redis.XReadArgs) *redis.XStreamSliceCmd {
+	return mc.slaveClient.XRead(a)
+}
+
+func (mc *redisMultiClient) ZAdd(key string, members ...redis.Z) *redis.IntCmd {
+	return mc.masterClient.ZAdd(key, members...)
+}
+
+func (mc *redisMultiClient) ZCard(key string) *redis.IntCmd {
+	return mc.slaveClient.ZCard(key)
+}
+
+func (mc *redisMultiClient) ZRange(key string, start, stop int64) *redis.StringSliceCmd {
+	return mc.slaveClient.ZRange(key, start, stop)
+}
+
+func (mc *redisMultiClient) ZRem(key string, members ...interface{}) *redis.IntCmd {
+	return mc.masterClient.ZRem(key, members...)
+}
+
+func (mc *redisMultiClient) ZRemRangeByScore(key, min, max string) *redis.IntCmd {
+	return mc.masterClient.ZRemRangeByScore(key, min, max)
+}
+
 var _ redisClient = &redis.Client{}
 var _ pushRawDatabase = &PushRedisDB{}
 
@@ -127,6 +279,78 @@ const (
 	DeliveryPointCounterPrefix string = "delivery.point.counter:"
 	// ServicesSet is the key for a redis SET - This is a set of service names.
 	ServicesSet string = "services{0}"
+	// LeasePrefix is the prefix of keys for a redis STRING (with an expiry) - Maps a lease name to the id of the uniqush-push instance holding it.
+	LeasePrefix string = "lease:"
+	// ClusterMembersKey is the key for a redis HASH - Maps the ids of uniqush-push instances in a cluster to json blobs with their last heartbeat.
+	ClusterMembersKey string = "cluster.members{0}"
+	// FallbackPushServiceProviderPrefix is the prefix of keys for a redis STRING - Maps a push service provider name to the name of the push service provider to fail over to.
+	FallbackPushServiceProviderPrefix string = "psp-2-fallback-psp:"
+	// PayloadFailuresPrefix is the prefix of keys for a redis STRING (with an expiry) - Maps a payload fingerprint to the number of times push services recently rejected that payload.
+	PayloadFailuresPrefix string = "payload.failures:"
+	// QuarantinedPayloadPrefix is the prefix of keys for a redis STRING (with an expiry) - Maps a payload fingerprint to a json blob describing why it was quarantined.
+	QuarantinedPayloadPrefix string = "quarantined.payload:"
+	// QuarantinedPayloadsSet is the key for a redis SET - This is a set of fingerprints of quarantined payloads (some of which may have expired).
+	QuarantinedPayloadsSet string = "quarantined.payloads{0}"
+	// DeliveryHistoryPrefix is the prefix of keys for a redis LIST (with an expiry) - Maps a service name + subscriber to json blobs describing recent push results, newest first.
+	DeliveryHistoryPrefix string = "delivery.history:"
+	// DeliveryHistoryIndexKey is the key for a redis ZSET - The members are the service name + subscriber of each delivery history, and the scores are the unix timestamps of their last pushes.
+	DeliveryHistoryIndexKey string = "delivery.history.index{0}"
+	// InboxPrefix is the prefix of keys for a redis LIST (with an expiry) - Maps a service name + subscriber to json blobs of the messages pushed to their inbox, newest first.
+	InboxPrefix string = "inbox:"
+	// BroadcastPrefix is the prefix of keys for a redis STRING - Maps a broadcast id to a json blob with the broadcast's notification and progress.
+	BroadcastPrefix string = "broadcast:"
+	// ActiveBroadcastsSet is the key for a redis SET - This is a set of ids of broadcasts which haven't finished.
+	ActiveBroadcastsSet string = "broadcasts.active{0}"
+	// BroadcastControlPrefix is the prefix of keys for a redis STRING (with an expiry) - Maps a broadcast id to the state (paused or cancelled) requested for it.
+	BroadcastControlPrefix string = "broadcast.control:"
+	// StagedUnsubscribePrefix is the prefix of keys for a redis STRING - Maps a staged unsubscribe id to a json blob with the delivery point to remove and when.
+	StagedUnsubscribePrefix string = "staged.unsubscribe:"
+	// StagedUnsubscribesSet is the key for a redis SET - This is a set of ids of unsubscribes which weren't committed or cancelled yet.
+	StagedUnsubscribesSet string = "staged.unsubscribes{0}"
+	// FlaggedDeliveryPointsPrefix is the prefix of keys for a redis HASH - Maps a service name to a hash of flagged delivery point names to json blobs describing why they were flagged.
+	FlaggedDeliveryPointsPrefix string = "flagged.dps:"
+	// ReplicationLogKey is the key for a redis STREAM - This is a log of the changes to subscriptions made in this region, read by the other regions.
+	ReplicationLogKey string = "replication.log{0}"
+	// ReplicationClockPrefix is the prefix of keys for a redis HASH - Maps a service name + subscriber to a hash of delivery point names to the clock of their latest change.
+	ReplicationClockPrefix string = "replication.clock:"
+	// ReplicationOffsetPrefix is the prefix of keys for a redis STRING - Maps a peer region to the id of the last event of its replication log applied in this region.
+	ReplicationOffsetPrefix string = "replication.offset:"
+	// AnalyticsPrefix is the prefix of keys for a redis HASH (with an expiry) - Maps a service name + the unix timestamp of the start of an hour to a hash of counter names (e.g. sent) to their counts during that hour.
+	AnalyticsPrefix string = "analytics:"
+	// UsagePrefix is the prefix of keys for a redis HASH (with an expiry) - Maps the unix timestamp of the start of a day to a hash of counter names + API key fingerprints (e.g. requests:sha256:...) to their counts during that day.
+	UsagePrefix string = "usage:"
+	// AuditLogKey is the key for a redis LIST - This is a log of json blobs describing administrative operations (e.g. changes to push service providers), newest first.
+	AuditLogKey string = "audit.log{0}"
+	// APIKeysKey is the key for a redis HASH - Maps the ids of API keys to json blobs with the hashes of their secrets, their scopes, and when they were rotated or revoked.
+	APIKeysKey string = "api.keys{0}"
+	// RequestSignaturePrefix is the prefix of keys for a redis STRING (with an expiry) - The HMAC signatures of signed API requests which were already received, to reject replays.
+	RequestSignaturePrefix string = "request.signature:"
+	// TenantsKey is the key for a redis HASH - Maps the ids of tenants to json blobs with their services and quotas.
+	TenantsKey string = "tenants{0}"
+	// TenantPushesPrefix is the prefix of keys for a redis STRING (with an expiry) - Maps a tenant + the unix timestamp of the start of a day to the number of pushes of the tenant during that day.
+	TenantPushesPrefix string = "tenant.pushes:"
+	// TenantSubscribersPrefix is the prefix of keys for a redis SET - Maps a tenant to the service + subscriber of each subscriber of its services.
+	TenantSubscribersPrefix string = "tenant.subscribers:"
+	// TenantDataKeyPrefix is the prefix of keys for a redis STRING - Maps a tenant to the data key encrypting the delivery points of its services
+	// (itself encrypted with the credential key, if one is configured). Deleting it shreds those delivery points.
+	TenantDataKeyPrefix string = "tenant.data.key:"
+	// ServiceTenantsKey is the key for a redis HASH - Maps service names to the tenant whose data key encrypts their delivery points.
+	ServiceTenantsKey string = "service.tenants{0}"
+	// MaintenanceKey is the key for a redis STRING - A json blob with the services whose pushes are held, while maintenance mode is on.
+	MaintenanceKey string = "maintenance{0}"
+	// HeldPushesKey is the key for a redis LIST - This is a queue of json blobs with the push requests held during maintenance mode, newest first.
+	HeldPushesKey string = "held.pushes{0}"
+	// SendingHeldPushesKey is the key for a redis ZSET - This maps the held push requests being sent (removed from HeldPushesKey) to the unix timestamp in milliseconds when they were claimed.
+	// They are removed once sent, or moved back to HeldPushesKey if they weren't sent in time (e.g. because the instance sending them crashed).
+	SendingHeldPushesKey string = "held.pushes.sending{0}"
+	// StagedPushServiceProvidersKey is the key for a redis HASH - This maps the names of push service providers to their staged credentials (a push service provider with the same name).
+	StagedPushServiceProvidersKey string = "psp.staged{0}"
+	// StagingStatesKey is the key for a redis HASH - This maps the names of push service providers to a json blob with how much traffic goes through their staged credentials.
+	StagingStatesKey string = "psp.staging{0}"
+	// FeatureFlagsKey is the key for a redis HASH - This maps "<flag>:<service>" (or "<flag>:*" for every service) to "1" if the feature flag is enabled, or "0" if it is disabled.
+	FeatureFlagsKey string = "feature.flags{0}"
+	// CacheInvalidationChannel is the name of a redis PUB/SUB channel - Messages are the keys of cached entries (e.g. "psp:<name>") which were changed by an instance, for every instance to evict.
+	CacheInvalidationChannel string = "cache.invalidation"
 )
 
 // buildRedisSlaveClient will optionally returns a redis client for uniqush-push to use for read-only operations (such as fetching subscriptions and services).
@@ -151,9 +375,28 @@ func buildRedisSlaveClient(c *DatabaseConfig) (*redis.Client, error) {
 		Password: c.Password,
 		DB:       int(db),
 	})
+	observeRedisCalls(ret, newSlowQueryLogger(c))
 	return ret, nil
 }
 
+// redisCallDuration is the latency of the commands sent to redis, by command name.
+var redisCallDuration = metrics.DefaultRegistry.NewHistogramVec("uniqush_redis_call_duration_seconds",
+	"Latency of redis commands, including retries.", metrics.DefaultBuckets, "command")
+
+// observeRedisCalls records the latency of every command client sends in redisCallDuration, and passes it to slowQueries.
+func observeRedisCalls(client *redis.Client, slowQueries *slowQueryLogger) {
+	client.WrapProcess(func(process func(cmd redis.Cmder) error) func(cmd redis.Cmder) error {
+		return func(cmd redis.Cmder) error {
+			start := time.Now()
+			err := process(cmd)
+			latency := time.Since(start)
+			redisCallDuration.Observe(latency.Seconds(), cmd.Name())
+			slowQueries.observe(cmd, latency)
+			return err
+		}
+	})
+}
+
 // buildRedisClient will build the client used to fetch and update subscriptions, services, etc.
 func buildRedisClient(c *DatabaseConfig) (redisClient, error) {
 	if c == nil {
@@ -182,6 +425,7 @@ func buildRedisClient(c *DatabaseConfig) (redisClient, error) {
 		Password: c.Password,
 		DB:       int(db),
 	})
+	observeRedisCalls(client, newSlowQueryLogger(c))
 	if slaveClient, err := buildRedisSlaveClient(c); slaveClient != nil || err != nil {
 		if err != nil {
 			return nil, fmt.Errorf("Invalid Redis Slave Database Config: %s", err.Error())
@@ -199,6 +443,7 @@ func buildPushRedisDB(client redisClient, psm *push.PushServiceManager) *PushRed
 	ret := new(PushRedisDB)
 	ret.client = client
 	ret.psm = psm
+	ret.tenantKeys = newTenantDataKeys()
 	if ret.psm == nil {
 		ret.psm = push.GetPushServiceManager()
 	}
@@ -212,6 +457,10 @@ func newPushRedisDB(c *DatabaseConfig) (*PushRedisDB, error) {
 	}
 
 	ret := buildPushRedisDB(client, c.PushServiceManager)
+	ret.binaryValues = c.ValueEncoding == ValueEncodingBinary
+	ret.compressValues = c.ValueCompression == ValueCompressionGzip
+	ret.credentials = c.CredentialKeys
+	ret.tenantEncryption = c.TenantEncryption
 	return ret, nil
 }
 
@@ -224,13 +473,38 @@ func (r *PushRedisDB) keyValueToDeliveryPoint(value []byte) (dp *push.DeliveryPo
 	return
 }
 
+// keyValueToPushServiceProvider decrypts the credentials of the push service provider, so that the layers above (including the cache) get plaintext credentials
+// (see CredentialKeyring).
 func (r *PushRedisDB) keyValueToPushServiceProvider(value []byte) (psp *push.PushServiceProvider, err error) {
 	psm := r.psm
 	psp, err = psm.BuildPushServiceProviderFromBytes(value)
 	if err != nil {
-		psp = nil
+		return nil, err
 	}
-	return
+	for _, fields := range []map[string]string{psp.FixedData, psp.VolatileData} {
+		if err = r.credentials.decryptFields(fields); err != nil {
+			return nil, fmt.Errorf("Cannot decrypt the credentials of %s: %v", psp.Name(), err)
+		}
+	}
+	return psp, nil
+}
+
+// storedPushServiceProvider returns the push service provider to save for psp: a copy with encrypted credentials if credential encryption is enabled.
+// psp itself keeps its plaintext credentials, since it is still used to push (and may be cached).
+func (r *PushRedisDB) storedPushServiceProvider(psp *push.PushServiceProvider) (*push.PushServiceProvider, error) {
+	if r.credentials == nil {
+		return psp, nil
+	}
+	stored, err := r.psm.BuildPushServiceProviderFromBytes(psp.Marshal())
+	if err != nil {
+		return nil, err
+	}
+	for _, fields := range []map[string]string{stored.FixedData, stored.VolatileData} {
+		if err := r.credentials.encryptFields(fields); err != nil {
+			return nil, err
+		}
+	}
+	return stored, nil
 }
 
 func deliveryPointToValue(dp *push.DeliveryPoint) []byte {
@@ -268,7 +542,23 @@ func (r *PushRedisDB) mgetRawDeliveryPoints(deliveryPointNames ...string) ([][]b
 
 	deliveryPointData, err := r.mgetStrings(deliveryPointKeys...)
 	if err != nil {
-		return nil, fmt.Errorf("Error getting deliveryPointKeys: %v", err)
+		return nil, newError("GetDeliveryPoints", DeliveryPointPrefix, err)
+	}
+	for i, data := range deliveryPointData {
+		if data == nil {
+			continue
+		}
+		if data, err = r.decryptDeliveryPointValue(data); err != nil || data == nil {
+			// Delivery points whose data key was shredded are missing.
+			deliveryPointData[i] = nil
+			if err != nil {
+				return nil, fmt.Errorf("Error decrypting delivery point %q: %v", deliveryPointNames[i], err)
+			}
+			continue
+		}
+		if deliveryPointData[i], err = decompressValue(data); err != nil {
+			return nil, fmt.Errorf("Error decompressing delivery point %q: %v", deliveryPointNames[i], err)
+		}
 	}
 	return deliveryPointData, nil
 }
@@ -277,18 +567,47 @@ func (r *PushRedisDB) mgetRawDeliveryPoints(deliveryPointNames ...string) ([][]b
 func (r *PushRedisDB) GetDeliveryPoint(name string) (*push.DeliveryPoint, error) {
 	b, err := r.client.Get(DeliveryPointPrefix + name).Bytes()
 	if err != nil {
-		return nil, fmt.Errorf("GetDeliveryPoint failed: %v", err)
+		return nil, newError("GetDeliveryPoint", DeliveryPointPrefix+name, err)
 	}
 	if len(b) == 0 {
 		return nil, nil
 	}
+	b, err = r.decryptDeliveryPointValue(b)
+	if err != nil || b == nil {
+		return nil, err
+	}
+	b, err = decompressValue(b)
+	if err != nil {
+		return nil, newError("GetDeliveryPoint", DeliveryPointPrefix+name, err)
+	}
 	return r.keyValueToDeliveryPoint(b)
 }
 
 // SetDeliveryPoint sets (adds or updates) the delivery point representation in the database.
 func (r *PushRedisDB) SetDeliveryPoint(dp *push.DeliveryPoint) error {
-	err := r.client.Set(DeliveryPointPrefix+dp.Name(), deliveryPointToValue(dp), 0).Err()
-	return err
+	save := func(value []byte) error {
+		value, err := r.deliveryPointValue(dp.FixedData["service"], value)
+		if err != nil {
+			return newError("SetDeliveryPoint", DeliveryPointPrefix+dp.Name(), err)
+		}
+		if err := r.client.Set(DeliveryPointPrefix+dp.Name(), value, 0).Err(); err != nil {
+			return newError("SetDeliveryPoint", DeliveryPointPrefix+dp.Name(), err)
+		}
+		return nil
+	}
+	if r.binaryValues {
+		return dp.WithBinary(save)
+	}
+	return save(deliveryPointToValue(dp))
+}
+
+// deliveryPointValue returns the value to save for a serialized delivery point of service, which is compressed if value_compression is gzip,
+// then encrypted with the data key of the tenant of service if tenant_encryption is on.
+func (r *PushRedisDB) deliveryPointValue(service string, value []byte) ([]byte, error) {
+	if r.compressValues {
+		value = compressValue(value)
+	}
+	return r.encryptDeliveryPointValue(service, value)
 }
 
 // GetPushServiceProvider will fetch and unserialize the push service provider with the given name.
@@ -296,7 +615,7 @@ func (r *PushRedisDB) GetPushServiceProvider(name string) (*push.PushServiceProv
 	cmd := r.client.Get(PushServiceProviderPrefix + name)
 	b, err := cmd.Bytes()
 	if err != nil {
-		return nil, fmt.Errorf("GetPushServiceProvider failed: %v", err)
+		return nil, newError("GetPushServiceProvider", PushServiceProviderPrefix+name, err)
 	}
 	if len(b) == 0 {
 		return nil, nil
@@ -315,7 +634,7 @@ func (r *PushRedisDB) GetPushServiceProviderConfigs(names []string) ([]*push.Pus
 	}
 	values, err := r.mgetStrings(keys...)
 	if err != nil {
-		return nil, []error{fmt.Errorf("GetPushServiceProviderConfigs: %v", err)}
+		return nil, []error{newError("GetPushServiceProviderConfigs", PushServiceProviderPrefix, err)}
 	}
 	errors := make([]error, 0)
 	psps := make([]*push.PushServiceProvider, 0)
@@ -334,10 +653,50 @@ func (r *PushRedisDB) GetPushServiceProviderConfigs(names []string) ([]*push.Pus
 	return psps, errors
 }
 
+// GetPushServiceProviders will fetch and unserialize the push service providers with the given names, in one MGET.
+// Returns them by name. Push service providers which don't exist are missing from the result.
+func (r *PushRedisDB) GetPushServiceProviders(names []string) (map[string]*push.PushServiceProvider, error) {
+	psps := make(map[string]*push.PushServiceProvider, len(names))
+	if len(names) == 0 {
+		return psps, nil
+	}
+	keys := make([]string, len(names))
+	for i, name := range names {
+		keys[i] = PushServiceProviderPrefix + name
+	}
+	values, err := r.mgetStrings(keys...)
+	if err != nil {
+		return nil, newError("GetPushServiceProviders", PushServiceProviderPrefix, err)
+	}
+	for i, value := range values {
+		if len(value) == 0 {
+			continue
+		}
+		psp, err := r.keyValueToPushServiceProvider(value)
+		if err != nil {
+			return nil, fmt.Errorf("GetPushServiceProviders: invalid psp %q: %v", names[i], err)
+		}
+		psps[names[i]] = psp
+	}
+	return psps, nil
+}
+
 // SetPushServiceProvider will add or update the push service provider psp. The redis key is based on a hash of FixedData.
 func (r *PushRedisDB) SetPushServiceProvider(psp *push.PushServiceProvider) error {
-	if err := r.client.Set(PushServiceProviderPrefix+psp.Name(), pushServiceProviderToValue(psp), 0).Err(); err != nil {
-		return fmt.Errorf("SetPushServiceProvider %q failed: %v", psp.Name(), err)
+	name := psp.Name()
+	stored, err := r.storedPushServiceProvider(psp)
+	if err != nil {
+		return newError("SetPushServiceProvider", PushServiceProviderPrefix+name, err)
+	}
+	if r.binaryValues {
+		err = stored.WithBinary(func(value []byte) error {
+			return r.client.Set(PushServiceProviderPrefix+name, value, 0).Err()
+		})
+	} else {
+		err = r.client.Set(PushServiceProviderPrefix+name, pushServiceProviderToValue(stored), 0).Err()
+	}
+	if err != nil {
+		return newError("SetPushServiceProvider", PushServiceProviderPrefix+name, err)
 	}
 	return nil
 }
@@ -346,7 +705,7 @@ func (r *PushRedisDB) SetPushServiceProvider(psp *push.PushServiceProvider) erro
 func (r *PushRedisDB) RemoveDeliveryPoint(dp string) error {
 	err := r.client.Del(DeliveryPointPrefix + dp).Err()
 	if err != nil {
-		return fmt.Errorf("RemoveDP %q failed: %v", dp, err)
+		return newError("RemoveDeliveryPoint", DeliveryPointPrefix+dp, err)
 	}
 	return nil
 }
@@ -355,7 +714,7 @@ func (r *PushRedisDB) RemoveDeliveryPoint(dp string) error {
 func (r *PushRedisDB) RemovePushServiceProvider(psp string) error {
 	err := r.client.Del(PushServiceProviderPrefix + psp).Err()
 	if err != nil {
-		return fmt.Errorf("RemovePSP %q failed: %v", psp, err)
+		return newError("RemovePushServiceProvider", PushServiceProviderPrefix+psp, err)
 	}
 	return nil
 }
@@ -369,7 +728,7 @@ func (r *PushRedisDB) GetDeliveryPointsNameByServiceSubscriber(srv, sub string)
 		var err error
 		keys, err = r.client.Keys(ServiceSubscriberToDeliveryPointsPrefix + srv + ":" + sub).Result()
 		if err != nil {
-			return nil, fmt.Errorf("GetDPsNameByServiceSubscriber dp lookup '%s:%s' failed: %v", srv, sub, err)
+			return nil, newError("GetDeliveryPointsNameByServiceSubscriber", ServiceSubscriberToDeliveryPointsPrefix+srv+":"+sub, err)
 		}
 	}
 
@@ -377,7 +736,7 @@ func (r *PushRedisDB) GetDeliveryPointsNameByServiceSubscriber(srv, sub string)
 	for _, k := range keys {
 		m, err := r.client.SMembers(k).Result()
 		if err != nil {
-			return nil, fmt.Errorf("GetDPsNameByServiceSubscriber smembers %q failed: %v", k, err)
+			return nil, newError("GetDeliveryPointsNameByServiceSubscriber", k, err)
 		}
 		if m == nil {
 			continue
@@ -400,7 +759,7 @@ func (r *PushRedisDB) GetDeliveryPointsNameByServiceSubscriber(srv, sub string)
 func (r *PushRedisDB) GetPushServiceProviderNameByServiceDeliveryPoint(srv, dp string) (string, error) {
 	b, err := r.client.Get(ServiceDeliveryPointToPushServiceProviderPrefix + srv + ":" + dp).Result()
 	if err != nil {
-		return "", fmt.Errorf("GetPSPNameByServiceDP failed: %v", err)
+		return "", newError("GetPushServiceProviderNameByServiceDeliveryPoint", ServiceDeliveryPointToPushServiceProviderPrefix+srv+":"+dp, err)
 	}
 	return b, nil
 }
@@ -409,14 +768,14 @@ func (r *PushRedisDB) GetPushServiceProviderNameByServiceDeliveryPoint(srv, dp s
 func (r *PushRedisDB) AddDeliveryPointToServiceSubscriber(srv, sub, dp string) error {
 	i, err := r.client.SAdd(ServiceSubscriberToDeliveryPointsPrefix+srv+":"+sub, dp).Result()
 	if err != nil {
-		return fmt.Errorf("AddDPToServiceSubscriber failed: %v", err)
+		return newError("AddDeliveryPointToServiceSubscriber", ServiceSubscriberToDeliveryPointsPrefix+srv+":"+sub, err)
 	}
 	if i == 0 { // Already exists
 		return nil
 	}
 	err = r.client.Incr(DeliveryPointCounterPrefix + dp).Err()
 	if err != nil {
-		return fmt.Errorf("AddDPToServiceSubscriber count tracking failed: %v", err)
+		return newError("AddDeliveryPointToServiceSubscriber", DeliveryPointCounterPrefix+dp, err)
 	}
 	return nil
 }
@@ -425,23 +784,23 @@ func (r *PushRedisDB) AddDeliveryPointToServiceSubscriber(srv, sub, dp string) e
 func (r *PushRedisDB) RemoveDeliveryPointFromServiceSubscriber(srv, sub, dp string) error {
 	j, err := r.client.SRem(ServiceSubscriberToDeliveryPointsPrefix+srv+":"+sub, dp).Result()
 	if err != nil {
-		return fmt.Errorf("Removing the delivery point pointer %q from \"%s:%s\" failed", dp, srv, sub)
+		return newError("RemoveDeliveryPointFromServiceSubscriber", ServiceSubscriberToDeliveryPointsPrefix+srv+":"+sub, err)
 	}
 	if j == 0 {
 		return nil
 	}
 	i, e := r.client.Decr(DeliveryPointCounterPrefix + dp).Result()
 	if e != nil {
-		return fmt.Errorf("Failed to decrement number of subscribers using dp %q: %v", dp, e)
+		return newError("RemoveDeliveryPointFromServiceSubscriber", DeliveryPointCounterPrefix+dp, e)
 	}
 	if i <= 0 {
 		e0 := r.client.Del(DeliveryPointCounterPrefix + dp).Err()
 		if e0 != nil {
-			return fmt.Errorf("Failed to remove counter for %q: %v", dp, e0)
+			return newError("RemoveDeliveryPointFromServiceSubscriber", DeliveryPointCounterPrefix+dp, e0)
 		}
 		e1 := r.client.Del(DeliveryPointPrefix + dp).Err()
 		if e1 != nil {
-			return fmt.Errorf("Failed to remove delivery point info for %q: %v", dp, e1)
+			return newError("RemoveDeliveryPointFromServiceSubscriber", DeliveryPointPrefix+dp, e1)
 		}
 	}
 	return nil
@@ -465,7 +824,7 @@ func (r *PushRedisDB) removeMissingDeliveryPointFromServiceSubscriber(service, s
 func (r *PushRedisDB) SetPushServiceProviderOfServiceDeliveryPoint(srv, dp, psp string) error {
 	err := r.client.Set(ServiceDeliveryPointToPushServiceProviderPrefix+srv+":"+dp, psp, 0).Err()
 	if err != nil {
-		return fmt.Errorf("SetPSPOfServiceDP failed for \"%s:%s\": %v", srv, dp, err)
+		return newError("SetPushServiceProviderOfServiceDeliveryPoint", ServiceDeliveryPointToPushServiceProviderPrefix+srv+":"+dp, err)
 	}
 	return nil
 }
@@ -474,16 +833,16 @@ func (r *PushRedisDB) SetPushServiceProviderOfServiceDeliveryPoint(srv, dp, psp
 func (r *PushRedisDB) RemovePushServiceProviderOfServiceDeliveryPoint(srv, dp string) error {
 	err := r.client.Del(ServiceDeliveryPointToPushServiceProviderPrefix + srv + ":" + dp).Err()
 	if err != nil {
-		return fmt.Errorf("RemovePSPOfServiceDP failed for \"%s:%s\": %v", srv, dp, err)
+		return newError("RemovePushServiceProviderOfServiceDeliveryPoint", ServiceDeliveryPointToPushServiceProviderPrefix+srv+":"+dp, err)
 	}
-	return err
+	return nil
 }
 
 // GetPushServiceProvidersByService will return a list of the names of push service providers belonging to the given service name
 func (r *PushRedisDB) GetPushServiceProvidersByService(srv string) ([]string, error) {
 	m, err := r.client.SMembers(ServiceToPushServiceProvidersPrefix + srv).Result()
 	if err != nil {
-		return nil, fmt.Errorf("GetPSPsByService failed for %q: %v", srv, err)
+		return nil, newError("GetPushServiceProvidersByService", ServiceToPushServiceProvidersPrefix+srv, err)
 	}
 	if m == nil {
 		return nil, nil
@@ -496,18 +855,18 @@ func (r *PushRedisDB) GetPushServiceProvidersByService(srv string) ([]string, er
 func (r *PushRedisDB) RemovePushServiceProviderFromService(srv, psp string) error {
 	err := r.client.SRem(ServiceToPushServiceProvidersPrefix+srv, psp).Err()
 	if err != nil {
-		return fmt.Errorf("RemovePSPFromService failed for psp %q of service %q: %v", psp, srv, err)
+		return newError("RemovePushServiceProviderFromService", ServiceToPushServiceProvidersPrefix+srv, err)
 	}
 	// A service name can be associated with multiple push service providers, so we must first check if there are no more push service providers of that type
 	// The API /addpsp allows psps with the same service name but different pushservicetypes (e.g. gcm, apns).
 	exists, err := r.client.Exists(ServiceToPushServiceProvidersPrefix + srv).Result()
 	if err != nil {
-		return fmt.Errorf("Unable to determine if service %q still exists after removing psp %q: %v", srv, psp, err)
+		return newError("RemovePushServiceProviderFromService", ServiceToPushServiceProvidersPrefix+srv, err)
 	}
 	if exists == 0 {
 		err := r.client.SRem(ServicesSet, srv).Err() // Non-essential. Used to list services in API.
 		if err != nil {
-			return fmt.Errorf("Unable to remove %q from set of services", srv)
+			return newError("RemovePushServiceProviderFromService", ServicesSet, err)
 		}
 	}
 	return nil
@@ -518,11 +877,11 @@ func (r *PushRedisDB) AddPushServiceProviderToService(srv, psp string) error {
 	// TODO: pipelined
 	err := r.client.SAdd(ServicesSet, srv).Err() // Used to list services in API.
 	if err != nil {
-		return fmt.Errorf("Unable to add %q to set of services", srv)
+		return newError("AddPushServiceProviderToService", ServicesSet, err)
 	}
 	err = r.client.SAdd(ServiceToPushServiceProvidersPrefix+srv, psp).Err()
 	if err != nil {
-		return fmt.Errorf("AddPSPToService failed for psp %q of service %q: %v", psp, srv, err)
+		return newError("AddPushServiceProviderToService", ServiceToPushServiceProvidersPrefix+srv, err)
 	}
 	return nil
 }
@@ -531,7 +890,7 @@ func (r *PushRedisDB) AddPushServiceProviderToService(srv, psp string) error {
 func (r *PushRedisDB) GetServiceNames() ([]string, error) {
 	serviceList, err := r.client.SMembers(ServicesSet).Result()
 	if err != nil {
-		return nil, fmt.Errorf("Could not get services from redis: %v", err)
+		return nil, newError("GetServiceNames", ServicesSet, err)
 	}
 	return serviceList, nil
 }
@@ -542,7 +901,7 @@ func (r *PushRedisDB) RebuildServiceSet() error {
 	// If any step fails, then return an error.
 	pspKeys, err := r.client.Keys(PushServiceProviderPrefix + "*").Result()
 	if err != nil {
-		return fmt.Errorf("Failed to fetch PSPs using redis KEYS command: %v", err)
+		return newError("RebuildServiceSet", PushServiceProviderPrefix+"*", err)
 	}
 
 	if len(pspKeys) == 0 {
@@ -577,12 +936,22 @@ func (r *PushRedisDB) RebuildServiceSet() error {
 	if len(serviceNameList) > 0 {
 		err := r.client.SAdd(ServicesSet, serviceNameList...).Err()
 		if err != nil {
-			return err
+			return newError("RebuildServiceSet", ServicesSet, err)
 		}
 	}
 	return nil
 }
 
+// Ping returns an error if redis can't be reached.
+func (r *PushRedisDB) Ping() error {
+	return r.client.Ping().Err()
+}
+
+// Time returns the clock of the redis server.
+func (r *PushRedisDB) Time() (time.Time, error) {
+	return r.client.Time().Result()
+}
+
 // FlushCache will ensure that redis data has been saved to disk.
 func (r *PushRedisDB) FlushCache() error {
 	// TODO: Make this configurable, allow uniqush configs to prevent redis flushes, e.g. if redis backups are set up already.
@@ -595,7 +964,7 @@ func (r *PushRedisDB) GetSubscriptions(queryServices []string, subscriber string
 	if len(queryServices) == 0 {
 		definedServices, err := r.GetServiceNames()
 		if err != nil {
-			return nil, fmt.Errorf("GetSubscriptions: %v", err)
+			return nil, newError("GetSubscriptions", ServicesSet, err)
 		}
 		queryServices = definedServices
 	}
@@ -611,7 +980,7 @@ func (r *PushRedisDB) GetSubscriptions(queryServices []string, subscriber string
 		deliveryPoints, err := r.client.SMembers(ServiceSubscriberToDeliveryPointsPrefix + service + ":" + subscriber).Result()
 
 		if err != nil {
-			return nil, fmt.Errorf("Could not get subscriber information")
+			return nil, newError("GetSubscriptions", ServiceSubscriberToDeliveryPointsPrefix+service+":"+subscriber, err)
 		}
 		if len(deliveryPoints) == 0 {
 			// it is OK to not have delivery points for a service
@@ -0,0 +1,65 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package db
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+func analyticsKey(srv string, hour int64) string {
+	return AnalyticsPrefix + srv + ":" + strconv.FormatInt(hour, 10)
+}
+
+// IncrAnalyticsCounts will add counts to the counters of a service for the hour starting at the unix timestamp hour.
+// The counters of the hour expire after retention.
+func (r *PushRedisDB) IncrAnalyticsCounts(srv string, hour int64, counts map[string]int64, retention time.Duration) error {
+	key := analyticsKey(srv, hour)
+	for name, n := range counts {
+		if err := r.client.HIncrBy(key, name, n).Err(); err != nil {
+			return newError("IncrAnalyticsCounts", key, err)
+		}
+	}
+	if err := r.client.Expire(key, retention).Err(); err != nil {
+		return newError("IncrAnalyticsCounts", key, err)
+	}
+	return nil
+}
+
+// GetAnalyticsCounts will return the counters of a service for each of the hours (unix timestamps of the start of the hour).
+// Hours without counters have an empty map.
+func (r *PushRedisDB) GetAnalyticsCounts(srv string, hours []int64) ([]map[string]int64, error) {
+	ret := make([]map[string]int64, len(hours))
+	for i, hour := range hours {
+		values, err := r.client.HGetAll(analyticsKey(srv, hour)).Result()
+		if err != nil {
+			return nil, newError("GetAnalyticsCounts", analyticsKey(srv, hour), err)
+		}
+		counts := make(map[string]int64, len(values))
+		for name, value := range values {
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("GetAnalyticsCounts %q: invalid count %q of %q: %v", srv, value, name, err)
+			}
+			counts[name] = n
+		}
+		ret[i] = counts
+	}
+	return ret, nil
+}
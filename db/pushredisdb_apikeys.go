@@ -0,0 +1,55 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package db
+
+import (
+	"github.com/go-redis/redis"
+)
+
+// SetAPIKey will save the record of the API key with the given id, replacing the previous one.
+func (r *PushRedisDB) SetAPIKey(id string, record []byte) error {
+	if err := r.client.HSet(APIKeysKey, id, record).Err(); err != nil {
+		return newError("SetAPIKey", APIKeysKey, err)
+	}
+	return nil
+}
+
+// GetAPIKey will return the record of the API key with the given id, or nil if there is no such key.
+func (r *PushRedisDB) GetAPIKey(id string) ([]byte, error) {
+	record, err := r.client.HGet(APIKeysKey, id).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, newError("GetAPIKey", APIKeysKey, err)
+	}
+	return record, nil
+}
+
+// GetAPIKeys will return the records of all API keys, by id.
+func (r *PushRedisDB) GetAPIKeys() (map[string][]byte, error) {
+	records, err := r.client.HGetAll(APIKeysKey).Result()
+	if err != nil {
+		return nil, newError("GetAPIKeys", APIKeysKey, err)
+	}
+	ret := make(map[string][]byte, len(records))
+	for id, record := range records {
+		ret[id] = []byte(record)
+	}
+	return ret, nil
+}
@@ -0,0 +1,55 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package db
+
+// AddAuditRecord will add a record of an administrative operation to the front of the audit log.
+// Only the newest maxRecords are kept. Unlike other logs, the audit log doesn't expire.
+func (r *PushRedisDB) AddAuditRecord(record []byte, maxRecords int64) error {
+	if err := r.client.LPush(AuditLogKey, record).Err(); err != nil {
+		return newError("AddAuditRecord", AuditLogKey, err)
+	}
+	if err := r.client.LTrim(AuditLogKey, 0, maxRecords-1).Err(); err != nil {
+		return newError("AddAuditRecord", AuditLogKey, err)
+	}
+	return nil
+}
+
+// TrimAuditRecords will remove the n oldest records of the audit log.
+func (r *PushRedisDB) TrimAuditRecords(n int64) error {
+	if n <= 0 {
+		return nil
+	}
+	// Trimming from the end is safe while newer records are pushed to the front.
+	if err := r.client.LTrim(AuditLogKey, 0, -n-1).Err(); err != nil {
+		return newError("TrimAuditRecords", AuditLogKey, err)
+	}
+	return nil
+}
+
+// GetAuditRecords will return the records of the audit log from index start to stop (inclusive, 0 being the newest record), newest first.
+// Negative indexes count from the oldest record (-1).
+func (r *PushRedisDB) GetAuditRecords(start, stop int64) ([][]byte, error) {
+	records, err := r.client.LRange(AuditLogKey, start, stop).Result()
+	if err != nil {
+		return nil, newError("GetAuditRecords", AuditLogKey, err)
+	}
+	ret := make([][]byte, len(records))
+	for i, record := range records {
+		ret[i] = []byte(record)
+	}
+	return ret, nil
+}
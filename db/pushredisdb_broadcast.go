@@ -0,0 +1,113 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package db
+
+import (
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// ScanSubscribersOfService will return a batch of roughly count subscribers of the service srv matching pattern, using a redis SCAN cursor.
+// Returns the cursor of the next batch, which is 0 after the last batch.
+func (r *PushRedisDB) ScanSubscribersOfService(srv, pattern string, cursor uint64, count int64) ([]string, uint64, error) {
+	prefix := ServiceSubscriberToDeliveryPointsPrefix + srv + ":"
+	keys, next, err := r.client.Scan(cursor, prefix+pattern, count).Result()
+	if err != nil {
+		return nil, 0, newError("ScanSubscribersOfService", prefix+pattern, err)
+	}
+	subs := make([]string, len(keys))
+	for i, key := range keys {
+		subs[i] = strings.TrimPrefix(key, prefix)
+	}
+	return subs, next, nil
+}
+
+// SetBroadcast will save the state of a broadcast. If ttl is 0, the state never expires.
+func (r *PushRedisDB) SetBroadcast(id string, data []byte, ttl time.Duration) error {
+	if err := r.client.Set(BroadcastPrefix+id, data, ttl).Err(); err != nil {
+		return newError("SetBroadcast", BroadcastPrefix+id, err)
+	}
+	return nil
+}
+
+// GetBroadcast will return the state of a broadcast, or nil if there is no broadcast with that id.
+func (r *PushRedisDB) GetBroadcast(id string) ([]byte, error) {
+	data, err := r.client.Get(BroadcastPrefix + id).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, newError("GetBroadcast", BroadcastPrefix+id, err)
+	}
+	return data, nil
+}
+
+// AddActiveBroadcast will add a broadcast to the set of broadcasts which haven't finished.
+func (r *PushRedisDB) AddActiveBroadcast(id string) error {
+	if err := r.client.SAdd(ActiveBroadcastsSet, id).Err(); err != nil {
+		return newError("AddActiveBroadcast", ActiveBroadcastsSet, err)
+	}
+	return nil
+}
+
+// RemoveActiveBroadcast will remove a finished broadcast from the set of broadcasts which haven't finished.
+func (r *PushRedisDB) RemoveActiveBroadcast(id string) error {
+	if err := r.client.SRem(ActiveBroadcastsSet, id).Err(); err != nil {
+		return newError("RemoveActiveBroadcast", ActiveBroadcastsSet, err)
+	}
+	return nil
+}
+
+// SetBroadcastControl will save a state change (e.g. "paused") requested for a broadcast, which the instance sending it applies after its current batch.
+func (r *PushRedisDB) SetBroadcastControl(id, control string, ttl time.Duration) error {
+	if err := r.client.Set(BroadcastControlPrefix+id, control, ttl).Err(); err != nil {
+		return newError("SetBroadcastControl", BroadcastControlPrefix+id, err)
+	}
+	return nil
+}
+
+// GetBroadcastControl will return the state change requested for a broadcast, or "" if there is none.
+func (r *PushRedisDB) GetBroadcastControl(id string) (string, error) {
+	control, err := r.client.Get(BroadcastControlPrefix + id).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	if err != nil {
+		return "", newError("GetBroadcastControl", BroadcastControlPrefix+id, err)
+	}
+	return control, nil
+}
+
+// RemoveBroadcastControl will remove the state change requested for a broadcast, once it was applied (or undone).
+func (r *PushRedisDB) RemoveBroadcastControl(id string) error {
+	if err := r.client.Del(BroadcastControlPrefix + id).Err(); err != nil {
+		return newError("RemoveBroadcastControl", BroadcastControlPrefix+id, err)
+	}
+	return nil
+}
+
+// GetActiveBroadcasts will return the ids of broadcasts which haven't finished.
+func (r *PushRedisDB) GetActiveBroadcasts() ([]string, error) {
+	ids, err := r.client.SMembers(ActiveBroadcastsSet).Result()
+	if err != nil {
+		return nil, newError("GetActiveBroadcasts", ActiveBroadcastsSet, err)
+	}
+	return ids, nil
+}
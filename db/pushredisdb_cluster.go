@@ -0,0 +1,51 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package db
+
+// SetClusterMember will save the heartbeat of the uniqush-push instance with the given id, replacing the previous one.
+func (r *PushRedisDB) SetClusterMember(id string, data []byte) error {
+	if err := r.client.HSet(ClusterMembersKey, id, data).Err(); err != nil {
+		return newError("SetClusterMember", ClusterMembersKey, err)
+	}
+	return nil
+}
+
+// GetClusterMembers will return the last heartbeat of every instance in the cluster, by id.
+// Instances which stopped without removing themselves are included until they are pruned.
+func (r *PushRedisDB) GetClusterMembers() (map[string][]byte, error) {
+	records, err := r.client.HGetAll(ClusterMembersKey).Result()
+	if err != nil {
+		return nil, newError("GetClusterMembers", ClusterMembersKey, err)
+	}
+	ret := make(map[string][]byte, len(records))
+	for id, record := range records {
+		ret[id] = []byte(record)
+	}
+	return ret, nil
+}
+
+// RemoveClusterMembers will remove the heartbeats of the instances with the given ids.
+func (r *PushRedisDB) RemoveClusterMembers(ids ...string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	if err := r.client.HDel(ClusterMembersKey, ids...).Err(); err != nil {
+		return newError("RemoveClusterMembers", ClusterMembersKey, err)
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package db
+
+import (
+	"github.com/go-redis/redis"
+)
+
+// SetFallbackPushServiceProvider will make fallback the push service provider used when psp rejects a push or is unavailable.
+func (r *PushRedisDB) SetFallbackPushServiceProvider(psp, fallback string) error {
+	if err := r.client.Set(FallbackPushServiceProviderPrefix+psp, fallback, 0).Err(); err != nil {
+		return newError("SetFallbackPushServiceProvider", FallbackPushServiceProviderPrefix+psp, err)
+	}
+	return nil
+}
+
+// GetFallbackPushServiceProvider will return the name of the fallback push service provider of psp, or "" if there is none.
+func (r *PushRedisDB) GetFallbackPushServiceProvider(psp string) (string, error) {
+	fallback, err := r.client.Get(FallbackPushServiceProviderPrefix + psp).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	if err != nil {
+		return "", newError("GetFallbackPushServiceProvider", FallbackPushServiceProviderPrefix+psp, err)
+	}
+	return fallback, nil
+}
+
+// RemoveFallbackPushServiceProvider will remove the association between psp and its fallback push service provider.
+func (r *PushRedisDB) RemoveFallbackPushServiceProvider(psp string) error {
+	if err := r.client.Del(FallbackPushServiceProviderPrefix + psp).Err(); err != nil {
+		return newError("RemoveFallbackPushServiceProvider", FallbackPushServiceProviderPrefix+psp, err)
+	}
+	return nil
+}
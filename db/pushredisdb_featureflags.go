@@ -0,0 +1,50 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package db
+
+// SetFeatureFlag will enable or disable the feature flag named name.
+func (r *PushRedisDB) SetFeatureFlag(name string, enabled bool) error {
+	value := "0"
+	if enabled {
+		value = "1"
+	}
+	if err := r.client.HSet(FeatureFlagsKey, name, value).Err(); err != nil {
+		return newError("SetFeatureFlag", FeatureFlagsKey, err)
+	}
+	return nil
+}
+
+// GetFeatureFlags will return whether each feature flag which was set is enabled, by name.
+func (r *PushRedisDB) GetFeatureFlags() (map[string]bool, error) {
+	values, err := r.client.HGetAll(FeatureFlagsKey).Result()
+	if err != nil {
+		return nil, newError("GetFeatureFlags", FeatureFlagsKey, err)
+	}
+	flags := make(map[string]bool, len(values))
+	for name, value := range values {
+		flags[name] = value == "1"
+	}
+	return flags, nil
+}
+
+// RemoveFeatureFlag will remove the feature flag named name.
+func (r *PushRedisDB) RemoveFeatureFlag(name string) error {
+	if err := r.client.HDel(FeatureFlagsKey, name).Err(); err != nil {
+		return newError("RemoveFeatureFlag", FeatureFlagsKey, err)
+	}
+	return nil
+}
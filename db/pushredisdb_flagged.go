@@ -0,0 +1,50 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package db
+
+// FlagDeliveryPoint will save why a delivery point of a service was flagged (e.g. the push service no longer recognizes it).
+func (r *PushRedisDB) FlagDeliveryPoint(srv, dpName string, data []byte) error {
+	if err := r.client.HSet(FlaggedDeliveryPointsPrefix+srv, dpName, data).Err(); err != nil {
+		return newError("FlagDeliveryPoint", FlaggedDeliveryPointsPrefix+srv, err)
+	}
+	return nil
+}
+
+// UnflagDeliveryPoints will remove the flags of delivery points of a service.
+func (r *PushRedisDB) UnflagDeliveryPoints(srv string, dpNames []string) error {
+	if len(dpNames) == 0 {
+		return nil
+	}
+	if err := r.client.HDel(FlaggedDeliveryPointsPrefix+srv, dpNames...).Err(); err != nil {
+		return newError("UnflagDeliveryPoints", FlaggedDeliveryPointsPrefix+srv, err)
+	}
+	return nil
+}
+
+// GetFlaggedDeliveryPoints will return the flagged delivery points of a service, by delivery point name.
+func (r *PushRedisDB) GetFlaggedDeliveryPoints(srv string) (map[string][]byte, error) {
+	values, err := r.client.HGetAll(FlaggedDeliveryPointsPrefix + srv).Result()
+	if err != nil {
+		return nil, newError("GetFlaggedDeliveryPoints", FlaggedDeliveryPointsPrefix+srv, err)
+	}
+	ret := make(map[string][]byte, len(values))
+	for dpName, data := range values {
+		ret[dpName] = []byte(data)
+	}
+	return ret, nil
+}
@@ -0,0 +1,92 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package db
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// AddDeliveryRecord will add a record of a push result to the front of the delivery history of a service+subscriber.
+// Only the newest maxRecords are kept, and the history expires after retention unless another record is added.
+// The time of the push is also saved in the index of delivery histories, which CompactDeliveryHistories uses to evict histories.
+func (r *PushRedisDB) AddDeliveryRecord(srv, sub string, record []byte, maxRecords int64, retention time.Duration) error {
+	key := DeliveryHistoryPrefix + srv + ":" + sub
+	if err := r.client.LPush(key, record).Err(); err != nil {
+		return newError("AddDeliveryRecord", key, err)
+	}
+	if err := r.client.LTrim(key, 0, maxRecords-1).Err(); err != nil {
+		return newError("AddDeliveryRecord", key, err)
+	}
+	if err := r.client.Expire(key, retention).Err(); err != nil {
+		return newError("AddDeliveryRecord", key, err)
+	}
+	if err := r.client.ZAdd(DeliveryHistoryIndexKey, redis.Z{Score: float64(time.Now().Unix()), Member: srv + ":" + sub}).Err(); err != nil {
+		return newError("AddDeliveryRecord", DeliveryHistoryIndexKey, err)
+	}
+	return nil
+}
+
+// CompactDeliveryHistories will remove the histories whose last push was before the unix timestamp idleBefore from the index (their keys have expired),
+// then delete the least recently pushed histories until at most maxSubscribers are left (unless maxSubscribers is 0). Returns the number of deleted histories.
+func (r *PushRedisDB) CompactDeliveryHistories(idleBefore int64, maxSubscribers int64) (int64, error) {
+	if err := r.client.ZRemRangeByScore(DeliveryHistoryIndexKey, "-inf", "("+strconv.FormatInt(idleBefore, 10)).Err(); err != nil {
+		return 0, newError("CompactDeliveryHistories", DeliveryHistoryIndexKey, err)
+	}
+	if maxSubscribers <= 0 {
+		return 0, nil
+	}
+	n, err := r.client.ZCard(DeliveryHistoryIndexKey).Result()
+	if err != nil {
+		return 0, newError("CompactDeliveryHistories", DeliveryHistoryIndexKey, err)
+	}
+	if n <= maxSubscribers {
+		return 0, nil
+	}
+	members, err := r.client.ZRange(DeliveryHistoryIndexKey, 0, n-maxSubscribers-1).Result()
+	if err != nil {
+		return 0, newError("CompactDeliveryHistories", DeliveryHistoryIndexKey, err)
+	}
+	var evicted int64
+	for _, member := range members {
+		// Keys are deleted one at a time, since they may be on different nodes of a cluster.
+		if err := r.client.Del(DeliveryHistoryPrefix + member).Err(); err != nil {
+			return evicted, newError("CompactDeliveryHistories", DeliveryHistoryPrefix+member, err)
+		}
+		if err := r.client.ZRem(DeliveryHistoryIndexKey, member).Err(); err != nil {
+			return evicted, newError("CompactDeliveryHistories", DeliveryHistoryIndexKey, err)
+		}
+		evicted++
+	}
+	return evicted, nil
+}
+
+// GetDeliveryRecords will return the delivery history of a service+subscriber, newest first.
+func (r *PushRedisDB) GetDeliveryRecords(srv, sub string) ([][]byte, error) {
+	records, err := r.client.LRange(DeliveryHistoryPrefix+srv+":"+sub, 0, -1).Result()
+	if err != nil {
+		return nil, newError("GetDeliveryRecords", DeliveryHistoryPrefix+srv+":"+sub, err)
+	}
+	ret := make([][]byte, len(records))
+	for i, record := range records {
+		ret[i] = []byte(record)
+	}
+	return ret, nil
+}
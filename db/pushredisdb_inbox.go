@@ -0,0 +1,60 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package db
+
+import (
+	"time"
+)
+
+// AddInboxMessage will add a message to the front of the inbox of a service+subscriber.
+// Only the newest maxMessages are kept, and the inbox expires after retention unless another message is added.
+func (r *PushRedisDB) AddInboxMessage(srv, sub string, message []byte, maxMessages int64, retention time.Duration) error {
+	key := InboxPrefix + srv + ":" + sub
+	if err := r.client.LPush(key, message).Err(); err != nil {
+		return newError("AddInboxMessage", key, err)
+	}
+	if err := r.client.LTrim(key, 0, maxMessages-1).Err(); err != nil {
+		return newError("AddInboxMessage", key, err)
+	}
+	if err := r.client.Expire(key, retention).Err(); err != nil {
+		return newError("AddInboxMessage", key, err)
+	}
+	return nil
+}
+
+// GetInboxMessages will return the messages in the inbox of a service+subscriber, newest first.
+func (r *PushRedisDB) GetInboxMessages(srv, sub string) ([][]byte, error) {
+	key := InboxPrefix + srv + ":" + sub
+	messages, err := r.client.LRange(key, 0, -1).Result()
+	if err != nil {
+		return nil, newError("GetInboxMessages", key, err)
+	}
+	ret := make([][]byte, len(messages))
+	for i, message := range messages {
+		ret[i] = []byte(message)
+	}
+	return ret, nil
+}
+
+// RemoveInboxMessage will remove a message (as returned by GetInboxMessages) from the inbox of a service+subscriber.
+func (r *PushRedisDB) RemoveInboxMessage(srv, sub string, message []byte) error {
+	key := InboxPrefix + srv + ":" + sub
+	if err := r.client.LRem(key, 0, message).Err(); err != nil {
+		return newError("RemoveInboxMessage", key, err)
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package db
+
+import (
+	"net"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+const (
+	// cacheInvalidationPingInterval is how often to check the connection receiving invalidations while no messages are received.
+	cacheInvalidationPingInterval = 30 * time.Second
+	cacheInvalidationRetryDelay   = time.Second
+)
+
+// PublishCacheInvalidation will tell every instance subscribed with SubscribeCacheInvalidations that the cached entry with the given key changed.
+func (r *PushRedisDB) PublishCacheInvalidation(key string) error {
+	if err := r.client.Publish(CacheInvalidationChannel, key).Err(); err != nil {
+		return newError("PublishCacheInvalidation", CacheInvalidationChannel, err)
+	}
+	return nil
+}
+
+// SubscribeCacheInvalidations will call invalidate with the key of each cached entry changed by an instance (including this one), until stop is called.
+// Messages published while the connection is lost can't be received, so invalidateAll is called whenever the subscription is (re)established.
+func (r *PushRedisDB) SubscribeCacheInvalidations(invalidate func(key string), invalidateAll func()) (stop func()) {
+	pubsub := r.client.Subscribe(CacheInvalidationChannel)
+	stopped := make(chan struct{})
+	go func() {
+		for {
+			msg, err := pubsub.ReceiveTimeout(cacheInvalidationPingInterval)
+			select {
+			case <-stopped:
+				return
+			default:
+			}
+			if err != nil {
+				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+					// A failed ping makes the next receive fail and reconnect.
+					pubsub.Ping()
+					continue
+				}
+				invalidateAll()
+				time.Sleep(cacheInvalidationRetryDelay)
+				continue
+			}
+			switch msg := msg.(type) {
+			case *redis.Subscription:
+				invalidateAll()
+			case *redis.Message:
+				invalidate(msg.Payload)
+			}
+		}
+	}()
+	return func() {
+		close(stopped)
+		pubsub.Close()
+	}
+}
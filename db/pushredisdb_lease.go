@@ -0,0 +1,70 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package db
+
+import (
+	"time"
+)
+
+// renewLeaseScript extends the expiry of a lease only if it is still held by the given owner.
+// KEYS[1] is the lease key, ARGV[1] is the owner and ARGV[2] is the new ttl in milliseconds.
+const renewLeaseScript = `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0
+`
+
+// releaseLeaseScript deletes a lease only if it is still held by the given owner.
+// KEYS[1] is the lease key, ARGV[1] is the owner.
+const releaseLeaseScript = `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`
+
+// AcquireLease will atomically claim the lease with the given name for owner, if no other owner currently holds it.
+// The lease expires after ttl unless it is renewed, so that a crashed instance can't hold it forever.
+// Returns true if the lease was acquired.
+func (r *PushRedisDB) AcquireLease(name, owner string, ttl time.Duration) (bool, error) {
+	acquired, err := r.client.SetNX(LeasePrefix+name, owner, ttl).Result()
+	if err != nil {
+		return false, newError("AcquireLease", LeasePrefix+name, err)
+	}
+	return acquired, nil
+}
+
+// RenewLease will extend the expiry of the lease with the given name to ttl from now, if it is still held by owner.
+// Returns false if the lease expired or was taken over by a different owner.
+func (r *PushRedisDB) RenewLease(name, owner string, ttl time.Duration) (bool, error) {
+	res, err := r.client.Eval(renewLeaseScript, []string{LeasePrefix + name}, owner, int64(ttl/time.Millisecond)).Int64()
+	if err != nil {
+		return false, newError("RenewLease", LeasePrefix+name, err)
+	}
+	return res == 1, nil
+}
+
+// ReleaseLease will give up the lease with the given name, if it is still held by owner.
+func (r *PushRedisDB) ReleaseLease(name, owner string) error {
+	err := r.client.Eval(releaseLeaseScript, []string{LeasePrefix + name}, owner).Err()
+	if err != nil {
+		return newError("ReleaseLease", LeasePrefix+name, err)
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package db
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// claimHeldPushesScript moves the entries of the sorted set KEYS[2] claimed before ARGV[3] back to the front of the list KEYS[1] (which is pushed to from the back),
+// then moves the oldest ARGV[1] entries of KEYS[1] to KEYS[2] with the score ARGV[2], and returns them newest first.
+const claimHeldPushesScript = `
+local expired = redis.call("ZRANGEBYSCORE", KEYS[2], "-inf", ARGV[3])
+for _, push in ipairs(expired) do
+	redis.call("RPUSH", KEYS[1], push)
+	redis.call("ZREM", KEYS[2], push)
+end
+local held = redis.call("LRANGE", KEYS[1], -ARGV[1], -1)
+if #held > 0 then
+	redis.call("LTRIM", KEYS[1], 0, -#held - 1)
+	for _, push in ipairs(held) do
+		redis.call("ZADD", KEYS[2], ARGV[2], push)
+	end
+end
+return held
+`
+
+// SetMaintenance will save the state of maintenance mode, or delete it (turning maintenance mode off) if data is nil.
+func (r *PushRedisDB) SetMaintenance(data []byte) error {
+	var err error
+	if data == nil {
+		err = r.client.Del(MaintenanceKey).Err()
+	} else {
+		err = r.client.Set(MaintenanceKey, data, 0).Err()
+	}
+	if err != nil {
+		return newError("SetMaintenance", MaintenanceKey, err)
+	}
+	return nil
+}
+
+// GetMaintenance will return the state of maintenance mode, or nil if it is off.
+func (r *PushRedisDB) GetMaintenance() ([]byte, error) {
+	data, err := r.client.Get(MaintenanceKey).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, newError("GetMaintenance", MaintenanceKey, err)
+	}
+	return data, nil
+}
+
+// HoldPush will add a push request to the queue of pushes held during maintenance mode.
+func (r *PushRedisDB) HoldPush(data []byte) error {
+	if err := r.client.LPush(HeldPushesKey, data).Err(); err != nil {
+		return newError("HoldPush", HeldPushesKey, err)
+	}
+	return nil
+}
+
+// ClaimHeldPushes will atomically move up to count of the oldest held push requests to the pushes being sent, and return them oldest first.
+// Several instances can claim from the queue at the same time without getting the same push request.
+// Push requests which were claimed more than timeout ago without being acknowledged with AckHeldPush (e.g. because the instance sending them crashed) are first moved back to the front of the queue.
+func (r *PushRedisDB) ClaimHeldPushes(count int64, timeout time.Duration) ([][]byte, error) {
+	now := time.Now()
+	res, err := r.client.Eval(claimHeldPushesScript, []string{HeldPushesKey, SendingHeldPushesKey}, count, now.UnixNano()/int64(time.Millisecond), now.Add(-timeout).UnixNano()/int64(time.Millisecond)).Result()
+	if err != nil {
+		return nil, newError("ClaimHeldPushes", HeldPushesKey, err)
+	}
+	values, ok := res.([]interface{})
+	if !ok {
+		return nil, newError("ClaimHeldPushes", HeldPushesKey, fmt.Errorf("unexpected result %T", res))
+	}
+	ret := make([][]byte, 0, len(values))
+	for i := len(values) - 1; i >= 0; i-- {
+		s, ok := values[i].(string)
+		if !ok {
+			return nil, newError("ClaimHeldPushes", HeldPushesKey, fmt.Errorf("unexpected value %T", values[i]))
+		}
+		ret = append(ret, []byte(s))
+	}
+	return ret, nil
+}
+
+// AckHeldPush will remove a push request claimed with ClaimHeldPushes from the pushes being sent, once it was sent (or held again).
+func (r *PushRedisDB) AckHeldPush(data []byte) error {
+	if err := r.client.ZRem(SendingHeldPushesKey, data).Err(); err != nil {
+		return newError("AckHeldPush", SendingHeldPushesKey, err)
+	}
+	return nil
+}
+
+// CountHeldPushes will return the number of push requests in the queue of held pushes, including those being sent.
+func (r *PushRedisDB) CountHeldPushes() (int64, error) {
+	held, err := r.client.LLen(HeldPushesKey).Result()
+	if err != nil {
+		return 0, newError("CountHeldPushes", HeldPushesKey, err)
+	}
+	sending, err := r.client.ZCard(SendingHeldPushesKey).Result()
+	if err != nil {
+		return 0, newError("CountHeldPushes", SendingHeldPushesKey, err)
+	}
+	return held + sending, nil
+}
@@ -0,0 +1,110 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package db
+
+import (
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// IncrPayloadFailures will count another rejection of the payload with the given fingerprint, returning the number of rejections within the window.
+// The count is reset window after the first rejection.
+func (r *PushRedisDB) IncrPayloadFailures(fingerprint string, window time.Duration) (int64, error) {
+	key := PayloadFailuresPrefix + fingerprint
+	n, err := r.client.Incr(key).Result()
+	if err != nil {
+		return 0, newError("IncrPayloadFailures", key, err)
+	}
+	if n == 1 {
+		if err := r.client.Expire(key, window).Err(); err != nil {
+			return 0, newError("IncrPayloadFailures", key, err)
+		}
+	}
+	return n, nil
+}
+
+// SetQuarantinedPayload will save the record of a quarantined payload, which expires after ttl.
+func (r *PushRedisDB) SetQuarantinedPayload(fingerprint string, record []byte, ttl time.Duration) error {
+	if err := r.client.Set(QuarantinedPayloadPrefix+fingerprint, record, ttl).Err(); err != nil {
+		return newError("SetQuarantinedPayload", QuarantinedPayloadPrefix+fingerprint, err)
+	}
+	if err := r.client.SAdd(QuarantinedPayloadsSet, fingerprint).Err(); err != nil {
+		return newError("SetQuarantinedPayload", QuarantinedPayloadsSet, err)
+	}
+	return nil
+}
+
+// GetQuarantinedPayload will return the record of a quarantined payload, or nil if the payload isn't quarantined.
+func (r *PushRedisDB) GetQuarantinedPayload(fingerprint string) ([]byte, error) {
+	record, err := r.client.Get(QuarantinedPayloadPrefix + fingerprint).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, newError("GetQuarantinedPayload", QuarantinedPayloadPrefix+fingerprint, err)
+	}
+	return record, nil
+}
+
+// GetQuarantinedPayloads will return the records of all quarantined payloads, by fingerprint. Expired records are removed from the set of quarantined payloads.
+func (r *PushRedisDB) GetQuarantinedPayloads() (map[string][]byte, error) {
+	fingerprints, err := r.client.SMembers(QuarantinedPayloadsSet).Result()
+	if err != nil {
+		return nil, newError("GetQuarantinedPayloads", QuarantinedPayloadsSet, err)
+	}
+	ret := make(map[string][]byte, len(fingerprints))
+	if len(fingerprints) == 0 {
+		return ret, nil
+	}
+	keys := make([]string, len(fingerprints))
+	for i, fingerprint := range fingerprints {
+		keys[i] = QuarantinedPayloadPrefix + fingerprint
+	}
+	records, err := r.mgetStrings(keys...)
+	if err != nil {
+		return nil, newError("GetQuarantinedPayloads", QuarantinedPayloadPrefix, err)
+	}
+	var expired []interface{}
+	for i, record := range records {
+		if record == nil {
+			expired = append(expired, fingerprints[i])
+			continue
+		}
+		ret[fingerprints[i]] = record
+	}
+	if len(expired) > 0 {
+		// Non-essential, the set is only used for listing.
+		r.client.SRem(QuarantinedPayloadsSet, expired...)
+	}
+	return ret, nil
+}
+
+// RemoveQuarantinedPayload will release a quarantined payload, and reset its count of rejections.
+func (r *PushRedisDB) RemoveQuarantinedPayload(fingerprint string) error {
+	if err := r.client.Del(QuarantinedPayloadPrefix + fingerprint).Err(); err != nil {
+		return newError("RemoveQuarantinedPayload", QuarantinedPayloadPrefix+fingerprint, err)
+	}
+	if err := r.client.Del(PayloadFailuresPrefix + fingerprint).Err(); err != nil {
+		return newError("RemoveQuarantinedPayload", PayloadFailuresPrefix+fingerprint, err)
+	}
+	if err := r.client.SRem(QuarantinedPayloadsSet, fingerprint).Err(); err != nil {
+		return newError("RemoveQuarantinedPayload", QuarantinedPayloadsSet, err)
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package db
+
+import (
+	"github.com/go-redis/redis"
+)
+
+// setReplicationClockScript saves the clock of the last change to a delivery point, only if it is newer than the saved clock.
+// Clocks are zero padded so that they compare as strings.
+// KEYS[1] is the hash of clocks of a service+subscriber, ARGV[1] is the delivery point name and ARGV[2] is the clock.
+const setReplicationClockScript = `
+local current = redis.call("HGET", KEYS[1], ARGV[1])
+if current and current >= ARGV[2] then
+	return 0
+end
+redis.call("HSET", KEYS[1], ARGV[1], ARGV[2])
+return 1
+`
+
+// AddReplicationEvent will append a change to the subscriptions of this region to the replication log, which is read by the other regions.
+// The log is trimmed to roughly maxLen events.
+func (r *PushRedisDB) AddReplicationEvent(data []byte, maxLen int64) error {
+	args := &redis.XAddArgs{
+		Stream:       ReplicationLogKey,
+		MaxLenApprox: maxLen,
+		Values:       map[string]interface{}{"event": data},
+	}
+	if err := r.client.XAdd(args).Err(); err != nil {
+		return newError("AddReplicationEvent", ReplicationLogKey, err)
+	}
+	return nil
+}
+
+// GetReplicationEvents will return up to count events of the replication log after the event with id after ("0" for the first event).
+// Returns the ids and data of the events.
+func (r *PushRedisDB) GetReplicationEvents(after string, count int64) ([]string, [][]byte, error) {
+	args := &redis.XReadArgs{
+		Streams: []string{ReplicationLogKey, after},
+		Count:   count,
+		// Don't block: the other region polls the log.
+		Block: -1,
+	}
+	streams, err := r.client.XRead(args).Result()
+	if err == redis.Nil {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, newError("GetReplicationEvents", ReplicationLogKey, err)
+	}
+	var ids []string
+	var events [][]byte
+	for _, stream := range streams {
+		for _, message := range stream.Messages {
+			data, _ := message.Values["event"].(string)
+			ids = append(ids, message.ID)
+			events = append(events, []byte(data))
+		}
+	}
+	return ids, events, nil
+}
+
+// SetReplicationClockIfNewer will save the clock of the latest change to a delivery point of a service+subscriber.
+// Returns false (and saves nothing) if a change with a newer clock was already saved.
+func (r *PushRedisDB) SetReplicationClockIfNewer(srv, sub, dpName, clock string) (bool, error) {
+	key := ReplicationClockPrefix + srv + ":" + sub
+	res, err := r.client.Eval(setReplicationClockScript, []string{key}, dpName, clock).Int64()
+	if err != nil {
+		return false, newError("SetReplicationClockIfNewer", key, err)
+	}
+	return res == 1, nil
+}
+
+// GetReplicationOffset will return the id of the last event of the replication log of the given peer region which was applied, or "" if none were.
+func (r *PushRedisDB) GetReplicationOffset(peer string) (string, error) {
+	id, err := r.client.Get(ReplicationOffsetPrefix + peer).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	if err != nil {
+		return "", newError("GetReplicationOffset", ReplicationOffsetPrefix+peer, err)
+	}
+	return id, nil
+}
+
+// SetReplicationOffset will save the id of the last event of the replication log of the given peer region which was applied.
+func (r *PushRedisDB) SetReplicationOffset(peer, id string) error {
+	if err := r.client.Set(ReplicationOffsetPrefix+peer, id, 0).Err(); err != nil {
+		return newError("SetReplicationOffset", ReplicationOffsetPrefix+peer, err)
+	}
+	return nil
+}
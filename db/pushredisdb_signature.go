@@ -0,0 +1,32 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package db
+
+import (
+	"time"
+)
+
+// ClaimRequestSignature will atomically record the signature of a signed request, which expires after ttl.
+// Returns false if the signature was already claimed, i.e. the request is being replayed.
+func (r *PushRedisDB) ClaimRequestSignature(signature string, ttl time.Duration) (bool, error) {
+	claimed, err := r.client.SetNX(RequestSignaturePrefix+signature, 1, ttl).Result()
+	if err != nil {
+		return false, newError("ClaimRequestSignature", RequestSignaturePrefix+signature, err)
+	}
+	return claimed, nil
+}
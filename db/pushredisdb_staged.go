@@ -0,0 +1,84 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package db
+
+import (
+	"github.com/go-redis/redis"
+)
+
+// SetStagedUnsubscribe will save a staged unsubscribe, which stays until it is removed.
+func (r *PushRedisDB) SetStagedUnsubscribe(id string, data []byte) error {
+	if err := r.client.Set(StagedUnsubscribePrefix+id, data, 0).Err(); err != nil {
+		return newError("SetStagedUnsubscribe", StagedUnsubscribePrefix+id, err)
+	}
+	if err := r.client.SAdd(StagedUnsubscribesSet, id).Err(); err != nil {
+		return newError("SetStagedUnsubscribe", StagedUnsubscribesSet, err)
+	}
+	return nil
+}
+
+// GetStagedUnsubscribe will return a staged unsubscribe, or nil if it doesn't exist.
+func (r *PushRedisDB) GetStagedUnsubscribe(id string) ([]byte, error) {
+	data, err := r.client.Get(StagedUnsubscribePrefix + id).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, newError("GetStagedUnsubscribe", StagedUnsubscribePrefix+id, err)
+	}
+	return data, nil
+}
+
+// GetStagedUnsubscribes will return every staged unsubscribe, by id.
+func (r *PushRedisDB) GetStagedUnsubscribes() (map[string][]byte, error) {
+	ids, err := r.client.SMembers(StagedUnsubscribesSet).Result()
+	if err != nil {
+		return nil, newError("GetStagedUnsubscribes", StagedUnsubscribesSet, err)
+	}
+	ret := make(map[string][]byte, len(ids))
+	if len(ids) == 0 {
+		return ret, nil
+	}
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = StagedUnsubscribePrefix + id
+	}
+	values, err := r.mgetStrings(keys...)
+	if err != nil {
+		return nil, newError("GetStagedUnsubscribes", StagedUnsubscribePrefix, err)
+	}
+	for i, data := range values {
+		if data != nil {
+			ret[ids[i]] = data
+		}
+	}
+	return ret, nil
+}
+
+// RemoveStagedUnsubscribe will remove a staged unsubscribe.
+// Returns false if it didn't exist (e.g. because another instance already removed it).
+func (r *PushRedisDB) RemoveStagedUnsubscribe(id string) (bool, error) {
+	n, err := r.client.SRem(StagedUnsubscribesSet, id).Result()
+	if err != nil {
+		return false, newError("RemoveStagedUnsubscribe", StagedUnsubscribesSet, err)
+	}
+	if err := r.client.Del(StagedUnsubscribePrefix + id).Err(); err != nil {
+		return false, newError("RemoveStagedUnsubscribe", StagedUnsubscribePrefix+id, err)
+	}
+	return n == 1, nil
+}
@@ -0,0 +1,76 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package db
+
+import (
+	"fmt"
+
+	"github.com/uniqush/uniqush-push/push"
+)
+
+// SetStagedPushServiceProvider will save psp (with its credentials encrypted like the ones of other push service providers) as the staged credentials of the push service provider with its name.
+func (r *PushRedisDB) SetStagedPushServiceProvider(psp *push.PushServiceProvider, state []byte) error {
+	name := psp.Name()
+	stored, err := r.storedPushServiceProvider(psp)
+	if err != nil {
+		return newError("SetStagedPushServiceProvider", StagedPushServiceProvidersKey, err)
+	}
+	if err := r.client.HSet(StagedPushServiceProvidersKey, name, pushServiceProviderToValue(stored)).Err(); err != nil {
+		return newError("SetStagedPushServiceProvider", StagedPushServiceProvidersKey, err)
+	}
+	if err := r.client.HSet(StagingStatesKey, name, state).Err(); err != nil {
+		return newError("SetStagedPushServiceProvider", StagingStatesKey, err)
+	}
+	return nil
+}
+
+// GetStagedPushServiceProviders will return the staged credentials of push service providers and the states of their stagings, by name.
+func (r *PushRedisDB) GetStagedPushServiceProviders() (map[string]StagedPushServiceProvider, error) {
+	values, err := r.client.HGetAll(StagedPushServiceProvidersKey).Result()
+	if err != nil {
+		return nil, newError("GetStagedPushServiceProviders", StagedPushServiceProvidersKey, err)
+	}
+	states, err := r.client.HGetAll(StagingStatesKey).Result()
+	if err != nil {
+		return nil, newError("GetStagedPushServiceProviders", StagingStatesKey, err)
+	}
+	staged := make(map[string]StagedPushServiceProvider, len(values))
+	for name, value := range values {
+		state, ok := states[name]
+		if !ok {
+			// The staging is being saved or removed.
+			continue
+		}
+		psp, err := r.keyValueToPushServiceProvider([]byte(value))
+		if err != nil {
+			return nil, fmt.Errorf("GetStagedPushServiceProviders: invalid psp %q: %v", name, err)
+		}
+		staged[name] = StagedPushServiceProvider{PushServiceProvider: psp, State: []byte(state)}
+	}
+	return staged, nil
+}
+
+// RemoveStagedPushServiceProvider will remove the staged credentials of the push service provider named name.
+func (r *PushRedisDB) RemoveStagedPushServiceProvider(name string) error {
+	if err := r.client.HDel(StagingStatesKey, name).Err(); err != nil {
+		return newError("RemoveStagedPushServiceProvider", StagingStatesKey, err)
+	}
+	if err := r.client.HDel(StagedPushServiceProvidersKey, name).Err(); err != nil {
+		return newError("RemoveStagedPushServiceProvider", StagedPushServiceProvidersKey, err)
+	}
+	return nil
+}
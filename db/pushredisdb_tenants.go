@@ -0,0 +1,161 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package db
+
+import (
+	"errors"
+	"strconv"
+	"time"
+)
+
+// SetTenant will save the record of the tenant with the given id, replacing the previous one.
+func (r *PushRedisDB) SetTenant(id string, record []byte) error {
+	if err := r.client.HSet(TenantsKey, id, record).Err(); err != nil {
+		return newError("SetTenant", TenantsKey, err)
+	}
+	return nil
+}
+
+// RemoveTenant will remove the record of the tenant with the given id, along with its counters.
+func (r *PushRedisDB) RemoveTenant(id string) error {
+	if err := r.client.HDel(TenantsKey, id).Err(); err != nil {
+		return newError("RemoveTenant", TenantsKey, err)
+	}
+	if err := r.client.Del(TenantSubscribersPrefix + id).Err(); err != nil {
+		return newError("RemoveTenant", TenantSubscribersPrefix+id, err)
+	}
+	return nil
+}
+
+// GetTenants will return the records of all tenants, by id.
+func (r *PushRedisDB) GetTenants() (map[string][]byte, error) {
+	records, err := r.client.HGetAll(TenantsKey).Result()
+	if err != nil {
+		return nil, newError("GetTenants", TenantsKey, err)
+	}
+	ret := make(map[string][]byte, len(records))
+	for id, record := range records {
+		ret[id] = []byte(record)
+	}
+	return ret, nil
+}
+
+// IncrTenantPushes will add n to the pushes of a tenant during the day starting at the unix timestamp day, returning the new total.
+// The counter is deleted after ttl.
+func (r *PushRedisDB) IncrTenantPushes(tenant string, day int64, n int64, ttl time.Duration) (int64, error) {
+	key := TenantPushesPrefix + tenant + ":" + strconv.FormatInt(day, 10)
+	total, err := r.client.IncrBy(key, n).Result()
+	if err != nil {
+		return 0, newError("IncrTenantPushes", key, err)
+	}
+	if total == n {
+		if err := r.client.Expire(key, ttl).Err(); err != nil {
+			return 0, newError("IncrTenantPushes", key, err)
+		}
+	}
+	return total, nil
+}
+
+// AddTenantSubscriber will add a subscriber (e.g. "<service>:<subscriber>") to the subscribers of a tenant, unless it would have more than max subscribers (if max isn't 0).
+// Returns false if the subscriber wasn't added because of max.
+func (r *PushRedisDB) AddTenantSubscriber(tenant, subscriber string, max int64) (bool, error) {
+	key := TenantSubscribersPrefix + tenant
+	added, err := r.client.SAdd(key, subscriber).Result()
+	if err != nil {
+		return false, newError("AddTenantSubscriber", key, err)
+	}
+	if added == 0 || max <= 0 {
+		return true, nil
+	}
+	n, err := r.client.SCard(key).Result()
+	if err != nil {
+		return false, newError("AddTenantSubscriber", key, err)
+	}
+	if n > max {
+		// Concurrent subscriptions can both be removed here, which is safer than letting both exceed the quota.
+		if err := r.client.SRem(key, subscriber).Err(); err != nil {
+			return false, newError("AddTenantSubscriber", key, err)
+		}
+		return false, nil
+	}
+	return true, nil
+}
+
+// RemoveTenantSubscriber will remove a subscriber from the subscribers of a tenant.
+func (r *PushRedisDB) RemoveTenantSubscriber(tenant, subscriber string) error {
+	if err := r.client.SRem(TenantSubscribersPrefix+tenant, subscriber).Err(); err != nil {
+		return newError("RemoveTenantSubscriber", TenantSubscribersPrefix+tenant, err)
+	}
+	return nil
+}
+
+// CountTenantSubscribers will return the number of subscribers of a tenant.
+func (r *PushRedisDB) CountTenantSubscribers(tenant string) (int64, error) {
+	n, err := r.client.SCard(TenantSubscribersPrefix + tenant).Result()
+	if err != nil {
+		return 0, newError("CountTenantSubscribers", TenantSubscribersPrefix+tenant, err)
+	}
+	return n, nil
+}
+
+// SetTenantServices will make the data key of a tenant encrypt the delivery points saved for its services, creating the data key if it has none,
+// and stop encrypting the services which no longer belong to it. It only removes services if tenant encryption is disabled.
+func (r *PushRedisDB) SetTenantServices(tenant string, services []string) error {
+	defer r.tenantKeys.invalidate()
+	mapped, err := r.client.HGetAll(ServiceTenantsKey).Result()
+	if err != nil {
+		return newError("SetTenantServices", ServiceTenantsKey, err)
+	}
+	owned := make(map[string]bool, len(services))
+	for _, service := range services {
+		owned[service] = true
+	}
+	for service, owner := range mapped {
+		if owner == tenant && !(owned[service] && r.tenantEncryption) {
+			if err := r.client.HDel(ServiceTenantsKey, service).Err(); err != nil {
+				return newError("SetTenantServices", ServiceTenantsKey, err)
+			}
+		}
+	}
+	if !r.tenantEncryption || len(services) == 0 {
+		return nil
+	}
+	if err := r.createTenantDataKey(tenant); err != nil {
+		return newError("SetTenantServices", TenantDataKeyPrefix+tenant, err)
+	}
+	for _, service := range services {
+		if err := r.client.HSet(ServiceTenantsKey, service, tenant).Err(); err != nil {
+			return newError("SetTenantServices", ServiceTenantsKey, err)
+		}
+	}
+	return nil
+}
+
+// ShredTenantDataKey will delete the data key of a tenant, so that the delivery points it encrypted can no longer be read,
+// even before they are removed. Delivery points can't be saved for its services until they belong to another tenant.
+func (r *PushRedisDB) ShredTenantDataKey(tenant string) error {
+	defer r.tenantKeys.invalidate()
+	n, err := r.client.Del(TenantDataKeyPrefix + tenant).Result()
+	if err != nil {
+		return newError("ShredTenantDataKey", TenantDataKeyPrefix+tenant, err)
+	}
+	if n == 0 {
+		return newError("ShredTenantDataKey", TenantDataKeyPrefix+tenant, errors.New("the tenant has no data key"))
+	}
+	return nil
+}
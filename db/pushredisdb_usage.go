@@ -0,0 +1,65 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package db
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+func usageKey(day int64) string {
+	return UsagePrefix + strconv.FormatInt(day, 10)
+}
+
+// IncrUsageCounts will add counts to the usage counters of the day starting at the unix timestamp day.
+// The counters of the day expire after retention.
+func (r *PushRedisDB) IncrUsageCounts(day int64, counts map[string]int64, retention time.Duration) error {
+	key := usageKey(day)
+	for name, n := range counts {
+		if err := r.client.HIncrBy(key, name, n).Err(); err != nil {
+			return newError("IncrUsageCounts", key, err)
+		}
+	}
+	if err := r.client.Expire(key, retention).Err(); err != nil {
+		return newError("IncrUsageCounts", key, err)
+	}
+	return nil
+}
+
+// GetUsageCounts will return the usage counters of each of the days (unix timestamps of the start of the day).
+// Days without counters have an empty map.
+func (r *PushRedisDB) GetUsageCounts(days []int64) ([]map[string]int64, error) {
+	ret := make([]map[string]int64, len(days))
+	for i, day := range days {
+		values, err := r.client.HGetAll(usageKey(day)).Result()
+		if err != nil {
+			return nil, newError("GetUsageCounts", usageKey(day), err)
+		}
+		counts := make(map[string]int64, len(values))
+		for name, value := range values {
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("GetUsageCounts: invalid count %q of %q: %v", value, name, err)
+			}
+			counts[name] = n
+		}
+		ret[i] = counts
+	}
+	return ret, nil
+}
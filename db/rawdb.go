@@ -18,6 +18,8 @@
 package db
 
 import (
+	"time"
+
 	"github.com/uniqush/log"
 	"github.com/uniqush/uniqush-push/push"
 )
@@ -62,13 +64,81 @@ type pushRawDatabaseWriter interface {
 	AddPushServiceProviderToService(srv, psp string) error
 	RemovePushServiceProviderFromService(srv, psp string) error
 
+	SetFallbackPushServiceProvider(psp, fallback string) error
+	RemoveFallbackPushServiceProvider(psp string) error
+
+	IncrPayloadFailures(fingerprint string, window time.Duration) (int64, error)
+	SetQuarantinedPayload(fingerprint string, record []byte, ttl time.Duration) error
+	RemoveQuarantinedPayload(fingerprint string) error
+
+	AddDeliveryRecord(srv, sub string, record []byte, maxRecords int64, retention time.Duration) error
+	AddInboxMessage(srv, sub string, message []byte, maxMessages int64, retention time.Duration) error
+	RemoveInboxMessage(srv, sub string, message []byte) error
+
+	IncrAnalyticsCounts(srv string, hour int64, counts map[string]int64, retention time.Duration) error
+
+	IncrUsageCounts(day int64, counts map[string]int64, retention time.Duration) error
+
+	AddAuditRecord(record []byte, maxRecords int64) error
+	TrimAuditRecords(n int64) error
+
+	SetAPIKey(id string, record []byte) error
+
+	ClaimRequestSignature(signature string, ttl time.Duration) (bool, error)
+
+	SetTenant(id string, record []byte) error
+	RemoveTenant(id string) error
+	SetTenantServices(tenant string, services []string) error
+	ShredTenantDataKey(tenant string) error
+	IncrTenantPushes(tenant string, day int64, n int64, ttl time.Duration) (int64, error)
+	AddTenantSubscriber(tenant, subscriber string, max int64) (bool, error)
+	RemoveTenantSubscriber(tenant, subscriber string) error
+	CompactDeliveryHistories(idleBefore int64, maxSubscribers int64) (int64, error)
+
+	SetBroadcast(id string, data []byte, ttl time.Duration) error
+	AddActiveBroadcast(id string) error
+	RemoveActiveBroadcast(id string) error
+	SetBroadcastControl(id, control string, ttl time.Duration) error
+	RemoveBroadcastControl(id string) error
+
+	SetStagedUnsubscribe(id string, data []byte) error
+	RemoveStagedUnsubscribe(id string) (bool, error)
+
+	FlagDeliveryPoint(srv, dpName string, data []byte) error
+	UnflagDeliveryPoints(srv string, dpNames []string) error
+
+	AddReplicationEvent(data []byte, maxLen int64) error
+	SetReplicationClockIfNewer(srv, sub, dpName, clock string) (bool, error)
+	SetReplicationOffset(peer, id string) error
+
+	PublishCacheInvalidation(key string) error
+
 	FlushCache() error
+
+	AcquireLease(name, owner string, ttl time.Duration) (bool, error)
+	RenewLease(name, owner string, ttl time.Duration) (bool, error)
+	ReleaseLease(name, owner string) error
+
+	SetClusterMember(id string, data []byte) error
+	RemoveClusterMembers(ids ...string) error
+
+	SetMaintenance(data []byte) error
+	HoldPush(data []byte) error
+	ClaimHeldPushes(count int64, timeout time.Duration) ([][]byte, error)
+	AckHeldPush(data []byte) error
+
+	SetStagedPushServiceProvider(psp *push.PushServiceProvider, state []byte) error
+	RemoveStagedPushServiceProvider(name string) error
+
+	SetFeatureFlag(name string, enabled bool) error
+	RemoveFeatureFlag(name string) error
 }
 
 // These methods should be fast!
 type pushRawDatabaseReader interface {
 	GetDeliveryPoint(name string) (*push.DeliveryPoint, error)
 	GetPushServiceProvider(name string) (*push.PushServiceProvider, error)
+	GetPushServiceProviders(names []string) (map[string]*push.PushServiceProvider, error)
 	GetServiceNames() ([]string, error)
 	GetPushServiceProviderConfigs([]string) ([]*push.PushServiceProvider, []error)
 	GetSubscriptions(queryServices []string, subscriber string, logger log.Logger) ([]map[string]string, error)
@@ -77,6 +147,57 @@ type pushRawDatabaseReader interface {
 	GetPushServiceProviderNameByServiceDeliveryPoint(srv, dp string) (string, error)
 
 	GetPushServiceProvidersByService(srv string) ([]string, error)
+	GetFallbackPushServiceProvider(psp string) (string, error)
+
+	GetQuarantinedPayload(fingerprint string) ([]byte, error)
+	GetQuarantinedPayloads() (map[string][]byte, error)
+
+	GetDeliveryRecords(srv, sub string) ([][]byte, error)
+
+	GetInboxMessages(srv, sub string) ([][]byte, error)
+
+	GetAnalyticsCounts(srv string, hours []int64) ([]map[string]int64, error)
+
+	GetUsageCounts(days []int64) ([]map[string]int64, error)
+
+	GetAuditRecords(start, stop int64) ([][]byte, error)
+
+	GetAPIKey(id string) ([]byte, error)
+	GetAPIKeys() (map[string][]byte, error)
+
+	GetTenants() (map[string][]byte, error)
+	EncryptDeliveryPointOfService(service string, data []byte) ([]byte, error)
+	DecryptDeliveryPointOfService(service string, data []byte) ([]byte, error)
+	CountTenantSubscribers(tenant string) (int64, error)
+
+	ScanSubscribersOfService(srv, pattern string, cursor uint64, count int64) ([]string, uint64, error)
+	GetBroadcast(id string) ([]byte, error)
+	GetActiveBroadcasts() ([]string, error)
+	GetBroadcastControl(id string) (string, error)
+
+	GetStagedUnsubscribe(id string) ([]byte, error)
+	GetStagedUnsubscribes() (map[string][]byte, error)
+
+	GetFlaggedDeliveryPoints(srv string) (map[string][]byte, error)
+
+	GetReplicationEvents(after string, count int64) ([]string, [][]byte, error)
+	GetReplicationOffset(peer string) (string, error)
+
+	GetClusterMembers() (map[string][]byte, error)
+
+	GetMaintenance() ([]byte, error)
+	CountHeldPushes() (int64, error)
+
+	GetStagedPushServiceProviders() (map[string]StagedPushServiceProvider, error)
+
+	GetFeatureFlags() (map[string]bool, error)
+
+	SubscribeCacheInvalidations(invalidate func(key string), invalidateAll func()) (stop func())
+
+	// Ping checks that the database can be reached. It is never cached.
+	Ping() error
+	// Time returns the clock of the database server, to check the clock skew of this instance. It is never cached.
+	Time() (time.Time, error)
 }
 
 type pushRawDatabase interface {
@@ -0,0 +1,338 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package db
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/uniqush/log"
+	"github.com/uniqush/uniqush-push/push"
+)
+
+// serviceRoutedDatabase keeps the push service providers, subscriptions, delivery histories, analytics and flagged delivery points
+// of some services in their own databases (e.g. in the region the data of their users must stay in), and everything else in the default database.
+// The other records (e.g. API keys, tenants, leases, broadcasts and the audit log) are only saved in the default database.
+type serviceRoutedDatabase struct {
+	// PushDatabase is the default database, for services which aren't routed and for the records which aren't of a service.
+	PushDatabase
+	// backends are the databases services are routed to, by name.
+	backends map[string]PushDatabase
+	// services maps services to the names of their backends.
+	services map[string]string
+}
+
+var _ PushDatabase = &serviceRoutedDatabase{}
+
+// NewServiceRoutedPushDatabase returns a database which saves the data of each service in services in the backend it is mapped to,
+// and the data of other services in defaultDB. Every backend in services must be in backends.
+func NewServiceRoutedPushDatabase(defaultDB PushDatabase, backends map[string]PushDatabase, services map[string]string) PushDatabase {
+	return &serviceRoutedDatabase{PushDatabase: defaultDB, backends: backends, services: services}
+}
+
+// forService returns the database with the data of service.
+func (r *serviceRoutedDatabase) forService(service string) PushDatabase {
+	if backend, ok := r.services[service]; ok {
+		return r.backends[backend]
+	}
+	return r.PushDatabase
+}
+
+// all returns the default database followed by the backends, sorted by name.
+func (r *serviceRoutedDatabase) all() []PushDatabase {
+	names := make([]string, 0, len(r.backends))
+	for name := range r.backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	databases := []PushDatabase{r.PushDatabase}
+	for _, name := range names {
+		databases = append(databases, r.backends[name])
+	}
+	return databases
+}
+
+func (r *serviceRoutedDatabase) RemovePushServiceProviderFromService(service string, psp *push.PushServiceProvider) error {
+	return r.forService(service).RemovePushServiceProviderFromService(service, psp)
+}
+
+func (r *serviceRoutedDatabase) AddPushServiceProviderToService(service string, psp *push.PushServiceProvider) error {
+	return r.forService(service).AddPushServiceProviderToService(service, psp)
+}
+
+func (r *serviceRoutedDatabase) ModifyPushServiceProvider(psp *push.PushServiceProvider) error {
+	return r.forService(psp.FixedData[push.Service]).ModifyPushServiceProvider(psp)
+}
+
+func (r *serviceRoutedDatabase) AddFallbackPushServiceProviderToService(service string, fallback *push.PushServiceProvider) (string, error) {
+	return r.forService(service).AddFallbackPushServiceProviderToService(service, fallback)
+}
+
+func (r *serviceRoutedDatabase) RemoveFallbackPushServiceProviderFromService(service string, fallback *push.PushServiceProvider) error {
+	return r.forService(service).RemoveFallbackPushServiceProviderFromService(service, fallback)
+}
+
+func (r *serviceRoutedDatabase) GetFallbackPushServiceProvider(psp *push.PushServiceProvider) (*push.PushServiceProvider, error) {
+	return r.forService(psp.FixedData[push.Service]).GetFallbackPushServiceProvider(psp)
+}
+
+// GetPushServiceProviderConfigs returns the push service providers of every database.
+func (r *serviceRoutedDatabase) GetPushServiceProviderConfigs() ([]*push.PushServiceProvider, error) {
+	var psps []*push.PushServiceProvider
+	for _, database := range r.all() {
+		found, err := database.GetPushServiceProviderConfigs()
+		if err != nil {
+			return nil, err
+		}
+		psps = append(psps, found...)
+	}
+	return psps, nil
+}
+
+func (r *serviceRoutedDatabase) RebuildServiceSet() error {
+	for _, database := range r.all() {
+		if err := database.RebuildServiceSet(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *serviceRoutedDatabase) AddDeliveryPointToService(service string, subscriber string, dp *push.DeliveryPoint) (*push.PushServiceProvider, error) {
+	return r.forService(service).AddDeliveryPointToService(service, subscriber, dp)
+}
+
+func (r *serviceRoutedDatabase) RemoveDeliveryPointFromService(service string, subscriber string, dp *push.DeliveryPoint) error {
+	return r.forService(service).RemoveDeliveryPointFromService(service, subscriber, dp)
+}
+
+func (r *serviceRoutedDatabase) ModifyDeliveryPoint(dp *push.DeliveryPoint) error {
+	return r.forService(dp.FixedData[push.Service]).ModifyDeliveryPoint(dp)
+}
+
+// GetPushServiceProviders looks up the names which aren't in the default database in the backends.
+func (r *serviceRoutedDatabase) GetPushServiceProvidersByService(service string) ([]string, error) {
+	return r.forService(service).GetPushServiceProvidersByService(service)
+}
+
+func (r *serviceRoutedDatabase) GetPushServiceProviders(names []string) (map[string]*push.PushServiceProvider, error) {
+	psps := make(map[string]*push.PushServiceProvider, len(names))
+	missing := names
+	for _, database := range r.all() {
+		if len(missing) == 0 {
+			break
+		}
+		found, err := database.GetPushServiceProviders(missing)
+		if err != nil {
+			return nil, err
+		}
+		var stillMissing []string
+		for _, name := range missing {
+			if psp, ok := found[name]; ok {
+				psps[name] = psp
+			} else {
+				stillMissing = append(stillMissing, name)
+			}
+		}
+		missing = stillMissing
+	}
+	return psps, nil
+}
+
+func (r *serviceRoutedDatabase) GetPushServiceProviderDeliveryPointPairs(service string, subscriber string, dpNamesRequested []string) ([]PushServiceProviderDeliveryPointPair, error) {
+	return r.forService(service).GetPushServiceProviderDeliveryPointPairs(service, subscriber, dpNamesRequested)
+}
+
+func (r *serviceRoutedDatabase) GetPushServiceProviderDeliveryPointPairsOfSubscribers(ctx context.Context, service string, subscribers []string, dpNamesRequested []string) (map[string][]PushServiceProviderDeliveryPointPair, map[string]error) {
+	return r.forService(service).GetPushServiceProviderDeliveryPointPairsOfSubscribers(ctx, service, subscribers, dpNamesRequested)
+}
+
+// GetSubscriptions looks up the subscriptions of each service in its database.
+func (r *serviceRoutedDatabase) GetSubscriptions(services []string, user string, logger log.Logger) ([]map[string]string, error) {
+	var order []PushDatabase
+	byDatabase := make(map[PushDatabase][]string)
+	for _, service := range services {
+		database := r.forService(service)
+		if _, ok := byDatabase[database]; !ok {
+			order = append(order, database)
+		}
+		byDatabase[database] = append(byDatabase[database], service)
+	}
+	subscriptions := []map[string]string{}
+	for _, database := range order {
+		found, err := database.GetSubscriptions(byDatabase[database], user, logger)
+		if err != nil {
+			return nil, err
+		}
+		subscriptions = append(subscriptions, found...)
+	}
+	return subscriptions, nil
+}
+
+func (r *serviceRoutedDatabase) FlushCache() error {
+	for _, database := range r.all() {
+		if err := database.FlushCache(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *serviceRoutedDatabase) CacheStats(hotKeys int) []CacheStats {
+	var stats []CacheStats
+	for _, database := range r.all() {
+		stats = append(stats, database.CacheStats(hotKeys)...)
+	}
+	return stats
+}
+
+// ResizeCaches resizes the caches of every database.
+func (r *serviceRoutedDatabase) ResizeCaches(maxEntries int, maxBytes int64) bool {
+	resized := false
+	for _, database := range r.all() {
+		if database.ResizeCaches(maxEntries, maxBytes) {
+			resized = true
+		}
+	}
+	return resized
+}
+
+// Ping returns an error if any of the databases can't be reached, since the services routed to it can't be used.
+func (r *serviceRoutedDatabase) Ping() error {
+	for _, database := range r.all() {
+		if err := database.Ping(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *serviceRoutedDatabase) PreloadCache() (int, error) {
+	total := 0
+	for _, database := range r.all() {
+		n, err := database.PreloadCache()
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+func (r *serviceRoutedDatabase) AddDeliveryRecord(service, subscriber string, record []byte, maxRecords int64, retention time.Duration) error {
+	return r.forService(service).AddDeliveryRecord(service, subscriber, record, maxRecords, retention)
+}
+
+func (r *serviceRoutedDatabase) GetDeliveryRecords(service, subscriber string) ([][]byte, error) {
+	return r.forService(service).GetDeliveryRecords(service, subscriber)
+}
+
+func (r *serviceRoutedDatabase) AddInboxMessage(service, subscriber string, message []byte, maxMessages int64, retention time.Duration) error {
+	return r.forService(service).AddInboxMessage(service, subscriber, message, maxMessages, retention)
+}
+
+func (r *serviceRoutedDatabase) GetInboxMessages(service, subscriber string) ([][]byte, error) {
+	return r.forService(service).GetInboxMessages(service, subscriber)
+}
+
+func (r *serviceRoutedDatabase) RemoveInboxMessage(service, subscriber string, message []byte) error {
+	return r.forService(service).RemoveInboxMessage(service, subscriber, message)
+}
+
+func (r *serviceRoutedDatabase) CompactDeliveryHistories(idleBefore int64, maxSubscribers int64) (int64, error) {
+	var total int64
+	for _, database := range r.all() {
+		n, err := database.CompactDeliveryHistories(idleBefore, maxSubscribers)
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+func (r *serviceRoutedDatabase) IncrAnalyticsCounts(service string, hour int64, counts map[string]int64, retention time.Duration) error {
+	return r.forService(service).IncrAnalyticsCounts(service, hour, counts, retention)
+}
+
+func (r *serviceRoutedDatabase) GetAnalyticsCounts(service string, hours []int64) ([]map[string]int64, error) {
+	return r.forService(service).GetAnalyticsCounts(service, hours)
+}
+
+// SetTenantServices saves the services of tenant in the database of each service, so that each database encrypts them with its own data key of the tenant.
+func (r *serviceRoutedDatabase) SetTenantServices(tenant string, services []string) error {
+	byDatabase := make(map[PushDatabase][]string)
+	for _, service := range services {
+		database := r.forService(service)
+		byDatabase[database] = append(byDatabase[database], service)
+	}
+	for _, database := range r.all() {
+		if err := database.SetTenantServices(tenant, byDatabase[database]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ShredTenantDataKey shreds the data keys of tenant in every database. It only returns an error if no database had a data key of tenant.
+func (r *serviceRoutedDatabase) ShredTenantDataKey(tenant string) error {
+	var firstErr error
+	shredded := false
+	for _, database := range r.all() {
+		if err := database.ShredTenantDataKey(tenant); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+		} else {
+			shredded = true
+		}
+	}
+	if shredded {
+		return nil
+	}
+	return firstErr
+}
+
+func (r *serviceRoutedDatabase) EncryptDeliveryPointOfService(service string, data []byte) ([]byte, error) {
+	return r.forService(service).EncryptDeliveryPointOfService(service, data)
+}
+
+func (r *serviceRoutedDatabase) DecryptDeliveryPointOfService(service string, data []byte) ([]byte, error) {
+	return r.forService(service).DecryptDeliveryPointOfService(service, data)
+}
+
+func (r *serviceRoutedDatabase) ScanSubscribersOfService(service, pattern string, cursor uint64, count int64) ([]string, uint64, error) {
+	return r.forService(service).ScanSubscribersOfService(service, pattern, cursor, count)
+}
+
+func (r *serviceRoutedDatabase) FlagDeliveryPoint(service, dpName string, data []byte) error {
+	return r.forService(service).FlagDeliveryPoint(service, dpName, data)
+}
+
+func (r *serviceRoutedDatabase) UnflagDeliveryPoints(service string, dpNames []string) error {
+	return r.forService(service).UnflagDeliveryPoints(service, dpNames)
+}
+
+func (r *serviceRoutedDatabase) GetFlaggedDeliveryPoints(service string) (map[string][]byte, error) {
+	return r.forService(service).GetFlaggedDeliveryPoints(service)
+}
+
+func (r *serviceRoutedDatabase) SetReplicationClockIfNewer(service, subscriber, dpName, clock string) (bool, error) {
+	return r.forService(service).SetReplicationClockIfNewer(service, subscriber, dpName, clock)
+}
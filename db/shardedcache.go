@@ -0,0 +1,145 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package db
+
+import (
+	"time"
+)
+
+// DefaultCacheShards is the default number of segments of each cache (see DatabaseConfig.CacheShards).
+const DefaultCacheShards = 16
+
+// shardedCache splits a cache into segments, each with its own lock, so that concurrent lookups of different keys don't contend.
+// Keys are assigned to segments by hash, and each segment evicts its own least recently used entries.
+type shardedCache struct {
+	name   string
+	shards []*lruCache
+}
+
+// newShardedCache creates a cache of at most maxEntries entries (and maxBytes bytes, unless it is 0), split into the given number of segments.
+// There are fewer segments if maxEntries is smaller.
+func newShardedCache(name string, shards int, maxEntries int, maxBytes int64) *shardedCache {
+	if shards > maxEntries {
+		shards = maxEntries
+	}
+	if shards < 1 {
+		shards = 1
+	}
+	c := &shardedCache{name: name, shards: make([]*lruCache, shards)}
+	for i := range c.shards {
+		c.shards[i] = newLRUCache(name, shardLimit(maxEntries, shards), shardLimit64(maxBytes, shards))
+	}
+	return c
+}
+
+// shardLimit and shardLimit64 spread a limit over the segments, rounding up so that small caches aren't empty.
+func shardLimit(limit int, shards int) int {
+	return (limit + shards - 1) / shards
+}
+
+func shardLimit64(limit int64, shards int) int64 {
+	return (limit + int64(shards) - 1) / int64(shards)
+}
+
+// Resize changes the limits of the cache. The number of segments doesn't change.
+func (c *shardedCache) Resize(maxEntries int, maxBytes int64) {
+	for _, shard := range c.shards {
+		shard.Resize(shardLimit(maxEntries, len(c.shards)), shardLimit64(maxBytes, len(c.shards)))
+	}
+}
+
+func (c *shardedCache) shard(key string) *lruCache {
+	if len(c.shards) == 1 {
+		return c.shards[0]
+	}
+	return c.shards[hashKey(key)%uint32(len(c.shards))]
+}
+
+// hashKey is FNV-1a, without allocating.
+func hashKey(key string) uint32 {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return h
+}
+
+// Get returns the cached value of key, or nil if it isn't cached (or has expired).
+func (c *shardedCache) Get(key string) []byte {
+	return c.shard(key).Get(key)
+}
+
+// Set caches the value of key for ttl (or until it is evicted, if ttl is 0).
+func (c *shardedCache) Set(key string, value []byte, ttl time.Duration) {
+	c.shard(key).Set(key, value, ttl)
+}
+
+// Remove removes key from the cache, e.g. because its value changed.
+func (c *shardedCache) Remove(key string) {
+	c.shard(key).Remove(key)
+}
+
+// Clear removes every entry from the cache.
+func (c *shardedCache) Clear() {
+	for _, shard := range c.shards {
+		shard.Clear()
+	}
+}
+
+// setOnEvict sets the function called with the keys of entries which were evicted or expired. It must be called before the cache is used.
+func (c *shardedCache) setOnEvict(onEvict func(key string)) {
+	for _, shard := range c.shards {
+		shard.onEvict = onEvict
+	}
+}
+
+// setNow replaces the clock of the cache, for tests.
+func (c *shardedCache) setNow(now func() time.Time) {
+	for _, shard := range c.shards {
+		shard.now = now
+	}
+}
+
+// Stats returns the sum of the counters of the segments.
+func (c *shardedCache) Stats() CacheStats {
+	total := CacheStats{Name: c.name}
+	for _, shard := range c.shards {
+		stats := shard.Stats()
+		total.Entries += stats.Entries
+		total.Bytes += stats.Bytes
+		total.MaxEntries += stats.MaxEntries
+		total.MaxBytes += stats.MaxBytes
+		total.Hits += stats.Hits
+		total.Misses += stats.Misses
+		total.Evictions += stats.Evictions
+		total.MemoryBytes += stats.MemoryBytes
+	}
+	return total
+}
+
+// HotKeys returns the n cached keys of every segment with the most hits, most hit first.
+func (c *shardedCache) HotKeys(n int) []CacheKeyHits {
+	var top []CacheKeyHits
+	for _, shard := range c.shards {
+		for _, k := range shard.HotKeys(n) {
+			top = addHotKey(top, k, n)
+		}
+	}
+	return top
+}
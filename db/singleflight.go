@@ -0,0 +1,75 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package db
+
+import (
+	"sync"
+)
+
+// flight is a lookup in progress, which other callers looking up the same key wait for.
+type flight struct {
+	done  chan struct{}
+	value []byte
+	err   error
+	// waiters is the number of other callers waiting for the results.
+	waiters int
+}
+
+// flightGroup coalesces concurrent lookups of the same key, so that only one of them reaches the database.
+// Values are serialized, so that each caller can build its own copy.
+type flightGroup struct {
+	mutex   sync.Mutex
+	flights map[string]*flight
+}
+
+func newFlightGroup() *flightGroup {
+	return &flightGroup{flights: make(map[string]*flight)}
+}
+
+// Do calls fn and returns its results, unless a call with the same key is in progress, in which case it waits for that call's results instead.
+// Forget doesn't stop a call in progress, so if fn caches the value it looked up, it must check that the key wasn't evicted meanwhile
+// (see cachedPushRawDatabase.cacheIfCurrent).
+func (g *flightGroup) Do(key string, fn func() ([]byte, error)) ([]byte, error) {
+	g.mutex.Lock()
+	if f, ok := g.flights[key]; ok {
+		f.waiters++
+		g.mutex.Unlock()
+		<-f.done
+		return f.value, f.err
+	}
+	f := &flight{done: make(chan struct{})}
+	g.flights[key] = f
+	g.mutex.Unlock()
+
+	f.value, f.err = fn()
+	close(f.done)
+
+	g.mutex.Lock()
+	if g.flights[key] == f {
+		delete(g.flights, key)
+	}
+	g.mutex.Unlock()
+	return f.value, f.err
+}
+
+// Forget makes later calls with key start a new lookup instead of waiting for the one in progress, e.g. because the value changed.
+func (g *flightGroup) Forget(key string) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	delete(g.flights, key)
+}
@@ -0,0 +1,90 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package db
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/uniqush/uniqush-push/testutil"
+)
+
+func TestFlightGroupCoalescesConcurrentCalls(t *testing.T) {
+	g := newFlightGroup()
+	var calls int32
+	release := make(chan struct{})
+	fn := func() ([]byte, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return []byte("value"), nil
+	}
+
+	var wg sync.WaitGroup
+	results := make([][]byte, 10)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], _ = g.Do("key", fn)
+		}(i)
+	}
+	waitForWaiters(g, "key", len(results)-1)
+	close(release)
+	wg.Wait()
+
+	testutil.ExpectEquals(t, int32(1), atomic.LoadInt32(&calls), "expected concurrent calls to be coalesced")
+	for _, result := range results {
+		testutil.ExpectEquals(t, []byte("value"), result, "expected every caller to get the result")
+	}
+}
+
+func TestFlightGroupForget(t *testing.T) {
+	g := newFlightGroup()
+	release := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		g.Do("key", func() ([]byte, error) {
+			<-release
+			return []byte("old"), nil
+		})
+		close(done)
+	}()
+	waitForWaiters(g, "key", 0)
+
+	g.Forget("key")
+	value, _ := g.Do("key", func() ([]byte, error) { return []byte("new"), nil })
+	testutil.ExpectEquals(t, []byte("new"), value, "expected a forgotten call not to be joined")
+	close(release)
+	<-done
+}
+
+// waitForWaiters waits until a call with key is in progress, with n other callers waiting for it.
+func waitForWaiters(g *flightGroup, key string, n int) {
+	for {
+		g.mutex.Lock()
+		f, ok := g.flights[key]
+		done := ok && f.waiters == n
+		g.mutex.Unlock()
+		if done {
+			return
+		}
+		runtime.Gosched()
+	}
+}
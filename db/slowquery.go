@@ -0,0 +1,138 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package db
+
+import (
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/uniqush/log"
+	"github.com/uniqush/uniqush-push/metrics"
+)
+
+// redisSlowCalls counts the commands sent to redis which took longer than DatabaseConfig.SlowQueryThreshold.
+var redisSlowCalls = metrics.DefaultRegistry.NewCounterVec("uniqush_redis_slow_calls_total",
+	"Redis commands slower than slow_query_threshold, by command and key pattern.", "command", "key_pattern")
+
+// keyPrefixes are the prefixes of the keys with a variable part (e.g. a service name), which are replaced by "*" in key patterns.
+var keyPrefixes = []string{
+	DeliveryPointPrefix,
+	PushServiceProviderPrefix,
+	ServiceSubscriberToDeliveryPointsPrefix,
+	ServiceDeliveryPointToPushServiceProviderPrefix,
+	ServiceToPushServiceProvidersPrefix,
+	DeliveryPointCounterPrefix,
+	LeasePrefix,
+	FallbackPushServiceProviderPrefix,
+	PayloadFailuresPrefix,
+	QuarantinedPayloadPrefix,
+	DeliveryHistoryPrefix,
+	InboxPrefix,
+	BroadcastPrefix,
+	BroadcastControlPrefix,
+	StagedUnsubscribePrefix,
+	FlaggedDeliveryPointsPrefix,
+	ReplicationClockPrefix,
+	ReplicationOffsetPrefix,
+	AnalyticsPrefix,
+}
+
+// keyPattern returns the pattern of a key, e.g. "srv.sub-2-dp:*" for the delivery points of a subscriber.
+// Keys without a variable part (e.g. "services{0}") are returned as is, and unknown keys as "other",
+// so that the patterns don't reveal subscribers and stay few enough to be metric labels.
+func keyPattern(key string) string {
+	for _, prefix := range keyPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return prefix + "*"
+		}
+	}
+	for _, fixed := range []string{ServicesSet, QuarantinedPayloadsSet, ActiveBroadcastsSet, StagedUnsubscribesSet, ReplicationLogKey, AuditLogKey, CacheInvalidationChannel} {
+		if key == fixed {
+			return key
+		}
+	}
+	return "other"
+}
+
+// commandKey returns the first key used by a command, or "" if it has none (e.g. PING).
+func commandKey(cmd redis.Cmder) string {
+	args := cmd.Args()
+	first := 1
+	switch strings.ToLower(cmd.Name()) {
+	case "xread", "xreadgroup":
+		// The keys follow the STREAMS argument.
+		for i, arg := range args {
+			if s, ok := arg.(string); ok && strings.ToLower(s) == "streams" {
+				first = i + 1
+				break
+			}
+		}
+	case "eval", "evalsha":
+		// EVAL script numkeys key...
+		first = 3
+	}
+	if first >= len(args) {
+		return ""
+	}
+	key, _ := args[first].(string)
+	return key
+}
+
+// isBlockingCommand returns true for commands which wait for data (e.g. the XREAD BLOCK of replication), whose latency isn't a problem.
+func isBlockingCommand(cmd redis.Cmder) bool {
+	switch strings.ToLower(cmd.Name()) {
+	case "blpop", "brpop", "brpoplpush", "bzpopmin", "bzpopmax":
+		return true
+	case "xread", "xreadgroup":
+		for _, arg := range cmd.Args() {
+			if s, ok := arg.(string); ok && strings.ToLower(s) == "block" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// slowQueryLogger logs and counts the commands which take longer than threshold, to spot hot keys and network issues.
+type slowQueryLogger struct {
+	threshold time.Duration
+	// logger may be nil, in which case slow commands are only counted.
+	logger log.Logger
+}
+
+// newSlowQueryLogger returns nil if c doesn't have a slow query threshold.
+func newSlowQueryLogger(c *DatabaseConfig) *slowQueryLogger {
+	if c.SlowQueryThreshold <= 0 {
+		return nil
+	}
+	return &slowQueryLogger{threshold: c.SlowQueryThreshold, logger: c.SlowQueryLogger}
+}
+
+func (l *slowQueryLogger) observe(cmd redis.Cmder, latency time.Duration) {
+	if l == nil || latency < l.threshold || isBlockingCommand(cmd) {
+		return
+	}
+	pattern := ""
+	if key := commandKey(cmd); key != "" {
+		pattern = keyPattern(key)
+	}
+	redisSlowCalls.Inc(cmd.Name(), pattern)
+	if l.logger != nil {
+		l.logger.Warnf("Command=%v KeyPattern=%v Args=%v Latency=%v Slow redis command", cmd.Name(), pattern, len(cmd.Args())-1, latency)
+	}
+}
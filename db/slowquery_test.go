@@ -0,0 +1,57 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package db
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/uniqush/log"
+	"github.com/uniqush/uniqush-push/testutil"
+)
+
+func TestKeyPattern(t *testing.T) {
+	testutil.ExpectStringEquals(t, "srv.sub-2-dp:*", keyPattern(ServiceSubscriberToDeliveryPointsPrefix+"myservice:alice"), "expected the variable part to be hidden")
+	testutil.ExpectStringEquals(t, "delivery.point.counter:*", keyPattern(DeliveryPointCounterPrefix+"apns:abc"), "expected the longer prefix to be matched")
+	testutil.ExpectStringEquals(t, ServicesSet, keyPattern(ServicesSet), "expected fixed keys to be kept")
+	testutil.ExpectStringEquals(t, "other", keyPattern("alice"), "expected unknown keys not to be revealed")
+}
+
+func TestCommandKey(t *testing.T) {
+	testutil.ExpectStringEquals(t, "srv-2-psp:s", commandKey(redis.NewStringSliceCmd("smembers", "srv-2-psp:s")), "expected the first argument")
+	testutil.ExpectStringEquals(t, ReplicationLogKey, commandKey(redis.NewXStreamSliceCmd("xread", "count", 10, "block", 0, "streams", ReplicationLogKey, "0")), "expected the key after STREAMS")
+	testutil.ExpectStringEquals(t, "", commandKey(redis.NewStatusCmd("ping")), "expected no key")
+}
+
+func TestSlowQueryLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := newSlowQueryLogger(&DatabaseConfig{SlowQueryThreshold: 50 * time.Millisecond, SlowQueryLogger: log.NewLogger(&buf, "", log.LOGLEVEL_WARN)})
+	cmd := redis.NewStringCmd("get", PushServiceProviderPrefix+"apns:abc")
+	l.observe(cmd, 10*time.Millisecond)
+	testutil.ExpectStringEquals(t, "", buf.String(), "expected fast commands not to be logged")
+	l.observe(cmd, 80*time.Millisecond)
+	if out := buf.String(); !strings.Contains(out, "Command=get KeyPattern=push.service.provider:* ") || strings.Contains(out, "apns:abc") {
+		t.Errorf("expected the command and key pattern to be logged without the key, got %q", out)
+	}
+	buf.Reset()
+	l.observe(redis.NewXStreamSliceCmd("xread", "block", 1000, "streams", ReplicationLogKey, "$"), time.Second)
+	testutil.ExpectStringEquals(t, "", buf.String(), "expected blocking commands not to be logged")
+	testutil.ExpectEquals(t, (*slowQueryLogger)(nil), newSlowQueryLogger(&DatabaseConfig{}), "expected a threshold of 0 to disable slow query logging")
+}
@@ -0,0 +1,218 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package db
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// tenantEncryptedPrefix starts every delivery point encrypted with the data key of a tenant, followed by "<tenant id>:" and the ciphertext.
+// Tenant ids can't contain ":". The prefix and the tenant id are the additional data of the ciphertext,
+// so that a ciphertext moved to another tenant (even one sharing the same data key) fails to decrypt.
+const tenantEncryptedPrefix = "uniqush-tenant-enc:v1:"
+
+// tenantDataKeysCacheTTL is how long the tenants of services and the data keys of tenants are cached.
+// A data key shredded by another instance can still decrypt delivery points on this instance for up to tenantDataKeysCacheTTL.
+const tenantDataKeysCacheTTL = 10 * time.Second
+
+// errTenantDataKeyShredded is returned when saving a delivery point of a service whose tenant's data key was shredded.
+var errTenantDataKeyShredded = errors.New("the data key of the tenant of the service was shredded")
+
+// sealTenantValue returns value encrypted with the data key of a tenant.
+func sealTenantValue(tenant string, dataKey cipher.AEAD, value []byte) ([]byte, error) {
+	header := []byte(tenantEncryptedPrefix + tenant + ":")
+	sealed, err := seal(dataKey, value, header)
+	if err != nil {
+		return nil, err
+	}
+	return append(header, sealed...), nil
+}
+
+// splitTenantValue returns the tenant, ciphertext and additional data of a value returned by sealTenantValue, or ok=false if value isn't encrypted.
+func splitTenantValue(value []byte) (tenant string, sealed []byte, additionalData []byte, ok bool) {
+	if !bytes.HasPrefix(value, []byte(tenantEncryptedPrefix)) {
+		return "", nil, nil, false
+	}
+	rest := value[len(tenantEncryptedPrefix):]
+	i := bytes.IndexByte(rest, ':')
+	if i < 0 {
+		return "", nil, nil, false
+	}
+	return string(rest[:i]), rest[i+1:], value[:len(tenantEncryptedPrefix)+i+1], true
+}
+
+type cachedTenantDataKey struct {
+	// dataKey is nil if the tenant has no data key (e.g. it was shredded).
+	dataKey cipher.AEAD
+	expires time.Time
+}
+
+// tenantDataKeys caches the tenants of services and the data keys of tenants, which encrypt the delivery points of the services of each tenant.
+type tenantDataKeys struct {
+	mutex           sync.Mutex
+	services        map[string]string
+	servicesExpires time.Time
+	keys            map[string]cachedTenantDataKey
+	now             func() time.Time
+}
+
+func newTenantDataKeys() *tenantDataKeys {
+	return &tenantDataKeys{keys: make(map[string]cachedTenantDataKey), now: time.Now}
+}
+
+// invalidate makes the next lookups read the tenants of services and the data keys from the database, after this instance changed them.
+func (k *tenantDataKeys) invalidate() {
+	k.mutex.Lock()
+	k.services = nil
+	k.keys = make(map[string]cachedTenantDataKey)
+	k.mutex.Unlock()
+}
+
+// tenantOfService returns the tenant whose data key encrypts the delivery points of service, or "" if there is none.
+func (r *PushRedisDB) tenantOfService(service string) (string, error) {
+	k := r.tenantKeys
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	if k.services == nil || !k.now().Before(k.servicesExpires) {
+		services, err := r.client.HGetAll(ServiceTenantsKey).Result()
+		if err != nil {
+			return "", fmt.Errorf("Cannot read the tenants of services: %v", err)
+		}
+		k.services, k.servicesExpires = services, k.now().Add(tenantDataKeysCacheTTL)
+	}
+	return k.services[service], nil
+}
+
+// tenantDataKey returns the data key of a tenant, or nil if it has none.
+func (r *PushRedisDB) tenantDataKey(tenant string) (cipher.AEAD, error) {
+	k := r.tenantKeys
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	if cached, ok := k.keys[tenant]; ok && k.now().Before(cached.expires) {
+		return cached.dataKey, nil
+	}
+	stored, err := r.client.Get(TenantDataKeyPrefix + tenant).Result()
+	if err != nil && err != redis.Nil {
+		return nil, fmt.Errorf("Cannot read the data key of tenant %q: %v", tenant, err)
+	}
+	var dataKey cipher.AEAD
+	if err == nil {
+		if dataKey, err = r.openTenantDataKey(stored); err != nil {
+			return nil, fmt.Errorf("Cannot decrypt the data key of tenant %q: %v", tenant, err)
+		}
+	}
+	k.keys[tenant] = cachedTenantDataKey{dataKey: dataKey, expires: k.now().Add(tenantDataKeysCacheTTL)}
+	return dataKey, nil
+}
+
+// openTenantDataKey returns the data key saved by createTenantDataKey, which is encrypted with the credential keys if they are configured.
+func (r *PushRedisDB) openTenantDataKey(stored string) (cipher.AEAD, error) {
+	encoded, err := r.credentials.Decrypt(stored)
+	if err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	return newAEAD(key)
+}
+
+// createTenantDataKey saves a random data key for a tenant, unless it already has one.
+func (r *PushRedisDB) createTenantDataKey(tenant string) error {
+	key := make([]byte, CredentialKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	stored := base64.StdEncoding.EncodeToString(key)
+	if r.credentials != nil {
+		var err error
+		if stored, err = r.credentials.Encrypt(stored); err != nil {
+			return err
+		}
+	}
+	// SETNX, so that instances creating the key concurrently can't replace a key which already encrypted delivery points.
+	return r.client.SetNX(TenantDataKeyPrefix+tenant, stored, 0).Err()
+}
+
+// encryptDeliveryPointValue returns the value to save for a delivery point of service: encrypted with the data key of its tenant,
+// if tenant encryption is enabled and the service belongs to a tenant.
+func (r *PushRedisDB) encryptDeliveryPointValue(service string, value []byte) ([]byte, error) {
+	encrypted, err := r.EncryptDeliveryPointOfService(service, value)
+	if encrypted == nil && err == nil {
+		return value, nil
+	}
+	return encrypted, err
+}
+
+// EncryptDeliveryPointOfService will return data encrypted with the data key of the tenant of service, the way the delivery points of service are saved,
+// or nil if the delivery points of service aren't encrypted (tenant encryption is disabled, or service doesn't belong to a tenant).
+// It returns an error if the data key of the tenant was shredded.
+func (r *PushRedisDB) EncryptDeliveryPointOfService(service string, data []byte) ([]byte, error) {
+	if !r.tenantEncryption {
+		return nil, nil
+	}
+	tenant, err := r.tenantOfService(service)
+	if err != nil || tenant == "" {
+		return nil, err
+	}
+	dataKey, err := r.tenantDataKey(tenant)
+	if err != nil {
+		return nil, err
+	}
+	if dataKey == nil {
+		return nil, errTenantDataKeyShredded
+	}
+	return sealTenantValue(tenant, dataKey, data)
+}
+
+// DecryptDeliveryPointOfService will return the plaintext of data returned by EncryptDeliveryPointOfService,
+// or nil if the data key of the tenant it was encrypted with was shredded.
+func (r *PushRedisDB) DecryptDeliveryPointOfService(service string, data []byte) ([]byte, error) {
+	if _, _, _, ok := splitTenantValue(data); !ok {
+		return nil, fmt.Errorf("Cannot decrypt a delivery point of service %q: it isn't encrypted with the data key of a tenant", service)
+	}
+	return r.decryptDeliveryPointValue(data)
+}
+
+// decryptDeliveryPointValue returns the plaintext of a saved delivery point. Values which aren't encrypted are returned unchanged.
+// It returns nil if the delivery point was encrypted with a data key which was shredded, so that it is treated as missing.
+func (r *PushRedisDB) decryptDeliveryPointValue(value []byte) ([]byte, error) {
+	tenant, sealed, additionalData, ok := splitTenantValue(value)
+	if !ok {
+		return value, nil
+	}
+	dataKey, err := r.tenantDataKey(tenant)
+	if err != nil || dataKey == nil {
+		return nil, err
+	}
+	plaintext, err := open(dataKey, sealed, additionalData)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot decrypt a delivery point of tenant %q: %v", tenant, err)
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,145 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// Package eventsink contains sinks which export delivery and engagement events to external systems (e.g. a kafka topic, or objects in S3 or GCS
+// which are loaded into a data warehouse such as BigQuery), so that analysts can query the performance of notifications alongside their own data.
+package eventsink
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/uniqush/log"
+)
+
+// Types of events.
+const (
+	// Delivery is the result of a push to a delivery point.
+	Delivery = "delivery"
+	// Opened is a notification which a client SDK reported as opened with /track/open.
+	Opened = "opened"
+	// Clicked is a notification which a client SDK reported as clicked with /track/click.
+	Clicked = "clicked"
+)
+
+// Event is a delivery or engagement event. It is encoded as a JSON object, with the fields which don't apply to its type omitted.
+type Event struct {
+	Type    string    `json:"type"`
+	Time    time.Time `json:"time"`
+	Service string    `json:"service"`
+	// RequestID is the id of the push request, or the id of the broadcast.
+	RequestID           string `json:"requestId,omitempty"`
+	Subscriber          string `json:"subscriber,omitempty"`
+	DeliveryPoint       string `json:"deliveryPoint,omitempty"`
+	PushServiceProvider string `json:"pushServiceProvider,omitempty"`
+	PushServiceType     string `json:"pushServiceType,omitempty"`
+	// MessageID is the id the push service gave to an accepted push.
+	MessageID string `json:"messageId,omitempty"`
+	// Result is the result of a push, as labeled in the uniqush_pushes_total metric (e.g. success, retry, unsubscribed).
+	Result   string `json:"result,omitempty"`
+	ErrorMsg string `json:"errorMsg,omitempty"`
+	// Campaign is the uniqush.campaign of the push, or the campaign reported with /track/open and /track/click.
+	Campaign string `json:"campaign,omitempty"`
+	// NotificationID is the id reported with /track/open and /track/click.
+	NotificationID string `json:"notificationId,omitempty"`
+}
+
+// Sink exports batches of events to an external system.
+type Sink interface {
+	// Write exports a batch of events. If it returns an error, the same batch may be written again.
+	Write(ctx context.Context, events []Event) error
+	// Close releases the resources of the sink, after the last batch was written.
+	Close() error
+}
+
+// Factory creates a sink from the settings in its [EventSink.<name>] section of uniqush.conf.
+type Factory func(name string, settings Settings, logger log.Logger) (Sink, error)
+
+var (
+	factoriesLock sync.Mutex
+	factories     = make(map[string]Factory)
+)
+
+// Register is called during initialization to make a sink type available to the type setting of [EventSink.<name>] sections.
+func Register(sinkType string, factory Factory) error {
+	factoriesLock.Lock()
+	defer factoriesLock.Unlock()
+	if _, ok := factories[sinkType]; ok {
+		return fmt.Errorf("Attempted to register event sink %q twice", sinkType)
+	}
+	factories[sinkType] = factory
+	return nil
+}
+
+// New creates a sink of a registered type.
+func New(sinkType, name string, settings Settings, logger log.Logger) (Sink, error) {
+	factoriesLock.Lock()
+	factory, ok := factories[sinkType]
+	types := make([]string, 0, len(factories))
+	for t := range factories {
+		types = append(types, t)
+	}
+	factoriesLock.Unlock()
+	if !ok {
+		sort.Strings(types)
+		return nil, fmt.Errorf("Unknown event sink type %q. Supported types: %v", sinkType, types)
+	}
+	return factory(name, settings, logger)
+}
+
+// Settings are the settings of an [EventSink.<name>] section of uniqush.conf.
+type Settings map[string]string
+
+// String returns the value of a setting, or defaultValue if it isn't set.
+func (s Settings) String(key, defaultValue string) string {
+	if v, ok := s[key]; ok && v != "" {
+		return v
+	}
+	return defaultValue
+}
+
+// Int returns the value of a positive integer setting, or defaultValue if it isn't set.
+func (s Settings) Int(key string, defaultValue int) (int, error) {
+	v, ok := s[key]
+	if !ok || v == "" {
+		return defaultValue, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid %s %q: %v", key, v, err)
+	}
+	if n <= 0 {
+		return 0, fmt.Errorf("%s must be positive, got %d", key, n)
+	}
+	return n, nil
+}
+
+// Seconds returns the value of a setting in seconds, or defaultValue if it isn't set. The value must be positive.
+func (s Settings) Seconds(key string, defaultValue time.Duration) (time.Duration, error) {
+	n, err := s.Int(key, 0)
+	if err != nil {
+		return 0, err
+	}
+	if n == 0 {
+		return defaultValue, nil
+	}
+	return time.Duration(n) * time.Second, nil
+}
@@ -0,0 +1,93 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package eventsink
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/uniqush/log"
+)
+
+// InstallKafka makes the kafka sink available.
+func InstallKafka() {
+	if err := Register("kafka", newKafkaSink); err != nil {
+		panic(fmt.Sprintf("Failed to install kafka event sink: %v", err))
+	}
+}
+
+// kafkaSink produces each event as a JSON message to a kafka topic. Messages are keyed by service and subscriber,
+// so that the events of a subscriber stay in order within a partition.
+type kafkaSink struct {
+	writer *kafka.Writer
+}
+
+func newKafkaSink(name string, settings Settings, logger log.Logger) (Sink, error) {
+	var brokers []string
+	for _, broker := range strings.Split(settings.String("brokers", ""), ",") {
+		if broker = strings.TrimSpace(broker); broker != "" {
+			brokers = append(brokers, broker)
+		}
+	}
+	if len(brokers) == 0 {
+		return nil, fmt.Errorf("brokers must be set")
+	}
+	topic := settings.String("topic", "")
+	if topic == "" {
+		return nil, fmt.Errorf("topic must be set")
+	}
+	var acks kafka.RequiredAcks
+	switch s := settings.String("acks", "all"); s {
+	case "all":
+		acks = kafka.RequireAll
+	case "one":
+		acks = kafka.RequireOne
+	default:
+		return nil, fmt.Errorf("acks must be all or one, got %q", s)
+	}
+	return &kafkaSink{
+		writer: &kafka.Writer{
+			Addr:         kafka.TCP(brokers...),
+			Topic:        topic,
+			Balancer:     &kafka.Hash{},
+			RequiredAcks: acks,
+			// Batches are already assembled by uniqush-push, so the writer shouldn't wait for more messages.
+			BatchTimeout: 10 * time.Millisecond,
+		},
+	}, nil
+}
+
+func (s *kafkaSink) Write(ctx context.Context, events []Event) error {
+	messages := make([]kafka.Message, len(events))
+	for i, event := range events {
+		value, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		messages[i] = kafka.Message{Key: []byte(event.Service + ":" + event.Subscriber), Value: value}
+	}
+	return s.writer.WriteMessages(ctx, messages...)
+}
+
+func (s *kafkaSink) Close() error {
+	return s.writer.Close()
+}
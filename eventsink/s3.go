@@ -0,0 +1,210 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package eventsink
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/uniqush/log"
+)
+
+const (
+	defaultS3Timeout = 30 * time.Second
+	// s3TimeFormat is the format of the x-amz-date header.
+	s3TimeFormat = "20060102T150405Z"
+)
+
+// InstallS3 makes the s3 sink available.
+func InstallS3() {
+	if err := Register("s3", newS3Sink); err != nil {
+		panic(fmt.Sprintf("Failed to install s3 event sink: %v", err))
+	}
+}
+
+// s3Sink uploads each batch of events as an object of newline delimited JSON (gzipped by default) to a bucket of S3, or of a service
+// with an S3 compatible API (e.g. Google Cloud Storage with HMAC keys, from which BigQuery can load or query the objects, or MinIO).
+// Objects are named <prefix>dt=<date>/hour=<hour>/<timestamp>-<random>.json(.gz), so that warehouses can partition them by date.
+type s3Sink struct {
+	endpoint        string
+	region          string
+	bucket          string
+	prefix          string
+	accessKeyID     string
+	secretAccessKey string
+	sessionToken    string
+	gzip            bool
+	client          *http.Client
+	now             func() time.Time
+}
+
+func newS3Sink(name string, settings Settings, logger log.Logger) (Sink, error) {
+	s := &s3Sink{
+		region:          settings.String("region", "us-east-1"),
+		bucket:          settings.String("bucket", ""),
+		prefix:          settings.String("prefix", ""),
+		accessKeyID:     settings.String("access_key_id", ""),
+		secretAccessKey: settings.String("secret_access_key", ""),
+		sessionToken:    settings.String("session_token", ""),
+		now:             time.Now,
+	}
+	s.endpoint = strings.TrimSuffix(settings.String("endpoint", "https://s3."+s.region+".amazonaws.com"), "/")
+	if s.bucket == "" {
+		return nil, fmt.Errorf("bucket must be set")
+	}
+	if s.accessKeyID == "" || s.secretAccessKey == "" {
+		return nil, fmt.Errorf("access_key_id and secret_access_key must be set")
+	}
+	switch compression := settings.String("gzip", "on"); compression {
+	case "on":
+		s.gzip = true
+	case "off":
+	default:
+		return nil, fmt.Errorf("gzip must be on or off, got %q", compression)
+	}
+	timeout, err := settings.Seconds("timeout", defaultS3Timeout)
+	if err != nil {
+		return nil, err
+	}
+	s.client = &http.Client{Timeout: timeout}
+	return s, nil
+}
+
+func (s *s3Sink) Write(ctx context.Context, events []Event) error {
+	var body bytes.Buffer
+	encoder := json.NewEncoder(&body)
+	for _, event := range events {
+		if err := encoder.Encode(event); err != nil {
+			return err
+		}
+	}
+	data := body.Bytes()
+	ext := ".json"
+	if s.gzip {
+		var compressed bytes.Buffer
+		w := gzip.NewWriter(&compressed)
+		w.Write(data)
+		if err := w.Close(); err != nil {
+			return err
+		}
+		data = compressed.Bytes()
+		ext = ".json.gz"
+	}
+	now := s.now().UTC()
+	var suffix [4]byte
+	rand.Read(suffix[:])
+	key := fmt.Sprintf("%sdt=%s/hour=%02d/%d-%s%s", s.prefix, now.Format("2006-01-02"), now.Hour(), now.UnixNano(), hex.EncodeToString(suffix[:]), ext)
+
+	req, err := http.NewRequest("PUT", s.endpoint+s3URIEncode("/"+s.bucket+"/"+key), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	if s.gzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	if s.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.sessionToken)
+	}
+	payloadHash := sha256.Sum256(data)
+	s3Sign(req, hex.EncodeToString(payloadHash[:]), s.accessKeyID, s.secretAccessKey, s.region, now)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		message, _ := ioutil.ReadAll(resp.Body)
+		if len(message) > 512 {
+			message = message[:512]
+		}
+		return fmt.Errorf("Unexpected status %s uploading %s: %s", resp.Status, key, message)
+	}
+	return nil
+}
+
+func (s *s3Sink) Close() error {
+	return nil
+}
+
+// s3URIEncode encodes every byte of a path except the unreserved characters and "/", as required by AWS signature version 4.
+func s3URIEncode(path string) string {
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') || strings.IndexByte("-._~/", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3Sign adds the x-amz-date, x-amz-content-sha256 and Authorization headers of AWS signature version 4 to req, signing its host and other headers.
+// The path of req must already be encoded with s3URIEncode, and it must not have a query string.
+func s3Sign(req *http.Request, payloadHash, accessKeyID, secretAccessKey, region string, now time.Time) {
+	amzDate := now.UTC().Format(s3TimeFormat)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+	canonicalRequest := strings.Join([]string{req.Method, req.URL.EscapedPath(), req.URL.RawQuery, canonicalHeaders.String(), signedHeaders, payloadHash}, "\n")
+
+	scope := amzDate[:8] + "/" + region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+	key := []byte("AWS4" + secretAccessKey)
+	for _, part := range []string{amzDate[:8], region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s,SignedHeaders=%s,Signature=%s", accessKeyID, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,190 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// Package ingest contains adapters which receive push requests from sources other than the REST API (e.g. an outbox stream or a message queue).
+// The push requests have the same parameters as /push, and are validated and sent the same way.
+package ingest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/uniqush/log"
+)
+
+// Message is a push request received by an Adapter. Params has the same names and values as the parameters of /push.
+type Message struct {
+	// ID uniquely identifies the message within its source (e.g. the id of a redis stream entry).
+	// It is used as the job id of the push (unless uniqush.job_id is set), so that a redelivered message is pushed at most once.
+	// It is empty if the source doesn't identify messages.
+	ID     string
+	Params url.Values
+}
+
+// RetryLaterError is returned by a Handler if a message can't be processed right now (e.g. because uniqush-push is overloaded or stopping).
+// The adapter should not acknowledge the message, and should wait for After before receiving more messages.
+type RetryLaterError struct {
+	After  time.Duration
+	Reason string
+}
+
+func (e *RetryLaterError) Error() string {
+	return fmt.Sprintf("Retry after %v: %s", e.After, e.Reason)
+}
+
+// Handler processes a message. If it returns nil, the message is acknowledged and won't be received again.
+type Handler func(msg *Message) error
+
+// Adapter receives push requests from a source other than the REST API.
+type Adapter interface {
+	// Run passes each received message to handler until stop is closed.
+	// Messages which handler didn't accept are received again later (possibly by another instance).
+	Run(handler Handler, stop <-chan struct{}) error
+}
+
+// Factory creates an adapter from the settings in its [Ingest.<name>] section of uniqush.conf.
+type Factory func(name string, settings Settings, logger log.Logger) (Adapter, error)
+
+var (
+	factoriesLock sync.Mutex
+	factories     = make(map[string]Factory)
+)
+
+// Register is called during initialization to make an adapter type available to the type setting of [Ingest.<name>] sections.
+func Register(adapterType string, factory Factory) error {
+	factoriesLock.Lock()
+	defer factoriesLock.Unlock()
+	if _, ok := factories[adapterType]; ok {
+		return fmt.Errorf("Attempted to register ingestion adapter %q twice", adapterType)
+	}
+	factories[adapterType] = factory
+	return nil
+}
+
+// New creates an adapter of a registered type.
+func New(adapterType, name string, settings Settings, logger log.Logger) (Adapter, error) {
+	factoriesLock.Lock()
+	factory, ok := factories[adapterType]
+	types := make([]string, 0, len(factories))
+	for t := range factories {
+		types = append(types, t)
+	}
+	factoriesLock.Unlock()
+	if !ok {
+		sort.Strings(types)
+		return nil, fmt.Errorf("Unknown ingestion adapter type %q. Supported types: %v", adapterType, types)
+	}
+	return factory(name, settings, logger)
+}
+
+// Settings are the settings of an [Ingest.<name>] section of uniqush.conf.
+type Settings map[string]string
+
+// String returns the value of a setting, or defaultValue if it isn't set.
+func (s Settings) String(key, defaultValue string) string {
+	if v, ok := s[key]; ok && v != "" {
+		return v
+	}
+	return defaultValue
+}
+
+// Int returns the value of an integer setting, or defaultValue if it isn't set.
+func (s Settings) Int(key string, defaultValue int) (int, error) {
+	v, ok := s[key]
+	if !ok || v == "" {
+		return defaultValue, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid %s %q: %v", key, v, err)
+	}
+	return n, nil
+}
+
+// Seconds returns the value of a setting in seconds, or defaultValue if it isn't set. The value must be positive.
+func (s Settings) Seconds(key string, defaultValue time.Duration) (time.Duration, error) {
+	n, err := s.Int(key, -1)
+	if err != nil {
+		return 0, err
+	}
+	if n == -1 {
+		return defaultValue, nil
+	}
+	if n <= 0 {
+		return 0, fmt.Errorf("%s must be positive, got %d", key, n)
+	}
+	return time.Duration(n) * time.Second, nil
+}
+
+// ParseJSON converts a JSON object with the parameters of /push into url.Values.
+// Values may be strings, numbers or booleans, or arrays of those (e.g. for uniqush.perdp.* parameters).
+func ParseJSON(data []byte) (url.Values, error) {
+	var obj map[string]interface{}
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return nil, fmt.Errorf("Invalid push request: %v", err)
+	}
+	params := make(url.Values, len(obj))
+	for k, v := range obj {
+		switch value := v.(type) {
+		case []interface{}:
+			for _, item := range value {
+				s, err := scalarToString(k, item)
+				if err != nil {
+					return nil, err
+				}
+				params.Add(k, s)
+			}
+		default:
+			s, err := scalarToString(k, value)
+			if err != nil {
+				return nil, err
+			}
+			params.Set(k, s)
+		}
+	}
+	return params, nil
+}
+
+func scalarToString(key string, v interface{}) (string, error) {
+	switch value := v.(type) {
+	case string:
+		return value, nil
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64), nil
+	case bool:
+		return strconv.FormatBool(value), nil
+	default:
+		return "", fmt.Errorf("Invalid push request: %q must be a string, number or boolean", key)
+	}
+}
+
+// sleep waits for d, or until stop is closed. Returns false if stop was closed.
+func sleep(d time.Duration, stop <-chan struct{}) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-stop:
+		return false
+	case <-timer.C:
+		return true
+	}
+}
@@ -0,0 +1,108 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package ingest
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/uniqush/uniqush-push/testutil"
+)
+
+func TestParseJSON(t *testing.T) {
+	params, err := ParseJSON([]byte(`{"service":"myservice","subscriber":"a,b","badge":3,"content-available":true,"uniqush.perdp.msg":["hi","hello"]}`))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := url.Values{
+		"service":           {"myservice"},
+		"subscriber":        {"a,b"},
+		"badge":             {"3"},
+		"content-available": {"true"},
+		"uniqush.perdp.msg": {"hi", "hello"},
+	}
+	testutil.ExpectEquals(t, expected, params, "expected JSON push request to be converted to /push parameters")
+
+	for _, data := range []string{`[]`, `{"msg":{"nested":1}}`, `{"msg":null}`, `{`} {
+		if _, err := ParseJSON([]byte(data)); err == nil {
+			t.Errorf("Expected %s to be rejected", data)
+		}
+	}
+}
+
+func TestSettings(t *testing.T) {
+	settings := Settings{"stream": "outbox", "batch_size": "20", "block": "0", "bad": "x"}
+	testutil.ExpectStringEquals(t, "outbox", settings.String("stream", "default"), "expected string setting")
+	testutil.ExpectStringEquals(t, "default", settings.String("group", "default"), "expected default string setting")
+	n, err := settings.Int("batch_size", 10)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	testutil.ExpectEquals(t, 20, n, "expected int setting")
+	if _, err := settings.Int("bad", 10); err == nil {
+		t.Errorf("Expected an invalid int setting to be rejected")
+	}
+	d, err := settings.Seconds("claim_idle", time.Minute)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	testutil.ExpectEquals(t, time.Minute, d, "expected default duration setting")
+	if _, err := settings.Seconds("block", time.Second); err == nil {
+		t.Errorf("Expected a duration of 0 to be rejected")
+	}
+}
+
+func TestRedisStreamParams(t *testing.T) {
+	params, err := redisStreamParams(map[string]interface{}{"service": "myservice", "subscriber": "a", "msg": "hi"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	testutil.ExpectEquals(t, url.Values{"service": {"myservice"}, "subscriber": {"a"}, "msg": {"hi"}}, params, "expected one field per parameter")
+
+	params, err = redisStreamParams(map[string]interface{}{RedisStreamRequestField: `{"service":"myservice","subscriber":"a"}`})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	testutil.ExpectEquals(t, url.Values{"service": {"myservice"}, "subscriber": {"a"}}, params, "expected a JSON request field to be parsed")
+}
+
+func TestKafkaSettings(t *testing.T) {
+	for _, settings := range []Settings{
+		{"topic": "pushes"},
+		{"brokers": "localhost:9092"},
+		{"brokers": "localhost:9092", "topic": "pushes", "start": "middle"},
+		{"brokers": "localhost:9092", "topic": "pushes", "max_wait": "0"},
+	} {
+		if _, err := newKafkaAdapter("events", settings, nil); err == nil {
+			t.Errorf("Expected %v to be rejected", settings)
+		}
+	}
+}
+
+func TestNATSAndAMQPSettings(t *testing.T) {
+	if _, err := newNATSAdapter("events", Settings{"url": "nats://localhost:4222"}, nil); err == nil {
+		t.Errorf("Expected a nats adapter without a subject to be rejected")
+	}
+	if _, err := newAMQPAdapter("events", Settings{}, nil); err == nil {
+		t.Errorf("Expected an amqp adapter without a queue to be rejected")
+	}
+	if _, err := newAMQPAdapter("events", Settings{"queue": "pushes", "prefetch": "0"}, nil); err == nil {
+		t.Errorf("Expected an amqp adapter with prefetch=0 to be rejected")
+	}
+}
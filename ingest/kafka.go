@@ -0,0 +1,150 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package ingest
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/uniqush/log"
+)
+
+const (
+	defaultKafkaGroup   = "uniqush-push"
+	defaultKafkaMaxWait = time.Second
+	// kafkaErrorDelay is how long to wait before fetching messages again after an error.
+	kafkaErrorDelay = time.Second
+)
+
+// InstallKafka makes the kafka adapter available.
+func InstallKafka() {
+	if err := Register("kafka", newKafkaAdapter); err != nil {
+		panic(fmt.Sprintf("Failed to install kafka ingestion adapter: %v", err))
+	}
+}
+
+// kafkaAdapter consumes push requests (JSON objects with the parameters of /push) from a kafka topic.
+// The topic's partitions are shared by every uniqush-push instance in the same consumer group, so throughput scales with the number of partitions.
+// The offset of a message is committed only after it was pushed. A message redelivered after a rebalance or a crash
+// has the same topic:partition:offset id, which is used as its job id, so it isn't pushed twice.
+type kafkaAdapter struct {
+	reader *kafka.Reader
+	topic  string
+	logger log.Logger
+}
+
+func newKafkaAdapter(name string, settings Settings, logger log.Logger) (Adapter, error) {
+	var brokers []string
+	for _, broker := range strings.Split(settings.String("brokers", ""), ",") {
+		if broker = strings.TrimSpace(broker); broker != "" {
+			brokers = append(brokers, broker)
+		}
+	}
+	if len(brokers) == 0 {
+		return nil, fmt.Errorf("brokers must be set")
+	}
+	topic := settings.String("topic", "")
+	if topic == "" {
+		return nil, fmt.Errorf("topic must be set")
+	}
+	var startOffset int64
+	switch start := settings.String("start", "first"); start {
+	case "first":
+		startOffset = kafka.FirstOffset
+	case "last":
+		startOffset = kafka.LastOffset
+	default:
+		return nil, fmt.Errorf("start must be first or last, got %q", start)
+	}
+	maxWait, err := settings.Seconds("max_wait", defaultKafkaMaxWait)
+	if err != nil {
+		return nil, err
+	}
+	return &kafkaAdapter{
+		reader: kafka.NewReader(kafka.ReaderConfig{
+			Brokers:     brokers,
+			GroupID:     settings.String("group", defaultKafkaGroup),
+			Topic:       topic,
+			StartOffset: startOffset,
+			MaxWait:     maxWait,
+			// Offsets are committed synchronously after each message is pushed.
+			CommitInterval: 0,
+			// Messages of aborted producer transactions are never pushed.
+			IsolationLevel: kafka.ReadCommitted,
+		}),
+		topic:  topic,
+		logger: logger,
+	}, nil
+}
+
+// Run consumes messages until stop is closed. Messages which weren't committed yet are consumed again by the next member of the group.
+func (a *kafkaAdapter) Run(handler Handler, stop <-chan struct{}) error {
+	defer a.reader.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-stop
+		cancel()
+	}()
+	for {
+		message, err := a.reader.FetchMessage(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			a.logger.Errorf("Topic=%v Cannot fetch message: %v", a.topic, err)
+			if !sleep(kafkaErrorDelay, stop) {
+				return nil
+			}
+			continue
+		}
+		if !a.process(handler, message, stop) {
+			return nil
+		}
+		if err := a.reader.CommitMessages(ctx, message); err != nil && ctx.Err() == nil {
+			a.logger.Errorf("Topic=%v Partition=%v Offset=%v Cannot commit offset: %v", a.topic, message.Partition, message.Offset, err)
+		}
+	}
+}
+
+// process passes a message to handler, waiting and retrying for as long as handler asks to retry later.
+// Returns false (without the message being processed) if stop was closed.
+func (a *kafkaAdapter) process(handler Handler, message kafka.Message, stop <-chan struct{}) bool {
+	id := fmt.Sprintf("%s:%d:%d", message.Topic, message.Partition, message.Offset)
+	params, err := ParseJSON(message.Value)
+	for err == nil {
+		err = handler(&Message{ID: id, Params: params})
+		retry, ok := err.(*RetryLaterError)
+		if !ok {
+			break
+		}
+		a.logger.Warnf("Topic=%v ID=%v Will retry: %v", a.topic, id, retry)
+		if !sleep(retry.After, stop) {
+			return false
+		}
+		err = nil
+	}
+	if err != nil {
+		// The message can't be processed no matter how often it is retried, so its offset is committed anyway.
+		a.logger.Errorf("Topic=%v ID=%v Dropped invalid message: %v", a.topic, id, err)
+	}
+	return true
+}
@@ -0,0 +1,119 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package ingest
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/uniqush/log"
+)
+
+const (
+	defaultNATSQueue = "uniqush-push"
+	// natsPollInterval is how often Run checks whether it should stop while no messages arrive.
+	natsPollInterval = time.Second
+	// natsMsgIDHeader is the header used by publishers (and JetStream) to identify a message. It is used as the job id.
+	natsMsgIDHeader = "Nats-Msg-Id"
+)
+
+// InstallNATS makes the nats adapter available.
+func InstallNATS() {
+	if err := Register("nats", newNATSAdapter); err != nil {
+		panic(fmt.Sprintf("Failed to install nats ingestion adapter: %v", err))
+	}
+}
+
+// natsAdapter receives push requests (JSON objects with the parameters of /push) published to a NATS subject.
+// Instances subscribe with the same queue group, so each message is received by one instance.
+// Core NATS doesn't redeliver messages, so a message which can't be pushed right now is retried by this instance until it stops.
+type natsAdapter struct {
+	url     string
+	subject string
+	queue   string
+	name    string
+	logger  log.Logger
+}
+
+func newNATSAdapter(name string, settings Settings, logger log.Logger) (Adapter, error) {
+	subject := settings.String("subject", "")
+	if subject == "" {
+		return nil, fmt.Errorf("subject must be set")
+	}
+	return &natsAdapter{
+		url:     settings.String("url", nats.DefaultURL),
+		subject: subject,
+		queue:   settings.String("queue", defaultNATSQueue),
+		name:    name,
+		logger:  logger,
+	}, nil
+}
+
+// Run receives messages until stop is closed. The client reconnects by itself if the connection to the server is lost.
+func (a *natsAdapter) Run(handler Handler, stop <-chan struct{}) error {
+	conn, err := nats.Connect(a.url, nats.Name("uniqush-push "+a.name), nats.MaxReconnects(-1))
+	if err != nil {
+		return fmt.Errorf("Cannot connect to %s: %v", a.url, err)
+	}
+	defer conn.Close()
+	sub, err := conn.QueueSubscribeSync(a.subject, a.queue)
+	if err != nil {
+		return fmt.Errorf("Cannot subscribe to %s: %v", a.subject, err)
+	}
+	for {
+		select {
+		case <-stop:
+			return nil
+		default:
+		}
+		msg, err := sub.NextMsg(natsPollInterval)
+		if err == nats.ErrTimeout {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("Cannot receive from %s: %v", a.subject, err)
+		}
+		a.process(handler, msg, stop)
+	}
+}
+
+// process passes a message to handler, waiting and retrying for as long as handler asks to retry later.
+func (a *natsAdapter) process(handler Handler, msg *nats.Msg, stop <-chan struct{}) {
+	id := ""
+	if msg.Header != nil {
+		id = msg.Header.Get(natsMsgIDHeader)
+	}
+	params, err := ParseJSON(msg.Data)
+	for err == nil {
+		err = handler(&Message{ID: id, Params: params})
+		retry, ok := err.(*RetryLaterError)
+		if !ok {
+			break
+		}
+		a.logger.Warnf("Subject=%v ID=%v Will retry: %v", a.subject, id, retry)
+		if !sleep(retry.After, stop) {
+			a.logger.Errorf("Subject=%v ID=%v Dropped message: stopping", a.subject, id)
+			return
+		}
+		err = nil
+	}
+	if err != nil {
+		a.logger.Errorf("Subject=%v ID=%v Dropped invalid message: %v", a.subject, id, err)
+	}
+}
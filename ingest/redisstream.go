@@ -0,0 +1,245 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package ingest
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/uniqush/log"
+)
+
+const (
+	defaultRedisStreamGroup     = "uniqush-push"
+	defaultRedisStreamBatchSize = 10
+	defaultRedisStreamBlock     = 5 * time.Second
+	defaultRedisStreamClaimIdle = 60 * time.Second
+	// redisStreamErrorDelay is how long to wait before reading the stream again after an error.
+	redisStreamErrorDelay = time.Second
+	// RedisStreamRequestField is the field of a stream entry which may contain a JSON push request, instead of using one field per /push parameter.
+	RedisStreamRequestField = "request"
+)
+
+// InstallRedisStream makes the redis_stream adapter available.
+func InstallRedisStream() {
+	if err := Register("redis_stream", newRedisStreamAdapter); err != nil {
+		panic(fmt.Sprintf("Failed to install redis_stream ingestion adapter: %v", err))
+	}
+}
+
+// redisStreamAdapter tails a redis stream used as a transactional outbox: an application server adds an entry to the stream
+// in the same MULTI/EXEC transaction (or lua script) as its business data, and the entry is converted into a push.
+// Entries are read with a consumer group, so that several uniqush-push instances share the work,
+// and entries left pending by a crashed instance are claimed by another one after claim_idle.
+type redisStreamAdapter struct {
+	client    *redis.Client
+	stream    string
+	group     string
+	consumer  string
+	batchSize int64
+	block     time.Duration
+	claimIdle time.Duration
+	logger    log.Logger
+}
+
+func newRedisStreamAdapter(name string, settings Settings, logger log.Logger) (Adapter, error) {
+	stream := settings.String("stream", "")
+	if stream == "" {
+		return nil, fmt.Errorf("stream must be set")
+	}
+	port, err := settings.Int("port", 6379)
+	if err != nil {
+		return nil, err
+	}
+	db, err := settings.Int("db", 0)
+	if err != nil {
+		return nil, err
+	}
+	batchSize, err := settings.Int("batch_size", defaultRedisStreamBatchSize)
+	if err != nil {
+		return nil, err
+	}
+	if batchSize <= 0 {
+		return nil, fmt.Errorf("batch_size must be positive, got %d", batchSize)
+	}
+	block, err := settings.Seconds("block", defaultRedisStreamBlock)
+	if err != nil {
+		return nil, err
+	}
+	claimIdle, err := settings.Seconds("claim_idle", defaultRedisStreamClaimIdle)
+	if err != nil {
+		return nil, err
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return &redisStreamAdapter{
+		client: redis.NewClient(&redis.Options{
+			Addr:     fmt.Sprintf("%s:%d", settings.String("host", "localhost"), port),
+			Password: settings.String("password", ""),
+			DB:       db,
+		}),
+		stream:    stream,
+		group:     settings.String("group", defaultRedisStreamGroup),
+		consumer:  settings.String("consumer", fmt.Sprintf("%s:%d", hostname, os.Getpid())),
+		batchSize: int64(batchSize),
+		block:     block,
+		claimIdle: claimIdle,
+		logger:    logger,
+	}, nil
+}
+
+// Run reads entries from the stream until stop is closed.
+// Entries which this consumer received but didn't acknowledge are processed before new entries.
+func (a *redisStreamAdapter) Run(handler Handler, stop <-chan struct{}) error {
+	defer a.client.Close()
+	err := a.client.XGroupCreateMkStream(a.stream, a.group, "0").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return fmt.Errorf("Cannot create consumer group %q of stream %q: %v", a.group, a.stream, err)
+	}
+	lastClaim := time.Time{}
+	for {
+		select {
+		case <-stop:
+			return nil
+		default:
+		}
+		if time.Since(lastClaim) >= a.claimIdle {
+			a.claim()
+			lastClaim = time.Now()
+		}
+		// "0" reads the entries pending for this consumer (without blocking), ">" waits for new entries.
+		messages, err := a.read("0", -1)
+		if err == nil && len(messages) == 0 {
+			messages, err = a.read(">", a.block)
+		}
+		if err != nil {
+			a.logger.Errorf("Stream=%v Cannot read stream: %v", a.stream, err)
+			if !sleep(redisStreamErrorDelay, stop) {
+				return nil
+			}
+			continue
+		}
+		for _, message := range messages {
+			if !a.process(handler, message, stop) {
+				break
+			}
+		}
+	}
+}
+
+// read returns up to batchSize entries after start. A negative block returns immediately if there are none.
+func (a *redisStreamAdapter) read(start string, block time.Duration) ([]redis.XMessage, error) {
+	args := &redis.XReadGroupArgs{
+		Group:    a.group,
+		Consumer: a.consumer,
+		Streams:  []string{a.stream, start},
+		Count:    a.batchSize,
+		Block:    block,
+	}
+	streams, err := a.client.XReadGroup(args).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var messages []redis.XMessage
+	for _, s := range streams {
+		messages = append(messages, s.Messages...)
+	}
+	return messages, nil
+}
+
+// process passes an entry to handler, and acknowledges it unless handler asked to retry later.
+// Returns false if the rest of the batch should be received again later.
+func (a *redisStreamAdapter) process(handler Handler, message redis.XMessage, stop <-chan struct{}) bool {
+	params, err := redisStreamParams(message.Values)
+	if err == nil {
+		err = handler(&Message{ID: message.ID, Params: params})
+	}
+	if retry, ok := err.(*RetryLaterError); ok {
+		a.logger.Warnf("Stream=%v ID=%v Will retry: %v", a.stream, message.ID, retry)
+		sleep(retry.After, stop)
+		return false
+	}
+	if err != nil {
+		// The entry can't be processed no matter how often it is retried, so it is acknowledged anyway.
+		a.logger.Errorf("Stream=%v ID=%v Dropped invalid entry: %v", a.stream, message.ID, err)
+	}
+	if err := a.client.XAck(a.stream, a.group, message.ID).Err(); err != nil {
+		a.logger.Errorf("Stream=%v ID=%v Cannot acknowledge entry: %v", a.stream, message.ID, err)
+	}
+	return true
+}
+
+// claim takes over entries which other consumers received but didn't acknowledge within claimIdle (e.g. because that instance crashed).
+func (a *redisStreamAdapter) claim() {
+	pending, err := a.client.XPendingExt(&redis.XPendingExtArgs{
+		Stream: a.stream,
+		Group:  a.group,
+		Start:  "-",
+		End:    "+",
+		Count:  a.batchSize,
+	}).Result()
+	if err != nil {
+		if err != redis.Nil {
+			a.logger.Errorf("Stream=%v Cannot list pending entries: %v", a.stream, err)
+		}
+		return
+	}
+	var ids []string
+	for _, p := range pending {
+		if p.Consumer != a.consumer && p.Idle >= a.claimIdle {
+			ids = append(ids, p.Id)
+		}
+	}
+	if len(ids) == 0 {
+		return
+	}
+	err = a.client.XClaimJustID(&redis.XClaimArgs{
+		Stream:   a.stream,
+		Group:    a.group,
+		Consumer: a.consumer,
+		MinIdle:  a.claimIdle,
+		Messages: ids,
+	}).Err()
+	if err != nil {
+		a.logger.Errorf("Stream=%v Cannot claim pending entries: %v", a.stream, err)
+		return
+	}
+	a.logger.Infof("Stream=%v NrEntries=%v Claimed entries of stopped consumers", a.stream, len(ids))
+}
+
+// redisStreamParams converts the fields of a stream entry into /push parameters.
+// The entry either has one field per parameter, or a single "request" field with a JSON push request.
+func redisStreamParams(values map[string]interface{}) (url.Values, error) {
+	if request, ok := values[RedisStreamRequestField]; ok && len(values) == 1 {
+		return ParseJSON([]byte(fmt.Sprint(request)))
+	}
+	params := make(url.Values, len(values))
+	for k, v := range values {
+		params.Set(k, fmt.Sprint(v))
+	}
+	return params, nil
+}
@@ -22,6 +22,9 @@ import (
 	"fmt"
 	"os"
 
+	"github.com/uniqush/uniqush-push/eventsink"
+	"github.com/uniqush/uniqush-push/ingest"
+	"github.com/uniqush/uniqush-push/server"
 	"github.com/uniqush/uniqush-push/srv"
 )
 
@@ -35,17 +38,67 @@ func installPushServices() {
 	srv.InstallFCM()
 	srv.InstallAPNS()
 	srv.InstallADM()
+	srv.InstallSNS()
+	srv.InstallChat()
+}
+
+func installIngestAdapters() {
+	ingest.InstallRedisStream()
+	ingest.InstallKafka()
+	ingest.InstallNATS()
+	ingest.InstallAMQP()
+}
+
+func installEventSinks() {
+	eventsink.InstallKafka()
+	eventsink.InstallS3()
 }
 
 func main() {
+	flag.Var(&server.ConfigFlagOverrides, "set", "Override a setting of the config file, as <section>.<option>=<value> (repeatable)")
 	flag.Parse()
 	if *uniqushPushShowVersionFlag {
 		fmt.Printf("%v\n", uniqushPushVersion)
 		return
 	}
 	installPushServices()
+	if flag.Arg(0) == "bench" {
+		// uniqush-push [-config file] bench [flags] measures the throughput of the database, cache and sender layers.
+		if err := server.RunBench(*uniqushPushConfFlags, flag.Args()[1:], os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "Benchmark failed: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if flag.Arg(0) == "config" && flag.Arg(1) == "validate" {
+		// uniqush-push [-config file] [-set section.option=value ...] config validate prints the effective configuration and checks it.
+		if err := server.RunConfigValidate(*uniqushPushConfFlags, os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid configuration: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Fprintln(os.Stderr, "The configuration is valid")
+		return
+	}
+	if flag.Arg(0) == "reencrypt" {
+		// uniqush-push [-config file] reencrypt encrypts the credentials of push service providers with the current credential_key.
+		if err := server.RunReencrypt(*uniqushPushConfFlags, os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "Re-encryption failed: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if flag.Arg(0) == "replay" {
+		// uniqush-push [-config file] replay [-until time] [-journal file] [-dry-run] rebuilds the subscriptions from the journal of [Journal].
+		if err := server.RunReplay(*uniqushPushConfFlags, flag.Args()[1:], os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "Replay failed: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	installIngestAdapters()
+	installEventSinks()
 
-	err := Run(*uniqushPushConfFlags, uniqushPushVersion)
+	err := server.Run(*uniqushPushConfFlags, uniqushPushVersion)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Cannot start: %v\n", err)
 	}
@@ -0,0 +1,363 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// Package metrics keeps the counters and histograms of uniqush-push, and writes them in the Prometheus text format for /metrics.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are the upper bounds (in seconds) of the buckets of latency histograms.
+var DefaultBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// DefaultRegistry has the metrics which are kept for the whole process, e.g. the latency of redis calls.
+var DefaultRegistry = NewRegistry()
+
+// collector writes the HELP and TYPE lines and the samples of a metric.
+type collector interface {
+	name() string
+	write(w *bufio.Writer)
+	collect() []Point
+}
+
+// Registry is a set of metrics, which are written in the order they were added.
+type Registry struct {
+	mutex      sync.Mutex
+	collectors []collector
+}
+
+// NewRegistry returns a registry without metrics.
+func NewRegistry() *Registry {
+	return new(Registry)
+}
+
+// register adds c to the registry. Like a duplicate flag, a duplicate metric name is a programming error, so it panics.
+func (r *Registry) register(c collector) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, other := range r.collectors {
+		if other.name() == c.name() {
+			panic(fmt.Sprintf("metrics: %s was registered twice", c.name()))
+		}
+	}
+	r.collectors = append(r.collectors, c)
+}
+
+// Write writes every metric of the registry in the Prometheus text exposition format.
+func (r *Registry) Write(w io.Writer) error {
+	r.mutex.Lock()
+	collectors := append([]collector(nil), r.collectors...)
+	r.mutex.Unlock()
+	bw := bufio.NewWriter(w)
+	for _, c := range collectors {
+		c.write(bw)
+	}
+	return bw.Flush()
+}
+
+// Collect returns the current value of every series of every metric of the registry, for exporters other than /metrics (e.g. statsd).
+func (r *Registry) Collect() []Point {
+	r.mutex.Lock()
+	collectors := append([]collector(nil), r.collectors...)
+	r.mutex.Unlock()
+	var points []Point
+	for _, c := range collectors {
+		points = append(points, c.collect()...)
+	}
+	return points
+}
+
+// Types of metrics.
+const (
+	TypeCounter   = "counter"
+	TypeGauge     = "gauge"
+	TypeHistogram = "histogram"
+)
+
+// Point is the value of a metric for some values of its labels, as returned by Registry.Collect.
+type Point struct {
+	Name        string
+	Type        string
+	Labels      []string
+	LabelValues []string
+	// Value is the value of a counter or gauge, or the sum of the observations of a histogram.
+	Value float64
+	// Count is the number of observations of a histogram.
+	Count uint64
+}
+
+// ContentType is the content type of the text exposition format written by Registry.Write.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Sample is a value of a metric collected by a function, along with the values of its labels.
+type Sample struct {
+	LabelValues []string
+	Value       float64
+}
+
+// series is the value of a metric for some values of its labels.
+type series struct {
+	labelValues []string
+	value       float64
+	// counts are the number of observations in each bucket of a histogram (not cumulative), and sum is their total.
+	counts []uint64
+	sum    float64
+}
+
+// vec keeps the series of a counter or histogram, by the values of its labels.
+type vec struct {
+	metricName string
+	help       string
+	labels     []string
+	mutex      sync.Mutex
+	series     map[string]*series
+}
+
+func newVec(name, help string, labels []string) vec {
+	return vec{metricName: name, help: help, labels: labels, series: make(map[string]*series)}
+}
+
+func (v *vec) name() string {
+	return v.metricName
+}
+
+// get returns the series of labelValues, creating it if needed. v.mutex must be locked.
+func (v *vec) get(labelValues []string) *series {
+	if len(labelValues) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %s has %d labels, got %d values", v.metricName, len(v.labels), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	s, ok := v.series[key]
+	if !ok {
+		s = &series{labelValues: append([]string(nil), labelValues...)}
+		v.series[key] = s
+	}
+	return s
+}
+
+// sorted returns copies of the series, sorted by the values of their labels so that the output is stable. v.mutex must be locked.
+func (v *vec) sorted() []series {
+	keys := make([]string, 0, len(v.series))
+	for key := range v.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	list := make([]series, len(keys))
+	for i, key := range keys {
+		s := *v.series[key]
+		s.counts = append([]uint64(nil), s.counts...)
+		list[i] = s
+	}
+	return list
+}
+
+// CounterVec is a counter for each combination of the values of its labels.
+type CounterVec struct {
+	vec
+}
+
+// NewCounterVec adds a counter with the given labels to the registry.
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{newVec(name, help, labels)}
+	r.register(c)
+	return c
+}
+
+// Add adds delta to the counter of labelValues.
+func (c *CounterVec) Add(delta float64, labelValues ...string) {
+	c.mutex.Lock()
+	c.get(labelValues).value += delta
+	c.mutex.Unlock()
+}
+
+// Inc increments the counter of labelValues.
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *CounterVec) collect() []Point {
+	c.mutex.Lock()
+	list := c.sorted()
+	c.mutex.Unlock()
+	points := make([]Point, len(list))
+	for i, s := range list {
+		points[i] = Point{Name: c.metricName, Type: TypeCounter, Labels: c.labels, LabelValues: s.labelValues, Value: s.value}
+	}
+	return points
+}
+
+func (c *CounterVec) write(w *bufio.Writer) {
+	c.mutex.Lock()
+	list := c.sorted()
+	c.mutex.Unlock()
+	writeHeader(w, c.metricName, c.help, TypeCounter)
+	for _, s := range list {
+		writeSample(w, c.metricName, c.labels, s.labelValues, "", 0, s.value)
+	}
+}
+
+// HistogramVec is a histogram for each combination of the values of its labels.
+type HistogramVec struct {
+	vec
+	buckets []float64
+}
+
+// NewHistogramVec adds a histogram with the given (sorted) bucket upper bounds and labels to the registry.
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{vec: newVec(name, help, labels), buckets: buckets}
+	r.register(h)
+	return h
+}
+
+// Observe adds value to the histogram of labelValues.
+func (h *HistogramVec) Observe(value float64, labelValues ...string) {
+	i := sort.SearchFloat64s(h.buckets, value)
+	h.mutex.Lock()
+	s := h.get(labelValues)
+	if s.counts == nil {
+		s.counts = make([]uint64, len(h.buckets)+1)
+	}
+	s.counts[i]++
+	s.sum += value
+	h.mutex.Unlock()
+}
+
+func (h *HistogramVec) collect() []Point {
+	h.mutex.Lock()
+	list := h.sorted()
+	h.mutex.Unlock()
+	points := make([]Point, len(list))
+	for i, s := range list {
+		var count uint64
+		for _, n := range s.counts {
+			count += n
+		}
+		points[i] = Point{Name: h.metricName, Type: TypeHistogram, Labels: h.labels, LabelValues: s.labelValues, Value: s.sum, Count: count}
+	}
+	return points
+}
+
+func (h *HistogramVec) write(w *bufio.Writer) {
+	h.mutex.Lock()
+	list := h.sorted()
+	h.mutex.Unlock()
+	writeHeader(w, h.metricName, h.help, TypeHistogram)
+	for _, s := range list {
+		var cumulative uint64
+		for i, count := range s.counts {
+			cumulative += count
+			le := math.Inf(1)
+			if i < len(h.buckets) {
+				le = h.buckets[i]
+			}
+			writeSample(w, h.metricName+"_bucket", h.labels, s.labelValues, "le", le, float64(cumulative))
+		}
+		writeSample(w, h.metricName+"_sum", h.labels, s.labelValues, "", 0, s.sum)
+		writeSample(w, h.metricName+"_count", h.labels, s.labelValues, "", 0, float64(cumulative))
+	}
+}
+
+// funcCollector is a metric whose samples are collected by a function when the metrics are written, e.g. from counters kept elsewhere.
+type funcCollector struct {
+	metricName string
+	help       string
+	typ        string
+	labels     []string
+	samples    func() []Sample
+}
+
+// NewGaugeFunc adds a gauge with the given labels to the registry, whose samples are returned by collect.
+func (r *Registry) NewGaugeFunc(name, help string, labels []string, collect func() []Sample) {
+	r.register(&funcCollector{metricName: name, help: help, typ: TypeGauge, labels: labels, samples: collect})
+}
+
+// NewCounterFunc adds a counter with the given labels to the registry, whose samples are returned by collect.
+func (r *Registry) NewCounterFunc(name, help string, labels []string, collect func() []Sample) {
+	r.register(&funcCollector{metricName: name, help: help, typ: TypeCounter, labels: labels, samples: collect})
+}
+
+func (f *funcCollector) name() string {
+	return f.metricName
+}
+
+func (f *funcCollector) collect() []Point {
+	samples := f.samples()
+	points := make([]Point, len(samples))
+	for i, s := range samples {
+		points[i] = Point{Name: f.metricName, Type: f.typ, Labels: f.labels, LabelValues: s.LabelValues, Value: s.Value}
+	}
+	return points
+}
+
+func (f *funcCollector) write(w *bufio.Writer) {
+	writeHeader(w, f.metricName, f.help, f.typ)
+	for _, s := range f.samples() {
+		writeSample(w, f.metricName, f.labels, s.LabelValues, "", 0, s.Value)
+	}
+}
+
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func writeHeader(w *bufio.Writer, name, help, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, helpEscaper.Replace(help), name, typ)
+}
+
+// writeSample writes a line of the text format. If extraLabel isn't "", it is added to the labels with the value extraValue (e.g. the le label of histogram buckets).
+func writeSample(w *bufio.Writer, name string, labels, labelValues []string, extraLabel string, extraValue float64, value float64) {
+	w.WriteString(name)
+	if len(labels) > 0 || extraLabel != "" {
+		w.WriteByte('{')
+		for i, label := range labels {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, `%s="%s"`, label, labelValueEscaper.Replace(labelValues[i]))
+		}
+		if extraLabel != "" {
+			if len(labels) > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, `%s="%s"`, extraLabel, formatFloat(extraValue))
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(value))
+	w.WriteByte('\n')
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
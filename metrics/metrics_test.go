@@ -0,0 +1,84 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package metrics
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/uniqush/uniqush-push/testutil"
+)
+
+func TestRegistryWrite(t *testing.T) {
+	r := NewRegistry()
+	pushes := r.NewCounterVec("pushes_total", "Pushes by result.", "service", "result")
+	latency := r.NewHistogramVec("latency_seconds", "Latency.", []float64{0.1, 1}, "path")
+	r.NewGaugeFunc("queue", "Queue depth.", nil, func() []Sample {
+		return []Sample{{Value: 3}}
+	})
+
+	pushes.Inc("b", "success")
+	pushes.Add(2, "a", "error")
+	pushes.Inc("a", "error")
+	latency.Observe(0.05, "/push")
+	latency.Observe(0.5, "/push")
+	latency.Observe(5, "/push")
+
+	var buf bytes.Buffer
+	if err := r.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	expected := `# HELP pushes_total Pushes by result.
+# TYPE pushes_total counter
+pushes_total{service="a",result="error"} 3
+pushes_total{service="b",result="success"} 1
+# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{path="/push",le="0.1"} 1
+latency_seconds_bucket{path="/push",le="1"} 2
+latency_seconds_bucket{path="/push",le="+Inf"} 3
+latency_seconds_sum{path="/push"} 5.55
+latency_seconds_count{path="/push"} 3
+# HELP queue Queue depth.
+# TYPE queue gauge
+queue 3
+`
+	testutil.ExpectStringEquals(t, expected, buf.String(), "unexpected metrics")
+}
+
+func TestLabelValuesAreEscaped(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounterVec("escaped_total", "Help with a \\ and\na newline.", "label").Inc("a \"quoted\"\nvalue")
+	var buf bytes.Buffer
+	r.Write(&buf)
+	testutil.ExpectStringEquals(t, `# HELP escaped_total Help with a \\ and\na newline.
+# TYPE escaped_total counter
+escaped_total{label="a \"quoted\"\nvalue"} 1
+`, buf.String(), "unexpected escaping")
+}
+
+func TestDuplicateMetricsPanic(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounterVec("duplicate_total", "")
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected registering a metric twice to panic")
+		}
+	}()
+	r.NewCounterVec("duplicate_total", "")
+}
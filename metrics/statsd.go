@@ -0,0 +1,154 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package metrics
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// statsdMaxPacketSize is the size of the UDP packets above which lines are sent in another packet, to avoid IP fragmentation.
+const statsdMaxPacketSize = 1432
+
+// statsdEscaper replaces the characters which have a meaning in the statsd line protocol.
+var statsdEscaper = strings.NewReplacer(":", "_", "|", "_", "@", "_", "#", "_", ",", "_", " ", "_", "\n", "_")
+
+// StatsdExporter sends the metrics of registries to a statsd server (or a Datadog agent) over UDP.
+// Counters are sent as their increase since the last flush, gauges as their value,
+// and histograms as the increase of the number (name.count) and sum (name.sum) of their observations.
+type StatsdExporter struct {
+	conn   net.Conn
+	prefix string
+	// tags are added to every metric, e.g. "env:production".
+	tags []string
+	// labelsAsTags sends the labels of metrics as DogStatsD tags. Otherwise, their values are appended to the name of the metric, since plain statsd has no tags.
+	labelsAsTags bool
+	registries   []*Registry
+	mutex        sync.Mutex
+	// previous are the values of counters (and the sums and counts of histograms) at the last flush, by series.
+	previous map[string]float64
+}
+
+// NewStatsdExporter returns an exporter which sends the metrics of registries to the statsd server at addr (e.g. "localhost:8125"),
+// with prefix prepended to their names.
+func NewStatsdExporter(addr, prefix string, tags []string, labelsAsTags bool, registries ...*Registry) (*StatsdExporter, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &StatsdExporter{
+		conn:         conn,
+		prefix:       prefix,
+		tags:         tags,
+		labelsAsTags: labelsAsTags,
+		registries:   registries,
+		previous:     make(map[string]float64),
+	}, nil
+}
+
+// Run flushes the metrics every interval. onError is called with the errors of sending them.
+func (e *StatsdExporter) Run(interval time.Duration, onError func(err error)) {
+	for range time.Tick(interval) {
+		if err := e.Flush(); err != nil && onError != nil {
+			onError(err)
+		}
+	}
+}
+
+// Flush sends the current values of the metrics.
+func (e *StatsdExporter) Flush() error {
+	var packet bytes.Buffer
+	for _, line := range e.lines() {
+		if packet.Len() > 0 && packet.Len()+1+len(line) > statsdMaxPacketSize {
+			if _, err := e.conn.Write(packet.Bytes()); err != nil {
+				return err
+			}
+			packet.Reset()
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+	if packet.Len() == 0 {
+		return nil
+	}
+	_, err := e.conn.Write(packet.Bytes())
+	return err
+}
+
+// lines returns the statsd lines of the current values of the metrics. Counters which didn't change since the last flush are skipped.
+func (e *StatsdExporter) lines() []string {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	var lines []string
+	for _, r := range e.registries {
+		for _, p := range r.Collect() {
+			name, tags := e.nameAndTags(p)
+			switch p.Type {
+			case TypeCounter:
+				if delta := e.delta(name+tags, p.Value); delta != 0 {
+					lines = append(lines, e.line(name, delta, "c", tags))
+				}
+			case TypeHistogram:
+				if count := e.delta(name+".count"+tags, float64(p.Count)); count != 0 {
+					lines = append(lines, e.line(name+".count", count, "c", tags))
+					lines = append(lines, e.line(name+".sum", e.delta(name+".sum"+tags, p.Value), "c", tags))
+				}
+			default:
+				lines = append(lines, e.line(name, p.Value, "g", tags))
+			}
+		}
+	}
+	return lines
+}
+
+// delta returns the increase of the series key since the last flush. Decreases mean the process restarted counting, so the whole value is sent.
+func (e *StatsdExporter) delta(key string, value float64) float64 {
+	previous, ok := e.previous[key]
+	e.previous[key] = value
+	if !ok || value < previous {
+		return value
+	}
+	return value - previous
+}
+
+// nameAndTags returns the name of the metric of p, and its tags in the DogStatsD format ("|#a:b,c:d", or "" without tags).
+func (e *StatsdExporter) nameAndTags(p Point) (string, string) {
+	name := e.prefix + statsdEscaper.Replace(p.Name)
+	tags := append([]string(nil), e.tags...)
+	for i, label := range p.Labels {
+		value := statsdEscaper.Replace(p.LabelValues[i])
+		if e.labelsAsTags {
+			tags = append(tags, label+":"+value)
+		} else {
+			name += "." + value
+		}
+	}
+	if len(tags) == 0 {
+		return name, ""
+	}
+	return name, "|#" + strings.Join(tags, ",")
+}
+
+func (e *StatsdExporter) line(name string, value float64, typ, tags string) string {
+	return name + ":" + strconv.FormatFloat(value, 'f', -1, 64) + "|" + typ + tags
+}
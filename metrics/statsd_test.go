@@ -0,0 +1,114 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package metrics
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/uniqush/uniqush-push/testutil"
+)
+
+func TestStatsdExporter(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	read := func() string {
+		server.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, statsdMaxPacketSize)
+		n, _, err := server.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(buf[:n])
+	}
+
+	r := NewRegistry()
+	pushes := r.NewCounterVec("pushes_total", "Pushes by result.", "service", "result")
+	latency := r.NewHistogramVec("latency_seconds", "Latency.", []float64{0.1, 1}, "path")
+	r.NewGaugeFunc("queue", "Queue depth.", nil, func() []Sample {
+		return []Sample{{Value: 3}}
+	})
+	pushes.Add(2, "a|b", "success")
+	latency.Observe(0.5, "/push")
+	latency.Observe(0.25, "/push")
+
+	e, err := NewStatsdExporter(server.LocalAddr().String(), "uniqush.", []string{"env:test"}, true, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectStringEquals(t, strings.Join([]string{
+		"uniqush.pushes_total:2|c|#env:test,service:a_b,result:success",
+		"uniqush.latency_seconds.count:2|c|#env:test,path:/push",
+		"uniqush.latency_seconds.sum:0.75|c|#env:test,path:/push",
+		"uniqush.queue:3|g|#env:test",
+	}, "\n"), read(), "unexpected lines")
+
+	pushes.Inc("a|b", "success")
+	if err := e.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectStringEquals(t, "uniqush.pushes_total:1|c|#env:test,service:a_b,result:success\nuniqush.queue:3|g|#env:test", read(),
+		"expected the increase of counters since the last flush, and unchanged series to be skipped")
+}
+
+func TestStatsdExporterWithoutTags(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounterVec("pushes_total", "Pushes by result.", "service", "result").Inc("srv", "success")
+	e := &StatsdExporter{registries: []*Registry{r}, previous: make(map[string]float64)}
+	testutil.ExpectEquals(t, []string{"pushes_total.srv.success:1|c"}, e.lines(), "expected the label values to be appended to the name")
+}
+
+func TestStatsdExporterSplitsPackets(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	r := NewRegistry()
+	counter := r.NewCounterVec("a_long_metric_name_to_fill_packets_total", "", "label")
+	for i := 0; i < 100; i++ {
+		counter.Inc(strings.Repeat("x", i))
+	}
+	e, err := NewStatsdExporter(server.LocalAddr().String(), "", nil, false, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	lines := 0
+	buf := make([]byte, 65536)
+	for lines < 100 {
+		server.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := server.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("expected 100 lines, got %d: %v", lines, err)
+		}
+		if n > statsdMaxPacketSize {
+			t.Fatalf("expected packets of at most %d bytes, got %d", statsdMaxPacketSize, n)
+		}
+		lines += strings.Count(string(buf[:n]), "\n") + 1
+	}
+}
@@ -69,12 +69,22 @@ func NewInfof(f string, v ...interface{}) *InfoReport {
 type ErrorReport struct {
 	implementsPushError
 	msg string
+	// Err is the underlying error, if any.
+	Err error
 }
 
 func (e *ErrorReport) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%s: %v", e.msg, e.Err)
+	}
 	return e.msg
 }
 
+// Unwrap returns the underlying error, or nil.
+func (e *ErrorReport) Unwrap() error {
+	return e.Err
+}
+
 // NewError returns an ErrorReport for the given error message to be reported to the user (with a severity of 'error')
 func NewError(msg string) *ErrorReport {
 	return &ErrorReport{msg: msg}
@@ -85,6 +95,12 @@ func NewErrorf(f string, v ...interface{}) *ErrorReport {
 	return &ErrorReport{msg: fmt.Sprintf(f, v...)}
 }
 
+// WrapError returns an ErrorReport for err, which failed the operation described by msg, to be reported to the user (with a severity of 'error').
+// The message is "<msg>: <err>", and err can be checked with Unwrap (or errors.Is and errors.As, with go 1.13 or newer).
+func WrapError(msg string, err error) *ErrorReport {
+	return &ErrorReport{msg: msg, Err: err}
+}
+
 /*********************/
 
 // RetryError indicates to the user that the push attempt for the given delivery point should be re-attempted after the given duration (uniqush retries failed pushes for some push services with exponential backoff and a finite number of re-attempts).
@@ -104,6 +120,11 @@ func (e *RetryError) Error() string {
 	return fmt.Sprintf("Retry")
 }
 
+// Unwrap returns the reason of the retry, or nil.
+func (e *RetryError) Unwrap() error {
+	return e.Reason
+}
+
 // NewRetryErrorWithReason builds a RetryError with the associated error causing uniqush-push to retry the push after the given duration.
 func NewRetryErrorWithReason(psp *PushServiceProvider, dp *DeliveryPoint, notif *Notification, after time.Duration, reason error) *RetryError {
 	return &RetryError{
@@ -292,6 +313,11 @@ func (e *ConnectionError) Error() string {
 	return fmt.Sprintf("ConnectionError %v", e.Err)
 }
 
+// Unwrap returns the error of the connection.
+func (e *ConnectionError) Unwrap() error {
+	return e.Err
+}
+
 // NewConnectionError returns a new ConnectionError.
 func NewConnectionError(err error) *ConnectionError {
 	return &ConnectionError{Err: err}
@@ -0,0 +1,126 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package push
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+)
+
+// binaryPeerFormat is the first byte of push peers serialized with AppendBinary. JSON serializations start with '['.
+const binaryPeerFormat byte = 1
+
+var errInvalidBinaryPeer = errors.New("Invalid binary Push Peer")
+
+// peerBuffers are reused by WithBinary.
+var peerBuffers = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, 0, 512)
+		return &buf
+	},
+}
+
+// AppendBinary appends a compact binary serialization of the structure embedding this push peer to buf, in the format "<push service type>:<binary data>".
+// It can be unserialized the same way as Marshal's JSON. Marshal should still be used for API responses and exports.
+func (p *PushPeer) AppendBinary(buf []byte) []byte {
+	if p.pushServiceType == nil {
+		return buf
+	}
+	buf = append(buf, p.pushServiceType.Name()...)
+	buf = append(buf, ':', binaryPeerFormat)
+	buf = appendBinaryMap(buf, p.FixedData)
+	return appendBinaryMap(buf, p.VolatileData)
+}
+
+// WithBinary calls fn with the binary serialization of the structure embedding this push peer (see AppendBinary), without allocating a new buffer.
+// The buffer is reused after fn returns, so fn must not keep it.
+func (p *PushPeer) WithBinary(fn func(value []byte) error) error {
+	bufp := peerBuffers.Get().(*[]byte)
+	*bufp = p.AppendBinary((*bufp)[:0])
+	err := fn(*bufp)
+	peerBuffers.Put(bufp)
+	return err
+}
+
+func appendBinaryMap(buf []byte, m map[string]string) []byte {
+	buf = appendUvarint(buf, uint64(len(m)))
+	for k, v := range m {
+		buf = appendUvarint(buf, uint64(len(k)))
+		buf = append(buf, k...)
+		buf = appendUvarint(buf, uint64(len(v)))
+		buf = append(buf, v...)
+	}
+	return buf
+}
+
+func appendUvarint(buf []byte, n uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	return append(buf, tmp[:binary.PutUvarint(tmp[:], n)]...)
+}
+
+// unmarshalBinary unserializes the data written by AppendBinary after the push service type.
+func (p *PushPeer) unmarshalBinary(value []byte) error {
+	if len(value) == 0 || value[0] != binaryPeerFormat {
+		return errInvalidBinaryPeer
+	}
+	fixed, rest, err := readBinaryMap(value[1:])
+	if err != nil {
+		return err
+	}
+	volatile, rest, err := readBinaryMap(rest)
+	if err != nil {
+		return err
+	}
+	if len(rest) != 0 {
+		return errInvalidBinaryPeer
+	}
+	p.FixedData = fixed
+	p.VolatileData = volatile
+	return nil
+}
+
+func readBinaryMap(value []byte) (map[string]string, []byte, error) {
+	n, size := binary.Uvarint(value)
+	if size <= 0 || n > uint64(len(value)) {
+		return nil, nil, errInvalidBinaryPeer
+	}
+	value = value[size:]
+	m := make(map[string]string, n)
+	for i := uint64(0); i < n; i++ {
+		var k, v string
+		var err error
+		if k, value, err = readBinaryString(value); err != nil {
+			return nil, nil, err
+		}
+		if v, value, err = readBinaryString(value); err != nil {
+			return nil, nil, err
+		}
+		m[k] = v
+	}
+	return m, value, nil
+}
+
+func readBinaryString(value []byte) (string, []byte, error) {
+	n, size := binary.Uvarint(value)
+	if size <= 0 || n > uint64(len(value)-size) {
+		return "", nil, errInvalidBinaryPeer
+	}
+	end := size + int(n)
+	return string(value[size:end]), value[end:], nil
+}
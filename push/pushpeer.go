@@ -19,7 +19,10 @@
 package push
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/sha1"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -43,6 +46,11 @@ const (
 	// TODO: Allow clients to specify version ranges?
 	AppVersion = "app_version"
 	Locale     = "locale"
+	// LastSeen is the unix timestamp of the last time the app of a DP refreshed it with /refresh (e.g. when it was launched).
+	LastSeen = "last_seen"
+	// EncryptionKey is optional. It is the base64 encoded P-256 public key (uncompressed, 65 bytes) of the app,
+	// with which uniqush encrypts the content of pushes to the delivery point, so that push services can't read it.
+	EncryptionKey = "encryption_key"
 )
 
 // PushPeer implements common functionality for pushes. Other structs in this module include this struct.
@@ -119,10 +127,14 @@ func (p *PushPeer) Marshal() []byte {
 	return []byte(str)
 }
 
-// Unmarshal unserializes the structure embedding this push peer from JSON (which was retrieved from the database).
+// Unmarshal unserializes the structure embedding this push peer from JSON or from the binary format of AppendBinary (which was retrieved from the database).
 func (p *PushPeer) Unmarshal(value []byte) error {
 	//var f interface{}
 
+	if len(value) > 0 && value[0] == binaryPeerFormat {
+		return p.unmarshalBinary(value)
+	}
+
 	var f []map[string]string
 
 	err := json.Unmarshal(value, &f)
@@ -187,6 +199,12 @@ func (dp *DeliveryPoint) addVolatileData(kv map[string]string) error {
 		}
 		dp.VolatileData[SubscribeDate] = subscribeDate
 	}
+	if key, ok := kv[EncryptionKey]; ok && len(key) > 0 {
+		if _, err := ParseEncryptionKey(key); err != nil {
+			return err
+		}
+		dp.VolatileData[EncryptionKey] = key
+	}
 	// Add any volatile fields with no validation
 	for _, field := range []string{DeviceID, OldDeviceID, AppVersion, Locale} {
 		if value, ok := kv[field]; ok && len(value) > 0 {
@@ -196,6 +214,19 @@ func (dp *DeliveryPoint) addVolatileData(kv map[string]string) error {
 	return nil
 }
 
+// ParseEncryptionKey parses the EncryptionKey of a delivery point, in standard or URL-safe base64 with or without padding.
+func ParseEncryptionKey(key string) (*ecdsa.PublicKey, error) {
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(strings.NewReplacer("+", "-", "/", "_").Replace(key), "="))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid encryption_key, expected base64: %v", err)
+	}
+	x, y := elliptic.Unmarshal(elliptic.P256(), data)
+	if x == nil {
+		return nil, errors.New("Invalid encryption_key, expected an uncompressed P-256 public key")
+	}
+	return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+}
+
 // PushServiceProvider contains the data needed to send pushes to an external push notifications service provider (certificates, pushservicetype, server address, etc.).
 type PushServiceProvider struct { // nolint: golint
 	PushPeer
@@ -208,6 +239,17 @@ func NewEmptyPushServiceProvider() *PushServiceProvider {
 	return psp
 }
 
+// CloneWithData returns a copy of psp with the given fixed and volatile data, which keeps the name of psp
+// (e.g. to push with credentials fetched from a secrets backend, while results still refer to psp).
+func (psp *PushServiceProvider) CloneWithData(fixedData, volatileData map[string]string) *PushServiceProvider {
+	clone := NewEmptyPushServiceProvider()
+	clone.pushServiceType = psp.pushServiceType
+	clone.name = psp.Name()
+	clone.FixedData = fixedData
+	clone.VolatileData = volatileData
+	return clone
+}
+
 // IsSamePSP returns whether or not the name, FixedData, and VolatileData of two PSPs are identical.
 func IsSamePSP(a *PushServiceProvider, b *PushServiceProvider) bool {
 	if a.Name() != b.Name() {
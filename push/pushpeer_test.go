@@ -19,6 +19,7 @@ package push
 
 import (
 	"fmt"
+	"reflect"
 	"testing"
 )
 
@@ -138,3 +139,39 @@ func TestCompatability(t *testing.T) {
 		t.Errorf("Should be compatible, but %q != %q\n", serviceNamePSP, serviceNameDP)
 	}
 }
+
+func TestPushPeerBinary(t *testing.T) {
+	tpst := newTestPushServiceType()
+	psm := GetPushServiceManager()
+	psm.RegisterPushServiceType(tpst)
+
+	dp := NewEmptyDeliveryPoint()
+	dp.pushServiceType = tpst
+	dp.FixedData = map[string]string{"service": "testServiceName", "subscriber": "subscriber.1234", "regid": "fdsafas"}
+	dp.VolatileData = map[string]string{DeviceID: "device:1", AppVersion: ""}
+
+	value := dp.AppendBinary(nil)
+	if len(value) >= len(dp.Marshal()) {
+		t.Errorf("Expected the binary serialization (%d bytes) to be smaller than JSON (%d bytes)", len(value), len(dp.Marshal()))
+	}
+	for _, serialized := range [][]byte{value, dp.Marshal()} {
+		decoded, err := psm.BuildDeliveryPointFromBytes(serialized)
+		if err != nil {
+			t.Fatalf("BuildDeliveryPointFromBytes(%q) failed: %v", serialized, err)
+		}
+		if !reflect.DeepEqual(dp.FixedData, decoded.FixedData) || !reflect.DeepEqual(dp.VolatileData, decoded.VolatileData) {
+			t.Errorf("Expected %v and %v, got %v and %v", dp.FixedData, dp.VolatileData, decoded.FixedData, decoded.VolatileData)
+		}
+	}
+
+	if _, err := psm.BuildDeliveryPointFromBytes(value[:len(value)-1]); err == nil {
+		t.Errorf("Expected a truncated binary delivery point to be rejected")
+	}
+
+	allocs := testing.AllocsPerRun(100, func() {
+		dp.WithBinary(func(value []byte) error { return nil })
+	})
+	if allocs != 0 {
+		t.Errorf("Expected WithBinary not to allocate, got %v allocations", allocs)
+	}
+}
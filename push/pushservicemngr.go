@@ -18,9 +18,10 @@
 package push
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
-	"strings"
 	"sync"
 
 	"github.com/uniqush/goconf/conf"
@@ -109,20 +110,19 @@ func (m *PushServiceManager) BuildPushServiceProviderFromMap(kv map[string]strin
 
 // BuildPushServiceProviderFromBytes will unserialize the passed in push service name+JSON (e.g. "apns:{...}") into a push service provider, or return an error.
 func (m *PushServiceManager) BuildPushServiceProviderFromBytes(value []byte) (psp *PushServiceProvider, err error) {
-	s := string(value)
-	parts := strings.SplitN(s, ":", 2)
-	if len(parts) < 2 {
+	i := bytes.IndexByte(value, ':')
+	if i < 0 {
 		return nil, errors.New("BuildPushServiceProviderFromBytes: No Push Service Type Specified")
 	}
-	pushServiceType := parts[0]
-	pair, ok := m.serviceTypes[pushServiceType]
+	pushServiceType := value[:i]
+	pair, ok := m.serviceTypes[string(pushServiceType)]
 	if !ok {
-		return nil, fmt.Errorf("BuildPushServiceProviderFromBytes: Unknown Push Service Type: %v", pushServiceType)
+		return nil, fmt.Errorf("BuildPushServiceProviderFromBytes: Unknown Push Service Type: %s", pushServiceType)
 	}
 
 	psp = NewEmptyPushServiceProvider()
 	psp.pushServiceType = pair.pst
-	err = psp.Unmarshal([]byte(parts[1]))
+	err = psp.Unmarshal(value[i+1:])
 	if err != nil {
 		psp = nil
 		return
@@ -160,21 +160,20 @@ func (m *PushServiceManager) BuildDeliveryPointFromMap(kv map[string]string) (*D
 
 // BuildDeliveryPointFromBytes will unserialize the passed in push service name+JSON (e.g. "apns:{...}") into a delivery point, or return an error.
 func (m *PushServiceManager) BuildDeliveryPointFromBytes(value []byte) (*DeliveryPoint, error) {
-	s := string(value)
-	parts := strings.SplitN(s, ":", 2)
-	if len(parts) < 2 {
+	i := bytes.IndexByte(value, ':')
+	if i < 0 {
 		return nil, errors.New("BuildDeliveryPointFromBytes: No Push Service Type Specified")
 	}
-	pushServiceType := parts[0]
-	pair, ok := m.serviceTypes[pushServiceType]
+	pushServiceType := value[:i]
+	pair, ok := m.serviceTypes[string(pushServiceType)]
 	if !ok {
-		return nil, fmt.Errorf("BuildDeliveryPointFromBytes: Unknown Push Service Type: %v", pushServiceType)
+		return nil, fmt.Errorf("BuildDeliveryPointFromBytes: Unknown Push Service Type: %s", pushServiceType)
 	}
 
 	dp := NewEmptyDeliveryPoint()
 	pst := pair.pst
 	dp.pushServiceType = pst
-	err := dp.Unmarshal([]byte(parts[1]))
+	err := dp.Unmarshal(value[i+1:])
 	if err != nil {
 		return nil, err
 	}
@@ -183,16 +182,25 @@ func (m *PushServiceManager) BuildDeliveryPointFromBytes(value []byte) (*Deliver
 
 // Push will send a push to each delivery point received over the channel dpQueue, and send success/error responses over resQueue.
 func (m *PushServiceManager) Push(psp *PushServiceProvider, dpQueue <-chan *DeliveryPoint, resQueue chan<- *Result, notif *Notification) {
+	m.PushContext(context.Background(), psp, dpQueue, resQueue, notif)
+}
+
+// PushContext is like Push, but the requests to the push service are canceled when ctx is done, if the push service type is a ContextPusher.
+func (m *PushServiceManager) PushContext(ctx context.Context, psp *PushServiceProvider, dpQueue <-chan *DeliveryPoint, resQueue chan<- *Result, notif *Notification) {
 	wg := new(sync.WaitGroup)
 
 	if psp.pushServiceType != nil {
 		wg.Add(1)
 		go func() {
-			psp.pushServiceType.Push(psp, dpQueue, resQueue, notif)
+			if pusher, ok := psp.pushServiceType.(ContextPusher); ok {
+				pusher.PushContext(ctx, psp, dpQueue, resQueue, notif)
+			} else {
+				psp.pushServiceType.Push(psp, dpQueue, resQueue, notif)
+			}
 			wg.Done()
 		}()
 	} else {
-		r := new(Result)
+		r := NewResult()
 		r.Provider = psp
 		r.Destination = nil
 		r.MsgID = ""
@@ -204,6 +212,37 @@ func (m *PushServiceManager) Push(psp *PushServiceProvider, dpQueue <-chan *Deli
 	wg.Wait()
 }
 
+// VerifyDeliveryPoint will ask the push service of psp whether it still recognizes dp.
+// supported is false if the push service type can't look up delivery points.
+func (m *PushServiceManager) VerifyDeliveryPoint(psp *PushServiceProvider, dp *DeliveryPoint) (valid bool, supported bool, err error) {
+	verifier, ok := psp.pushServiceType.(DeliveryPointVerifier)
+	if !ok {
+		return false, false, nil
+	}
+	valid, err = verifier.VerifyDeliveryPoint(psp, dp)
+	return valid, true, err
+}
+
+// ValidateCredentials will ask the push service of psp whether it accepts the credentials of psp.
+// supported is false if the push service type can't check credentials.
+func (m *PushServiceManager) ValidateCredentials(psp *PushServiceProvider) (supported bool, err error) {
+	validator, ok := psp.pushServiceType.(CredentialValidator)
+	if !ok {
+		return false, nil
+	}
+	return true, validator.ValidateCredentials(psp)
+}
+
+// RefreshToken will set the token which dp is pushed to, without changing the name of dp.
+// supported is false if the push service type of dp can't change the tokens of delivery points.
+func (m *PushServiceManager) RefreshToken(dp *DeliveryPoint, token string) (supported bool, err error) {
+	refresher, ok := dp.pushServiceType.(TokenRefresher)
+	if !ok {
+		return false, nil
+	}
+	return true, refresher.RefreshToken(dp, token)
+}
+
 // Preview will return the bytes of the serialized payload that will be sent to an external service for the given uniqush API parameters in 'notif' (adding placeholders where needed).
 func (m *PushServiceManager) Preview(pushServiceType string, notif *Notification) ([]byte, Error) {
 	if pst, ok := m.serviceTypes[pushServiceType]; ok && pst != nil {
@@ -230,6 +269,17 @@ func (m *PushServiceManager) SetConfigFile(c *conf.ConfigFile) {
 	}
 }
 
+// ReloadConfigFile applies the settings of a reloaded config file which can change without restarting to the push service types implementing ConfigReloader.
+// Other settings (e.g. the pool_size of APNs) keep the values they had when the push service types were registered.
+func (m *PushServiceManager) ReloadConfigFile(c *conf.ConfigFile) {
+	m.configFile = c
+	for _, t := range m.serviceTypes {
+		if reloader, ok := t.pst.(ConfigReloader); ok {
+			reloader.ReloadPushServiceConfig(NewPushServiceConfig(c, t.pst.Name()))
+		}
+	}
+}
+
 // Finalize will finalize each of the push service types before shutting down.
 func (m *PushServiceManager) Finalize() {
 	// TODO: Could use a WaitGroup to do this in parallel, but that isn't high priority.
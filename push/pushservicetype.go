@@ -17,7 +17,11 @@
 
 package push
 
-import "fmt"
+import (
+	"context"
+	"fmt"
+	"sync"
+)
 
 // Result is an abstraction of the result of a request to push to an external service.
 type Result struct {
@@ -28,6 +32,24 @@ type Result struct {
 	Err         Error
 }
 
+// results reuses the results of pushes, since one is sent for every delivery point pushed to.
+var results = sync.Pool{
+	New: func() interface{} {
+		return new(Result)
+	},
+}
+
+// NewResult returns an empty result, reusing one which was released if possible.
+func NewResult() *Result {
+	return results.Get().(*Result)
+}
+
+// Release returns the result to be reused by NewResult. The result must not be used after it is released.
+func (r *Result) Release() {
+	*r = Result{}
+	results.Put(r)
+}
+
 // IsError returns true if the result of the push attempt was an error.
 func (r *Result) IsError() bool {
 	return r.Err != nil
@@ -88,3 +110,37 @@ type PushServiceType interface { // nolint: golint
 	// Finalize will release any resources (e.g. network connections) used by this push service type. It is called on shutdown
 	Finalize()
 }
+
+// DeliveryPointVerifier is implemented by push service types which can ask the push service whether it still recognizes a delivery point.
+// APNs has no such API, but GCM and FCM can look up registration ids with the Instance ID API.
+type DeliveryPointVerifier interface {
+	// VerifyDeliveryPoint returns false if the push service no longer recognizes the delivery point (e.g. the app was uninstalled).
+	VerifyDeliveryPoint(psp *PushServiceProvider, dp *DeliveryPoint) (bool, error)
+}
+
+// ConfigReloader is implemented by push service types which can apply changes to their section of the config file (e.g. push_workers) without restarting.
+type ConfigReloader interface {
+	// ReloadPushServiceConfig applies the settings of the reloaded config file which can change while pushes are sent.
+	ReloadPushServiceConfig(c *PushServiceConfig)
+}
+
+// CredentialValidator is implemented by push service types which can check the credentials of a push service provider with the push service
+// (e.g. with a dry run push), so that invalid credentials are rejected when the push service provider is added, rather than failing every push.
+type CredentialValidator interface {
+	// ValidateCredentials returns an error describing why the push service rejected the credentials of psp.
+	ValidateCredentials(psp *PushServiceProvider) error
+}
+
+// TokenRefresher is implemented by push service types whose delivery points can be given a new token (e.g. after the push service rotated it)
+// without changing the name of the delivery point, like the canonical registration ids of GCM and FCM.
+type TokenRefresher interface {
+	// RefreshToken sets the token which dp is pushed to, returning an error if the token isn't valid.
+	RefreshToken(dp *DeliveryPoint, token string) error
+}
+
+// ContextPusher is implemented by push service types whose requests to the push service can be canceled.
+type ContextPusher interface {
+	// PushContext is like Push, but stops sending requests (and cancels the ones in flight) when ctx is done.
+	// The delivery points which weren't sent get a result with an error, like the ones whose requests failed.
+	PushContext(ctx context.Context, psp *PushServiceProvider, dpQueue <-chan *DeliveryPoint, resQueue chan<- *Result, notif *Notification)
+}
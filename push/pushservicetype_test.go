@@ -0,0 +1,41 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package push
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestReleasedResultsAreReusedEmpty(t *testing.T) {
+	for i := 0; i < 10; i++ {
+		r := NewResult()
+		if !reflect.DeepEqual(Result{}, *r) {
+			t.Fatalf("Expected a new result to be empty, got %+v", *r)
+		}
+		r.Provider = &PushServiceProvider{}
+		r.Destination = &DeliveryPoint{}
+		r.Content = NewEmptyNotification()
+		r.MsgID = "msgid"
+		r.Err = NewError("error")
+		r.Release()
+		if !reflect.DeepEqual(Result{}, *r) {
+			t.Errorf("Expected a released result to be cleared, got %+v", *r)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package push
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/uniqush/uniqush-push/metrics"
+)
+
+// requestDuration tells apart slow push services from pushes queued in uniqush-push: it only measures the HTTP requests,
+// and the endpoint label tells apart the hosts of a push service (e.g. the production and development APNs endpoints).
+var requestDuration = metrics.DefaultRegistry.NewHistogramVec("uniqush_push_service_request_duration_seconds",
+	"Round-trip latency of HTTP requests to push services, by push service type, endpoint host and status code (or error).",
+	metrics.DefaultBuckets, "pushservicetype", "endpoint", "status")
+
+// ObserveRequest records the round-trip latency of an HTTP request to a push service which was sent at start.
+// resp and err are the results of http.Client.Do.
+func ObserveRequest(pushServiceType string, req *http.Request, start time.Time, resp *http.Response, err error) {
+	ObserveRequestTo(pushServiceType, req.URL.Host, start, resp, err)
+}
+
+// ObserveRequestTo is ObserveRequest with the endpoint label given, for push services whose hosts are chosen by their users
+// (e.g. the webhooks of chat), so that the number of label values stays bounded and the hosts aren't exported.
+func ObserveRequestTo(pushServiceType, endpoint string, start time.Time, resp *http.Response, err error) {
+	status := "error"
+	if err == nil && resp != nil {
+		status = strconv.Itoa(resp.StatusCode)
+	}
+	requestDuration.Observe(time.Since(start).Seconds(), pushServiceType, endpoint, status)
+}
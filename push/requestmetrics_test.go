@@ -0,0 +1,45 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package push
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/uniqush/uniqush-push/metrics"
+)
+
+func TestObserveRequest(t *testing.T) {
+	req, _ := http.NewRequest("POST", "https://api.development.push.apple.com/3/device/abc", nil)
+	ObserveRequest("testpushservice", req, time.Now(), &http.Response{StatusCode: 410}, nil)
+	ObserveRequest("testpushservice", req, time.Now(), nil, errors.New("timeout"))
+
+	var buf bytes.Buffer
+	metrics.DefaultRegistry.Write(&buf)
+	for _, expected := range []string{
+		`uniqush_push_service_request_duration_seconds_count{pushservicetype="testpushservice",endpoint="api.development.push.apple.com",status="410"} 1`,
+		`uniqush_push_service_request_duration_seconds_count{pushservicetype="testpushservice",endpoint="api.development.push.apple.com",status="error"} 1`,
+	} {
+		if !strings.Contains(buf.String(), expected) {
+			t.Errorf("expected %q in the metrics, got:\n%s", expected, buf.String())
+		}
+	}
+}
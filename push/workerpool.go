@@ -0,0 +1,122 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package push
+
+import "sync"
+
+// DefaultPushWorkers is the number of pushes to individual delivery points a push service type sends at once, unless push_workers is set in its section of the config file.
+const DefaultPushWorkers = 100
+
+// WorkerPool runs tasks on a number of goroutines, so that pushing to many delivery points doesn't start a goroutine for each of them.
+// The workers are started when the first task is run, and can be added or retired with Resize. A nil WorkerPool runs each task on a new goroutine.
+type WorkerPool struct {
+	mutex   sync.Mutex
+	size    int
+	running int
+	started bool
+	tasks   chan func()
+	// retire stops a worker once it finishes its task, when the pool is made smaller.
+	retire chan struct{}
+}
+
+// NewWorkerPool returns a pool of size workers, or of DefaultPushWorkers workers if size isn't positive.
+func NewWorkerPool(size int) *WorkerPool {
+	if size <= 0 {
+		size = DefaultPushWorkers
+	}
+	return &WorkerPool{
+		size:   size,
+		tasks:  make(chan func()),
+		retire: make(chan struct{}),
+	}
+}
+
+// PushWorkersFromConfig returns push_workers of the push service's section of the config file, or DefaultPushWorkers if it isn't set.
+func PushWorkersFromConfig(c *PushServiceConfig) int {
+	workers, err := c.GetInt("push_workers")
+	if err != nil || workers <= 0 {
+		workers = DefaultPushWorkers
+	}
+	return workers
+}
+
+// NewWorkerPoolFromConfig returns a pool with the number of workers in push_workers of the push service's section of the config file.
+func NewWorkerPoolFromConfig(c *PushServiceConfig) *WorkerPool {
+	return NewWorkerPool(PushWorkersFromConfig(c))
+}
+
+// Go runs task on one of the workers, waiting until one of them is free. Tasks must not call Go on the same pool.
+func (p *WorkerPool) Go(task func()) {
+	if p == nil {
+		go task()
+		return
+	}
+	p.mutex.Lock()
+	if !p.started {
+		p.started = true
+		p.startWorkers()
+	}
+	p.mutex.Unlock()
+	p.tasks <- task
+}
+
+// Resize changes the number of workers (to DefaultPushWorkers if size isn't positive), e.g. when the config file is reloaded.
+// Workers which are retired finish their current task first.
+func (p *WorkerPool) Resize(size int) {
+	if p == nil {
+		return
+	}
+	if size <= 0 {
+		size = DefaultPushWorkers
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.size = size
+	if !p.started {
+		return
+	}
+	p.startWorkers()
+	for ; p.running > p.size; p.running-- {
+		go func() { p.retire <- struct{}{} }()
+	}
+}
+
+// Size returns the number of workers of the pool.
+func (p *WorkerPool) Size() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.size
+}
+
+// startWorkers starts workers until there are size of them. The mutex must be held.
+func (p *WorkerPool) startWorkers() {
+	for ; p.running < p.size; p.running++ {
+		go p.work()
+	}
+}
+
+func (p *WorkerPool) work() {
+	for {
+		select {
+		case task := <-p.tasks:
+			task()
+		case <-p.retire:
+			return
+		}
+	}
+}
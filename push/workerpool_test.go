@@ -0,0 +1,89 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package push
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestWorkerPoolLimitsConcurrentTasks(t *testing.T) {
+	const size = 3
+	pool := NewWorkerPool(size)
+	var running, maxRunning int32
+	release := make(chan struct{})
+	wg := new(sync.WaitGroup)
+	wg.Add(10)
+	go func() {
+		for i := 0; i < 10; i++ {
+			pool.Go(func() {
+				defer wg.Done()
+				n := atomic.AddInt32(&running, 1)
+				for {
+					max := atomic.LoadInt32(&maxRunning)
+					if n <= max || atomic.CompareAndSwapInt32(&maxRunning, max, n) {
+						break
+					}
+				}
+				<-release
+				atomic.AddInt32(&running, -1)
+			})
+		}
+	}()
+	for i := 0; i < 10; i++ {
+		release <- struct{}{}
+	}
+	wg.Wait()
+	if maxRunning > size {
+		t.Errorf("Expected at most %d tasks to run at once, got %d", size, maxRunning)
+	}
+}
+
+func TestNilWorkerPoolRunsTasks(t *testing.T) {
+	var pool *WorkerPool
+	done := make(chan struct{})
+	pool.Go(func() { close(done) })
+	<-done
+}
+
+func TestWorkerPoolResize(t *testing.T) {
+	pool := NewWorkerPool(1)
+	started := make(chan struct{})
+	release := make(chan struct{})
+	task := func() {
+		started <- struct{}{}
+		<-release
+	}
+	pool.Go(task)
+	<-started
+	pool.Resize(3)
+	if pool.Size() != 3 {
+		t.Errorf("Expected 3 workers, got %d", pool.Size())
+	}
+	// With one worker, these would wait for the first task to finish.
+	go pool.Go(task)
+	go pool.Go(task)
+	<-started
+	<-started
+	close(release)
+	pool.Resize(0)
+	if pool.Size() != DefaultPushWorkers {
+		t.Errorf("Expected %d workers, got %d", DefaultPushWorkers, pool.Size())
+	}
+}
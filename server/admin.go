@@ -0,0 +1,286 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/uniqush/log"
+)
+
+// AdminConfig is a representation of the settings in the [Admin] section of uniqush.conf.
+type AdminConfig struct {
+	// Addr is the address of the admin listener, which is separate from the API so that it can be kept private. The admin listener is disabled if Addr is "".
+	Addr string
+	// Token must be sent in the "Authorization: Bearer <token>" header of every request to the admin listener.
+	Token string
+	// Profiling serves the CPU, heap and other profiles of net/http/pprof under /debug/pprof/ on the admin listener.
+	Profiling bool
+	// TLS serves the admin listener over TLS (and requires client certificates if TLS.ClientCAFile is set).
+	// TLS.ClientScopes are the roles granted to client certificates by subject alternative name, instead of a bearer token.
+	TLS TLSConfig
+	// OIDC accepts the JWTs of an OpenID Connect issuer as bearer tokens as well as Token, with roles mapped from their claims.
+	OIDC OIDCConfig
+	// SessionTokenTTL is the longest lifetime of the session tokens exchanged for Token or a JWT at /sessiontoken. 0 disables session tokens.
+	SessionTokenTTL time.Duration
+}
+
+// adminAuthHandler rejects requests which don't have the admin token or, if oidc isn't nil, a valid JWT with a role allowing the request,
+// or, if sessions isn't nil, a session token with a role allowing the request.
+// Requests without a bearer token are authorized with the role of the SANs of their client certificate, if clientCerts isn't nil.
+type adminAuthHandler struct {
+	token       []byte
+	oidc        *oidcVerifier
+	sessions    *adminSessions
+	clientCerts *clientCertIdentities
+	handler     http.Handler
+}
+
+// newAdminHandler returns the handler of the admin listener, which changes the levels of loggers with /loglevel and samples debug logs with /logsampling,
+// samples the payloads of services with /payloads (if captures isn't nil), reports the usage of API keys with /usage (if usage isn't nil),
+// and manages API keys with /apikeys, /createapikey, /rotateapikey and /revokeapikey, and tenants with /tenants, /settenant and /rmtenant (if apiKeys isn't nil).
+// streams the delivery and engagement events with /events (if tail isn't nil), reloads the config file with /reload (if reloader isn't nil),
+// /sessiontoken is served by adminAuthHandler, since it depends on the credential of the request.
+// The pprof handlers are registered on their own mux, since importing net/http/pprof registers them on http.DefaultServeMux as well.
+func newAdminHandler(conf AdminConfig, loggers []log.Logger, captures *payloadCapture, usage *usageMeter, apiKeys *apiKeyStore, tail *eventTail, reloader *configReloader, listeners *listenerSet, maintenance *maintenanceMode, features *featureFlags) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/loglevel", func(w http.ResponseWriter, r *http.Request) {
+		setLogLevel(w, r, loggers, logControl)
+	})
+	mux.HandleFunc(LogSamplingURL, func(w http.ResponseWriter, r *http.Request) {
+		serveLogSampling(w, r, logControl)
+	})
+	if captures != nil {
+		mux.HandleFunc("/payloads", func(w http.ResponseWriter, r *http.Request) {
+			servePayloads(w, r, captures)
+		})
+	}
+	if usage != nil {
+		mux.HandleFunc("/usage", func(w http.ResponseWriter, r *http.Request) {
+			serveUsage(w, r, usage)
+		})
+	}
+	if apiKeys != nil {
+		for _, path := range []string{QueryAPIKeysURL, CreateAPIKeyURL, RotateAPIKeyURL, RevokeAPIKeyURL} {
+			mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+				serveAPIKeys(w, r, apiKeys, r.RemoteAddr)
+			})
+		}
+		for _, path := range []string{QueryTenantsURL, SetTenantURL, RemoveTenantURL} {
+			mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+				serveTenants(w, r, apiKeys.tenants, r.RemoteAddr)
+			})
+		}
+	}
+	if tail != nil {
+		mux.HandleFunc(QueryEventsURL, tail.serveEvents)
+	}
+	if reloader != nil {
+		mux.HandleFunc(ReloadConfigURL, reloader.serveReload)
+	}
+	if listeners != nil {
+		for _, path := range []string{QueryListenersURL, AddListenerURL, RemoveListenerURL} {
+			mux.HandleFunc(path, listeners.serveListeners)
+		}
+	}
+	if maintenance != nil {
+		for _, path := range []string{QueryMaintenanceURL, EnableMaintenanceURL, DisableMaintenanceURL} {
+			mux.HandleFunc(path, maintenance.serveMaintenance)
+		}
+	}
+	if features != nil {
+		mux.HandleFunc(QueryFeatureFlagsURL, features.serveFeatureFlags)
+		mux.HandleFunc(SetFeatureFlagURL, features.serveFeatureFlags)
+	}
+	if conf.Profiling {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+	return &adminAuthHandler{token: []byte(conf.Token), oidc: newOIDCVerifier(conf.OIDC), sessions: newAdminSessions(conf), clientCerts: newClientCertIdentities(conf.TLS), handler: mux}
+}
+
+// setLogLevel sets the level of the logger named by the logger parameter (a section of uniqush.conf, e.g. Push, in any case), or of every logger if it is empty.
+// The level lasts until uniqush-push is restarted or the config file is reloaded.
+// logger=sender:<push service type> (e.g. sender:apns) sets the level of the log lines about the push service providers of that type in every logger,
+// for duration seconds if set, until level=reset. GET lists the levels.
+func setLogLevel(w http.ResponseWriter, r *http.Request, loggers []log.Logger, controls *logControls) {
+	if r.Method == "GET" {
+		serveLogLevels(w, loggers, controls)
+		return
+	}
+	name := r.FormValue("logger")
+	if alias, ok := loggerAliases[strings.ToLower(name)]; ok {
+		name = alias
+	}
+	if strings.HasPrefix(name, logSenderPrefix) {
+		setPushServiceTypeLogLevel(w, r, strings.TrimPrefix(name, logSenderPrefix), controls)
+		return
+	}
+	level, warningMsg := extractLogLevel(r.FormValue("level"))
+	if warningMsg != "" {
+		http.Error(w, warningMsg, http.StatusBadRequest)
+		return
+	}
+	n := 0
+	for i, section := range loggerSections {
+		if name == "" || strings.EqualFold(name, section) {
+			loggers[i].SetLogLevel(level)
+			n++
+		}
+	}
+	if n == 0 {
+		http.Error(w, fmt.Sprintf("Unknown logger %q", name), http.StatusNotFound)
+		return
+	}
+	fmt.Fprintf(w, "Set the level of %d loggers to %s\n", n, r.FormValue("level"))
+}
+
+func setPushServiceTypeLogLevel(w http.ResponseWriter, r *http.Request, pushServiceType string, controls *logControls) {
+	if pushServiceType == "" {
+		http.Error(w, "The push service type of sender: is required", http.StatusBadRequest)
+		return
+	}
+	if r.FormValue("level") == logLevelReset {
+		if !controls.RemoveOverride(pushServiceType) {
+			http.Error(w, fmt.Sprintf("No level is set for %s%s", logSenderPrefix, pushServiceType), http.StatusNotFound)
+			return
+		}
+		fmt.Fprintf(w, "Reset the level of %s%s\n", logSenderPrefix, pushServiceType)
+		return
+	}
+	level, warningMsg := extractLogLevel(r.FormValue("level"))
+	if warningMsg != "" {
+		http.Error(w, warningMsg, http.StatusBadRequest)
+		return
+	}
+	var duration time.Duration
+	if s := r.FormValue("duration"); s != "" {
+		seconds, err := strconv.Atoi(s)
+		if err != nil || seconds <= 0 {
+			http.Error(w, fmt.Sprintf("Invalid duration %q: must be a positive number of seconds", s), http.StatusBadRequest)
+			return
+		}
+		duration = time.Duration(seconds) * time.Second
+	}
+	controls.SetOverride(pushServiceType, level, duration)
+	fmt.Fprintf(w, "Set the level of %s%s to %s\n", logSenderPrefix, pushServiceType, r.FormValue("level"))
+}
+
+func (h *adminAuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	const prefix = "Bearer "
+	auth := r.Header.Get("Authorization")
+	var cred adminCredential
+	var err error
+	if strings.HasPrefix(auth, prefix) {
+		cred, err = h.authenticate(auth[len(prefix):])
+	} else if cred = h.clientCerts.adminCredential(r); cred.role == "" {
+		err = errAdminUnauthorized
+	}
+	if err == errAdminUnauthorized {
+		h.unauthorized(w, "Unauthorized")
+		return
+	}
+	if err != nil {
+		h.unauthorized(w, fmt.Sprintf("Unauthorized: %v", err))
+		return
+	}
+	if r.URL.Path == AdminSessionTokenURL && h.sessions != nil {
+		// Session tokens can't be renewed with session tokens, so that they stop working after the lifetime of the credential.
+		if cred.isSession {
+			http.Error(w, "Forbidden: session tokens must be requested with the admin token, a JWT or a client certificate", http.StatusForbidden)
+			return
+		}
+		h.sessions.serveSessionToken(w, r, cred)
+		return
+	}
+	if !adminRoleAllows(cred.role, r) {
+		http.Error(w, fmt.Sprintf("Forbidden: the role %s of %s doesn't allow %s %s", cred.role, cred.subject, r.Method, r.URL.Path), http.StatusForbidden)
+		return
+	}
+	h.handler.ServeHTTP(w, r)
+}
+
+// errAdminUnauthorized is returned by authenticate for tokens which aren't recognized, without further details.
+var errAdminUnauthorized = errors.New("Unauthorized")
+
+// adminCredential is the identity authenticated by a request to the admin listener.
+type adminCredential struct {
+	subject string
+	role    string
+	// isSession is true for session tokens.
+	isSession bool
+	// expires is when the credential stops being valid (the exp of a JWT or the NotAfter of a client certificate), or zero for the admin token.
+	expires time.Time
+}
+
+// authenticate returns the credential of the admin token, a JWT or a session token.
+func (h *adminAuthHandler) authenticate(token string) (adminCredential, error) {
+	if len(h.token) > 0 && subtle.ConstantTimeCompare([]byte(token), h.token) == 1 {
+		return adminCredential{subject: adminTokenSubject, role: APIKeyScopeAdmin}, nil
+	}
+	if h.sessions != nil && strings.HasPrefix(token, adminSessionTokenPrefix) {
+		claims, err := h.sessions.Verify(token)
+		if err != nil {
+			return adminCredential{isSession: true}, err
+		}
+		return adminCredential{subject: claims.Subject, role: claims.Role, isSession: true, expires: time.Unix(claims.ExpiresAt, 0)}, nil
+	}
+	if h.oidc == nil {
+		return adminCredential{}, errAdminUnauthorized
+	}
+	subject, role, expires, err := h.oidc.Verify(token)
+	return adminCredential{subject: subject, role: role, expires: expires}, err
+}
+
+func (h *adminAuthHandler) unauthorized(w http.ResponseWriter, msg string) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="uniqush-push admin"`)
+	http.Error(w, msg, http.StatusUnauthorized)
+}
+
+// runAdmin serves admin requests on conf.Addr. Failing to listen is logged rather than fatal, since the API still works without it.
+func runAdmin(conf AdminConfig, loggers []log.Logger, captures *payloadCapture, usage *usageMeter, apiKeys *apiKeyStore, tail *eventTail, reloader *configReloader, listeners *listenerSet, maintenance *maintenanceMode, features *featureFlags) {
+	logger := loggers[LoggerWeb]
+	logger.Infof("[Admin] %s Profiling=%v TLS=%v ClientCertificates=%v OIDCIssuer=%q", conf.Addr, conf.Profiling, conf.TLS.Enabled(), conf.TLS.ClientCAFile != "", conf.OIDC.Issuer)
+	if conf.SessionTokenTTL > 0 && conf.Token == "" {
+		logger.Warnf("[Admin] Without a token, session tokens are signed with a random key and are only valid on this instance until it restarts. Set token, or session_token_ttl=0 to disable them")
+	}
+	tlsConfig, err := newServerTLSConfig(conf.TLS, logger)
+	if err != nil {
+		logger.Errorf("AdminServerError \"%v\"", err)
+		return
+	}
+	server := &http.Server{Addr: conf.Addr, Handler: newAdminHandler(conf, loggers, captures, usage, apiKeys, tail, reloader, listeners, maintenance, features), TLSConfig: tlsConfig}
+	if tlsConfig != nil {
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err != nil {
+		logger.Errorf("AdminServerError \"%v\"", err)
+	}
+}
@@ -0,0 +1,161 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/uniqush/log"
+	"github.com/uniqush/uniqush-push/testutil"
+)
+
+func TestAdminHandlerRequiresToken(t *testing.T) {
+	handler := newAdminHandler(AdminConfig{Addr: "localhost:0", Token: "secret", Profiling: true}, nil, nil, nil, nil, nil, nil, nil, nil, nil)
+	get := func(path, auth string) int {
+		req := httptest.NewRequest("GET", path, nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+	testutil.ExpectEquals(t, http.StatusUnauthorized, get("/debug/pprof/", ""), "expected requests without a token to be rejected")
+	testutil.ExpectEquals(t, http.StatusUnauthorized, get("/debug/pprof/", "Bearer wrong"), "expected requests with the wrong token to be rejected")
+	testutil.ExpectEquals(t, http.StatusOK, get("/debug/pprof/", "Bearer secret"), "expected the profiles to be listed")
+	testutil.ExpectEquals(t, http.StatusOK, get("/debug/pprof/heap", "Bearer secret"), "expected the heap profile")
+}
+
+func TestAdminHandlerClientCertRoles(t *testing.T) {
+	conf := AdminConfig{Addr: "localhost:0", Profiling: true, TLS: TLSConfig{ClientScopes: map[string][]string{
+		"*.ops.example.org":  {APIKeyScopeViewer},
+		"deploy.example.org": {APIKeyScopeOperator, APIKeyScopeViewer},
+	}}}
+	handler := newAdminHandler(conf, nil, nil, nil, nil, nil, nil, nil, nil, nil)
+	get := func(method, path string, names ...string) int {
+		req := httptest.NewRequest(method, path, nil)
+		if names != nil {
+			req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{DNSNames: names}}}}
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+	testutil.ExpectEquals(t, http.StatusUnauthorized, get("GET", "/loglevel"), "expected requests without a certificate to be rejected")
+	testutil.ExpectEquals(t, http.StatusUnauthorized, get("GET", "/loglevel", "unknown.example.org"), "expected certificates without a role to be rejected")
+	testutil.ExpectEquals(t, http.StatusOK, get("GET", "/loglevel", "app.ops.example.org"), "expected viewers to read the log levels")
+	testutil.ExpectEquals(t, http.StatusForbidden, get("POST", "/loglevel", "app.ops.example.org"), "expected viewers not to set the log levels")
+	testutil.ExpectEquals(t, http.StatusForbidden, get("GET", "/debug/pprof/", "app.ops.example.org"), "expected viewers not to capture profiles")
+	testutil.ExpectEquals(t, http.StatusOK, get("GET", "/debug/pprof/", "deploy.example.org"), "expected the highest role of the certificate")
+}
+
+func TestAdminHandlerProfilingOff(t *testing.T) {
+	handler := newAdminHandler(AdminConfig{Addr: "localhost:0", Token: "secret"}, nil, nil, nil, nil, nil, nil, nil, nil, nil)
+	req := httptest.NewRequest("GET", "/debug/pprof/", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	testutil.ExpectEquals(t, http.StatusNotFound, w.Code, "expected profiles not to be served unless pprof=on")
+}
+
+func TestAdminHandlerSetsLogLevel(t *testing.T) {
+	loggers := make([]log.Logger, NumberOfLoggers)
+	for i := range loggers {
+		loggers[i] = newJSONLogger(ioutil.Discard, loggerSections[i], log.LOGLEVEL_INFO)
+	}
+	handler := newAdminHandler(AdminConfig{Addr: "localhost:0", Token: "secret"}, loggers, nil, nil, nil, nil, nil, nil, nil, nil)
+	post := func(query string) int {
+		req := httptest.NewRequest("POST", "/loglevel?"+query, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+	testutil.ExpectEquals(t, http.StatusOK, post("logger=Push&level=debug"), "expected the level to be set")
+	testutil.ExpectEquals(t, int32(log.LOGLEVEL_DEBUG), loggers[LoggerPush].(*jsonLogger).level, "expected the push logger to log debug messages")
+	testutil.ExpectEquals(t, int32(log.LOGLEVEL_INFO), loggers[LoggerWeb].(*jsonLogger).level, "expected other loggers to be unchanged")
+
+	testutil.ExpectEquals(t, http.StatusBadRequest, post("logger=Push&level=loud"), "expected unknown levels to be rejected")
+	testutil.ExpectEquals(t, http.StatusNotFound, post("logger=Nope&level=debug"), "expected unknown loggers to be rejected")
+}
+
+func TestAdminSessionTokens(t *testing.T) {
+	handler := newAdminHandler(AdminConfig{Addr: "localhost:0", Token: "secret", Profiling: true, SessionTokenTTL: time.Hour}, nil, nil, nil, nil, nil, nil, nil, nil, nil).(*adminAuthHandler)
+	now := time.Unix(1500000000, 0)
+	handler.sessions.now = func() time.Time { return now }
+	request := func(method, path, auth string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", "Bearer "+auth)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+	issue := func(query, auth string) (int, string) {
+		w := request("POST", AdminSessionTokenURL+"?"+query, auth)
+		var resp struct {
+			Token     string `json:"token"`
+			Role      string `json:"role"`
+			ExpiresAt int64  `json:"exp"`
+		}
+		if w.Code == http.StatusOK {
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			testutil.ExpectEquals(t, now.Add(10*time.Minute).Unix(), resp.ExpiresAt, "expected the token to expire after ttl")
+		}
+		return w.Code, resp.Token
+	}
+
+	code, _ := issue("ttl=600", "wrong")
+	testutil.ExpectEquals(t, http.StatusUnauthorized, code, "expected session tokens to require a credential")
+	code, _ = issue("ttl=7200", "secret")
+	testutil.ExpectEquals(t, http.StatusBadRequest, code, "expected ttl to be limited by session_token_ttl")
+	code, admin := issue("ttl=600", "secret")
+	testutil.ExpectEquals(t, http.StatusOK, code, "expected the admin token to be exchanged for a session token")
+	testutil.ExpectEquals(t, http.StatusOK, request("GET", "/debug/pprof/", admin).Code, "expected the session token to be accepted")
+	code, _ = issue("ttl=600", admin)
+	testutil.ExpectEquals(t, http.StatusForbidden, code, "expected session tokens not to be renewed with session tokens")
+
+	code, viewer := issue("ttl=600&role=viewer", "secret")
+	testutil.ExpectEquals(t, http.StatusOK, code, "expected a session token with a lower role")
+	testutil.ExpectEquals(t, http.StatusForbidden, request("GET", "/debug/pprof/", viewer).Code, "expected the role of the session token to be enforced")
+
+	testutil.ExpectEquals(t, http.StatusUnauthorized, request("GET", "/debug/pprof/", admin+"x").Code, "expected tampered session tokens to be rejected")
+	now = now.Add(10 * time.Minute)
+	testutil.ExpectEquals(t, http.StatusUnauthorized, request("GET", "/debug/pprof/", admin).Code, "expected expired session tokens to be rejected")
+	other := newAdminHandler(AdminConfig{Addr: "localhost:0", Token: "rotated", Profiling: true, SessionTokenTTL: time.Hour}, nil, nil, nil, nil, nil, nil, nil, nil, nil)
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/debug/pprof/", nil)
+	req.Header.Set("Authorization", "Bearer "+viewer)
+	other.ServeHTTP(w, req)
+	testutil.ExpectEquals(t, http.StatusUnauthorized, w.Code, "expected changing the admin token to revoke session tokens")
+}
+
+func TestAdminSessionTokensDontOutliveCredential(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	sessions := newAdminSessions(AdminConfig{Token: "secret", SessionTokenTTL: time.Hour})
+	sessions.now = func() time.Time { return now }
+	issue := func(query string, expires time.Time) (int, int64) {
+		w := httptest.NewRecorder()
+		sessions.serveSessionToken(w, httptest.NewRequest("POST", AdminSessionTokenURL+"?"+query, nil), adminCredential{subject: "alice", role: APIKeyScopeAdmin, expires: expires})
+		var resp struct {
+			ExpiresAt int64 `json:"exp"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return w.Code, resp.ExpiresAt
+	}
+	code, exp := issue("ttl=600", now.Add(5*time.Minute))
+	testutil.ExpectEquals(t, http.StatusOK, code, "expected a session token")
+	testutil.ExpectEquals(t, now.Add(5*time.Minute).Unix(), exp, "expected the token to expire with the credential")
+	_, exp = issue("ttl=600", now.Add(time.Hour))
+	testutil.ExpectEquals(t, now.Add(10*time.Minute).Unix(), exp, "expected the requested ttl if the credential expires later")
+	_, exp = issue("", time.Time{})
+	testutil.ExpectEquals(t, now.Add(time.Hour).Unix(), exp, "expected session_token_ttl for credentials which don't expire")
+	code, _ = issue("", now)
+	testutil.ExpectEquals(t, http.StatusForbidden, code, "expected expired credentials not to get session tokens")
+}
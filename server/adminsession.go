@@ -0,0 +1,168 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AdminSessionTokenURL exchanges the credential of an operator (the admin token, the JWT of OIDC or a client certificate) for a short-lived session token,
+// which CLI tools send instead, so that long-lived credentials don't end up in shell history and scripts.
+const AdminSessionTokenURL = "/sessiontoken"
+
+const (
+	defaultAdminSessionTokenTTL = 15 * time.Minute
+	// maxAdminSessionTokenTTL is the longest session_token_ttl.
+	maxAdminSessionTokenTTL = 24 * time.Hour
+	// adminSessionTokenPrefix starts session tokens, followed by the base64url encoded claims, "." and their base64url encoded HMAC-SHA256.
+	adminSessionTokenPrefix = "uniqush-session."
+	// adminTokenSubject is the subject of session tokens exchanged for the static admin token.
+	adminTokenSubject = "admin-token"
+)
+
+// adminSessionClaims are the claims of session tokens.
+type adminSessionClaims struct {
+	Subject   string `json:"sub"`
+	Role      string `json:"role"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// adminSessions issues and verifies the session tokens of the admin listener.
+// Tokens are signed with a key derived from the admin token, so that every instance with the same configuration accepts them,
+// and changing the admin token revokes them. Without an admin token (OIDC only), the key is random, and tokens are only valid on the instance issuing them.
+type adminSessions struct {
+	key    []byte
+	maxTTL time.Duration
+	now    func() time.Time
+}
+
+// newAdminSessions returns nil if session tokens are disabled (session_token_ttl=0).
+func newAdminSessions(conf AdminConfig) *adminSessions {
+	if conf.SessionTokenTTL <= 0 {
+		return nil
+	}
+	var key []byte
+	if conf.Token != "" {
+		key = hmacSHA256([]byte(conf.Token), "uniqush-push admin session tokens")
+	} else {
+		key = make([]byte, sha256.Size)
+		if _, err := rand.Read(key); err != nil {
+			panic(err)
+		}
+	}
+	return &adminSessions{key: key, maxTTL: conf.SessionTokenTTL, now: time.Now}
+}
+
+func (s *adminSessions) sign(payload string) string {
+	return base64.RawURLEncoding.EncodeToString(hmacSHA256(s.key, payload))
+}
+
+// Issue returns a session token of subject with role, which expires after ttl.
+func (s *adminSessions) Issue(subject, role string, ttl time.Duration) (string, adminSessionClaims, error) {
+	now := s.now()
+	claims := adminSessionClaims{Subject: subject, Role: role, IssuedAt: now.Unix(), ExpiresAt: now.Add(ttl).Unix()}
+	b, err := json.Marshal(claims)
+	if err != nil {
+		return "", claims, err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(b)
+	return adminSessionTokenPrefix + payload + "." + s.sign(payload), claims, nil
+}
+
+// Verify returns the claims of a session token, or an error if it is invalid or expired.
+func (s *adminSessions) Verify(token string) (*adminSessionClaims, error) {
+	parts := strings.Split(strings.TrimPrefix(token, adminSessionTokenPrefix), ".")
+	if len(parts) != 2 || !hmac.Equal([]byte(s.sign(parts[0])), []byte(parts[1])) {
+		return nil, errors.New("invalid session token")
+	}
+	b, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errors.New("invalid session token")
+	}
+	claims := new(adminSessionClaims)
+	if err := json.Unmarshal(b, claims); err != nil {
+		return nil, errors.New("invalid session token")
+	}
+	if s.now().Unix() >= claims.ExpiresAt {
+		return nil, errors.New("the session token expired")
+	}
+	return claims, nil
+}
+
+// serveSessionToken handles AdminSessionTokenURL, for an operator authenticated with cred.
+// ttl (in seconds, at most session_token_ttl) shortens the token, and role (e.g. viewer) restricts it to a lower role.
+// The token never outlives cred (e.g. a JWT which expires sooner than the ttl).
+func (s *adminSessions) serveSessionToken(w http.ResponseWriter, r *http.Request, cred adminCredential) {
+	if r.Method != "POST" {
+		http.Error(w, "Session tokens must be requested with POST", http.StatusMethodNotAllowed)
+		return
+	}
+	r.ParseForm()
+	ttl := s.maxTTL
+	if param := r.Form.Get("ttl"); param != "" {
+		seconds, err := strconv.ParseInt(param, 10, 64)
+		if err != nil || seconds <= 0 || time.Duration(seconds)*time.Second > s.maxTTL {
+			http.Error(w, fmt.Sprintf("ttl must be between 1 and %d seconds", int64(s.maxTTL/time.Second)), http.StatusBadRequest)
+			return
+		}
+		ttl = time.Duration(seconds) * time.Second
+	}
+	if !cred.expires.IsZero() {
+		if remaining := cred.expires.Sub(s.now()); remaining < ttl {
+			ttl = remaining
+		}
+		if ttl < time.Second {
+			http.Error(w, "Forbidden: the credential expires too soon to request a session token", http.StatusForbidden)
+			return
+		}
+	}
+	subject, role := cred.subject, cred.role
+	if requested := r.Form.Get("role"); requested != "" {
+		if _, ok := adminRoleRanks[requested]; !ok {
+			http.Error(w, fmt.Sprintf("Unknown role %q: must be viewer, operator or admin", requested), http.StatusBadRequest)
+			return
+		}
+		if adminRoleRanks[requested] > adminRoleRanks[role] {
+			http.Error(w, fmt.Sprintf("Forbidden: the role %s of %s doesn't allow %s session tokens", role, subject, requested), http.StatusForbidden)
+			return
+		}
+		role = requested
+	}
+	token, claims, err := s.Issue(subject, role, ttl)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(struct {
+		Token string `json:"token"`
+		adminSessionClaims
+	}{token, claims})
+}
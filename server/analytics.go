@@ -0,0 +1,292 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/uniqush/log"
+	"github.com/uniqush/uniqush-push/db"
+	"github.com/uniqush/uniqush-push/push"
+)
+
+const (
+	defaultAnalyticsRetention     = 90 * 24 * time.Hour
+	defaultAnalyticsFlushInterval = 10 * time.Second
+	// maxAnalyticsRange is the longest period which can be queried at once with /analytics.
+	maxAnalyticsRange = 31 * 24 * time.Hour
+	// defaultAnalyticsRange is the period queried by /analytics if from isn't given.
+	defaultAnalyticsRange = 24 * time.Hour
+)
+
+// Names of the counters of each service and hour. Failures are counted by reason, as analyticsFailedPrefix + the result label of uniqush_pushes_total (e.g. failed.connection_error).
+// Pushes with a uniqush.campaign are also counted by campaign, as analyticsCampaignPrefix + campaign + ":" + the name of the counter (e.g. campaign:spring_sale:opened).
+const (
+	analyticsSent           = "sent"
+	analyticsAccepted       = "accepted"
+	analyticsInvalidated    = "invalidated"
+	analyticsOpened         = "opened"
+	analyticsClicked        = "clicked"
+	analyticsFailedPrefix   = "failed."
+	analyticsCampaignPrefix = "campaign:"
+)
+
+// campaignKey is the reserved key of /push and /broadcast which attributes the notification to a campaign, so that its engagement is counted separately.
+// Like other keys beginning with "uniqush.", it isn't sent to devices.
+const campaignKey = "uniqush.campaign"
+
+// validCampaignPattern is the accepted characters of campaigns. It excludes ":", which separates the campaign from the name of the counter.
+var validCampaignPattern = regexp.MustCompile(`^[a-zA-Z.0-9_@-]{1,128}$`)
+
+func validateCampaign(campaign string) error {
+	if !validCampaignPattern.MatchString(campaign) {
+		return fmt.Errorf("invalid campaign: %q. Accepted characters: a-z, A-Z, 0-9, -, _, @ or . (up to 128)", campaign) // nolint: golint
+	}
+	return nil
+}
+
+// notificationCampaign returns the campaign of a notification, or "" if it has none.
+func notificationCampaign(notif *push.Notification) string {
+	if notif == nil {
+		return ""
+	}
+	return notif.Data[campaignKey]
+}
+
+// AnalyticsConfig is a representation of the settings in the [Analytics] section of uniqush.conf.
+type AnalyticsConfig struct {
+	// Retention is how long the hourly counters are kept. 0 disables analytics.
+	Retention time.Duration
+	// FlushInterval is how often the counters are added to the database.
+	FlushInterval time.Duration
+}
+
+// AnalyticsBucket is the number of pushes to delivery points of a service during an hour, by result.
+type AnalyticsBucket struct {
+	// Hour is the unix timestamp of the start of the hour. It is omitted from totals.
+	Hour int64 `json:"hour,omitempty"`
+	// Sent is the number of results of pushes to delivery points, including the ones which will be retried.
+	Sent int64 `json:"sent"`
+	// Accepted is the number of pushes the push services accepted.
+	Accepted int64 `json:"accepted"`
+	// Failures are the number of pushes which failed, by reason (e.g. retry, connection_error, bad_delivery_point).
+	Failures map[string]int64 `json:"failures"`
+	// Invalidated is the number of delivery points which the push services reported as unsubscribed or invalid.
+	Invalidated int64 `json:"invalidated"`
+	// Opened is the number of notifications which client SDKs reported as opened with /track/open.
+	Opened int64 `json:"opened"`
+	// Clicked is the number of notifications which client SDKs reported as clicked with /track/click.
+	Clicked int64 `json:"clicked"`
+}
+
+// add adds the counts of other to b.
+func (b *AnalyticsBucket) add(other AnalyticsBucket) {
+	b.Sent += other.Sent
+	b.Accepted += other.Accepted
+	b.Invalidated += other.Invalidated
+	b.Opened += other.Opened
+	b.Clicked += other.Clicked
+	for reason, n := range other.Failures {
+		b.Failures[reason] += n
+	}
+}
+
+type analyticsKey struct {
+	service string
+	hour    int64
+}
+
+// analytics counts the results of pushes by service and hour, and adds the counts to the database every FlushInterval,
+// so that the database isn't written to for every result.
+type analytics struct {
+	db     db.PushDatabase
+	conf   AnalyticsConfig
+	logger log.Logger
+	mutex  sync.Mutex
+	counts map[analyticsKey]map[string]int64
+	now    func() time.Time
+}
+
+func newAnalytics(database db.PushDatabase, conf AnalyticsConfig, logger log.Logger) *analytics {
+	if conf.Retention <= 0 {
+		return nil
+	}
+	a := &analytics{
+		db:     database,
+		conf:   conf,
+		logger: logger,
+		counts: make(map[analyticsKey]map[string]int64),
+		now:    time.Now,
+	}
+	go a.run()
+	return a
+}
+
+func (a *analytics) run() {
+	for range time.Tick(a.conf.FlushInterval) {
+		a.Flush()
+	}
+}
+
+// analyticsCounter returns the name of the counter of the result of a push (other than analyticsSent, which counts every result).
+func analyticsCounter(err push.Error) string {
+	switch err.(type) {
+	case nil, *push.DeliveryPointUpdate, *push.PushServiceProviderUpdate:
+		// Updates are reported along with pushes which were accepted.
+		return analyticsAccepted
+	case *push.UnsubscribeUpdate, *push.InvalidRegistrationUpdate:
+		return analyticsInvalidated
+	default:
+		return analyticsFailedPrefix + pushResultLabel(err)
+	}
+}
+
+// record counts the result of a push to a delivery point of service, and of campaign if it isn't "".
+func (a *analytics) record(service, campaign string, err push.Error) {
+	a.incr(service, campaign, analyticsSent, analyticsCounter(err))
+}
+
+// track counts a notification of service (and of campaign if it isn't "") which was opened or clicked.
+func (a *analytics) track(service, campaign, counter string) {
+	a.incr(service, campaign, counter)
+}
+
+func (a *analytics) incr(service, campaign string, names ...string) {
+	if a == nil {
+		return
+	}
+	key := analyticsKey{service: service, hour: a.now().Unix() / 3600 * 3600}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	counts, ok := a.counts[key]
+	if !ok {
+		counts = make(map[string]int64)
+		a.counts[key] = counts
+	}
+	for _, name := range names {
+		counts[name]++
+		if campaign != "" {
+			counts[analyticsCampaignPrefix+campaign+":"+name]++
+		}
+	}
+}
+
+// Flush adds the counts since the last flush to the database. Counts which can't be saved are logged and dropped,
+// since adding them again could count some of them twice.
+func (a *analytics) Flush() {
+	if a == nil {
+		return
+	}
+	a.mutex.Lock()
+	pending := a.counts
+	a.counts = make(map[analyticsKey]map[string]int64)
+	a.mutex.Unlock()
+	for key, counts := range pending {
+		if err := a.db.IncrAnalyticsCounts(key.service, key.hour, counts, a.conf.Retention); err != nil {
+			a.logger.Errorf("Service=%v Hour=%v Cannot save analytics %v: %v", key.service, key.hour, counts, err)
+		}
+	}
+}
+
+// Query returns the hourly counts of the pushes to a service between from and to (inclusive), oldest first.
+// If campaign isn't "", only the pushes of that campaign are counted.
+// The counts of the current hour don't include the results since the last flush.
+func (a *analytics) Query(service, campaign string, from, to time.Time) ([]AnalyticsBucket, error) {
+	buckets := []AnalyticsBucket{}
+	if a == nil {
+		return buckets, nil
+	}
+	var hours []int64
+	for hour := from.Unix() / 3600 * 3600; hour <= to.Unix(); hour += 3600 {
+		hours = append(hours, hour)
+	}
+	if len(hours) == 0 {
+		return buckets, nil
+	}
+	counts, err := a.db.GetAnalyticsCounts(service, hours)
+	if err != nil {
+		return nil, err
+	}
+	for i, hour := range hours {
+		bucket := AnalyticsBucket{Hour: hour, Failures: map[string]int64{}}
+		for name, n := range counts[i] {
+			if campaign != "" {
+				prefix := analyticsCampaignPrefix + campaign + ":"
+				if !strings.HasPrefix(name, prefix) {
+					continue
+				}
+				name = name[len(prefix):]
+			}
+			switch {
+			case name == analyticsSent:
+				bucket.Sent = n
+			case name == analyticsAccepted:
+				bucket.Accepted = n
+			case name == analyticsInvalidated:
+				bucket.Invalidated = n
+			case name == analyticsOpened:
+				bucket.Opened = n
+			case name == analyticsClicked:
+				bucket.Clicked = n
+			case strings.HasPrefix(name, analyticsFailedPrefix):
+				bucket.Failures[name[len(analyticsFailedPrefix):]] = n
+			}
+		}
+		buckets = append(buckets, bucket)
+	}
+	return buckets, nil
+}
+
+// parseAnalyticsTime parses the from and to parameters of /analytics, which are unix timestamps or RFC 3339 dates.
+func parseAnalyticsTime(s string) (time.Time, error) {
+	if seconds, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Invalid time %q: must be a unix timestamp or an RFC 3339 date", s)
+	}
+	return t, nil
+}
+
+// analyticsRange returns the period queried by the from and to parameters of /analytics. to defaults to now, and from to a day before to.
+func analyticsRange(fromParam, toParam string, now time.Time) (from, to time.Time, err error) {
+	to = now
+	if toParam != "" {
+		if to, err = parseAnalyticsTime(toParam); err != nil {
+			return
+		}
+	}
+	from = to.Add(-defaultAnalyticsRange)
+	if fromParam != "" {
+		if from, err = parseAnalyticsTime(fromParam); err != nil {
+			return
+		}
+	}
+	if from.After(to) {
+		err = fmt.Errorf("from must not be after to")
+	} else if to.Sub(from) > maxAnalyticsRange {
+		err = fmt.Errorf("Cannot query more than %v at once", maxAnalyticsRange)
+	}
+	return
+}
@@ -0,0 +1,180 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/uniqush/log"
+	"github.com/uniqush/uniqush-push/db"
+	"github.com/uniqush/uniqush-push/push"
+	"github.com/uniqush/uniqush-push/testutil"
+)
+
+// analyticsDatabase keeps the analytics counts in memory. Other methods aren't implemented.
+type analyticsDatabase struct {
+	db.PushDatabase
+	counts map[string]map[int64]map[string]int64
+}
+
+func (d *analyticsDatabase) IncrAnalyticsCounts(service string, hour int64, counts map[string]int64, retention time.Duration) error {
+	if d.counts[service] == nil {
+		d.counts[service] = make(map[int64]map[string]int64)
+	}
+	if d.counts[service][hour] == nil {
+		d.counts[service][hour] = make(map[string]int64)
+	}
+	for name, n := range counts {
+		d.counts[service][hour][name] += n
+	}
+	return nil
+}
+
+func (d *analyticsDatabase) GetAnalyticsCounts(service string, hours []int64) ([]map[string]int64, error) {
+	ret := make([]map[string]int64, len(hours))
+	for i, hour := range hours {
+		ret[i] = d.counts[service][hour]
+	}
+	return ret, nil
+}
+
+func TestAnalytics(t *testing.T) {
+	database := &analyticsDatabase{counts: make(map[string]map[int64]map[string]int64)}
+	a := &analytics{
+		db:     database,
+		conf:   AnalyticsConfig{Retention: time.Hour},
+		logger: log.NewLogger(ioutil.Discard, "", log.LOGLEVEL_SILENT),
+		counts: make(map[analyticsKey]map[string]int64),
+	}
+	now := time.Unix(1500000000, 0)
+	a.now = func() time.Time { return now }
+	hour := int64(1500000000 / 3600 * 3600)
+
+	a.record("srv", "", nil)
+	a.record("srv", "", &push.DeliveryPointUpdate{})
+	a.record("srv", "", push.NewConnectionError(nil))
+	a.record("srv", "", &push.UnsubscribeUpdate{})
+	a.record("other", "", nil)
+	a.Flush()
+	now = now.Add(time.Hour)
+	a.record("srv", "", push.NewConnectionError(nil))
+	a.Flush()
+
+	buckets, err := a.Query("srv", "", time.Unix(hour-3600, 0), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectEquals(t, []AnalyticsBucket{
+		{Hour: hour - 3600, Failures: map[string]int64{}},
+		{Hour: hour, Sent: 4, Accepted: 2, Invalidated: 1, Failures: map[string]int64{"connection_error": 1}},
+		{Hour: hour + 3600, Sent: 1, Failures: map[string]int64{"connection_error": 1}},
+	}, buckets, "expected the results to be counted by hour")
+}
+
+func TestAnalyticsCampaigns(t *testing.T) {
+	database := &analyticsDatabase{counts: make(map[string]map[int64]map[string]int64)}
+	a := &analytics{
+		db:     database,
+		conf:   AnalyticsConfig{Retention: time.Hour},
+		logger: log.NewLogger(ioutil.Discard, "", log.LOGLEVEL_SILENT),
+		counts: make(map[analyticsKey]map[string]int64),
+	}
+	now := time.Unix(1500000000, 0)
+	a.now = func() time.Time { return now }
+	hour := int64(1500000000 / 3600 * 3600)
+
+	a.record("srv", "sale", nil)
+	a.record("srv", "sale", push.NewConnectionError(nil))
+	a.record("srv", "", nil)
+	a.track("srv", "sale", analyticsOpened)
+	a.track("srv", "sale", analyticsClicked)
+	a.track("srv", "", analyticsOpened)
+	a.Flush()
+
+	buckets, err := a.Query("srv", "", now, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectEquals(t, []AnalyticsBucket{
+		{Hour: hour, Sent: 3, Accepted: 2, Opened: 2, Clicked: 1, Failures: map[string]int64{"connection_error": 1}},
+	}, buckets, "expected the service to count every push")
+
+	buckets, err = a.Query("srv", "sale", now, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectEquals(t, []AnalyticsBucket{
+		{Hour: hour, Sent: 2, Accepted: 1, Opened: 1, Clicked: 1, Failures: map[string]int64{"connection_error": 1}},
+	}, buckets, "expected only the pushes of the campaign to be counted")
+
+	for _, invalid := range []string{"", "a:b", strings.Repeat("a", 129)} {
+		if validateCampaign(invalid) == nil {
+			t.Errorf("expected %q to be an invalid campaign", invalid)
+		}
+	}
+}
+
+func TestAnalyticsRange(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	from, to, err := analyticsRange("", "", now)
+	testutil.ExpectEquals(t, nil, err, "unexpected error")
+	testutil.ExpectEquals(t, now.Add(-24*time.Hour), from, "expected the last day by default")
+	testutil.ExpectEquals(t, now, to, "expected to to default to now")
+
+	from, to, err = analyticsRange("1499990000", "2017-07-14T02:40:00Z", now)
+	testutil.ExpectEquals(t, nil, err, "unexpected error")
+	testutil.ExpectEquals(t, int64(1499990000), from.Unix(), "expected a unix timestamp to be parsed")
+	testutil.ExpectEquals(t, int64(1500000000), to.Unix(), "expected an RFC 3339 date to be parsed")
+
+	for _, params := range [][2]string{{"yesterday", ""}, {"1500000001", "1500000000"}, {"1400000000", "1500000000"}} {
+		if _, _, err := analyticsRange(params[0], params[1], now); err == nil {
+			t.Errorf("expected from=%q to=%q to be rejected", params[0], params[1])
+		}
+	}
+}
+
+func TestTrackNotification(t *testing.T) {
+	api := newHealthTestAPI(&analyticsDatabase{counts: make(map[string]map[int64]map[string]int64)})
+	api.waitGroup = new(sync.WaitGroup)
+	api.backend.analytics = &analytics{
+		db:     api.backend.db,
+		conf:   AnalyticsConfig{Retention: time.Hour},
+		logger: log.NewLogger(ioutil.Discard, "", log.LOGLEVEL_SILENT),
+		counts: make(map[analyticsKey]map[string]int64),
+		now:    time.Now,
+	}
+	track := func(path string) APIResponseDetails {
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		var response APISimpleResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatalf("invalid response %q: %v", w.Body.String(), err)
+		}
+		return response.Details
+	}
+	details := track(TrackOpenURL + "?service=srv&id=abc&campaign=sale")
+	testutil.ExpectStringEquals(t, UNIQUSH_SUCCESS, details.Code, "unexpected code")
+	testutil.ExpectStringEquals(t, "abc", *details.RequestID, "expected the notification ID")
+	details = track(TrackClickURL + "?service=srv&id=abc")
+	testutil.ExpectStringEquals(t, UNIQUSH_SUCCESS, details.Code, "unexpected code")
+	details = track(TrackClickURL + "?service=srv")
+	testutil.ExpectStringEquals(t, UNIQUSH_ERROR_GENERIC, details.Code, "expected the notification ID to be required")
+	details = track(TrackClickURL + "?service=srv&id=abc&campaign=a:b")
+	testutil.ExpectStringEquals(t, UNIQUSH_ERROR_GENERIC, details.Code, "expected an invalid campaign to be rejected")
+
+	api.backend.analytics.Flush()
+	buckets, err := api.backend.analytics.Query("srv", "sale", time.Now(), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectEquals(t, int64(1), buckets[0].Opened, "expected the open to be counted for the campaign")
+	buckets, err = api.backend.analytics.Query("srv", "", time.Now(), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectEquals(t, int64(1), buckets[0].Clicked, "expected the click to be counted for the service")
+}
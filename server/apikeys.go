@@ -0,0 +1,587 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/uniqush/log"
+	"github.com/uniqush/uniqush-push/db"
+)
+
+const (
+	defaultAPIKeyCacheTTL = 30 * time.Second
+	// maxAPIKeyRotationGrace is the longest time for which the previous secret of a rotated API key can stay valid.
+	maxAPIKeyRotationGrace = 7 * 24 * time.Hour
+)
+
+// Scopes of API keys. Each endpoint requires one of them. push and subscribe are for the backends and apps of services,
+// while viewer, operator and admin are the roles of the people and tools operating uniqush-push: each role grants the endpoints of the previous ones.
+const (
+	// APIKeyScopePush allows sending pushes and broadcasts (/push, /previewpush, /broadcast and the endpoints controlling broadcasts), and issuing unsubscribe tokens.
+	APIKeyScopePush = "push"
+	// APIKeyScopeSubscribe allows the requests of apps: /subscribe, /unsubscribe, /track/open and /track/click.
+	APIKeyScopeSubscribe = "subscribe"
+	// APIKeyScopeViewer allows reading push service providers (without credentials), subscribers, deliveries, broadcasts, analytics and metrics.
+	APIKeyScopeViewer = "viewer"
+	// APIKeyScopeOperator allows running broadcasts, reconciling subscribers, releasing quarantined payloads and resolving staged unsubscribes.
+	APIKeyScopeOperator = "operator"
+	// APIKeyScopeAdmin allows every endpoint, including changes to push service providers, stopping uniqush-push, the audit log and the management of API keys and tenants.
+	APIKeyScopeAdmin = "admin"
+)
+
+// apiKeyRoles are the scopes granted by each role, in addition to the role itself. APIKeyScopeAdmin grants every scope.
+var apiKeyRoles = map[string][]string{
+	APIKeyScopeOperator: {APIKeyScopeViewer},
+}
+
+// Paths of the endpoints which manage API keys. They require APIKeyScopeAdmin, and are also served by the admin listener
+// (with the admin token), so that the first key can be created before API keys are enabled.
+const (
+	QueryAPIKeysURL = "/apikeys"
+	CreateAPIKeyURL = "/createapikey"
+	RotateAPIKeyURL = "/rotateapikey"
+	RevokeAPIKeyURL = "/revokeapikey"
+)
+
+// API keys are "<id>.<secret>": the id is apiKeyIDLength random bytes in hex, and the secret apiKeySecretSize random bytes in unpadded base64url.
+const (
+	apiKeySeparator  = "."
+	apiKeyIDLength   = 8
+	apiKeySecretSize = 32
+	// apiKeyAuthRealm is the WWW-Authenticate header of requests rejected for not having a valid API key.
+	apiKeyAuthRealm = `Bearer realm="uniqush-push"`
+)
+
+// Actions of audit records of API keys.
+const (
+	AuditCreateAPIKey = "createapikey"
+	AuditRotateAPIKey = "rotateapikey"
+	AuditRevokeAPIKey = "revokeapikey"
+)
+
+// apiKeyScopes are the scopes allowing endpoints other than the ones of APIKeyScopeAdmin (any of them is enough).
+// Endpoints which aren't listed require APIKeyScopeAdmin, except for the public ones in publicAPIPaths.
+var apiKeyScopes = map[string][]string{
+	PushNotificationURL:                {APIKeyScopePush},
+	PreviewPushNotificationURL:         {APIKeyScopePush, APIKeyScopeViewer},
+	TestPushURL:                        {APIKeyScopeOperator},
+	BroadcastURL:                       {APIKeyScopePush, APIKeyScopeOperator},
+	QueryBroadcastsURL:                 {APIKeyScopePush, APIKeyScopeViewer},
+	PauseBroadcastURL:                  {APIKeyScopePush, APIKeyScopeOperator},
+	ResumeBroadcastURL:                 {APIKeyScopePush, APIKeyScopeOperator},
+	CancelBroadcastURL:                 {APIKeyScopePush, APIKeyScopeOperator},
+	UnsubscribeTokenURL:                {APIKeyScopePush},
+	AddDeliveryPointToServiceURL:       {APIKeyScopeSubscribe},
+	RemoveDeliveryPointFromServiceURL:  {APIKeyScopeSubscribe},
+	RefreshDeliveryPointURL:            {APIKeyScopeSubscribe},
+	TrackOpenURL:                       {APIKeyScopeSubscribe},
+	TrackClickURL:                      {APIKeyScopeSubscribe},
+	QueryInboxURL:                      {APIKeyScopeSubscribe, APIKeyScopeViewer},
+	RemoveInboxMessagesURL:             {APIKeyScopeSubscribe},
+	QueryPushServiceProviders:          {APIKeyScopeViewer},
+	QueryNumberOfDeliveryPointsURL:     {APIKeyScopeViewer},
+	QuerySubscriptionsURL:              {APIKeyScopeViewer},
+	QuerySubscribersURL:                {APIKeyScopeViewer},
+	QueryDeliveriesURL:                 {APIKeyScopeViewer},
+	QueryAnalyticsURL:                  {APIKeyScopeViewer},
+	QueryFailuresURL:                   {APIKeyScopeViewer},
+	QueryCanaryURL:                     {APIKeyScopeViewer},
+	QueryQueueURL:                      {APIKeyScopeViewer},
+	QueryCacheURL:                      {APIKeyScopeViewer},
+	QueryClusterURL:                    {APIKeyScopeViewer},
+	QueryStagedPushServiceProvidersURL: {APIKeyScopeViewer},
+	DiagnosticsURL:                     {APIKeyScopeViewer},
+	QueryQuarantineURL:                 {APIKeyScopeViewer},
+	QueryFlaggedDeliveryPointsURL:      {APIKeyScopeViewer},
+	QueryStagedUnsubscribesURL:         {APIKeyScopeViewer},
+	QuerySubscribeAbuseURL:             {APIKeyScopeViewer},
+	DashboardURL:                       {APIKeyScopeViewer},
+	MetricsURL:                         {APIKeyScopeViewer},
+	ReconcileURL:                       {APIKeyScopeOperator},
+	ReleaseQuarantineURL:               {APIKeyScopeOperator},
+	ConfirmUnsubscribeURL:              {APIKeyScopeOperator},
+	CancelUnsubscribeURL:               {APIKeyScopeOperator},
+	ReviewSubscribeAbuseURL:            {APIKeyScopeOperator},
+	RebuildServiceSetURL:               {APIKeyScopeOperator},
+}
+
+// publicAPIPaths can be requested without an API key, for load balancers and orchestrators, and for end users with unsubscribe tokens.
+var publicAPIPaths = map[string]bool{
+	VersionInfoURL: true,
+	HealthzURL:     true,
+	ReadyzURL:      true,
+	// End users send unsubscribe tokens, which are verified instead.
+	UnsubscribeWithTokenURL: true,
+}
+
+// APIKeysConfig is a representation of the settings in the [APIKeys] section of uniqush.conf.
+type APIKeysConfig struct {
+	// Enabled requires an API key with the scope of the endpoint in the "Authorization: Bearer <key>" header of every request to the API.
+	Enabled bool
+	// CacheTTL is how long verified keys are cached. Keys rotated or revoked by another instance stay valid on this instance for up to CacheTTL.
+	CacheTTL time.Duration
+}
+
+// APIKey describes an API key, without its secret.
+type APIKey struct {
+	ID     string   `json:"id"`
+	Name   string   `json:"name,omitempty"`
+	Scopes []string `json:"scopes"`
+	// Tenant is the tenant the key belongs to, if any. The keys of tenants can only use the services of their tenant.
+	Tenant string `json:"tenant,omitempty"`
+	// Created, Rotated and Revoked are unix timestamps. Rotated and Revoked are 0 if the key wasn't rotated or revoked.
+	Created int64 `json:"created"`
+	Rotated int64 `json:"rotated,omitempty"`
+	Revoked int64 `json:"revoked,omitempty"`
+}
+
+// hasScope returns true if the key grants scope, directly or through its role.
+func (k *APIKey) hasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope || s == APIKeyScopeAdmin {
+			return true
+		}
+		for _, granted := range apiKeyRoles[s] {
+			if granted == scope {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// hasAnyScope returns true if the key grants one of scopes.
+func (k *APIKey) hasAnyScope(scopes []string) bool {
+	for _, scope := range scopes {
+		if k.hasScope(scope) {
+			return true
+		}
+	}
+	return false
+}
+
+// apiKeyRecord is what is saved in the database for an API key. Only the hashes of secrets are saved.
+type apiKeyRecord struct {
+	APIKey
+	SecretHash string `json:"secretHash"`
+	// PreviousSecretHash is the hash of the secret before the last rotation, which is valid until PreviousSecretExpiry (a unix timestamp).
+	PreviousSecretHash   string `json:"previousSecretHash,omitempty"`
+	PreviousSecretExpiry int64  `json:"previousSecretExpiry,omitempty"`
+}
+
+type cachedAPIKey struct {
+	// record is nil if there is no key with this id.
+	record  *apiKeyRecord
+	expires time.Time
+}
+
+// apiKeyStore creates, rotates and revokes API keys, and checks that requests have a key with the scope of the endpoint.
+type apiKeyStore struct {
+	db   db.PushDatabase
+	conf APIKeysConfig
+	// tenants are the tenants which keys can belong to. If nil, keys can't belong to tenants.
+	tenants *tenantStore
+	audit   *auditLog
+	logger  log.Logger
+	mutex   sync.Mutex
+	cache   map[string]cachedAPIKey
+	now     func() time.Time
+}
+
+func newAPIKeyStore(database db.PushDatabase, conf APIKeysConfig, tenants *tenantStore, audit *auditLog, logger log.Logger) *apiKeyStore {
+	return &apiKeyStore{
+		db:      database,
+		conf:    conf,
+		tenants: tenants,
+		audit:   audit,
+		logger:  logger,
+		cache:   make(map[string]cachedAPIKey),
+		now:     time.Now,
+	}
+}
+
+func hashAPIKeySecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// newAPIKeySecret returns a random secret and its hash.
+func newAPIKeySecret() (string, string, error) {
+	var b [apiKeySecretSize]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", "", err
+	}
+	secret := base64.RawURLEncoding.EncodeToString(b[:])
+	return secret, hashAPIKeySecret(secret), nil
+}
+
+// apiKeyScopeNames lists the scopes for the errors of parseAPIKeyScopes.
+const apiKeyScopeNames = APIKeyScopePush + ", " + APIKeyScopeSubscribe + ", " + APIKeyScopeViewer + ", " + APIKeyScopeOperator + " or " + APIKeyScopeAdmin
+
+// parseAPIKeyScopes parses a comma separated list of scopes.
+func parseAPIKeyScopes(s string) ([]string, error) {
+	var scopes []string
+	seen := make(map[string]bool)
+	for _, scope := range strings.Split(s, ",") {
+		scope = strings.TrimSpace(scope)
+		if scope == "" || seen[scope] {
+			continue
+		}
+		switch scope {
+		case APIKeyScopePush, APIKeyScopeSubscribe, APIKeyScopeViewer, APIKeyScopeOperator, APIKeyScopeAdmin:
+		default:
+			return nil, fmt.Errorf("Unknown scope %q: must be %s", scope, apiKeyScopeNames)
+		}
+		seen[scope] = true
+		scopes = append(scopes, scope)
+	}
+	if len(scopes) == 0 {
+		return nil, fmt.Errorf("Must specify the scopes of the key (%s)", apiKeyScopeNames)
+	}
+	sort.Strings(scopes)
+	return scopes, nil
+}
+
+// load returns the record of the key with the given id, or nil if there is no such key. Records are cached for CacheTTL.
+func (s *apiKeyStore) load(id string) (*apiKeyRecord, error) {
+	now := s.now()
+	s.mutex.Lock()
+	cached, ok := s.cache[id]
+	s.mutex.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached.record, nil
+	}
+	b, err := s.db.GetAPIKey(id)
+	if err != nil {
+		return nil, err
+	}
+	var record *apiKeyRecord
+	if b != nil {
+		record = new(apiKeyRecord)
+		if err := json.Unmarshal(b, record); err != nil {
+			return nil, fmt.Errorf("Invalid API key %q: %v", id, err)
+		}
+	}
+	s.cacheRecord(id, record)
+	return record, nil
+}
+
+func (s *apiKeyStore) cacheRecord(id string, record *apiKeyRecord) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now := s.now()
+	// Expired entries are removed when caching, so that requests with random ids can't grow the cache indefinitely.
+	for cachedID, cached := range s.cache {
+		if !now.Before(cached.expires) {
+			delete(s.cache, cachedID)
+		}
+	}
+	s.cache[id] = cachedAPIKey{record: record, expires: now.Add(s.conf.CacheTTL)}
+}
+
+func (s *apiKeyStore) save(record *apiKeyRecord) error {
+	b, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if err := s.db.SetAPIKey(record.ID, b); err != nil {
+		return err
+	}
+	s.cacheRecord(record.ID, record)
+	return nil
+}
+
+// verify returns the key whose secret is key (in the form "<id>.<secret>"), or nil if the key is invalid, revoked or unknown.
+func (s *apiKeyStore) verify(key string) (*APIKey, error) {
+	i := strings.Index(key, apiKeySeparator)
+	if i <= 0 {
+		return nil, nil
+	}
+	record, err := s.load(key[:i])
+	if err != nil || record == nil || record.Revoked != 0 {
+		return nil, err
+	}
+	hash := []byte(hashAPIKeySecret(key[i+1:]))
+	if subtle.ConstantTimeCompare(hash, []byte(record.SecretHash)) == 1 {
+		return &record.APIKey, nil
+	}
+	if record.PreviousSecretHash != "" && s.now().Unix() < record.PreviousSecretExpiry && subtle.ConstantTimeCompare(hash, []byte(record.PreviousSecretHash)) == 1 {
+		return &record.APIKey, nil
+	}
+	return nil, nil
+}
+
+// authorize checks that r has an API key with the scope of its endpoint, if API keys are enabled.
+// It returns the key (nil if API keys are disabled or the endpoint is public) and http.StatusOK, or the status and code to reject the request with.
+func (s *apiKeyStore) authorize(r *http.Request) (*APIKey, int, string) {
+	if s == nil || !s.conf.Enabled || publicAPIPaths[r.URL.Path] {
+		return nil, http.StatusOK, UNIQUSH_SUCCESS
+	}
+	const prefix = "Bearer "
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, prefix) {
+		return nil, http.StatusUnauthorized, UNIQUSH_ERROR_UNAUTHORIZED
+	}
+	key, err := s.verify(strings.TrimSpace(auth[len(prefix):]))
+	if err != nil {
+		s.logger.Errorf("URL=%v Cannot verify API key: %v", r.URL.Path, err)
+		return nil, http.StatusServiceUnavailable, UNIQUSH_ERROR_DATABASE
+	}
+	if key == nil {
+		return nil, http.StatusUnauthorized, UNIQUSH_ERROR_UNAUTHORIZED
+	}
+	return authorizeScopes(key, r.URL.Path)
+}
+
+// authorizeScopes returns key and http.StatusOK if it has one of the scopes of path, or the status and code to reject the request with.
+func authorizeScopes(key *APIKey, path string) (*APIKey, int, string) {
+	scopes, ok := apiKeyScopes[path]
+	if !ok {
+		scopes = []string{APIKeyScopeAdmin}
+	}
+	if !key.hasAnyScope(scopes) {
+		return nil, http.StatusForbidden, UNIQUSH_ERROR_FORBIDDEN
+	}
+	return key, http.StatusOK, UNIQUSH_SUCCESS
+}
+
+// authorize checks the scopes of the client certificate of r if its SANs are mapped to scopes (even if API keys are disabled),
+// and otherwise the API key of r.
+func (api *RestAPI) authorize(r *http.Request) (*APIKey, int, string) {
+	if !publicAPIPaths[r.URL.Path] {
+		if key := api.backend.clientCerts.identify(r); key != nil {
+			return authorizeScopes(key, r.URL.Path)
+		}
+	}
+	return api.backend.apiKeys.authorize(r)
+}
+
+// List returns every API key (including revoked ones), oldest first.
+func (s *apiKeyStore) List() ([]APIKey, error) {
+	records, err := s.db.GetAPIKeys()
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]APIKey, 0, len(records))
+	for id, b := range records {
+		var record apiKeyRecord
+		if err := json.Unmarshal(b, &record); err != nil {
+			s.logger.Errorf("APIKey=%v Ignoring invalid API key: %v", id, err)
+			continue
+		}
+		keys = append(keys, record.APIKey)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Created != keys[j].Created {
+			return keys[i].Created < keys[j].Created
+		}
+		return keys[i].ID < keys[j].ID
+	})
+	return keys, nil
+}
+
+// Create saves a new API key with the given scopes (of tenant, unless it is ""), and returns it along with the key to send in requests.
+// The key can't be retrieved later.
+func (s *apiKeyStore) Create(name string, scopes []string, tenant string, record AuditRecord) (APIKey, string, error) {
+	if tenant != "" {
+		t, err := s.tenants.Get(tenant)
+		if err == nil && t == nil {
+			err = fmt.Errorf("Unknown tenant %q", tenant)
+		}
+		if err != nil {
+			return APIKey{}, "", err
+		}
+	}
+	var idBytes [apiKeyIDLength]byte
+	if _, err := rand.Read(idBytes[:]); err != nil {
+		return APIKey{}, "", err
+	}
+	secret, hash, err := newAPIKeySecret()
+	if err != nil {
+		return APIKey{}, "", err
+	}
+	key := &apiKeyRecord{
+		APIKey:     APIKey{ID: hex.EncodeToString(idBytes[:]), Name: name, Scopes: scopes, Tenant: tenant, Created: s.now().Unix()},
+		SecretHash: hash,
+	}
+	err = s.save(key)
+	record.Action = AuditCreateAPIKey
+	record.Changes = map[string]AuditChange{"id": {New: key.ID}, "name": {New: name}, "scopes": {New: strings.Join(scopes, ",")}}
+	if tenant != "" {
+		record.Changes["tenant"] = AuditChange{New: tenant}
+	}
+	s.addAuditRecord(record, err)
+	if err != nil {
+		return APIKey{}, "", err
+	}
+	return key.APIKey, key.ID + apiKeySeparator + secret, nil
+}
+
+// Rotate replaces the secret of an API key, and returns the new key to send in requests. The previous secret stays valid for grace.
+func (s *apiKeyStore) Rotate(id string, grace time.Duration, record AuditRecord) (APIKey, string, error) {
+	key, err := s.loadForChange(id)
+	if err != nil {
+		return APIKey{}, "", err
+	}
+	secret, hash, err := newAPIKeySecret()
+	if err != nil {
+		return APIKey{}, "", err
+	}
+	now := s.now()
+	key.PreviousSecretHash, key.PreviousSecretExpiry = "", 0
+	if grace > 0 {
+		key.PreviousSecretHash, key.PreviousSecretExpiry = key.SecretHash, now.Add(grace).Unix()
+	}
+	key.SecretHash = hash
+	key.Rotated = now.Unix()
+	err = s.save(key)
+	record.Action = AuditRotateAPIKey
+	record.Changes = map[string]AuditChange{"id": {Old: id, New: id}, "grace": {New: grace.String()}}
+	s.addAuditRecord(record, err)
+	if err != nil {
+		return APIKey{}, "", err
+	}
+	return key.APIKey, id + apiKeySeparator + secret, nil
+}
+
+// Revoke revokes an API key immediately on this instance, and within CacheTTL on other instances.
+func (s *apiKeyStore) Revoke(id string, record AuditRecord) (APIKey, error) {
+	key, err := s.loadForChange(id)
+	if err != nil {
+		return APIKey{}, err
+	}
+	key.Revoked = s.now().Unix()
+	key.PreviousSecretHash, key.PreviousSecretExpiry = "", 0
+	err = s.save(key)
+	record.Action = AuditRevokeAPIKey
+	record.Changes = map[string]AuditChange{"id": {Old: id}}
+	s.addAuditRecord(record, err)
+	if err != nil {
+		return APIKey{}, err
+	}
+	return key.APIKey, nil
+}
+
+// loadForChange returns the record of a key which can be rotated or revoked, bypassing the cache.
+func (s *apiKeyStore) loadForChange(id string) (*apiKeyRecord, error) {
+	if id == "" {
+		return nil, fmt.Errorf("Must specify the id of an API key")
+	}
+	b, err := s.db.GetAPIKey(id)
+	if err != nil {
+		return nil, err
+	}
+	if b == nil {
+		return nil, fmt.Errorf("Unknown API key %q", id)
+	}
+	key := new(apiKeyRecord)
+	if err := json.Unmarshal(b, key); err != nil {
+		return nil, fmt.Errorf("Invalid API key %q: %v", id, err)
+	}
+	if key.Revoked != 0 {
+		return nil, fmt.Errorf("API key %q was revoked", id)
+	}
+	return key, nil
+}
+
+func (s *apiKeyStore) addAuditRecord(record AuditRecord, err error) {
+	record.Code = UNIQUSH_SUCCESS
+	if err != nil {
+		record.Code = UNIQUSH_ERROR_GENERIC
+		record.ErrorMsg = err.Error()
+	}
+	s.audit.add(record)
+}
+
+// serveAPIKeys handles the endpoints managing API keys, for the API and the admin listener.
+// The key is only included in the responses of /createapikey and /rotateapikey.
+func serveAPIKeys(w http.ResponseWriter, r *http.Request, s *apiKeyStore, remoteAddr string) {
+	type responseType struct {
+		APIKeys      []APIKey `json:"apiKeys"`
+		Key          string   `json:"key,omitempty"`
+		ErrorMessage *string  `json:"errorMsg,omitempty"`
+		Code         string   `json:"code"`
+	}
+	r.ParseForm()
+	record := AuditRecord{From: remoteAddr, APIKey: auditAPIKey(r)}
+	var resp responseType
+	var key APIKey
+	var err error
+	switch {
+	case s == nil:
+		err = fmt.Errorf("API keys are not configured")
+	case r.URL.Path == QueryAPIKeysURL:
+		resp.APIKeys, err = s.List()
+	case r.URL.Path == CreateAPIKeyURL:
+		var scopes []string
+		if scopes, err = parseAPIKeyScopes(r.Form.Get("scopes")); err == nil {
+			key, resp.Key, err = s.Create(r.Form.Get("name"), scopes, r.Form.Get("tenant"), record)
+		}
+	case r.URL.Path == RotateAPIKeyURL:
+		var grace time.Duration
+		if param := r.Form.Get("grace"); param != "" {
+			var seconds int64
+			if seconds, err = strconv.ParseInt(param, 10, 64); err != nil || seconds < 0 || time.Duration(seconds)*time.Second > maxAPIKeyRotationGrace {
+				err = fmt.Errorf("grace must be between 0 and %d seconds", int64(maxAPIKeyRotationGrace/time.Second))
+			}
+			grace = time.Duration(seconds) * time.Second
+		}
+		if err == nil {
+			key, resp.Key, err = s.Rotate(r.Form.Get("id"), grace, record)
+		}
+	case r.URL.Path == RevokeAPIKeyURL:
+		key, err = s.Revoke(r.Form.Get("id"), record)
+	}
+	if resp.APIKeys == nil {
+		resp.APIKeys = []APIKey{}
+		if key.ID != "" {
+			resp.APIKeys = append(resp.APIKeys, key)
+		}
+	}
+	if err != nil {
+		errorMsg := redactedError(err)
+		if s != nil {
+			s.logger.Errorf("From=%v URL=%v %v", remoteAddr, r.URL.Path, err)
+		}
+		resp.Code = UNIQUSH_ERROR_GENERIC
+		resp.ErrorMessage = &errorMsg
+	} else {
+		resp.Code = UNIQUSH_SUCCESS
+		if r.URL.Path != QueryAPIKeysURL {
+			s.logger.Infof("From=%v URL=%v APIKey=%v Scopes=%v", remoteAddr, r.URL.Path, key.ID, key.Scopes)
+		}
+	}
+	b, err := json.Marshal(resp)
+	if err != nil {
+		b = []byte("Failed to serialize response")
+	}
+	fmt.Fprintf(w, "%s\r\n", b)
+}
@@ -0,0 +1,188 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/uniqush/log"
+	"github.com/uniqush/uniqush-push/testutil"
+)
+
+// apiKeyDatabase keeps API keys and the audit log in memory. Other methods aren't implemented.
+type apiKeyDatabase struct {
+	auditDatabase
+	keys  map[string][]byte
+	reads int
+}
+
+func (d *apiKeyDatabase) SetAPIKey(id string, record []byte) error {
+	d.keys[id] = record
+	return nil
+}
+
+func (d *apiKeyDatabase) GetAPIKey(id string) ([]byte, error) {
+	d.reads++
+	return d.keys[id], nil
+}
+
+func (d *apiKeyDatabase) GetAPIKeys() (map[string][]byte, error) {
+	return d.keys, nil
+}
+
+func newTestAPIKeyStore(enabled bool) (*apiKeyStore, *apiKeyDatabase) {
+	database := &apiKeyDatabase{keys: make(map[string][]byte)}
+	logger := log.NewLogger(ioutil.Discard, "", log.LOGLEVEL_SILENT)
+	audit := newAuditLog(database, AuditConfig{MaxRecords: 10}, logger)
+	return newAPIKeyStore(database, APIKeysConfig{Enabled: enabled, CacheTTL: time.Minute}, nil, audit, logger), database
+}
+
+func authorizeAPIKey(s *apiKeyStore, path, key string) int {
+	req := httptest.NewRequest("POST", path, nil)
+	if key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+	_, status, _ := s.authorize(req)
+	return status
+}
+
+func TestParseAPIKeyScopes(t *testing.T) {
+	scopes, err := parseAPIKeyScopes("subscribe, push,push,viewer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectEquals(t, []string{APIKeyScopePush, APIKeyScopeSubscribe, APIKeyScopeViewer}, scopes, "expected sorted scopes without duplicates")
+	for _, invalid := range []string{"", " , ", "push,root"} {
+		if _, err := parseAPIKeyScopes(invalid); err == nil {
+			t.Errorf("expected %q to be invalid", invalid)
+		}
+	}
+}
+
+func TestAPIKeyScopes(t *testing.T) {
+	s, database := newTestAPIKeyStore(true)
+	_, pushKey, err := s.Create("backend", []string{APIKeyScopePush}, "", AuditRecord{From: "127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, adminKey, err := s.Create("ops", []string{APIKeyScopeAdmin}, "", AuditRecord{From: "127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id, b := range database.keys {
+		var record apiKeyRecord
+		if err := json.Unmarshal(b, &record); err != nil {
+			t.Fatal(err)
+		}
+		testutil.ExpectEquals(t, 64, len(record.SecretHash), "expected only the hash of the secret to be saved")
+		testutil.ExpectStringEquals(t, id, record.ID, "expected keys to be saved by id")
+	}
+
+	testutil.ExpectEquals(t, http.StatusOK, authorizeAPIKey(s, HealthzURL, ""), "expected health checks not to require a key")
+	testutil.ExpectEquals(t, http.StatusUnauthorized, authorizeAPIKey(s, PushNotificationURL, ""), "expected requests without a key to be rejected")
+	testutil.ExpectEquals(t, http.StatusUnauthorized, authorizeAPIKey(s, PushNotificationURL, pushKey+"x"), "expected invalid keys to be rejected")
+	testutil.ExpectEquals(t, http.StatusUnauthorized, authorizeAPIKey(s, PushNotificationURL, "unknown.secret"), "expected unknown keys to be rejected")
+	testutil.ExpectEquals(t, http.StatusOK, authorizeAPIKey(s, PushNotificationURL, pushKey), "expected the push scope to allow /push")
+	testutil.ExpectEquals(t, http.StatusForbidden, authorizeAPIKey(s, AddDeliveryPointToServiceURL, pushKey), "expected the push scope not to allow /subscribe")
+	testutil.ExpectEquals(t, http.StatusForbidden, authorizeAPIKey(s, CreateAPIKeyURL, pushKey), "expected unlisted endpoints to require the admin scope")
+	testutil.ExpectEquals(t, http.StatusOK, authorizeAPIKey(s, AddDeliveryPointToServiceURL, adminKey), "expected the admin scope to allow every endpoint")
+
+	reads := database.reads
+	authorizeAPIKey(s, PushNotificationURL, pushKey)
+	testutil.ExpectEquals(t, reads, database.reads, "expected verified keys to be cached")
+
+	disabled, _ := newTestAPIKeyStore(false)
+	testutil.ExpectEquals(t, http.StatusOK, authorizeAPIKey(disabled, AddPushServiceProviderToServiceURL, ""), "expected every request to be allowed when API keys are disabled")
+	testutil.ExpectEquals(t, http.StatusOK, authorizeAPIKey(nil, AddPushServiceProviderToServiceURL, ""), "expected every request to be allowed without a store")
+}
+
+func TestAPIKeyRoles(t *testing.T) {
+	s, _ := newTestAPIKeyStore(true)
+	_, viewerKey, err := s.Create("support", []string{APIKeyScopeViewer}, "", AuditRecord{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, operatorKey, err := s.Create("oncall", []string{APIKeyScopeOperator}, "", AuditRecord{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectEquals(t, http.StatusOK, authorizeAPIKey(s, QuerySubscribersURL, viewerKey), "expected viewers to read subscribers")
+	testutil.ExpectEquals(t, http.StatusOK, authorizeAPIKey(s, QueryBroadcastsURL, viewerKey), "expected viewers to read broadcasts")
+	testutil.ExpectEquals(t, http.StatusForbidden, authorizeAPIKey(s, BroadcastURL, viewerKey), "expected viewers not to run broadcasts")
+	testutil.ExpectEquals(t, http.StatusForbidden, authorizeAPIKey(s, PushNotificationURL, viewerKey), "expected viewers not to push")
+
+	testutil.ExpectEquals(t, http.StatusOK, authorizeAPIKey(s, QuerySubscribersURL, operatorKey), "expected operators to have the endpoints of viewers")
+	testutil.ExpectEquals(t, http.StatusOK, authorizeAPIKey(s, BroadcastURL, operatorKey), "expected operators to run broadcasts")
+	testutil.ExpectEquals(t, http.StatusOK, authorizeAPIKey(s, ReleaseQuarantineURL, operatorKey), "expected operators to release quarantined payloads")
+	testutil.ExpectEquals(t, http.StatusForbidden, authorizeAPIKey(s, AddPushServiceProviderToServiceURL, operatorKey), "expected operators not to change push service providers")
+	testutil.ExpectEquals(t, http.StatusForbidden, authorizeAPIKey(s, CreateAPIKeyURL, operatorKey), "expected operators not to manage API keys")
+}
+
+func TestRotateAndRevokeAPIKey(t *testing.T) {
+	s, database := newTestAPIKeyStore(true)
+	now := time.Unix(1500000000, 0)
+	s.now = func() time.Time { return now }
+	key, oldKey, err := s.Create("backend", []string{APIKeyScopePush}, "", AuditRecord{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, newKey, err := s.Rotate(key.ID, time.Hour, AuditRecord{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectEquals(t, http.StatusOK, authorizeAPIKey(s, PushNotificationURL, newKey), "expected the new key to be valid")
+	testutil.ExpectEquals(t, http.StatusOK, authorizeAPIKey(s, PushNotificationURL, oldKey), "expected the previous key to be valid during the grace period")
+	now = now.Add(2 * time.Hour)
+	testutil.ExpectEquals(t, http.StatusUnauthorized, authorizeAPIKey(s, PushNotificationURL, oldKey), "expected the previous key to expire after the grace period")
+
+	if _, err := s.Revoke(key.ID, AuditRecord{}); err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectEquals(t, http.StatusUnauthorized, authorizeAPIKey(s, PushNotificationURL, newKey), "expected revoked keys to be rejected immediately")
+	if _, _, err := s.Rotate(key.ID, 0, AuditRecord{}); err == nil {
+		t.Error("expected revoked keys not to be rotated")
+	}
+	testutil.ExpectEquals(t, 3, len(database.records), "expected each successful change to be audited")
+	var newest AuditRecord
+	if err := json.Unmarshal(database.records[0], &newest); err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectStringEquals(t, AuditRevokeAPIKey, newest.Action, "expected the revocation to be audited")
+}
+
+func TestAdminAPIKeys(t *testing.T) {
+	s, _ := newTestAPIKeyStore(true)
+	handler := newAdminHandler(AdminConfig{Addr: "localhost:0", Token: "secret"}, nil, nil, nil, s, nil, nil, nil, nil, nil)
+	type responseType struct {
+		APIKeys  []APIKey `json:"apiKeys"`
+		Key      string   `json:"key"`
+		ErrorMsg string   `json:"errorMsg"`
+		Code     string   `json:"code"`
+	}
+	get := func(path string) responseType {
+		req := httptest.NewRequest("POST", path, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		var response responseType
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatalf("invalid response %s: %v", w.Body.String(), err)
+		}
+		return response
+	}
+	testutil.ExpectStringEquals(t, UNIQUSH_ERROR_GENERIC, get(CreateAPIKeyURL+"?name=x&scopes=root").Code, "expected unknown scopes to be rejected")
+	created := get(CreateAPIKeyURL + "?name=backend&scopes=push,subscribe")
+	testutil.ExpectStringEquals(t, UNIQUSH_SUCCESS, created.Code, "unexpected error: "+created.ErrorMsg)
+	testutil.ExpectEquals(t, []string{APIKeyScopePush, APIKeyScopeSubscribe}, created.APIKeys[0].Scopes, "expected the scopes of the key")
+	testutil.ExpectEquals(t, http.StatusOK, authorizeAPIKey(s, TrackOpenURL, created.Key), "expected the created key to be valid")
+
+	listed := get(QueryAPIKeysURL)
+	testutil.ExpectEquals(t, 1, len(listed.APIKeys), "expected the key to be listed")
+	testutil.ExpectStringEquals(t, "", listed.Key, "expected keys not to be included in the list")
+	testutil.ExpectStringEquals(t, UNIQUSH_ERROR_GENERIC, get(RotateAPIKeyURL+"?id="+created.APIKeys[0].ID+"&grace=-1").Code, "expected negative grace periods to be rejected")
+	testutil.ExpectStringEquals(t, UNIQUSH_SUCCESS, get(RevokeAPIKeyURL+"?id="+created.APIKeys[0].ID).Code, "expected the key to be revoked")
+	testutil.ExpectEquals(t, http.StatusUnauthorized, authorizeAPIKey(s, TrackOpenURL, created.Key), "expected the revoked key to be rejected")
+}
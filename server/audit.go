@@ -0,0 +1,304 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/uniqush/log"
+	"github.com/uniqush/uniqush-push/db"
+	"github.com/uniqush/uniqush-push/push"
+)
+
+const (
+	defaultAuditMaxRecords = 100000
+	// defaultAuditQueryLimit is the number of records returned by /audit if limit isn't given.
+	defaultAuditQueryLimit = 100
+	// maxAuditQueryLimit is the most records which can be returned by /audit at once.
+	maxAuditQueryLimit = 1000
+	// auditPageSize is the number of records read from the database at once when searching the audit log.
+	auditPageSize = 500
+	// auditCompactionInterval is how often the records older than the retention are removed.
+	auditCompactionInterval = time.Hour
+)
+
+// Actions of audit records.
+const (
+	AuditAddPSP            = "addpsp"
+	AuditModifyPSP         = "modifypsp"
+	AuditRemovePSP         = "rmpsp"
+	AuditAddFallbackPSP    = "addfallbackpsp"
+	AuditRemoveFallbackPSP = "rmfallbackpsp"
+	AuditReconcile         = "reconcile"
+	AuditRebuildServiceSet = "rebuildserviceset"
+)
+
+// AuditConfig is a representation of the settings in the [Audit] section of uniqush.conf.
+type AuditConfig struct {
+	// MaxRecords is the number of records kept in the audit log. 0 disables the audit log.
+	MaxRecords int
+	// Retention is how long records are kept. 0 keeps them until they are pushed out by MaxRecords.
+	Retention time.Duration
+}
+
+// AuditChange is the value of a field of a push service provider before and after an operation.
+// The values of secrets (e.g. apikey) are replaced by their fingerprints.
+type AuditChange struct {
+	Old string `json:"old,omitempty"`
+	New string `json:"new,omitempty"`
+}
+
+// AuditRecord describes an administrative operation: what was changed, by whom, and when.
+type AuditRecord struct {
+	// Date is the unix timestamp of the operation.
+	Date   int64  `json:"date"`
+	Action string `json:"action"`
+	From   string `json:"from"`
+	// APIKey is the fingerprint of the credentials in the Authorization header of the request, which identifies the caller without revealing them.
+	APIKey              string                 `json:"apiKey,omitempty"`
+	Service             string                 `json:"service,omitempty"`
+	PushServiceProvider string                 `json:"pushServiceProvider,omitempty"`
+	Changes             map[string]AuditChange `json:"changes,omitempty"`
+	Code                string                 `json:"code"`
+	ErrorMsg            string                 `json:"errorMsg,omitempty"`
+}
+
+// auditFilter selects the records returned by /audit. Empty fields match every record.
+type auditFilter struct {
+	service string
+	action  string
+	apiKey  string
+	// since is the unix timestamp of the oldest record to return.
+	since int64
+	limit int
+}
+
+func (f auditFilter) matches(record AuditRecord) bool {
+	return (f.service == "" || f.service == record.Service) &&
+		(f.action == "" || f.action == record.Action) &&
+		(f.apiKey == "" || f.apiKey == record.APIKey)
+}
+
+// auditLog saves records of administrative operations in the database, for compliance and incident forensics.
+type auditLog struct {
+	db     db.PushDatabase
+	conf   AuditConfig
+	logger log.Logger
+	now    func() time.Time
+}
+
+func newAuditLog(database db.PushDatabase, conf AuditConfig, logger log.Logger) *auditLog {
+	if conf.MaxRecords <= 0 {
+		return nil
+	}
+	a := &auditLog{
+		db:     database,
+		conf:   conf,
+		logger: logger,
+		now:    time.Now,
+	}
+	if conf.Retention > 0 {
+		go a.runCompaction()
+	}
+	return a
+}
+
+func (a *auditLog) runCompaction() {
+	for range time.Tick(auditCompactionInterval) {
+		a.compact()
+	}
+}
+
+// compact removes the records older than Retention from the end of the audit log, one page at a time.
+func (a *auditLog) compact() {
+	cutoff := a.now().Add(-a.conf.Retention).Unix()
+	var removed int64
+	for {
+		data, err := a.db.GetAuditRecords(-auditPageSize, -1)
+		if err != nil {
+			a.logger.Errorf("Cannot compact the audit log: %v", err)
+			break
+		}
+		// data is newest first, so the expired records are at the end.
+		var expired int64
+		for i := len(data) - 1; i >= 0; i-- {
+			var record AuditRecord
+			if err := json.Unmarshal(data[i], &record); err == nil && record.Date >= cutoff {
+				break
+			}
+			expired++
+		}
+		if expired == 0 {
+			break
+		}
+		if err := a.db.TrimAuditRecords(expired); err != nil {
+			a.logger.Errorf("Cannot compact the audit log: %v", err)
+			break
+		}
+		removed += expired
+		if expired < int64(len(data)) || len(data) < auditPageSize {
+			break
+		}
+	}
+	if removed > 0 {
+		a.logger.Infof("Removed %d audit records older than %v", removed, a.conf.Retention)
+	}
+}
+
+// auditAPIKey returns the fingerprint of the credentials in the Authorization header of r (without the scheme, e.g. "Bearer"), or "" if there are none.
+func auditAPIKey(r *http.Request) string {
+	auth := strings.TrimSpace(r.Header.Get("Authorization"))
+	if auth == "" {
+		return ""
+	}
+	if i := strings.IndexByte(auth, ' '); i >= 0 {
+		auth = strings.TrimSpace(auth[i+1:])
+	}
+	return auditFingerprint(auth)
+}
+
+// auditFingerprint returns "sha256:" and the first 16 hex digits of the SHA-256 hash of a secret.
+func auditFingerprint(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return "sha256:" + hex.EncodeToString(sum[:8])
+}
+
+// isSecretField returns true for the fields of push service providers which are credentials (e.g. apikey, clientsecret, token).
+// They are the fields which are encrypted in the database if credential_key is set.
+func isSecretField(name string) bool {
+	return db.IsCredentialField(name)
+}
+
+func auditValue(name, value string) string {
+	if value == "" || !isSecretField(name) {
+		return value
+	}
+	return auditFingerprint(value)
+}
+
+// diffFields returns the fields whose values differ between before and after, with secrets replaced by their fingerprints.
+func diffFields(before, after map[string]string) map[string]AuditChange {
+	changes := make(map[string]AuditChange)
+	for name, old := range before {
+		if value := after[name]; value != old {
+			changes[name] = AuditChange{Old: auditValue(name, old), New: auditValue(name, value)}
+		}
+	}
+	for name, value := range after {
+		if _, ok := before[name]; !ok && value != "" {
+			changes[name] = AuditChange{New: auditValue(name, value)}
+		}
+	}
+	return changes
+}
+
+// changePushServiceProvider calls change, which adds or removes psp, and records it along with the fields it changed.
+// Adding a push service provider which is already saved is recorded as AuditModifyPSP. Removing a fallback only removes the link to it, so no fields are recorded.
+func (a *auditLog) changePushServiceProvider(record AuditRecord, psp *push.PushServiceProvider, add bool, change func() error) error {
+	if a == nil {
+		return change()
+	}
+	pspName := psp.Name()
+	var before map[string]string
+	if psps, err := a.db.GetPushServiceProviders([]string{pspName}); err != nil {
+		a.logger.Warnf("From=%v Service=%v PushServiceProvider=%v Cannot load the saved push service provider, recording every field as changed: %v", record.From, record.Service, pspName, err)
+	} else if saved, ok := psps[pspName]; ok {
+		before = encodePSPForAPI(saved)
+	}
+	err := change()
+	record.PushServiceProvider = pspName
+	switch {
+	case add:
+		if record.Action == AuditAddPSP && before != nil {
+			record.Action = AuditModifyPSP
+		}
+		record.Changes = diffFields(before, encodePSPForAPI(psp))
+	case record.Action == AuditRemovePSP:
+		if before == nil {
+			before = encodePSPForAPI(psp)
+		}
+		record.Changes = diffFields(before, nil)
+	}
+	record.Code = UNIQUSH_SUCCESS
+	if err != nil {
+		record.Code = UNIQUSH_ERROR_GENERIC
+		record.ErrorMsg = err.Error()
+	}
+	a.add(record)
+	return err
+}
+
+// add saves a record. Records are saved before responding, so that an operation which succeeded is always in the audit log unless the database failed.
+func (a *auditLog) add(record AuditRecord) {
+	if a == nil {
+		return
+	}
+	if record.Date == 0 {
+		record.Date = a.now().Unix()
+	}
+	b, err := json.Marshal(record)
+	if err == nil {
+		err = a.db.AddAuditRecord(b, int64(a.conf.MaxRecords))
+	}
+	if err != nil {
+		a.logger.Errorf("Action=%v From=%v Service=%v PushServiceProvider=%v Cannot save audit record: %v", record.Action, record.From, record.Service, record.PushServiceProvider, err)
+	}
+}
+
+// Records returns the saved records matching filter, newest first. Records older than Retention aren't returned, even if they haven't been compacted yet.
+func (a *auditLog) Records(filter auditFilter) ([]AuditRecord, error) {
+	records := []AuditRecord{}
+	if a == nil {
+		return records, nil
+	}
+	if a.conf.Retention > 0 {
+		if cutoff := a.now().Add(-a.conf.Retention).Unix(); cutoff > filter.since {
+			filter.since = cutoff
+		}
+	}
+	for start := int64(0); start < int64(a.conf.MaxRecords); start += auditPageSize {
+		data, err := a.db.GetAuditRecords(start, start+auditPageSize-1)
+		if err != nil {
+			return nil, err
+		}
+		for _, b := range data {
+			var record AuditRecord
+			if err := json.Unmarshal(b, &record); err != nil {
+				a.logger.Errorf("Invalid audit record: %v", err)
+				continue
+			}
+			if record.Date < filter.since {
+				return records, nil
+			}
+			if filter.matches(record) {
+				records = append(records, record)
+				if len(records) >= filter.limit {
+					return records, nil
+				}
+			}
+		}
+		if len(data) < auditPageSize {
+			break
+		}
+	}
+	return records, nil
+}
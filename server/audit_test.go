@@ -0,0 +1,134 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/uniqush/log"
+	"github.com/uniqush/uniqush-push/db"
+	"github.com/uniqush/uniqush-push/testutil"
+)
+
+// auditDatabase keeps the audit log in memory, newest first. Other methods aren't implemented.
+type auditDatabase struct {
+	db.PushDatabase
+	records [][]byte
+}
+
+func (d *auditDatabase) AddAuditRecord(record []byte, maxRecords int64) error {
+	d.records = append([][]byte{record}, d.records...)
+	if int64(len(d.records)) > maxRecords {
+		d.records = d.records[:maxRecords]
+	}
+	return nil
+}
+
+func (d *auditDatabase) GetAuditRecords(start, stop int64) ([][]byte, error) {
+	n := int64(len(d.records))
+	// Negative indexes count from the end, like LRANGE.
+	if start < 0 {
+		start += n
+		if start < 0 {
+			start = 0
+		}
+	}
+	if stop < 0 {
+		stop += n
+	}
+	if start >= n || stop < start {
+		return nil, nil
+	}
+	if stop >= n {
+		stop = n - 1
+	}
+	return d.records[start : stop+1], nil
+}
+
+func (d *auditDatabase) TrimAuditRecords(n int64) error {
+	if n > int64(len(d.records)) {
+		n = int64(len(d.records))
+	}
+	d.records = d.records[:int64(len(d.records))-n]
+	return nil
+}
+
+func TestDiffFields(t *testing.T) {
+	before := map[string]string{"service": "srv", "apikey": "old", "addr": "https://a"}
+	after := map[string]string{"service": "srv", "apikey": "new", "skipverify": "true"}
+	changes := diffFields(before, after)
+	expected := map[string]AuditChange{
+		"apikey":     {Old: auditFingerprint("old"), New: auditFingerprint("new")},
+		"addr":       {Old: "https://a"},
+		"skipverify": {New: "true"},
+	}
+	testutil.ExpectEquals(t, expected, changes, "expected the changed fields, with secrets fingerprinted")
+	testutil.ExpectEquals(t, 0, len(diffFields(before, before)), "expected no changes")
+}
+
+func TestAuditAPIKey(t *testing.T) {
+	r, _ := http.NewRequest("POST", "/addpsp", nil)
+	testutil.ExpectStringEquals(t, "", auditAPIKey(r), "expected no api key without an Authorization header")
+	r.Header.Set("Authorization", "Bearer secret")
+	testutil.ExpectStringEquals(t, auditFingerprint("secret"), auditAPIKey(r), "expected the fingerprint of the credentials")
+	r.Header.Set("Authorization", "secret")
+	testutil.ExpectStringEquals(t, auditFingerprint("secret"), auditAPIKey(r), "expected credentials without a scheme to be fingerprinted")
+}
+
+func TestAuditRecords(t *testing.T) {
+	database := &auditDatabase{}
+	logger := log.NewLogger(ioutil.Discard, "", log.LOGLEVEL_SILENT)
+	a := newAuditLog(database, AuditConfig{MaxRecords: 3}, logger)
+	now := time.Unix(1500000000, 0)
+	a.now = func() time.Time { return now }
+	for i, action := range []string{AuditAddPSP, AuditReconcile, AuditModifyPSP, AuditRemovePSP} {
+		now = time.Unix(1500000000+int64(i), 0)
+		a.add(AuditRecord{Action: action, From: "127.0.0.1", APIKey: auditFingerprint("key"), Service: "srv", Code: UNIQUSH_SUCCESS})
+	}
+	testutil.ExpectEquals(t, 3, len(database.records), "expected the oldest record to be trimmed")
+	var newest AuditRecord
+	if err := json.Unmarshal(database.records[0], &newest); err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectEquals(t, int64(1500000003), newest.Date, "expected the date to be set")
+
+	records, err := a.Records(auditFilter{limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectEquals(t, 3, len(records), "expected every record")
+	testutil.ExpectStringEquals(t, AuditRemovePSP, records[0].Action, "expected the newest record first")
+
+	records, _ = a.Records(auditFilter{action: AuditReconcile, limit: 10})
+	testutil.ExpectEquals(t, 1, len(records), "expected records to be filtered by action")
+	records, _ = a.Records(auditFilter{since: 1500000002, limit: 10})
+	testutil.ExpectEquals(t, 2, len(records), "expected records to be filtered by date")
+	records, _ = a.Records(auditFilter{limit: 1})
+	testutil.ExpectEquals(t, 1, len(records), "expected records to be limited")
+	records, _ = a.Records(auditFilter{apiKey: auditFingerprint("other"), limit: 10})
+	testutil.ExpectEquals(t, 0, len(records), "expected records to be filtered by api key")
+}
+
+func TestAuditRetention(t *testing.T) {
+	database := &auditDatabase{}
+	logger := log.NewLogger(ioutil.Discard, "", log.LOGLEVEL_SILENT)
+	a := newAuditLog(database, AuditConfig{MaxRecords: 2000, Retention: 24 * time.Hour}, logger)
+	now := time.Unix(1500000000, 0)
+	a.now = func() time.Time { return now }
+	// More expired records than fit in a page, then one which is recent enough to keep.
+	for i := 0; i < auditPageSize+10; i++ {
+		a.add(AuditRecord{Action: AuditReconcile, Code: UNIQUSH_SUCCESS})
+	}
+	now = now.Add(24 * time.Hour)
+	a.add(AuditRecord{Action: AuditAddPSP, Code: UNIQUSH_SUCCESS})
+	now = now.Add(time.Hour)
+
+	records, _ := a.Records(auditFilter{limit: maxAuditQueryLimit})
+	testutil.ExpectEquals(t, 1, len(records), "expected expired records not to be returned before compaction")
+	a.compact()
+	testutil.ExpectEquals(t, 1, len(database.records), "expected expired records to be removed")
+	a.compact()
+	testutil.ExpectEquals(t, 1, len(database.records), "expected records within the retention to be kept")
+}
@@ -0,0 +1,97 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultBackpressureRetryAfter = 5 * time.Second
+)
+
+// BackpressureConfig is a representation of the settings in the [Backpressure] section of uniqush.conf.
+type BackpressureConfig struct {
+	// MaxInflightPushes is the number of pushes (from /push and /broadcast) being sent at once, above which new pushes are rejected. 0 means unlimited.
+	MaxInflightPushes int
+	// MaxQueuedDeliveryRecords is the number of delivery records waiting to be saved, above which new pushes are rejected. 0 means unlimited.
+	MaxQueuedDeliveryRecords int
+	// RetryAfter is sent in the Retry-After header of rejected requests.
+	RetryAfter time.Duration
+}
+
+// QueueDepths is a snapshot of the internal queues of uniqush-push, returned by /queue.
+type QueueDepths struct {
+	InflightPushes           int64 `json:"inflightPushes"`
+	MaxInflightPushes        int   `json:"maxInflightPushes"`
+	QueuedDeliveryRecords    int   `json:"queuedDeliveryRecords"`
+	MaxQueuedDeliveryRecords int   `json:"maxQueuedDeliveryRecords"`
+	Overloaded               bool  `json:"overloaded"`
+}
+
+// backpressure keeps track of the pushes in progress, so that clients can be asked to slow down (with HTTP 429) instead of timing out.
+type backpressure struct {
+	conf     BackpressureConfig
+	history  *deliveryHistory
+	inflight int64
+}
+
+func newBackpressure(conf BackpressureConfig, history *deliveryHistory) *backpressure {
+	return &backpressure{
+		conf:    conf,
+		history: history,
+	}
+}
+
+// begin records that a push started. end must be called when it finishes.
+func (b *backpressure) begin() {
+	if b != nil {
+		atomic.AddInt64(&b.inflight, 1)
+	}
+}
+
+func (b *backpressure) end() {
+	if b != nil {
+		atomic.AddInt64(&b.inflight, -1)
+	}
+}
+
+// Depths returns the current depths of the queues, and whether new pushes would be rejected.
+func (b *backpressure) Depths() QueueDepths {
+	if b == nil {
+		return QueueDepths{}
+	}
+	depths := QueueDepths{
+		InflightPushes:           atomic.LoadInt64(&b.inflight),
+		MaxInflightPushes:        b.conf.MaxInflightPushes,
+		QueuedDeliveryRecords:    b.history.queued(),
+		MaxQueuedDeliveryRecords: b.conf.MaxQueuedDeliveryRecords,
+	}
+	depths.Overloaded = (depths.MaxInflightPushes > 0 && depths.InflightPushes >= int64(depths.MaxInflightPushes)) ||
+		(depths.MaxQueuedDeliveryRecords > 0 && depths.QueuedDeliveryRecords >= depths.MaxQueuedDeliveryRecords)
+	return depths
+}
+
+// Overloaded returns true (and how long clients should wait before retrying) if new pushes should be rejected.
+func (b *backpressure) Overloaded() (time.Duration, bool) {
+	if b == nil || !b.Depths().Overloaded {
+		return 0, false
+	}
+	return b.conf.RetryAfter, true
+}
@@ -0,0 +1,53 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/uniqush/uniqush-push/testutil"
+)
+
+func TestBackpressure(t *testing.T) {
+	b := newBackpressure(BackpressureConfig{MaxInflightPushes: 2, RetryAfter: 3 * time.Second}, nil)
+	b.begin()
+	_, overloaded := b.Overloaded()
+	testutil.ExpectEquals(t, false, overloaded, "expected pushes to be accepted below the limit")
+	b.begin()
+	retryAfter, overloaded := b.Overloaded()
+	testutil.ExpectEquals(t, true, overloaded, "expected pushes to be rejected at the limit")
+	testutil.ExpectEquals(t, 3*time.Second, retryAfter, "expected the configured retry_after")
+	testutil.ExpectEquals(t, QueueDepths{InflightPushes: 2, MaxInflightPushes: 2, Overloaded: true}, b.Depths(), "expected queue depths")
+	b.end()
+	_, overloaded = b.Overloaded()
+	testutil.ExpectEquals(t, false, overloaded, "expected pushes to be accepted after a push finished")
+}
+
+func TestBackpressureUnlimited(t *testing.T) {
+	b := newBackpressure(BackpressureConfig{}, nil)
+	for i := 0; i < 100; i++ {
+		b.begin()
+	}
+	_, overloaded := b.Overloaded()
+	testutil.ExpectEquals(t, false, overloaded, "expected a limit of 0 to be unlimited")
+
+	var disabled *backpressure
+	disabled.begin()
+	testutil.ExpectEquals(t, QueueDepths{}, disabled.Depths(), "expected nil backpressure to be safe to use")
+}
@@ -0,0 +1,307 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/uniqush/log"
+	"github.com/uniqush/uniqush-push/db"
+	"github.com/uniqush/uniqush-push/push"
+)
+
+// benchPushServiceName is the push service type of the delivery points registered by `uniqush-push bench`.
+const benchPushServiceName = "bench"
+
+// benchPushServiceType pretends to send pushes, taking latency for each delivery point, so that benchmarks measure uniqush-push rather than external push services.
+type benchPushServiceType struct {
+	latency time.Duration
+	workers *push.WorkerPool
+	msgID   uint64
+}
+
+var _ push.PushServiceType = &benchPushServiceType{}
+
+func newBenchPushServiceType(latency time.Duration) *benchPushServiceType {
+	return &benchPushServiceType{
+		latency: latency,
+		workers: push.NewWorkerPool(push.DefaultPushWorkers),
+	}
+}
+
+func (pst *benchPushServiceType) Name() string {
+	return benchPushServiceName
+}
+
+func (pst *benchPushServiceType) BuildPushServiceProviderFromMap(kv map[string]string, psp *push.PushServiceProvider) error {
+	if service, ok := kv["service"]; ok && len(service) > 0 {
+		psp.FixedData["service"] = service
+	} else {
+		return errors.New("NoService")
+	}
+	return nil
+}
+
+func (pst *benchPushServiceType) BuildDeliveryPointFromMap(kv map[string]string, dp *push.DeliveryPoint) error {
+	err := dp.AddCommonData(kv)
+	if err != nil {
+		return err
+	}
+	if token, ok := kv["token"]; ok && len(token) > 0 {
+		dp.FixedData["token"] = token
+	} else {
+		return errors.New("NoToken")
+	}
+	return nil
+}
+
+func (pst *benchPushServiceType) Push(psp *push.PushServiceProvider, dpQueue <-chan *push.DeliveryPoint, resQueue chan<- *push.Result, notif *push.Notification) {
+	wg := new(sync.WaitGroup)
+	for dp := range dpQueue {
+		dp := dp
+		wg.Add(1)
+		pst.workers.Go(func() {
+			defer wg.Done()
+			if pst.latency > 0 {
+				time.Sleep(pst.latency)
+			}
+			res := push.NewResult()
+			res.Provider = psp
+			res.Destination = dp
+			res.Content = notif
+			res.MsgID = fmt.Sprintf("%s:%d", benchPushServiceName, atomic.AddUint64(&pst.msgID, 1))
+			resQueue <- res
+		})
+	}
+	wg.Wait()
+	close(resQueue)
+}
+
+func (pst *benchPushServiceType) Preview(notif *push.Notification) ([]byte, push.Error) {
+	data, err := json.Marshal(notif.Data)
+	if err != nil {
+		return nil, push.NewErrorf("Failed to encode the notification: %v", err)
+	}
+	return data, nil
+}
+
+func (pst *benchPushServiceType) SetErrorReportChan(errChan chan<- push.Error) {}
+
+func (pst *benchPushServiceType) SetPushServiceConfig(c *push.PushServiceConfig) {
+	pst.workers = push.NewWorkerPoolFromConfig(c)
+}
+
+func (pst *benchPushServiceType) Finalize() {}
+
+// benchOptions are the flags of `uniqush-push bench`.
+type benchOptions struct {
+	service            string
+	subscribers        int
+	pushes             int
+	subscribersPerPush int
+	concurrency        int
+	latency            time.Duration
+	keep               bool
+}
+
+func parseBenchOptions(args []string) (benchOptions, error) {
+	var opts benchOptions
+	flags := flag.NewFlagSet("bench", flag.ContinueOnError)
+	flags.StringVar(&opts.service, "service", "uniqush-bench", "Service to register the synthetic subscribers of")
+	flags.IntVar(&opts.subscribers, "subscribers", 10000, "Number of subscribers to register, each with one delivery point")
+	flags.IntVar(&opts.pushes, "pushes", 10000, "Number of pushes to send")
+	flags.IntVar(&opts.subscribersPerPush, "subscribers-per-push", 1, "Number of subscribers each push is sent to")
+	flags.IntVar(&opts.concurrency, "concurrency", 64, "Number of subscriptions or pushes sent at once")
+	flags.DurationVar(&opts.latency, "latency", 0, "Simulated latency of the push service for each delivery point")
+	flags.BoolVar(&opts.keep, "keep", false, "Keep the synthetic subscribers and push service provider afterwards")
+	if err := flags.Parse(args); err != nil {
+		return opts, err
+	}
+	if opts.subscribers <= 0 || opts.pushes <= 0 || opts.subscribersPerPush <= 0 || opts.concurrency <= 0 {
+		return opts, errors.New("-subscribers, -pushes, -subscribers-per-push and -concurrency must be positive")
+	}
+	if opts.subscribersPerPush > opts.subscribers {
+		return opts, fmt.Errorf("-subscribers-per-push must be at most -subscribers (%d)", opts.subscribers)
+	}
+	return opts, nil
+}
+
+// benchResponseHandler counts the delivery points which pushes succeeded and failed for.
+type benchResponseHandler struct {
+	successes *int64
+	failures  *int64
+}
+
+var _ APIResponseHandler = &benchResponseHandler{}
+
+func (h *benchResponseHandler) AddDetailsToHandler(v APIResponseDetails) {
+	if v.Code == UNIQUSH_SUCCESS {
+		atomic.AddInt64(h.successes, 1)
+	} else {
+		atomic.AddInt64(h.failures, 1)
+	}
+}
+
+func (h *benchResponseHandler) ToJSON() []byte {
+	return nil
+}
+
+// RunBench registers synthetic delivery points of the bench push service type in the database of the config file,
+// sends pushes to them, and writes the throughput and latency percentiles of subscribing and pushing to w.
+func RunBench(conf string, args []string, w io.Writer) error {
+	opts, err := parseBenchOptions(args)
+	if err != nil {
+		return err
+	}
+	c, err := OpenConfig(conf)
+	if err != nil {
+		return err
+	}
+	dbconf, err := LoadDatabaseConfig(c)
+	if err != nil {
+		return err
+	}
+	psm := push.GetPushServiceManager()
+	if err := psm.RegisterPushServiceType(newBenchPushServiceType(opts.latency)); err != nil {
+		return err
+	}
+	psm.SetConfigFile(c)
+	database, err := db.NewPushDatabase(dbconf)
+	if err != nil {
+		return err
+	}
+	// Logging every push would measure the log files rather than uniqush-push.
+	loggers := make([]log.Logger, NumberOfLoggers)
+	for i := range loggers {
+		loggers[i] = log.NewLogger(ioutil.Discard, "", log.LOGLEVEL_SILENT)
+	}
+	backend := NewPushBackEnd(psm, database, loggers)
+
+	psp, err := psm.BuildPushServiceProviderFromMap(map[string]string{"service": opts.service, "pushservicetype": benchPushServiceName})
+	if err != nil {
+		return err
+	}
+	if err := backend.AddPushServiceProvider(opts.service, psp); err != nil {
+		return fmt.Errorf("Failed to add the push service provider: %v", err)
+	}
+
+	subs := make([]string, opts.subscribers)
+	dps := make([]*push.DeliveryPoint, opts.subscribers)
+	for i := range subs {
+		subs[i] = fmt.Sprintf("bench%d", i)
+		dps[i], err = psm.BuildDeliveryPointFromMap(map[string]string{
+			"service":         opts.service,
+			"subscriber":      subs[i],
+			"pushservicetype": benchPushServiceName,
+			"token":           fmt.Sprintf("token%d", i),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	var failedSubscriptions int64
+	elapsed, latencies := runBenchConcurrently(opts.subscribers, opts.concurrency, func(i int) {
+		if _, err := backend.Subscribe(opts.service, subs[i], dps[i]); err != nil {
+			atomic.AddInt64(&failedSubscriptions, 1)
+		}
+	})
+	writeBenchReport(w, "subscribe", opts.subscribers, elapsed, latencies)
+	if failedSubscriptions > 0 {
+		fmt.Fprintf(w, "  %d subscriptions failed\n", failedSubscriptions)
+	}
+
+	var successes, failures int64
+	handler := &benchResponseHandler{successes: &successes, failures: &failures}
+	elapsed, latencies = runBenchConcurrently(opts.pushes, opts.concurrency, func(i int) {
+		notif := push.NewEmptyNotification()
+		notif.Data["msg"] = "uniqush-push bench"
+		start := (i * opts.subscribersPerPush) % opts.subscribers
+		pushSubs := make([]string, opts.subscribersPerPush)
+		for j := range pushSubs {
+			pushSubs[j] = subs[(start+j)%opts.subscribers]
+		}
+		backend.Push(context.Background(), fmt.Sprintf("bench-%d", i), "bench", opts.service, pushSubs, nil, notif, nil, nil, loggers[LoggerPush], handler)
+	})
+	writeBenchReport(w, "push", opts.pushes, elapsed, latencies)
+	fmt.Fprintf(w, "  %d delivery points pushed to (%.0f/s), %d failed\n", successes, float64(successes)/elapsed.Seconds(), failures)
+
+	if opts.keep {
+		return nil
+	}
+	for i := range subs {
+		if err := backend.Unsubscribe(opts.service, subs[i], dps[i]); err != nil {
+			return fmt.Errorf("Failed to remove subscriber %s: %v", subs[i], err)
+		}
+	}
+	if err := backend.RemovePushServiceProvider(opts.service, psp); err != nil {
+		return fmt.Errorf("Failed to remove the push service provider: %v", err)
+	}
+	return nil
+}
+
+// runBenchConcurrently calls f(0) to f(n-1) on concurrency goroutines, and returns how long that took along with the sorted latencies of each call.
+func runBenchConcurrently(n int, concurrency int, f func(i int)) (time.Duration, []time.Duration) {
+	latencies := make([]time.Duration, n)
+	var next int64 = -1
+	wg := new(sync.WaitGroup)
+	wg.Add(concurrency)
+	start := time.Now()
+	for g := 0; g < concurrency; g++ {
+		go func() {
+			defer wg.Done()
+			for {
+				i := int(atomic.AddInt64(&next, 1))
+				if i >= n {
+					return
+				}
+				callStart := time.Now()
+				f(i)
+				latencies[i] = time.Since(callStart)
+			}
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	return elapsed, latencies
+}
+
+// benchPercentile returns the latency which the fraction p of the sorted latencies are at most.
+func benchPercentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	return sorted[int(p*float64(len(sorted)-1))]
+}
+
+func writeBenchReport(w io.Writer, name string, n int, elapsed time.Duration, sorted []time.Duration) {
+	fmt.Fprintf(w, "%s: %d in %v (%.0f/s)\n", name, n, elapsed, float64(n)/elapsed.Seconds())
+	fmt.Fprintf(w, "  latency p50=%v p90=%v p99=%v max=%v\n",
+		benchPercentile(sorted, 0.5), benchPercentile(sorted, 0.9), benchPercentile(sorted, 0.99), benchPercentile(sorted, 1))
+}
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/uniqush/uniqush-push/push"
+	"github.com/uniqush/uniqush-push/testutil"
+)
+
+func TestBenchPushServiceTypeSendsResultsToEveryDeliveryPoint(t *testing.T) {
+	pst := newBenchPushServiceType(time.Millisecond)
+	dpQueue := make(chan *push.DeliveryPoint)
+	resQueue := make(chan *push.Result)
+	go pst.Push(push.NewEmptyPushServiceProvider(), dpQueue, resQueue, push.NewEmptyNotification())
+	go func() {
+		for i := 0; i < 5; i++ {
+			dpQueue <- push.NewEmptyDeliveryPoint()
+		}
+		close(dpQueue)
+	}()
+	n := 0
+	for res := range resQueue {
+		if res.Err != nil {
+			t.Errorf("Unexpected error: %v", res.Err)
+		}
+		n++
+	}
+	testutil.ExpectEquals(t, 5, n, "expected a result for each delivery point")
+}
+
+func TestBenchPercentile(t *testing.T) {
+	sorted := []time.Duration{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	testutil.ExpectEquals(t, time.Duration(5), benchPercentile(sorted, 0.5), "unexpected p50")
+	testutil.ExpectEquals(t, time.Duration(9), benchPercentile(sorted, 0.99), "unexpected p99")
+	testutil.ExpectEquals(t, time.Duration(10), benchPercentile(sorted, 1), "unexpected max")
+	testutil.ExpectEquals(t, time.Duration(0), benchPercentile(nil, 0.5), "unexpected percentile of no latencies")
+}
+
+func TestParseBenchOptions(t *testing.T) {
+	opts, err := parseBenchOptions([]string{"-subscribers", "100", "-subscribers-per-push", "10", "-latency", "5ms"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectEquals(t, 100, opts.subscribers, "unexpected subscribers")
+	testutil.ExpectEquals(t, 10, opts.subscribersPerPush, "unexpected subscribers per push")
+	testutil.ExpectEquals(t, 5*time.Millisecond, opts.latency, "unexpected latency")
+
+	if _, err := parseBenchOptions([]string{"-subscribers", "1", "-subscribers-per-push", "2"}); err == nil {
+		t.Error("Expected pushing to more subscribers than were registered to be rejected")
+	}
+}
@@ -0,0 +1,491 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/uniqush/log"
+	"github.com/uniqush/uniqush-push/db"
+	"github.com/uniqush/uniqush-push/push"
+)
+
+// States of a broadcast
+const (
+	BroadcastRunning   = "running"
+	BroadcastPaused    = "paused"
+	BroadcastCancelled = "cancelled"
+	BroadcastDone      = "done"
+)
+
+const (
+	broadcastLeasePrefix      = "broadcast:"
+	defaultBroadcastBatchSize = 500
+	// maxBroadcastSpread is the longest duration a broadcast can be spread over with uniqush.spread.
+	maxBroadcastSpread = 24 * time.Hour
+)
+
+// Broadcast is a push to every subscriber of a service matching a pattern.
+// Its progress is saved after each batch of subscribers, so that it can be resumed by any instance if the instance sending it stops.
+type Broadcast struct {
+	ID          string            `json:"id"`
+	Service     string            `json:"service"`
+	Subscribers string            `json:"subscribers"`
+	Data        map[string]string `json:"data"`
+	RetryPolicy *RetryPolicy      `json:"retryPolicy,omitempty"`
+	State       string            `json:"state"`
+	// APIKey is the fingerprint of the credentials which started the broadcast (see auditAPIKey), to which its notifications are metered.
+	APIKey string `json:"apiKey,omitempty"`
+	// Cursor is the position of the next batch of subscribers to push to.
+	Cursor uint64 `json:"cursor"`
+	// NrSubscribers is the number of subscribers pushed to so far. This may include duplicates, if a batch was sent again after resuming.
+	NrSubscribers int64 `json:"nrSubscribers"`
+	// Spread is the number of seconds after Created over which the pushes are spread, each subscriber at a random time. If 0, pushes are sent as fast as possible.
+	Spread int64 `json:"spread,omitempty"`
+	// Total is the number of subscribers counted before the broadcast starts, used to give each batch its share of the spread and to report progress.
+	Total   int64  `json:"total,omitempty"`
+	Created int64  `json:"created"`
+	Updated int64  `json:"updated"`
+	Error   string `json:"error,omitempty"`
+}
+
+// broadcaster sends broadcasts in batches, saving a checkpoint after each batch.
+// Every instance periodically resumes active broadcasts which no instance is sending, so at most one instance sends a broadcast at a time.
+type broadcaster struct {
+	backend   *PushBackEnd
+	db        db.PushDatabase
+	jobs      *jobRunner
+	retention time.Duration
+	batchSize int64
+	logger    log.Logger
+	// pushSubscribers pushes a notification of the broadcast to a batch of its subscribers. It is replaced in tests.
+	pushSubscribers func(b *Broadcast, subs []string, notif *push.Notification, logger log.Logger, handler APIResponseHandler)
+
+	mutex    sync.Mutex
+	running  map[string]bool
+	stopped  bool
+	stopChan chan struct{}
+	// sending is used to wait for broadcasts being sent by this instance to save their checkpoint when stopping.
+	sending sync.WaitGroup
+}
+
+func newBroadcaster(backend *PushBackEnd, database db.PushDatabase, jobs *jobRunner, retention time.Duration, logger log.Logger) *broadcaster {
+	return &broadcaster{
+		backend:   backend,
+		db:        database,
+		jobs:      jobs,
+		retention: retention,
+		batchSize: defaultBroadcastBatchSize,
+		logger:    logger,
+		pushSubscribers: func(b *Broadcast, subs []string, notif *push.Notification, logger log.Logger, handler APIResponseHandler) {
+			backend.Push(context.Background(), b.ID, "broadcast", b.Service, subs, nil, notif, nil, b.RetryPolicy, logger, handler)
+		},
+		running:  make(map[string]bool),
+		stopChan: make(chan struct{}),
+	}
+}
+
+// Start saves a new broadcast and starts sending it in the background.
+// If spread isn't 0, the pushes are spread over that duration, so that the service's own backend isn't overwhelmed by users opening the app at the same time.
+func (bc *broadcaster) Start(service, subscribers string, notif *push.Notification, retryPolicy *RetryPolicy, spread time.Duration, apiKey string) (*Broadcast, error) {
+	now := time.Now().Unix()
+	b := &Broadcast{
+		ID:          randomUniqID(),
+		Service:     service,
+		Subscribers: subscribers,
+		Data:        notif.Data,
+		RetryPolicy: retryPolicy,
+		Spread:      int64(spread / time.Second),
+		State:       BroadcastRunning,
+		APIKey:      apiKey,
+		Created:     now,
+		Updated:     now,
+	}
+	if err := bc.save(b); err != nil {
+		return nil, err
+	}
+	go bc.resume(b.ID)
+	return b, nil
+}
+
+// Get returns the state of a broadcast, or nil if it doesn't exist (or finished longer than the retention period ago).
+func (bc *broadcaster) Get(id string) (*Broadcast, error) {
+	data, err := bc.db.GetBroadcast(id)
+	if err != nil || data == nil {
+		return nil, err
+	}
+	b := new(Broadcast)
+	if err := json.Unmarshal(data, b); err != nil {
+		return nil, fmt.Errorf("Invalid broadcast %s: %v", id, err)
+	}
+	return b, nil
+}
+
+// Active returns the state of every broadcast which hasn't finished.
+func (bc *broadcaster) Active() ([]*Broadcast, error) {
+	ids, err := bc.db.GetActiveBroadcasts()
+	if err != nil {
+		return nil, err
+	}
+	broadcasts := make([]*Broadcast, 0, len(ids))
+	for _, id := range ids {
+		b, err := bc.Get(id)
+		if err != nil {
+			return nil, err
+		}
+		if b != nil {
+			broadcasts = append(broadcasts, b)
+		}
+	}
+	return broadcasts, nil
+}
+
+// Pause stops sending a running broadcast after its current batch, until it is resumed with Resume.
+func (bc *broadcaster) Pause(id string) (*Broadcast, error) {
+	return bc.control(id, BroadcastPaused, BroadcastRunning)
+}
+
+// Cancel stops sending a running or paused broadcast after its current batch. It can't be resumed.
+func (bc *broadcaster) Cancel(id string) (*Broadcast, error) {
+	return bc.control(id, BroadcastCancelled, BroadcastRunning, BroadcastPaused)
+}
+
+// Resume continues sending a paused broadcast from its last batch, or undoes a pause which wasn't applied yet.
+func (bc *broadcaster) Resume(id string) (*Broadcast, error) {
+	b, err := bc.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if b == nil {
+		return nil, fmt.Errorf("No broadcast with id %s", id)
+	}
+	if b.State != BroadcastRunning && b.State != BroadcastPaused {
+		return nil, fmt.Errorf("Cannot resume a broadcast which is %s", b.State)
+	}
+	if err := bc.db.RemoveBroadcastControl(id); err != nil {
+		return nil, err
+	}
+	if b.State == BroadcastPaused {
+		b.State = BroadcastRunning
+		b.Updated = time.Now().Unix()
+		if err := bc.save(b); err != nil {
+			return nil, err
+		}
+	}
+	go bc.resume(id)
+	return b, nil
+}
+
+// control requests a state change of a broadcast in one of the states from. The instance sending the broadcast applies it after its current batch.
+// If no instance is sending it, this instance applies it right away.
+func (bc *broadcaster) control(id, state string, from ...string) (*Broadcast, error) {
+	b, err := bc.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if b == nil {
+		return nil, fmt.Errorf("No broadcast with id %s", id)
+	}
+	allowed := false
+	for _, s := range from {
+		allowed = allowed || b.State == s
+	}
+	if !allowed {
+		return nil, fmt.Errorf("Cannot change a broadcast which is %s to %s", b.State, state)
+	}
+	if err := bc.db.SetBroadcastControl(id, state, bc.retention); err != nil {
+		return nil, err
+	}
+	go bc.resume(id)
+	return b, nil
+}
+
+// ResumeAll resumes every active broadcast assigned to this instance by the cluster which isn't being sent by any instance.
+func (bc *broadcaster) ResumeAll() {
+	ids, err := bc.db.GetActiveBroadcasts()
+	if err != nil {
+		bc.logger.Errorf("Cannot list active broadcasts: %v", err)
+		return
+	}
+	for _, id := range ids {
+		if bc.backend.cluster.Owns(broadcastLeasePrefix + id) {
+			go bc.resume(id)
+		}
+	}
+}
+
+// Run resumes broadcasts left behind by stopped instances every interval, until Stop is called.
+func (bc *broadcaster) Run(interval time.Duration) {
+	bc.ResumeAll()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-bc.stopChan:
+			return
+		case <-ticker.C:
+			bc.ResumeAll()
+		}
+	}
+}
+
+// Stop stops resuming broadcasts. Broadcasts which are being sent stop after their current batch,
+// and Stop waits until the deadline for them to save their checkpoint, so that another instance resumes them from there.
+// Returns false if some broadcasts were still sending at the deadline.
+func (bc *broadcaster) Stop(deadline time.Time) bool {
+	bc.mutex.Lock()
+	if !bc.stopped {
+		bc.stopped = true
+		close(bc.stopChan)
+	}
+	bc.mutex.Unlock()
+	return waitGroupUntil(&bc.sending, deadline)
+}
+
+func (bc *broadcaster) resume(id string) {
+	bc.mutex.Lock()
+	if bc.stopped || bc.running[id] {
+		bc.mutex.Unlock()
+		return
+	}
+	bc.running[id] = true
+	bc.sending.Add(1)
+	bc.mutex.Unlock()
+	defer func() {
+		bc.mutex.Lock()
+		delete(bc.running, id)
+		bc.mutex.Unlock()
+		bc.sending.Done()
+	}()
+
+	_, err := bc.jobs.RunExclusive(broadcastLeasePrefix+id, func(lost <-chan struct{}) {
+		bc.send(id, lost)
+	})
+	if err != nil {
+		bc.logger.Errorf("BroadcastID=%v Cannot claim broadcast: %v", id, err)
+	}
+}
+
+// send pushes to the remaining subscribers of the broadcast, one batch at a time, saving the cursor after each batch.
+// If this instance stops in the middle of a batch, that batch will be sent again when the broadcast is resumed.
+func (bc *broadcaster) send(id string, lost <-chan struct{}) {
+	// Reload the broadcast now that the lease is held, in case another instance made progress.
+	b, err := bc.Get(id)
+	if err != nil {
+		bc.logger.Errorf("BroadcastID=%v Cannot load broadcast: %v", id, err)
+		return
+	}
+	if b == nil || b.State == BroadcastDone || b.State == BroadcastCancelled {
+		return
+	}
+	if bc.applyControl(b) || b.State != BroadcastRunning {
+		return
+	}
+	notif := push.NewEmptyNotification()
+	notif.Data = b.Data
+	logger := bc.backend.loggers[LoggerPush]
+	handler := bc.backend.usage.Wrap(b.APIKey, bc.backend.history.Wrap(&NullAPIResponseHandler{}))
+	if b.Cursor == 0 && b.NrSubscribers == 0 {
+		bc.logger.Infof("BroadcastID=%v Service=%v Subscribers=%v Start", b.ID, b.Service, b.Subscribers)
+		if b.Total == 0 {
+			if b.Total, err = bc.count(b); err != nil {
+				// Leave the broadcast active, so that it is retried later.
+				bc.logger.Errorf("BroadcastID=%v Cannot count subscribers: %v", b.ID, err)
+				return
+			}
+			if b.Spread > 0 {
+				bc.logger.Infof("BroadcastID=%v Total=%v Spread=%v Spreading pushes", b.ID, b.Total, time.Duration(b.Spread)*time.Second)
+			}
+			if err := bc.backend.tenants.broadcastTooLarge(b.Service, b.Total); err != nil {
+				bc.logger.Errorf("BroadcastID=%v Service=%v Total=%v Cancelled: %v", b.ID, b.Service, b.Total, err)
+				b.State = BroadcastCancelled
+				b.Error = err.Error()
+				b.Updated = time.Now().Unix()
+				if err := bc.save(b); err != nil {
+					bc.logger.Errorf("BroadcastID=%v Cannot save state: %v", b.ID, err)
+				}
+				return
+			}
+			if err := bc.save(b); err != nil {
+				bc.logger.Errorf("BroadcastID=%v Cannot save number of subscribers: %v", b.ID, err)
+				return
+			}
+			// The quota of the tenant was checked when the broadcast was created, so it is only counted here, rather than stopping the broadcast halfway.
+			bc.backend.tenants.countPushes(b.Service, b.Total)
+		}
+	} else {
+		bc.logger.Infof("BroadcastID=%v Service=%v Subscribers=%v Cursor=%v NrSubscribers=%v Resume", b.ID, b.Service, b.Subscribers, b.Cursor, b.NrSubscribers)
+	}
+	for {
+		select {
+		case <-lost:
+			bc.logger.Warnf("BroadcastID=%v Cursor=%v Stopping: lost lease", b.ID, b.Cursor)
+			return
+		case <-bc.stopChan:
+			bc.logger.Infof("BroadcastID=%v Cursor=%v NrSubscribers=%v Stopping: shutting down", b.ID, b.Cursor, b.NrSubscribers)
+			return
+		default:
+		}
+		if bc.applyControl(b) {
+			return
+		}
+		subs, next, err := bc.db.ScanSubscribersOfService(b.Service, b.Subscribers, b.Cursor, bc.batchSize)
+		if err != nil {
+			// Leave the broadcast active, so that it is retried later.
+			bc.logger.Errorf("BroadcastID=%v Cursor=%v Cannot list subscribers: %v", b.ID, b.Cursor, err)
+			b.Error = err.Error()
+			bc.save(b)
+			return
+		}
+		if len(subs) > 0 && !bc.pushBatch(b, subs, notif, logger, handler, lost) {
+			// Stopped in the middle of a spread batch. The batch will be sent again when the broadcast is resumed.
+			continue
+		}
+		b.NrSubscribers += int64(len(subs))
+		b.Cursor = next
+		b.Updated = time.Now().Unix()
+		b.Error = ""
+		if next == 0 {
+			b.State = BroadcastDone
+		}
+		if err := bc.save(b); err != nil {
+			bc.logger.Errorf("BroadcastID=%v Cursor=%v Cannot save checkpoint: %v", b.ID, b.Cursor, err)
+			return
+		}
+		if b.State == BroadcastDone {
+			bc.logger.Infof("BroadcastID=%v Service=%v Subscribers=%v NrSubscribers=%v Done", b.ID, b.Service, b.Subscribers, b.NrSubscribers)
+			bc.backend.webhooks.Emit(WebhookEvent{Type: WebhookBroadcastCompleted, Service: b.Service, RequestID: b.ID, NrSubscribers: b.NrSubscribers})
+			return
+		}
+	}
+}
+
+// applyControl applies a requested state change (pause or cancel) to the broadcast being sent by this instance.
+// Returns true if the broadcast must stop being sent.
+func (bc *broadcaster) applyControl(b *Broadcast) bool {
+	control, err := bc.db.GetBroadcastControl(b.ID)
+	if err != nil {
+		bc.logger.Errorf("BroadcastID=%v Cannot check for pause or cancellation: %v", b.ID, err)
+		return false
+	}
+	if control == "" {
+		return false
+	}
+	b.State = control
+	b.Updated = time.Now().Unix()
+	if err := bc.save(b); err != nil {
+		// Leave the request, so that it is applied when the broadcast is resumed.
+		bc.logger.Errorf("BroadcastID=%v State=%v Cannot save state: %v", b.ID, control, err)
+		return true
+	}
+	if err := bc.db.RemoveBroadcastControl(b.ID); err != nil {
+		bc.logger.Errorf("BroadcastID=%v Cannot remove applied state change: %v", b.ID, err)
+	}
+	bc.logger.Infof("BroadcastID=%v Service=%v Cursor=%v NrSubscribers=%v State=%v", b.ID, b.Service, b.Cursor, b.NrSubscribers, b.State)
+	return true
+}
+
+// pushBatch pushes to a batch of subscribers. If the broadcast is spread, the batch's pushes are spread over the batch's share of the spread,
+// each subscriber at a random second. Returns false if the lease was lost or this instance is stopping before the whole batch was pushed.
+func (bc *broadcaster) pushBatch(b *Broadcast, subs []string, notif *push.Notification, logger log.Logger, handler APIResponseHandler, lost <-chan struct{}) bool {
+	// Batches wait while the tenant of the service has as many pushes in progress as its max_queued_pushes.
+	if !bc.backend.tenants.waitForQueue(b.Service, lost, bc.stopChan) {
+		return false
+	}
+	if b.Spread <= 0 {
+		bc.pushSubscribers(b, subs, notif, logger, handler)
+		return true
+	}
+	start, end := b.batchWindow(int64(len(subs)))
+	subsByTime := make(map[int64][]string)
+	for _, sub := range subs {
+		at := start + rand.Int63n(end-start+1)
+		subsByTime[at] = append(subsByTime[at], sub)
+	}
+	times := make([]int64, 0, len(subsByTime))
+	for at := range subsByTime {
+		times = append(times, at)
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+	for _, at := range times {
+		if wait := time.Until(time.Unix(at, 0)); wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-lost:
+				timer.Stop()
+				return false
+			case <-bc.stopChan:
+				timer.Stop()
+				return false
+			case <-timer.C:
+			}
+		}
+		bc.pushSubscribers(b, subsByTime[at], notif, logger, handler)
+	}
+	return true
+}
+
+// batchWindow returns the unix timestamps between which the next n subscribers of a spread broadcast are pushed to.
+// Subscribers added after the broadcast counted its subscribers are pushed to before the end of the spread.
+func (b *Broadcast) batchWindow(n int64) (int64, int64) {
+	last := b.Created + b.Spread
+	if b.Total <= 0 {
+		return last, last
+	}
+	start := b.Created + b.Spread*b.NrSubscribers/b.Total
+	end := b.Created + b.Spread*(b.NrSubscribers+n)/b.Total
+	if start > last {
+		start = last
+	}
+	if end > last {
+		end = last
+	}
+	return start, end
+}
+
+// count returns the number of subscribers of a broadcast.
+func (bc *broadcaster) count(b *Broadcast) (int64, error) {
+	var total int64
+	var cursor uint64
+	for {
+		subs, next, err := bc.db.ScanSubscribersOfService(b.Service, b.Subscribers, cursor, bc.batchSize)
+		if err != nil {
+			return 0, err
+		}
+		total += int64(len(subs))
+		if next == 0 {
+			return total, nil
+		}
+		cursor = next
+	}
+}
+
+func (bc *broadcaster) save(b *Broadcast) error {
+	data, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+	// Paused broadcasts stay active, so that they are listed by /broadcasts and don't expire.
+	return bc.db.SaveBroadcast(b.ID, data, b.State == BroadcastRunning || b.State == BroadcastPaused, bc.retention)
+}
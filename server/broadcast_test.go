@@ -0,0 +1,326 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/uniqush/log"
+	"github.com/uniqush/uniqush-push/db"
+	"github.com/uniqush/uniqush-push/push"
+	"github.com/uniqush/uniqush-push/testutil"
+)
+
+// broadcastDatabase keeps broadcasts, their controls and leases in memory, and lists a fixed set of subscribers. Other methods aren't implemented.
+type broadcastDatabase struct {
+	db.PushDatabase
+	mutex       sync.Mutex
+	subscribers []string
+	broadcasts  map[string][]byte
+	active      map[string]bool
+	controls    map[string]string
+	leases      map[string]string
+}
+
+func newBroadcastDatabase(subscribers ...string) *broadcastDatabase {
+	return &broadcastDatabase{
+		subscribers: subscribers,
+		broadcasts:  make(map[string][]byte),
+		active:      make(map[string]bool),
+		controls:    make(map[string]string),
+		leases:      make(map[string]string),
+	}
+}
+
+func (d *broadcastDatabase) ScanSubscribersOfService(service, pattern string, cursor uint64, count int64) ([]string, uint64, error) {
+	end := cursor + uint64(count)
+	if end >= uint64(len(d.subscribers)) {
+		return d.subscribers[cursor:], 0, nil
+	}
+	return d.subscribers[cursor:end], end, nil
+}
+
+func (d *broadcastDatabase) SaveBroadcast(id string, data []byte, active bool, ttl time.Duration) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.broadcasts[id] = data
+	d.active[id] = active
+	return nil
+}
+
+func (d *broadcastDatabase) GetBroadcast(id string) ([]byte, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.broadcasts[id], nil
+}
+
+func (d *broadcastDatabase) SetBroadcastControl(id, control string, ttl time.Duration) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.controls[id] = control
+	return nil
+}
+
+func (d *broadcastDatabase) GetBroadcastControl(id string) (string, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.controls[id], nil
+}
+
+func (d *broadcastDatabase) RemoveBroadcastControl(id string) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	delete(d.controls, id)
+	return nil
+}
+
+func (d *broadcastDatabase) AcquireLease(name, owner string, ttl time.Duration) (bool, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if holder, ok := d.leases[name]; ok && holder != owner {
+		return false, nil
+	}
+	d.leases[name] = owner
+	return true, nil
+}
+
+func (d *broadcastDatabase) RenewLease(name, owner string, ttl time.Duration) (bool, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.leases[name] == owner, nil
+}
+
+func (d *broadcastDatabase) ReleaseLease(name, owner string) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.leases[name] == owner {
+		delete(d.leases, name)
+	}
+	return nil
+}
+
+// newTestBroadcaster returns a broadcaster sending batches of 2 subscribers, which records the subscribers it pushes to in pushed.
+func newTestBroadcaster(database *broadcastDatabase, pushed *[]string) *broadcaster {
+	logger := log.NewLogger(ioutil.Discard, "", log.LOGLEVEL_SILENT)
+	loggers := make([]log.Logger, NumberOfLoggers)
+	for i := range loggers {
+		loggers[i] = logger
+	}
+	bc := newBroadcaster(&PushBackEnd{loggers: loggers}, database, newJobRunner(database, JobConfig{LeaseTTL: time.Hour, Retention: time.Hour}, logger), time.Hour, logger)
+	bc.batchSize = 2
+	bc.pushSubscribers = func(b *Broadcast, subs []string, notif *push.Notification, logger log.Logger, handler APIResponseHandler) {
+		*pushed = append(*pushed, subs...)
+	}
+	return bc
+}
+
+func newTestBroadcast(t *testing.T, bc *broadcaster) *Broadcast {
+	b := &Broadcast{ID: "broadcast1", Service: "myservice", Subscribers: "*", Data: map[string]string{"msg": "hello"}, State: BroadcastRunning, Created: 1500000000, Updated: 1500000000}
+	if err := bc.save(b); err != nil {
+		t.Fatalf("Cannot save the broadcast: %v", err)
+	}
+	return b
+}
+
+func getTestBroadcast(t *testing.T, bc *broadcaster, id string) *Broadcast {
+	b, err := bc.Get(id)
+	if err != nil || b == nil {
+		t.Fatalf("Cannot get the broadcast: %v", err)
+	}
+	return b
+}
+
+func TestBroadcastBatchWindow(t *testing.T) {
+	b := &Broadcast{Created: 1000, Spread: 1800, Total: 3000}
+	start, end := b.batchWindow(500)
+	testutil.ExpectEquals(t, int64(1000), start, "expected the first batch to start when the broadcast was created")
+	testutil.ExpectEquals(t, int64(1300), end, "expected the first batch to get its share of the spread")
+
+	b.NrSubscribers = 2500
+	start, end = b.batchWindow(1000)
+	testutil.ExpectEquals(t, int64(2500), start, "unexpected start of the last batch")
+	testutil.ExpectEquals(t, int64(2800), end, "expected subscribers added after counting to be pushed before the end of the spread")
+
+	b.Total = 0
+	start, end = b.batchWindow(10)
+	testutil.ExpectEquals(t, int64(2800), start, "expected uncounted subscribers to be pushed at the end of the spread")
+	testutil.ExpectEquals(t, int64(2800), end, "expected uncounted subscribers to be pushed at the end of the spread")
+}
+
+func TestBroadcastResumesFromCheckpoint(t *testing.T) {
+	subscribers := []string{"user1", "user2", "user3", "user4", "user5", "user6", "user7"}
+	database := newBroadcastDatabase(subscribers...)
+	var pushed []string
+	first := newTestBroadcaster(database, &pushed)
+	nrBatches := 0
+	first.pushSubscribers = func(b *Broadcast, subs []string, notif *push.Notification, logger log.Logger, handler APIResponseHandler) {
+		pushed = append(pushed, subs...)
+		nrBatches++
+		if nrBatches == 2 {
+			// The instance starts shutting down while sending the second batch.
+			first.mutex.Lock()
+			first.stopped = true
+			close(first.stopChan)
+			first.mutex.Unlock()
+		}
+	}
+	b := newTestBroadcast(t, first)
+	first.resume(b.ID)
+
+	b = getTestBroadcast(t, first, b.ID)
+	testutil.ExpectStringEquals(t, BroadcastRunning, b.State, "expected a stopped broadcast to stay active")
+	testutil.ExpectEquals(t, uint64(4), b.Cursor, "expected the checkpoint to be saved after the batch in progress")
+	testutil.ExpectEquals(t, int64(4), b.NrSubscribers, "unexpected number of subscribers pushed before stopping")
+	testutil.ExpectEquals(t, int64(len(subscribers)), b.Total, "expected the subscribers to be counted")
+	testutil.ExpectEquals(t, true, database.active[b.ID], "expected a stopped broadcast to be resumed later")
+	testutil.ExpectEquals(t, 0, len(database.leases), "expected the lease to be released when stopping")
+
+	second := newTestBroadcaster(database, &pushed)
+	second.resume(b.ID)
+	b = getTestBroadcast(t, second, b.ID)
+	testutil.ExpectStringEquals(t, BroadcastDone, b.State, "expected the broadcast to be finished by another instance")
+	testutil.ExpectEquals(t, int64(len(subscribers)), b.NrSubscribers, "unexpected number of subscribers pushed")
+	testutil.ExpectEquals(t, subscribers, pushed, "expected every subscriber to be pushed to exactly once")
+	testutil.ExpectEquals(t, false, database.active[b.ID], "expected a finished broadcast not to be active")
+
+	second.resume(b.ID)
+	testutil.ExpectEquals(t, subscribers, pushed, "expected a finished broadcast not to be sent again")
+}
+
+func TestBroadcastLostLeaseResumesFromCheckpoint(t *testing.T) {
+	subscribers := []string{"user1", "user2", "user3", "user4", "user5"}
+	database := newBroadcastDatabase(subscribers...)
+	var pushed []string
+	first := newTestBroadcaster(database, &pushed)
+	b := newTestBroadcast(t, first)
+	lost := make(chan struct{})
+	first.pushSubscribers = func(b *Broadcast, subs []string, notif *push.Notification, logger log.Logger, handler APIResponseHandler) {
+		pushed = append(pushed, subs...)
+		// The lease expires while the first batch is sent, e.g. because redis was unreachable.
+		close(lost)
+	}
+	first.send(b.ID, lost)
+
+	b = getTestBroadcast(t, first, b.ID)
+	testutil.ExpectEquals(t, uint64(2), b.Cursor, "expected the checkpoint of the batch which was sent to be saved")
+
+	second := newTestBroadcaster(database, &pushed)
+	second.resume(b.ID)
+	testutil.ExpectStringEquals(t, BroadcastDone, getTestBroadcast(t, second, b.ID).State, "expected the broadcast to be finished by another instance")
+	testutil.ExpectEquals(t, subscribers, pushed, "expected every subscriber to be pushed to exactly once")
+}
+
+// waitForBroadcastState waits for a control request which is applied in the background to change the state of the broadcast.
+func waitForBroadcastState(t *testing.T, bc *broadcaster, id, state string) *Broadcast {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		b := getTestBroadcast(t, bc, id)
+		if b.State == state {
+			return b
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the broadcast to be %s, but it is %s", state, b.State)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// pauseTestBroadcast sends the first batch of a new broadcast, pausing it while that batch is sent.
+func pauseTestBroadcast(t *testing.T, bc *broadcaster, pushed *[]string) *Broadcast {
+	b := newTestBroadcast(t, bc)
+	bc.pushSubscribers = func(b *Broadcast, subs []string, notif *push.Notification, logger log.Logger, handler APIResponseHandler) {
+		*pushed = append(*pushed, subs...)
+		if len(*pushed) == len(subs) {
+			if _, err := bc.Pause(b.ID); err != nil {
+				t.Errorf("Unexpected error pausing the broadcast: %v", err)
+			}
+		}
+	}
+	bc.resume(b.ID)
+	b = getTestBroadcast(t, bc, b.ID)
+	testutil.ExpectStringEquals(t, BroadcastPaused, b.State, "expected the broadcast to be paused after its current batch")
+	testutil.ExpectEquals(t, uint64(2), b.Cursor, "expected the checkpoint of the current batch to be saved")
+	return b
+}
+
+func TestBroadcastPauseResume(t *testing.T) {
+	subscribers := []string{"user1", "user2", "user3", "user4", "user5"}
+	database := newBroadcastDatabase(subscribers...)
+	var pushed []string
+	bc := newTestBroadcaster(database, &pushed)
+	b := pauseTestBroadcast(t, bc, &pushed)
+	testutil.ExpectEquals(t, []string{"user1", "user2"}, pushed, "expected no push after pausing")
+	testutil.ExpectEquals(t, true, database.active[b.ID], "expected a paused broadcast to stay active")
+	testutil.ExpectEquals(t, "", database.controls[b.ID], "expected the applied pause to be removed")
+	if _, err := bc.Pause(b.ID); err == nil {
+		t.Error("Expected a paused broadcast not to be paused again")
+	}
+
+	if _, err := bc.Resume(b.ID); err != nil {
+		t.Fatalf("Unexpected error resuming the broadcast: %v", err)
+	}
+	b = waitForBroadcastState(t, bc, b.ID, BroadcastDone)
+	testutil.ExpectEquals(t, int64(len(subscribers)), b.NrSubscribers, "unexpected number of subscribers pushed")
+	testutil.ExpectEquals(t, subscribers, pushed, "expected the broadcast to resume after the last batch sent before pausing")
+}
+
+func TestBroadcastPauseCancel(t *testing.T) {
+	database := newBroadcastDatabase("user1", "user2", "user3", "user4", "user5")
+	var pushed []string
+	bc := newTestBroadcaster(database, &pushed)
+	b := pauseTestBroadcast(t, bc, &pushed)
+
+	if _, err := bc.Cancel(b.ID); err != nil {
+		t.Fatalf("Unexpected error cancelling the broadcast: %v", err)
+	}
+	b = waitForBroadcastState(t, bc, b.ID, BroadcastCancelled)
+	testutil.ExpectEquals(t, uint64(2), b.Cursor, "expected cancelling not to send the rest of the broadcast")
+	testutil.ExpectEquals(t, false, database.active[b.ID], "expected a cancelled broadcast not to be active")
+	if _, err := bc.Resume(b.ID); err == nil {
+		t.Error("Expected a cancelled broadcast not to be resumed")
+	}
+	bc.resume(b.ID)
+	testutil.ExpectEquals(t, []string{"user1", "user2"}, pushed, "expected a cancelled broadcast not to be sent")
+}
+
+func TestBroadcastControlOfFinishedOrUnknownBroadcast(t *testing.T) {
+	database := newBroadcastDatabase("user1")
+	var pushed []string
+	bc := newTestBroadcaster(database, &pushed)
+	b := newTestBroadcast(t, bc)
+	bc.resume(b.ID)
+	testutil.ExpectStringEquals(t, BroadcastDone, getTestBroadcast(t, bc, b.ID).State, "expected the broadcast to be finished")
+
+	for _, id := range []string{b.ID, "unknown"} {
+		if _, err := bc.Pause(id); err == nil {
+			t.Errorf("Expected broadcast %s not to be paused", id)
+		}
+		if _, err := bc.Resume(id); err == nil {
+			t.Errorf("Expected broadcast %s not to be resumed", id)
+		}
+		if _, err := bc.Cancel(id); err == nil {
+			t.Errorf("Expected broadcast %s not to be cancelled", id)
+		}
+	}
+	testutil.ExpectEquals(t, 0, len(database.controls), "expected no state change to be requested")
+	testutil.ExpectStringEquals(t, BroadcastDone, getTestBroadcast(t, bc, b.ID).State, "expected the finished broadcast to be left alone")
+	testutil.ExpectEquals(t, []string{"user1"}, pushed, "expected the finished broadcast not to be sent again")
+}
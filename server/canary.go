@@ -0,0 +1,305 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/uniqush/log"
+	"github.com/uniqush/uniqush-push/push"
+)
+
+const (
+	defaultCanarySubscriber  = "uniqush.canary"
+	defaultCanaryMessage     = "uniqush-push canary"
+	defaultCanaryMaxFailures = 3
+)
+
+// Statuses of the push service providers checked by canary pushes.
+const (
+	// CanaryOK means the last canary push through the push service provider was accepted.
+	CanaryOK = "ok"
+	// CanaryFailed means the last canary push through the push service provider failed.
+	CanaryFailed = "failed"
+	// CanaryNoDeliveryPoint means the canary subscriber has never had a delivery point of the push service provider, so it isn't checked.
+	CanaryNoDeliveryPoint = "no_delivery_point"
+)
+
+// CanaryConfig is a representation of the [Canary] section of uniqush.conf.
+type CanaryConfig struct {
+	// Interval is how often a canary push is sent to every service. If 0, no canary pushes are sent.
+	Interval time.Duration
+	// Subscriber is the subscriber of each service whose delivery points receive the canary pushes.
+	Subscriber string
+	// Message is the msg of the canary pushes.
+	Message string
+	// MaxFailures is the number of consecutive failed canary pushes through a push service provider after which an alert is raised.
+	MaxFailures int
+}
+
+// CanaryStatus is the result of the canary pushes through a push service provider.
+type CanaryStatus struct {
+	Service             string `json:"service"`
+	PushServiceProvider string `json:"pushServiceProvider"`
+	// Status is CanaryOK, CanaryFailed or CanaryNoDeliveryPoint.
+	Status string `json:"status"`
+	// LastRun and LastSuccess are the unix timestamps of the last canary push, and of the last one which was accepted.
+	LastRun     int64 `json:"lastRun"`
+	LastSuccess int64 `json:"lastSuccess,omitempty"`
+	// LastError is the error of the last canary push which failed.
+	LastError           string `json:"lastError,omitempty"`
+	ConsecutiveFailures int    `json:"consecutiveFailures"`
+	// Alerting is true from the MaxFailures-th consecutive failure until a canary push is accepted again.
+	Alerting bool `json:"alerting"`
+}
+
+// canary periodically sends a push to the canary subscriber of every service, and alerts when the pushes through a push service provider keep failing,
+// so that a broken path to a push service (e.g. an expired certificate or a revoked key) is noticed before users report it.
+// Each instance sends its own canary pushes, so that a path which only fails from some instances is noticed too.
+type canary struct {
+	backend  *PushBackEnd
+	conf     CanaryConfig
+	webhooks *webhookNotifier
+	logger   log.Logger
+	mutex    sync.Mutex
+	// statuses are keyed by the name of the push service provider.
+	statuses map[string]*CanaryStatus
+	stopChan chan struct{}
+	now      func() time.Time
+}
+
+func newCanary(backend *PushBackEnd, conf CanaryConfig, webhooks *webhookNotifier, logger log.Logger) *canary {
+	if conf.Interval <= 0 {
+		return nil
+	}
+	return &canary{
+		backend:  backend,
+		conf:     conf,
+		webhooks: webhooks,
+		logger:   logger,
+		statuses: make(map[string]*CanaryStatus),
+		stopChan: make(chan struct{}),
+		now:      time.Now,
+	}
+}
+
+// Run sends canary pushes every interval (if this instance is the leader of the cluster), until Stop is called.
+func (c *canary) Run() {
+	ticker := time.NewTicker(c.conf.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stopChan:
+			return
+		case <-ticker.C:
+			if c.backend.cluster.IsLeader() {
+				c.checkAll()
+			}
+		}
+	}
+}
+
+// Stop stops sending canary pushes.
+func (c *canary) Stop() {
+	if c == nil {
+		return
+	}
+	close(c.stopChan)
+}
+
+func (c *canary) checkAll() {
+	psps, err := c.backend.GetPushServiceProviderConfigs()
+	if err != nil {
+		c.logger.Errorf("Cannot list push service providers to send canary pushes to: %v", err)
+		return
+	}
+	services := make(map[string][]string)
+	for _, psp := range psps {
+		service := psp.FixedData["service"]
+		services[service] = append(services[service], psp.Name())
+	}
+	for service, pspNames := range services {
+		select {
+		case <-c.stopChan:
+			return
+		default:
+		}
+		c.check(service, pspNames)
+	}
+}
+
+// canaryResponseHandler collects the results of a canary push by push service provider.
+type canaryResponseHandler struct {
+	mutex sync.Mutex
+	// errors are keyed by the name of the push service provider. The error is "" if every push through it was accepted.
+	errors map[string]string
+	// other is the error of a result without a push service provider (e.g. a database error), if any.
+	other string
+}
+
+var _ APIResponseHandler = &canaryResponseHandler{}
+
+func (h *canaryResponseHandler) AddDetailsToHandler(v APIResponseDetails) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	errorMsg := v.Code
+	if v.ErrorMsg != nil {
+		errorMsg = fmt.Sprintf("%s: %s", v.Code, *v.ErrorMsg)
+	}
+	if v.PushServiceProvider == nil {
+		if v.Code != UNIQUSH_ERROR_NO_DEVICE {
+			h.other = errorMsg
+		}
+		return
+	}
+	pspName := *v.PushServiceProvider
+	if v.Code == UNIQUSH_SUCCESS {
+		// Updates of delivery points are reported as successes without a message id, along with the result of the push.
+		if _, ok := h.errors[pspName]; !ok && v.MessageID != nil {
+			h.errors[pspName] = ""
+		}
+		return
+	}
+	h.errors[pspName] = errorMsg
+}
+
+func (h *canaryResponseHandler) ToJSON() []byte {
+	return nil
+}
+
+// check sends a canary push to the canary subscriber of a service, and updates the statuses of its push service providers.
+func (c *canary) check(service string, pspNames []string) {
+	notif := push.NewEmptyNotification()
+	notif.Data["msg"] = c.conf.Message
+	handler := &canaryResponseHandler{errors: make(map[string]string)}
+	reqID := randomUniqID()
+	c.backend.Push(context.Background(), reqID, "canary", service, []string{c.conf.Subscriber}, nil, notif, nil, nil, c.logger, handler)
+	if handler.other != "" {
+		c.logger.Errorf("RequestID=%v Service=%v Cannot send canary push: %v", reqID, service, handler.other)
+		return
+	}
+	now := c.now().Unix()
+	for _, pspName := range pspNames {
+		errorMsg, checked := handler.errors[pspName]
+		c.update(reqID, service, pspName, now, checked, errorMsg)
+	}
+}
+
+func (c *canary) update(reqID, service, pspName string, now int64, checked bool, errorMsg string) {
+	c.mutex.Lock()
+	status, ok := c.statuses[pspName]
+	if !ok {
+		if !checked {
+			c.statuses[pspName] = &CanaryStatus{Service: service, PushServiceProvider: pspName, Status: CanaryNoDeliveryPoint, LastRun: now}
+			c.mutex.Unlock()
+			return
+		}
+		status = &CanaryStatus{Service: service, PushServiceProvider: pspName}
+		c.statuses[pspName] = status
+	}
+	if !checked && status.Status == CanaryNoDeliveryPoint {
+		status.LastRun = now
+		c.mutex.Unlock()
+		return
+	}
+	if !checked {
+		// The canary delivery point of a push service provider which was checked before was removed, e.g. because the push service invalidated it.
+		errorMsg = fmt.Sprintf("%s: the canary subscriber no longer has a delivery point of this push service provider", UNIQUSH_ERROR_NO_DEVICE)
+	}
+	status.LastRun = now
+	eventType := ""
+	if checked && errorMsg == "" {
+		status.Status = CanaryOK
+		status.LastSuccess = now
+		status.ConsecutiveFailures = 0
+		if status.Alerting {
+			status.Alerting = false
+			eventType = WebhookCanaryRecovered
+		}
+	} else {
+		status.Status = CanaryFailed
+		status.LastError = errorMsg
+		status.ConsecutiveFailures++
+		if !status.Alerting && status.ConsecutiveFailures >= c.conf.MaxFailures {
+			status.Alerting = true
+			eventType = WebhookCanaryFailed
+		}
+	}
+	failures := status.ConsecutiveFailures
+	c.mutex.Unlock()
+
+	switch eventType {
+	case WebhookCanaryFailed:
+		c.logger.Alertf("RequestID=%v Service=%v PushServiceProvider=%v Failures=%v LastError=%q Canary pushes keep failing", reqID, service, pspName, failures, errorMsg)
+	case WebhookCanaryRecovered:
+		c.logger.Infof("RequestID=%v Service=%v PushServiceProvider=%v Canary pushes recovered", reqID, service, pspName)
+	default:
+		if errorMsg != "" {
+			c.logger.Warnf("RequestID=%v Service=%v PushServiceProvider=%v Failures=%v Canary push failed: %v", reqID, service, pspName, failures, errorMsg)
+		}
+		return
+	}
+	c.webhooks.Emit(WebhookEvent{Type: eventType, Service: service, PushServiceProvider: pspName, RequestID: reqID, ErrorMsg: errorMsg, NrFailures: int64(failures)})
+}
+
+// Statuses returns the statuses of the push service providers of a service (or of every service if service is ""), sorted by service and name.
+func (c *canary) Statuses(service string) []CanaryStatus {
+	statuses := []CanaryStatus{}
+	if c == nil {
+		return statuses
+	}
+	c.mutex.Lock()
+	for _, status := range c.statuses {
+		if service == "" || status.Service == service {
+			statuses = append(statuses, *status)
+		}
+	}
+	c.mutex.Unlock()
+	sort.Slice(statuses, func(i, j int) bool {
+		if statuses[i].Service != statuses[j].Service {
+			return statuses[i].Service < statuses[j].Service
+		}
+		return statuses[i].PushServiceProvider < statuses[j].PushServiceProvider
+	})
+	return statuses
+}
+
+// queryCanary returns the statuses of the canary pushes for /canary.
+func (api *RestAPI) queryCanary(kv url.Values) []byte {
+	type responseType struct {
+		Enabled  bool           `json:"enabled"`
+		Statuses []CanaryStatus `json:"statuses"`
+		Code     string         `json:"code"`
+	}
+	r := responseType{
+		Enabled:  api.backend.canary != nil,
+		Statuses: api.backend.canary.Statuses(kv.Get("service")),
+		Code:     UNIQUSH_SUCCESS,
+	}
+	json, err := json.Marshal(r)
+	if err != nil {
+		return []byte("Failed to serialize response")
+	}
+	return json
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/uniqush/log"
+	"github.com/uniqush/uniqush-push/testutil"
+)
+
+func TestCanaryResponseHandler(t *testing.T) {
+	h := &canaryResponseHandler{errors: make(map[string]string)}
+	pspA, pspB, messageID, errorMsg := "apns:a", "fcm:b", "id", "certificate has expired"
+	h.AddDetailsToHandler(APIResponseDetails{PushServiceProvider: &pspA, Code: UNIQUSH_SUCCESS})
+	testutil.ExpectEquals(t, 0, len(h.errors), "expected updates of delivery points not to count as accepted pushes")
+	h.AddDetailsToHandler(APIResponseDetails{PushServiceProvider: &pspA, Code: UNIQUSH_SUCCESS, MessageID: &messageID})
+	h.AddDetailsToHandler(APIResponseDetails{PushServiceProvider: &pspB, Code: UNIQUSH_SUCCESS, MessageID: &messageID})
+	h.AddDetailsToHandler(APIResponseDetails{PushServiceProvider: &pspB, Code: UNIQUSH_ERROR_GENERIC, ErrorMsg: &errorMsg})
+	h.AddDetailsToHandler(APIResponseDetails{PushServiceProvider: &pspB, Code: UNIQUSH_SUCCESS, MessageID: &messageID})
+	h.AddDetailsToHandler(APIResponseDetails{Code: UNIQUSH_ERROR_NO_DEVICE})
+	testutil.ExpectEquals(t, map[string]string{"apns:a": "", "fcm:b": UNIQUSH_ERROR_GENERIC + ": " + errorMsg}, h.errors, "expected a push service provider to fail if any canary push through it failed")
+	testutil.ExpectStringEquals(t, "", h.other, "expected subscribers without delivery points to be reported by push service provider")
+}
+
+func TestCanaryAlerts(t *testing.T) {
+	events := make(chan WebhookEvent, 4)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event WebhookEvent
+		body, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(body, &event)
+		events <- event
+	}))
+	defer server.Close()
+	logger := log.NewLogger(ioutil.Discard, "", log.LOGLEVEL_SILENT)
+	webhooks := newWebhookNotifier(&WebhookConfigs{Default: WebhookConfig{URL: server.URL}, Timeout: time.Second, MaxAttempts: 1}, logger)
+	c := newCanary(nil, CanaryConfig{Interval: time.Minute, MaxFailures: 2}, webhooks, logger)
+
+	c.update("r0", "myservice", "apns:a", 100, true, "")
+	c.update("r0", "myservice", "fcm:b", 100, false, "")
+	expected := []CanaryStatus{
+		{Service: "myservice", PushServiceProvider: "apns:a", Status: CanaryOK, LastRun: 100, LastSuccess: 100},
+		{Service: "myservice", PushServiceProvider: "fcm:b", Status: CanaryNoDeliveryPoint, LastRun: 100},
+	}
+	testutil.ExpectEquals(t, expected, c.Statuses("myservice"), "expected the status of each push service provider")
+
+	c.update("r1", "myservice", "apns:a", 200, true, "UNIQUSH_ERROR_GENERIC: certificate has expired")
+	testutil.ExpectEquals(t, 0, len(events), "expected no alert before max_failures consecutive failures")
+	c.update("r2", "myservice", "apns:a", 300, false, "")
+	c.update("r2", "myservice", "fcm:b", 300, false, "")
+	testutil.ExpectEquals(t, true, webhooks.Flush(time.Now().Add(5*time.Second)), "expected the alert to be sent")
+	event := <-events
+	testutil.ExpectStringEquals(t, WebhookCanaryFailed, event.Type, "expected an alert")
+	testutil.ExpectStringEquals(t, "apns:a", event.PushServiceProvider, "expected the push service provider of the alert")
+	testutil.ExpectStringEquals(t, "r2", event.RequestID, "expected the request id of the last canary push")
+	testutil.ExpectEquals(t, int64(2), event.NrFailures, "expected the number of consecutive failures")
+	statuses := c.Statuses("")
+	testutil.ExpectEquals(t, true, statuses[0].Alerting, "expected the push service provider to be alerting")
+	testutil.ExpectEquals(t, int64(100), statuses[0].LastSuccess, "expected the last accepted canary push")
+	testutil.ExpectEquals(t, CanaryNoDeliveryPoint, statuses[1].Status, "expected push service providers without a canary delivery point not to fail")
+
+	c.update("r3", "myservice", "apns:a", 400, true, "")
+	testutil.ExpectEquals(t, true, webhooks.Flush(time.Now().Add(5*time.Second)), "expected the recovery to be sent")
+	event = <-events
+	testutil.ExpectStringEquals(t, WebhookCanaryRecovered, event.Type, "expected the alert to be cleared")
+	testutil.ExpectEquals(t, 0, len(c.Statuses("otherservice")), "expected statuses to be filtered by service")
+	testutil.ExpectEquals(t, (*canary)(nil), newCanary(nil, CanaryConfig{}, nil, nil), "expected an interval of 0 to disable canary pushes")
+}
@@ -0,0 +1,241 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/uniqush/goconf/conf"
+	"github.com/uniqush/log"
+)
+
+const (
+	defaultChurnWindow          = 10 * time.Minute
+	defaultChurnBaseline        = 144
+	defaultChurnMaxRatio        = 5
+	defaultChurnMinUnsubscribes = 100
+
+	// churnSectionPrefix is the prefix of config sections with the churn thresholds of a single service.
+	churnSectionPrefix = "Churn."
+)
+
+// ChurnThresholds decide when the unsubscribes of a service are anomalous.
+type ChurnThresholds struct {
+	// MaxRatio is the ratio of the unsubscribes during a window to the average of the baseline windows above which an alert is raised. 0 disables alerts.
+	MaxRatio float64
+	// MinUnsubscribes is the number of unsubscribes during a window below which no alert is raised, so that quiet services don't alert on a handful of unsubscribes.
+	MinUnsubscribes int64
+}
+
+// ChurnConfig is a representation of the [Churn] section and [Churn.<service>] sections of uniqush.conf.
+type ChurnConfig struct {
+	// Window is the period over which subscribes and unsubscribes are counted.
+	Window time.Duration
+	// Baseline is the number of windows before the current one which are averaged to get the usual number of unsubscribes.
+	Baseline int
+	Default  ChurnThresholds
+	// ByService is keyed by the service name, which is case sensitive (see serviceSections).
+	ByService map[string]ChurnThresholds
+}
+
+// ForService returns the thresholds of a service.
+func (c ChurnConfig) ForService(service string) ChurnThresholds {
+	if t, ok := c.ByService[service]; ok {
+		return t
+	}
+	return c.Default
+}
+
+// LoadChurnConfig returns a representation of the [Churn] section and [Churn.<service>] sections of uniqush.conf.
+// Service sections override max_ratio and min_unsubscribes, and inherit any settings they don't override from [Churn]. window is in seconds.
+func LoadChurnConfig(c *conf.ConfigFile) (ChurnConfig, error) {
+	config := ChurnConfig{
+		Window:    defaultChurnWindow,
+		Baseline:  defaultChurnBaseline,
+		Default:   ChurnThresholds{MaxRatio: defaultChurnMaxRatio, MinUnsubscribes: defaultChurnMinUnsubscribes},
+		ByService: make(map[string]ChurnThresholds),
+	}
+	if window, err := c.GetInt("Churn", "window"); err == nil {
+		if window <= 0 {
+			return config, fmt.Errorf("[Churn] window must be positive, got %d", window)
+		}
+		config.Window = time.Duration(window) * time.Second
+	}
+	if baseline, err := c.GetInt("Churn", "baseline"); err == nil {
+		if baseline <= 0 {
+			return config, fmt.Errorf("[Churn] baseline must be positive, got %d", baseline)
+		}
+		config.Baseline = baseline
+	}
+	var err error
+	config.Default, err = loadChurnThresholds(c, "Churn", config.Default)
+	if err != nil {
+		return config, err
+	}
+	sections, err := serviceSections(c, churnSectionPrefix)
+	if err != nil {
+		return config, err
+	}
+	for _, s := range sections {
+		config.ByService[s.service], err = loadChurnThresholds(c, s.section, config.Default)
+		if err != nil {
+			return config, err
+		}
+	}
+	return config, nil
+}
+
+func loadChurnThresholds(c *conf.ConfigFile, section string, defaults ChurnThresholds) (ChurnThresholds, error) {
+	t := defaults
+	if s, err := c.GetString(section, "max_ratio"); err == nil && s != "" {
+		ratio, err := strconv.ParseFloat(s, 64)
+		if err != nil || ratio < 0 {
+			return t, fmt.Errorf("[%s] max_ratio must be a number which isn't negative, got %q", section, s)
+		}
+		t.MaxRatio = ratio
+	}
+	if minUnsubscribes, err := c.GetInt(section, "min_unsubscribes"); err == nil {
+		if minUnsubscribes < 0 {
+			return t, fmt.Errorf("[%s] min_unsubscribes must not be negative, got %d", section, minUnsubscribes)
+		}
+		t.MinUnsubscribes = int64(minUnsubscribes)
+	}
+	return t, nil
+}
+
+type churnSlot struct {
+	// index is the number of windows since the unix epoch at the start of the slot.
+	index        int64
+	subscribes   int64
+	unsubscribes int64
+}
+
+type serviceChurn struct {
+	// slots holds the current window and the baseline windows before it.
+	slots []churnSlot
+	// first is the index of the first window of the service, so that the windows before uniqush-push started don't count as windows without unsubscribes.
+	first     int64
+	anomalous bool
+	// lastExceeded is the index of the last window whose unsubscribes exceeded the threshold.
+	lastExceeded int64
+}
+
+// baseline returns the average number of unsubscribes per window in the baseline windows before the window current,
+// and the number of those windows which were tracked.
+func (c *serviceChurn) baseline(current int64) (float64, int64) {
+	start := current - int64(len(c.slots)-1)
+	if start < c.first {
+		start = c.first
+	}
+	windows := current - start
+	if windows <= 0 {
+		return 0, 0
+	}
+	var unsubscribes int64
+	for _, slot := range c.slots {
+		if slot.index >= start && slot.index < current {
+			unsubscribes += slot.unsubscribes
+		}
+	}
+	return float64(unsubscribes) / float64(windows), windows
+}
+
+// churnDetector tracks the subscribes and unsubscribes of each service, and raises an alert (in the log and with the webhook of the service)
+// when the unsubscribes during a window exceed MaxRatio times the trailing baseline, e.g. after an app release which unsubscribes devices by mistake.
+// Alerts are cleared once a whole window passes without exceeding the threshold.
+type churnDetector struct {
+	conf     ChurnConfig
+	webhooks *webhookNotifier
+	logger   log.Logger
+	mutex    sync.Mutex
+	services map[string]*serviceChurn
+	now      func() time.Time
+}
+
+func newChurnDetector(conf ChurnConfig, webhooks *webhookNotifier, logger log.Logger) *churnDetector {
+	if conf.Default.MaxRatio <= 0 {
+		enabled := false
+		for _, t := range conf.ByService {
+			enabled = enabled || t.MaxRatio > 0
+		}
+		if !enabled {
+			return nil
+		}
+	}
+	return &churnDetector{
+		conf:     conf,
+		webhooks: webhooks,
+		logger:   logger,
+		services: make(map[string]*serviceChurn),
+		now:      time.Now,
+	}
+}
+
+// record counts a subscribe or unsubscribe (including delivery points which the push service invalidated) of service, and raises or clears its alert.
+func (d *churnDetector) record(service string, unsubscribe bool) {
+	if d == nil {
+		return
+	}
+	thresholds := d.conf.ForService(service)
+	if thresholds.MaxRatio <= 0 {
+		return
+	}
+	index := d.now().UnixNano() / int64(d.conf.Window)
+	d.mutex.Lock()
+	c, ok := d.services[service]
+	if !ok {
+		c = &serviceChurn{slots: make([]churnSlot, d.conf.Baseline+1), first: index}
+		d.services[service] = c
+	}
+	slot := &c.slots[index%int64(len(c.slots))]
+	if slot.index != index {
+		*slot = churnSlot{index: index}
+	}
+	if unsubscribe {
+		slot.unsubscribes++
+	} else {
+		slot.subscribes++
+	}
+	subscribes, unsubscribes := slot.subscribes, slot.unsubscribes
+	baseline, windows := c.baseline(index)
+	eventType := ""
+	if windows > 0 && unsubscribes >= thresholds.MinUnsubscribes && float64(unsubscribes) > thresholds.MaxRatio*baseline {
+		c.lastExceeded = index
+		if !c.anomalous {
+			c.anomalous = true
+			eventType = WebhookChurnAnomalyDetected
+		}
+	} else if c.anomalous && index > c.lastExceeded+1 {
+		c.anomalous = false
+		eventType = WebhookChurnAnomalyRecovered
+	}
+	d.mutex.Unlock()
+
+	switch eventType {
+	case WebhookChurnAnomalyDetected:
+		d.logger.Alertf("Service=%v Unsubscribes=%v Subscribes=%v Baseline=%.1f Unsubscribes exceeded %v times the average of the last %v windows of %v", service, unsubscribes, subscribes, baseline, thresholds.MaxRatio, windows, d.conf.Window)
+	case WebhookChurnAnomalyRecovered:
+		d.logger.Infof("Service=%v Unsubscribes=%v Subscribes=%v Baseline=%.1f Unsubscribes are back to normal", service, unsubscribes, subscribes, baseline)
+	default:
+		return
+	}
+	d.webhooks.Emit(WebhookEvent{Type: eventType, Service: service, NrUnsubscribes: unsubscribes, NrSubscribes: subscribes, BaselineUnsubscribes: baseline})
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/uniqush/goconf/conf"
+	"github.com/uniqush/log"
+	"github.com/uniqush/uniqush-push/testutil"
+)
+
+func TestChurnAlerts(t *testing.T) {
+	events := make(chan WebhookEvent, 4)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event WebhookEvent
+		body, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(body, &event)
+		events <- event
+	}))
+	defer server.Close()
+	logger := log.NewLogger(ioutil.Discard, "", log.LOGLEVEL_SILENT)
+	webhooks := newWebhookNotifier(&WebhookConfigs{Default: WebhookConfig{URL: server.URL}, Timeout: time.Second, MaxAttempts: 1}, logger)
+
+	config := ChurnConfig{Window: time.Minute, Baseline: 3, Default: ChurnThresholds{MaxRatio: 3, MinUnsubscribes: 5}}
+	d := newChurnDetector(config, webhooks, logger)
+	now := time.Unix(1500000000/60*60, 0)
+	d.now = func() time.Time { return now }
+	record := func(n int, unsubscribe bool) {
+		for i := 0; i < n; i++ {
+			d.record("myservice", unsubscribe)
+		}
+	}
+	record(10, true)
+	testutil.ExpectEquals(t, 0, len(events), "expected no alert without a baseline")
+	for i := 0; i < 3; i++ {
+		now = now.Add(time.Minute)
+		record(2, true)
+		record(5, false)
+	}
+	testutil.ExpectEquals(t, 0, len(events), "expected no alert with fewer than min_unsubscribes unsubscribes")
+
+	// The baseline is (2+2+2)/3 unsubscribes per window.
+	now = now.Add(time.Minute)
+	record(6, true)
+	testutil.ExpectEquals(t, 0, len(events), "expected no alert below max_ratio times the baseline")
+	record(1, true)
+	testutil.ExpectEquals(t, true, webhooks.Flush(time.Now().Add(5*time.Second)), "expected the alert to be sent")
+	event := <-events
+	testutil.ExpectStringEquals(t, WebhookChurnAnomalyDetected, event.Type, "expected an alert")
+	testutil.ExpectStringEquals(t, "myservice", event.Service, "expected the service of the alert")
+	testutil.ExpectEquals(t, int64(7), event.NrUnsubscribes, "expected the unsubscribes of the window")
+	testutil.ExpectEquals(t, 2.0, event.BaselineUnsubscribes, "expected the baseline")
+
+	now = now.Add(time.Minute)
+	record(1, false)
+	testutil.ExpectEquals(t, 0, len(events), "expected the alert to last until a whole window passes below the threshold")
+	now = now.Add(time.Minute)
+	record(1, true)
+	testutil.ExpectEquals(t, true, webhooks.Flush(time.Now().Add(5*time.Second)), "expected the recovery to be sent")
+	event = <-events
+	testutil.ExpectStringEquals(t, WebhookChurnAnomalyRecovered, event.Type, "expected a recovery")
+}
+
+func TestLoadChurnConfigForService(t *testing.T) {
+	c := conf.NewConfigFile()
+	c.AddOption("Churn", "max_ratio", "4")
+	c.AddOption("Churn.MyService", "service", "MyService")
+	c.AddOption("Churn.MyService", "max_ratio", "0")
+	c.AddOption("Churn.Noisy", "min_unsubscribes", "1000")
+	config, err := LoadChurnConfig(c)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	testutil.ExpectEquals(t, ChurnThresholds{MaxRatio: 4, MinUnsubscribes: 100}, config.ForService("other"), "expected the [Churn] section to be used by default")
+	testutil.ExpectEquals(t, ChurnThresholds{MaxRatio: 0, MinUnsubscribes: 100}, config.ForService("MyService"), "expected the [Churn.<service>] section to override max_ratio")
+	testutil.ExpectEquals(t, ChurnThresholds{MaxRatio: 4, MinUnsubscribes: 1000}, config.ForService("noisy"), "expected the [Churn.<service>] section to override min_unsubscribes")
+
+	c.AddOption("Churn.Bad", "max_ratio", "-1")
+	if _, err := LoadChurnConfig(c); err == nil {
+		t.Fatal("expected a negative max_ratio to be rejected")
+	}
+}
@@ -0,0 +1,273 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package server
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/uniqush/log"
+	"github.com/uniqush/uniqush-push/db"
+)
+
+const (
+	clusterLeaderLease = "cluster:leader"
+
+	defaultClusterHeartbeatInterval = 5 * time.Second
+	defaultClusterMemberTTLFactor   = 3
+)
+
+// ClusterConfig is a representation of the [Cluster] section of uniqush.conf.
+type ClusterConfig struct {
+	// Enabled makes the instances sharing the database elect a leader and split broadcasts and reconciliations between themselves.
+	Enabled bool
+	// HeartbeatInterval is how often an instance records that it is alive and renews its leadership.
+	HeartbeatInterval time.Duration
+	// MemberTTL is how long an instance is considered alive after its last heartbeat. If the leader stops, another instance takes over after this long.
+	MemberTTL time.Duration
+}
+
+// ClusterMember is the last heartbeat of a uniqush-push instance in the cluster.
+type ClusterMember struct {
+	ID string `json:"id"`
+	// Started is the unix timestamp when the instance started.
+	Started int64 `json:"started"`
+	// Heartbeat is the unix timestamp of the last heartbeat.
+	Heartbeat int64 `json:"heartbeat"`
+	// Expires is the unix timestamp after which the instance is considered stopped, unless it sends another heartbeat.
+	Expires int64 `json:"expires"`
+	Leader  bool  `json:"leader"`
+}
+
+// cluster coordinates the uniqush-push instances sharing a database, without any other service.
+// Each instance saves a heartbeat in the database, and one of them holds the leader lease.
+// Jobs which only need to run once in the cluster (e.g. committing staged unsubscribes) run on the leader,
+// and work which can be split (e.g. resuming broadcasts) is assigned to the live members by rendezvous hashing.
+type cluster struct {
+	db      db.PushDatabase
+	id      string
+	conf    ClusterConfig
+	logger  log.Logger
+	started time.Time
+
+	mutex   sync.Mutex
+	leader  bool
+	members []ClusterMember
+
+	stopChan chan struct{}
+	now      func() time.Time
+}
+
+// newCluster returns the cluster which this instance (identified like the owner of its job leases) joins, or nil if clustering is disabled.
+func newCluster(database db.PushDatabase, jobs *jobRunner, conf ClusterConfig, logger log.Logger) *cluster {
+	if !conf.Enabled {
+		return nil
+	}
+	return &cluster{
+		db:       database,
+		id:       jobs.owner,
+		conf:     conf,
+		logger:   logger,
+		started:  time.Now(),
+		stopChan: make(chan struct{}),
+		now:      time.Now,
+	}
+}
+
+// Run sends the first heartbeat (so that the members are known before the first job runs), then sends one every heartbeat interval until Stop is called.
+func (c *cluster) Run() {
+	c.heartbeat()
+	go func() {
+		ticker := time.NewTicker(c.conf.HeartbeatInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-c.stopChan:
+				return
+			case <-ticker.C:
+				c.heartbeat()
+			}
+		}
+	}()
+}
+
+// Stop stops sending heartbeats, gives up the leadership and leaves the cluster, so that the other instances take over right away.
+func (c *cluster) Stop() {
+	if c == nil {
+		return
+	}
+	close(c.stopChan)
+	c.mutex.Lock()
+	c.leader = false
+	c.mutex.Unlock()
+	if err := c.db.ReleaseLease(clusterLeaderLease, c.id); err != nil {
+		c.logger.Errorf("Cannot give up the cluster leadership: %v", err)
+	}
+	if err := c.db.RemoveClusterMembers(c.id); err != nil {
+		c.logger.Errorf("Cannot leave the cluster: %v", err)
+	}
+}
+
+// heartbeat claims or renews the leadership, saves the heartbeat of this instance and refreshes the list of live members.
+// The leader also removes the members which stopped sending heartbeats.
+func (c *cluster) heartbeat() {
+	now := c.now()
+	c.mutex.Lock()
+	wasLeader := c.leader
+	c.mutex.Unlock()
+
+	var leader bool
+	var err error
+	if wasLeader {
+		leader, err = c.db.RenewLease(clusterLeaderLease, c.id, c.conf.MemberTTL)
+	} else {
+		leader, err = c.db.AcquireLease(clusterLeaderLease, c.id, c.conf.MemberTTL)
+	}
+	if err != nil {
+		// Another instance may take over once the lease expires, so don't act as the leader until it's renewed.
+		c.logger.Errorf("Cannot claim the cluster leadership: %v", err)
+		leader = false
+	}
+	if leader != wasLeader {
+		if leader {
+			c.logger.Infof("Cluster=%v Became the cluster leader", c.id)
+		} else {
+			c.logger.Warnf("Cluster=%v No longer the cluster leader", c.id)
+		}
+	}
+
+	self := ClusterMember{
+		ID:        c.id,
+		Started:   c.started.Unix(),
+		Heartbeat: now.Unix(),
+		Expires:   now.Add(c.conf.MemberTTL).Unix(),
+		Leader:    leader,
+	}
+	if b, err := json.Marshal(self); err == nil {
+		if err := c.db.SetClusterMember(c.id, b); err != nil {
+			c.logger.Errorf("Cannot save the cluster heartbeat: %v", err)
+		}
+	}
+
+	members := []ClusterMember{self}
+	records, err := c.db.GetClusterMembers()
+	if err != nil {
+		c.logger.Errorf("Cannot list the cluster members: %v", err)
+	}
+	var expired []string
+	for id, b := range records {
+		if id == c.id {
+			continue
+		}
+		var member ClusterMember
+		if err := json.Unmarshal(b, &member); err != nil {
+			c.logger.Errorf("Cluster=%v Invalid cluster member: %v", id, err)
+			continue
+		}
+		if member.Expires < now.Unix() {
+			expired = append(expired, id)
+			continue
+		}
+		members = append(members, member)
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].ID < members[j].ID })
+	if leader && len(expired) > 0 {
+		if err := c.db.RemoveClusterMembers(expired...); err != nil {
+			c.logger.Errorf("Cannot remove stopped cluster members: %v", err)
+		} else {
+			c.logger.Infof("Removed %d stopped cluster members", len(expired))
+		}
+	}
+
+	c.mutex.Lock()
+	c.leader = leader
+	c.members = members
+	c.mutex.Unlock()
+}
+
+// IsLeader returns true if this instance should run the jobs which only need to run once in the cluster.
+// Every instance is the leader if clustering is disabled.
+func (c *cluster) IsLeader() bool {
+	if c == nil {
+		return true
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.leader
+}
+
+// Owns returns true if the work identified by key (e.g. a broadcast id) is assigned to this instance.
+// Each key is assigned to the live member with the highest hash of its id and the key, so that only the keys of members which join or leave are reassigned.
+// Every key is assigned to this instance if clustering is disabled.
+func (c *cluster) Owns(key string) bool {
+	if c == nil {
+		return true
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	var owner string
+	var highest uint64
+	for _, member := range c.members {
+		sum := sha1.Sum([]byte(member.ID + "\x00" + key))
+		if weight := binary.BigEndian.Uint64(sum[:8]); owner == "" || weight > highest {
+			owner, highest = member.ID, weight
+		}
+	}
+	return owner == "" || owner == c.id
+}
+
+// Members returns the live members of the cluster as of the last heartbeat, sorted by id.
+func (c *cluster) Members() []ClusterMember {
+	if c == nil {
+		return nil
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]ClusterMember(nil), c.members...)
+}
+
+func (api *RestAPI) queryCluster() []byte {
+	type responseType struct {
+		Enabled bool            `json:"enabled"`
+		ID      string          `json:"id,omitempty"`
+		Leader  bool            `json:"leader"`
+		Members []ClusterMember `json:"members"`
+		Code    string          `json:"code"`
+	}
+	c := api.backend.cluster
+	r := responseType{
+		Enabled: c != nil,
+		Leader:  c.IsLeader(),
+		Members: c.Members(),
+		Code:    UNIQUSH_SUCCESS,
+	}
+	if c != nil {
+		r.ID = c.id
+	}
+	if r.Members == nil {
+		r.Members = []ClusterMember{}
+	}
+	json, err := json.Marshal(r)
+	if err != nil {
+		return []byte("Failed to serialize response")
+	}
+	return json
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/uniqush/log"
+	"github.com/uniqush/uniqush-push/db"
+	"github.com/uniqush/uniqush-push/testutil"
+)
+
+// clusterDatabase keeps the leases and cluster members in memory. Leases never expire. Other methods aren't implemented.
+type clusterDatabase struct {
+	db.PushDatabase
+	leases  map[string]string
+	members map[string][]byte
+}
+
+func newClusterDatabase() *clusterDatabase {
+	return &clusterDatabase{leases: make(map[string]string), members: make(map[string][]byte)}
+}
+
+func (d *clusterDatabase) AcquireLease(name, owner string, ttl time.Duration) (bool, error) {
+	if holder, ok := d.leases[name]; ok && holder != owner {
+		return false, nil
+	}
+	d.leases[name] = owner
+	return true, nil
+}
+
+func (d *clusterDatabase) RenewLease(name, owner string, ttl time.Duration) (bool, error) {
+	return d.leases[name] == owner, nil
+}
+
+func (d *clusterDatabase) ReleaseLease(name, owner string) error {
+	if d.leases[name] == owner {
+		delete(d.leases, name)
+	}
+	return nil
+}
+
+func (d *clusterDatabase) SetClusterMember(id string, data []byte) error {
+	d.members[id] = data
+	return nil
+}
+
+func (d *clusterDatabase) GetClusterMembers() (map[string][]byte, error) {
+	ret := make(map[string][]byte, len(d.members))
+	for id, data := range d.members {
+		ret[id] = data
+	}
+	return ret, nil
+}
+
+func (d *clusterDatabase) RemoveClusterMembers(ids ...string) error {
+	for _, id := range ids {
+		delete(d.members, id)
+	}
+	return nil
+}
+
+func newTestClusterMember(database *clusterDatabase, id string, now time.Time) *cluster {
+	c := newCluster(database, &jobRunner{owner: id}, ClusterConfig{Enabled: true, HeartbeatInterval: 5 * time.Second, MemberTTL: 15 * time.Second}, log.NewLogger(ioutil.Discard, "", log.LOGLEVEL_SILENT))
+	c.now = func() time.Time { return now }
+	return c
+}
+
+func TestClusterLeaderElection(t *testing.T) {
+	database := newClusterDatabase()
+	now := time.Unix(1500000000, 0)
+	a := newTestClusterMember(database, "a", now)
+	b := newTestClusterMember(database, "b", now)
+	stopped, _ := json.Marshal(ClusterMember{ID: "c", Expires: now.Add(-time.Second).Unix()})
+	database.members["c"] = stopped
+
+	a.heartbeat()
+	b.heartbeat()
+	a.heartbeat()
+	testutil.ExpectEquals(t, true, a.IsLeader(), "expected the first instance to become the leader")
+	testutil.ExpectEquals(t, false, b.IsLeader(), "expected only one leader")
+	testutil.ExpectEquals(t, 2, len(a.Members()), "expected the members which stopped sending heartbeats to be ignored")
+	_, ok := database.members["c"]
+	testutil.ExpectEquals(t, false, ok, "expected the leader to remove the members which stopped sending heartbeats")
+
+	owned := 0
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("broadcast:%d", i)
+		testutil.ExpectEquals(t, a.Owns(key), !b.Owns(key), "expected every key to be assigned to exactly one member")
+		if a.Owns(key) {
+			owned++
+		}
+	}
+	if owned == 0 || owned == 100 {
+		t.Errorf("expected keys to be split between members, the first member owns %d of 100", owned)
+	}
+
+	a.Stop()
+	b.heartbeat()
+	testutil.ExpectEquals(t, true, b.IsLeader(), "expected another instance to take over when the leader stops")
+	testutil.ExpectEquals(t, 1, len(b.Members()), "expected the stopped leader to leave the cluster")
+	testutil.ExpectEquals(t, true, b.Owns("broadcast:1"), "expected the remaining member to own every key")
+}
+
+func TestClusterDisabled(t *testing.T) {
+	c := newCluster(nil, nil, ClusterConfig{}, nil)
+	testutil.ExpectEquals(t, (*cluster)(nil), c, "expected no cluster unless it's enabled")
+	testutil.ExpectEquals(t, true, c.IsLeader(), "expected every instance to be the leader without a cluster")
+	testutil.ExpectEquals(t, true, c.Owns("broadcast:1"), "expected every instance to own every key without a cluster")
+	c.Stop()
+}
@@ -0,0 +1,73 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/uniqush/goconf/conf"
+)
+
+// CompatUpstream is the value of compat in [WebFrontend] which makes the API respond like the upstream uniqush-push.
+const CompatUpstream = "upstream"
+
+// LoadUpstreamCompat returns whether the API is compatible with the clients of the upstream uniqush-push (compat=upstream in [WebFrontend]).
+// The endpoints and parameters of upstream (/addpsp, /rmpsp, /subscribe, /unsubscribe, /push, /nrdp, /subscriptions, /psps, /previewpush,
+// /rebuildserviceset, /version and /stop) are served as usual, but their failures are reported the way upstream reports them.
+func LoadUpstreamCompat(c *conf.ConfigFile) (bool, error) {
+	compat, err := c.GetString("WebFrontend", "compat")
+	if err != nil || compat == "" {
+		return false, nil
+	}
+	if compat != CompatUpstream {
+		return false, fmt.Errorf("[WebFrontend] compat must be %s or empty, got %q", CompatUpstream, compat)
+	}
+	return true, nil
+}
+
+// upstreamAPITypes are the types of the simple responses of the endpoints of upstream which change data.
+var upstreamAPITypes = map[string]string{
+	AddPushServiceProviderToServiceURL:      "AddPushServiceProvider",
+	RemovePushServiceProviderFromServiceURL: "RemovePushServiceProvider",
+	AddDeliveryPointToServiceURL:            "Subscribe",
+	RemoveDeliveryPointFromServiceURL:       "Unsubscribe",
+}
+
+// rejectUpstream responds to a rejected request to an endpoint of upstream with status 200 and the response upstream would send for the failure:
+// a push response with the failure in failureDetails for /push, or a simple response with status 1.
+// Upstream has no rate limits, API keys or maintenance, so its clients expect every failure there, and don't check the HTTP status.
+// It returns false for the other endpoints, which are rejected as usual.
+func (api *RestAPI) rejectUpstream(w http.ResponseWriter, path string, details APIResponseDetails, retryAfter time.Duration) bool {
+	var handler APIResponseHandler
+	if path == PushNotificationURL {
+		handler = newPushResponseHandler(api.loggers[LoggerPush])
+	} else if apiType, ok := upstreamAPITypes[path]; ok {
+		handler = newSimpleResponseHandler(api.loggers[LoggerWeb], apiType)
+	} else {
+		return false
+	}
+	handler.AddDetailsToHandler(details)
+	if retryAfter > 0 {
+		seconds := int64((retryAfter + time.Second - 1) / time.Second)
+		w.Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+	}
+	fmt.Fprintf(w, "%s\r\n", handler.ToJSON())
+	return true
+}
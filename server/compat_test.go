@@ -0,0 +1,60 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/uniqush/goconf/conf"
+	"github.com/uniqush/uniqush-push/testutil"
+)
+
+func TestLoadUpstreamCompat(t *testing.T) {
+	c := conf.NewConfigFile()
+	compat, err := LoadUpstreamCompat(c)
+	testutil.ExpectEquals(t, nil, err, "unexpected error")
+	testutil.ExpectEquals(t, false, compat, "expected compatibility to be off by default")
+	c.AddOption("WebFrontend", "compat", "upstream")
+	compat, err = LoadUpstreamCompat(c)
+	testutil.ExpectEquals(t, nil, err, "unexpected error")
+	testutil.ExpectEquals(t, true, compat, "expected compatibility with upstream")
+	c.AddOption("WebFrontend", "compat", "gorush")
+	if _, err = LoadUpstreamCompat(c); err == nil {
+		t.Errorf("expected unknown modes to be rejected")
+	}
+}
+
+func TestRejectUpstream(t *testing.T) {
+	api := newHealthTestAPI(nil)
+	api.stopping = true
+
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest("POST", "/push?service=myservice&subscriber=user1&msg=hi", nil))
+	testutil.ExpectEquals(t, http.StatusServiceUnavailable, w.Code, "expected the usual status without compatibility")
+
+	api.upstreamCompat = true
+	w = httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest("POST", "/push?service=myservice&subscriber=user1&msg=hi", nil))
+	testutil.ExpectEquals(t, http.StatusOK, w.Code, "expected upstream clients to get status 200")
+	var push APIPushResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &push); err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectStringEquals(t, "Push", push.Type, "expected a push response")
+	testutil.ExpectEquals(t, 1, push.FailureCount, "expected the rejection to be a failure")
+	testutil.ExpectStringEquals(t, UNIQUSH_ERROR_SHUTTING_DOWN, push.FailureDetails[0].Code, "unexpected code")
+
+	w = httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest("POST", "/subscribe?service=myservice&subscriber=user1", nil))
+	var simple APISimpleResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &simple); err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectStringEquals(t, "Subscribe", simple.Type, "expected a subscribe response")
+	testutil.ExpectEquals(t, StatusFailure, simple.Status, "expected the rejection to be a failure")
+
+	w = httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest("POST", "/broadcast?service=myservice", nil))
+	testutil.ExpectEquals(t, http.StatusServiceUnavailable, w.Code, "expected endpoints which upstream doesn't have to be rejected as usual")
+}
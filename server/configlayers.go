@@ -0,0 +1,187 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/uniqush/goconf/conf"
+)
+
+// configEnvPrefix starts the environment variables overriding settings of uniqush.conf: UNIQUSH_<SECTION>__<OPTION>=<value>,
+// e.g. UNIQUSH_DATABASE__HOST=redis.internal or UNIQUSH_DATARESIDENCY.EU__HOST=redis.eu. Sections and options are case insensitive.
+const configEnvPrefix = "UNIQUSH_"
+
+// configOverride is a setting which overrides uniqush.conf, from an environment variable or a -set flag.
+type configOverride struct {
+	Section string
+	Option  string
+	Value   string
+	// Source is the environment variable or flag the setting is from.
+	Source string
+}
+
+// configOverrides are the -set <section>.<option>=<value> flags, which override uniqush.conf and the environment.
+type configOverrides []configOverride
+
+// ConfigFlagOverrides are the -set flags of the command line, applied to every config file opened with OpenConfig.
+var ConfigFlagOverrides configOverrides
+
+func (o *configOverrides) String() string {
+	var settings []string
+	for _, override := range *o {
+		settings = append(settings, override.Section+"."+override.Option+"="+override.Value)
+	}
+	return strings.Join(settings, " ")
+}
+
+// Set parses <section>.<option>=<value>. Sections may contain dots (e.g. DataResidency.EU.host), so the option is after the last one.
+func (o *configOverrides) Set(s string) error {
+	i := strings.IndexByte(s, '=')
+	if i < 0 {
+		return fmt.Errorf("invalid setting %q: must be <section>.<option>=<value>", s)
+	}
+	name, value := s[:i], s[i+1:]
+	j := strings.LastIndexByte(name, '.')
+	if j <= 0 || j == len(name)-1 {
+		return fmt.Errorf("invalid setting %q: must be <section>.<option>=<value>", s)
+	}
+	*o = append(*o, configOverride{Section: name[:j], Option: name[j+1:], Value: value, Source: "-set " + name})
+	return nil
+}
+
+// envConfigOverrides returns the settings of the UNIQUSH_<SECTION>__<OPTION> variables of environ (in the format of os.Environ).
+// Other variables starting with UNIQUSH_ (e.g. UNIQUSH_CREDENTIAL_KEY, referenced with env:) are ignored.
+func envConfigOverrides(environ []string) configOverrides {
+	var overrides configOverrides
+	for _, entry := range environ {
+		i := strings.IndexByte(entry, '=')
+		if i < 0 || !strings.HasPrefix(entry, configEnvPrefix) {
+			continue
+		}
+		name, value := entry[:i], entry[i+1:]
+		parts := strings.SplitN(name[len(configEnvPrefix):], "__", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			continue
+		}
+		overrides = append(overrides, configOverride{Section: parts[0], Option: parts[1], Value: value, Source: name})
+	}
+	// os.Environ isn't sorted, and later variables for the same setting would win.
+	sort.SliceStable(overrides, func(i, j int) bool { return overrides[i].Source < overrides[j].Source })
+	return overrides
+}
+
+// openLayeredConfig opens the uniqush.conf file at filename, then applies the environment variables and then the -set flags,
+// so that flags override the environment, which overrides the file. It returns the overrides which were applied.
+func openLayeredConfig(filename string, environ []string, flags configOverrides) (*conf.ConfigFile, configOverrides, error) {
+	c, err := conf.ReadConfigFile(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	overrides := append(envConfigOverrides(environ), flags...)
+	for _, override := range overrides {
+		c.AddOption(override.Section, override.Option, override.Value)
+	}
+	return c, overrides, nil
+}
+
+// secretConfigOptions are the options whose values are masked when printing the effective configuration.
+var secretConfigOptions = map[string]bool{
+	"token":                    true,
+	"vault_token":              true,
+	"secret":                   true,
+	"secrets":                  true,
+	"secret_access_key":        true,
+	"password":                 true,
+	"credential_key":           true,
+	"credential_previous_keys": true,
+}
+
+// validateConfig loads every section used by Run, and returns the first invalid setting.
+func validateConfig(c *conf.ConfigFile) error {
+	if _, err := LoadLogConfig(c); err != nil {
+		return err
+	}
+	if _, err := LoadRedactionConfig(c); err != nil {
+		return err
+	}
+	for _, section := range loggerSections {
+		if _, warningMsg := loadLogLevel(c, section); warningMsg != "" {
+			return fmt.Errorf("[%s] %s", section, warningMsg)
+		}
+	}
+	_, err := loadServerConfig(c)
+	return err
+}
+
+// RunConfigValidate checks the config file (with the environment and -set flags applied) without starting uniqush-push,
+// and writes the effective configuration to w, with the source of each overridden setting and secrets masked.
+func RunConfigValidate(filename string, w io.Writer) error {
+	if filename == "" {
+		filename = defaultConfigFilePath
+	}
+	c, overrides, err := openLayeredConfig(filename, os.Environ(), ConfigFlagOverrides)
+	if err != nil {
+		return err
+	}
+	writeEffectiveConfig(w, c, filename, overrides)
+	return validateConfig(c)
+}
+
+// writeEffectiveConfig writes the settings of c in the format of uniqush.conf, sorted by section and option.
+func writeEffectiveConfig(w io.Writer, c *conf.ConfigFile, filename string, overrides configOverrides) {
+	sources := make(map[string]string)
+	for _, override := range overrides {
+		sources[strings.ToLower(override.Section)+"."+strings.ToLower(override.Option)] = override.Source
+	}
+	fmt.Fprintf(w, "# Effective configuration of %s\n", filename)
+	sections := c.GetSections()
+	sort.Strings(sections)
+	for _, section := range sections {
+		options, err := c.GetOptions(section)
+		if err != nil {
+			continue
+		}
+		sort.Strings(options)
+		fmt.Fprintf(w, "\n[%s]\n", section)
+		for _, option := range options {
+			value, err := c.GetRawString(section, option)
+			if err != nil {
+				continue
+			}
+			// Options of [default] are inherited by every section.
+			if section != "default" {
+				if inherited, err := c.GetRawString("default", option); err == nil && inherited == value {
+					continue
+				}
+			}
+			if secretConfigOptions[strings.ToLower(option)] && value != "" {
+				value = "[redacted]"
+			}
+			if source, ok := sources[strings.ToLower(section)+"."+strings.ToLower(option)]; ok {
+				fmt.Fprintf(w, "%s=%s # from %s\n", option, value, source)
+			} else {
+				fmt.Fprintf(w, "%s=%s\n", option, value)
+			}
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/uniqush/uniqush-push/testutil"
+)
+
+func TestConfigOverridesSet(t *testing.T) {
+	var overrides configOverrides
+	for _, s := range []string{"Database.host=redis.internal", "DataResidency.EU.host=redis.eu=1"} {
+		if err := overrides.Set(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	testutil.ExpectEquals(t, configOverrides{
+		{Section: "Database", Option: "host", Value: "redis.internal", Source: "-set Database.host"},
+		{Section: "DataResidency.EU", Option: "host", Value: "redis.eu=1", Source: "-set DataResidency.EU.host"},
+	}, overrides, "unexpected overrides")
+	for _, s := range []string{"host=redis", "Database=redis", ".host=redis", "Database.=redis"} {
+		if err := overrides.Set(s); err == nil {
+			t.Errorf("expected %q to be rejected", s)
+		}
+	}
+}
+
+func TestOpenLayeredConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "uniqush-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "uniqush.conf")
+	if err := ioutil.WriteFile(path, []byte("[WebFrontend]\naddr=localhost:9898\n[Database]\nhost=file\nport=6379\n[Admin]\ntoken=secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	environ := []string{"UNIQUSH_DATABASE__HOST=env", "UNIQUSH_DATABASE__PORT=6380", "UNIQUSH_CREDENTIAL_KEY=ignored", "PATH=/bin"}
+	flags := configOverrides{{Section: "Database", Option: "host", Value: "flag", Source: "-set Database.host"}}
+	c, overrides, err := openLayeredConfig(path, environ, flags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectEquals(t, 3, len(overrides), "expected the settings of the environment and the flags")
+	dbconf, err := LoadDatabaseConfig(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectStringEquals(t, "flag", dbconf.Host, "expected flags to override the environment")
+	testutil.ExpectEquals(t, 6380, dbconf.Port, "expected the environment to override the file")
+	addr, err := LoadRestAddr(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectStringEquals(t, "localhost:9898", addr, "expected other settings to be read from the file")
+	if err := validateConfig(c); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	writeEffectiveConfig(&buf, c, path, overrides)
+	out := buf.String()
+	testutil.ExpectEquals(t, true, strings.Contains(out, "host=flag # from -set Database.host\n"), "expected the source of overridden settings in:\n"+out)
+	testutil.ExpectEquals(t, true, strings.Contains(out, "port=6380 # from UNIQUSH_DATABASE__PORT\n"), "expected the source of overridden settings in:\n"+out)
+	testutil.ExpectEquals(t, true, strings.Contains(out, "token=[redacted]\n"), "expected secrets to be masked in:\n"+out)
+	testutil.ExpectEquals(t, false, strings.Contains(out, "secret\n"), "expected secrets to be masked in:\n"+out)
+
+	c.AddOption("RateLimit", "per_ip", "fast")
+	if err := validateConfig(c); err == nil {
+		t.Error("expected invalid settings to be reported")
+	}
+}
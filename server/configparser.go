@@ -0,0 +1,1377 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/uniqush/goconf/conf"
+	"github.com/uniqush/log"
+	"github.com/uniqush/uniqush-push/db"
+	"github.com/uniqush/uniqush-push/push"
+)
+
+// Logger* is an enum of the indices of the loggers for the various log categories.
+const (
+	LoggerWeb = iota
+	LoggerAddPSP
+	LoggerRemovePSP
+	LoggerPSPs
+	LoggerSub
+	LoggerUnsub
+	LoggerPush
+	LoggerSubscriptions
+	LoggerServices
+	LoggerPreview
+	LoggerQuarantine
+	LoggerDeliveryHistory
+	LoggerBroadcast
+	LoggerIngest
+	LoggerWebhooks
+	LoggerReconcile
+	LoggerReplication
+	LoggerAnalytics
+	LoggerAudit
+	LoggerSLO
+	LoggerChurn
+	LoggerCanary
+	LoggerEventSink
+	LoggerDatabase
+	NumberOfLoggers
+)
+
+func extractLogLevel(loglevel string) (int, string) {
+	warningMsg := ""
+	var level int
+	switch strings.ToLower(loglevel) {
+	case "alert":
+		level = log.LOGLEVEL_ALERT
+	case "error":
+		level = log.LOGLEVEL_ERROR
+	case "warn", "warning":
+		level = log.LOGLEVEL_WARN
+	case "standard", "verbose", "info":
+		level = log.LOGLEVEL_INFO
+	case "debug":
+		level = log.LOGLEVEL_DEBUG
+	default:
+		warningMsg = fmt.Sprintf("Unsupported loglevel %q. Supported values: alert, error, warn/warning, standard/verbose/info, and debug", loglevel)
+		level = log.LOGLEVEL_INFO
+	}
+	return level, warningMsg
+}
+
+// loadLogLevel returns the level of the logger of a section (log and loglevel), and a warning if loglevel isn't supported.
+func loadLogLevel(c *conf.ConfigFile, field string) (int, string) {
+	if logswitch, err := c.GetBool(field, "log"); err == nil && !logswitch {
+		return log.LOGLEVEL_SILENT, ""
+	}
+	loglevel, err := c.GetString(field, "loglevel")
+	if err != nil {
+		loglevel = "standard"
+	}
+	return extractLogLevel(loglevel)
+}
+
+func loadLogger(writer io.Writer, format string, c *conf.ConfigFile, field string, prefix string) (log.Logger, error) {
+	if writer == nil {
+		writer = os.Stderr
+	}
+
+	level, warningMsg := loadLogLevel(c, field)
+
+	var logger log.Logger
+	if format == LogFormatJSON {
+		logger = newJSONLogger(writer, field, level)
+	} else {
+		logger = log.NewLogger(writer, prefix, level)
+	}
+	if warningMsg != "" {
+		logger.Warn(warningMsg)
+	}
+	return newControlledLogger(logger, level, logControl), nil
+}
+
+// serviceSection is a section of uniqush.conf with the settings of a single service, e.g. [Retry.<service>].
+type serviceSection struct {
+	service string
+	section string
+}
+
+// serviceSections returns the sections of c whose name starts with prefix (e.g. "Retry."), and the service each of them configures.
+// goconf lowercases section names, so the prefix is matched case insensitively, and the rest of the section name is only the service if it has no uppercase letters.
+// Because service names are case sensitive, a section can set the exact name of its service with the service option instead (e.g. service=MyService).
+func serviceSections(c *conf.ConfigFile, prefix string) ([]serviceSection, error) {
+	var sections []serviceSection
+	seen := make(map[string]string)
+	for _, section := range c.GetSections() {
+		if !strings.HasPrefix(strings.ToLower(section), strings.ToLower(prefix)) {
+			continue
+		}
+		service := section[len(prefix):]
+		if name, err := c.GetString(section, "service"); err == nil && name != "" {
+			service = name
+		}
+		if other, ok := seen[service]; ok {
+			return nil, fmt.Errorf("[%s]: service %s is already configured by [%s]", section, service, other)
+		}
+		seen[service] = section
+		sections = append(sections, serviceSection{service: service, section: section})
+	}
+	return sections, nil
+}
+
+// LoadDatabaseConfig returns a representation of the [Database] section from uniqush.conf, or an error
+func LoadDatabaseConfig(cf *conf.ConfigFile) (*db.DatabaseConfig, error) {
+	return loadDatabaseConfigFromSection(cf, "Database")
+}
+
+// loadDatabaseConfigFromSection returns a representation of a section with the same settings as [Database] (e.g. the database of a peer region in [Replication.<peer>]).
+func loadDatabaseConfigFromSection(cf *conf.ConfigFile, section string) (*db.DatabaseConfig, error) {
+	c := new(db.DatabaseConfig)
+
+	getDbConfigString := func(key, defaultValue string) string {
+		value, err := cf.GetString(section, key)
+		if err != nil || value == "" {
+			return defaultValue
+		}
+		return value
+	}
+	var err error
+	c.PushServiceManager = push.GetPushServiceManager()
+	c.Engine = getDbConfigString("engine", "redis")
+	c.Name = getDbConfigString("name", "0")
+	c.Port, err = cf.GetInt(section, "port")
+	if err != nil || c.Port <= 0 {
+		c.Port = -1
+	}
+	c.Host = getDbConfigString("host", "localhost")
+	c.SlavePort, err = cf.GetInt(section, "slave_port")
+	if err != nil || c.SlavePort <= 0 {
+		c.SlavePort = -1
+	}
+	c.SlaveHost = getDbConfigString("slave_host", "")
+	c.Password = getDbConfigString("password", "")
+	i, e := cf.GetInt(section, "everysec")
+	// TODO: Change condition to < 60 or change assignment to c.EverySec = 60?
+	c.EverySec = int64(i)
+	if e != nil || c.EverySec <= 60 {
+		c.EverySec = 600
+	}
+	c.LeastDirty, err = cf.GetInt(section, "leastdirty")
+	if err != nil || c.LeastDirty < 0 {
+		c.LeastDirty = 10
+	}
+	c.CacheSize, err = cf.GetInt(section, "cachesize")
+	if err != nil || c.CacheSize < 0 {
+		c.CacheSize = 1024
+	}
+	c.Cache, err = cf.GetBool(section, "cache")
+	if err != nil {
+		c.Cache = false
+	}
+	c.CacheShards, err = cf.GetInt(section, "cache_shards")
+	if err != nil || c.CacheShards <= 0 {
+		c.CacheShards = db.DefaultCacheShards
+	}
+	maxBytes, err := cf.GetInt(section, "cache_max_bytes")
+	if err == nil {
+		if maxBytes < 0 {
+			return nil, fmt.Errorf("[%s] cache_max_bytes must not be negative, got %d", section, maxBytes)
+		}
+		c.CacheMaxBytes = int64(maxBytes)
+	}
+	c.CacheNotFoundTTL = defaultCacheNotFoundTTL
+	notFoundTTL, err := cf.GetInt(section, "cache_not_found_ttl")
+	if err == nil {
+		if notFoundTTL < 0 {
+			return nil, fmt.Errorf("[%s] cache_not_found_ttl must not be negative, got %d", section, notFoundTTL)
+		}
+		c.CacheNotFoundTTL = time.Duration(notFoundTTL) * time.Second
+	}
+	for key, ttl := range map[string]*time.Duration{
+		"cache_dp_ttl":         &c.CacheDeliveryPointTTL,
+		"cache_psp_ttl":        &c.CachePushServiceProviderTTL,
+		"cache_subscriber_ttl": &c.CacheSubscriberTTL,
+		"cache_pair_ttl":       &c.CachePairTTL,
+	} {
+		seconds, err := cf.GetInt(section, key)
+		if err != nil {
+			continue
+		}
+		if seconds < 0 {
+			return nil, fmt.Errorf("[%s] %s must not be negative, got %d", section, key, seconds)
+		}
+		*ttl = time.Duration(seconds) * time.Second
+	}
+	c.ValueEncoding, err = cf.GetString(section, "value_encoding")
+	if err != nil || c.ValueEncoding == "" {
+		c.ValueEncoding = db.ValueEncodingJSON
+	}
+	if c.ValueEncoding != db.ValueEncodingJSON && c.ValueEncoding != db.ValueEncodingBinary {
+		return nil, fmt.Errorf("[%s] invalid value_encoding %q, expected %s or %s", section, c.ValueEncoding, db.ValueEncodingJSON, db.ValueEncodingBinary)
+	}
+	c.ValueCompression, err = cf.GetString(section, "value_compression")
+	if err != nil || c.ValueCompression == "" {
+		c.ValueCompression = db.ValueCompressionNone
+	}
+	if c.ValueCompression != db.ValueCompressionNone && c.ValueCompression != db.ValueCompressionGzip {
+		return nil, fmt.Errorf("[%s] invalid value_compression %q, expected %s or %s", section, c.ValueCompression, db.ValueCompressionNone, db.ValueCompressionGzip)
+	}
+	c.TenantEncryption, err = cf.GetBool(section, "tenant_encryption")
+	if err != nil {
+		c.TenantEncryption = false
+	}
+	c.CachePreload, err = cf.GetBool(section, "cache_preload")
+	if err != nil {
+		c.CachePreload = false
+	}
+	if c.CachePreload && !c.Cache {
+		return nil, fmt.Errorf("[%s] cache_preload=on requires cache=on", section)
+	}
+	preloadServices, err := cf.GetString(section, "cache_preload_services")
+	if err == nil {
+		for _, srv := range strings.Split(preloadServices, ",") {
+			if srv = strings.TrimSpace(srv); srv != "" {
+				c.CachePreloadServices = append(c.CachePreloadServices, srv)
+			}
+		}
+	}
+	c.CacheWritePolicy, err = cf.GetString(section, "cache_write_policy")
+	if err != nil || c.CacheWritePolicy == "" {
+		c.CacheWritePolicy = db.CacheWriteThrough
+	}
+	switch c.CacheWritePolicy {
+	case db.CacheWriteThrough:
+	case db.CacheWriteBehind:
+		if !c.Cache {
+			return nil, fmt.Errorf("[%s] cache_write_policy=%s requires cache=on", section, db.CacheWriteBehind)
+		}
+	default:
+		return nil, fmt.Errorf("[%s] invalid cache_write_policy %q, expected %s or %s", section, c.CacheWritePolicy, db.CacheWriteThrough, db.CacheWriteBehind)
+	}
+	if ms, err := cf.GetInt(section, "slow_query_threshold"); err == nil {
+		if ms < 0 {
+			return nil, fmt.Errorf("[%s] slow_query_threshold must not be negative, got %d", section, ms)
+		}
+		c.SlowQueryThreshold = time.Duration(ms) * time.Millisecond
+	}
+	c.CredentialKeys, err = loadCredentialKeyring(getDbConfigString("credential_key", ""), getDbConfigString("credential_previous_keys", ""))
+	if err != nil {
+		return nil, fmt.Errorf("[%s] %v", section, err)
+	}
+
+	return c, nil
+}
+
+// LoadJobConfig returns a representation of the [Jobs] section from uniqush.conf.
+// lease_ttl and retention are in seconds.
+func LoadJobConfig(cf *conf.ConfigFile) (JobConfig, error) {
+	c := JobConfig{
+		LeaseTTL:  defaultJobLeaseTTL,
+		Retention: defaultJobRetention,
+	}
+	if ttl, err := cf.GetInt("Jobs", "lease_ttl"); err == nil {
+		c.LeaseTTL = time.Duration(ttl) * time.Second
+		if c.LeaseTTL < minJobLeaseTTL {
+			return c, fmt.Errorf("[Jobs] lease_ttl must be at least %v, got %v", minJobLeaseTTL, c.LeaseTTL)
+		}
+	}
+	if retention, err := cf.GetInt("Jobs", "retention"); err == nil {
+		c.Retention = time.Duration(retention) * time.Second
+		if c.Retention < c.LeaseTTL {
+			return c, fmt.Errorf("[Jobs] retention must be at least lease_ttl (%v), got %v", c.LeaseTTL, c.Retention)
+		}
+	}
+	return c, nil
+}
+
+// LoadClusterConfig returns a representation of the settings in the [Cluster] section from uniqush.conf.
+// heartbeat_interval and member_ttl are in seconds.
+func LoadClusterConfig(cf *conf.ConfigFile) (ClusterConfig, error) {
+	c := ClusterConfig{HeartbeatInterval: defaultClusterHeartbeatInterval}
+	if enabled, err := cf.GetBool("Cluster", "enabled"); err == nil {
+		c.Enabled = enabled
+	}
+	if interval, err := cf.GetInt("Cluster", "heartbeat_interval"); err == nil {
+		if interval <= 0 {
+			return c, fmt.Errorf("[Cluster] heartbeat_interval must be positive, got %d", interval)
+		}
+		c.HeartbeatInterval = time.Duration(interval) * time.Second
+	}
+	c.MemberTTL = defaultClusterMemberTTLFactor * c.HeartbeatInterval
+	if ttl, err := cf.GetInt("Cluster", "member_ttl"); err == nil {
+		c.MemberTTL = time.Duration(ttl) * time.Second
+		if c.MemberTTL <= c.HeartbeatInterval {
+			return c, fmt.Errorf("[Cluster] member_ttl must be longer than heartbeat_interval (%v), got %v", c.HeartbeatInterval, c.MemberTTL)
+		}
+	}
+	return c, nil
+}
+
+// LoadFailoverConfig returns a representation of the [Failover] section from uniqush.conf.
+// circuit_breaker_cooldown is in seconds.
+func LoadFailoverConfig(cf *conf.ConfigFile) (FailoverConfig, error) {
+	c := FailoverConfig{
+		CircuitBreakerThreshold: defaultCircuitBreakerThreshold,
+		CircuitBreakerCooldown:  defaultCircuitBreakerCooldown,
+	}
+	if threshold, err := cf.GetInt("Failover", "circuit_breaker_threshold"); err == nil {
+		if threshold < 0 {
+			return c, fmt.Errorf("[Failover] circuit_breaker_threshold must not be negative, got %d", threshold)
+		}
+		c.CircuitBreakerThreshold = threshold
+	}
+	if cooldown, err := cf.GetInt("Failover", "circuit_breaker_cooldown"); err == nil {
+		if cooldown <= 0 {
+			return c, fmt.Errorf("[Failover] circuit_breaker_cooldown must be positive, got %d", cooldown)
+		}
+		c.CircuitBreakerCooldown = time.Duration(cooldown) * time.Second
+	}
+	return c, nil
+}
+
+// LoadQuarantineConfig returns a representation of the settings in the [Quarantine] section from uniqush.conf.
+// window and duration are in seconds.
+func LoadQuarantineConfig(cf *conf.ConfigFile) (QuarantineConfig, error) {
+	c := QuarantineConfig{
+		Threshold: defaultQuarantineThreshold,
+		Window:    defaultQuarantineWindow,
+		Duration:  defaultQuarantineDuration,
+	}
+	if threshold, err := cf.GetInt("Quarantine", "threshold"); err == nil {
+		if threshold < 0 {
+			return c, fmt.Errorf("[Quarantine] threshold must not be negative, got %d", threshold)
+		}
+		c.Threshold = threshold
+	}
+	for _, setting := range []struct {
+		key   string
+		value *time.Duration
+	}{{"window", &c.Window}, {"duration", &c.Duration}} {
+		seconds, err := cf.GetInt("Quarantine", setting.key)
+		if err != nil {
+			continue
+		}
+		if seconds <= 0 {
+			return c, fmt.Errorf("[Quarantine] %s must be positive, got %d", setting.key, seconds)
+		}
+		*setting.value = time.Duration(seconds) * time.Second
+	}
+	return c, nil
+}
+
+// LoadDeliveryHistoryConfig returns a representation of the settings in the [DeliveryHistory] section from uniqush.conf.
+// retention is in seconds.
+func LoadDeliveryHistoryConfig(cf *conf.ConfigFile) (DeliveryHistoryConfig, error) {
+	c := DeliveryHistoryConfig{
+		MaxRecords: defaultDeliveryHistoryMaxRecords,
+		Retention:  defaultDeliveryHistoryRetention,
+	}
+	if maxRecords, err := cf.GetInt("DeliveryHistory", "max_records"); err == nil {
+		if maxRecords < 0 {
+			return c, fmt.Errorf("[DeliveryHistory] max_records must not be negative, got %d", maxRecords)
+		}
+		c.MaxRecords = maxRecords
+	}
+	if retention, err := cf.GetInt("DeliveryHistory", "retention"); err == nil {
+		if retention <= 0 {
+			return c, fmt.Errorf("[DeliveryHistory] retention must be positive, got %d", retention)
+		}
+		c.Retention = time.Duration(retention) * time.Second
+	}
+	if maxSubscribers, err := cf.GetInt("DeliveryHistory", "max_subscribers"); err == nil {
+		if maxSubscribers < 0 {
+			return c, fmt.Errorf("[DeliveryHistory] max_subscribers must not be negative, got %d", maxSubscribers)
+		}
+		c.MaxSubscribers = maxSubscribers
+	}
+	return c, nil
+}
+
+// LoadInboxConfig returns a representation of the settings in the [Inbox] section from uniqush.conf.
+// retention is in seconds.
+func LoadInboxConfig(cf *conf.ConfigFile) (InboxConfig, error) {
+	c := InboxConfig{
+		MaxMessages: defaultInboxMaxMessages,
+		Retention:   defaultInboxRetention,
+	}
+	if maxMessages, err := cf.GetInt("Inbox", "max_messages"); err == nil {
+		if maxMessages < 0 {
+			return c, fmt.Errorf("[Inbox] max_messages must not be negative, got %d", maxMessages)
+		}
+		c.MaxMessages = maxMessages
+	}
+	if retention, err := cf.GetInt("Inbox", "retention"); err == nil {
+		if retention <= 0 {
+			return c, fmt.Errorf("[Inbox] retention must be positive, got %d", retention)
+		}
+		c.Retention = time.Duration(retention) * time.Second
+	}
+	return c, nil
+}
+
+// LoadAuditConfig returns a representation of the settings in the [Audit] section from uniqush.conf.
+// retention is in days.
+func LoadAuditConfig(cf *conf.ConfigFile) (AuditConfig, error) {
+	c := AuditConfig{MaxRecords: defaultAuditMaxRecords}
+	if maxRecords, err := cf.GetInt("Audit", "max_records"); err == nil {
+		if maxRecords < 0 {
+			return c, fmt.Errorf("[Audit] max_records must not be negative, got %d", maxRecords)
+		}
+		c.MaxRecords = maxRecords
+	}
+	if retention, err := cf.GetInt("Audit", "retention"); err == nil {
+		if retention < 0 {
+			return c, fmt.Errorf("[Audit] retention must not be negative, got %d", retention)
+		}
+		c.Retention = time.Duration(retention) * 24 * time.Hour
+	}
+	return c, nil
+}
+
+// LoadAPIKeysConfig returns a representation of the settings in the [APIKeys] section from uniqush.conf.
+// cache_ttl is in seconds.
+func LoadAPIKeysConfig(cf *conf.ConfigFile) (APIKeysConfig, error) {
+	c := APIKeysConfig{CacheTTL: defaultAPIKeyCacheTTL}
+	if enabled, err := cf.GetBool("APIKeys", "enabled"); err == nil {
+		c.Enabled = enabled
+	}
+	if ttl, err := cf.GetInt("APIKeys", "cache_ttl"); err == nil {
+		if ttl < 0 {
+			return c, fmt.Errorf("[APIKeys] cache_ttl must not be negative, got %d", ttl)
+		}
+		c.CacheTTL = time.Duration(ttl) * time.Second
+	}
+	return c, nil
+}
+
+// LoadSigningConfig returns a representation of the settings in the [Signing] section from uniqush.conf.
+// secrets is a comma separated list, and max_skew is in seconds.
+func LoadSigningConfig(cf *conf.ConfigFile) (SigningConfig, error) {
+	c := SigningConfig{MaxSkew: defaultSigningMaxSkew}
+	if secrets, err := cf.GetString("Signing", "secrets"); err == nil {
+		for _, secret := range strings.Split(secrets, ",") {
+			if secret = strings.TrimSpace(secret); secret != "" {
+				c.Secrets = append(c.Secrets, secret)
+			}
+		}
+	}
+	if maxSkew, err := cf.GetInt("Signing", "max_skew"); err == nil {
+		if maxSkew <= 0 {
+			return c, fmt.Errorf("[Signing] max_skew must be positive, got %d", maxSkew)
+		}
+		c.MaxSkew = time.Duration(maxSkew) * time.Second
+	}
+	return c, nil
+}
+
+// LoadUnsubscribeTokensConfig returns a representation of the settings in the [UnsubscribeTokens] section from uniqush.conf.
+// ttl is in days.
+func LoadUnsubscribeTokensConfig(cf *conf.ConfigFile) (UnsubscribeTokensConfig, error) {
+	c := UnsubscribeTokensConfig{TTL: defaultUnsubscribeTokenTTL}
+	if secrets, err := cf.GetString("UnsubscribeTokens", "secrets"); err == nil {
+		for _, secret := range strings.Split(secrets, ",") {
+			if secret = strings.TrimSpace(secret); secret != "" {
+				c.Secrets = append(c.Secrets, secret)
+			}
+		}
+	}
+	if ttl, err := cf.GetInt("UnsubscribeTokens", "ttl"); err == nil {
+		if ttl <= 0 {
+			return c, fmt.Errorf("[UnsubscribeTokens] ttl must be positive, got %d", ttl)
+		}
+		c.TTL = time.Duration(ttl) * 24 * time.Hour
+	}
+	return c, nil
+}
+
+// LoadSubscribeAbuseConfig returns a representation of the settings in the [SubscribeAbuse] section from uniqush.conf.
+// window and block_duration are in seconds.
+func LoadSubscribeAbuseConfig(cf *conf.ConfigFile) (SubscribeAbuseConfig, error) {
+	c := SubscribeAbuseConfig{Window: defaultSubscribeAbuseWindow, BlockDuration: defaultSubscribeAbuseBlockDuration}
+	if window, err := cf.GetInt("SubscribeAbuse", "window"); err == nil {
+		if window <= 0 {
+			return c, fmt.Errorf("[SubscribeAbuse] window must be positive, got %d", window)
+		}
+		c.Window = time.Duration(window) * time.Second
+	}
+	if max, err := cf.GetInt("SubscribeAbuse", "max_subscribers_per_ip"); err == nil {
+		if max < 0 {
+			return c, fmt.Errorf("[SubscribeAbuse] max_subscribers_per_ip must not be negative, got %d", max)
+		}
+		c.MaxSubscribersPerIP = max
+	}
+	if max, err := cf.GetInt("SubscribeAbuse", "max_subscribers_per_token"); err == nil {
+		if max < 0 {
+			return c, fmt.Errorf("[SubscribeAbuse] max_subscribers_per_token must not be negative, got %d", max)
+		}
+		c.MaxSubscribersPerToken = max
+	}
+	if duration, err := cf.GetInt("SubscribeAbuse", "block_duration"); err == nil {
+		if duration <= 0 {
+			return c, fmt.Errorf("[SubscribeAbuse] block_duration must be positive, got %d", duration)
+		}
+		c.BlockDuration = time.Duration(duration) * time.Second
+	}
+	return c, nil
+}
+
+// LoadSLOConfig returns a representation of the settings in the [SLO] section from uniqush.conf.
+// window is in seconds.
+func LoadSLOConfig(cf *conf.ConfigFile) (SLOConfig, error) {
+	c := SLOConfig{
+		Window:       defaultSLOWindow,
+		MinPushes:    defaultSLOMinPushes,
+		MaxErrorRate: defaultSLOMaxErrorRate,
+	}
+	if window, err := cf.GetInt("SLO", "window"); err == nil {
+		if window < sloSlots {
+			return c, fmt.Errorf("[SLO] window must be at least %d seconds, got %d", sloSlots, window)
+		}
+		c.Window = time.Duration(window) * time.Second
+	}
+	if minPushes, err := cf.GetInt("SLO", "min_pushes"); err == nil {
+		if minPushes < 0 {
+			return c, fmt.Errorf("[SLO] min_pushes must not be negative, got %d", minPushes)
+		}
+		c.MinPushes = int64(minPushes)
+	}
+	if s, err := cf.GetString("SLO", "max_error_rate"); err == nil && s != "" {
+		rate, err := strconv.ParseFloat(s, 64)
+		if err != nil || rate < 0 || rate > 1 {
+			return c, fmt.Errorf("[SLO] max_error_rate must be between 0 and 1, got %q", s)
+		}
+		c.MaxErrorRate = rate
+	}
+	return c, nil
+}
+
+// LoadAnalyticsConfig returns a representation of the settings in the [Analytics] section from uniqush.conf.
+// retention is in days, and flush_interval in seconds.
+func LoadAnalyticsConfig(cf *conf.ConfigFile) (AnalyticsConfig, error) {
+	c := AnalyticsConfig{
+		Retention:     defaultAnalyticsRetention,
+		FlushInterval: defaultAnalyticsFlushInterval,
+	}
+	if retention, err := cf.GetInt("Analytics", "retention"); err == nil {
+		if retention < 0 {
+			return c, fmt.Errorf("[Analytics] retention must not be negative, got %d", retention)
+		}
+		c.Retention = time.Duration(retention) * 24 * time.Hour
+	}
+	if interval, err := cf.GetInt("Analytics", "flush_interval"); err == nil {
+		if interval <= 0 {
+			return c, fmt.Errorf("[Analytics] flush_interval must be positive, got %d", interval)
+		}
+		c.FlushInterval = time.Duration(interval) * time.Second
+	}
+	return c, nil
+}
+
+// LoadUsageConfig returns a representation of the settings in the [Usage] section from uniqush.conf.
+// retention is in days, and flush_interval in seconds.
+func LoadUsageConfig(cf *conf.ConfigFile) (UsageConfig, error) {
+	c := UsageConfig{
+		Retention:     defaultUsageRetention,
+		FlushInterval: defaultUsageFlushInterval,
+	}
+	if retention, err := cf.GetInt("Usage", "retention"); err == nil {
+		if retention < 0 {
+			return c, fmt.Errorf("[Usage] retention must not be negative, got %d", retention)
+		}
+		c.Retention = time.Duration(retention) * 24 * time.Hour
+	}
+	if interval, err := cf.GetInt("Usage", "flush_interval"); err == nil {
+		if interval <= 0 {
+			return c, fmt.Errorf("[Usage] flush_interval must be positive, got %d", interval)
+		}
+		c.FlushInterval = time.Duration(interval) * time.Second
+	}
+	return c, nil
+}
+
+// LoadCanaryConfig returns a representation of the settings in the [Canary] section from uniqush.conf.
+// interval is in seconds.
+func LoadCanaryConfig(cf *conf.ConfigFile) (CanaryConfig, error) {
+	c := CanaryConfig{
+		Subscriber:  defaultCanarySubscriber,
+		Message:     defaultCanaryMessage,
+		MaxFailures: defaultCanaryMaxFailures,
+	}
+	if interval, err := cf.GetInt("Canary", "interval"); err == nil {
+		if interval < 0 {
+			return c, fmt.Errorf("[Canary] interval must not be negative, got %d", interval)
+		}
+		c.Interval = time.Duration(interval) * time.Second
+	}
+	if subscriber, err := cf.GetString("Canary", "subscriber"); err == nil && subscriber != "" {
+		if err := validateSubscribers([]string{subscriber}); err != nil {
+			return c, fmt.Errorf("[Canary] subscriber: %v", err)
+		}
+		c.Subscriber = subscriber
+	}
+	if message, err := cf.GetString("Canary", "message"); err == nil && message != "" {
+		c.Message = message
+	}
+	if maxFailures, err := cf.GetInt("Canary", "max_failures"); err == nil {
+		if maxFailures <= 0 {
+			return c, fmt.Errorf("[Canary] max_failures must be positive, got %d", maxFailures)
+		}
+		c.MaxFailures = maxFailures
+	}
+	return c, nil
+}
+
+// LoadDiagnosticsConfig returns a representation of the settings in the [Diagnostics] section from uniqush.conf.
+// max_clock_skew is in seconds.
+func LoadDiagnosticsConfig(cf *conf.ConfigFile) (DiagnosticsConfig, error) {
+	c := DiagnosticsConfig{MaxClockSkew: defaultMaxClockSkew}
+	if validate, err := cf.GetBool("Diagnostics", "validate_credentials"); err == nil {
+		c.ValidateCredentials = validate
+	}
+	if skew, err := cf.GetInt("Diagnostics", "max_clock_skew"); err == nil {
+		if skew <= 0 {
+			return c, fmt.Errorf("[Diagnostics] max_clock_skew must be positive, got %d", skew)
+		}
+		c.MaxClockSkew = time.Duration(skew) * time.Second
+	}
+	if strict, err := cf.GetBool("Diagnostics", "strict"); err == nil {
+		c.Strict = strict
+	}
+	return c, nil
+}
+
+// LoadReconcileConfig returns a representation of the settings in the [Reconcile] section from uniqush.conf.
+// interval is in seconds.
+func LoadReconcileConfig(cf *conf.ConfigFile) (ReconcileConfig, error) {
+	c := ReconcileConfig{
+		RequestsPerSecond: defaultReconcileRequestsPerSecond,
+	}
+	if interval, err := cf.GetInt("Reconcile", "interval"); err == nil {
+		if interval < 0 {
+			return c, fmt.Errorf("[Reconcile] interval must not be negative, got %d", interval)
+		}
+		c.Interval = time.Duration(interval) * time.Second
+	}
+	if rate, err := cf.GetInt("Reconcile", "requests_per_second"); err == nil {
+		if rate <= 0 {
+			return c, fmt.Errorf("[Reconcile] requests_per_second must be positive, got %d", rate)
+		}
+		c.RequestsPerSecond = rate
+	}
+	if remove, err := cf.GetBool("Reconcile", "remove_unrecognized"); err == nil {
+		c.RemoveUnrecognized = remove
+	}
+	return c, nil
+}
+
+// LoadUnsubscribeConfig returns a representation of the settings in the [Unsubscribe] section from uniqush.conf.
+// confirm_timeout is in seconds.
+func LoadUnsubscribeConfig(cf *conf.ConfigFile) (UnsubscribeConfig, error) {
+	c := UnsubscribeConfig{
+		ConfirmTimeout: defaultUnsubscribeConfirmTimeout,
+	}
+	if staged, err := cf.GetBool("Unsubscribe", "staged"); err == nil {
+		c.Staged = staged
+	}
+	if timeout, err := cf.GetInt("Unsubscribe", "confirm_timeout"); err == nil {
+		if timeout <= 0 {
+			return c, fmt.Errorf("[Unsubscribe] confirm_timeout must be positive, got %d", timeout)
+		}
+		c.ConfirmTimeout = time.Duration(timeout) * time.Second
+	}
+	return c, nil
+}
+
+// LoadBackpressureConfig returns a representation of the settings in the [Backpressure] section from uniqush.conf.
+// retry_after is in seconds.
+func LoadBackpressureConfig(cf *conf.ConfigFile) (BackpressureConfig, error) {
+	c := BackpressureConfig{
+		RetryAfter: defaultBackpressureRetryAfter,
+	}
+	for _, setting := range []struct {
+		key   string
+		value *int
+	}{{"max_inflight_pushes", &c.MaxInflightPushes}, {"max_queued_delivery_records", &c.MaxQueuedDeliveryRecords}} {
+		limit, err := cf.GetInt("Backpressure", setting.key)
+		if err != nil {
+			continue
+		}
+		if limit < 0 {
+			return c, fmt.Errorf("[Backpressure] %s must not be negative, got %d", setting.key, limit)
+		}
+		*setting.value = limit
+	}
+	if retryAfter, err := cf.GetInt("Backpressure", "retry_after"); err == nil {
+		if retryAfter <= 0 {
+			return c, fmt.Errorf("[Backpressure] retry_after must be positive, got %d", retryAfter)
+		}
+		c.RetryAfter = time.Duration(retryAfter) * time.Second
+	}
+	return c, nil
+}
+
+const (
+	defaultConfigFilePath = "/etc/uniqush/uniqush.conf"
+
+	defaultCacheNotFoundTTL = 5 * time.Second
+)
+
+// OpenConfig opens the uniqush.conf file at filename, with the UNIQUSH_<SECTION>__<OPTION> environment variables
+// and then the -set flags applied on top of it, or returns an error
+func OpenConfig(filename string) (c *conf.ConfigFile, err error) {
+	if filename == "" {
+		filename = defaultConfigFilePath
+	}
+	c, _, err = openLayeredConfig(filename, os.Environ(), ConfigFlagOverrides)
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+// loggerSections are the sections of uniqush.conf with the settings of each logger, which are also the names of the loggers (e.g. for /loglevel).
+var loggerSections = map[int]string{
+	LoggerWeb:             "WebFrontend",
+	LoggerAddPSP:          "AddPushServiceProvider",
+	LoggerRemovePSP:       "RemovePushServiceProvider",
+	LoggerPSPs:            "PSPs",
+	LoggerSub:             "Subscribe",
+	LoggerUnsub:           "Unsubscribe",
+	LoggerPush:            "Push",
+	LoggerSubscriptions:   "Subscriptions",
+	LoggerServices:        "Services",
+	LoggerPreview:         "Preview",
+	LoggerQuarantine:      "Quarantine",
+	LoggerDeliveryHistory: "DeliveryHistory",
+	LoggerBroadcast:       "Broadcast",
+	LoggerIngest:          "Ingest",
+	LoggerWebhooks:        "Webhooks",
+	LoggerReconcile:       "Reconcile",
+	LoggerReplication:     "Replication",
+	LoggerAnalytics:       "Analytics",
+	LoggerAudit:           "Audit",
+	LoggerSLO:             "SLO",
+	LoggerChurn:           "Churn",
+	LoggerCanary:          "Canary",
+	LoggerEventSink:       "EventSink",
+	LoggerDatabase:        "Database",
+}
+
+// LoadLogConfig returns a representation of the logging settings in the [default] section from uniqush.conf.
+// Logs are written to logfile if it is set, and to stderr otherwise, unless log_sink says otherwise. logfile_max_size is in megabytes.
+func LoadLogConfig(cf *conf.ConfigFile) (LogConfig, error) {
+	c := LogConfig{
+		Format:     LogFormatText,
+		Sink:       LogSinkStderr,
+		MaxBackups: defaultLogMaxBackups,
+		SyslogTag:  defaultSyslogTag,
+	}
+	if file, err := cf.GetString("default", "logfile"); err == nil && file != "" {
+		c.File = file
+		c.Sink = LogSinkFile
+	}
+	if format, err := cf.GetString("default", "log_format"); err == nil && format != "" {
+		if format != LogFormatText && format != LogFormatJSON {
+			return c, fmt.Errorf("[default] invalid log_format %q, expected %s or %s", format, LogFormatText, LogFormatJSON)
+		}
+		c.Format = format
+	}
+	if sink, err := cf.GetString("default", "log_sink"); err == nil && sink != "" {
+		if sink != LogSinkStderr && sink != LogSinkFile && sink != LogSinkSyslog {
+			return c, fmt.Errorf("[default] invalid log_sink %q, expected %s, %s or %s", sink, LogSinkStderr, LogSinkFile, LogSinkSyslog)
+		}
+		c.Sink = sink
+	}
+	if c.Sink == LogSinkFile && c.File == "" {
+		return c, fmt.Errorf("[default] log_sink=%s requires logfile", LogSinkFile)
+	}
+	if size, err := cf.GetInt("default", "logfile_max_size"); err == nil {
+		if size < 0 {
+			return c, fmt.Errorf("[default] logfile_max_size must not be negative, got %d", size)
+		}
+		c.MaxSize = int64(size) << 20
+	}
+	if backups, err := cf.GetInt("default", "logfile_max_backups"); err == nil {
+		if backups < 0 {
+			return c, fmt.Errorf("[default] logfile_max_backups must not be negative, got %d", backups)
+		}
+		c.MaxBackups = backups
+	}
+	if tag, err := cf.GetString("default", "syslog_tag"); err == nil && tag != "" {
+		c.SyslogTag = tag
+	}
+	return c, nil
+}
+
+// LoadLoggers will return an array of loggers, for each type in the enum.
+// The log level of individual loggers vary based on the config.
+func LoadLoggers(c *conf.ConfigFile) ([]log.Logger, error) {
+	logConf, err := LoadLogConfig(c)
+	if err != nil {
+		return nil, err
+	}
+	logfile, err := openLogSink(logConf)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open the %s log sink, logging to stderr: %v\n", logConf.Sink, err)
+		logfile = os.Stderr
+	}
+	redactionConf, err := LoadRedactionConfig(c)
+	if err != nil {
+		return nil, err
+	}
+	redaction.configure(redactionConf)
+	logfile = &redactingWriter{w: logfile, redactor: redaction}
+
+	loggers := make([]log.Logger, NumberOfLoggers)
+	for loggerIndex, loggerName := range loggerSections {
+		loggers[loggerIndex], err = loadLogger(logfile, logConf.Format, c, loggerName, fmt.Sprintf("[%s]", loggerName))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return loggers, nil
+}
+
+// LoadRestAddr returns the address to listen to HTTP requests on, or returns an error.
+// The default is localhost:9898, which will accept connections only from localhost.
+// 0.0.0.0:9898 can be used to listen in on all interfaces, a firewall to control access to uniqush-push is strongly recommended.
+// unix:/path/to/push.sock listens on a unix domain socket instead of TCP.
+func LoadRestAddr(c *conf.ConfigFile) (string, error) {
+	addr, err := c.GetString("WebFrontend", "addr")
+	if err != nil || addr == "" {
+		addr = "localhost:9898"
+		err = nil
+	}
+	return addr, err
+}
+
+// LoadShutdownTimeout returns how long to wait for requests in progress to finish when stopping (shutdown_timeout in [WebFrontend], in seconds).
+func LoadShutdownTimeout(c *conf.ConfigFile) (time.Duration, error) {
+	timeout, err := c.GetInt("WebFrontend", "shutdown_timeout")
+	if err != nil {
+		return defaultShutdownTimeout, nil
+	}
+	if timeout <= 0 {
+		return 0, fmt.Errorf("[WebFrontend] shutdown_timeout must be positive, got %d", timeout)
+	}
+	return time.Duration(timeout) * time.Second, nil
+}
+
+// LoadSocketMode returns the permissions of the unix sockets the API listens on (socket_mode in [WebFrontend], in octal, e.g. 0660),
+// or 0 if the socket keeps the permissions of the umask.
+func LoadSocketMode(c *conf.ConfigFile) (os.FileMode, error) {
+	mode, err := c.GetString("WebFrontend", "socket_mode")
+	if err != nil || mode == "" {
+		return 0, nil
+	}
+	perm, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || perm > 0777 {
+		return 0, fmt.Errorf("[WebFrontend] socket_mode must be octal permissions such as 0660, got %q", mode)
+	}
+	return os.FileMode(perm), nil
+}
+
+// LoadRequestTimeout returns how long a push can take (request_timeout in [WebFrontend], in seconds), or 0 if it isn't limited.
+func LoadRequestTimeout(c *conf.ConfigFile) (time.Duration, error) {
+	timeout, err := c.GetInt("WebFrontend", "request_timeout")
+	if err != nil {
+		return 0, nil
+	}
+	if timeout < 0 {
+		return 0, fmt.Errorf("[WebFrontend] request_timeout must not be negative, got %d", timeout)
+	}
+	return time.Duration(timeout) * time.Second, nil
+}
+
+// LoadTLSConfig returns a representation of the TLS settings (tls_cert, tls_key, tls_min_version, tls_ciphers, tls_reload_interval,
+// tls_client_ca, tls_client_auth and tls_client_scopes) in the [WebFrontend] section from uniqush.conf.
+// tls_reload_interval is in seconds.
+func LoadTLSConfig(cf *conf.ConfigFile) (TLSConfig, error) {
+	c, err := loadTLSConfig(cf, "WebFrontend")
+	if err != nil {
+		return c, err
+	}
+	if scopes, err := cf.GetString("WebFrontend", "tls_client_scopes"); err == nil && strings.TrimSpace(scopes) != "" {
+		if c.ClientCAFile == "" {
+			return c, fmt.Errorf("[WebFrontend] tls_client_scopes requires tls_client_ca")
+		}
+		if c.ClientScopes, err = parseClientScopes(scopes); err != nil {
+			return c, fmt.Errorf("[WebFrontend] tls_client_scopes: %v", err)
+		}
+	}
+	return c, nil
+}
+
+// loadTLSConfig returns a representation of the TLS settings of a listener, in section.
+func loadTLSConfig(cf *conf.ConfigFile, section string) (TLSConfig, error) {
+	c := TLSConfig{MinVersion: tlsVersions["1.2"], ReloadInterval: defaultTLSReloadInterval}
+	if cert, err := cf.GetString(section, "tls_cert"); err == nil {
+		c.CertFile = cert
+	}
+	if key, err := cf.GetString(section, "tls_key"); err == nil {
+		c.KeyFile = key
+	}
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return c, fmt.Errorf("[%s] tls_cert and tls_key must be set together", section)
+	}
+	if version, err := cf.GetString(section, "tls_min_version"); err == nil && version != "" {
+		v, ok := tlsVersions[version]
+		if !ok {
+			return c, fmt.Errorf("[%s] tls_min_version must be 1.0, 1.1, 1.2 or 1.3, got %q", section, version)
+		}
+		c.MinVersion = v
+	}
+	if ciphers, err := cf.GetString(section, "tls_ciphers"); err == nil {
+		suites, err := parseCipherSuites(ciphers)
+		if err != nil {
+			return c, fmt.Errorf("[%s] tls_ciphers: %v", section, err)
+		}
+		c.CipherSuites = suites
+	}
+	if interval, err := cf.GetInt(section, "tls_reload_interval"); err == nil {
+		if interval <= 0 {
+			return c, fmt.Errorf("[%s] tls_reload_interval must be positive, got %d", section, interval)
+		}
+		c.ReloadInterval = time.Duration(interval) * time.Second
+	}
+	if ca, err := cf.GetString(section, "tls_client_ca"); err == nil && ca != "" {
+		if !c.Enabled() {
+			return c, fmt.Errorf("[%s] tls_client_ca requires tls_cert and tls_key", section)
+		}
+		c.ClientCAFile = ca
+		c.ClientAuth = tls.RequireAndVerifyClientCert
+		if auth, err := cf.GetString(section, "tls_client_auth"); err == nil && auth != "" {
+			switch auth {
+			case "require":
+			case "optional":
+				c.ClientAuth = tls.VerifyClientCertIfGiven
+			default:
+				return c, fmt.Errorf("[%s] tls_client_auth must be require or optional, got %q", section, auth)
+			}
+		}
+	}
+	return c, nil
+}
+
+// LoadAdminConfig returns a representation of the settings in the [Admin] section from uniqush.conf.
+// The admin listener requires a token (or OpenID Connect, or client certificates with roles), so that profiles can't be captured by anyone who can reach it.
+func LoadAdminConfig(cf *conf.ConfigFile) (AdminConfig, error) {
+	var c AdminConfig
+	if addr, err := cf.GetString("Admin", "addr"); err == nil {
+		c.Addr = addr
+	}
+	if token, err := cf.GetString("Admin", "token"); err == nil {
+		c.Token = token
+	}
+	if profiling, err := cf.GetBool("Admin", "pprof"); err == nil {
+		c.Profiling = profiling
+	}
+	tlsConf, err := loadTLSConfig(cf, "Admin")
+	if err != nil {
+		return c, err
+	}
+	if roles, err := cf.GetString("Admin", "tls_client_roles"); err == nil && strings.TrimSpace(roles) != "" {
+		if tlsConf.ClientCAFile == "" {
+			return c, fmt.Errorf("[Admin] tls_client_roles requires tls_client_ca")
+		}
+		if tlsConf.ClientScopes, err = parseClientScopes(roles); err != nil {
+			return c, fmt.Errorf("[Admin] tls_client_roles: %v", err)
+		}
+		for name, scopes := range tlsConf.ClientScopes {
+			for _, scope := range scopes {
+				if _, ok := adminRoleRanks[scope]; !ok {
+					return c, fmt.Errorf("[Admin] tls_client_roles: %s: %q is not a role (viewer, operator or admin)", name, scope)
+				}
+			}
+		}
+	}
+	c.TLS = tlsConf
+	c.OIDC.RolesClaim = defaultOIDCRolesClaim
+	if issuer, err := cf.GetString("Admin", "oidc_issuer"); err == nil {
+		c.OIDC.Issuer = issuer
+	}
+	if audience, err := cf.GetString("Admin", "oidc_audience"); err == nil {
+		c.OIDC.Audience = audience
+	}
+	if claim, err := cf.GetString("Admin", "oidc_roles_claim"); err == nil && claim != "" {
+		c.OIDC.RolesClaim = claim
+	}
+	if roles, err := cf.GetString("Admin", "oidc_roles"); err == nil {
+		if c.OIDC.Roles, err = parseOIDCRoles(roles); err != nil {
+			return c, fmt.Errorf("[Admin] oidc_roles: %v", err)
+		}
+	}
+	c.SessionTokenTTL = defaultAdminSessionTokenTTL
+	if seconds, err := cf.GetInt("Admin", "session_token_ttl"); err == nil {
+		c.SessionTokenTTL = time.Duration(seconds) * time.Second
+		if c.SessionTokenTTL < 0 || c.SessionTokenTTL > maxAdminSessionTokenTTL {
+			return c, fmt.Errorf("[Admin] session_token_ttl must be between 0 and %d seconds, got %d", int64(maxAdminSessionTokenTTL/time.Second), seconds)
+		}
+	}
+	if c.OIDC.Issuer != "" && (c.OIDC.Audience == "" || len(c.OIDC.Roles) == 0) {
+		return c, fmt.Errorf("[Admin] oidc_issuer requires oidc_audience and oidc_roles")
+	}
+	if c.Profiling && c.Addr == "" {
+		return c, fmt.Errorf("[Admin] pprof=on requires addr")
+	}
+	if c.Addr != "" && c.Token == "" && c.OIDC.Issuer == "" && len(c.TLS.ClientScopes) == 0 {
+		return c, fmt.Errorf("[Admin] addr requires a token, oidc_issuer or tls_client_roles")
+	}
+	return c, nil
+}
+
+// LoadTracingConfig returns a representation of the settings in the [Tracing] section from uniqush.conf.
+func LoadTracingConfig(cf *conf.ConfigFile) (TracingConfig, error) {
+	c := TracingConfig{
+		SampleRatio:   defaultTracingSampleRatio,
+		ServiceName:   defaultTracingServiceName,
+		FlushInterval: defaultTracingFlushInterval,
+	}
+	if endpoint, err := cf.GetString("Tracing", "endpoint"); err == nil {
+		c.Endpoint = endpoint
+	}
+	if s, err := cf.GetString("Tracing", "sample_ratio"); err == nil && s != "" {
+		ratio, err := strconv.ParseFloat(s, 64)
+		if err != nil || ratio < 0 || ratio > 1 {
+			return c, fmt.Errorf("[Tracing] sample_ratio must be between 0 and 1, got %q", s)
+		}
+		c.SampleRatio = ratio
+	}
+	if name, err := cf.GetString("Tracing", "service_name"); err == nil && name != "" {
+		c.ServiceName = name
+	}
+	if seconds, err := cf.GetInt("Tracing", "flush_interval"); err == nil {
+		if seconds <= 0 {
+			return c, fmt.Errorf("[Tracing] flush_interval must be positive, got %d", seconds)
+		}
+		c.FlushInterval = time.Duration(seconds) * time.Second
+	}
+	return c, nil
+}
+
+// LoadNetworkPolicyConfig returns a representation of the settings in the [NetworkPolicy] section from uniqush.conf.
+// Each key is a class of endpoints (public, push, subscribe, viewer, operator or admin), whose value is a comma separated list of CIDRs.
+func LoadNetworkPolicyConfig(cf *conf.ConfigFile) (NetworkPolicyConfig, error) {
+	c := NetworkPolicyConfig{AllowedNetworks: make(map[string][]*net.IPNet)}
+	for _, class := range endpointClasses {
+		s, err := cf.GetString("NetworkPolicy", class)
+		if err != nil || strings.TrimSpace(s) == "" {
+			continue
+		}
+		networks, err := parseAllowedNetworks(s)
+		if err != nil {
+			return c, fmt.Errorf("[NetworkPolicy] %s: %v", class, err)
+		}
+		c.AllowedNetworks[class] = networks
+	}
+	return c, nil
+}
+
+// LoadRateLimitConfig returns a representation of the settings in the [RateLimit] section from uniqush.conf.
+// Rates are in requests per second, as "<rate>[:<burst>]". keys and endpoints are comma separated lists of "<key id or path>:<rate>[:<burst>]".
+func LoadRateLimitConfig(cf *conf.ConfigFile) (RateLimitConfig, error) {
+	var c RateLimitConfig
+	for _, setting := range []struct {
+		key   string
+		value *RateLimit
+	}{{"per_ip", &c.PerIP}, {"per_key", &c.PerKey}} {
+		s, err := cf.GetString("RateLimit", setting.key)
+		if err != nil || strings.TrimSpace(s) == "" {
+			continue
+		}
+		if *setting.value, err = parseRateLimit(s); err != nil {
+			return c, fmt.Errorf("[RateLimit] %s: %v", setting.key, err)
+		}
+	}
+	for _, setting := range []struct {
+		key   string
+		value *map[string]RateLimit
+	}{{"keys", &c.Keys}, {"endpoints", &c.Endpoints}} {
+		s, err := cf.GetString("RateLimit", setting.key)
+		if err != nil {
+			continue
+		}
+		if *setting.value, err = parseRateLimits(s); err != nil {
+			return c, fmt.Errorf("[RateLimit] %s: %v", setting.key, err)
+		}
+	}
+	return c, nil
+}
+
+// LoadSecretsConfig returns a representation of the settings in the [Secrets] section from uniqush.conf.
+// refresh_interval is in seconds. vault_addr, vault_token and aws_region default to VAULT_ADDR, VAULT_TOKEN and AWS_REGION.
+func LoadSecretsConfig(cf *conf.ConfigFile) (SecretsConfig, error) {
+	c := SecretsConfig{
+		RefreshInterval: defaultSecretsRefreshInterval,
+		VaultAddr:       os.Getenv("VAULT_ADDR"),
+		VaultToken:      os.Getenv("VAULT_TOKEN"),
+		AWSRegion:       os.Getenv("AWS_REGION"),
+	}
+	if seconds, err := cf.GetInt("Secrets", "refresh_interval"); err == nil {
+		if seconds <= 0 {
+			return c, fmt.Errorf("[Secrets] refresh_interval must be positive, got %d", seconds)
+		}
+		c.RefreshInterval = time.Duration(seconds) * time.Second
+	}
+	if addr, err := cf.GetString("Secrets", "vault_addr"); err == nil && addr != "" {
+		c.VaultAddr = addr
+	}
+	if token, err := cf.GetString("Secrets", "vault_token"); err == nil && token != "" {
+		c.VaultToken = token
+	}
+	if region, err := cf.GetString("Secrets", "aws_region"); err == nil && region != "" {
+		c.AWSRegion = region
+	}
+	if endpoint, err := cf.GetString("Secrets", "aws_endpoint"); err == nil {
+		c.AWSEndpoint = endpoint
+	}
+	return c, nil
+}
+
+// LoadStatsdConfig returns a representation of the settings in the [Statsd] section from uniqush.conf.
+func LoadStatsdConfig(cf *conf.ConfigFile) (StatsdConfig, error) {
+	c := StatsdConfig{
+		FlushInterval: defaultStatsdFlushInterval,
+	}
+	if addr, err := cf.GetString("Statsd", "addr"); err == nil {
+		c.Addr = addr
+	}
+	if prefix, err := cf.GetString("Statsd", "prefix"); err == nil {
+		c.Prefix = prefix
+	}
+	if tags, err := cf.GetString("Statsd", "tags"); err == nil {
+		for _, tag := range strings.Split(tags, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "" {
+				continue
+			}
+			if strings.ContainsAny(tag, "|#@ ") {
+				return c, fmt.Errorf("[Statsd] invalid tag %q", tag)
+			}
+			c.Tags = append(c.Tags, tag)
+		}
+	}
+	if dogstatsd, err := cf.GetString("Statsd", "dogstatsd"); err == nil {
+		c.DogStatsD = dogstatsd == "on"
+	}
+	if len(c.Tags) > 0 && !c.DogStatsD {
+		return c, fmt.Errorf("[Statsd] tags require dogstatsd=on")
+	}
+	if seconds, err := cf.GetInt("Statsd", "flush_interval"); err == nil {
+		if seconds <= 0 {
+			return c, fmt.Errorf("[Statsd] flush_interval must be positive, got %d", seconds)
+		}
+		c.FlushInterval = time.Duration(seconds) * time.Second
+	}
+	return c, nil
+}
+
+// serverConfig is every setting of uniqush.conf used by Run, except the loggers.
+type serverConfig struct {
+	dbconf                *db.DatabaseConfig
+	addr                  string
+	socketMode            os.FileMode
+	shutdownTimeout       time.Duration
+	upstreamCompat        bool
+	requestTimeout        time.Duration
+	tlsConf               TLSConfig
+	adminConf             AdminConfig
+	tracingConf           TracingConfig
+	statsdConf            StatsdConfig
+	jobConf               JobConfig
+	clusterConf           ClusterConfig
+	failoverConf          FailoverConfig
+	retryPolicies         *RetryPolicies
+	payloadPolicies       *PayloadPolicies
+	quarantineConf        QuarantineConfig
+	historyConf           DeliveryHistoryConfig
+	inboxConf             InboxConfig
+	analyticsConf         AnalyticsConfig
+	usageConf             UsageConfig
+	auditConf             AuditConfig
+	apiKeysConf           APIKeysConfig
+	signingConf           SigningConfig
+	sloConf               SLOConfig
+	churnConf             ChurnConfig
+	canaryConf            CanaryConfig
+	backpressureConf      BackpressureConfig
+	ingestConfs           []IngestConfig
+	eventSinkConfs        []EventSinkConfig
+	webhookConfs          *WebhookConfigs
+	unsubscribeConf       UnsubscribeConfig
+	reconcileConf         ReconcileConfig
+	replicationConf       *ReplicationConfig
+	journalConf           *JournalConfig
+	residencyConf         *DataResidencyConfig
+	secretsConf           SecretsConfig
+	networkConf           NetworkPolicyConfig
+	rateLimitConf         RateLimitConfig
+	unsubscribeTokensConf UnsubscribeTokensConfig
+	subscribeAbuseConf    SubscribeAbuseConfig
+	diagnosticsConf       DiagnosticsConfig
+}
+
+// loadServerConfig loads every section of uniqush.conf used by Run, or returns the first invalid setting.
+func loadServerConfig(c *conf.ConfigFile) (*serverConfig, error) {
+	sc := new(serverConfig)
+	var err error
+	if sc.dbconf, err = LoadDatabaseConfig(c); err != nil {
+		return nil, err
+	}
+	if sc.addr, err = LoadRestAddr(c); err != nil {
+		return nil, err
+	}
+	if sc.socketMode, err = LoadSocketMode(c); err != nil {
+		return nil, err
+	}
+	if sc.shutdownTimeout, err = LoadShutdownTimeout(c); err != nil {
+		return nil, err
+	}
+	if sc.upstreamCompat, err = LoadUpstreamCompat(c); err != nil {
+		return nil, err
+	}
+	if sc.requestTimeout, err = LoadRequestTimeout(c); err != nil {
+		return nil, err
+	}
+	if sc.tlsConf, err = LoadTLSConfig(c); err != nil {
+		return nil, err
+	}
+	if sc.adminConf, err = LoadAdminConfig(c); err != nil {
+		return nil, err
+	}
+	if sc.tracingConf, err = LoadTracingConfig(c); err != nil {
+		return nil, err
+	}
+	if sc.statsdConf, err = LoadStatsdConfig(c); err != nil {
+		return nil, err
+	}
+	if sc.jobConf, err = LoadJobConfig(c); err != nil {
+		return nil, err
+	}
+	if sc.clusterConf, err = LoadClusterConfig(c); err != nil {
+		return nil, err
+	}
+	if sc.failoverConf, err = LoadFailoverConfig(c); err != nil {
+		return nil, err
+	}
+	if sc.retryPolicies, err = LoadRetryPolicies(c); err != nil {
+		return nil, err
+	}
+	if sc.payloadPolicies, err = LoadPayloadPolicies(c); err != nil {
+		return nil, err
+	}
+	if sc.quarantineConf, err = LoadQuarantineConfig(c); err != nil {
+		return nil, err
+	}
+	if sc.historyConf, err = LoadDeliveryHistoryConfig(c); err != nil {
+		return nil, err
+	}
+	if sc.inboxConf, err = LoadInboxConfig(c); err != nil {
+		return nil, err
+	}
+	if sc.analyticsConf, err = LoadAnalyticsConfig(c); err != nil {
+		return nil, err
+	}
+	if sc.usageConf, err = LoadUsageConfig(c); err != nil {
+		return nil, err
+	}
+	if sc.auditConf, err = LoadAuditConfig(c); err != nil {
+		return nil, err
+	}
+	if sc.apiKeysConf, err = LoadAPIKeysConfig(c); err != nil {
+		return nil, err
+	}
+	if sc.signingConf, err = LoadSigningConfig(c); err != nil {
+		return nil, err
+	}
+	if sc.sloConf, err = LoadSLOConfig(c); err != nil {
+		return nil, err
+	}
+	if sc.churnConf, err = LoadChurnConfig(c); err != nil {
+		return nil, err
+	}
+	if sc.canaryConf, err = LoadCanaryConfig(c); err != nil {
+		return nil, err
+	}
+	if sc.backpressureConf, err = LoadBackpressureConfig(c); err != nil {
+		return nil, err
+	}
+	if sc.ingestConfs, err = LoadIngestConfigs(c); err != nil {
+		return nil, err
+	}
+	if sc.eventSinkConfs, err = LoadEventSinkConfigs(c); err != nil {
+		return nil, err
+	}
+	if sc.webhookConfs, err = LoadWebhookConfigs(c); err != nil {
+		return nil, err
+	}
+	if sc.unsubscribeConf, err = LoadUnsubscribeConfig(c); err != nil {
+		return nil, err
+	}
+	if sc.reconcileConf, err = LoadReconcileConfig(c); err != nil {
+		return nil, err
+	}
+	if sc.replicationConf, err = LoadReplicationConfig(c); err != nil {
+		return nil, err
+	}
+	if sc.journalConf, err = LoadJournalConfig(c); err != nil {
+		return nil, err
+	}
+	if sc.residencyConf, err = LoadDataResidencyConfig(c); err != nil {
+		return nil, err
+	}
+	if sc.secretsConf, err = LoadSecretsConfig(c); err != nil {
+		return nil, err
+	}
+	if sc.networkConf, err = LoadNetworkPolicyConfig(c); err != nil {
+		return nil, err
+	}
+	if sc.rateLimitConf, err = LoadRateLimitConfig(c); err != nil {
+		return nil, err
+	}
+	if sc.unsubscribeTokensConf, err = LoadUnsubscribeTokensConfig(c); err != nil {
+		return nil, err
+	}
+	if sc.subscribeAbuseConf, err = LoadSubscribeAbuseConfig(c); err != nil {
+		return nil, err
+	}
+	if sc.diagnosticsConf, err = LoadDiagnosticsConfig(c); err != nil {
+		return nil, err
+	}
+	return sc, nil
+}
+
+// Run will load the configuration and start the uniqush-push server and REST API based on that config.
+// It returns after the server is stopped with /stop or SIGTERM.
+func Run(conf, version string) error {
+	s, err := New(conf, version)
+	if err != nil {
+		return err
+	}
+	return s.Serve()
+}
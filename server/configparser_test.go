@@ -0,0 +1,301 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/uniqush/goconf/conf"
+	"github.com/uniqush/log"
+	"github.com/uniqush/uniqush-push/db"
+	"github.com/uniqush/uniqush-push/push"
+	"github.com/uniqush/uniqush-push/testutil"
+)
+
+func TestOpenConfig(t *testing.T) {
+	c, err := OpenConfig("../conf/uniqush-push.conf")
+	if err != nil {
+		t.Fatalf("Unexpected error loading example config: %v", err)
+	}
+	fmt.Printf("c: %#v\n", c)
+	getString := func(section, setting string) string {
+		s, loadErr := c.GetString(section, setting)
+		if loadErr != nil {
+			t.Errorf("Failed to get section %q setting %q: %v", section, setting, loadErr)
+		}
+		return s
+	}
+
+	testutil.ExpectStringEquals(t, "on", getString("WebFrontend", "log"), "unexpected data for log")
+	testutil.ExpectStringEquals(t, "standard", getString("WebFrontend", "loglevel"), "unexpected data for loglevel")
+	testutil.ExpectStringEquals(t, "localhost:9898", getString("WebFrontend", "addr"), "unexpected data for addr")
+
+	shutdownTimeout, err := LoadShutdownTimeout(c)
+	if err != nil {
+		t.Fatalf("Failed to load shutdown timeout: %v", err)
+	}
+	testutil.ExpectEquals(t, 30*time.Second, shutdownTimeout, "expected shutdown_timeout to be parsed")
+
+	tlsConf, err := LoadTLSConfig(c)
+	if err != nil {
+		t.Fatalf("Failed to load TLS settings: %v", err)
+	}
+	testutil.ExpectEquals(t, TLSConfig{MinVersion: tls.VersionTLS12, ReloadInterval: 10 * time.Second}, tlsConf, "expected TLS to be disabled by default")
+
+	dbConf, err := LoadDatabaseConfig(c)
+	if err != nil {
+		t.Fatalf("Failed to load database config section: %v", err)
+	}
+	expectedDbConf := &db.DatabaseConfig{
+		Engine:             "redis",
+		Name:               "0",
+		Host:               "localhost",
+		Port:               -1, // redis db package converts this to default redis port
+		SlaveHost:          "",
+		SlavePort:          -1,
+		EverySec:           600, // TODO: Change configparser.go to make this 60?
+		LeastDirty:         10,
+		CacheSize:          1024,
+		CacheShards:        db.DefaultCacheShards,
+		CacheNotFoundTTL:   5 * time.Second,
+		CacheWritePolicy:   db.CacheWriteThrough,
+		ValueEncoding:      db.ValueEncodingJSON,
+		ValueCompression:   db.ValueCompressionNone,
+		SlowQueryThreshold: 100 * time.Millisecond,
+		PushServiceManager: push.GetPushServiceManager(),
+	}
+	testutil.ExpectEquals(t, *expectedDbConf, *dbConf, "expected config settings to be parsed")
+
+	jobConf, err := LoadJobConfig(c)
+	if err != nil {
+		t.Fatalf("Failed to load jobs config section: %v", err)
+	}
+	testutil.ExpectEquals(t, JobConfig{LeaseTTL: 30 * time.Second, Retention: 24 * time.Hour}, jobConf, "expected jobs settings to be parsed")
+
+	failoverConf, err := LoadFailoverConfig(c)
+	if err != nil {
+		t.Fatalf("Failed to load failover config section: %v", err)
+	}
+	testutil.ExpectEquals(t, FailoverConfig{CircuitBreakerThreshold: 5, CircuitBreakerCooldown: 30 * time.Second}, failoverConf, "expected failover settings to be parsed")
+
+	retryPolicies, err := LoadRetryPolicies(c)
+	if err != nil {
+		t.Fatalf("Failed to load retry config section: %v", err)
+	}
+	testutil.ExpectEquals(t, defaultRetryPolicy(), retryPolicies.ForService("myservice"), "expected retry settings to be parsed")
+
+	quarantineConf, err := LoadQuarantineConfig(c)
+	if err != nil {
+		t.Fatalf("Failed to load quarantine config section: %v", err)
+	}
+	testutil.ExpectEquals(t, QuarantineConfig{Threshold: 3, Window: time.Hour, Duration: 24 * time.Hour}, quarantineConf, "expected quarantine settings to be parsed")
+
+	historyConf, err := LoadDeliveryHistoryConfig(c)
+	if err != nil {
+		t.Fatalf("Failed to load delivery history config section: %v", err)
+	}
+	testutil.ExpectEquals(t, DeliveryHistoryConfig{MaxRecords: 100, Retention: 7 * 24 * time.Hour}, historyConf, "expected delivery history settings to be parsed")
+
+	backpressureConf, err := LoadBackpressureConfig(c)
+	if err != nil {
+		t.Fatalf("Failed to load backpressure config section: %v", err)
+	}
+	testutil.ExpectEquals(t, BackpressureConfig{MaxInflightPushes: 1000, MaxQueuedDeliveryRecords: 3072, RetryAfter: 5 * time.Second}, backpressureConf, "expected backpressure settings to be parsed")
+
+	ingestConfs, err := LoadIngestConfigs(c)
+	if err != nil {
+		t.Fatalf("Failed to load ingest config sections: %v", err)
+	}
+	testutil.ExpectEquals(t, 0, len(ingestConfs), "expected no ingestion adapters to be configured by default")
+
+	webhookConfs, err := LoadWebhookConfigs(c)
+	if err != nil {
+		t.Fatalf("Failed to load webhooks config section: %v", err)
+	}
+	testutil.ExpectEquals(t, &WebhookConfigs{ByService: map[string]WebhookConfig{}, Timeout: 10 * time.Second, MaxAttempts: 3}, webhookConfs, "expected webhooks settings to be parsed")
+
+	unsubscribeConf, err := LoadUnsubscribeConfig(c)
+	if err != nil {
+		t.Fatalf("Failed to load unsubscribe config section: %v", err)
+	}
+	testutil.ExpectEquals(t, UnsubscribeConfig{Staged: false, ConfirmTimeout: time.Hour}, unsubscribeConf, "expected unsubscribe settings to be parsed")
+
+	reconcileConf, err := LoadReconcileConfig(c)
+	if err != nil {
+		t.Fatalf("Failed to load reconcile config section: %v", err)
+	}
+	testutil.ExpectEquals(t, ReconcileConfig{Interval: 0, RequestsPerSecond: 10, RemoveUnrecognized: false}, reconcileConf, "expected reconcile settings to be parsed")
+
+	logConf, err := LoadLogConfig(c)
+	if err != nil {
+		t.Fatalf("Failed to load log settings: %v", err)
+	}
+	testutil.ExpectEquals(t, LogConfig{Format: LogFormatText, Sink: LogSinkFile, File: "/var/log/uniqush", MaxBackups: 5, SyslogTag: "uniqush-push"}, logConf, "expected log settings to be parsed")
+
+	adminConf, err := LoadAdminConfig(c)
+	if err != nil {
+		t.Fatalf("Failed to load admin config section: %v", err)
+	}
+	testutil.ExpectEquals(t, AdminConfig{TLS: TLSConfig{MinVersion: tls.VersionTLS12, ReloadInterval: 10 * time.Second}, OIDC: OIDCConfig{RolesClaim: "groups"}, SessionTokenTTL: 15 * time.Minute}, adminConf, "expected the admin listener to be disabled by default")
+
+	analyticsConf, err := LoadAnalyticsConfig(c)
+	if err != nil {
+		t.Fatalf("Failed to load analytics config section: %v", err)
+	}
+	testutil.ExpectEquals(t, AnalyticsConfig{Retention: 90 * 24 * time.Hour, FlushInterval: 10 * time.Second}, analyticsConf, "expected analytics settings to be parsed")
+
+	usageConf, err := LoadUsageConfig(c)
+	if err != nil {
+		t.Fatalf("Failed to load usage config section: %v", err)
+	}
+	testutil.ExpectEquals(t, UsageConfig{Retention: 400 * 24 * time.Hour, FlushInterval: 10 * time.Second}, usageConf, "expected usage settings to be parsed")
+
+	auditConf, err := LoadAuditConfig(c)
+	if err != nil {
+		t.Fatalf("Failed to load audit config section: %v", err)
+	}
+	testutil.ExpectEquals(t, AuditConfig{MaxRecords: 100000}, auditConf, "expected audit settings to be parsed")
+
+	apiKeysConf, err := LoadAPIKeysConfig(c)
+	if err != nil {
+		t.Fatalf("Failed to load API keys config section: %v", err)
+	}
+	testutil.ExpectEquals(t, APIKeysConfig{CacheTTL: 30 * time.Second}, apiKeysConf, "expected API keys to be disabled by default")
+
+	signingConf, err := LoadSigningConfig(c)
+	if err != nil {
+		t.Fatalf("Failed to load signing config section: %v", err)
+	}
+	testutil.ExpectEquals(t, SigningConfig{MaxSkew: 5 * time.Minute}, signingConf, "expected request signing to be disabled by default")
+
+	networkConf, err := LoadNetworkPolicyConfig(c)
+	if err != nil {
+		t.Fatalf("Failed to load network policy config section: %v", err)
+	}
+	testutil.ExpectEquals(t, 0, len(networkConf.AllowedNetworks), "expected every address to be allowed by default")
+
+	rateLimitConf, err := LoadRateLimitConfig(c)
+	if err != nil {
+		t.Fatalf("Failed to load rate limit config section: %v", err)
+	}
+	testutil.ExpectEquals(t, true, newRateLimiter(rateLimitConf) == nil, "expected requests not to be rate limited by default")
+
+	unsubscribeTokensConf, err := LoadUnsubscribeTokensConfig(c)
+	if err != nil {
+		t.Fatalf("Failed to load unsubscribe tokens config section: %v", err)
+	}
+	testutil.ExpectEquals(t, UnsubscribeTokensConfig{TTL: 30 * 24 * time.Hour}, unsubscribeTokensConf, "expected unsubscribe tokens to be disabled by default")
+
+	payloadPolicies, err := LoadPayloadPolicies(c)
+	if err != nil {
+		t.Fatalf("Failed to load payload policy config section: %v", err)
+	}
+	testutil.ExpectEquals(t, PayloadPolicy{CategoryKey: "category"}, payloadPolicies.ForService("myservice"), "expected payloads not to be restricted by default")
+
+	subscribeAbuseConf, err := LoadSubscribeAbuseConfig(c)
+	if err != nil {
+		t.Fatalf("Failed to load subscribe abuse config section: %v", err)
+	}
+	testutil.ExpectEquals(t, SubscribeAbuseConfig{Window: time.Hour, BlockDuration: 24 * time.Hour}, subscribeAbuseConf, "expected subscribe abuse detection to be disabled by default")
+
+	sloConf, err := LoadSLOConfig(c)
+	if err != nil {
+		t.Fatalf("Failed to load SLO config section: %v", err)
+	}
+	testutil.ExpectEquals(t, SLOConfig{Window: 10 * time.Minute, MinPushes: 20, MaxErrorRate: 0.1}, sloConf, "expected SLO settings to be parsed")
+
+	churnConf, err := LoadChurnConfig(c)
+	if err != nil {
+		t.Fatalf("Failed to load churn config section: %v", err)
+	}
+	expectedChurnConf := ChurnConfig{Window: 10 * time.Minute, Baseline: 144, Default: ChurnThresholds{MaxRatio: 5, MinUnsubscribes: 100}, ByService: map[string]ChurnThresholds{}}
+	testutil.ExpectEquals(t, expectedChurnConf, churnConf, "expected churn settings to be parsed")
+
+	clusterConf, err := LoadClusterConfig(c)
+	if err != nil {
+		t.Fatalf("Failed to load cluster config section: %v", err)
+	}
+	testutil.ExpectEquals(t, ClusterConfig{HeartbeatInterval: 5 * time.Second, MemberTTL: 15 * time.Second}, clusterConf, "expected clustering to be disabled by default")
+
+	diagnosticsConf, err := LoadDiagnosticsConfig(c)
+	if err != nil {
+		t.Fatalf("Failed to load diagnostics config section: %v", err)
+	}
+	testutil.ExpectEquals(t, DiagnosticsConfig{MaxClockSkew: 30 * time.Second}, diagnosticsConf, "expected credentials not to be checked by default")
+
+	journalConf, err := LoadJournalConfig(c)
+	if err != nil {
+		t.Fatalf("Failed to load journal config section: %v", err)
+	}
+	testutil.ExpectEquals(t, &JournalConfig{}, journalConf, "expected the journal to be disabled by default")
+
+	canaryConf, err := LoadCanaryConfig(c)
+	if err != nil {
+		t.Fatalf("Failed to load canary config section: %v", err)
+	}
+	testutil.ExpectEquals(t, CanaryConfig{Subscriber: "uniqush.canary", Message: "uniqush-push canary", MaxFailures: 3}, canaryConf, "expected canary settings to be parsed")
+
+	redactionConf, err := LoadRedactionConfig(c)
+	if err != nil {
+		t.Fatalf("Failed to load redaction config section: %v", err)
+	}
+	testutil.ExpectEquals(t, RedactionConfig{VisibleChars: 6}, redactionConf, "expected redaction settings to be parsed")
+
+	tracingConf, err := LoadTracingConfig(c)
+	if err != nil {
+		t.Fatalf("Failed to load tracing config section: %v", err)
+	}
+	testutil.ExpectEquals(t, TracingConfig{SampleRatio: 1, ServiceName: "uniqush-push", FlushInterval: 5 * time.Second}, tracingConf, "expected tracing to be disabled by default")
+
+	secretsConf, err := LoadSecretsConfig(c)
+	if err != nil {
+		t.Fatalf("Failed to load secrets config section: %v", err)
+	}
+	testutil.ExpectEquals(t, 5*time.Minute, secretsConf.RefreshInterval, "expected secrets to be refreshed every 5 minutes by default")
+
+	statsdConf, err := LoadStatsdConfig(c)
+	if err != nil {
+		t.Fatalf("Failed to load statsd config section: %v", err)
+	}
+	testutil.ExpectEquals(t, StatsdConfig{Prefix: "uniqush.", DogStatsD: true, FlushInterval: 10 * time.Second}, statsdConf, "expected statsd to be disabled by default")
+
+	replicationConf, err := LoadReplicationConfig(c)
+	if err != nil {
+		t.Fatalf("Failed to load replication config section: %v", err)
+	}
+	testutil.ExpectEquals(t, &ReplicationConfig{LogLength: 1000000, PollPeriod: time.Second, Peers: map[string]*db.DatabaseConfig{}}, replicationConf, "expected replication to be disabled")
+}
+
+func TestExtractLogLevel(t *testing.T) {
+	expectLogLevelForName := func(level int, loglevel string) {
+		actualLevel, warningMsg := extractLogLevel(loglevel)
+		testutil.ExpectStringEquals(t, "", warningMsg, "expected no warning")
+		testutil.ExpectEquals(t, level, actualLevel, "expected log level to be parsed")
+	}
+	expectLogLevelForName(log.LOGLEVEL_WARN, "warn")
+	expectLogLevelForName(log.LOGLEVEL_ERROR, "error")
+	expectLogLevelForName(log.LOGLEVEL_INFO, "standard")
+
+	level, warningMsg := extractLogLevel("blue")
+	testutil.ExpectStringEquals(t, `Unsupported loglevel "blue". Supported values: alert, error, warn/warning, standard/verbose/info, and debug`, warningMsg, "expected a warning message")
+	testutil.ExpectEquals(t, log.LOGLEVEL_INFO, level, "expected INFO level fallback")
+}
+
+func TestLoadSocketMode(t *testing.T) {
+	c := conf.NewConfigFile()
+	mode, err := LoadSocketMode(c)
+	testutil.ExpectEquals(t, nil, err, "unexpected error")
+	testutil.ExpectEquals(t, os.FileMode(0), mode, "expected the umask to be kept by default")
+	c.AddOption("WebFrontend", "socket_mode", "0660")
+	mode, err = LoadSocketMode(c)
+	testutil.ExpectEquals(t, nil, err, "unexpected error")
+	testutil.ExpectEquals(t, os.FileMode(0660), mode, "unexpected permissions")
+	for _, invalid := range []string{"rw-rw----", "0999", "1777"} {
+		c.AddOption("WebFrontend", "socket_mode", invalid)
+		if _, err = LoadSocketMode(c); err == nil {
+			t.Errorf("expected socket_mode=%s to be rejected", invalid)
+		}
+	}
+}
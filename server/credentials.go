@@ -0,0 +1,140 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/uniqush/uniqush-push/db"
+)
+
+// loadCredentialKey reads a master key encrypting the credentials of push service providers, from a source of credential_key:
+// "env:<variable>", "file:<path>" or "command:<shell command>" (e.g. a KMS or vault CLI decrypting the key). The key is base64 encoded.
+func loadCredentialKey(source string) ([]byte, error) {
+	var encoded string
+	switch {
+	case strings.HasPrefix(source, "env:"):
+		name := source[len("env:"):]
+		encoded = os.Getenv(name)
+		if encoded == "" {
+			return nil, fmt.Errorf("environment variable %s is not set", name)
+		}
+	case strings.HasPrefix(source, "file:"):
+		b, err := ioutil.ReadFile(source[len("file:"):])
+		if err != nil {
+			return nil, err
+		}
+		encoded = string(b)
+	case strings.HasPrefix(source, "command:"):
+		cmd := exec.Command("sh", "-c", source[len("command:"):])
+		cmd.Stderr = os.Stderr
+		b, err := cmd.Output()
+		if err != nil {
+			return nil, fmt.Errorf("command failed: %v", err)
+		}
+		encoded = string(b)
+	default:
+		return nil, fmt.Errorf("invalid source %q: must start with env:, file: or command:", source)
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("the key must be base64 encoded: %v", err)
+	}
+	return key, nil
+}
+
+// loadCredentialKeyring returns the keyring of the credential_key and credential_previous_keys sources, or nil if credential_key isn't set.
+func loadCredentialKeyring(primarySource, previousSources string) (*db.CredentialKeyring, error) {
+	if primarySource == "" {
+		if previousSources != "" {
+			return nil, fmt.Errorf("credential_previous_keys requires credential_key")
+		}
+		return nil, nil
+	}
+	primary, err := loadCredentialKey(primarySource)
+	if err != nil {
+		return nil, fmt.Errorf("credential_key: %v", err)
+	}
+	var previous [][]byte
+	for _, source := range strings.Split(previousSources, ",") {
+		if source = strings.TrimSpace(source); source == "" {
+			continue
+		}
+		key, err := loadCredentialKey(source)
+		if err != nil {
+			return nil, fmt.Errorf("credential_previous_keys: %v", err)
+		}
+		previous = append(previous, key)
+	}
+	return db.NewCredentialKeyring(primary, previous...)
+}
+
+// RunReencrypt saves every push service provider (and fallback) again, so that their credentials are encrypted with the current credential_key.
+// It is run after rotating the key (with the previous key in credential_previous_keys), or after enabling encryption, to encrypt existing credentials.
+func RunReencrypt(conf string, w io.Writer) error {
+	c, err := OpenConfig(conf)
+	if err != nil {
+		return err
+	}
+	dbconf, err := LoadDatabaseConfig(c)
+	if err != nil {
+		return err
+	}
+	if dbconf.CredentialKeys == nil {
+		return fmt.Errorf("[Database] credential_key must be set to encrypt credentials")
+	}
+	residencyConf, err := LoadDataResidencyConfig(c)
+	if err != nil {
+		return err
+	}
+	// The cache is bypassed, so that every push service provider is written to redis before returning.
+	// The push service providers of pinned services are saved in their backends, with the credential_key of the backend.
+	database, err := newDataResidencyDatabase(dbconf, residencyConf, db.NewPushDatabaseWithoutCache)
+	if err != nil {
+		return err
+	}
+	psps, err := database.GetPushServiceProviderConfigs()
+	if err != nil {
+		return err
+	}
+	n := 0
+	for _, psp := range psps {
+		if err := database.ModifyPushServiceProvider(psp); err != nil {
+			return err
+		}
+		n++
+		fallback, err := database.GetFallbackPushServiceProvider(psp)
+		if err != nil {
+			return err
+		}
+		if fallback != nil {
+			if err := database.ModifyPushServiceProvider(fallback); err != nil {
+				return err
+			}
+			n++
+		}
+	}
+	fmt.Fprintf(w, "Encrypted the credentials of %d push service providers with key %s\n", n, dbconf.CredentialKeys.PrimaryKeyID())
+	return nil
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/uniqush/uniqush-push/testutil"
+)
+
+func TestLoadCredentialKey(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+	encoded := base64.StdEncoding.EncodeToString(key)
+
+	os.Setenv("UNIQUSH_TEST_CREDENTIAL_KEY", encoded)
+	defer os.Unsetenv("UNIQUSH_TEST_CREDENTIAL_KEY")
+	got, err := loadCredentialKey("env:UNIQUSH_TEST_CREDENTIAL_KEY")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectEquals(t, key, got, "expected the key of the environment variable")
+
+	dir, err := ioutil.TempDir("", "uniqush-credential-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "key")
+	if err := ioutil.WriteFile(path, []byte(encoded+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	got, err = loadCredentialKey("file:" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectEquals(t, key, got, "expected the key of the file, without the trailing newline")
+
+	got, err = loadCredentialKey("command:echo " + encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectEquals(t, key, got, "expected the key printed by the command")
+
+	for _, invalid := range []string{"", "plain:" + encoded, "env:UNIQUSH_TEST_UNSET_KEY", "command:echo not-base64!"} {
+		if _, err := loadCredentialKey(invalid); err == nil {
+			t.Errorf("expected %q to be invalid", invalid)
+		}
+	}
+}
+
+func TestLoadCredentialKeyring(t *testing.T) {
+	os.Setenv("UNIQUSH_TEST_CREDENTIAL_KEY", base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, 32)))
+	os.Setenv("UNIQUSH_TEST_PREVIOUS_KEY", base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{8}, 32)))
+	defer os.Unsetenv("UNIQUSH_TEST_CREDENTIAL_KEY")
+	defer os.Unsetenv("UNIQUSH_TEST_PREVIOUS_KEY")
+
+	k, err := loadCredentialKeyring("", "")
+	if err != nil || k != nil {
+		t.Fatalf("expected no keyring without credential_key, got %v, %v", k, err)
+	}
+	if _, err := loadCredentialKeyring("", "env:UNIQUSH_TEST_PREVIOUS_KEY"); err == nil {
+		t.Error("expected previous keys to require a key")
+	}
+	previous, err := loadCredentialKeyring("env:UNIQUSH_TEST_PREVIOUS_KEY", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := previous.Encrypt("s3cr3t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, err = loadCredentialKeyring("env:UNIQUSH_TEST_CREDENTIAL_KEY", "env:UNIQUSH_TEST_PREVIOUS_KEY")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext, err := k.Decrypt(encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectStringEquals(t, "s3cr3t", plaintext, "expected the previous key to decrypt credentials after a rotation")
+}
@@ -0,0 +1,313 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/uniqush/uniqush-push/push"
+)
+
+const (
+	// dashboardRateWindow is the number of seconds over which pushes per second are averaged.
+	dashboardRateWindow = 10
+	// dashboardMaxFailures is the number of recent failures listed by /dashboard.
+	dashboardMaxFailures = 50
+	// defaultDashboardStreamInterval is how often /dashboard?stream=1 sends a snapshot, unless interval is given.
+	defaultDashboardStreamInterval = 2 * time.Second
+)
+
+// PSPPushRate is the number of results of pushes to a push service provider per second, averaged over the last dashboardRateWindow seconds.
+type PSPPushRate struct {
+	PushServiceProvider string  `json:"pushServiceProvider"`
+	PushesPerSecond     float64 `json:"pushesPerSecond"`
+	FailuresPerSecond   float64 `json:"failuresPerSecond"`
+}
+
+// DashboardFailure is a recent push to a delivery point which failed.
+type DashboardFailure struct {
+	// Date is the unix timestamp of the result.
+	Date                int64  `json:"date"`
+	RequestID           string `json:"requestId"`
+	Service             string `json:"service"`
+	PushServiceProvider string `json:"pushServiceProvider,omitempty"`
+	DeliveryPoint       string `json:"deliveryPoint,omitempty"`
+	// Result is the reason of the failure, as in the result label of uniqush_pushes_total (e.g. connection_error).
+	Result   string `json:"result"`
+	ErrorMsg string `json:"errorMsg,omitempty"`
+}
+
+// DashboardBroadcast is the progress of an active broadcast.
+type DashboardBroadcast struct {
+	ID            string `json:"id"`
+	Service       string `json:"service"`
+	State         string `json:"state"`
+	NrSubscribers int64  `json:"nrSubscribers"`
+	Total         int64  `json:"total,omitempty"`
+	// ProgressPercent is NrSubscribers as a percentage of Total. It is omitted until the subscribers have been counted.
+	ProgressPercent *float64 `json:"progressPercent,omitempty"`
+	Created         int64    `json:"created"`
+	Updated         int64    `json:"updated"`
+}
+
+// Dashboard is a snapshot of the activity of this instance, returned by /dashboard.
+type Dashboard struct {
+	// Date is the unix timestamp of the snapshot.
+	Date           int64                `json:"date"`
+	Queue          QueueDepths          `json:"queue"`
+	PushRates      []PSPPushRate        `json:"pushRates"`
+	RecentFailures []DashboardFailure   `json:"recentFailures"`
+	Broadcasts     []DashboardBroadcast `json:"broadcasts"`
+	OpenCircuits   []string             `json:"openCircuits"`
+}
+
+type rateSlot struct {
+	second   int64
+	pushes   int64
+	failures int64
+}
+
+// dashboardStats keeps the push rates and recent failures shown by /dashboard in memory.
+type dashboardStats struct {
+	mutex sync.Mutex
+	// rates has a slot per second of the window (and one for the current second) for each push service provider.
+	rates    map[string]*[dashboardRateWindow + 1]rateSlot
+	failures []DashboardFailure
+	// nextFailure is the index of failures to overwrite once it is full.
+	nextFailure int
+	now         func() time.Time
+}
+
+func newDashboardStats() *dashboardStats {
+	return &dashboardStats{
+		rates: make(map[string]*[dashboardRateWindow + 1]rateSlot),
+		now:   time.Now,
+	}
+}
+
+// record counts the result of a push to a delivery point of service.
+func (d *dashboardStats) record(reqID, service string, res *push.Result) {
+	if d == nil {
+		return
+	}
+	pspName := getProviderNameOrUnknown(res.Provider)
+	failed := strings.HasPrefix(analyticsCounter(res.Err), analyticsFailedPrefix)
+	now := d.now()
+	second := now.Unix()
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	slots, ok := d.rates[pspName]
+	if !ok {
+		slots = new([dashboardRateWindow + 1]rateSlot)
+		d.rates[pspName] = slots
+	}
+	slot := &slots[second%int64(len(slots))]
+	if slot.second != second {
+		*slot = rateSlot{second: second}
+	}
+	slot.pushes++
+	if !failed {
+		return
+	}
+	slot.failures++
+	failure := DashboardFailure{
+		Date:                second,
+		RequestID:           reqID,
+		Service:             service,
+		PushServiceProvider: pspName,
+		Result:              pushResultLabel(res.Err),
+		ErrorMsg:            redactedError(res.Err),
+	}
+	if res.Destination != nil {
+		failure.DeliveryPoint = res.Destination.Name()
+	}
+	if len(d.failures) < dashboardMaxFailures {
+		d.failures = append(d.failures, failure)
+	} else {
+		d.failures[d.nextFailure] = failure
+	}
+	d.nextFailure = (d.nextFailure + 1) % dashboardMaxFailures
+}
+
+// Rates returns the push rate of each push service provider with pushes during the window, sorted by name.
+// The current second isn't counted, since it isn't over yet.
+func (d *dashboardStats) Rates() []PSPPushRate {
+	rates := []PSPPushRate{}
+	if d == nil {
+		return rates
+	}
+	current := d.now().Unix()
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for pspName, slots := range d.rates {
+		var pushes, failures int64
+		for _, slot := range slots {
+			if slot.second < current && slot.second >= current-dashboardRateWindow {
+				pushes += slot.pushes
+				failures += slot.failures
+			}
+		}
+		if pushes == 0 {
+			if slots[current%int64(len(slots))].second != current {
+				// Forget push service providers which are no longer used.
+				delete(d.rates, pspName)
+			}
+			continue
+		}
+		rates = append(rates, PSPPushRate{
+			PushServiceProvider: pspName,
+			PushesPerSecond:     float64(pushes) / dashboardRateWindow,
+			FailuresPerSecond:   float64(failures) / dashboardRateWindow,
+		})
+	}
+	sort.Slice(rates, func(i, j int) bool {
+		return rates[i].PushServiceProvider < rates[j].PushServiceProvider
+	})
+	return rates
+}
+
+// Failures returns the recent failures, newest first.
+func (d *dashboardStats) Failures() []DashboardFailure {
+	failures := []DashboardFailure{}
+	if d == nil {
+		return failures
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for i := 1; i <= len(d.failures); i++ {
+		failures = append(failures, d.failures[(d.nextFailure-i+len(d.failures))%len(d.failures)])
+	}
+	return failures
+}
+
+// newDashboardBroadcast returns the progress of b.
+func newDashboardBroadcast(b *Broadcast) DashboardBroadcast {
+	ret := DashboardBroadcast{
+		ID:            b.ID,
+		Service:       b.Service,
+		State:         b.State,
+		NrSubscribers: b.NrSubscribers,
+		Total:         b.Total,
+		Created:       b.Created,
+		Updated:       b.Updated,
+	}
+	if b.Total > 0 {
+		// NrSubscribers may exceed Total if batches were sent again after resuming, or subscribers were added.
+		progress := 100 * float64(b.NrSubscribers) / float64(b.Total)
+		if progress > 100 {
+			progress = 100
+		}
+		ret.ProgressPercent = &progress
+	}
+	return ret
+}
+
+// dashboard returns a snapshot of the activity of this instance. If the active broadcasts can't be loaded, the rest of the snapshot is still returned along with the error.
+func (api *RestAPI) dashboard() (Dashboard, error) {
+	d := Dashboard{
+		Date:           time.Now().Unix(),
+		Queue:          api.backend.QueueDepths(),
+		PushRates:      api.backend.dashboard.Rates(),
+		RecentFailures: api.backend.dashboard.Failures(),
+		Broadcasts:     []DashboardBroadcast{},
+		OpenCircuits:   api.backend.breaker.OpenCircuits(),
+	}
+	if d.OpenCircuits == nil {
+		d.OpenCircuits = []string{}
+	}
+	if api.backend.broadcasts == nil {
+		return d, nil
+	}
+	broadcasts, err := api.backend.broadcasts.Active()
+	for _, b := range broadcasts {
+		d.Broadcasts = append(d.Broadcasts, newDashboardBroadcast(b))
+	}
+	return d, err
+}
+
+// dashboardJSON returns the JSON of a snapshot of the activity of this instance, with a code.
+func (api *RestAPI) dashboardJSON() []byte {
+	type responseType struct {
+		Dashboard
+		ErrorMessage *string `json:"errorMsg,omitempty"`
+		Code         string  `json:"code"`
+	}
+	d, err := api.dashboard()
+	r := responseType{Dashboard: d, Code: UNIQUSH_SUCCESS}
+	if err != nil {
+		errorMsg := redactedError(err)
+		api.loggers[LoggerWeb].Errorf("Error querying broadcasts in /dashboard: %v", err)
+		r.Code = UNIQUSH_ERROR_DATABASE
+		r.ErrorMessage = &errorMsg
+	}
+	json, err := json.Marshal(r)
+	if err != nil {
+		return []byte("Failed to serialize response")
+	}
+	return json
+}
+
+// queryDashboard responds with a snapshot of the activity of this instance, for dashboards to poll.
+// With stream=1 (or an Accept header of text/event-stream), it sends a snapshot as a server-sent event every interval seconds (2 by default),
+// until the client disconnects or uniqush-push stops.
+func (api *RestAPI) queryDashboard(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	if r.Form.Get("stream") != "1" && !strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		fmt.Fprintf(w, "%s\r\n", api.dashboardJSON())
+		return
+	}
+	interval := defaultDashboardStreamInterval
+	if s := r.Form.Get("interval"); s != "" {
+		seconds, err := strconv.Atoi(s)
+		if err != nil || seconds <= 0 {
+			http.Error(w, fmt.Sprintf("Invalid interval %q: must be a positive number of seconds", s), http.StatusBadRequest)
+			return
+		}
+		interval = time.Duration(seconds) * time.Second
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		fmt.Fprintf(w, "event: dashboard\ndata: %s\n\n", api.dashboardJSON())
+		flusher.Flush()
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+		}
+		api.stopMutex.Lock()
+		stopping := api.stopping
+		api.stopMutex.Unlock()
+		if stopping {
+			return
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/uniqush/uniqush-push/push"
+	"github.com/uniqush/uniqush-push/testutil"
+)
+
+func TestDashboardStats(t *testing.T) {
+	d := newDashboardStats()
+	now := time.Unix(1500000000, 0)
+	d.now = func() time.Time { return now }
+
+	for i := 0; i < 18; i++ {
+		d.record("req1", "service", &push.Result{})
+	}
+	for i := 0; i < 2; i++ {
+		d.record("req2", "service", &push.Result{Err: push.NewError("timeout")})
+	}
+	testutil.ExpectEquals(t, 0, len(d.Rates()), "expected the current second not to be counted")
+
+	now = now.Add(time.Second)
+	rates := d.Rates()
+	testutil.ExpectEquals(t, 1, len(rates), "expected one push service provider")
+	testutil.ExpectEquals(t, PSPPushRate{PushServiceProvider: "Unknown", PushesPerSecond: 2, FailuresPerSecond: 0.2}, rates[0], "expected the rates over the window")
+
+	now = now.Add(dashboardRateWindow * time.Second)
+	testutil.ExpectEquals(t, 0, len(d.Rates()), "expected pushes older than the window not to be counted")
+	testutil.ExpectEquals(t, 0, len(d.rates), "expected idle push service providers to be forgotten")
+
+	failures := d.Failures()
+	testutil.ExpectEquals(t, 2, len(failures), "expected the failures to be kept")
+	testutil.ExpectStringEquals(t, "req2", failures[0].RequestID, "unexpected request id")
+	testutil.ExpectStringEquals(t, "timeout", failures[0].ErrorMsg, "unexpected error")
+
+	for i := 0; i < dashboardMaxFailures+5; i++ {
+		d.record(fmt.Sprint(i), "service", &push.Result{Err: push.NewError("timeout")})
+	}
+	failures = d.Failures()
+	testutil.ExpectEquals(t, dashboardMaxFailures, len(failures), "expected the number of failures to be bounded")
+	testutil.ExpectStringEquals(t, fmt.Sprint(dashboardMaxFailures+4), failures[0].RequestID, "expected the newest failure first")
+
+	var disabled *dashboardStats
+	disabled.record("req", "service", &push.Result{})
+	testutil.ExpectEquals(t, 0, len(disabled.Rates()), "expected no rates when disabled")
+}
+
+func TestDashboardBroadcastProgress(t *testing.T) {
+	b := newDashboardBroadcast(&Broadcast{ID: "b1", NrSubscribers: 50})
+	if b.ProgressPercent != nil {
+		t.Fatalf("expected no progress before the subscribers are counted, got %v", *b.ProgressPercent)
+	}
+	b = newDashboardBroadcast(&Broadcast{ID: "b1", NrSubscribers: 50, Total: 200})
+	testutil.ExpectEquals(t, 25.0, *b.ProgressPercent, "unexpected progress")
+	b = newDashboardBroadcast(&Broadcast{ID: "b1", NrSubscribers: 250, Total: 200})
+	testutil.ExpectEquals(t, 100.0, *b.ProgressPercent, "expected the progress not to exceed 100%")
+}
+
+func TestQueryDashboard(t *testing.T) {
+	api := newHealthTestAPI(&pingDatabase{})
+	api.backend.dashboard = newDashboardStats()
+	api.backend.dashboard.record("req", "service", &push.Result{Err: push.NewError("timeout")})
+
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest("GET", DashboardURL, nil))
+	var body map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("invalid response %q: %v", w.Body.String(), err)
+	}
+	testutil.ExpectStringEquals(t, UNIQUSH_SUCCESS, body["code"].(string), "unexpected code")
+	testutil.ExpectEquals(t, 1, len(body["recentFailures"].([]interface{})), "expected the recent failure")
+	testutil.ExpectEquals(t, 0, len(body["broadcasts"].([]interface{})), "expected no broadcasts")
+
+	w = httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest("GET", DashboardURL+"?stream=1&interval=0", nil))
+	testutil.ExpectEquals(t, 400, w.Code, "expected an invalid interval to be rejected")
+}
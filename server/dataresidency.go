@@ -0,0 +1,115 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/uniqush/goconf/conf"
+	"github.com/uniqush/uniqush-push/db"
+)
+
+// dataResidencySectionPrefix is the prefix of config sections with the database of a backend which services can be pinned to.
+const dataResidencySectionPrefix = "DataResidency."
+
+// DataResidencyConfig is a representation of the [DataResidency] section and [DataResidency.<backend>] sections of uniqush.conf.
+type DataResidencyConfig struct {
+	// Backends are the databases (e.g. in another region) which services can be pinned to, by name.
+	Backends map[string]*db.DatabaseConfig
+	// Services maps the services pinned to a backend to its name. The data of other services is saved in [Database].
+	Services map[string]string
+}
+
+// Pinned returns true if the data of service is kept in a backend of [DataResidency], so it must not be copied elsewhere (e.g. to peer regions).
+func (c *DataResidencyConfig) Pinned(service string) bool {
+	if c == nil {
+		return false
+	}
+	_, ok := c.Services[service]
+	return ok
+}
+
+// LoadDataResidencyConfig returns a representation of the [DataResidency] and [DataResidency.<backend>] sections from uniqush.conf.
+// services is a comma separated list of <service>=<backend>.
+func LoadDataResidencyConfig(c *conf.ConfigFile) (*DataResidencyConfig, error) {
+	config := &DataResidencyConfig{
+		Backends: make(map[string]*db.DatabaseConfig),
+		Services: make(map[string]string),
+	}
+	for _, section := range c.GetSections() {
+		// goconf lowercases section names, so match the prefix case insensitively. The name of the backend is the lowercase rest of the section name.
+		if !strings.HasPrefix(strings.ToLower(section), strings.ToLower(dataResidencySectionPrefix)) {
+			continue
+		}
+		backendConfig, err := loadDatabaseConfigFromSection(c, section)
+		if err != nil {
+			return nil, fmt.Errorf("[%s]: %v", section, err)
+		}
+		config.Backends[strings.ToLower(section[len(dataResidencySectionPrefix):])] = backendConfig
+	}
+	services, err := c.GetString("DataResidency", "services")
+	if err != nil {
+		return config, nil
+	}
+	for _, entry := range strings.Split(services, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		i := strings.LastIndexByte(entry, '=')
+		if i <= 0 {
+			return nil, fmt.Errorf("[DataResidency] services: invalid entry %q: must be <service>=<backend>", entry)
+		}
+		service, backend := strings.TrimSpace(entry[:i]), strings.ToLower(strings.TrimSpace(entry[i+1:]))
+		if _, ok := config.Backends[backend]; !ok {
+			return nil, fmt.Errorf("[DataResidency] services: %s is pinned to %q, which has no [%s%s] section", service, backend, dataResidencySectionPrefix, backend)
+		}
+		if _, ok := config.Services[service]; ok {
+			return nil, fmt.Errorf("[DataResidency] services: %s is pinned more than once", service)
+		}
+		config.Services[service] = backend
+	}
+	return config, nil
+}
+
+// newDataResidencyDatabase connects to the database of dbconf with newDB (e.g. db.NewPushDatabase), and to the backends of conf if any services are pinned.
+// The data of each pinned service is then saved in its backend, and the data of other services in the database of dbconf.
+func newDataResidencyDatabase(dbconf *db.DatabaseConfig, conf *DataResidencyConfig, newDB func(*db.DatabaseConfig) (db.PushDatabase, error)) (db.PushDatabase, error) {
+	database, err := newDB(dbconf)
+	if err != nil || len(conf.Services) == 0 {
+		return database, err
+	}
+	var names []string
+	for name := range conf.Backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	backends := make(map[string]db.PushDatabase, len(names))
+	for _, name := range names {
+		backendConf := conf.Backends[name]
+		backendConf.SlowQueryLogger = dbconf.SlowQueryLogger
+		backend, err := newDB(backendConf)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot connect to the database of [%s%s]: %v", dataResidencySectionPrefix, name, err)
+		}
+		backends[name] = backend
+	}
+	return db.NewServiceRoutedPushDatabase(database, backends, conf.Services), nil
+}
@@ -0,0 +1,108 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"testing"
+
+	"github.com/uniqush/goconf/conf"
+	"github.com/uniqush/uniqush-push/db"
+	"github.com/uniqush/uniqush-push/push"
+	"github.com/uniqush/uniqush-push/testutil"
+)
+
+func TestLoadDataResidencyConfig(t *testing.T) {
+	c := conf.NewConfigFile()
+	config, err := LoadDataResidencyConfig(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectEquals(t, 0, len(config.Services), "expected no services to be pinned by default")
+
+	c.AddOption("DataResidency.EU", "host", "redis.eu")
+	c.AddOption("DataResidency", "services", "eu-app=eu, eu-shop = EU")
+	config, err = LoadDataResidencyConfig(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectEquals(t, map[string]string{"eu-app": "eu", "eu-shop": "eu"}, config.Services, "unexpected pinned services")
+	testutil.ExpectStringEquals(t, "redis.eu", config.Backends["eu"].Host, "unexpected host of the backend")
+	testutil.ExpectEquals(t, true, config.Pinned("eu-app"), "expected eu-app to be pinned")
+	testutil.ExpectEquals(t, false, config.Pinned("us-app"), "expected other services not to be pinned")
+
+	c.AddOption("DataResidency", "services", "eu-app=ap")
+	if _, err := LoadDataResidencyConfig(c); err == nil {
+		t.Error("expected services pinned to unknown backends to be rejected")
+	}
+	c.AddOption("DataResidency", "services", "eu-app=eu,eu-app=eu")
+	if _, err := LoadDataResidencyConfig(c); err == nil {
+		t.Error("expected services pinned twice to be rejected")
+	}
+}
+
+// residencyTestDatabase records the subscriptions saved in one of the databases of TestDataResidencyDatabase.
+type residencyTestDatabase struct {
+	db.PushDatabase
+	host       string
+	subscribed []string
+}
+
+func (d *residencyTestDatabase) AddDeliveryPointToService(service string, subscriber string, dp *push.DeliveryPoint) (*push.PushServiceProvider, error) {
+	d.subscribed = append(d.subscribed, service+"/"+subscriber)
+	return nil, nil
+}
+
+func (d *residencyTestDatabase) GetPushServiceProviderConfigs() ([]*push.PushServiceProvider, error) {
+	psp := push.NewEmptyPushServiceProvider()
+	psp.FixedData[push.Service] = d.host
+	return []*push.PushServiceProvider{psp}, nil
+}
+
+func TestDataResidencyDatabase(t *testing.T) {
+	databases := make(map[string]*residencyTestDatabase)
+	newDB := func(c *db.DatabaseConfig) (db.PushDatabase, error) {
+		databases[c.Host] = &residencyTestDatabase{host: c.Host}
+		return databases[c.Host], nil
+	}
+	residency := &DataResidencyConfig{
+		Backends: map[string]*db.DatabaseConfig{"eu": {Host: "redis.eu"}},
+		Services: map[string]string{"eu-app": "eu"},
+	}
+	database, err := newDataResidencyDatabase(&db.DatabaseConfig{Host: "redis.us"}, residency, newDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, service := range []string{"eu-app", "us-app"} {
+		if _, err := database.AddDeliveryPointToService(service, "user1", push.NewEmptyDeliveryPoint()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	testutil.ExpectEquals(t, []string{"eu-app/user1"}, databases["redis.eu"].subscribed, "expected the pinned service to be saved in its backend")
+	testutil.ExpectEquals(t, []string{"us-app/user1"}, databases["redis.us"].subscribed, "expected other services to be saved in [Database]")
+	psps, err := database.GetPushServiceProviderConfigs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectEquals(t, 2, len(psps), "expected the push service providers of every database")
+
+	plain, err := newDataResidencyDatabase(&db.DatabaseConfig{Host: "redis.us"}, &DataResidencyConfig{}, newDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectEquals(t, databases["redis.us"], plain, "expected the database not to be wrapped if no services are pinned")
+}
@@ -0,0 +1,236 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"sync/atomic"
+	"time"
+
+	"github.com/uniqush/log"
+	"github.com/uniqush/uniqush-push/db"
+)
+
+const (
+	defaultDeliveryHistoryMaxRecords = 100
+	defaultDeliveryHistoryRetention  = 7 * 24 * time.Hour
+	// deliveryHistoryQueueSize is the number of records which may be waiting to be saved before new records are dropped.
+	deliveryHistoryQueueSize = 4096
+	// deliveryHistoryCompactionInterval is how often idle histories are removed from the index and histories above max_subscribers are evicted.
+	deliveryHistoryCompactionInterval = time.Hour
+)
+
+// DeliveryHistoryConfig is a representation of the settings in the [DeliveryHistory] section of uniqush.conf.
+type DeliveryHistoryConfig struct {
+	// MaxRecords is the number of records kept for each service+subscriber. 0 disables the delivery history.
+	MaxRecords int
+	// Retention is how long the history of a service+subscriber is kept after the last push to it. Older records of a history aren't returned.
+	Retention time.Duration
+	// MaxSubscribers is the number of service+subscribers whose histories are kept. The least recently pushed histories above it are evicted. 0 is unlimited.
+	MaxSubscribers int
+}
+
+// DeliveryRecord is a compact record of the result of sending a push to one delivery point of a subscriber.
+type DeliveryRecord struct {
+	RequestID           string `json:"requestId"`
+	Service             string `json:"service"`
+	Subscriber          string `json:"subscriber"`
+	DeliveryPoint       string `json:"deliveryPoint,omitempty"`
+	PushServiceProvider string `json:"pushServiceProvider,omitempty"`
+	MessageID           string `json:"messageId,omitempty"`
+	Code                string `json:"code"`
+	ErrorMsg            string `json:"errorMsg,omitempty"`
+	// RequestDate is the unix timestamp of the /push request.
+	RequestDate int64 `json:"requestDate"`
+	// Date is the unix timestamp of the result (which may be later than RequestDate for retries).
+	Date int64 `json:"date"`
+}
+
+// deliveryHistory saves the results of pushes in the background, so that support teams can find out if a subscriber got a push.
+type deliveryHistory struct {
+	db      db.PushDatabase
+	cluster *cluster
+	conf    DeliveryHistoryConfig
+	logger  log.Logger
+	records chan DeliveryRecord
+	// pending is the number of records which were queued but haven't been saved yet.
+	pending int64
+	now     func() time.Time
+}
+
+func newDeliveryHistory(database db.PushDatabase, cluster *cluster, conf DeliveryHistoryConfig, logger log.Logger) *deliveryHistory {
+	if conf.MaxRecords <= 0 {
+		return nil
+	}
+	h := &deliveryHistory{
+		db:      database,
+		cluster: cluster,
+		conf:    conf,
+		logger:  logger,
+		records: make(chan DeliveryRecord, deliveryHistoryQueueSize),
+		now:     time.Now,
+	}
+	go h.run()
+	go h.runCompaction()
+	return h
+}
+
+func (h *deliveryHistory) run() {
+	for record := range h.records {
+		b, err := json.Marshal(record)
+		if err == nil {
+			err = h.db.AddDeliveryRecord(record.Service, record.Subscriber, b, int64(h.conf.MaxRecords), h.conf.Retention)
+		}
+		if err != nil {
+			h.logger.Errorf("RequestID=%v Service=%v Subscriber=%v Cannot save delivery record: %v", record.RequestID, record.Service, record.Subscriber, err)
+		}
+		atomic.AddInt64(&h.pending, -1)
+	}
+}
+
+// runCompaction compacts the histories every compaction interval, if this instance is the leader of the cluster.
+func (h *deliveryHistory) runCompaction() {
+	for range time.Tick(deliveryHistoryCompactionInterval) {
+		if h.cluster.IsLeader() {
+			h.compact()
+		}
+	}
+}
+
+// compact removes the histories which expired from the index, and evicts the least recently pushed histories above MaxSubscribers.
+func (h *deliveryHistory) compact() {
+	evicted, err := h.db.CompactDeliveryHistories(h.now().Add(-h.conf.Retention).Unix(), int64(h.conf.MaxSubscribers))
+	if err != nil {
+		h.logger.Errorf("Cannot compact delivery histories: %v", err)
+	}
+	if evicted > 0 {
+		h.logger.Infof("Evicted the %d least recently pushed delivery histories above max_subscribers=%d", evicted, h.conf.MaxSubscribers)
+	}
+}
+
+// add queues a record to be saved. Records are dropped rather than slowing down pushes if the database can't keep up.
+func (h *deliveryHistory) add(record DeliveryRecord) {
+	atomic.AddInt64(&h.pending, 1)
+	select {
+	case h.records <- record:
+	default:
+		atomic.AddInt64(&h.pending, -1)
+		h.logger.Warnf("RequestID=%v Service=%v Subscriber=%v Dropped delivery record: queue is full", record.RequestID, record.Service, record.Subscriber)
+	}
+}
+
+// queued returns the number of records waiting to be saved.
+func (h *deliveryHistory) queued() int {
+	if h == nil {
+		return 0
+	}
+	return len(h.records)
+}
+
+// Flush waits until every queued record is saved, or until the deadline.
+// Returns false if some records weren't saved in time.
+func (h *deliveryHistory) Flush(deadline time.Time) bool {
+	if h == nil {
+		return true
+	}
+	return waitUntil(deadline, func() bool {
+		return atomic.LoadInt64(&h.pending) == 0
+	})
+}
+
+// Records returns the saved delivery records of a service+subscriber, newest first, up to Retention ago.
+// If requestID isn't empty, only records of that push request are returned.
+func (h *deliveryHistory) Records(service, subscriber, requestID string) ([]DeliveryRecord, error) {
+	records := []DeliveryRecord{}
+	if h == nil {
+		return records, nil
+	}
+	data, err := h.db.GetDeliveryRecords(service, subscriber)
+	if err != nil {
+		return nil, err
+	}
+	since := h.now().Add(-h.conf.Retention).Unix()
+	for _, b := range data {
+		var record DeliveryRecord
+		if err := json.Unmarshal(b, &record); err != nil {
+			h.logger.Errorf("Service=%v Subscriber=%v Invalid delivery record: %v", service, subscriber, err)
+			continue
+		}
+		if record.Date < since {
+			// Histories only expire after Retention without pushes, so records of active subscribers may be older than it.
+			break
+		}
+		if requestID != "" && record.RequestID != requestID {
+			continue
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// Wrap returns a response handler which saves the results of a push to the delivery history, in addition to passing them on to handler.
+func (h *deliveryHistory) Wrap(handler APIResponseHandler) APIResponseHandler {
+	if h == nil {
+		return handler
+	}
+	return &deliveryHistoryResponseHandler{
+		handler:     handler,
+		history:     h,
+		requestDate: time.Now().Unix(),
+	}
+}
+
+// deliveryHistoryResponseHandler records every result of a push which is about a specific subscriber.
+type deliveryHistoryResponseHandler struct {
+	handler     APIResponseHandler
+	history     *deliveryHistory
+	requestDate int64
+}
+
+var _ APIResponseHandler = &deliveryHistoryResponseHandler{}
+
+// AddDetailsToHandler records the result, then passes it on to the wrapped handler.
+func (handler *deliveryHistoryResponseHandler) AddDetailsToHandler(v APIResponseDetails) {
+	if v.Service != nil && v.Subscriber != nil && *v.Subscriber != "" {
+		handler.history.add(DeliveryRecord{
+			RequestID:           derefOrEmpty(v.RequestID),
+			Service:             *v.Service,
+			Subscriber:          *v.Subscriber,
+			DeliveryPoint:       derefOrEmpty(v.DeliveryPoint),
+			PushServiceProvider: derefOrEmpty(v.PushServiceProvider),
+			MessageID:           derefOrEmpty(v.MessageID),
+			Code:                v.Code,
+			ErrorMsg:            derefOrEmpty(v.ErrorMsg),
+			RequestDate:         handler.requestDate,
+			Date:                time.Now().Unix(),
+		})
+	}
+	handler.handler.AddDetailsToHandler(v)
+}
+
+// ToJSON returns the response of the wrapped handler.
+func (handler *deliveryHistoryResponseHandler) ToJSON() []byte {
+	return handler.handler.ToJSON()
+}
+
+func derefOrEmpty(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
@@ -0,0 +1,88 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/uniqush/log"
+	"github.com/uniqush/uniqush-push/db"
+	"github.com/uniqush/uniqush-push/testutil"
+)
+
+// historyDatabase returns a fixed delivery history and records compactions. Other methods aren't implemented.
+type historyDatabase struct {
+	db.PushDatabase
+	records        [][]byte
+	idleBefore     int64
+	maxSubscribers int64
+}
+
+func (d *historyDatabase) GetDeliveryRecords(srv, sub string) ([][]byte, error) {
+	return d.records, nil
+}
+
+func (d *historyDatabase) CompactDeliveryHistories(idleBefore int64, maxSubscribers int64) (int64, error) {
+	d.idleBefore, d.maxSubscribers = idleBefore, maxSubscribers
+	return 0, nil
+}
+
+func TestDeliveryHistoryResponseHandler(t *testing.T) {
+	history := &deliveryHistory{records: make(chan DeliveryRecord, 10)}
+	pushHandler := newPushResponseHandler(nil)
+	handler := history.Wrap(pushHandler)
+
+	reqID, service, sub, dp, psp, msgID := "rid", "myservice", "user1", "dp1", "psp1", "msg1"
+	handler.AddDetailsToHandler(APIResponseDetails{RequestID: &reqID, Service: &service, Subscriber: &sub, DeliveryPoint: &dp, PushServiceProvider: &psp, MessageID: &msgID, Code: UNIQUSH_SUCCESS})
+	// Results which aren't about a subscriber aren't recorded.
+	handler.AddDetailsToHandler(APIResponseDetails{RequestID: &reqID, Service: &service, Code: UNIQUSH_ERROR_NO_SUBSCRIBER})
+
+	testutil.ExpectEquals(t, 1, len(history.records), "expected one delivery record")
+	record := <-history.records
+	testutil.ExpectStringEquals(t, "user1", record.Subscriber, "unexpected subscriber")
+	testutil.ExpectStringEquals(t, "dp1", record.DeliveryPoint, "unexpected delivery point")
+	testutil.ExpectStringEquals(t, "msg1", record.MessageID, "unexpected message id")
+	testutil.ExpectStringEquals(t, UNIQUSH_SUCCESS, record.Code, "unexpected code")
+	testutil.ExpectEquals(t, 1, pushHandler.response.SuccessCount, "expected results to be passed on to the wrapped handler")
+	testutil.ExpectEquals(t, 1, pushHandler.response.FailureCount, "expected results to be passed on to the wrapped handler")
+}
+
+func TestDeliveryHistoryRetention(t *testing.T) {
+	database := &historyDatabase{}
+	logger := log.NewLogger(ioutil.Discard, "", log.LOGLEVEL_SILENT)
+	history := &deliveryHistory{db: database, conf: DeliveryHistoryConfig{MaxRecords: 10, Retention: time.Hour, MaxSubscribers: 1000}, logger: logger}
+	now := time.Unix(1500000000, 0)
+	history.now = func() time.Time { return now }
+	for _, date := range []int64{1500000000, 1499999000, 1499990000} {
+		b, _ := json.Marshal(DeliveryRecord{RequestID: "rid", Service: "srv", Subscriber: "sub", Date: date})
+		database.records = append(database.records, b)
+	}
+
+	records, err := history.Records("srv", "sub", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectEquals(t, 2, len(records), "expected records older than the retention not to be returned")
+
+	history.compact()
+	testutil.ExpectEquals(t, int64(1499996400), database.idleBefore, "expected histories without pushes during the retention to be compacted")
+	testutil.ExpectEquals(t, int64(1000), database.maxSubscribers, "expected max_subscribers to be enforced")
+}
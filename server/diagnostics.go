@@ -0,0 +1,253 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/uniqush/log"
+	"github.com/uniqush/uniqush-push/db"
+	"github.com/uniqush/uniqush-push/push"
+)
+
+// DiagnosticsURL returns the report of the self-check run at startup, or of a new self-check with refresh=1.
+const DiagnosticsURL = "/diagnostics"
+
+// Results of the checks of a self-check, from best to worst.
+const (
+	DiagnosticOK       = "ok"
+	DiagnosticWarning  = "warning"
+	DiagnosticCritical = "critical"
+)
+
+// Names of the checks of a self-check. Each push service provider has its own check, named pushServiceProvider:<name>.
+const (
+	diagnosticDatabase            = "database"
+	diagnosticClockSkew           = "clockSkew"
+	diagnosticPushServiceProvider = "pushServiceProvider"
+
+	defaultMaxClockSkew = 30 * time.Second
+
+	// maxConcurrentCredentialChecks is how many push services are asked to check credentials at the same time.
+	maxConcurrentCredentialChecks = 8
+)
+
+// DiagnosticsConfig is a representation of the [Diagnostics] section of uniqush.conf.
+type DiagnosticsConfig struct {
+	// ValidateCredentials makes the self-check ask the push service of every stored push service provider whether it accepts its credentials.
+	ValidateCredentials bool
+	// MaxClockSkew is the largest difference between the clocks of this instance and of the database before the self-check fails.
+	// Job leases, cluster heartbeats and signed requests rely on the clocks of instances agreeing.
+	MaxClockSkew time.Duration
+	// Strict makes uniqush-push refuse to start if any check has a warning, rather than only if a check is critical.
+	Strict bool
+}
+
+// DiagnosticCheck is the result of one check of a self-check.
+type DiagnosticCheck struct {
+	Name    string `json:"name"`
+	Status  string `json:"status"`
+	Message string `json:"message,omitempty"`
+}
+
+// DiagnosticsReport is the result of a self-check.
+type DiagnosticsReport struct {
+	// Started is the unix timestamp when the self-check started.
+	Started int64 `json:"started"`
+	// Duration is how long the self-check took, in milliseconds.
+	Duration int64 `json:"duration"`
+	// Status is the worst status of the checks.
+	Status string            `json:"status"`
+	Checks []DiagnosticCheck `json:"checks"`
+}
+
+// Failed returns an error describing the failed checks if the report has a critical check, or any warning if strict is set.
+func (r *DiagnosticsReport) Failed(strict bool) error {
+	var failed []string
+	for _, check := range r.Checks {
+		if check.Status == DiagnosticCritical || (strict && check.Status == DiagnosticWarning) {
+			failed = append(failed, fmt.Sprintf("%s: %s", check.Name, check.Message))
+		}
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	return fmt.Errorf("self-check failed: %s", strings.Join(failed, "; "))
+}
+
+// diagnostics checks that uniqush-push can work: that the database is reachable, that the clock of this instance agrees with it,
+// and that the stored push service providers are usable. It runs once at startup, so that a misconfigured instance stops right away
+// instead of failing the pushes it accepts, and again on request.
+type diagnostics struct {
+	db     db.PushDatabase
+	conf   DiagnosticsConfig
+	logger log.Logger
+	// validate asks the push service of a push service provider whether it accepts its credentials (see PushBackEnd.ValidateCredentials).
+	validate func(psp *push.PushServiceProvider) (supported bool, err error)
+	now      func() time.Time
+
+	mutex  sync.Mutex
+	report *DiagnosticsReport
+}
+
+func newDiagnostics(database db.PushDatabase, conf DiagnosticsConfig, logger log.Logger) *diagnostics {
+	return &diagnostics{
+		db:     database,
+		conf:   conf,
+		logger: logger,
+		now:    time.Now,
+	}
+}
+
+// Run runs a self-check, logs its results, and keeps its report for Report.
+func (d *diagnostics) Run() *DiagnosticsReport {
+	start := d.now()
+	r := &DiagnosticsReport{Started: start.Unix(), Status: DiagnosticOK}
+	r.Checks = append(r.Checks, d.checkDatabase())
+	if r.Checks[0].Status == DiagnosticOK {
+		r.Checks = append(r.Checks, d.checkClockSkew())
+		r.Checks = append(r.Checks, d.checkPushServiceProviders()...)
+	}
+	r.Duration = int64(d.now().Sub(start) / time.Millisecond)
+	for _, check := range r.Checks {
+		switch check.Status {
+		case DiagnosticCritical:
+			r.Status = DiagnosticCritical
+			d.logger.Errorf("Check=%v Self-check failed: %v", check.Name, check.Message)
+		case DiagnosticWarning:
+			if r.Status == DiagnosticOK {
+				r.Status = DiagnosticWarning
+			}
+			d.logger.Warnf("Check=%v Self-check warning: %v", check.Name, check.Message)
+		default:
+			d.logger.Infof("Check=%v Self-check passed %v", check.Name, check.Message)
+		}
+	}
+	d.logger.Infof("Self-check finished in %v: %v", d.now().Sub(start), r.Status)
+	d.mutex.Lock()
+	d.report = r
+	d.mutex.Unlock()
+	return r
+}
+
+// Report returns the report of the last self-check, or nil if none ran.
+func (d *diagnostics) Report() *DiagnosticsReport {
+	if d == nil {
+		return nil
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.report
+}
+
+func (d *diagnostics) checkDatabase() DiagnosticCheck {
+	check := DiagnosticCheck{Name: diagnosticDatabase, Status: DiagnosticOK}
+	if err := d.db.Ping(); err != nil {
+		check.Status = DiagnosticCritical
+		check.Message = fmt.Sprintf("unreachable: %v", err)
+	}
+	return check
+}
+
+func (d *diagnostics) checkClockSkew() DiagnosticCheck {
+	check := DiagnosticCheck{Name: diagnosticClockSkew, Status: DiagnosticOK}
+	before := d.now()
+	dbTime, err := d.db.Time()
+	if err != nil {
+		check.Status = DiagnosticWarning
+		check.Message = fmt.Sprintf("failed to read the clock of the database: %v", err)
+		return check
+	}
+	// Compare with the middle of the round trip, so that the latency of the database isn't counted as skew.
+	local := before.Add(d.now().Sub(before) / 2)
+	skew := local.Sub(dbTime)
+	direction := "ahead of"
+	if skew < 0 {
+		skew, direction = -skew, "behind"
+	}
+	check.Message = fmt.Sprintf("the clock is %v %s the database", skew.Round(time.Millisecond), direction)
+	if skew > d.conf.MaxClockSkew {
+		check.Status = DiagnosticCritical
+		check.Message += fmt.Sprintf(" (max_clock_skew is %v)", d.conf.MaxClockSkew)
+	}
+	return check
+}
+
+// checkPushServiceProviders checks that every stored push service provider can be loaded, and if ValidateCredentials is set,
+// that its push service accepts its credentials. Rejected credentials are a warning, since the other push service providers still work.
+func (d *diagnostics) checkPushServiceProviders() []DiagnosticCheck {
+	psps, err := d.db.GetPushServiceProviderConfigs()
+	if err != nil {
+		return []DiagnosticCheck{{Name: diagnosticPushServiceProvider, Status: DiagnosticWarning, Message: fmt.Sprintf("failed to load: %v", err)}}
+	}
+	checks := make([]DiagnosticCheck, len(psps))
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, maxConcurrentCredentialChecks)
+	for i, psp := range psps {
+		checks[i] = DiagnosticCheck{Name: diagnosticPushServiceProvider + ":" + psp.Name(), Status: DiagnosticOK, Message: "credentials not checked"}
+		if !d.conf.ValidateCredentials || d.validate == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(check *DiagnosticCheck, psp *push.PushServiceProvider) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			supported, err := d.validate(psp)
+			switch {
+			case err != nil:
+				check.Status = DiagnosticWarning
+				check.Message = fmt.Sprintf("service %s: credentials rejected: %v", psp.FixedData["service"], err)
+			case supported:
+				check.Message = "credentials accepted"
+			default:
+				check.Message = "credentials can't be checked"
+			}
+		}(&checks[i], psp)
+	}
+	wg.Wait()
+	return checks
+}
+
+// queryDiagnostics returns the report of the last self-check, after running a new one if refresh is set.
+func (api *RestAPI) queryDiagnostics(refresh bool) []byte {
+	type responseType struct {
+		*DiagnosticsReport
+		Code     string  `json:"code"`
+		ErrorMsg *string `json:"errorMsg,omitempty"`
+	}
+	d := api.backend.diagnostics
+	r := responseType{Code: UNIQUSH_SUCCESS}
+	if refresh && d != nil {
+		r.DiagnosticsReport = d.Run()
+	} else {
+		r.DiagnosticsReport = d.Report()
+	}
+	if r.DiagnosticsReport == nil {
+		msg := "no self-check has run"
+		r.Code, r.ErrorMsg = UNIQUSH_ERROR_GENERIC, &msg
+	}
+	json, err := json.Marshal(r)
+	if err != nil {
+		return []byte("Failed to serialize response")
+	}
+	return json
+}
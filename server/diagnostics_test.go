@@ -0,0 +1,94 @@
+package server
+
+import (
+	"errors"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/uniqush/log"
+	"github.com/uniqush/uniqush-push/db"
+	"github.com/uniqush/uniqush-push/push"
+	"github.com/uniqush/uniqush-push/testutil"
+)
+
+// diagnosticsDatabase is a database with a clock offset from the clock of this instance, and a push service provider per service.
+type diagnosticsDatabase struct {
+	db.PushDatabase
+	pingErr  error
+	offset   time.Duration
+	services []string
+}
+
+func (d *diagnosticsDatabase) Ping() error {
+	return d.pingErr
+}
+
+func (d *diagnosticsDatabase) Time() (time.Time, error) {
+	return time.Now().Add(d.offset), nil
+}
+
+func (d *diagnosticsDatabase) GetPushServiceProviderConfigs() ([]*push.PushServiceProvider, error) {
+	psm := push.GetPushServiceManager()
+	var psps []*push.PushServiceProvider
+	for _, service := range d.services {
+		psp, err := psm.BuildPushServiceProviderFromMap(map[string]string{"service": service, "pushservicetype": benchPushServiceName})
+		if err != nil {
+			return nil, err
+		}
+		psps = append(psps, psp)
+	}
+	return psps, nil
+}
+
+func newTestDiagnostics(t *testing.T, database *diagnosticsDatabase, conf DiagnosticsConfig) *diagnostics {
+	psm := push.GetPushServiceManager()
+	psm.ClearAllPushServiceTypesForUnitTest()
+	if err := psm.RegisterPushServiceType(newBenchPushServiceType(0)); err != nil {
+		t.Fatal(err)
+	}
+	return newDiagnostics(database, conf, log.NewLogger(ioutil.Discard, "", log.LOGLEVEL_SILENT))
+}
+
+func TestDiagnostics(t *testing.T) {
+	database := &diagnosticsDatabase{services: []string{"good", "bad"}}
+	d := newTestDiagnostics(t, database, DiagnosticsConfig{MaxClockSkew: time.Minute, ValidateCredentials: true})
+	d.validate = func(psp *push.PushServiceProvider) (bool, error) {
+		if psp.FixedData[push.Service] == "bad" {
+			return true, errors.New("invalid api key")
+		}
+		return true, nil
+	}
+	testutil.ExpectEquals(t, (*DiagnosticsReport)(nil), d.Report(), "expected no report before the self-check")
+
+	r := d.Run()
+	testutil.ExpectStringEquals(t, DiagnosticWarning, r.Status, "expected rejected credentials to be a warning")
+	testutil.ExpectEquals(t, 4, len(r.Checks), "expected a check per push service provider")
+	testutil.ExpectStringEquals(t, DiagnosticOK, r.Checks[1].Status, "expected the clocks to agree")
+	testutil.ExpectStringEquals(t, "credentials accepted", r.Checks[2].Message, "expected the credentials of the first push service provider to be accepted")
+	testutil.ExpectStringEquals(t, "service bad: credentials rejected: invalid api key", r.Checks[3].Message, "expected the error of the push service")
+	testutil.ExpectEquals(t, nil, r.Failed(false), "expected warnings not to stop uniqush-push")
+	testutil.ExpectEquals(t, true, r.Failed(true) != nil, "expected warnings to stop uniqush-push in strict mode")
+	testutil.ExpectEquals(t, r, d.Report(), "expected the report to be kept")
+
+	database.offset = -2 * time.Minute
+	r = d.Run()
+	testutil.ExpectStringEquals(t, DiagnosticCritical, r.Status, "expected a large clock skew to be critical")
+	testutil.ExpectEquals(t, true, r.Failed(false) != nil, "expected a critical check to stop uniqush-push")
+
+	database.pingErr = errors.New("connection refused")
+	r = d.Run()
+	testutil.ExpectEquals(t, []DiagnosticCheck{{Name: diagnosticDatabase, Status: DiagnosticCritical, Message: "unreachable: connection refused"}}, r.Checks, "expected the other checks to be skipped without a database")
+	testutil.ExpectStringEquals(t, "self-check failed: database: unreachable: connection refused", r.Failed(false).Error(), "unexpected error")
+}
+
+func TestDiagnosticsWithoutValidation(t *testing.T) {
+	d := newTestDiagnostics(t, &diagnosticsDatabase{services: []string{"app"}}, DiagnosticsConfig{MaxClockSkew: time.Minute})
+	d.validate = func(psp *push.PushServiceProvider) (bool, error) {
+		t.Error("expected credentials not to be checked")
+		return true, nil
+	}
+	r := d.Run()
+	testutil.ExpectStringEquals(t, DiagnosticOK, r.Status, "expected the self-check to pass")
+	testutil.ExpectStringEquals(t, "credentials not checked", r.Checks[2].Message, "expected credentials not to be checked")
+}
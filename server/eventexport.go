@@ -0,0 +1,278 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/uniqush/goconf/conf"
+	"github.com/uniqush/log"
+	"github.com/uniqush/uniqush-push/eventsink"
+	"github.com/uniqush/uniqush-push/push"
+)
+
+const (
+	// eventSinkSectionPrefix is the prefix of config sections with the settings of an event sink.
+	eventSinkSectionPrefix = "EventSink."
+
+	defaultEventSinkBatchSize     = 500
+	defaultEventSinkFlushInterval = 10 * time.Second
+	defaultEventSinkMaxAttempts   = 3
+	// eventSinkQueueSize is the number of events which may be waiting to be exported by a sink before new events are dropped.
+	eventSinkQueueSize = 65536
+	// eventSinkRetryInterval is the delay before the first retry of a batch. It doubles with each retry.
+	eventSinkRetryInterval = time.Second
+)
+
+// EventSinkConfig is a representation of an [EventSink.<name>] section of uniqush.conf.
+type EventSinkConfig struct {
+	Name string
+	// Type is the type of the sink (e.g. kafka or s3).
+	Type string
+	// BatchSize is the number of events above which a batch is exported without waiting for FlushInterval.
+	BatchSize     int
+	FlushInterval time.Duration
+	// MaxAttempts is the number of times a batch is written before it is dropped.
+	MaxAttempts int
+	Settings    eventsink.Settings
+}
+
+// LoadEventSinkConfigs returns a representation of the [EventSink.<name>] sections of uniqush.conf.
+// batch_size, flush_interval (in seconds) and max_attempts apply to every type of sink. The other settings are passed to the sink.
+func LoadEventSinkConfigs(c *conf.ConfigFile) ([]EventSinkConfig, error) {
+	var configs []EventSinkConfig
+	for _, section := range c.GetSections() {
+		// goconf lowercases section names, so match the prefix case insensitively. The name of the sink is the lowercase rest of the section name.
+		if !strings.HasPrefix(strings.ToLower(section), strings.ToLower(eventSinkSectionPrefix)) {
+			continue
+		}
+		options, err := c.GetOptions(section)
+		if err != nil {
+			return nil, fmt.Errorf("[%s]: %v", section, err)
+		}
+		settings := make(eventsink.Settings, len(options))
+		for _, option := range options {
+			if value, err := c.GetString(section, option); err == nil {
+				settings[option] = value
+			}
+		}
+		config := EventSinkConfig{Name: section[len(eventSinkSectionPrefix):], Type: settings["type"], Settings: settings}
+		if config.Type == "" {
+			return nil, fmt.Errorf("[%s]: type must be set", section)
+		}
+		if config.BatchSize, err = settings.Int("batch_size", defaultEventSinkBatchSize); err != nil {
+			return nil, fmt.Errorf("[%s]: %v", section, err)
+		}
+		if config.FlushInterval, err = settings.Seconds("flush_interval", defaultEventSinkFlushInterval); err != nil {
+			return nil, fmt.Errorf("[%s]: %v", section, err)
+		}
+		if config.MaxAttempts, err = settings.Int("max_attempts", defaultEventSinkMaxAttempts); err != nil {
+			return nil, fmt.Errorf("[%s]: %v", section, err)
+		}
+		configs = append(configs, config)
+	}
+	return configs, nil
+}
+
+// eventExporter exports the delivery and engagement events to the configured sinks in batches, in the background, and passes them to tail.
+// Each sink has its own queue, so that a slow or unavailable sink doesn't delay the others. Events are dropped when a queue is full, rather than slowing down pushes.
+type eventExporter struct {
+	sinks  []*eventSinkWorker
+	tail   *eventTail
+	logger log.Logger
+}
+
+type eventSinkWorker struct {
+	conf   EventSinkConfig
+	sink   eventsink.Sink
+	logger log.Logger
+	queue  chan eventsink.Event
+	// flush asks the worker to export its current batch without waiting for the flush interval.
+	flush chan struct{}
+	// pending is the number of events which were queued but haven't been exported (or given up on) yet.
+	pending int64
+	dropped int64
+}
+
+// newEventExporter returns nil if there are no sinks and tail is nil.
+func newEventExporter(configs []EventSinkConfig, tail *eventTail, logger log.Logger) (*eventExporter, error) {
+	if len(configs) == 0 && tail == nil {
+		return nil, nil
+	}
+	e := &eventExporter{tail: tail, logger: logger}
+	for _, config := range configs {
+		sink, err := eventsink.New(config.Type, config.Name, config.Settings, logger)
+		if err != nil {
+			return nil, fmt.Errorf("[%s%s]: %v", eventSinkSectionPrefix, config.Name, err)
+		}
+		w := &eventSinkWorker{
+			conf:   config,
+			sink:   sink,
+			logger: logger,
+			queue:  make(chan eventsink.Event, eventSinkQueueSize),
+			flush:  make(chan struct{}, 1),
+		}
+		e.sinks = append(e.sinks, w)
+		go w.run()
+	}
+	return e, nil
+}
+
+// enabled returns true if there is a sink, or a client tailing the events.
+func (e *eventExporter) enabled() bool {
+	return e != nil && (len(e.sinks) > 0 || e.tail.active())
+}
+
+// emit queues an event to be exported by every sink.
+func (e *eventExporter) emit(event eventsink.Event) {
+	if !e.enabled() {
+		return
+	}
+	event.Time = time.Now()
+	e.tail.publish(event)
+	for _, w := range e.sinks {
+		atomic.AddInt64(&w.pending, 1)
+		select {
+		case w.queue <- event:
+		default:
+			atomic.AddInt64(&w.pending, -1)
+			atomic.AddInt64(&w.dropped, 1)
+		}
+	}
+}
+
+// delivery exports the result of a push to a delivery point of service.
+func (e *eventExporter) delivery(reqID, service string, res *push.Result, notif *push.Notification) {
+	if !e.enabled() {
+		return
+	}
+	event := eventsink.Event{
+		Type:                eventsink.Delivery,
+		Service:             service,
+		RequestID:           reqID,
+		PushServiceProvider: getProviderNameOrUnknown(res.Provider),
+		DeliveryPoint:       getDeliveryPointNameOrUnknown(res.Destination),
+		MessageID:           res.MsgID,
+		Result:              pushResultLabel(res.Err),
+		Campaign:            notificationCampaign(notif),
+	}
+	if res.Provider != nil {
+		event.PushServiceType = res.Provider.PushServiceName()
+	}
+	if res.Destination != nil {
+		event.Subscriber = res.Destination.FixedData["subscriber"]
+	}
+	if res.Err != nil {
+		event.ErrorMsg = redactedError(res.Err)
+	}
+	e.emit(event)
+}
+
+// engagement exports a notification which was reported as opened or clicked (eventType is eventsink.Opened or eventsink.Clicked).
+func (e *eventExporter) engagement(eventType, service, campaign, notificationID string) {
+	e.emit(eventsink.Event{Type: eventType, Service: service, Campaign: campaign, NotificationID: notificationID})
+}
+
+// Flush exports the queued events of every sink, waiting until the deadline. Returns false if some events weren't exported in time.
+func (e *eventExporter) Flush(deadline time.Time) bool {
+	if e == nil {
+		return true
+	}
+	for _, w := range e.sinks {
+		select {
+		case w.flush <- struct{}{}:
+		default:
+		}
+	}
+	return waitUntil(deadline, func() bool {
+		for _, w := range e.sinks {
+			if atomic.LoadInt64(&w.pending) != 0 {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// Close closes every sink. It is called after Flush when stopping.
+func (e *eventExporter) Close() {
+	if e == nil {
+		return
+	}
+	for _, w := range e.sinks {
+		if err := w.sink.Close(); err != nil {
+			e.logger.Errorf("Sink=%v Cannot close: %v", w.conf.Name, err)
+		}
+	}
+}
+
+func (w *eventSinkWorker) run() {
+	ticker := time.NewTicker(w.conf.FlushInterval)
+	defer ticker.Stop()
+	var batch []eventsink.Event
+	for {
+		select {
+		case event := <-w.queue:
+			batch = append(batch, event)
+			if len(batch) < w.conf.BatchSize {
+				continue
+			}
+		case <-ticker.C:
+		case <-w.flush:
+			// Export everything which was queued before the flush, in batches of at most BatchSize.
+			for n := len(w.queue); n > 0; n-- {
+				batch = append(batch, <-w.queue)
+				if len(batch) >= w.conf.BatchSize {
+					w.write(batch)
+					batch = nil
+				}
+			}
+		}
+		if dropped := atomic.SwapInt64(&w.dropped, 0); dropped > 0 {
+			w.logger.Warnf("Sink=%v Dropped %v events: queue is full", w.conf.Name, dropped)
+		}
+		if len(batch) == 0 {
+			continue
+		}
+		w.write(batch)
+		batch = nil
+	}
+}
+
+// write exports a batch, retrying failures up to MaxAttempts times. Batches which still fail are logged and dropped.
+func (w *eventSinkWorker) write(batch []eventsink.Event) {
+	interval := eventSinkRetryInterval
+	for attempt := 1; ; attempt++ {
+		err := w.sink.Write(context.Background(), batch)
+		if err == nil {
+			w.logger.Debugf("Sink=%v Exported %v events", w.conf.Name, len(batch))
+			break
+		}
+		if attempt >= w.conf.MaxAttempts {
+			w.logger.Errorf("Sink=%v Attempts=%v Dropped %v events: %v", w.conf.Name, attempt, len(batch), err)
+			break
+		}
+		time.Sleep(interval)
+		interval *= 2
+	}
+	atomic.AddInt64(&w.pending, -int64(len(batch)))
+}
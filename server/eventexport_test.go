@@ -0,0 +1,78 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/uniqush/log"
+	"github.com/uniqush/uniqush-push/eventsink"
+	"github.com/uniqush/uniqush-push/push"
+	"github.com/uniqush/uniqush-push/testutil"
+)
+
+// memorySink keeps the batches it is given. The first failures writes fail.
+type memorySink struct {
+	mutex    sync.Mutex
+	batches  [][]eventsink.Event
+	failures int
+}
+
+func (s *memorySink) Write(ctx context.Context, events []eventsink.Event) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.failures > 0 {
+		s.failures--
+		return errors.New("unavailable")
+	}
+	s.batches = append(s.batches, events)
+	return nil
+}
+
+func (s *memorySink) Close() error {
+	return nil
+}
+
+func newTestEventExporter(sink eventsink.Sink, batchSize int) *eventExporter {
+	logger := log.NewLogger(ioutil.Discard, "", log.LOGLEVEL_SILENT)
+	w := &eventSinkWorker{
+		conf:   EventSinkConfig{Name: "memory", BatchSize: batchSize, FlushInterval: time.Hour, MaxAttempts: 2},
+		sink:   sink,
+		logger: logger,
+		queue:  make(chan eventsink.Event, eventSinkQueueSize),
+		flush:  make(chan struct{}, 1),
+	}
+	go w.run()
+	return &eventExporter{sinks: []*eventSinkWorker{w}, logger: logger}
+}
+
+func TestEventExporter(t *testing.T) {
+	sink := &memorySink{failures: 1}
+	e := newTestEventExporter(sink, 2)
+	psp, dp := newFailureTestPeers(t)
+	notif := push.NewEmptyNotification()
+	notif.Data[campaignKey] = "spring_sale"
+
+	e.delivery("r1", "myservice", &push.Result{Provider: psp, Destination: dp, MsgID: "m1", Content: notif}, notif)
+	e.delivery("r1", "myservice", &push.Result{Provider: psp, Destination: dp, Err: push.NewConnectionError(errors.New("reset")), Content: notif}, notif)
+	e.engagement(eventsink.Clicked, "myservice", "spring_sale", "m1")
+	testutil.ExpectEquals(t, true, e.Flush(time.Now().Add(10*time.Second)), "expected the events to be exported")
+
+	testutil.ExpectEquals(t, 2, len(sink.batches), "expected a full batch to be retried, then the rest to be exported when flushing")
+	delivered := sink.batches[0][0]
+	testutil.ExpectStringEquals(t, eventsink.Delivery, delivered.Type, "unexpected type")
+	testutil.ExpectStringEquals(t, "m1", delivered.MessageID, "expected the message id")
+	testutil.ExpectStringEquals(t, "success", delivered.Result, "expected the result")
+	testutil.ExpectStringEquals(t, "spring_sale", delivered.Campaign, "expected the campaign of the push")
+	testutil.ExpectStringEquals(t, psp.Name(), delivered.PushServiceProvider, "expected the push service provider")
+	testutil.ExpectStringEquals(t, dp.FixedData["subscriber"], delivered.Subscriber, "expected the subscriber")
+	testutil.ExpectStringEquals(t, "connection_error", sink.batches[0][1].Result, "expected failures to be exported")
+	testutil.ExpectEquals(t, eventsink.Event{Type: eventsink.Clicked, Time: sink.batches[1][0].Time, Service: "myservice", Campaign: "spring_sale", NotificationID: "m1"}, sink.batches[1][0], "expected engagement to be exported")
+
+	var disabled *eventExporter
+	disabled.delivery("r1", "myservice", &push.Result{Provider: psp, Destination: dp}, notif)
+	testutil.ExpectEquals(t, true, disabled.Flush(time.Now()), "expected nothing to flush without sinks")
+}
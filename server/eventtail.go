@@ -0,0 +1,111 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/uniqush/uniqush-push/eventsink"
+)
+
+// QueryEventsURL streams the delivery and engagement events on the admin listener as they happen, one JSON object per line (e.g. for uniqushctl tail).
+const QueryEventsURL = "/events"
+
+// eventTailBufferSize is the number of events which may be waiting to be sent to a client of /events before new events are dropped for it.
+const eventTailBufferSize = 1024
+
+// eventTail passes the events of eventExporter to the clients of /events. Slow clients miss events, rather than slowing down pushes.
+type eventTail struct {
+	mutex       sync.Mutex
+	subscribers map[chan eventsink.Event]struct{}
+	// n is the number of subscribers, read without the mutex for every event.
+	n int32
+}
+
+func newEventTail() *eventTail {
+	return &eventTail{subscribers: make(map[chan eventsink.Event]struct{})}
+}
+
+// active returns true if any client is tailing the events.
+func (t *eventTail) active() bool {
+	return t != nil && atomic.LoadInt32(&t.n) > 0
+}
+
+// publish sends an event to every client, dropping it for clients which are behind.
+func (t *eventTail) publish(event eventsink.Event) {
+	if !t.active() {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for ch := range t.subscribers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// subscribe returns the channel of the events of a client, and a function to stop receiving them.
+func (t *eventTail) subscribe() (<-chan eventsink.Event, func()) {
+	ch := make(chan eventsink.Event, eventTailBufferSize)
+	t.mutex.Lock()
+	t.subscribers[ch] = struct{}{}
+	atomic.AddInt32(&t.n, 1)
+	t.mutex.Unlock()
+	return ch, func() {
+		t.mutex.Lock()
+		delete(t.subscribers, ch)
+		atomic.AddInt32(&t.n, -1)
+		t.mutex.Unlock()
+	}
+}
+
+// serveEvents streams events to the client until it disconnects. The service and type parameters only stream the events of a service or of a type (e.g. delivery).
+func (t *eventTail) serveEvents(w http.ResponseWriter, r *http.Request) {
+	service := r.FormValue("service")
+	eventType := r.FormValue("type")
+	flusher, _ := w.(http.Flusher)
+	events, stop := t.subscribe()
+	defer stop()
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	if flusher != nil {
+		flusher.Flush()
+	}
+	encoder := json.NewEncoder(w)
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event := <-events:
+			if (service != "" && event.Service != service) || (eventType != "" && event.Type != eventType) {
+				continue
+			}
+			if err := encoder.Encode(event); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/uniqush/uniqush-push/eventsink"
+	"github.com/uniqush/uniqush-push/testutil"
+)
+
+func TestEventTail(t *testing.T) {
+	tail := newEventTail()
+	exporter, err := newEventExporter(nil, tail, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectEquals(t, false, exporter.enabled(), "expected events not to be built until a client is tailing them")
+
+	server := httptest.NewServer(http.HandlerFunc(tail.serveEvents))
+	defer server.Close()
+	resp, err := http.Get(server.URL + QueryEventsURL + "?service=srv1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	testutil.ExpectEquals(t, true, exporter.enabled(), "expected events to be built while a client is tailing them")
+
+	exporter.engagement(eventsink.Opened, "srv2", "", "n1")
+	exporter.engagement(eventsink.Opened, "srv1", "spring", "n2")
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+	select {
+	case line := <-lines:
+		var event eventsink.Event
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			t.Fatal(err)
+		}
+		testutil.ExpectStringEquals(t, "srv1", event.Service, "expected only the events of the service")
+		testutil.ExpectStringEquals(t, "n2", event.NotificationID, "unexpected event")
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the event to be streamed")
+	}
+}
@@ -0,0 +1,177 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/uniqush/log"
+	"github.com/uniqush/uniqush-push/push"
+)
+
+const (
+	defaultCircuitBreakerThreshold = 5
+	defaultCircuitBreakerCooldown  = 30 * time.Second
+)
+
+// FailoverConfig is a representation of the [Failover] section of uniqush.conf.
+type FailoverConfig struct {
+	// CircuitBreakerThreshold is the number of consecutive failures of a push service provider after which pushes go straight to its fallback. 0 disables this.
+	CircuitBreakerThreshold int
+	// CircuitBreakerCooldown is how long pushes go straight to the fallback before the push service provider is tried again.
+	CircuitBreakerCooldown time.Duration
+}
+
+// pspCircuitBreaker tracks consecutive failures of push service providers (by name), to stop sending pushes to a provider that is down.
+type pspCircuitBreaker struct {
+	mutex     sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  map[string]int
+	openUntil map[string]time.Time
+	now       func() time.Time
+}
+
+func newPSPCircuitBreaker(conf FailoverConfig) *pspCircuitBreaker {
+	if conf.CircuitBreakerThreshold <= 0 {
+		return nil
+	}
+	return &pspCircuitBreaker{
+		threshold: conf.CircuitBreakerThreshold,
+		cooldown:  conf.CircuitBreakerCooldown,
+		failures:  make(map[string]int),
+		openUntil: make(map[string]time.Time),
+		now:       time.Now,
+	}
+}
+
+// IsOpen returns true if pushes to the push service provider pspName should go to its fallback instead.
+// Once the cooldown has elapsed, pushes are tried again, and a single failure will reopen the circuit.
+func (b *pspCircuitBreaker) IsOpen(pspName string) bool {
+	if b == nil {
+		return false
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	until, ok := b.openUntil[pspName]
+	if !ok {
+		return false
+	}
+	if b.now().Before(until) {
+		return true
+	}
+	delete(b.openUntil, pspName)
+	b.failures[pspName] = b.threshold - 1
+	return false
+}
+
+// RecordFailure counts a failure of the push service provider which could be fixed by failing over.
+func (b *pspCircuitBreaker) RecordFailure(pspName string) {
+	if b == nil {
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.failures[pspName]++
+	if b.failures[pspName] >= b.threshold {
+		b.openUntil[pspName] = b.now().Add(b.cooldown)
+	}
+}
+
+// RecordSuccess resets the count of consecutive failures of the push service provider.
+func (b *pspCircuitBreaker) RecordSuccess(pspName string) {
+	if b == nil {
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	delete(b.failures, pspName)
+}
+
+// OpenCircuits returns the names of the push service providers whose circuit is open, sorted.
+func (b *pspCircuitBreaker) OpenCircuits() []string {
+	if b == nil {
+		return nil
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	var names []string
+	now := b.now()
+	for name, until := range b.openUntil {
+		if now.Before(until) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// isFailoverError returns true if the error indicates that the push service provider (rather than the delivery point or payload) is the problem.
+func isFailoverError(err push.Error) bool {
+	switch err.(type) {
+	case *push.BadPushServiceProvider, *push.ConnectionError:
+		return true
+	default:
+		return false
+	}
+}
+
+// fallbackFor returns the fallback push service provider of provider, if there is one which can push to dest.
+func (backend *PushBackEnd) fallbackFor(provider *push.PushServiceProvider, dest *push.DeliveryPoint, logger log.Logger) *push.PushServiceProvider {
+	if provider == nil || dest == nil {
+		return nil
+	}
+	fallback, err := backend.db.GetFallbackPushServiceProvider(provider)
+	if err != nil {
+		logger.Errorf("PushServiceProvider=%v Cannot get fallback: %v", provider.Name(), err)
+		return nil
+	}
+	if fallback == nil || fallback.PushServiceName() != dest.PushServiceName() {
+		return nil
+	}
+	return fallback
+}
+
+// failover resends the push to dest through the fallback of provider.
+// Returns false if there is no compatible fallback, in which case the caller should report the original error.
+func (backend *PushBackEnd) failover(
+	reqID string,
+	remoteAddr string,
+	service string,
+	provider *push.PushServiceProvider,
+	dest *push.DeliveryPoint,
+	notif *push.Notification,
+	logger log.Logger,
+	retry retryState,
+	handler APIResponseHandler,
+) bool {
+	if notif == nil {
+		return false
+	}
+	fallback := backend.fallbackFor(provider, dest, logger)
+	if fallback == nil {
+		return false
+	}
+	sub := dest.FixedData["subscriber"]
+	logger.Infof("RequestID=%v Service=%v Subscriber=%v PushServiceProvider=%v DeliveryPoint=%v Failover to %v", reqID, service, sub, provider.Name(), dest.Name(), fallback.Name())
+	// The fallback gets a fresh set of attempts.
+	backend.pushImpl(retry.context(), reqID, remoteAddr, service, []string{sub}, nil, notif, nil, logger, fallback, dest, retryState{policy: retry.policy}, handler)
+	return true
+}
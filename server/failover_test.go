@@ -0,0 +1,54 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/uniqush/uniqush-push/testutil"
+)
+
+func TestPSPCircuitBreaker(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	b := newPSPCircuitBreaker(FailoverConfig{CircuitBreakerThreshold: 2, CircuitBreakerCooldown: 10 * time.Second})
+	b.now = func() time.Time { return now }
+
+	b.RecordFailure("fcm:a")
+	testutil.ExpectEquals(t, false, b.IsOpen("fcm:a"), "expected circuit to stay closed below threshold")
+	b.RecordSuccess("fcm:a")
+	b.RecordFailure("fcm:a")
+	testutil.ExpectEquals(t, false, b.IsOpen("fcm:a"), "expected a success to reset the failure count")
+	b.RecordFailure("fcm:a")
+	testutil.ExpectEquals(t, true, b.IsOpen("fcm:a"), "expected circuit to open at threshold")
+	testutil.ExpectEquals(t, false, b.IsOpen("fcm:b"), "expected other psps to be unaffected")
+	testutil.ExpectEquals(t, []string{"fcm:a"}, b.OpenCircuits(), "expected the open circuit to be listed")
+
+	now = now.Add(11 * time.Second)
+	testutil.ExpectEquals(t, 0, len(b.OpenCircuits()), "expected no open circuits after cooldown")
+	testutil.ExpectEquals(t, false, b.IsOpen("fcm:a"), "expected circuit to close after cooldown")
+	b.RecordFailure("fcm:a")
+	testutil.ExpectEquals(t, true, b.IsOpen("fcm:a"), "expected one failure after cooldown to reopen the circuit")
+}
+
+func TestPSPCircuitBreakerDisabled(t *testing.T) {
+	b := newPSPCircuitBreaker(FailoverConfig{CircuitBreakerThreshold: 0})
+	b.RecordFailure("fcm:a")
+	testutil.ExpectEquals(t, false, b.IsOpen("fcm:a"), "expected a disabled circuit breaker to never open")
+	testutil.ExpectEquals(t, 0, len(b.OpenCircuits()), "expected a disabled circuit breaker to have no open circuits")
+}
@@ -0,0 +1,270 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/uniqush/uniqush-push/push"
+)
+
+const (
+	// failureReportSlots is the number of minutes during which failures are grouped. Older failures are forgotten.
+	failureReportSlots = 60
+	// failureReportMaxGroups is the number of distinct groups kept per minute. Failures of further groups are counted under failureReportOtherCause.
+	failureReportMaxGroups = 1000
+	// maxFailureCauseLength is the length above which causes are truncated.
+	maxFailureCauseLength = 200
+	// defaultFailureReportLimit is the number of groups returned by /failures if limit isn't given.
+	defaultFailureReportLimit = 20
+	// maxFailureReportLimit is the most groups which can be returned by /failures at once.
+	maxFailureReportLimit = 1000
+)
+
+// failureReportOtherCause is the cause of the failures which didn't fit in failureReportMaxGroups groups.
+const failureReportOtherCause = "(other causes)"
+
+// FailureGroup is the number of recent results of pushes of a service to a push service provider which failed (or invalidated the delivery point)
+// for the same reason, e.g. 12431 unsubscribed/Unregistered results for apns:abc during the last hour.
+type FailureGroup struct {
+	Service             string `json:"service"`
+	PushServiceProvider string `json:"pushServiceProvider"`
+	// Class is the result label of uniqush_pushes_total (e.g. bad_delivery_point, connection_error or unsubscribed).
+	Class string `json:"class"`
+	// Cause is the error without the delivery point, e.g. "Unregistered" or the reason given by the push service.
+	Cause string `json:"cause"`
+	Count int64  `json:"count"`
+	// FirstSeen and LastSeen are the unix timestamps of the first and last failures of the group during the window.
+	FirstSeen int64 `json:"firstSeen"`
+	LastSeen  int64 `json:"lastSeen"`
+	// Example is the last failure of the group.
+	Example DashboardFailure `json:"example"`
+}
+
+type failureGroupKey struct {
+	service string
+	psp     string
+	class   string
+	cause   string
+}
+
+type failureSlot struct {
+	// minute is the number of minutes since the unix epoch at the start of the slot.
+	minute int64
+	groups map[failureGroupKey]*FailureGroup
+}
+
+// failureReport groups the failures of the last failureReportSlots minutes by service, push service provider, class and cause,
+// so that operators see which errors are widespread rather than individual failures.
+type failureReport struct {
+	mutex sync.Mutex
+	// slots has a slot per minute of the window, and one for the current minute.
+	slots [failureReportSlots + 1]failureSlot
+	now   func() time.Time
+}
+
+func newFailureReport() *failureReport {
+	return &failureReport{now: time.Now}
+}
+
+// failureCause returns the reason of a failure without the name of the delivery point, so that failures for the same reason are grouped together.
+func failureCause(err push.Error) string {
+	var cause string
+	switch e := err.(type) {
+	case *push.UnsubscribeUpdate:
+		cause = "Unregistered"
+	case *push.InvalidRegistrationUpdate:
+		cause = "InvalidRegistration"
+	case *push.BadDeliveryPoint:
+		cause = "BadDeliveryPoint"
+		if e.Details != "" {
+			cause = e.Details
+		}
+	case *push.BadPushServiceProvider:
+		cause = "BadPushServiceProvider"
+		if e.Details != "" {
+			cause = e.Details
+		}
+	case *push.BadNotification:
+		cause = "BadNotification"
+		if e.Details != "" {
+			cause = e.Details
+		}
+	case *push.RetryError:
+		cause = "Retry"
+		if e.Reason != nil {
+			cause = e.Reason.Error()
+		}
+	case *push.ConnectionError:
+		cause = fmt.Sprint(e.Err)
+	default:
+		cause = err.Error()
+	}
+	cause = redaction.Redact(cause)
+	if len(cause) > maxFailureCauseLength {
+		cause = cause[:maxFailureCauseLength]
+	}
+	return cause
+}
+
+// record counts the result of a push to a delivery point of service, if it failed or invalidated the delivery point.
+func (r *failureReport) record(reqID, service string, res *push.Result) {
+	if r == nil || analyticsCounter(res.Err) == analyticsAccepted {
+		return
+	}
+	pspName := getProviderNameOrUnknown(res.Provider)
+	key := failureGroupKey{service: service, psp: pspName, class: pushResultLabel(res.Err), cause: failureCause(res.Err)}
+	now := r.now().Unix()
+	example := DashboardFailure{
+		Date:                now,
+		RequestID:           reqID,
+		Service:             service,
+		PushServiceProvider: pspName,
+		Result:              key.class,
+		ErrorMsg:            redactedError(res.Err),
+	}
+	if res.Destination != nil {
+		example.DeliveryPoint = res.Destination.Name()
+	}
+	minute := now / 60
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	slot := &r.slots[minute%int64(len(r.slots))]
+	if slot.minute != minute || slot.groups == nil {
+		*slot = failureSlot{minute: minute, groups: make(map[failureGroupKey]*FailureGroup)}
+	}
+	group, ok := slot.groups[key]
+	if !ok && len(slot.groups) >= failureReportMaxGroups {
+		key.cause = failureReportOtherCause
+		group, ok = slot.groups[key]
+	}
+	if !ok {
+		group = &FailureGroup{Service: key.service, PushServiceProvider: key.psp, Class: key.class, Cause: key.cause, FirstSeen: now}
+		slot.groups[key] = group
+	}
+	group.Count++
+	group.LastSeen = now
+	group.Example = example
+}
+
+// failureReportFilter selects the groups returned by /failures. Empty fields match every group.
+type failureReportFilter struct {
+	service string
+	psp     string
+	// window is the number of minutes before the current one to include.
+	window int64
+	limit  int
+}
+
+// Groups returns the groups of failures matching filter during the window (and the current minute), most frequent first.
+func (r *failureReport) Groups(filter failureReportFilter) []FailureGroup {
+	groups := []FailureGroup{}
+	if r == nil {
+		return groups
+	}
+	current := r.now().Unix() / 60
+	merged := make(map[failureGroupKey]*FailureGroup)
+	r.mutex.Lock()
+	for _, slot := range r.slots {
+		if slot.minute < current-filter.window || slot.minute > current {
+			continue
+		}
+		for key, group := range slot.groups {
+			if (filter.service != "" && filter.service != key.service) || (filter.psp != "" && filter.psp != key.psp) {
+				continue
+			}
+			m, ok := merged[key]
+			if !ok {
+				g := *group
+				merged[key] = &g
+				continue
+			}
+			m.Count += group.Count
+			if group.FirstSeen < m.FirstSeen {
+				m.FirstSeen = group.FirstSeen
+			}
+			if group.LastSeen > m.LastSeen {
+				m.LastSeen = group.LastSeen
+				m.Example = group.Example
+			}
+		}
+	}
+	r.mutex.Unlock()
+	for _, group := range merged {
+		groups = append(groups, *group)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].Count != groups[j].Count {
+			return groups[i].Count > groups[j].Count
+		}
+		return groups[i].LastSeen > groups[j].LastSeen
+	})
+	if len(groups) > filter.limit {
+		groups = groups[:filter.limit]
+	}
+	return groups
+}
+
+// queryFailureReport responds with the failures of this instance during the last window seconds (3600 by default and at most),
+// grouped by service, push service provider, class and cause, most frequent first.
+// They can be filtered by service and push service provider (psp), and limit sets the number of groups.
+func (api *RestAPI) queryFailureReport(kv url.Values) []byte {
+	type responseType struct {
+		// Window is the number of seconds covered by the groups.
+		Window       int64          `json:"window,omitempty"`
+		Groups       []FailureGroup `json:"groups,omitempty"`
+		ErrorMessage *string        `json:"errorMsg,omitempty"`
+		Code         string         `json:"code"`
+	}
+	var r responseType
+	filter := failureReportFilter{service: kv.Get("service"), psp: kv.Get("psp"), window: failureReportSlots, limit: defaultFailureReportLimit}
+	var err error
+	if s := kv.Get("window"); s != "" {
+		var seconds int64
+		if seconds, err = strconv.ParseInt(s, 10, 64); err != nil || seconds < 60 || seconds > failureReportSlots*60 {
+			err = fmt.Errorf("window must be between 60 and %d seconds", failureReportSlots*60)
+		} else {
+			filter.window = seconds / 60
+		}
+	}
+	if s := kv.Get("limit"); s != "" && err == nil {
+		if filter.limit, err = strconv.Atoi(s); err == nil && (filter.limit <= 0 || filter.limit > maxFailureReportLimit) {
+			err = fmt.Errorf("limit must be between 1 and %d", maxFailureReportLimit)
+		}
+	}
+	if err != nil {
+		errorMsg := redactedError(err)
+		r.Code = UNIQUSH_ERROR_GENERIC
+		r.ErrorMessage = &errorMsg
+	} else {
+		r.Window = filter.window * 60
+		r.Groups = api.backend.failures.Groups(filter)
+		r.Code = UNIQUSH_SUCCESS
+	}
+	json, err := json.Marshal(r)
+	if err != nil {
+		return []byte("Failed to serialize response")
+	}
+	return json
+}
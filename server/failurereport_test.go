@@ -0,0 +1,101 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/uniqush/uniqush-push/push"
+	"github.com/uniqush/uniqush-push/testutil"
+)
+
+// newFailureTestPeers returns a push service provider and delivery point of the bench push service type, whose names can be used in errors.
+func newFailureTestPeers(t *testing.T) (*push.PushServiceProvider, *push.DeliveryPoint) {
+	psm := push.GetPushServiceManager()
+	psm.ClearAllPushServiceTypesForUnitTest()
+	if err := psm.RegisterPushServiceType(newBenchPushServiceType(0)); err != nil {
+		t.Fatal(err)
+	}
+	psp, err := psm.BuildPushServiceProviderFromMap(map[string]string{"service": "myservice", "pushservicetype": benchPushServiceName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dp, err := psm.BuildDeliveryPointFromMap(map[string]string{"service": "myservice", "subscriber": "user1", "pushservicetype": benchPushServiceName, "token": "token1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return psp, dp
+}
+
+func TestFailureCause(t *testing.T) {
+	_, dp := newFailureTestPeers(t)
+	testutil.ExpectStringEquals(t, "Unregistered", failureCause(push.NewUnsubscribeUpdate(nil, dp)), "expected invalidated delivery points to be grouped")
+	testutil.ExpectStringEquals(t, "MismatchSenderId", failureCause(push.NewBadDeliveryPointWithDetails(dp, "MismatchSenderId")), "expected the details without the delivery point")
+	testutil.ExpectStringEquals(t, "i/o timeout", failureCause(push.NewConnectionError(errors.New("i/o timeout"))), "expected the underlying connection error")
+	testutil.ExpectEquals(t, maxFailureCauseLength, len(failureCause(push.NewError(strings.Repeat("x ", 500)))), "expected long causes to be truncated")
+	testutil.ExpectStringEquals(t, "BadDeviceToken [redacted:abcdef]", failureCause(push.NewError("BadDeviceToken "+strings.Repeat("0123456789abcdef", 4))), "expected device tokens to be redacted from causes")
+}
+
+func TestFailureReport(t *testing.T) {
+	r := newFailureReport()
+	now := time.Unix(1500000000, 0)
+	r.now = func() time.Time { return now }
+	psp, dp := newFailureTestPeers(t)
+
+	for i := 0; i < 3; i++ {
+		r.record("req1", "myservice", &push.Result{Provider: psp, Destination: dp, Err: push.NewUnsubscribeUpdate(psp, dp)})
+	}
+	r.record("req1", "myservice", &push.Result{Provider: psp, Destination: dp})
+	now = now.Add(10 * time.Minute)
+	r.record("req2", "myservice", &push.Result{Provider: psp, Destination: dp, Err: push.NewUnsubscribeUpdate(psp, dp)})
+	r.record("req2", "myservice", &push.Result{Provider: psp, Destination: dp, Err: push.NewConnectionError(errors.New("i/o timeout"))})
+	r.record("req3", "otherservice", &push.Result{Err: push.NewError("timeout")})
+
+	groups := r.Groups(failureReportFilter{service: "myservice", window: failureReportSlots, limit: 10})
+	testutil.ExpectEquals(t, 2, len(groups), "expected the failures to be grouped by cause, without successful pushes")
+	testutil.ExpectEquals(t, FailureGroup{
+		Service:             "myservice",
+		PushServiceProvider: psp.Name(),
+		Class:               "unsubscribed",
+		Cause:               "Unregistered",
+		Count:               4,
+		FirstSeen:           1500000000,
+		LastSeen:            1500000600,
+		Example:             groups[0].Example,
+	}, groups[0], "expected the most frequent group first")
+	testutil.ExpectStringEquals(t, "req2", groups[0].Example.RequestID, "expected the last failure as the example")
+	testutil.ExpectStringEquals(t, "connection_error", groups[1].Class, "expected the other group")
+
+	groups = r.Groups(failureReportFilter{window: 5, limit: 10})
+	testutil.ExpectEquals(t, 3, len(groups), "expected failures older than the window not to be counted")
+	testutil.ExpectEquals(t, int64(1), groups[0].Count, "expected failures older than the window not to be counted")
+	testutil.ExpectEquals(t, 1, len(r.Groups(failureReportFilter{window: 5, limit: 1})), "expected groups to be limited")
+
+	now = now.Add((failureReportSlots + 1) * time.Minute)
+	testutil.ExpectEquals(t, 0, len(r.Groups(failureReportFilter{window: failureReportSlots, limit: 10})), "expected old failures to be forgotten")
+}
+
+func TestQueryFailureReport(t *testing.T) {
+	api := newHealthTestAPI(nil)
+	api.backend.failures = newFailureReport()
+	api.backend.failures.record("req1", "myservice", &push.Result{Err: push.NewError("timeout")})
+
+	var response struct {
+		Window int64          `json:"window"`
+		Groups []FailureGroup `json:"groups"`
+		Code   string         `json:"code"`
+	}
+	if err := json.Unmarshal(api.queryFailureReport(url.Values{"window": {"600"}}), &response); err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectStringEquals(t, UNIQUSH_SUCCESS, response.Code, "expected success")
+	testutil.ExpectEquals(t, int64(600), response.Window, "expected the window")
+	testutil.ExpectEquals(t, 1, len(response.Groups), "expected one group")
+
+	response.Code = ""
+	json.Unmarshal(api.queryFailureReport(url.Values{"window": {"86400"}}), &response)
+	testutil.ExpectStringEquals(t, UNIQUSH_ERROR_GENERIC, response.Code, "expected windows longer than an hour to be rejected")
+}
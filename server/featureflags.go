@@ -0,0 +1,243 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/uniqush/log"
+	"github.com/uniqush/uniqush-push/db"
+)
+
+// Paths of the admin listener which show and change the feature flags of services.
+const (
+	QueryFeatureFlagsURL = "/featureflags"
+	SetFeatureFlagURL    = "/setfeatureflag"
+)
+
+// Feature flags, which enable subsystems for some services while they are rolled out.
+const (
+	FeatureWebPush  = "web_push"
+	FeatureReceipts = "receipts"
+	FeatureDedupe   = "dedupe"
+)
+
+// knownFeatureFlags are the feature flags which can be set. Flags are disabled for every service unless they are set.
+var knownFeatureFlags = []string{FeatureWebPush, FeatureReceipts, FeatureDedupe}
+
+// featureFlagAllServices is the service of feature flags set for every service. Flags set for a service take precedence over it.
+const featureFlagAllServices = "*"
+
+// featureFlagsRefreshInterval is how often each instance reloads the feature flags, to apply the changes made through other instances.
+const featureFlagsRefreshInterval = 5 * time.Second
+
+// FeatureFlag is a feature flag set for a service (or for every service if Service is "*").
+type FeatureFlag struct {
+	Flag    string `json:"flag"`
+	Service string `json:"service"`
+	Enabled bool   `json:"enabled"`
+}
+
+func featureFlagName(flag, service string) string {
+	return flag + ":" + service
+}
+
+func isKnownFeatureFlag(flag string) bool {
+	for _, known := range knownFeatureFlags {
+		if known == flag {
+			return true
+		}
+	}
+	return false
+}
+
+// featureFlags enables subsystems for some services at runtime, so that they can be rolled out one service (tenant) at a time.
+// The flags are shared by the instances using the same database.
+type featureFlags struct {
+	db     db.PushDatabase
+	logger log.Logger
+
+	mutex    sync.RWMutex
+	flags    map[string]bool
+	stopChan chan struct{}
+}
+
+func newFeatureFlags(database db.PushDatabase, logger log.Logger) *featureFlags {
+	return &featureFlags{
+		db:       database,
+		logger:   logger,
+		flags:    make(map[string]bool),
+		stopChan: make(chan struct{}),
+	}
+}
+
+// Run loads the feature flags, then reloads them every refresh interval until Stop is called.
+func (f *featureFlags) Run() {
+	f.refresh()
+	go func() {
+		ticker := time.NewTicker(featureFlagsRefreshInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-f.stopChan:
+				return
+			case <-ticker.C:
+				f.refresh()
+			}
+		}
+	}()
+}
+
+// Stop stops reloading the feature flags.
+func (f *featureFlags) Stop() {
+	if f == nil {
+		return
+	}
+	close(f.stopChan)
+}
+
+func (f *featureFlags) refresh() {
+	flags, err := f.db.GetFeatureFlags()
+	if err != nil {
+		f.logger.Errorf("Cannot load feature flags: %v", err)
+		return
+	}
+	f.mutex.Lock()
+	f.flags = flags
+	f.mutex.Unlock()
+}
+
+// Enabled returns true if flag is enabled for service: either for service itself, or for every service if it isn't set for service.
+func (f *featureFlags) Enabled(service, flag string) bool {
+	if f == nil {
+		return false
+	}
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	if enabled, ok := f.flags[featureFlagName(flag, service)]; ok {
+		return enabled
+	}
+	return f.flags[featureFlagName(flag, featureFlagAllServices)]
+}
+
+// Set enables or disables flag for service (or every service if service is "*").
+func (f *featureFlags) Set(flag, service string, enabled bool) error {
+	if err := f.db.SetFeatureFlag(featureFlagName(flag, service), enabled); err != nil {
+		return err
+	}
+	f.refresh()
+	f.logger.Infof("[FeatureFlags] Flag=%v Service=%v Enabled=%v", flag, service, enabled)
+	return nil
+}
+
+// Reset removes flag for service (or every service if service is "*"), so that the flag of every service (or the default) applies again.
+func (f *featureFlags) Reset(flag, service string) error {
+	if err := f.db.RemoveFeatureFlag(featureFlagName(flag, service)); err != nil {
+		return err
+	}
+	f.refresh()
+	f.logger.Infof("[FeatureFlags] Flag=%v Service=%v Reset", flag, service)
+	return nil
+}
+
+// List returns the feature flags which were set, for service and for every service (or for all services if service is ""), by flag then service.
+func (f *featureFlags) List(service string) []FeatureFlag {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	list := []FeatureFlag{}
+	for name, enabled := range f.flags {
+		i := strings.LastIndex(name, ":")
+		if i < 0 {
+			continue
+		}
+		flag := FeatureFlag{Flag: name[:i], Service: name[i+1:], Enabled: enabled}
+		if service != "" && flag.Service != service && flag.Service != featureFlagAllServices {
+			continue
+		}
+		list = append(list, flag)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Flag != list[j].Flag {
+			return list[i].Flag < list[j].Flag
+		}
+		return list[i].Service < list[j].Service
+	})
+	return list
+}
+
+// serveFeatureFlags handles QueryFeatureFlagsURL and SetFeatureFlagURL.
+// /featureflags takes an optional service, to also show which flags are in effect for it.
+// /setfeatureflag takes the flag, the service (every service by default), and enabled=true or false, or reset=1 to remove the flag.
+func (f *featureFlags) serveFeatureFlags(w http.ResponseWriter, r *http.Request) {
+	service := strings.TrimSpace(r.FormValue("service"))
+	if service != "" && service != featureFlagAllServices {
+		if err := validateService(service); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid service %q: %v", service, err), http.StatusBadRequest)
+			return
+		}
+	}
+	if r.URL.Path == SetFeatureFlagURL {
+		if r.Method != "POST" {
+			http.Error(w, "Feature flags must be changed with POST", http.StatusMethodNotAllowed)
+			return
+		}
+		flag := r.FormValue("flag")
+		if !isKnownFeatureFlag(flag) {
+			http.Error(w, fmt.Sprintf("Unknown feature flag %q: must be one of %s", flag, strings.Join(knownFeatureFlags, ", ")), http.StatusBadRequest)
+			return
+		}
+		if service == "" {
+			service = featureFlagAllServices
+		}
+		var err error
+		if r.FormValue("reset") == "1" {
+			err = f.Reset(flag, service)
+		} else {
+			enabled, parseErr := strconv.ParseBool(r.FormValue("enabled"))
+			if parseErr != nil {
+				http.Error(w, fmt.Sprintf("Invalid enabled %q: must be true or false", r.FormValue("enabled")), http.StatusBadRequest)
+				return
+			}
+			err = f.Set(flag, service, enabled)
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to change feature flag: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+	type responseType struct {
+		Flags []FeatureFlag `json:"flags"`
+		// Effective is whether each flag is enabled for the requested service.
+		Effective map[string]bool `json:"effective,omitempty"`
+	}
+	resp := responseType{Flags: f.List(service)}
+	if service != "" {
+		resp.Effective = make(map[string]bool, len(knownFeatureFlags))
+		for _, flag := range knownFeatureFlags {
+			resp.Effective[flag] = f.Enabled(service, flag)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
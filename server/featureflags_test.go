@@ -0,0 +1,106 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/uniqush/log"
+	"github.com/uniqush/uniqush-push/db"
+	"github.com/uniqush/uniqush-push/testutil"
+)
+
+// featureFlagsDatabase keeps the feature flags in memory.
+type featureFlagsDatabase struct {
+	db.PushDatabase
+	flags map[string]bool
+}
+
+func (d *featureFlagsDatabase) SetFeatureFlag(name string, enabled bool) error {
+	d.flags[name] = enabled
+	return nil
+}
+
+func (d *featureFlagsDatabase) GetFeatureFlags() (map[string]bool, error) {
+	flags := make(map[string]bool, len(d.flags))
+	for name, enabled := range d.flags {
+		flags[name] = enabled
+	}
+	return flags, nil
+}
+
+func (d *featureFlagsDatabase) RemoveFeatureFlag(name string) error {
+	delete(d.flags, name)
+	return nil
+}
+
+func newTestFeatureFlags() *featureFlags {
+	return newFeatureFlags(&featureFlagsDatabase{flags: make(map[string]bool)}, log.NewLogger(ioutil.Discard, "", log.LOGLEVEL_SILENT))
+}
+
+func TestFeatureFlagsEnabled(t *testing.T) {
+	f := newTestFeatureFlags()
+	testutil.ExpectEquals(t, false, f.Enabled("myservice", FeatureDedupe), "expected flags to be disabled by default")
+
+	f.Set(FeatureDedupe, "myservice", true)
+	testutil.ExpectEquals(t, true, f.Enabled("myservice", FeatureDedupe), "expected the flag to be enabled for the service")
+	testutil.ExpectEquals(t, false, f.Enabled("otherservice", FeatureDedupe), "expected the flag to stay disabled for other services")
+
+	f.Set(FeatureDedupe, featureFlagAllServices, true)
+	f.Set(FeatureDedupe, "otherservice", false)
+	testutil.ExpectEquals(t, true, f.Enabled("thirdservice", FeatureDedupe), "expected the flag of every service to apply")
+	testutil.ExpectEquals(t, false, f.Enabled("otherservice", FeatureDedupe), "expected the flag of a service to take precedence")
+
+	f.Reset(FeatureDedupe, "otherservice")
+	testutil.ExpectEquals(t, true, f.Enabled("otherservice", FeatureDedupe), "expected a reset flag to fall back to every service")
+	testutil.ExpectEquals(t, false, f.Enabled("otherservice", FeatureReceipts), "expected flags to be independent")
+
+	testutil.ExpectEquals(t, []FeatureFlag{
+		{Flag: FeatureDedupe, Service: featureFlagAllServices, Enabled: true},
+		{Flag: FeatureDedupe, Service: "myservice", Enabled: true},
+	}, f.List(""), "expected the flags to be listed by flag then service")
+	testutil.ExpectEquals(t, 1, len(f.List("otherservice")), "expected the flags of other services not to be listed")
+
+	var nilFlags *featureFlags
+	testutil.ExpectEquals(t, false, nilFlags.Enabled("myservice", FeatureDedupe), "expected nil feature flags to be disabled")
+}
+
+func serveFeatureFlagsRequest(handler http.Handler, method, target string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+func TestServeFeatureFlags(t *testing.T) {
+	f := newTestFeatureFlags()
+	handler := newAdminHandler(AdminConfig{Addr: "localhost:0", Token: "secret"}, nil, nil, nil, nil, nil, nil, nil, nil, f)
+
+	w := serveFeatureFlagsRequest(handler, "GET", SetFeatureFlagURL+"?flag=web_push&enabled=true")
+	testutil.ExpectEquals(t, http.StatusMethodNotAllowed, w.Code, "expected flags to be changed with POST")
+	w = serveFeatureFlagsRequest(handler, "POST", SetFeatureFlagURL+"?flag=unknown&enabled=true")
+	testutil.ExpectEquals(t, http.StatusBadRequest, w.Code, "expected unknown flags to be rejected")
+	w = serveFeatureFlagsRequest(handler, "POST", SetFeatureFlagURL+"?flag=web_push&enabled=maybe")
+	testutil.ExpectEquals(t, http.StatusBadRequest, w.Code, "expected enabled to be a boolean")
+
+	w = serveFeatureFlagsRequest(handler, "POST", SetFeatureFlagURL+"?flag=web_push&service=myservice&enabled=true")
+	testutil.ExpectEquals(t, http.StatusOK, w.Code, "expected the flag to be set")
+	testutil.ExpectEquals(t, true, f.Enabled("myservice", FeatureWebPush), "expected the flag to be enabled")
+
+	w = serveFeatureFlagsRequest(handler, "GET", QueryFeatureFlagsURL+"?service=myservice")
+	var resp struct {
+		Flags     []FeatureFlag   `json:"flags"`
+		Effective map[string]bool `json:"effective"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Invalid response %q: %v", w.Body.String(), err)
+	}
+	testutil.ExpectEquals(t, []FeatureFlag{{Flag: FeatureWebPush, Service: "myservice", Enabled: true}}, resp.Flags, "expected the flag to be listed")
+	testutil.ExpectEquals(t, map[string]bool{FeatureWebPush: true, FeatureReceipts: false, FeatureDedupe: false}, resp.Effective, "expected the flags in effect for the service")
+
+	serveFeatureFlagsRequest(handler, "POST", SetFeatureFlagURL+"?flag=web_push&service=myservice&reset=1")
+	testutil.ExpectEquals(t, false, f.Enabled("myservice", FeatureWebPush), "expected the flag to be reset")
+}
@@ -0,0 +1,97 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Names of the checks of /readyz.
+const (
+	readinessCheckDatabase             = "database"
+	readinessCheckPushServiceProviders = "pushServiceProviders"
+	readinessCheckQueue                = "queue"
+	readinessCheckShutdown             = "shutdown"
+)
+
+// readinessCheckOK is the result of a check which passed.
+const readinessCheckOK = "ok"
+
+// healthz responds to liveness probes. Being able to respond means the process is alive, so it always succeeds, even while stopping.
+func (api *RestAPI) healthz() []byte {
+	json, err := json.Marshal(APIResponseDetails{Code: UNIQUSH_SUCCESS})
+	if err != nil {
+		return []byte("Failed to serialize response")
+	}
+	return json
+}
+
+// readinessChecks returns the result of each check of /readyz: "ok", or why this instance can't serve pushes.
+func (api *RestAPI) readinessChecks() map[string]string {
+	checks := map[string]string{
+		readinessCheckDatabase:             readinessCheckOK,
+		readinessCheckPushServiceProviders: readinessCheckOK,
+		readinessCheckQueue:                readinessCheckOK,
+		readinessCheckShutdown:             readinessCheckOK,
+	}
+	if err := api.backend.db.Ping(); err != nil {
+		checks[readinessCheckDatabase] = fmt.Sprintf("unreachable: %v", err)
+	}
+	if open := api.backend.breaker.OpenCircuits(); len(open) > 0 {
+		checks[readinessCheckPushServiceProviders] = "circuit open: " + strings.Join(open, ",")
+	}
+	if _, overloaded := api.backend.Overloaded(); overloaded {
+		checks[readinessCheckQueue] = "overloaded"
+	}
+	api.stopMutex.Lock()
+	if api.stopping {
+		checks[readinessCheckShutdown] = "stopping"
+	}
+	api.stopMutex.Unlock()
+	return checks
+}
+
+// readyz responds to readiness probes, with HTTP 503 if any check fails, so that load balancers stop sending requests to this instance until it recovers.
+func (api *RestAPI) readyz(w http.ResponseWriter) {
+	type responseType struct {
+		Ready  bool              `json:"ready"`
+		Checks map[string]string `json:"checks"`
+		// Maintenance is set while pushes are held in maintenance mode. This instance is still ready, since it keeps accepting pushes.
+		Maintenance *MaintenanceState `json:"maintenance,omitempty"`
+		Code        string            `json:"code"`
+	}
+	r := responseType{Ready: true, Checks: api.readinessChecks(), Maintenance: api.backend.maintenance.State(), Code: UNIQUSH_SUCCESS}
+	for name, result := range r.Checks {
+		if result != readinessCheckOK {
+			r.Ready = false
+			r.Code = UNIQUSH_ERROR_NOT_READY
+			api.loggers[LoggerWeb].Warnf("Check=%v Not ready: %v", name, result)
+		}
+	}
+	json, err := json.Marshal(r)
+	if err != nil {
+		json = []byte("Failed to serialize response")
+	}
+	if !r.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	fmt.Fprintf(w, "%s\r\n", json)
+}
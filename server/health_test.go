@@ -0,0 +1,70 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/uniqush/log"
+	"github.com/uniqush/uniqush-push/db"
+	"github.com/uniqush/uniqush-push/testutil"
+)
+
+// pingDatabase is a database whose Ping returns err. Other methods aren't implemented.
+type pingDatabase struct {
+	db.PushDatabase
+	err error
+}
+
+func (d *pingDatabase) Ping() error {
+	return d.err
+}
+
+func newHealthTestAPI(database db.PushDatabase) *RestAPI {
+	loggers := make([]log.Logger, NumberOfLoggers)
+	for i := range loggers {
+		loggers[i] = log.NewLogger(ioutil.Discard, "", log.LOGLEVEL_SILENT)
+	}
+	return &RestAPI{loggers: loggers, backend: &PushBackEnd{db: database}}
+}
+
+func serveHealth(api *RestAPI, path string) (int, map[string]interface{}) {
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+	var body map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &body)
+	return w.Code, body
+}
+
+func TestReadyz(t *testing.T) {
+	database := &pingDatabase{}
+	api := newHealthTestAPI(database)
+
+	status, body := serveHealth(api, ReadyzURL)
+	testutil.ExpectEquals(t, http.StatusOK, status, "expected a reachable database to be ready")
+	testutil.ExpectEquals(t, true, body["ready"], "expected ready to be true")
+	testutil.ExpectStringEquals(t, UNIQUSH_SUCCESS, body["code"].(string), "unexpected code")
+
+	database.err = errors.New("connection refused")
+	status, body = serveHealth(api, ReadyzURL)
+	testutil.ExpectEquals(t, http.StatusServiceUnavailable, status, "expected an unreachable database not to be ready")
+	testutil.ExpectStringEquals(t, UNIQUSH_ERROR_NOT_READY, body["code"].(string), "unexpected code")
+	checks := body["checks"].(map[string]interface{})
+	testutil.ExpectStringEquals(t, "unreachable: connection refused", checks[readinessCheckDatabase].(string), "expected the database check to fail")
+	testutil.ExpectStringEquals(t, readinessCheckOK, checks[readinessCheckQueue].(string), "expected the queue check to pass")
+
+	status, body = serveHealth(api, HealthzURL)
+	testutil.ExpectEquals(t, http.StatusOK, status, "expected the process to be alive while not ready")
+	testutil.ExpectStringEquals(t, UNIQUSH_SUCCESS, body["code"].(string), "unexpected code")
+}
+
+func TestReadyzWhileStopping(t *testing.T) {
+	api := newHealthTestAPI(&pingDatabase{})
+	api.stopping = true
+	status, body := serveHealth(api, ReadyzURL)
+	testutil.ExpectEquals(t, http.StatusServiceUnavailable, status, "expected a stopping instance not to be ready")
+	testutil.ExpectStringEquals(t, "stopping", body["checks"].(map[string]interface{})[readinessCheckShutdown].(string), "expected the shutdown check to fail")
+}
@@ -0,0 +1,210 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/uniqush/uniqush-push/db"
+	"github.com/uniqush/uniqush-push/push"
+)
+
+// inboxPushServiceName is the push service type of the inboxes which uniqush-push keeps for subscribers in its database.
+const inboxPushServiceName = "inbox"
+
+const (
+	defaultInboxMaxMessages = 100
+	defaultInboxRetention   = 30 * 24 * time.Hour
+)
+
+// InboxConfig is a representation of the settings in the [Inbox] section of uniqush.conf.
+type InboxConfig struct {
+	// MaxMessages is the number of messages kept in the inbox of each service+subscriber. 0 disables the inbox push service type.
+	MaxMessages int
+	// Retention is how long the inbox of a service+subscriber is kept after the last message. Older messages of an inbox aren't returned.
+	Retention time.Duration
+}
+
+// InboxMessage is a notification pushed to the inbox of a subscriber, which the app can fetch with /inbox when it's opened.
+type InboxMessage struct {
+	ID   string            `json:"id"`
+	Data map[string]string `json:"data"`
+	// Date is the unix timestamp when the message was pushed.
+	Date int64 `json:"date"`
+}
+
+// inbox is a push service type which saves notifications in the database instead of sending them to an external push service,
+// so that apps can show a message center, and get pushes which the other delivery points of a subscriber didn't.
+// A service uses it with /addpsp?pushservicetype=inbox, and subscribers with /subscribe?pushservicetype=inbox (without a token).
+type inbox struct {
+	db   db.PushDatabase
+	conf InboxConfig
+	now  func() time.Time
+}
+
+var _ push.PushServiceType = &inbox{}
+
+func newInbox(database db.PushDatabase, conf InboxConfig) *inbox {
+	if conf.MaxMessages <= 0 {
+		return nil
+	}
+	return &inbox{db: database, conf: conf, now: time.Now}
+}
+
+func (ib *inbox) Name() string {
+	return inboxPushServiceName
+}
+
+func (ib *inbox) BuildPushServiceProviderFromMap(kv map[string]string, psp *push.PushServiceProvider) error {
+	if service, ok := kv["service"]; ok && len(service) > 0 {
+		psp.FixedData["service"] = service
+	} else {
+		return errors.New("NoService")
+	}
+	return nil
+}
+
+// BuildDeliveryPointFromMap builds the inbox of a subscriber, which is named after the service and subscriber.
+func (ib *inbox) BuildDeliveryPointFromMap(kv map[string]string, dp *push.DeliveryPoint) error {
+	return dp.AddCommonData(kv)
+}
+
+// Push saves the notification to the inbox of every delivery point.
+func (ib *inbox) Push(psp *push.PushServiceProvider, dpQueue <-chan *push.DeliveryPoint, resQueue chan<- *push.Result, notif *push.Notification) {
+	data, err := inboxMessageData(notif)
+	for dp := range dpQueue {
+		res := push.NewResult()
+		res.Provider = psp
+		res.Destination = dp
+		res.Content = notif
+		if err != nil {
+			res.Err = err
+		} else {
+			res.MsgID, res.Err = ib.add(dp, data)
+		}
+		resQueue <- res
+	}
+	close(resQueue)
+}
+
+// add saves a message to the inbox of dp, returning its id.
+func (ib *inbox) add(dp *push.DeliveryPoint, data map[string]string) (string, push.Error) {
+	message := InboxMessage{ID: randomUniqID(), Data: data, Date: ib.now().Unix()}
+	b, err := json.Marshal(message)
+	if err != nil {
+		return "", push.NewErrorf("Failed to encode the message: %v", err)
+	}
+	if err := ib.db.AddInboxMessage(dp.FixedData["service"], dp.FixedData["subscriber"], b, int64(ib.conf.MaxMessages), ib.conf.Retention); err != nil {
+		return "", push.NewErrorf("Failed to save the message: %v", err)
+	}
+	return message.ID, nil
+}
+
+// inboxMessageData returns the data of the message saved for a notification: the JSON object in uniqush.payload.inbox,
+// or the data of the notification except the keys reserved by uniqush.
+func inboxMessageData(notif *push.Notification) (map[string]string, push.Error) {
+	data := make(map[string]string, len(notif.Data))
+	if rawPayload, ok := notif.Data["uniqush.payload.inbox"]; ok {
+		if err := json.Unmarshal([]byte(rawPayload), &data); err != nil {
+			return nil, push.NewBadNotificationWithDetails("invalid uniqush.payload.inbox: " + err.Error())
+		}
+	} else {
+		for k, v := range notif.Data {
+			if strings.HasPrefix(k, "uniqush.") { // keys beginning with "uniqush." are reserved by Uniqush.
+				continue
+			}
+			data[k] = v
+		}
+	}
+	if len(data) == 0 {
+		return nil, push.NewBadNotificationWithDetails("empty notification")
+	}
+	return data, nil
+}
+
+func (ib *inbox) Preview(notif *push.Notification) ([]byte, push.Error) {
+	data, err := inboxMessageData(notif)
+	if err != nil {
+		return nil, err
+	}
+	b, jsonErr := json.Marshal(InboxMessage{ID: "placeholder", Data: data, Date: ib.now().Unix()})
+	if jsonErr != nil {
+		return nil, push.NewErrorf("Failed to encode the message: %v", jsonErr)
+	}
+	return b, nil
+}
+
+func (ib *inbox) SetErrorReportChan(errChan chan<- push.Error) {}
+
+func (ib *inbox) SetPushServiceConfig(c *push.PushServiceConfig) {}
+
+func (ib *inbox) Finalize() {}
+
+// Messages returns the messages in the inbox of a service+subscriber, newest first, up to Retention ago.
+func (ib *inbox) Messages(service, subscriber string) ([]InboxMessage, error) {
+	messages := []InboxMessage{}
+	if ib == nil {
+		return messages, nil
+	}
+	data, err := ib.db.GetInboxMessages(service, subscriber)
+	if err != nil {
+		return nil, err
+	}
+	since := ib.now().Add(-ib.conf.Retention).Unix()
+	for _, b := range data {
+		var message InboxMessage
+		if err := json.Unmarshal(b, &message); err != nil {
+			continue
+		}
+		if message.Date < since {
+			// Inboxes only expire after Retention without messages, so messages of active subscribers may be older than it.
+			break
+		}
+		messages = append(messages, message)
+	}
+	return messages, nil
+}
+
+// Remove removes the messages with the given ids from the inbox of a service+subscriber (e.g. once they were read), returning how many were found.
+func (ib *inbox) Remove(service, subscriber string, ids []string) (int, error) {
+	if ib == nil {
+		return 0, nil
+	}
+	data, err := ib.db.GetInboxMessages(service, subscriber)
+	if err != nil {
+		return 0, err
+	}
+	remove := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		remove[id] = true
+	}
+	removed := 0
+	for _, b := range data {
+		var message InboxMessage
+		if err := json.Unmarshal(b, &message); err != nil || !remove[message.ID] {
+			continue
+		}
+		if err := ib.db.RemoveInboxMessage(service, subscriber, b); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
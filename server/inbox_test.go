@@ -0,0 +1,183 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/uniqush/goconf/conf"
+	"github.com/uniqush/uniqush-push/db"
+	"github.com/uniqush/uniqush-push/push"
+	"github.com/uniqush/uniqush-push/testutil"
+)
+
+// inboxDatabase keeps inboxes in memory. Other methods aren't implemented.
+type inboxDatabase struct {
+	db.PushDatabase
+	inboxes map[string][][]byte
+}
+
+func (d *inboxDatabase) AddInboxMessage(service, subscriber string, message []byte, maxMessages int64, retention time.Duration) error {
+	key := service + ":" + subscriber
+	messages := append([][]byte{message}, d.inboxes[key]...)
+	if int64(len(messages)) > maxMessages {
+		messages = messages[:maxMessages]
+	}
+	d.inboxes[key] = messages
+	return nil
+}
+
+func (d *inboxDatabase) GetInboxMessages(service, subscriber string) ([][]byte, error) {
+	return d.inboxes[service+":"+subscriber], nil
+}
+
+func (d *inboxDatabase) RemoveInboxMessage(service, subscriber string, message []byte) error {
+	key := service + ":" + subscriber
+	var messages [][]byte
+	for _, m := range d.inboxes[key] {
+		if string(m) != string(message) {
+			messages = append(messages, m)
+		}
+	}
+	d.inboxes[key] = messages
+	return nil
+}
+
+func pushToInbox(ib *inbox, notif *push.Notification, subscribers ...string) []*push.Result {
+	dpQueue := make(chan *push.DeliveryPoint, len(subscribers))
+	resQueue := make(chan *push.Result, len(subscribers))
+	for _, sub := range subscribers {
+		dp := push.NewEmptyDeliveryPoint()
+		dp.AddCommonData(map[string]string{"service": "myservice", "subscriber": sub})
+		dpQueue <- dp
+	}
+	close(dpQueue)
+	ib.Push(push.NewEmptyPushServiceProvider(), dpQueue, resQueue, notif)
+	var results []*push.Result
+	for res := range resQueue {
+		results = append(results, res)
+	}
+	return results
+}
+
+func TestInboxPush(t *testing.T) {
+	database := &inboxDatabase{inboxes: make(map[string][][]byte)}
+	ib := newInbox(database, InboxConfig{MaxMessages: 2, Retention: time.Hour})
+	for _, msg := range []string{"first", "second", "third"} {
+		notif := push.NewEmptyNotification()
+		notif.Data["msg"] = msg
+		notif.Data["uniqush.notification.id"] = "id1"
+		for _, res := range pushToInbox(ib, notif, "user1", "user2") {
+			testutil.ExpectEquals(t, nil, res.Err, "unexpected error")
+			if res.MsgID == "" {
+				t.Error("expected the id of the message")
+			}
+		}
+	}
+
+	messages, err := ib.Messages("myservice", "user1")
+	testutil.ExpectEquals(t, nil, err, "unexpected error")
+	testutil.ExpectEquals(t, 2, len(messages), "expected only max_messages to be kept")
+	testutil.ExpectEquals(t, map[string]string{"msg": "third"}, messages[0].Data, "expected the newest message first, without the keys reserved by uniqush")
+
+	notif := push.NewEmptyNotification()
+	notif.Data["msg"] = "ignored"
+	notif.Data["uniqush.payload.inbox"] = `{"title":"Sale","body":"50% off"}`
+	pushToInbox(ib, notif, "user1")
+	messages, _ = ib.Messages("myservice", "user1")
+	testutil.ExpectEquals(t, map[string]string{"title": "Sale", "body": "50% off"}, messages[0].Data, "expected uniqush.payload.inbox to be the message")
+
+	notif.Data["uniqush.payload.inbox"] = `[]`
+	results := pushToInbox(ib, notif, "user1")
+	if _, ok := results[0].Err.(*push.BadNotification); !ok {
+		t.Errorf("expected an invalid uniqush.payload.inbox to be rejected, got %v", results[0].Err)
+	}
+
+	removed, err := ib.Remove("myservice", "user1", []string{messages[0].ID, "unknown"})
+	testutil.ExpectEquals(t, nil, err, "unexpected error")
+	testutil.ExpectEquals(t, 1, removed, "expected one message to be removed")
+	messages, _ = ib.Messages("myservice", "user1")
+	testutil.ExpectEquals(t, 1, len(messages), "expected one message to be left")
+	testutil.ExpectEquals(t, map[string]string{"msg": "third"}, messages[0].Data, "expected the other message to be left")
+}
+
+func TestInboxRetention(t *testing.T) {
+	database := &inboxDatabase{inboxes: make(map[string][][]byte)}
+	ib := newInbox(database, InboxConfig{MaxMessages: 10, Retention: time.Hour})
+	now := time.Unix(1500000000, 0)
+	ib.now = func() time.Time { return now }
+	for _, date := range []int64{1500000000, 1499999000, 1499990000} {
+		b, _ := json.Marshal(InboxMessage{ID: "id", Data: map[string]string{"msg": "hello"}, Date: date})
+		database.inboxes["myservice:user1"] = append(database.inboxes["myservice:user1"], b)
+	}
+	messages, err := ib.Messages("myservice", "user1")
+	testutil.ExpectEquals(t, nil, err, "unexpected error")
+	testutil.ExpectEquals(t, 2, len(messages), "expected messages older than the retention to be hidden")
+
+	var disabled *inbox
+	messages, err = disabled.Messages("myservice", "user1")
+	testutil.ExpectEquals(t, nil, err, "unexpected error")
+	testutil.ExpectEquals(t, 0, len(messages), "expected no messages without an inbox")
+}
+
+func TestInboxAPI(t *testing.T) {
+	database := &inboxDatabase{inboxes: make(map[string][][]byte)}
+	api := newHealthTestAPI(database)
+	api.waitGroup = new(sync.WaitGroup)
+	api.backend.inbox = newInbox(database, InboxConfig{MaxMessages: 10, Retention: time.Hour})
+	notif := push.NewEmptyNotification()
+	notif.Data["msg"] = "hello"
+	id := pushToInbox(api.backend.inbox, notif, "user1")[0].MsgID
+
+	type responseType struct {
+		Messages []InboxMessage `json:"messages"`
+		Code     string         `json:"code"`
+	}
+	query := func(params url.Values) responseType {
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest("GET", QueryInboxURL+"?"+params.Encode(), nil))
+		var response responseType
+		json.Unmarshal(w.Body.Bytes(), &response)
+		return response
+	}
+	remove := func(params url.Values) APIResponseDetails {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", RemoveInboxMessagesURL, strings.NewReader(params.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		api.ServeHTTP(w, req)
+		var response APISimpleResponse
+		json.Unmarshal(w.Body.Bytes(), &response)
+		return response.Details
+	}
+
+	testutil.ExpectStringEquals(t, UNIQUSH_ERROR_NO_SUBSCRIBER, query(url.Values{"service": {"myservice"}}).Code, "expected the subscriber to be required")
+	response := query(url.Values{"service": {"myservice"}, "subscriber": {"user1"}})
+	testutil.ExpectStringEquals(t, UNIQUSH_SUCCESS, response.Code, "unexpected code")
+	testutil.ExpectEquals(t, 1, len(response.Messages), "expected the pushed message")
+	testutil.ExpectStringEquals(t, id, response.Messages[0].ID, "unexpected id")
+
+	testutil.ExpectStringEquals(t, UNIQUSH_ERROR_GENERIC, remove(url.Values{"service": {"myservice"}, "subscriber": {"user1"}}).Code, "expected the ids to be required")
+	testutil.ExpectStringEquals(t, UNIQUSH_SUCCESS, remove(url.Values{"service": {"myservice"}, "subscriber": {"user1"}, "id": {id}}).Code, "unexpected code")
+	testutil.ExpectEquals(t, 0, len(query(url.Values{"service": {"myservice"}, "subscriber": {"user1"}}).Messages), "expected the message to be removed")
+}
+
+func TestLoadInboxConfig(t *testing.T) {
+	c := conf.NewConfigFile()
+	inboxConf, err := LoadInboxConfig(c)
+	testutil.ExpectEquals(t, nil, err, "unexpected error")
+	testutil.ExpectEquals(t, InboxConfig{MaxMessages: defaultInboxMaxMessages, Retention: defaultInboxRetention}, inboxConf, "unexpected defaults")
+	c.AddOption("Inbox", "max_messages", "0")
+	inboxConf, err = LoadInboxConfig(c)
+	testutil.ExpectEquals(t, nil, err, "unexpected error")
+	if newInbox(nil, inboxConf) != nil {
+		t.Error("expected max_messages=0 to disable the inbox")
+	}
+	c.AddOption("Inbox", "retention", "0")
+	if _, err = LoadInboxConfig(c); err == nil {
+		t.Error("expected retention=0 to be rejected")
+	}
+}
@@ -0,0 +1,143 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/uniqush/goconf/conf"
+	"github.com/uniqush/log"
+	"github.com/uniqush/uniqush-push/ingest"
+	"github.com/uniqush/uniqush-push/tracing"
+)
+
+// ingestSectionPrefix is the prefix of config sections with the settings of an ingestion adapter.
+const ingestSectionPrefix = "Ingest."
+
+// IngestConfig is a representation of an [Ingest.<name>] section of uniqush.conf.
+type IngestConfig struct {
+	Name string
+	// Type is the type of the ingestion adapter (e.g. redis_stream).
+	Type     string
+	Settings ingest.Settings
+}
+
+// LoadIngestConfigs returns a representation of the [Ingest.<name>] sections of uniqush.conf.
+func LoadIngestConfigs(c *conf.ConfigFile) ([]IngestConfig, error) {
+	var configs []IngestConfig
+	for _, section := range c.GetSections() {
+		// goconf lowercases section names, so match the prefix case insensitively. The name of the adapter is the lowercase rest of the section name.
+		if !strings.HasPrefix(strings.ToLower(section), strings.ToLower(ingestSectionPrefix)) {
+			continue
+		}
+		options, err := c.GetOptions(section)
+		if err != nil {
+			return nil, fmt.Errorf("[%s]: %v", section, err)
+		}
+		settings := make(ingest.Settings, len(options))
+		for _, option := range options {
+			if value, err := c.GetString(section, option); err == nil {
+				settings[option] = value
+			}
+		}
+		config := IngestConfig{Name: section[len(ingestSectionPrefix):], Type: settings["type"], Settings: settings}
+		if config.Type == "" {
+			return nil, fmt.Errorf("[%s]: type must be set", section)
+		}
+		configs = append(configs, config)
+	}
+	return configs, nil
+}
+
+// ingester runs the configured ingestion adapters. Their push requests go through the same validation and routing as /push.
+type ingester struct {
+	api      *RestAPI
+	adapters map[string]ingest.Adapter
+	logger   log.Logger
+	stopChan chan struct{}
+	stopOnce sync.Once
+}
+
+func newIngester(api *RestAPI, configs []IngestConfig, logger log.Logger) (*ingester, error) {
+	if len(configs) == 0 {
+		return nil, nil
+	}
+	in := &ingester{
+		api:      api,
+		adapters: make(map[string]ingest.Adapter, len(configs)),
+		logger:   logger,
+		stopChan: make(chan struct{}),
+	}
+	for _, config := range configs {
+		adapter, err := ingest.New(config.Type, config.Name, config.Settings, logger)
+		if err != nil {
+			return nil, fmt.Errorf("[%s%s]: %v", ingestSectionPrefix, config.Name, err)
+		}
+		in.adapters[config.Name] = adapter
+	}
+	return in, nil
+}
+
+// Run starts receiving push requests from every adapter.
+func (in *ingester) Run() {
+	if in == nil {
+		return
+	}
+	for name, adapter := range in.adapters {
+		go func(name string, adapter ingest.Adapter) {
+			in.logger.Infof("Adapter=%v Start", name)
+			if err := adapter.Run(func(msg *ingest.Message) error { return in.handle(name, msg) }, in.stopChan); err != nil {
+				in.logger.Errorf("Adapter=%v Stopped: %v", name, err)
+			}
+		}(name, adapter)
+	}
+}
+
+// Stop stops receiving push requests. Requests being processed are tracked by the RestAPI, which waits for them when stopping.
+func (in *ingester) Stop() {
+	if in == nil {
+		return
+	}
+	in.stopOnce.Do(func() { close(in.stopChan) })
+}
+
+// handle sends the push request in msg, as if it was sent to /push.
+// Unless the request has a uniqush.job_id, the id of the message (if any) is used as the job id, so that redelivered messages aren't pushed again.
+func (in *ingester) handle(name string, msg *ingest.Message) error {
+	if retryAfter, overloaded := in.api.backend.Overloaded(); overloaded {
+		return &ingest.RetryLaterError{After: retryAfter, Reason: "overloaded"}
+	}
+	if !in.api.beginRequest() {
+		return &ingest.RetryLaterError{After: in.api.shutdownTimeout, Reason: "shutting down"}
+	}
+	defer in.api.endRequest()
+
+	kv, perdp := parseKV(msg.Params)
+	if kv["uniqush.job_id"] == "" && msg.ID != "" {
+		kv["uniqush.job_id"] = fmt.Sprintf("ingest:%s:%s", name, msg.ID)
+	}
+	logger := in.api.loggers[LoggerPush]
+	handler := in.api.backend.history.Wrap(newPushResponseHandler(logger))
+	ctx, span := tracing.Start(context.Background(), "ingest:"+name, tracing.KindServer)
+	defer span.Finish()
+	in.api.pushNotification(ctx, randomUniqID(), kv, perdp, logger, "ingest:"+name, handler)
+	return nil
+}
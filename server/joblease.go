@@ -0,0 +1,136 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/uniqush/log"
+	"github.com/uniqush/uniqush-push/db"
+)
+
+const (
+	jobLeasePrefix = "job:"
+
+	defaultJobLeaseTTL   = 30 * time.Second
+	defaultJobRetention  = 24 * time.Hour
+	minJobLeaseTTL       = 3 * time.Second
+	jobLeaseRenewDivisor = 3
+)
+
+// JobConfig is a representation of the [Jobs] section of uniqush.conf.
+type JobConfig struct {
+	// LeaseTTL is how long a job's lease lasts without being renewed. If an instance crashes while running a job, other instances may claim it after this long.
+	LeaseTTL time.Duration
+	// Retention is how long a job id is remembered after the job finishes, so that a duplicate request for the same job is ignored.
+	Retention time.Duration
+}
+
+// jobRunner ensures that a job with a given id runs at most once, even if several uniqush-push instances sharing the same database receive it.
+//
+// The lease is claimed before the job runs, renewed while it runs and only given up (or, for RunOnce, kept for the retention period) after the job returns.
+// A job that was claimed is not run again if it fails: delivery is at most once per retention period, and the caller is responsible for reporting failures.
+// The one exception is an instance that stops renewing the lease while the job is still running (it crashed or lost redis for longer than the lease ttl):
+// once the lease expires, another instance may claim and run the same job. The job is told that its lease was lost and should stop,
+// but requests which were already in flight may still be sent twice.
+type jobRunner struct {
+	db     db.PushDatabase
+	owner  string
+	conf   JobConfig
+	logger log.Logger
+}
+
+func newJobRunner(database db.PushDatabase, conf JobConfig, logger log.Logger) *jobRunner {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return &jobRunner{
+		db:     database,
+		owner:  fmt.Sprintf("%s:%d:%s", hostname, os.Getpid(), randomUniqID()),
+		conf:   conf,
+		logger: logger,
+	}
+}
+
+// RunOnce calls fn if no instance has claimed jobID of service within the retention period. Job ids of different services don't conflict.
+// While fn runs, the lease is periodically renewed. If the lease is lost anyway, lost is closed and fn should stop.
+// Once fn returns, the lease is kept for the retention period.
+// Returns false (and does not call fn) if the job was already claimed.
+func (r *jobRunner) RunOnce(service, jobID string, fn func(lost <-chan struct{})) (bool, error) {
+	name := jobLeasePrefix + service + ":" + jobID
+	acquired, err := r.db.AcquireLease(name, r.owner, r.conf.LeaseTTL)
+	if err != nil || !acquired {
+		return false, err
+	}
+
+	done := make(chan struct{})
+	lost := make(chan struct{})
+	go r.renew(name, done, lost)
+	fn(lost)
+	close(done)
+
+	if _, err := r.db.RenewLease(name, r.owner, r.conf.Retention); err != nil {
+		r.logger.Errorf("JobID=%v Failed to retain lease of finished job: %v", jobID, err)
+	}
+	return true, nil
+}
+
+// RunExclusive calls fn if no other instance is currently holding the lease with the given name, and releases the lease when fn returns.
+// While fn runs, the lease is periodically renewed. If the lease is lost anyway (e.g. redis was unreachable for longer than the lease ttl), lost is closed and fn should stop.
+// Returns false (and does not call fn) if another instance holds the lease.
+func (r *jobRunner) RunExclusive(name string, fn func(lost <-chan struct{})) (bool, error) {
+	acquired, err := r.db.AcquireLease(name, r.owner, r.conf.LeaseTTL)
+	if err != nil || !acquired {
+		return false, err
+	}
+
+	done := make(chan struct{})
+	lost := make(chan struct{})
+	go r.renew(name, done, lost)
+	fn(lost)
+	close(done)
+
+	if err := r.db.ReleaseLease(name, r.owner); err != nil {
+		r.logger.Errorf("Lease=%v Failed to release lease: %v", name, err)
+	}
+	return true, nil
+}
+
+// renew renews the lease until done is closed. lost is closed if the lease is taken by another owner.
+func (r *jobRunner) renew(name string, done <-chan struct{}, lost chan<- struct{}) {
+	ticker := time.NewTicker(r.conf.LeaseTTL / jobLeaseRenewDivisor)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			renewed, err := r.db.RenewLease(name, r.owner, r.conf.LeaseTTL)
+			if err != nil {
+				r.logger.Errorf("Lease=%v Failed to renew lease: %v", name, err)
+			} else if !renewed {
+				r.logger.Warnf("Lease=%v LostLease", name)
+				close(lost)
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/uniqush/log"
+	"github.com/uniqush/uniqush-push/db"
+	"github.com/uniqush/uniqush-push/testutil"
+)
+
+// lostLeaseDatabase grants every lease, but fails to renew any of them, as if another instance had claimed them after they expired.
+type lostLeaseDatabase struct {
+	db.PushDatabase
+	acquired []string
+}
+
+func (d *lostLeaseDatabase) AcquireLease(name, owner string, ttl time.Duration) (bool, error) {
+	d.acquired = append(d.acquired, name)
+	return true, nil
+}
+
+func (d *lostLeaseDatabase) RenewLease(name, owner string, ttl time.Duration) (bool, error) {
+	return false, nil
+}
+
+func TestJobRunnerNamespacesJobsByService(t *testing.T) {
+	database := newClusterDatabase()
+	a := newJobRunner(database, JobConfig{LeaseTTL: time.Hour, Retention: time.Hour}, log.NewLogger(ioutil.Discard, "", log.LOGLEVEL_SILENT))
+	b := newJobRunner(database, JobConfig{LeaseTTL: time.Hour, Retention: time.Hour}, log.NewLogger(ioutil.Discard, "", log.LOGLEVEL_SILENT))
+
+	runs := 0
+	run := func(lost <-chan struct{}) { runs++ }
+	ran, err := a.RunOnce("service1", "job", run)
+	testutil.ExpectEquals(t, true, ran && err == nil, "expected the first claim of a job to run it")
+	ran, err = b.RunOnce("service1", "job", run)
+	testutil.ExpectEquals(t, false, ran || err != nil, "expected a job of the same service not to run twice")
+	ran, err = b.RunOnce("service2", "job", run)
+	testutil.ExpectEquals(t, true, ran && err == nil, "expected a job of a different service with the same id to run")
+	testutil.ExpectEquals(t, 2, runs, "unexpected number of runs")
+}
+
+func TestJobRunnerStopsJobOnLostLease(t *testing.T) {
+	database := &lostLeaseDatabase{}
+	r := newJobRunner(database, JobConfig{LeaseTTL: 30 * time.Millisecond, Retention: time.Hour}, log.NewLogger(ioutil.Discard, "", log.LOGLEVEL_SILENT))
+
+	stopped := false
+	ran, err := r.RunOnce("service", "job", func(lost <-chan struct{}) {
+		select {
+		case <-lost:
+			stopped = true
+		case <-time.After(5 * time.Second):
+		}
+	})
+	testutil.ExpectEquals(t, true, ran && err == nil, "expected the job to run")
+	testutil.ExpectEquals(t, true, stopped, "expected the job to be told that its lease was lost")
+	testutil.ExpectEquals(t, []string{"job:service:job"}, database.acquired, "expected the lease name to include the service")
+}
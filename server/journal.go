@@ -0,0 +1,317 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/uniqush/goconf/conf"
+	"github.com/uniqush/uniqush-push/db"
+	"github.com/uniqush/uniqush-push/push"
+)
+
+// Operations of journal entries, besides ReplicationSubscribe and ReplicationUnsubscribe.
+const (
+	JournalModify = "modify"
+)
+
+// maxJournalEntrySize is the size of the largest journal entry which can be replayed.
+const maxJournalEntrySize = 1024 * 1024
+
+// JournalConfig is a representation of the [Journal] section of uniqush.conf.
+type JournalConfig struct {
+	// File is the path of the journal. If it is empty, changes to subscriptions aren't journaled.
+	File string
+	// Sync makes every entry be flushed to disk before the change is saved in the database.
+	Sync bool
+}
+
+// LoadJournalConfig returns a representation of the [Journal] section.
+func LoadJournalConfig(c *conf.ConfigFile) (*JournalConfig, error) {
+	config := &JournalConfig{}
+	if file, err := c.GetString("Journal", "file"); err == nil {
+		config.File = strings.TrimSpace(file)
+	}
+	if sync, err := c.GetBool("Journal", "sync"); err == nil {
+		config.Sync = sync
+	}
+	return config, nil
+}
+
+// JournalEntry is a change to the subscriptions, as written to the journal (one JSON object per line).
+type JournalEntry struct {
+	// Time is the unix timestamp of the change, in nanoseconds.
+	Time       int64  `json:"time"`
+	Op         string `json:"op"`
+	Service    string `json:"service,omitempty"`
+	Subscriber string `json:"subscriber,omitempty"`
+	// DeliveryPoint is the serialized delivery point, as saved in the database.
+	DeliveryPoint string `json:"deliveryPoint,omitempty"`
+	// EncryptedDeliveryPoint replaces DeliveryPoint if the delivery points of the service are encrypted with the data key of its tenant (see tenant_encryption).
+	// It is encrypted with the same key, so that it can't be replayed once the data key is shredded.
+	EncryptedDeliveryPoint []byte `json:"encryptedDeliveryPoint,omitempty"`
+}
+
+// errJournalDataKeyShredded is returned when replaying a journal entry encrypted with the data key of a tenant which was shredded.
+var errJournalDataKeyShredded = errors.New("the data key of the tenant of the service was shredded")
+
+// operationJournal appends every change to the subscriptions to a file before saving it in the database (a write-ahead log),
+// so that the subscriptions can be rebuilt with the replay command after the database is flushed or corrupted.
+// Changes which then fail to be saved are journaled too: replaying them fails again, or doesn't change anything.
+// Push service providers aren't journaled, so that their credentials aren't written to disk, and must be added back before replaying.
+// The delivery points of the services of tenants are encrypted with the data key of the tenant, like in the database.
+type operationJournal struct {
+	db    db.PushDatabase
+	mutex sync.Mutex
+	file  *os.File
+	sync  bool
+	now   func() time.Time
+}
+
+func newOperationJournal(conf *JournalConfig, database db.PushDatabase) (*operationJournal, error) {
+	if conf.File == "" {
+		return nil, nil
+	}
+	file, err := os.OpenFile(conf.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot open the journal: %v", err)
+	}
+	return &operationJournal{db: database, file: file, sync: conf.Sync, now: time.Now}, nil
+}
+
+// Record appends a change to a delivery point of sub to the journal. The change must not be saved if it can't be journaled.
+func (j *operationJournal) Record(op, service, sub string, dp *push.DeliveryPoint) error {
+	if j == nil {
+		return nil
+	}
+	entry := JournalEntry{Op: op, Service: service, Subscriber: sub}
+	data := dp.Marshal()
+	encrypted, err := j.db.EncryptDeliveryPointOfService(service, data)
+	if err != nil {
+		return fmt.Errorf("Cannot encrypt the delivery point for the journal: %v", err)
+	}
+	if encrypted != nil {
+		entry.EncryptedDeliveryPoint = encrypted
+	} else {
+		entry.DeliveryPoint = string(data)
+	}
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	// The time is taken while holding the lock, so that entries are in the order of their times.
+	entry.Time = j.now().UnixNano()
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if _, err := j.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("Cannot write to the journal: %v", err)
+	}
+	if j.sync {
+		if err := j.file.Sync(); err != nil {
+			return fmt.Errorf("Cannot flush the journal: %v", err)
+		}
+	}
+	return nil
+}
+
+// Close closes the journal file.
+func (j *operationJournal) Close() error {
+	if j == nil {
+		return nil
+	}
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	return j.file.Close()
+}
+
+// replayOptions are the flags of the replay command.
+type replayOptions struct {
+	journal string
+	until   time.Time
+	dryRun  bool
+}
+
+// parseJournalTime parses a time of the replay command, either as RFC 3339 or as a unix timestamp in seconds.
+func parseJournalTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	seconds, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q: must be RFC 3339 (e.g. 2018-07-21T15:04:05Z) or a unix timestamp", s)
+	}
+	return time.Unix(seconds, 0), nil
+}
+
+func parseReplayOptions(args []string, journalConf *JournalConfig) (replayOptions, error) {
+	opts := replayOptions{until: time.Now()}
+	var until string
+	flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+	flags.StringVar(&opts.journal, "journal", journalConf.File, "Journal to replay (the file of [Journal] by default)")
+	flags.StringVar(&until, "until", "", "Only replay the changes made up to this time, as RFC 3339 or a unix timestamp (now by default)")
+	flags.BoolVar(&opts.dryRun, "dry-run", false, "Count the changes which would be replayed without saving them")
+	if err := flags.Parse(args); err != nil {
+		return opts, err
+	}
+	if opts.journal == "" {
+		return opts, errors.New("-journal must be set when [Journal] file isn't")
+	}
+	if until != "" {
+		t, err := parseJournalTime(until)
+		if err != nil {
+			return opts, err
+		}
+		opts.until = t
+	}
+	return opts, nil
+}
+
+// replayStats counts the entries of a journal by what replaying them did.
+type replayStats struct {
+	applied int
+	// later counts the entries after the time the journal is replayed until.
+	later int
+	// shredded counts the entries encrypted with the data key of a tenant which was shredded.
+	shredded int
+	failed   int
+}
+
+// replayJournal applies the changes of the journal r made up to until to the database, in the order they were made, and writes the failures to w.
+func replayJournal(r io.Reader, database db.PushDatabase, psm *push.PushServiceManager, until time.Time, dryRun bool, w io.Writer) (replayStats, error) {
+	var stats replayStats
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxJournalEntrySize)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var entry JournalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// The last entry may have been partially written when the instance stopped.
+			fmt.Fprintf(w, "Line %d: invalid entry: %v\n", line, err)
+			stats.failed++
+			continue
+		}
+		if entry.Time > until.UnixNano() {
+			stats.later++
+			continue
+		}
+		err := applyJournalEntry(&entry, database, psm, dryRun)
+		if err == errJournalDataKeyShredded {
+			stats.shredded++
+			continue
+		}
+		if err != nil {
+			fmt.Fprintf(w, "Line %d: Service=%v Subscriber=%v Op=%v Failed: %v\n", line, entry.Service, entry.Subscriber, entry.Op, err)
+			stats.failed++
+			continue
+		}
+		stats.applied++
+	}
+	return stats, scanner.Err()
+}
+
+func applyJournalEntry(entry *JournalEntry, database db.PushDatabase, psm *push.PushServiceManager, dryRun bool) error {
+	data := []byte(entry.DeliveryPoint)
+	if entry.EncryptedDeliveryPoint != nil {
+		var err error
+		if data, err = database.DecryptDeliveryPointOfService(entry.Service, entry.EncryptedDeliveryPoint); err != nil {
+			return err
+		}
+		if data == nil {
+			return errJournalDataKeyShredded
+		}
+	}
+	dp, err := psm.BuildDeliveryPointFromBytes(data)
+	if err != nil {
+		return err
+	}
+	if dryRun {
+		switch entry.Op {
+		case ReplicationSubscribe, ReplicationUnsubscribe, JournalModify:
+			return nil
+		}
+		return fmt.Errorf("Unknown operation %q", entry.Op)
+	}
+	switch entry.Op {
+	case ReplicationSubscribe:
+		_, err = database.AddDeliveryPointToService(entry.Service, entry.Subscriber, dp)
+	case ReplicationUnsubscribe:
+		err = database.RemoveDeliveryPointFromService(entry.Service, entry.Subscriber, dp)
+	case JournalModify:
+		err = database.ModifyDeliveryPoint(dp)
+	default:
+		err = fmt.Errorf("Unknown operation %q", entry.Op)
+	}
+	return err
+}
+
+// RunReplay rebuilds the subscriptions by applying the changes of the journal made up to a time (e.g. just before the database was flushed) to the database.
+// The push service providers must have been added back first. The changes aren't journaled again.
+func RunReplay(conf string, args []string, w io.Writer) error {
+	c, err := OpenConfig(conf)
+	if err != nil {
+		return err
+	}
+	journalConf, err := LoadJournalConfig(c)
+	if err != nil {
+		return err
+	}
+	opts, err := parseReplayOptions(args, journalConf)
+	if err != nil {
+		return err
+	}
+	dbconf, err := LoadDatabaseConfig(c)
+	if err != nil {
+		return err
+	}
+	residencyConf, err := LoadDataResidencyConfig(c)
+	if err != nil {
+		return err
+	}
+	// The cache is bypassed, so that every change is written to redis before returning.
+	database, err := newDataResidencyDatabase(dbconf, residencyConf, db.NewPushDatabaseWithoutCache)
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(opts.journal)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	stats, err := replayJournal(file, database, push.GetPushServiceManager(), opts.until, opts.dryRun, w)
+	if err != nil {
+		return err
+	}
+	verb := "Replayed"
+	if opts.dryRun {
+		verb = "Would replay"
+	}
+	fmt.Fprintf(w, "%s %d changes made until %s (%d failed, %d later changes skipped, %d changes of tenants whose data key was shredded skipped)\n",
+		verb, stats.applied, opts.until.UTC().Format(time.RFC3339), stats.failed, stats.later, stats.shredded)
+	return nil
+}
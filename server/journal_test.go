@@ -0,0 +1,199 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/uniqush/uniqush-push/db"
+	"github.com/uniqush/uniqush-push/push"
+	"github.com/uniqush/uniqush-push/testutil"
+)
+
+// journalDatabase records the changes replayed from a journal. The delivery points of the services in dataKeys are "encrypted" by xoring them with their key.
+type journalDatabase struct {
+	db.PushDatabase
+	changes []string
+	// dataKeys are the keys of the services of tenants. A nil key was shredded.
+	dataKeys map[string][]byte
+}
+
+func xorJournalTestData(key, data []byte) []byte {
+	ret := make([]byte, len(data))
+	for i := range data {
+		ret[i] = data[i] ^ key[i%len(key)]
+	}
+	return ret
+}
+
+func (d *journalDatabase) EncryptDeliveryPointOfService(service string, data []byte) ([]byte, error) {
+	key, ok := d.dataKeys[service]
+	if !ok {
+		return nil, nil
+	}
+	if key == nil {
+		return nil, errors.New("the data key of the tenant of the service was shredded")
+	}
+	return xorJournalTestData(key, data), nil
+}
+
+func (d *journalDatabase) DecryptDeliveryPointOfService(service string, data []byte) ([]byte, error) {
+	key := d.dataKeys[service]
+	if key == nil {
+		return nil, nil
+	}
+	return xorJournalTestData(key, data), nil
+}
+
+func (d *journalDatabase) AddDeliveryPointToService(service, sub string, dp *push.DeliveryPoint) (*push.PushServiceProvider, error) {
+	if service == "unknown" {
+		return nil, errors.New("no push service provider")
+	}
+	d.changes = append(d.changes, "subscribe "+service+" "+sub+" "+dp.FixedData["token"])
+	return nil, nil
+}
+
+func (d *journalDatabase) RemoveDeliveryPointFromService(service, sub string, dp *push.DeliveryPoint) error {
+	d.changes = append(d.changes, "unsubscribe "+service+" "+sub+" "+dp.FixedData["token"])
+	return nil
+}
+
+func (d *journalDatabase) ModifyDeliveryPoint(dp *push.DeliveryPoint) error {
+	d.changes = append(d.changes, "modify "+dp.FixedData["token"])
+	return nil
+}
+
+func TestJournalReplay(t *testing.T) {
+	psm := push.GetPushServiceManager()
+	psm.ClearAllPushServiceTypesForUnitTest()
+	psm.RegisterPushServiceType(newBenchPushServiceType(0))
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "journal.log")
+
+	journal, err := newOperationJournal(&JournalConfig{File: path, Sync: true}, &journalDatabase{})
+	if err != nil {
+		t.Fatalf("Cannot open the journal: %v", err)
+	}
+	clock := time.Unix(1500000000, 0)
+	journal.now = func() time.Time {
+		clock = clock.Add(time.Minute)
+		return clock
+	}
+	record := func(op, service, token string) {
+		dp := newStagingTestDeliveryPoint(t, token)
+		if err := journal.Record(op, service, "sub", dp); err != nil {
+			t.Fatalf("Cannot write to the journal: %v", err)
+		}
+	}
+	record(ReplicationSubscribe, "myservice", "t1")
+	record(ReplicationSubscribe, "unknown", "t2")
+	record(JournalModify, "myservice", "t1")
+	record(ReplicationUnsubscribe, "myservice", "t1")
+	if err := journal.Close(); err != nil {
+		t.Fatalf("Cannot close the journal: %v", err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A partially written entry, as when the instance stopped while writing it.
+	data = append(data, []byte(`{"time":`)...)
+	database := &journalDatabase{}
+	var out bytes.Buffer
+	stats, err := replayJournal(bytes.NewReader(data), database, psm, time.Unix(1500000000, 0).Add(3*time.Minute), false, &out)
+	if err != nil {
+		t.Fatalf("Unexpected error replaying the journal: %v", err)
+	}
+	testutil.ExpectEquals(t, []string{"subscribe myservice sub t1", "modify t1"}, database.changes, "expected the changes up to the time to be replayed in order")
+	testutil.ExpectEquals(t, replayStats{applied: 2, later: 1, failed: 2}, stats, "expected the entries to be counted")
+	if !strings.Contains(out.String(), "Line 2: Service=unknown") || !strings.Contains(out.String(), "Line 5: invalid entry") {
+		t.Errorf("Expected the failures to be reported, got %q", out.String())
+	}
+
+	database = &journalDatabase{}
+	stats, _ = replayJournal(bytes.NewReader(data), database, psm, time.Now(), true, ioutil.Discard)
+	testutil.ExpectEquals(t, 0, len(database.changes), "expected a dry run not to change the database")
+	testutil.ExpectEquals(t, 4, stats.applied, "expected a dry run to count the changes")
+}
+
+func TestJournalEncryptsDeliveryPointsOfTenants(t *testing.T) {
+	psm := push.GetPushServiceManager()
+	psm.ClearAllPushServiceTypesForUnitTest()
+	psm.RegisterPushServiceType(newBenchPushServiceType(0))
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "journal.log")
+
+	database := &journalDatabase{dataKeys: map[string][]byte{"tenantservice": []byte("key")}}
+	journal, err := newOperationJournal(&JournalConfig{File: path}, database)
+	if err != nil {
+		t.Fatalf("Cannot open the journal: %v", err)
+	}
+	for _, change := range [][2]string{{"tenantservice", "secrettoken"}, {"myservice", "plaintoken"}} {
+		if err := journal.Record(ReplicationSubscribe, change[0], "sub", newStagingTestDeliveryPoint(t, change[1])); err != nil {
+			t.Fatalf("Cannot write to the journal: %v", err)
+		}
+	}
+	journal.Close()
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectEquals(t, false, strings.Contains(string(data), "secrettoken"), "expected the delivery points of tenants to be encrypted in the journal")
+	testutil.ExpectEquals(t, true, strings.Contains(string(data), "plaintoken"), "expected the delivery points of other services to be journaled as they are")
+
+	stats, err := replayJournal(bytes.NewReader(data), database, psm, time.Now(), false, ioutil.Discard)
+	testutil.ExpectEquals(t, nil, err, "unexpected error replaying the journal")
+	testutil.ExpectEquals(t, replayStats{applied: 2}, stats, "expected every change to be replayed")
+	testutil.ExpectEquals(t, []string{"subscribe tenantservice sub secrettoken", "subscribe myservice sub plaintoken"}, database.changes, "expected the delivery points to be decrypted")
+
+	database.dataKeys["tenantservice"] = nil
+	database.changes = nil
+	stats, _ = replayJournal(bytes.NewReader(data), database, psm, time.Now(), false, ioutil.Discard)
+	testutil.ExpectEquals(t, replayStats{applied: 1, shredded: 1}, stats, "expected the changes of a tenant whose data key was shredded to be skipped")
+	testutil.ExpectEquals(t, []string{"subscribe myservice sub plaintoken"}, database.changes, "expected the delivery points of a shredded tenant not to be restored")
+
+	journal, _ = newOperationJournal(&JournalConfig{File: path}, database)
+	defer journal.Close()
+	if err := journal.Record(ReplicationSubscribe, "tenantservice", "sub", newStagingTestDeliveryPoint(t, "secrettoken")); err == nil {
+		t.Error("Expected the changes of a tenant whose data key was shredded not to be journaled")
+	}
+}
+
+func TestDisabledJournal(t *testing.T) {
+	journal, err := newOperationJournal(&JournalConfig{}, nil)
+	testutil.ExpectEquals(t, (*operationJournal)(nil), journal, "expected no journal without a file")
+	testutil.ExpectEquals(t, nil, err, "expected no error without a file")
+	testutil.ExpectEquals(t, nil, journal.Record(ReplicationSubscribe, "myservice", "sub", nil), "expected a nil journal to accept changes")
+}
+
+func TestParseReplayOptions(t *testing.T) {
+	_, err := parseReplayOptions(nil, &JournalConfig{})
+	if err == nil {
+		t.Error("Expected the journal to be required")
+	}
+	opts, err := parseReplayOptions([]string{"-until", "2018-07-21T15:04:05Z"}, &JournalConfig{File: "/var/lib/uniqush/journal.log"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	testutil.ExpectStringEquals(t, "/var/lib/uniqush/journal.log", opts.journal, "expected the journal of [Journal] by default")
+	testutil.ExpectEquals(t, time.Date(2018, 7, 21, 15, 4, 5, 0, time.UTC).Unix(), opts.until.Unix(), "expected RFC 3339 times")
+	opts, _ = parseReplayOptions([]string{"-journal", "j.log", "-until", "1532185445"}, &JournalConfig{})
+	testutil.ExpectEquals(t, int64(1532185445), opts.until.Unix(), "expected unix timestamps")
+	if _, err := parseReplayOptions([]string{"-journal", "j.log", "-until", "yesterday"}, &JournalConfig{}); err == nil {
+		t.Error("Expected invalid times to be rejected")
+	}
+}
@@ -0,0 +1,350 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/uniqush/log"
+)
+
+// Paths of the admin listener which list, add and remove the listeners of the REST API at runtime.
+const (
+	QueryListenersURL = "/listeners"
+	AddListenerURL    = "/addlistener"
+	RemoveListenerURL = "/rmlistener"
+)
+
+// unixSocketPrefix starts the addresses of listeners on unix domain sockets, e.g. unix:/run/uniqush/push.sock.
+const unixSocketPrefix = "unix:"
+
+// ListenerInfo describes a listener of the REST API.
+type ListenerInfo struct {
+	// Addr is the address the listener was added with (e.g. :9898 or unix:/run/uniqush/push.sock).
+	Addr string `json:"addr"`
+	// Bound is the address the listener is bound to (e.g. [::]:9898 or /run/uniqush/push.sock).
+	Bound string `json:"bound"`
+	TLS   bool   `json:"tls"`
+	// Started is the unix timestamp when the listener started accepting connections.
+	Started int64 `json:"started"`
+}
+
+type restListener struct {
+	info   ListenerInfo
+	server *http.Server
+}
+
+// listenerSet serves the REST API on listeners which can be added and removed without restarting,
+// e.g. to move the API to another port or to enable TLS on a live instance.
+// A removed listener stops accepting connections right away, and its requests in progress get drainTimeout to finish.
+type listenerSet struct {
+	mutex   sync.Mutex
+	handler http.Handler
+	// configPath is the config file whose TLS settings ([WebFrontend] tls_cert etc.) are loaded when a TLS listener is added, if TLS wasn't enabled when uniqush-push started.
+	configPath   string
+	tlsConfig    *tls.Config
+	drainTimeout time.Duration
+	// socketMode is the permissions of the unix sockets listened on (socket_mode in [WebFrontend]), 0 to keep the ones of the umask.
+	socketMode os.FileMode
+	logger     log.Logger
+	listeners  map[string]*restListener
+}
+
+func newListenerSet(handler http.Handler, configPath string, tlsConfig *tls.Config, drainTimeout time.Duration, socketMode os.FileMode, logger log.Logger) *listenerSet {
+	return &listenerSet{
+		handler:      handler,
+		configPath:   configPath,
+		tlsConfig:    tlsConfig,
+		drainTimeout: drainTimeout,
+		socketMode:   socketMode,
+		logger:       logger,
+		listeners:    make(map[string]*restListener),
+	}
+}
+
+// Add starts serving the REST API on addr. Returns an error (and doesn't add the listener) if addr can't be bound.
+func (s *listenerSet) Add(addr string, useTLS bool) (ListenerInfo, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.listeners[addr]; ok {
+		return ListenerInfo{}, fmt.Errorf("Already listening on %s", addr)
+	}
+	var tlsConfig *tls.Config
+	if useTLS {
+		var err error
+		if tlsConfig, err = s.loadTLSConfig(); err != nil {
+			return ListenerInfo{}, err
+		}
+	}
+	ln, err := s.listen(addr)
+	if err != nil {
+		return ListenerInfo{}, err
+	}
+	l := &restListener{
+		info:   ListenerInfo{Addr: addr, Bound: ln.Addr().String(), TLS: useTLS, Started: time.Now().Unix()},
+		server: &http.Server{Handler: s.handler, TLSConfig: tlsConfig},
+	}
+	s.listeners[addr] = l
+	go s.serve(l, ln)
+	s.logger.Infof("[Listener] Added %s TLS=%v", addr, useTLS)
+	return l.info, nil
+}
+
+// listen binds a TCP address, or the unix socket of an address starting with unix:.
+// A socket left behind by a process which didn't stop cleanly is replaced, but not one which is still accepting connections.
+// The socket is removed when its listener is closed.
+func (s *listenerSet) listen(addr string) (net.Listener, error) {
+	if !strings.HasPrefix(addr, unixSocketPrefix) {
+		return net.Listen("tcp", addr)
+	}
+	path := strings.TrimPrefix(addr, unixSocketPrefix)
+	if path == "" {
+		return nil, fmt.Errorf("Missing the path of the unix socket in %s", addr)
+	}
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use by another process", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	return listenUnix(path, s.socketMode)
+}
+
+// listenUnix listens on the unix socket path, with the permissions mode (0 to keep the ones of the umask).
+// The socket is created in a private directory and linked to path once it has its permissions, so that no client can connect to it before.
+// Linking fails if path exists, like binding it would.
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	bound := path
+	if mode != 0 {
+		dir, err := ioutil.TempDir(filepath.Dir(path), ".uniqush-")
+		if err != nil {
+			return nil, err
+		}
+		defer os.RemoveAll(dir)
+		bound = filepath.Join(dir, "s")
+	}
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: bound, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	// The listener would only remove the name it was bound to.
+	ln.SetUnlinkOnClose(false)
+	if bound != path {
+		err = os.Chmod(bound, mode)
+		if err == nil {
+			err = os.Link(bound, path)
+		}
+		if err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+	return &unixSocketListener{UnixListener: ln, addr: &net.UnixAddr{Name: path, Net: "unix"}}, nil
+}
+
+// unixSocketClientAddr is the RemoteAddr of the requests of the clients of unix sockets, which have no address of their own.
+const unixSocketClientAddr = "@unix"
+
+// unixSocketListener is a listener on the unix socket at addr, which it removes when it is closed.
+// The remote address of its connections is unixSocketClientAddr, so that they can't be mistaken for requests with an empty RemoteAddr.
+type unixSocketListener struct {
+	*net.UnixListener
+	addr *net.UnixAddr
+}
+
+func (l *unixSocketListener) Accept() (net.Conn, error) {
+	conn, err := l.UnixListener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return unixSocketConn{conn}, nil
+}
+
+func (l *unixSocketListener) Addr() net.Addr {
+	return l.addr
+}
+
+func (l *unixSocketListener) Close() error {
+	err := l.UnixListener.Close()
+	os.Remove(l.addr.Name)
+	return err
+}
+
+type unixSocketConn struct {
+	net.Conn
+}
+
+func (unixSocketConn) RemoteAddr() net.Addr {
+	return &net.UnixAddr{Name: unixSocketClientAddr, Net: "unix"}
+}
+
+// isUnixSocketAddr returns true if remoteAddr is the address of a client connected to a unix socket (see unixSocketListener).
+// An empty remoteAddr (e.g. a request which didn't come from a listener) is not.
+func isUnixSocketAddr(remoteAddr string) bool {
+	return remoteAddr == unixSocketClientAddr
+}
+
+func (s *listenerSet) serve(l *restListener, ln net.Listener) {
+	var err error
+	if l.info.TLS {
+		// The certificate comes from TLSConfig.GetCertificate, so that it can be reloaded.
+		err = l.server.ServeTLS(ln, "", "")
+	} else {
+		err = l.server.Serve(ln)
+	}
+	if err != nil && err != http.ErrServerClosed {
+		s.logger.Errorf("HTTPServerError Addr=%v \"%v\"", l.info.Addr, err)
+	}
+}
+
+// loadTLSConfig returns the TLS settings of the REST API. If TLS wasn't enabled when uniqush-push started, they are loaded from the config file.
+// This must be called with mutex held.
+func (s *listenerSet) loadTLSConfig() (*tls.Config, error) {
+	if s.tlsConfig != nil {
+		return s.tlsConfig, nil
+	}
+	c, err := OpenConfig(s.configPath)
+	if err != nil {
+		return nil, err
+	}
+	conf, err := LoadTLSConfig(c)
+	if err != nil {
+		return nil, err
+	}
+	if !conf.Enabled() {
+		return nil, fmt.Errorf("[WebFrontend] tls_cert is not set in %s", s.configPath)
+	}
+	if s.tlsConfig, err = newServerTLSConfig(conf, s.logger); err != nil {
+		return nil, err
+	}
+	return s.tlsConfig, nil
+}
+
+// Remove stops accepting connections on addr, and lets the requests in progress finish in the background.
+// The last listener can't be removed.
+func (s *listenerSet) Remove(addr string) error {
+	s.mutex.Lock()
+	l, ok := s.listeners[addr]
+	if !ok {
+		s.mutex.Unlock()
+		return fmt.Errorf("Not listening on %s", addr)
+	}
+	if len(s.listeners) == 1 {
+		s.mutex.Unlock()
+		return fmt.Errorf("Cannot remove the last listener %s", addr)
+	}
+	delete(s.listeners, addr)
+	s.mutex.Unlock()
+
+	s.logger.Infof("[Listener] Removing %s, Timeout=%v", addr, s.drainTimeout)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), s.drainTimeout)
+		defer cancel()
+		if err := l.server.Shutdown(ctx); err != nil {
+			s.logger.Warnf("[Listener] Requests in progress on %s didn't finish before the deadline: %v", addr, err)
+			l.server.Close()
+		}
+	}()
+	return nil
+}
+
+// Replace adds a listener on addr, then removes the listener on old once the new one accepts connections.
+func (s *listenerSet) Replace(old, addr string, useTLS bool) (ListenerInfo, error) {
+	s.mutex.Lock()
+	_, ok := s.listeners[old]
+	s.mutex.Unlock()
+	if !ok {
+		return ListenerInfo{}, fmt.Errorf("Not listening on %s", old)
+	}
+	info, err := s.Add(addr, useTLS)
+	if err != nil {
+		return info, err
+	}
+	return info, s.Remove(old)
+}
+
+// List returns the listeners, sorted by address.
+func (s *listenerSet) List() []ListenerInfo {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	list := make([]ListenerInfo, 0, len(s.listeners))
+	for _, l := range s.listeners {
+		list = append(list, l.info)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Addr < list[j].Addr })
+	return list
+}
+
+// serveListeners handles QueryListenersURL, AddListenerURL and RemoveListenerURL.
+// /addlistener takes the addr to listen on, whether to use tls (by default, if TLS is enabled), and optionally the address of a listener to replace.
+func (s *listenerSet) serveListeners(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != QueryListenersURL && r.Method != "POST" {
+		http.Error(w, "Listeners must be changed with POST", http.StatusMethodNotAllowed)
+		return
+	}
+	addr := r.FormValue("addr")
+	if r.URL.Path != QueryListenersURL && addr == "" {
+		http.Error(w, "Missing addr", http.StatusBadRequest)
+		return
+	}
+	switch r.URL.Path {
+	case AddListenerURL:
+		s.mutex.Lock()
+		useTLS := s.tlsConfig != nil
+		s.mutex.Unlock()
+		if v := r.FormValue("tls"); v != "" {
+			var err error
+			if useTLS, err = strconv.ParseBool(v); err != nil {
+				http.Error(w, fmt.Sprintf("Invalid tls %q", v), http.StatusBadRequest)
+				return
+			}
+		}
+		var err error
+		if old := r.FormValue("replace"); old != "" {
+			_, err = s.Replace(old, addr, useTLS)
+		} else {
+			_, err = s.Add(addr, useTLS)
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to add the listener: %v", err), http.StatusBadRequest)
+			return
+		}
+	case RemoveListenerURL:
+		if err := s.Remove(addr); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to remove the listener: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.List())
+}
@@ -0,0 +1,155 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/uniqush/log"
+	"github.com/uniqush/uniqush-push/testutil"
+)
+
+func TestListenerSet(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	})
+	s := newListenerSet(handler, "../conf/uniqush-push.conf", nil, time.Second, 0, log.NewLogger(ioutil.Discard, "", log.LOGLEVEL_SILENT))
+	get := func(addr string) error {
+		resp, err := http.Get("http://" + addr + "/")
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+
+	first, err := s.Add("127.0.0.1:0", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := get(first.Bound); err != nil {
+		t.Fatalf("expected the API to be served on the first listener: %v", err)
+	}
+	if _, err := s.Add("127.0.0.1:0", false); err == nil {
+		t.Error("expected adding the same address twice to fail")
+	}
+	if _, err := s.Add("localhost:0", true); err == nil {
+		t.Error("expected a TLS listener to be rejected when [TLS] isn't configured")
+	}
+	if err := s.Remove("127.0.0.1:0"); err == nil {
+		t.Error("expected the last listener not to be removed")
+	}
+
+	second, err := s.Replace("127.0.0.1:0", "localhost:0", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := get(second.Bound); err != nil {
+		t.Errorf("expected the API to be served on the new listener: %v", err)
+	}
+	testutil.ExpectEquals(t, []ListenerInfo{second}, s.List(), "expected the replaced listener to be removed")
+	if !waitUntil(time.Now().Add(time.Second), func() bool { return get(first.Bound) != nil }) {
+		t.Error("expected the replaced listener to stop accepting connections")
+	}
+}
+
+func TestUnixSocketListener(t *testing.T) {
+	dir, err := ioutil.TempDir("", "uniqush-socket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "push.sock")
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.RemoteAddr)
+	})
+	s := newListenerSet(handler, "../conf/uniqush-push.conf", nil, time.Second, 0660, log.NewLogger(ioutil.Discard, "", log.LOGLEVEL_SILENT))
+
+	// A socket left behind by a process which didn't stop cleanly.
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	info, err := s.Add("unix:"+path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectStringEquals(t, path, info.Bound, "unexpected bound address")
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectEquals(t, os.FileMode(0660), fi.Mode().Perm(), "unexpected permissions of the socket")
+	if _, err := s.Add("unix:", false); err == nil {
+		t.Error("expected the path of the socket to be required")
+	}
+	other := newListenerSet(handler, "", nil, time.Second, 0, log.NewLogger(ioutil.Discard, "", log.LOGLEVEL_SILENT))
+	if _, err := other.Add("unix:"+path, false); err == nil {
+		t.Error("expected a socket in use not to be replaced")
+	}
+
+	client := &http.Client{Transport: &http.Transport{DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return net.Dial("unix", path)
+	}}}
+	resp, err := client.Get("http://uniqush/")
+	if err != nil {
+		t.Fatalf("expected the API to be served on the socket: %v", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !isUnixSocketAddr(string(body)) {
+		t.Errorf("expected the address of a client of a unix socket, got %q", body)
+	}
+	if isUnixSocketAddr("") {
+		t.Error("expected an empty address not to be the address of a client of a unix socket")
+	}
+	if entries, _ := ioutil.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("expected only the socket in %s, got %d entries", dir, len(entries))
+	}
+
+	if _, err := s.Add("127.0.0.1:0", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Remove("unix:" + path); err != nil {
+		t.Fatal(err)
+	}
+	if !waitUntil(time.Now().Add(time.Second), func() bool { _, err := os.Stat(path); return os.IsNotExist(err) }) {
+		t.Error("expected the socket to be removed with its listener")
+	}
+}
+
+func TestServeListeners(t *testing.T) {
+	s := newListenerSet(http.NotFoundHandler(), "../conf/uniqush-push.conf", nil, time.Second, 0, log.NewLogger(ioutil.Discard, "", log.LOGLEVEL_SILENT))
+	if _, err := s.Add("127.0.0.1:0", false); err != nil {
+		t.Fatal(err)
+	}
+	serve := func(method, path string, form url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		s.serveListeners(w, req)
+		return w
+	}
+
+	testutil.ExpectEquals(t, http.StatusMethodNotAllowed, serve("GET", AddListenerURL, url.Values{"addr": {"localhost:0"}}).Code, "expected listeners to be added with POST")
+	testutil.ExpectEquals(t, http.StatusBadRequest, serve("POST", AddListenerURL, url.Values{}).Code, "expected addr to be required")
+	testutil.ExpectEquals(t, http.StatusBadRequest, serve("POST", AddListenerURL, url.Values{"addr": {"localhost:0"}, "tls": {"maybe"}}).Code, "expected an invalid tls to be rejected")
+	w := serve("POST", AddListenerURL, url.Values{"addr": {"localhost:0"}})
+	testutil.ExpectEquals(t, http.StatusOK, w.Code, "expected the listener to be added")
+	testutil.ExpectEquals(t, 2, len(s.List()), "expected two listeners")
+	testutil.ExpectEquals(t, http.StatusOK, serve("POST", RemoveListenerURL, url.Values{"addr": {"127.0.0.1:0"}}).Code, "expected the listener to be removed")
+	testutil.ExpectEquals(t, http.StatusBadRequest, serve("POST", RemoveListenerURL, url.Values{"addr": {"localhost:0"}}).Code, "expected the last listener not to be removed")
+	testutil.ExpectEquals(t, http.StatusOK, serve("GET", QueryListenersURL, nil).Code, "expected the listeners to be listed")
+}
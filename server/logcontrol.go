@@ -0,0 +1,358 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/uniqush/log"
+)
+
+// LogSamplingURL enables (or with rate=0, disables) the temporary sampling of the debug logs of a service on the admin listener.
+const LogSamplingURL = "/logsampling"
+
+const (
+	// logSenderPrefix is the prefix of the components of /loglevel which are push service types (e.g. sender:apns).
+	// Their levels apply to the log lines about push service providers of that type, in every logger.
+	logSenderPrefix = "sender:"
+	// logLevelReset removes the level of a push service type set with /loglevel.
+	logLevelReset = "reset"
+
+	defaultLogSamplingDuration = 10 * time.Minute
+	maxLogSamplingDuration     = 24 * time.Hour
+)
+
+// loggerAliases are other names accepted by /loglevel for the loggers of sections of uniqush.conf.
+var loggerAliases = map[string]string{
+	"dbfrontdesk": "Database",
+}
+
+// LogOverride is the level of the log lines about the push service providers of a push service type, set with /loglevel?logger=sender:<type>.
+type LogOverride struct {
+	Component string `json:"component"`
+	Level     string `json:"level"`
+	// Expires is the unix timestamp after which the override is removed, or 0 if it lasts until uniqush-push is restarted.
+	Expires int64 `json:"expires,omitempty"`
+	level   int
+}
+
+// LogSampling logs the debug lines of a sample of the requests of a service, whatever the level of the loggers.
+type LogSampling struct {
+	Service string `json:"service"`
+	// Rate is the fraction of requests whose debug lines are logged.
+	Rate float64 `json:"rate"`
+	// Expires is the unix timestamp after which sampling stops.
+	Expires int64 `json:"expires"`
+}
+
+// logControls holds the levels of push service types and the sampling of services, which apply to every controlled logger.
+// Looking at the fields of log lines is only needed (and only done) while an override or sampling is active.
+type logControls struct {
+	mutex     sync.RWMutex
+	overrides map[string]LogOverride
+	sampling  map[string]LogSampling
+	// active is the number of overrides and sampled services.
+	active int32
+	now    func() time.Time
+}
+
+// logControl applies to every logger returned by LoadLoggers. Like redaction, it is shared by all of them.
+var logControl = newLogControls()
+
+func newLogControls() *logControls {
+	return &logControls{
+		overrides: make(map[string]LogOverride),
+		sampling:  make(map[string]LogSampling),
+		now:       time.Now,
+	}
+}
+
+func (c *logControls) updateActive() {
+	atomic.StoreInt32(&c.active, int32(len(c.overrides)+len(c.sampling)))
+}
+
+// SetOverride sets the level of the log lines about the push service providers of pushServiceType, for duration (or until restarted if duration is 0).
+func (c *logControls) SetOverride(pushServiceType string, level int, duration time.Duration) {
+	o := LogOverride{Component: logSenderPrefix + pushServiceType, Level: logLevelName(level), level: level}
+	if duration > 0 {
+		o.Expires = c.now().Add(duration).Unix()
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.overrides[pushServiceType] = o
+	c.updateActive()
+}
+
+// RemoveOverride returns false if pushServiceType had no level.
+func (c *logControls) RemoveOverride(pushServiceType string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	_, ok := c.overrides[pushServiceType]
+	delete(c.overrides, pushServiceType)
+	c.updateActive()
+	return ok
+}
+
+// SetSampling logs the debug lines of rate of the requests of service for duration. A rate of 0 stops sampling service.
+func (c *logControls) SetSampling(service string, rate float64, duration time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if rate <= 0 {
+		delete(c.sampling, service)
+	} else {
+		c.sampling[service] = LogSampling{Service: service, Rate: rate, Expires: c.now().Add(duration).Unix()}
+	}
+	c.updateActive()
+}
+
+// List removes the expired overrides and sampled services, and returns the others.
+func (c *logControls) List() ([]LogOverride, []LogSampling) {
+	now := c.now().Unix()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	overrides := []LogOverride{}
+	for pushServiceType, o := range c.overrides {
+		if o.Expires != 0 && o.Expires <= now {
+			delete(c.overrides, pushServiceType)
+			continue
+		}
+		overrides = append(overrides, o)
+	}
+	sampling := []LogSampling{}
+	for service, s := range c.sampling {
+		if s.Expires <= now {
+			delete(c.sampling, service)
+			continue
+		}
+		sampling = append(sampling, s)
+	}
+	c.updateActive()
+	sort.Slice(overrides, func(i, j int) bool { return overrides[i].Component < overrides[j].Component })
+	sort.Slice(sampling, func(i, j int) bool { return sampling[i].Service < sampling[j].Service })
+	return overrides, sampling
+}
+
+// allows returns true if a line of msg at level must be logged by a logger at loggerLevel, once the level of the push service type
+// of its PushServiceProvider field and the sampling of its Service field are applied.
+func (c *logControls) allows(level, loggerLevel int, msg string) bool {
+	if atomic.LoadInt32(&c.active) == 0 {
+		return level <= loggerLevel
+	}
+	fields := logMessageFields(msg)
+	now := c.now().Unix()
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	if psp := fields["PushServiceProvider"]; psp != "" {
+		pushServiceType := psp
+		if i := strings.IndexByte(psp, ':'); i >= 0 {
+			pushServiceType = psp[:i]
+		}
+		if o, ok := c.overrides[pushServiceType]; ok && (o.Expires == 0 || o.Expires > now) {
+			loggerLevel = o.level
+		}
+	}
+	if level <= loggerLevel {
+		return true
+	}
+	s, ok := c.sampling[fields["Service"]]
+	if !ok || s.Expires <= now || level > log.LOGLEVEL_DEBUG {
+		return false
+	}
+	return sampleLogRequest(fields["RequestID"], s.Rate)
+}
+
+// sampleLogRequest returns true for rate of the request ids, always the same ones, so that every line of a sampled request is logged.
+// Lines without a request id are sampled independently.
+func sampleLogRequest(requestID string, rate float64) bool {
+	if requestID == "" {
+		return rand.Float64() < rate
+	}
+	h := fnv.New32a()
+	h.Write([]byte(requestID))
+	return float64(h.Sum32()%10000) < rate*10000
+}
+
+// logMessageFields returns the Key=Value pairs of a log message.
+func logMessageFields(msg string) map[string]string {
+	fields := make(map[string]string)
+	rest := msg
+	for len(rest) > 0 {
+		word := rest
+		if i := strings.IndexByte(rest, ' '); i >= 0 {
+			word = rest[:i]
+		}
+		n := len(word)
+		if eq := strings.IndexByte(word, '='); eq > 0 && isLogFieldKey(word[:eq]) {
+			var value string
+			value, n = logFieldValue(rest[eq+1:])
+			fields[word[:eq]] = strings.Trim(value, `"`)
+			n += eq + 1
+		}
+		rest = rest[n:]
+		if len(rest) > 0 {
+			rest = rest[1:]
+		}
+	}
+	return fields
+}
+
+func logLevelName(level int) string {
+	if level == log.LOGLEVEL_SILENT {
+		return "off"
+	}
+	return logLevelNames[level]
+}
+
+// controlledLogger is a log.Logger whose level is applied with logControls, so that the lines of some services and push service types
+// can be logged at another level. The logger it wraps logs every line it is given.
+type controlledLogger struct {
+	logger   log.Logger
+	level    int32
+	controls *logControls
+}
+
+var _ log.Logger = &controlledLogger{}
+
+func newControlledLogger(logger log.Logger, level int, controls *logControls) *controlledLogger {
+	logger.SetLogLevel(log.LOGLEVEL_DEBUG)
+	return &controlledLogger{logger: logger, level: int32(level), controls: controls}
+}
+
+// SetLogLevel changes the level of the logger. It is safe to call while the logger is used, e.g. from /loglevel.
+func (l *controlledLogger) SetLogLevel(level int) {
+	atomic.StoreInt32(&l.level, int32(level))
+}
+
+// LogLevel returns the level of the logger, for /loglevel.
+func (l *controlledLogger) LogLevel() int {
+	return int(atomic.LoadInt32(&l.level))
+}
+
+func (l *controlledLogger) logf(level int, out func(string, ...interface{}), format string, v []interface{}) {
+	loggerLevel := l.LogLevel()
+	if atomic.LoadInt32(&l.controls.active) == 0 {
+		if level <= loggerLevel {
+			out(format, v...)
+		}
+		return
+	}
+	msg := fmt.Sprintf(format, v...)
+	if l.controls.allows(level, loggerLevel, msg) {
+		out("%s", msg)
+	}
+}
+
+func (l *controlledLogger) log(level int, out func(...interface{}), v []interface{}) {
+	loggerLevel := l.LogLevel()
+	if atomic.LoadInt32(&l.controls.active) == 0 {
+		if level <= loggerLevel {
+			out(v...)
+		}
+		return
+	}
+	if l.controls.allows(level, loggerLevel, fmt.Sprint(v...)) {
+		out(v...)
+	}
+}
+
+func (l *controlledLogger) Fatal(v ...interface{}) { l.log(log.LOGLEVEL_FATAL, l.logger.Fatal, v) }
+func (l *controlledLogger) Fatalf(format string, v ...interface{}) {
+	l.logf(log.LOGLEVEL_FATAL, l.logger.Fatalf, format, v)
+}
+func (l *controlledLogger) Alert(v ...interface{}) { l.log(log.LOGLEVEL_ALERT, l.logger.Alert, v) }
+func (l *controlledLogger) Alertf(format string, v ...interface{}) {
+	l.logf(log.LOGLEVEL_ALERT, l.logger.Alertf, format, v)
+}
+func (l *controlledLogger) Error(v ...interface{}) { l.log(log.LOGLEVEL_ERROR, l.logger.Error, v) }
+func (l *controlledLogger) Errorf(format string, v ...interface{}) {
+	l.logf(log.LOGLEVEL_ERROR, l.logger.Errorf, format, v)
+}
+func (l *controlledLogger) Warn(v ...interface{}) { l.log(log.LOGLEVEL_WARN, l.logger.Warn, v) }
+func (l *controlledLogger) Warnf(format string, v ...interface{}) {
+	l.logf(log.LOGLEVEL_WARN, l.logger.Warnf, format, v)
+}
+func (l *controlledLogger) Config(v ...interface{}) { l.log(log.LOGLEVEL_CONFIG, l.logger.Config, v) }
+func (l *controlledLogger) Configf(format string, v ...interface{}) {
+	l.logf(log.LOGLEVEL_CONFIG, l.logger.Configf, format, v)
+}
+func (l *controlledLogger) Info(v ...interface{}) { l.log(log.LOGLEVEL_INFO, l.logger.Info, v) }
+func (l *controlledLogger) Infof(format string, v ...interface{}) {
+	l.logf(log.LOGLEVEL_INFO, l.logger.Infof, format, v)
+}
+func (l *controlledLogger) Debug(v ...interface{}) { l.log(log.LOGLEVEL_DEBUG, l.logger.Debug, v) }
+func (l *controlledLogger) Debugf(format string, v ...interface{}) {
+	l.logf(log.LOGLEVEL_DEBUG, l.logger.Debugf, format, v)
+}
+
+// serveLogLevels lists the levels of the loggers, the levels of push service types and the sampled services.
+func serveLogLevels(w http.ResponseWriter, loggers []log.Logger, controls *logControls) {
+	type responseType struct {
+		Loggers   map[string]string `json:"loggers"`
+		Overrides []LogOverride     `json:"overrides"`
+		Sampling  []LogSampling     `json:"sampling"`
+	}
+	r := responseType{Loggers: make(map[string]string)}
+	for i, section := range loggerSections {
+		if i < len(loggers) {
+			if l, ok := loggers[i].(*controlledLogger); ok {
+				r.Loggers[section] = logLevelName(l.LogLevel())
+			}
+		}
+	}
+	r.Overrides, r.Sampling = controls.List()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(r)
+}
+
+// serveLogSampling logs the debug lines of rate (0 to 1) of the requests of service for duration seconds (10 minutes by default).
+func serveLogSampling(w http.ResponseWriter, r *http.Request, controls *logControls) {
+	service := r.FormValue("service")
+	if service == "" {
+		http.Error(w, "service is required", http.StatusBadRequest)
+		return
+	}
+	rate, err := strconv.ParseFloat(r.FormValue("rate"), 64)
+	if err != nil || rate < 0 || rate > 1 {
+		http.Error(w, fmt.Sprintf("Invalid rate %q: must be between 0 and 1", r.FormValue("rate")), http.StatusBadRequest)
+		return
+	}
+	duration := defaultLogSamplingDuration
+	if s := r.FormValue("duration"); s != "" {
+		seconds, err := strconv.Atoi(s)
+		if err != nil || seconds <= 0 || time.Duration(seconds)*time.Second > maxLogSamplingDuration {
+			http.Error(w, fmt.Sprintf("Invalid duration %q: must be between 1 and %d seconds", s, int(maxLogSamplingDuration/time.Second)), http.StatusBadRequest)
+			return
+		}
+		duration = time.Duration(seconds) * time.Second
+	}
+	controls.SetSampling(service, rate, duration)
+	if rate == 0 {
+		fmt.Fprintf(w, "Stopped sampling the debug logs of %s\n", service)
+		return
+	}
+	fmt.Fprintf(w, "Logging the debug lines of %v%% of the requests of %s for %v\n", rate*100, service, duration)
+}
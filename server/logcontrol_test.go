@@ -0,0 +1,106 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/uniqush/log"
+	"github.com/uniqush/uniqush-push/testutil"
+)
+
+func TestControlledLogger(t *testing.T) {
+	var buf bytes.Buffer
+	controls := newLogControls()
+	now := time.Unix(1500000000, 0)
+	controls.now = func() time.Time { return now }
+	logger := newControlledLogger(newJSONLogger(&buf, "Push", log.LOGLEVEL_INFO), log.LOGLEVEL_INFO, controls)
+	logged := func(f func()) bool {
+		buf.Reset()
+		f()
+		return buf.Len() > 0
+	}
+
+	testutil.ExpectEquals(t, false, logged(func() { logger.Debugf("Service=app PushServiceProvider=apns:1 hidden") }), "expected the level of the logger to apply")
+	testutil.ExpectEquals(t, true, logged(func() { logger.Infof("Service=app visible") }), "expected info lines to be logged")
+
+	controls.SetOverride("apns", log.LOGLEVEL_DEBUG, time.Minute)
+	testutil.ExpectEquals(t, true, logged(func() { logger.Debugf("Service=app PushServiceProvider=apns:1 Sent") }), "expected the debug lines of apns to be logged")
+	testutil.ExpectEquals(t, false, logged(func() { logger.Debugf("Service=app PushServiceProvider=fcm:1 Sent") }), "expected other push service types to keep the level of the logger")
+	controls.SetOverride("fcm", log.LOGLEVEL_ERROR, 0)
+	testutil.ExpectEquals(t, false, logged(func() { logger.Infof("Service=app PushServiceProvider=fcm:1 Sent") }), "expected the level of a push service type to be lowered")
+	now = now.Add(2 * time.Minute)
+	testutil.ExpectEquals(t, false, logged(func() { logger.Debugf("Service=app PushServiceProvider=apns:1 Sent") }), "expected the level to expire")
+	overrides, _ := controls.List()
+	testutil.ExpectEquals(t, []LogOverride{{Component: "sender:fcm", Level: "error", level: log.LOGLEVEL_ERROR}}, overrides, "expected expired levels to be removed")
+	testutil.ExpectEquals(t, true, controls.RemoveOverride("fcm"), "expected the level to be removed")
+
+	controls.SetSampling("app", 0.5, time.Minute)
+	sampled := 0
+	for i := 0; i < 200; i++ {
+		requestID := strings.Repeat("r", i%7) + string(rune('a'+i%26)) + string(rune('a'+i/26))
+		first := logged(func() { logger.Debugf("RequestID=%s Service=app Pushing", requestID) })
+		second := logged(func() { logger.Debugf("RequestID=%s Service=app Sent", requestID) })
+		testutil.ExpectEquals(t, first, second, "expected every line of a sampled request to be logged")
+		if first {
+			sampled++
+		}
+	}
+	testutil.ExpectEquals(t, true, sampled > 50 && sampled < 150, "expected about half of the requests to be sampled")
+	testutil.ExpectEquals(t, false, logged(func() { logger.Debugf("RequestID=r1 Service=other Sent") }), "expected other services not to be sampled")
+	now = now.Add(2 * time.Minute)
+	testutil.ExpectEquals(t, false, logged(func() { logger.Debugf("Service=app Sent") }), "expected sampling to expire")
+	_, sampling := controls.List()
+	testutil.ExpectEquals(t, 0, len(sampling), "expected expired sampling to be removed")
+
+	logger.SetLogLevel(log.LOGLEVEL_SILENT)
+	testutil.ExpectEquals(t, false, logged(func() { logger.Errorf("Service=app Failed") }), "expected a silent logger not to log")
+}
+
+func TestAdminHandlerLogControls(t *testing.T) {
+	defer func() { logControl = newLogControls() }()
+	loggers := make([]log.Logger, NumberOfLoggers)
+	for i := range loggers {
+		loggers[i] = newControlledLogger(log.NewLogger(&bytes.Buffer{}, "", log.LOGLEVEL_INFO), log.LOGLEVEL_INFO, logControl)
+	}
+	handler := newAdminHandler(AdminConfig{Addr: "localhost:0", Token: "secret"}, loggers, nil, nil, nil, nil, nil, nil, nil, nil)
+	request := func(method, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+	testutil.ExpectEquals(t, http.StatusOK, request("POST", "/loglevel?logger=dbfrontdesk&level=debug").Code, "expected loggers to have aliases")
+	testutil.ExpectEquals(t, http.StatusOK, request("POST", "/loglevel?logger=webfrontend&level=warn").Code, "expected logger names to be case insensitive")
+	testutil.ExpectEquals(t, http.StatusOK, request("POST", "/loglevel?logger=sender:apns&level=debug&duration=60").Code, "expected the level of a push service type to be set")
+	testutil.ExpectEquals(t, http.StatusBadRequest, request("POST", "/loglevel?logger=sender:apns&level=debug&duration=soon").Code, "expected invalid durations to be rejected")
+	testutil.ExpectEquals(t, http.StatusOK, request("POST", LogSamplingURL+"?service=app&rate=0.1").Code, "expected sampling to be enabled")
+	testutil.ExpectEquals(t, http.StatusBadRequest, request("POST", LogSamplingURL+"?service=app&rate=2").Code, "expected invalid rates to be rejected")
+
+	w := request("GET", "/loglevel")
+	var levels struct {
+		Loggers   map[string]string `json:"loggers"`
+		Overrides []LogOverride     `json:"overrides"`
+		Sampling  []LogSampling     `json:"sampling"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &levels); err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectStringEquals(t, "debug", levels.Loggers["Database"], "expected the level of the database logger")
+	testutil.ExpectStringEquals(t, "warn", levels.Loggers["WebFrontend"], "expected the level of the web frontend logger")
+	testutil.ExpectStringEquals(t, "info", levels.Loggers["Push"], "expected other loggers to be unchanged")
+	testutil.ExpectEquals(t, 1, len(levels.Overrides), "expected the level of apns to be listed")
+	testutil.ExpectStringEquals(t, "sender:apns", levels.Overrides[0].Component, "unexpected component")
+	testutil.ExpectEquals(t, []LogSampling{{Service: "app", Rate: 0.1, Expires: levels.Sampling[0].Expires}}, levels.Sampling, "expected the sampled service to be listed")
+
+	testutil.ExpectEquals(t, http.StatusOK, request("POST", "/loglevel?logger=sender:apns&level=reset").Code, "expected the level to be reset")
+	testutil.ExpectEquals(t, http.StatusNotFound, request("POST", "/loglevel?logger=sender:apns&level=reset").Code, "expected resetting twice to fail")
+	testutil.ExpectEquals(t, http.StatusOK, request("POST", LogSamplingURL+"?service=app&rate=0").Code, "expected sampling to be stopped")
+	overrides, sampling := logControl.List()
+	testutil.ExpectEquals(t, 0, len(overrides)+len(sampling), "expected no level or sampling to be left")
+}
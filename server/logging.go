@@ -0,0 +1,356 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/uniqush/log"
+)
+
+// Formats of log lines, for LogConfig.Format.
+const (
+	// LogFormatText writes log lines as text, e.g. "[Push] 2018/01/02 15:04:05 RequestID=... Service=... Success!".
+	LogFormatText = "text"
+	// LogFormatJSON writes each log line as a JSON object (see jsonLogger).
+	LogFormatJSON = "json"
+)
+
+// Destinations of log lines, for LogConfig.Sink.
+const (
+	LogSinkStderr = "stderr"
+	// LogSinkFile appends to LogConfig.File, rotating it once it is larger than LogConfig.MaxSize.
+	LogSinkFile = "file"
+	// LogSinkSyslog sends log lines to the local syslog daemon (not supported on Windows).
+	LogSinkSyslog = "syslog"
+)
+
+// LogConfig is a representation of the logging settings in the [default] section of uniqush.conf.
+type LogConfig struct {
+	Format string
+	Sink   string
+	// File is the log file of LogSinkFile.
+	File string
+	// MaxSize is the size in bytes above which the log file is rotated. 0 disables rotation (e.g. when using logrotate).
+	MaxSize int64
+	// MaxBackups is the number of rotated log files kept, named File.1 (the newest) to File.<MaxBackups>.
+	MaxBackups int
+	// SyslogTag is the tag of the log lines sent to syslog.
+	SyslogTag string
+}
+
+const (
+	defaultLogMaxBackups = 5
+	defaultSyslogTag     = "uniqush-push"
+)
+
+// openLogSink returns the writer which every logger writes to.
+func openLogSink(c LogConfig) (io.Writer, error) {
+	switch c.Sink {
+	case LogSinkFile:
+		return openRotatingFile(c.File, c.MaxSize, c.MaxBackups)
+	case LogSinkSyslog:
+		return openSyslog(c.SyslogTag)
+	default:
+		return os.Stderr, nil
+	}
+}
+
+// logFieldNames maps the keys of the Key=Value pairs which log messages start with to the fields of JSON log lines.
+var logFieldNames = map[string]string{
+	"RequestID":           "request_id",
+	"From":                "from",
+	"Service":             "service",
+	"PushServiceProvider": "provider",
+	"DeliveryPoint":       "delivery_point",
+	"JobID":               "job_id",
+}
+
+// jsonLogger is a log.Logger which writes each log line as a JSON object, e.g.
+// {"time":"...","level":"info","logger":"Push","msg":"...","request_id":"...","service":"...","subscriber_hash":"...","provider":"...","latency_seconds":0.01}
+// The fields are taken from the Key=Value pairs of the message. Subscribers are replaced with a hash (in the message too), so that logs can be correlated without identifying users.
+type jsonLogger struct {
+	w     io.Writer
+	name  string
+	level int32
+	// mutex serializes writes, so that concurrent log lines aren't interleaved.
+	mutex *sync.Mutex
+}
+
+var _ log.Logger = &jsonLogger{}
+
+// jsonLoggerMutexes has a mutex for each writer which JSON loggers share.
+var jsonLoggerMutexes = struct {
+	sync.Mutex
+	byWriter map[io.Writer]*sync.Mutex
+}{byWriter: make(map[io.Writer]*sync.Mutex)}
+
+func newJSONLogger(w io.Writer, name string, level int) *jsonLogger {
+	jsonLoggerMutexes.Lock()
+	mutex, ok := jsonLoggerMutexes.byWriter[w]
+	if !ok {
+		mutex = new(sync.Mutex)
+		jsonLoggerMutexes.byWriter[w] = mutex
+	}
+	jsonLoggerMutexes.Unlock()
+	return &jsonLogger{w: w, name: name, level: int32(level), mutex: mutex}
+}
+
+// SetLogLevel changes the level of the logger. It is safe to call while the logger is used, e.g. from /loglevel.
+func (l *jsonLogger) SetLogLevel(level int) {
+	atomic.StoreInt32(&l.level, int32(level))
+}
+
+var logLevelNames = map[int]string{
+	log.LOGLEVEL_FATAL:  "fatal",
+	log.LOGLEVEL_ALERT:  "alert",
+	log.LOGLEVEL_ERROR:  "error",
+	log.LOGLEVEL_WARN:   "warn",
+	log.LOGLEVEL_CONFIG: "config",
+	log.LOGLEVEL_INFO:   "info",
+	log.LOGLEVEL_DEBUG:  "debug",
+}
+
+func (l *jsonLogger) log(level int, msg string) {
+	if int32(level) > atomic.LoadInt32(&l.level) {
+		return
+	}
+	line := map[string]interface{}{
+		"time":   time.Now().UTC().Format(time.RFC3339Nano),
+		"level":  logLevelNames[level],
+		"logger": l.name,
+	}
+	line["msg"] = parseLogFields(msg, line)
+	data, err := json.Marshal(line)
+	if err != nil {
+		return
+	}
+	data = append(data, '\n')
+	l.mutex.Lock()
+	l.w.Write(data)
+	l.mutex.Unlock()
+}
+
+// parseLogFields adds the fields of the Key=Value pairs of msg to line, and returns msg with subscribers replaced by their hashes.
+func parseLogFields(msg string, line map[string]interface{}) string {
+	var out strings.Builder
+	rest := msg
+	for len(rest) > 0 {
+		word := rest
+		if i := strings.IndexByte(rest, ' '); i >= 0 {
+			word = rest[:i]
+		}
+		eq := strings.IndexByte(word, '=')
+		if eq <= 0 || !isLogFieldKey(word[:eq]) {
+			out.WriteString(word)
+			rest = rest[len(word):]
+			if len(rest) > 0 {
+				out.WriteByte(' ')
+				rest = rest[1:]
+			}
+			continue
+		}
+		key := word[:eq]
+		value, n := logFieldValue(rest[eq+1:])
+		rest = rest[eq+1+n:]
+		switch key {
+		case "Subscriber", "Subscribers":
+			value = hashSubscriber(value)
+			line["subscriber_hash"] = value
+		case "Latency":
+			if d, err := time.ParseDuration(value); err == nil {
+				line["latency_seconds"] = d.Seconds()
+			}
+		default:
+			if name, ok := logFieldNames[key]; ok {
+				line[name] = value
+			}
+		}
+		out.WriteString(key)
+		out.WriteByte('=')
+		out.WriteString(value)
+		if len(rest) > 0 {
+			out.WriteByte(' ')
+			rest = rest[1:]
+		}
+	}
+	return out.String()
+}
+
+// isLogFieldKey returns true if key is a key of a Key=Value pair, e.g. RequestID.
+func isLogFieldKey(key string) bool {
+	for _, c := range key {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z') {
+			return false
+		}
+	}
+	return true
+}
+
+// logFieldValue returns the value at the start of s and its length in s. Values end at a space, unless they are quoted or in brackets (e.g. lists of subscribers).
+func logFieldValue(s string) (string, int) {
+	if len(s) > 0 && (s[0] == '"' || s[0] == '[') {
+		end := byte('"')
+		if s[0] == '[' {
+			end = ']'
+		}
+		for i := 1; i < len(s); i++ {
+			if s[i] == '\\' {
+				i++
+			} else if s[i] == end {
+				return s[:i+1], i + 1
+			}
+		}
+	}
+	if i := strings.IndexByte(s, ' '); i >= 0 {
+		return s[:i], i
+	}
+	return s, len(s)
+}
+
+// hashSubscriber returns the first 16 hex digits of the SHA-256 hash of a subscriber (or list of subscribers), which identifies it in logs without revealing it.
+func hashSubscriber(subscriber string) string {
+	sum := sha256.Sum256([]byte(subscriber))
+	return hex.EncodeToString(sum[:8])
+}
+
+func (l *jsonLogger) Fatal(v ...interface{}) {
+	l.log(log.LOGLEVEL_FATAL, fmt.Sprint(v...))
+}
+
+func (l *jsonLogger) Fatalf(f string, v ...interface{}) {
+	l.log(log.LOGLEVEL_FATAL, fmt.Sprintf(f, v...))
+}
+
+func (l *jsonLogger) Alert(v ...interface{}) {
+	l.log(log.LOGLEVEL_ALERT, fmt.Sprint(v...))
+}
+
+func (l *jsonLogger) Alertf(f string, v ...interface{}) {
+	l.log(log.LOGLEVEL_ALERT, fmt.Sprintf(f, v...))
+}
+
+func (l *jsonLogger) Error(v ...interface{}) {
+	l.log(log.LOGLEVEL_ERROR, fmt.Sprint(v...))
+}
+
+func (l *jsonLogger) Errorf(f string, v ...interface{}) {
+	l.log(log.LOGLEVEL_ERROR, fmt.Sprintf(f, v...))
+}
+
+func (l *jsonLogger) Warn(v ...interface{}) {
+	l.log(log.LOGLEVEL_WARN, fmt.Sprint(v...))
+}
+
+func (l *jsonLogger) Warnf(f string, v ...interface{}) {
+	l.log(log.LOGLEVEL_WARN, fmt.Sprintf(f, v...))
+}
+
+func (l *jsonLogger) Config(v ...interface{}) {
+	l.log(log.LOGLEVEL_CONFIG, fmt.Sprint(v...))
+}
+
+func (l *jsonLogger) Configf(f string, v ...interface{}) {
+	l.log(log.LOGLEVEL_CONFIG, fmt.Sprintf(f, v...))
+}
+
+func (l *jsonLogger) Info(v ...interface{}) {
+	l.log(log.LOGLEVEL_INFO, fmt.Sprint(v...))
+}
+
+func (l *jsonLogger) Infof(f string, v ...interface{}) {
+	l.log(log.LOGLEVEL_INFO, fmt.Sprintf(f, v...))
+}
+
+func (l *jsonLogger) Debug(v ...interface{}) {
+	l.log(log.LOGLEVEL_DEBUG, fmt.Sprint(v...))
+}
+
+func (l *jsonLogger) Debugf(f string, v ...interface{}) {
+	l.log(log.LOGLEVEL_DEBUG, fmt.Sprintf(f, v...))
+}
+
+// rotatingFile appends to a log file, and renames it to name.1 (and older files to name.2, etc.) once it is larger than maxSize.
+type rotatingFile struct {
+	mutex      sync.Mutex
+	name       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+func openRotatingFile(name string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	f := &rotatingFile{name: name, maxSize: maxSize, maxBackups: maxBackups}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotate renames the log files and opens a new one. f.mutex must be locked.
+func (f *rotatingFile) rotate() error {
+	f.file.Close()
+	if f.maxBackups > 0 {
+		os.Remove(fmt.Sprintf("%s.%d", f.name, f.maxBackups))
+		for i := f.maxBackups - 1; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", f.name, i), fmt.Sprintf("%s.%d", f.name, i+1))
+		}
+		os.Rename(f.name, f.name+".1")
+	} else {
+		os.Remove(f.name)
+	}
+	return f.open()
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/uniqush/log"
+	"github.com/uniqush/uniqush-push/testutil"
+)
+
+func TestJSONLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := newJSONLogger(&buf, "Push", log.LOGLEVEL_INFO)
+	logger.Debugf("RequestID=%v Hidden", "r0")
+	logger.Infof("RequestID=%v Service=%v Subscriber=%v PushServiceProvider=%v Latency=%v Success!", "r1", "srv", "alice", "psp1", "1.5s")
+
+	var line map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("Expected one JSON log line, got %q: %v", buf.String(), err)
+	}
+	hash := hashSubscriber("alice")
+	testutil.ExpectEquals(t, "info", line["level"], "unexpected level")
+	testutil.ExpectEquals(t, "Push", line["logger"], "unexpected logger")
+	testutil.ExpectEquals(t, "r1", line["request_id"], "unexpected request id")
+	testutil.ExpectEquals(t, "srv", line["service"], "unexpected service")
+	testutil.ExpectEquals(t, hash, line["subscriber_hash"], "unexpected subscriber hash")
+	testutil.ExpectEquals(t, "psp1", line["provider"], "unexpected provider")
+	testutil.ExpectEquals(t, 1.5, line["latency_seconds"], "unexpected latency")
+	testutil.ExpectEquals(t, "RequestID=r1 Service=srv Subscriber="+hash+" PushServiceProvider=psp1 Latency=1.5s Success!", line["msg"], "expected the subscriber to be hashed in the message")
+}
+
+func TestParseLogFieldsWithListsAndQuotes(t *testing.T) {
+	line := map[string]interface{}{}
+	msg := parseLogFields(`RequestID=r1 Subscribers="[a b]" Failed: error=bad`, line)
+	hash := hashSubscriber(`"[a b]"`)
+	testutil.ExpectStringEquals(t, `RequestID=r1 Subscribers=`+hash+` Failed: error=bad`, msg, "unexpected message")
+	testutil.ExpectEquals(t, hash, line["subscriber_hash"], "expected the quoted list of subscribers to be hashed as a whole")
+}
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "uniqush-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "uniqush.log")
+	f, err := openRotatingFile(name, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	read := func(name string) string {
+		data, _ := ioutil.ReadFile(name)
+		return string(data)
+	}
+	testutil.ExpectStringEquals(t, "fourth\n", read(name), "unexpected current log file")
+	testutil.ExpectStringEquals(t, "third\n", read(name+".1"), "unexpected newest backup")
+	testutil.ExpectStringEquals(t, "second\n", read(name+".2"), "unexpected oldest backup")
+	if _, err := os.Stat(name + ".3"); !os.IsNotExist(err) {
+		t.Errorf("Expected at most 2 backups, got %v", err)
+	}
+}
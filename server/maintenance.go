@@ -0,0 +1,365 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/uniqush/log"
+	"github.com/uniqush/uniqush-push/db"
+	"github.com/uniqush/uniqush-push/tracing"
+)
+
+// Paths of the admin listener which show maintenance mode, and turn it on and off.
+const (
+	QueryMaintenanceURL   = "/maintenance"
+	EnableMaintenanceURL  = "/enablemaintenance"
+	DisableMaintenanceURL = "/disablemaintenance"
+)
+
+const (
+	// maintenanceRefreshInterval is how often each instance checks whether maintenance mode was turned on or off by another instance.
+	maintenanceRefreshInterval = 5 * time.Second
+	// maintenanceDrainBatchSize is the number of held pushes sent at the same time once maintenance mode is turned off.
+	maintenanceDrainBatchSize = 50
+	// maintenanceClaimTimeout is how long a held push can be sent for before it is assumed that the instance sending it crashed, and it is held again.
+	maintenanceClaimTimeout = 10 * time.Minute
+)
+
+// MaintenanceState describes maintenance mode, which is shared by the instances using the same database.
+type MaintenanceState struct {
+	// Services are the services whose pushes are held. If empty, the pushes of every service are held.
+	Services []string `json:"services,omitempty"`
+	Reason   string   `json:"reason,omitempty"`
+	// Since is the unix timestamp when maintenance mode was turned on.
+	Since int64 `json:"since"`
+}
+
+// holds returns true if the pushes of service are held.
+func (s *MaintenanceState) holds(service string) bool {
+	if len(s.Services) == 0 {
+		return true
+	}
+	for _, held := range s.Services {
+		if held == service {
+			return true
+		}
+	}
+	return false
+}
+
+// heldPush is a push request which was accepted during maintenance mode, saved to be sent once it's over.
+type heldPush struct {
+	RequestID string              `json:"requestId"`
+	From      string              `json:"from"`
+	Service   string              `json:"service"`
+	Params    map[string]string   `json:"params"`
+	PerDP     map[string][]string `json:"perdp,omitempty"`
+	// Held is the unix timestamp when the push was held.
+	Held int64 `json:"held"`
+}
+
+// maintenanceMode holds the pushes of some services (e.g. while the credentials of their push service providers are being replaced) in the database,
+// instead of sending them, and sends them once maintenance mode is turned off.
+// Held pushes are only removed from the database once they are sent, so a push being sent when an instance crashes is held again after maintenanceClaimTimeout,
+// and may be sent twice.
+type maintenanceMode struct {
+	db     db.PushDatabase
+	logger log.Logger
+	// replay sends a held push. It returns false if the push can't be sent now (e.g. this instance is stopping), to hold it again.
+	replay func(*heldPush) bool
+
+	mutex    sync.Mutex
+	state    *MaintenanceState
+	draining bool
+	stopChan chan struct{}
+}
+
+func newMaintenanceMode(database db.PushDatabase, logger log.Logger) *maintenanceMode {
+	return &maintenanceMode{
+		db:       database,
+		logger:   logger,
+		stopChan: make(chan struct{}),
+	}
+}
+
+// Run loads maintenance mode, then reloads it every refresh interval (to apply changes made by other instances) until Stop is called.
+// Pushes held by stopped instances are sent once maintenance mode is off.
+func (m *maintenanceMode) Run() {
+	m.refresh()
+	go func() {
+		ticker := time.NewTicker(maintenanceRefreshInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-m.stopChan:
+				return
+			case <-ticker.C:
+				m.refresh()
+			}
+		}
+	}()
+}
+
+// Stop stops reloading maintenance mode. Pushes being sent from the queue stop after the current batch.
+func (m *maintenanceMode) Stop() {
+	if m == nil {
+		return
+	}
+	close(m.stopChan)
+}
+
+func (m *maintenanceMode) refresh() {
+	data, err := m.db.GetMaintenance()
+	if err != nil {
+		m.logger.Errorf("Cannot load maintenance mode: %v", err)
+		return
+	}
+	var state *MaintenanceState
+	if data != nil {
+		state = new(MaintenanceState)
+		if err := json.Unmarshal(data, state); err != nil {
+			m.logger.Errorf("Invalid maintenance mode: %v", err)
+			return
+		}
+	}
+	m.mutex.Lock()
+	m.state = state
+	m.mutex.Unlock()
+	if state == nil {
+		m.startDraining()
+	}
+}
+
+// State returns maintenance mode, or nil if it is off.
+func (m *maintenanceMode) State() *MaintenanceState {
+	if m == nil {
+		return nil
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.state
+}
+
+// Holds returns true if the pushes of service should be held instead of sent.
+func (m *maintenanceMode) Holds(service string) bool {
+	state := m.State()
+	return state != nil && state.holds(service)
+}
+
+// Enable turns maintenance mode on for services (or every service if it is empty), for every instance sharing the database.
+func (m *maintenanceMode) Enable(services []string, reason string) (*MaintenanceState, error) {
+	state := &MaintenanceState{Services: services, Reason: reason, Since: time.Now().Unix()}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.db.SetMaintenance(data); err != nil {
+		return nil, err
+	}
+	m.mutex.Lock()
+	m.state = state
+	m.mutex.Unlock()
+	m.logger.Infof("[Maintenance] Enabled Services=%q Reason=%q", services, reason)
+	return state, nil
+}
+
+// Disable turns maintenance mode off, and starts sending the held pushes.
+func (m *maintenanceMode) Disable() error {
+	if err := m.db.SetMaintenance(nil); err != nil {
+		return err
+	}
+	m.mutex.Lock()
+	m.state = nil
+	m.mutex.Unlock()
+	m.logger.Infof("[Maintenance] Disabled")
+	m.startDraining()
+	return nil
+}
+
+// Hold saves a push to send once maintenance mode is off.
+func (m *maintenanceMode) Hold(push *heldPush) error {
+	data, err := json.Marshal(push)
+	if err != nil {
+		return err
+	}
+	return m.db.HoldPush(data)
+}
+
+func (m *maintenanceMode) startDraining() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.draining || m.replay == nil {
+		return
+	}
+	m.draining = true
+	go m.drain()
+}
+
+// drain sends the held pushes in batches, until there are none left or maintenance mode is turned on again.
+// Other instances may drain the queue at the same time. Pushes which weren't sent because maintenance mode was turned on again during a batch are held again.
+func (m *maintenanceMode) drain() {
+	defer func() {
+		m.mutex.Lock()
+		m.draining = false
+		m.mutex.Unlock()
+	}()
+	sent := 0
+	for m.State() == nil {
+		select {
+		case <-m.stopChan:
+			return
+		default:
+		}
+		batch, err := m.db.ClaimHeldPushes(maintenanceDrainBatchSize, maintenanceClaimTimeout)
+		if err != nil {
+			m.logger.Errorf("Cannot load held pushes: %v", err)
+			return
+		}
+		if len(batch) == 0 {
+			break
+		}
+		var wg sync.WaitGroup
+		var unsent int32
+		for _, data := range batch {
+			data := data
+			push := new(heldPush)
+			if err := json.Unmarshal(data, push); err != nil {
+				m.logger.Errorf("Invalid held push: %v", err)
+				m.ack(data)
+				continue
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if !m.replay(push) {
+					atomic.AddInt32(&unsent, 1)
+					if err := m.db.HoldPush(data); err != nil {
+						// Left to be held again once maintenanceClaimTimeout passed.
+						m.logger.Errorf("RequestID=%v Service=%v Cannot hold push again: %v", push.RequestID, push.Service, err)
+						return
+					}
+				}
+				m.ack(data)
+			}()
+		}
+		wg.Wait()
+		if unsent > 0 {
+			// Held again to be sent by another instance, or after a restart.
+			return
+		}
+		sent += len(batch)
+	}
+	if sent > 0 {
+		m.logger.Infof("[Maintenance] Sent %d held pushes", sent)
+	}
+}
+
+// ack removes a held push which was sent (or held again) from the pushes being sent.
+func (m *maintenanceMode) ack(data []byte) {
+	if err := m.db.AckHeldPush(data); err != nil {
+		// It will be held again once maintenanceClaimTimeout passed, and sent twice.
+		m.logger.Errorf("Cannot remove sent held push: %v", err)
+	}
+}
+
+// holdPush saves a push request (with the parameters it had before they were parsed) instead of sending it, because its service is in maintenance mode.
+func (api *RestAPI) holdPush(reqID, remoteAddr, service string, params map[string]string, perdp map[string][]string, logger log.Logger, handler APIResponseHandler) {
+	push := &heldPush{RequestID: reqID, From: remoteAddr, Service: service, Params: params, PerDP: perdp, Held: time.Now().Unix()}
+	if err := api.backend.maintenance.Hold(push); err != nil {
+		logger.Errorf("RequestID=%v From=%v Service=%v Cannot hold push during maintenance: %v", reqID, remoteAddr, service, err)
+		handler.AddDetailsToHandler(APIResponseDetails{RequestID: &reqID, From: &remoteAddr, Service: &service, Code: UNIQUSH_ERROR_DATABASE, ErrorMsg: strPtrOfErr(err)})
+		return
+	}
+	logger.Infof("RequestID=%v From=%v Service=%v HeldForMaintenance", reqID, remoteAddr, service)
+	handler.AddDetailsToHandler(APIResponseDetails{RequestID: &reqID, From: &remoteAddr, Service: &service, Code: UNIQUSH_PUSH_HELD})
+}
+
+// replayHeldPush sends a push which was held during maintenance mode, as if it was sent to /push again.
+// Returns false if this instance is stopping, or if maintenance mode was turned on again for the service of the push, to hold it again.
+func (api *RestAPI) replayHeldPush(push *heldPush) bool {
+	if api.backend.maintenance.Holds(push.Service) {
+		return false
+	}
+	if !api.beginRequest() {
+		return false
+	}
+	defer api.endRequest()
+	logger := api.loggers[LoggerPush]
+	handler := api.backend.history.Wrap(newPushResponseHandler(logger))
+	ctx, span := tracing.Start(context.Background(), "maintenance", tracing.KindInternal)
+	defer span.Finish()
+	logger.Infof("RequestID=%v From=%v Service=%v HeldFor=%v Sending held push", push.RequestID, push.From, push.Service, time.Since(time.Unix(push.Held, 0)))
+	api.pushNotification(ctx, push.RequestID, push.Params, push.PerDP, logger, push.From, handler)
+	return true
+}
+
+// serveMaintenance handles QueryMaintenanceURL, EnableMaintenanceURL and DisableMaintenanceURL.
+// /enablemaintenance takes the comma separated services to hold the pushes of (every service by default), and the reason to show.
+func (m *maintenanceMode) serveMaintenance(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != QueryMaintenanceURL && r.Method != "POST" {
+		http.Error(w, "Maintenance mode must be changed with POST", http.StatusMethodNotAllowed)
+		return
+	}
+	switch r.URL.Path {
+	case EnableMaintenanceURL:
+		var services []string
+		for _, service := range strings.Split(r.FormValue("service"), ",") {
+			service = strings.TrimSpace(service)
+			if service == "" {
+				continue
+			}
+			if err := validateService(service); err != nil {
+				http.Error(w, fmt.Sprintf("Invalid service %q: %v", service, err), http.StatusBadRequest)
+				return
+			}
+			services = append(services, service)
+		}
+		if _, err := m.Enable(services, r.FormValue("reason")); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to enable maintenance mode: %v", err), http.StatusInternalServerError)
+			return
+		}
+	case DisableMaintenanceURL:
+		if err := m.Disable(); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to disable maintenance mode: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+	type responseType struct {
+		Enabled bool `json:"enabled"`
+		*MaintenanceState
+		// Held is the number of pushes waiting to be sent.
+		Held int64 `json:"held"`
+	}
+	state := m.State()
+	resp := responseType{Enabled: state != nil, MaintenanceState: state}
+	held, err := m.db.CountHeldPushes()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to count held pushes: %v", err), http.StatusInternalServerError)
+		return
+	}
+	resp.Held = held
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,218 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/uniqush/log"
+	"github.com/uniqush/uniqush-push/db"
+	"github.com/uniqush/uniqush-push/testutil"
+)
+
+// maintenanceDatabase keeps maintenance mode, the held pushes and the time when the pushes being sent were claimed in memory. Other methods aren't implemented.
+type maintenanceDatabase struct {
+	db.PushDatabase
+	mutex       sync.Mutex
+	maintenance []byte
+	held        [][]byte
+	sending     map[string]time.Time
+}
+
+func (d *maintenanceDatabase) SetMaintenance(data []byte) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.maintenance = data
+	return nil
+}
+
+func (d *maintenanceDatabase) GetMaintenance() ([]byte, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.maintenance, nil
+}
+
+func (d *maintenanceDatabase) HoldPush(data []byte) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.held = append(d.held, data)
+	return nil
+}
+
+func (d *maintenanceDatabase) ClaimHeldPushes(count int64, timeout time.Duration) ([][]byte, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.sending == nil {
+		d.sending = make(map[string]time.Time)
+	}
+	for data, claimed := range d.sending {
+		if time.Since(claimed) > timeout {
+			d.held = append([][]byte{[]byte(data)}, d.held...)
+			delete(d.sending, data)
+		}
+	}
+	if int64(len(d.held)) < count {
+		count = int64(len(d.held))
+	}
+	claimed := d.held[:count]
+	d.held = d.held[count:]
+	for _, data := range claimed {
+		d.sending[string(data)] = time.Now()
+	}
+	return claimed, nil
+}
+
+func (d *maintenanceDatabase) AckHeldPush(data []byte) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	delete(d.sending, string(data))
+	return nil
+}
+
+func (d *maintenanceDatabase) Ping() error {
+	return nil
+}
+
+func (d *maintenanceDatabase) CountHeldPushes() (int64, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return int64(len(d.held) + len(d.sending)), nil
+}
+
+func TestMaintenanceMode(t *testing.T) {
+	database := &maintenanceDatabase{}
+	m := newMaintenanceMode(database, log.NewLogger(ioutil.Discard, "", log.LOGLEVEL_SILENT))
+	var mutex sync.Mutex
+	var sent []string
+	m.replay = func(push *heldPush) bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		sent = append(sent, push.RequestID)
+		return true
+	}
+	testutil.ExpectEquals(t, false, m.Holds("svc"), "expected pushes not to be held before maintenance mode is enabled")
+
+	if _, err := m.Enable([]string{"svc"}, "rotating certificates"); err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectEquals(t, true, m.Holds("svc"), "expected the pushes of the service in maintenance to be held")
+	testutil.ExpectEquals(t, false, m.Holds("other"), "expected the pushes of other services to be sent")
+	for _, id := range []string{"1", "2", "3"} {
+		if err := m.Hold(&heldPush{RequestID: id, Service: "svc"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	other := newMaintenanceMode(database, log.NewLogger(ioutil.Discard, "", log.LOGLEVEL_SILENT))
+	other.refresh()
+	testutil.ExpectEquals(t, true, other.Holds("svc"), "expected maintenance mode to be shared by instances using the same database")
+
+	if err := m.Disable(); err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectEquals(t, false, m.Holds("svc"), "expected pushes not to be held after maintenance mode is disabled")
+	if !waitUntil(time.Now().Add(time.Second), func() bool {
+		n, _ := database.CountHeldPushes()
+		m.mutex.Lock()
+		defer m.mutex.Unlock()
+		return n == 0 && !m.draining
+	}) {
+		t.Fatal("expected the held pushes to be sent")
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	testutil.ExpectEquals(t, 3, len(sent), "expected every held push to be sent")
+}
+
+func TestMaintenanceModeHoldsAgainWhenStopping(t *testing.T) {
+	database := &maintenanceDatabase{}
+	m := newMaintenanceMode(database, log.NewLogger(ioutil.Discard, "", log.LOGLEVEL_SILENT))
+	m.replay = func(push *heldPush) bool { return false }
+	m.Hold(&heldPush{RequestID: "1", Service: "svc"})
+	m.drain()
+	n, _ := database.CountHeldPushes()
+	testutil.ExpectEquals(t, int64(1), n, "expected a push which couldn't be sent to be held again")
+	testutil.ExpectEquals(t, 1, len(database.held), "expected the push to be back in the queue")
+	testutil.ExpectEquals(t, 0, len(database.sending), "expected the push not to be left as being sent")
+}
+
+func TestMaintenanceModeResendsPushesOfCrashedInstances(t *testing.T) {
+	database := &maintenanceDatabase{}
+	m := newMaintenanceMode(database, log.NewLogger(ioutil.Discard, "", log.LOGLEVEL_SILENT))
+	var sent []string
+	m.replay = func(push *heldPush) bool {
+		sent = append(sent, push.RequestID)
+		return true
+	}
+	m.Hold(&heldPush{RequestID: "1", Service: "svc"})
+	m.Hold(&heldPush{RequestID: "2", Service: "svc"})
+
+	// An instance claims the first push, then crashes before sending it.
+	crashed, _ := database.ClaimHeldPushes(1, maintenanceClaimTimeout)
+	testutil.ExpectEquals(t, 1, len(crashed), "expected a push to be claimed")
+	m.drain()
+	testutil.ExpectEquals(t, []string{"2"}, sent, "expected a push being sent by another instance not to be sent again right away")
+	n, _ := database.CountHeldPushes()
+	testutil.ExpectEquals(t, int64(1), n, "expected a push which is being sent to stay held until it is sent")
+
+	database.sending[string(crashed[0])] = time.Now().Add(-maintenanceClaimTimeout - time.Second)
+	m.drain()
+	testutil.ExpectEquals(t, []string{"2", "1"}, sent, "expected the push of the crashed instance to be sent after the claim timeout")
+	n, _ = database.CountHeldPushes()
+	testutil.ExpectEquals(t, int64(0), n, "expected sent pushes to be removed")
+}
+
+func TestReplayHeldPushDuringMaintenance(t *testing.T) {
+	database := &maintenanceDatabase{}
+	api := newHealthTestAPI(database)
+	m := newMaintenanceMode(database, api.loggers[LoggerPush])
+	api.backend.maintenance = m
+	push := &heldPush{RequestID: "1", Service: "svc", Params: map[string]string{"service": "svc", "subscriber": "u1", "msg": "hello"}}
+	if _, err := m.Enable([]string{"svc"}, ""); err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectEquals(t, false, api.replayHeldPush(push), "expected a held push not to be sent while its service is in maintenance")
+	if err := m.Disable(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Maintenance mode is turned on again while this instance is sending the held pushes.
+	m.Hold(push)
+	m.replay = func(push *heldPush) bool {
+		m.Enable([]string{"svc"}, "")
+		return api.replayHeldPush(push)
+	}
+	m.drain()
+	testutil.ExpectEquals(t, 1, len(database.held), "expected the push to be held again")
+	testutil.ExpectEquals(t, 0, len(database.sending), "expected the push not to be left as being sent")
+	data, _ := json.Marshal(push)
+	testutil.ExpectStringEquals(t, string(data), string(database.held[0]), "expected the push to be held again as it was held the first time")
+}
+
+func TestHoldPushDuringMaintenance(t *testing.T) {
+	database := &maintenanceDatabase{}
+	api := newHealthTestAPI(database)
+	api.backend.maintenance = newMaintenanceMode(database, api.loggers[LoggerPush])
+	if _, err := api.backend.maintenance.Enable(nil, ""); err != nil {
+		t.Fatal(err)
+	}
+	handler := newPushResponseHandler(api.loggers[LoggerPush])
+	kv := map[string]string{"service": "svc", "subscriber": "u1", "msg": "hello", "uniqush.job_id": "job1"}
+	api.pushNotification(context.Background(), "rid", kv, nil, api.loggers[LoggerPush], "127.0.0.1", handler)
+	if !strings.Contains(string(handler.ToJSON()), UNIQUSH_PUSH_HELD) {
+		t.Errorf("expected the push to be held, got %s", handler.ToJSON())
+	}
+	testutil.ExpectEquals(t, 1, len(database.held), "expected the push to be saved")
+	testutil.ExpectStringEquals(t, `{"requestId":"rid","from":"127.0.0.1","service":"svc","params":{"msg":"hello","service":"svc","subscriber":"u1","uniqush.job_id":"job1"},"held":`,
+		string(database.held[0][:strings.Index(string(database.held[0]), `"held":`)+len(`"held":`)]), "expected the parameters of the push to be saved before being parsed")
+
+	status, body := serveHealth(api, ReadyzURL)
+	testutil.ExpectEquals(t, 200, status, "expected an instance holding pushes to stay ready")
+	if body["maintenance"] == nil {
+		t.Error("expected readiness to show maintenance mode")
+	}
+}
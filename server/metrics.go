@@ -0,0 +1,130 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"github.com/uniqush/uniqush-push/db"
+	"github.com/uniqush/uniqush-push/metrics"
+	"github.com/uniqush/uniqush-push/push"
+)
+
+var (
+	pushesTotal = metrics.DefaultRegistry.NewCounterVec("uniqush_pushes_total",
+		"Results of pushes to delivery points, by service, push service provider and result.", "service", "psp", "result")
+	pushServiceConnectionErrors = metrics.DefaultRegistry.NewCounterVec("uniqush_push_service_connection_errors_total",
+		"Errors connecting to push services, by push service type and push service provider.", "pushservicetype", "psp")
+	apiRequestDuration = metrics.DefaultRegistry.NewHistogramVec("uniqush_api_request_duration_seconds",
+		"Latency of REST API requests, by path.", metrics.DefaultBuckets, "path")
+)
+
+// pushResultLabel returns the result label of uniqush_pushes_total for the error of a push result (nil if it succeeded).
+func pushResultLabel(err push.Error) string {
+	switch err.(type) {
+	case nil:
+		return "success"
+	case *push.RetryError:
+		return "retry"
+	case *push.ConnectionError:
+		return "connection_error"
+	case *push.BadDeliveryPoint:
+		return "bad_delivery_point"
+	case *push.BadPushServiceProvider:
+		return "bad_push_service_provider"
+	case *push.BadNotification:
+		return "bad_notification"
+	case *push.UnsubscribeUpdate, *push.InvalidRegistrationUpdate:
+		return "unsubscribed"
+	case *push.DeliveryPointUpdate, *push.PushServiceProviderUpdate:
+		return "updated"
+	default:
+		return "error"
+	}
+}
+
+// recordPushResult counts the result of a push to a delivery point of service.
+func recordPushResult(service string, res *push.Result) {
+	pspName := getProviderNameOrUnknown(res.Provider)
+	pushesTotal.Inc(service, pspName, pushResultLabel(res.Err))
+	if _, ok := res.Err.(*push.ConnectionError); ok && res.Provider != nil {
+		pushServiceConnectionErrors.Inc(res.Provider.PushServiceName(), pspName)
+	}
+}
+
+// newBackendMetrics returns the metrics which are collected from backend when /metrics is requested: the depths of its queues and the counters of its caches.
+func newBackendMetrics(backend *PushBackEnd) *metrics.Registry {
+	r := metrics.NewRegistry()
+	r.NewGaugeFunc("uniqush_inflight_pushes", "Pushes (from /push and /broadcast) being sent.", nil, func() []metrics.Sample {
+		return []metrics.Sample{{Value: float64(backend.QueueDepths().InflightPushes)}}
+	})
+	r.NewGaugeFunc("uniqush_queued_delivery_records", "Delivery records waiting to be saved.", nil, func() []metrics.Sample {
+		return []metrics.Sample{{Value: float64(backend.QueueDepths().QueuedDeliveryRecords)}}
+	})
+
+	r.NewGaugeFunc("uniqush_psp_error_rate", "Fraction of the pushes to each push service provider during the [SLO] window which failed because of the push service provider.", []string{"push_service_provider"}, func() []metrics.Sample {
+		var samples []metrics.Sample
+		for _, rate := range backend.slo.Rates() {
+			samples = append(samples, metrics.Sample{LabelValues: []string{rate.PushServiceProvider}, Value: rate.ErrorRate})
+		}
+		return samples
+	})
+	r.NewGaugeFunc("uniqush_canary_success", "1 if the last canary push through each push service provider was accepted, 0 if it failed (see [Canary]).", []string{"service", "push_service_provider"}, func() []metrics.Sample {
+		var samples []metrics.Sample
+		for _, status := range backend.canary.Statuses("") {
+			switch status.Status {
+			case CanaryOK:
+				samples = append(samples, metrics.Sample{LabelValues: []string{status.Service, status.PushServiceProvider}, Value: 1})
+			case CanaryFailed:
+				samples = append(samples, metrics.Sample{LabelValues: []string{status.Service, status.PushServiceProvider}, Value: 0})
+			}
+		}
+		return samples
+	})
+
+	cacheSamples := func(value func(stats db.CacheStats) float64) func() []metrics.Sample {
+		return func() []metrics.Sample {
+			var samples []metrics.Sample
+			for _, stats := range backend.db.CacheStats(0) {
+				samples = append(samples, metrics.Sample{LabelValues: []string{stats.Name}, Value: value(stats)})
+			}
+			return samples
+		}
+	}
+	cacheLabels := []string{"cache"}
+	r.NewCounterFunc("uniqush_cache_hits_total", "Hits of the in-memory caches.", cacheLabels, cacheSamples(func(stats db.CacheStats) float64 {
+		return float64(stats.Hits)
+	}))
+	r.NewCounterFunc("uniqush_cache_misses_total", "Misses of the in-memory caches.", cacheLabels, cacheSamples(func(stats db.CacheStats) float64 {
+		return float64(stats.Misses)
+	}))
+	r.NewCounterFunc("uniqush_cache_evictions_total", "Entries evicted from the in-memory caches to stay within their limits.", cacheLabels, cacheSamples(func(stats db.CacheStats) float64 {
+		return float64(stats.Evictions)
+	}))
+	r.NewGaugeFunc("uniqush_cache_hit_ratio", "Fraction of the lookups of the in-memory caches which were hits, since uniqush-push started.", cacheLabels, cacheSamples(func(stats db.CacheStats) float64 {
+		if stats.Hits+stats.Misses == 0 {
+			return 0
+		}
+		return float64(stats.Hits) / float64(stats.Hits+stats.Misses)
+	}))
+	r.NewGaugeFunc("uniqush_cache_entries", "Entries in the in-memory caches.", cacheLabels, cacheSamples(func(stats db.CacheStats) float64 {
+		return float64(stats.Entries)
+	}))
+	r.NewGaugeFunc("uniqush_cache_memory_bytes", "Estimated memory used by the in-memory caches.", cacheLabels, cacheSamples(func(stats db.CacheStats) float64 {
+		return float64(stats.MemoryBytes)
+	}))
+	return r
+}
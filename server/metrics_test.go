@@ -0,0 +1,16 @@
+package server
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/uniqush/uniqush-push/push"
+	"github.com/uniqush/uniqush-push/testutil"
+)
+
+func TestPushResultLabel(t *testing.T) {
+	testutil.ExpectStringEquals(t, "success", pushResultLabel(nil), "unexpected label of successful pushes")
+	testutil.ExpectStringEquals(t, "connection_error", pushResultLabel(push.NewConnectionError(errors.New("refused"))), "unexpected label of connection errors")
+	testutil.ExpectStringEquals(t, "bad_notification", pushResultLabel(push.NewBadNotificationWithDetails("too large")), "unexpected label of bad notifications")
+	testutil.ExpectStringEquals(t, "error", pushResultLabel(push.NewError("unknown")), "unexpected label of other errors")
+}
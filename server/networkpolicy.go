@@ -0,0 +1,118 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// endpointClassPublic is the class of the endpoints in publicAPIPaths. The other classes are the scopes of API keys.
+const endpointClassPublic = "public"
+
+// endpointClasses are the keys of the [NetworkPolicy] section.
+var endpointClasses = []string{endpointClassPublic, APIKeyScopePush, APIKeyScopeSubscribe, APIKeyScopeViewer, APIKeyScopeOperator, APIKeyScopeAdmin}
+
+// endpointClass returns the class of an endpoint: "public" for publicAPIPaths, otherwise the first scope of API keys allowing it
+// (e.g. "push" for /push and /broadcast, "subscribe" for /subscribe, and "admin" for /addpsp and endpoints which aren't in apiKeyScopes).
+func endpointClass(path string) string {
+	if publicAPIPaths[path] {
+		return endpointClassPublic
+	}
+	if scopes, ok := apiKeyScopes[path]; ok {
+		return scopes[0]
+	}
+	return APIKeyScopeAdmin
+}
+
+// NetworkPolicyConfig is a representation of the settings in the [NetworkPolicy] section of uniqush.conf.
+type NetworkPolicyConfig struct {
+	// AllowedNetworks are the networks which can request the endpoints of each class. Classes which aren't in AllowedNetworks can be requested from any address.
+	AllowedNetworks map[string][]*net.IPNet
+}
+
+// parseAllowedNetworks parses a comma separated list of CIDRs (e.g. "10.0.0.0/8,192.168.1.0/24") or addresses (which are single address networks).
+func parseAllowedNetworks(s string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, cidr := range strings.Split(s, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", cidr)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// networkPolicy rejects requests to endpoints from addresses outside of the networks allowed for their class.
+type networkPolicy struct {
+	allowed map[string][]*net.IPNet
+}
+
+// newNetworkPolicy returns nil if no class is restricted.
+func newNetworkPolicy(conf NetworkPolicyConfig) *networkPolicy {
+	if len(conf.AllowedNetworks) == 0 {
+		return nil
+	}
+	return &networkPolicy{allowed: conf.AllowedNetworks}
+}
+
+// allows returns nil if remoteAddr (the host:port of a request) can request path.
+// Clients of unix sockets are on the same host, and are controlled by the permissions of the socket (socket_mode in [WebFrontend]) instead.
+func (p *networkPolicy) allows(path, remoteAddr string) error {
+	if p == nil || isUnixSocketAddr(remoteAddr) {
+		return nil
+	}
+	class := endpointClass(path)
+	networks, ok := p.allowed[class]
+	if !ok {
+		return nil
+	}
+	if remoteAddr == "" {
+		return fmt.Errorf("requests without a remote address are not allowed to request %s endpoints", class)
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		for _, network := range networks {
+			if network.Contains(ip) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("%s is not allowed to request %s endpoints", host, class)
+}
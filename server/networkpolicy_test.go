@@ -0,0 +1,65 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/uniqush/uniqush-push/testutil"
+)
+
+func TestEndpointClass(t *testing.T) {
+	testutil.ExpectStringEquals(t, "public", endpointClass(HealthzURL), "expected health checks to be public")
+	testutil.ExpectStringEquals(t, "push", endpointClass(BroadcastURL), "expected the first scope of the endpoint")
+	testutil.ExpectStringEquals(t, "subscribe", endpointClass(AddDeliveryPointToServiceURL), "expected the scope of the endpoint")
+	testutil.ExpectStringEquals(t, "viewer", endpointClass(MetricsURL), "expected the scope of the endpoint")
+	testutil.ExpectStringEquals(t, "admin", endpointClass(AddPushServiceProviderToServiceURL), "expected unlisted endpoints to be admin endpoints")
+}
+
+func TestParseAllowedNetworks(t *testing.T) {
+	networks, err := parseAllowedNetworks("10.0.0.0/8, 192.168.1.7,::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectEquals(t, 3, len(networks), "expected every network")
+	testutil.ExpectEquals(t, true, networks[1].Contains(net.ParseIP("192.168.1.7")), "expected addresses to be single address networks")
+	testutil.ExpectEquals(t, false, networks[1].Contains(net.ParseIP("192.168.1.8")), "expected addresses to be single address networks")
+	for _, invalid := range []string{"10.0.0.0/33", "example.com"} {
+		if _, err := parseAllowedNetworks(invalid); err == nil {
+			t.Errorf("expected %q to be invalid", invalid)
+		}
+	}
+}
+
+func TestNetworkPolicy(t *testing.T) {
+	push, _ := parseAllowedNetworks("10.0.0.0/16")
+	admin, _ := parseAllowedNetworks("10.1.0.0/24")
+	api := newHealthTestAPI(nil)
+	api.backend.network = newNetworkPolicy(NetworkPolicyConfig{AllowedNetworks: map[string][]*net.IPNet{"push": push, "admin": admin}})
+	serve := func(path, remoteAddr string) int {
+		r := httptest.NewRequest("GET", path, nil)
+		r.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, r)
+		return w.Code
+	}
+	testutil.ExpectEquals(t, http.StatusForbidden, serve(PushNotificationURL, "192.168.1.7:4000"), "expected pushes from other networks to be rejected")
+	testutil.ExpectEquals(t, http.StatusForbidden, serve(StopProgramURL, "10.0.5.1:4000"), "expected admin requests from the push network to be rejected")
+	testutil.ExpectEquals(t, http.StatusOK, serve(VersionInfoURL, "192.168.1.7:4000"), "expected classes without a policy to be allowed")
+	if err := api.backend.network.allows(PushNotificationURL, "10.0.5.1:4000"); err != nil {
+		t.Errorf("expected pushes from the push network to be allowed, got %v", err)
+	}
+	if err := api.backend.network.allows(StopProgramURL, unixSocketClientAddr); err != nil {
+		t.Errorf("expected requests over unix sockets to be allowed, got %v", err)
+	}
+	if err := api.backend.network.allows(StopProgramURL, ""); err == nil {
+		t.Error("expected requests without a remote address to be rejected")
+	}
+	if err := api.backend.network.allows(VersionInfoURL, ""); err != nil {
+		t.Errorf("expected requests without a remote address to be allowed to classes without a policy, got %v", err)
+	}
+
+	var disabled *networkPolicy
+	testutil.ExpectEquals(t, nil, disabled.allows(StopProgramURL, "192.168.1.7:4000"), "expected every address to be allowed without a policy")
+}
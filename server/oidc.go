@@ -0,0 +1,411 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultOIDCRolesClaim = "groups"
+	// oidcKeysRefreshInterval is how often the signing keys of the issuer are fetched again, so that rotated keys are used.
+	oidcKeysRefreshInterval = time.Hour
+	// oidcMinRefreshInterval limits how often tokens signed with unknown keys make uniqush-push fetch the keys of the issuer.
+	oidcMinRefreshInterval = time.Minute
+	// oidcLeeway is the clock skew allowed when checking when tokens expire or become valid.
+	oidcLeeway = time.Minute
+)
+
+// OIDCConfig is a representation of the OpenID Connect settings in the [Admin] section of uniqush.conf.
+type OIDCConfig struct {
+	// Issuer is the URL of the OpenID Connect issuer whose JWTs are accepted as bearer tokens by the admin listener. OIDC is disabled if it is "".
+	Issuer string
+	// Audience must be in the aud claim of tokens (e.g. the client id of uniqush-push).
+	Audience string
+	// RolesClaim is the claim listing the groups (or roles) of the operator, e.g. groups or realm_access.roles.
+	RolesClaim string
+	// Roles maps the values of RolesClaim to admin roles (viewer, operator or admin). Tokens without one of them are rejected.
+	Roles map[string]string
+}
+
+// adminRoleRanks orders the roles of operators on the admin listener, each allowing the requests of the roles below it.
+var adminRoleRanks = map[string]int{
+	APIKeyScopeViewer:   1,
+	APIKeyScopeOperator: 2,
+	APIKeyScopeAdmin:    3,
+}
+
+// adminPathRoles are the roles required by the paths of the admin listener. Other paths require the admin role.
+// Reading /payloads and /loglevel only requires the viewer role, while capturing payloads and changing levels requires the operator role.
+var adminPathRoles = map[string]string{
+	"/loglevel":           APIKeyScopeOperator,
+	LogSamplingURL:        APIKeyScopeOperator,
+	"/payloads":           APIKeyScopeOperator,
+	"/usage":              APIKeyScopeViewer,
+	ReloadConfigURL:       APIKeyScopeOperator,
+	QueryEventsURL:        APIKeyScopeViewer,
+	QueryListenersURL:     APIKeyScopeViewer,
+	QueryMaintenanceURL:   APIKeyScopeViewer,
+	EnableMaintenanceURL:  APIKeyScopeOperator,
+	DisableMaintenanceURL: APIKeyScopeOperator,
+	QueryFeatureFlagsURL:  APIKeyScopeViewer,
+	SetFeatureFlagURL:     APIKeyScopeOperator,
+	"/debug/pprof/":       APIKeyScopeOperator,
+	QueryAPIKeysURL:       APIKeyScopeViewer,
+	QueryTenantsURL:       APIKeyScopeViewer,
+}
+
+// adminRoleAllows returns true if role allows a request to the admin listener.
+func adminRoleAllows(role string, r *http.Request) bool {
+	required, ok := adminPathRoles[r.URL.Path]
+	if strings.HasPrefix(r.URL.Path, "/debug/pprof/") {
+		required, ok = adminPathRoles["/debug/pprof/"]
+	}
+	if !ok {
+		required = APIKeyScopeAdmin
+	}
+	if (r.URL.Path == "/payloads" || r.URL.Path == "/loglevel") && r.Method == "GET" {
+		required = APIKeyScopeViewer
+	}
+	return adminRoleRanks[role] >= adminRoleRanks[required]
+}
+
+// parseOIDCRoles parses a comma separated list of "<claim value>=<role>" (e.g. "uniqush-admins=admin,sre=operator").
+func parseOIDCRoles(s string) (map[string]string, error) {
+	roles := make(map[string]string)
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		i := strings.LastIndexByte(entry, '=')
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid entry %q: must be <claim value>=<role>", entry)
+		}
+		role := entry[i+1:]
+		if _, ok := adminRoleRanks[role]; !ok {
+			return nil, fmt.Errorf("%s: unknown role %q: must be viewer, operator or admin", entry[:i], role)
+		}
+		roles[entry[:i]] = role
+	}
+	return roles, nil
+}
+
+// oidcVerifier verifies the JWTs issued by an OpenID Connect issuer to operators, so that they sign in to the admin listener with SSO
+// instead of sharing the static token. The signing keys are discovered from the issuer and cached. RS256, RS384, RS512, ES256 and ES384 are supported.
+type oidcVerifier struct {
+	conf   OIDCConfig
+	client *http.Client
+	now    func() time.Time
+
+	mutex   sync.Mutex
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+}
+
+// newOIDCVerifier returns nil if there is no issuer.
+func newOIDCVerifier(conf OIDCConfig) *oidcVerifier {
+	if conf.Issuer == "" {
+		return nil
+	}
+	return &oidcVerifier{
+		conf:   conf,
+		client: &http.Client{Timeout: 10 * time.Second},
+		now:    time.Now,
+	}
+}
+
+// oidcClaims are the registered claims of tokens which are checked, and the others by name.
+type oidcClaims struct {
+	Issuer    string          `json:"iss"`
+	Subject   string          `json:"sub"`
+	Audience  json.RawMessage `json:"aud"`
+	Expires   int64           `json:"exp"`
+	NotBefore int64           `json:"nbf"`
+	claims    map[string]interface{}
+}
+
+// hasAudience returns true if aud is audience or an array including it.
+func (c *oidcClaims) hasAudience(audience string) bool {
+	var one string
+	if json.Unmarshal(c.Audience, &one) == nil {
+		return one == audience
+	}
+	var many []string
+	if json.Unmarshal(c.Audience, &many) == nil {
+		for _, aud := range many {
+			if aud == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// claimValues returns the strings of a claim, which is a string or an array of them. Nested claims are separated by ".".
+func (c *oidcClaims) claimValues(name string) []string {
+	var value interface{} = c.claims
+	for _, part := range strings.Split(name, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = object[part]
+	}
+	switch v := value.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		var values []string
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// Verify returns the subject, the highest role and the expiry of a valid token.
+func (v *oidcVerifier) Verify(token string) (subject string, role string, expires time.Time, err error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", "", time.Time{}, errors.New("Malformed token")
+	}
+	var header struct {
+		Algorithm string `json:"alg"`
+		KeyID     string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return "", "", time.Time{}, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", "", time.Time{}, errors.New("Malformed token signature")
+	}
+	key, err := v.key(header.KeyID)
+	if err != nil {
+		return "", "", time.Time{}, err
+	}
+	if err := verifyJWTSignature(header.Algorithm, key, parts[0]+"."+parts[1], signature); err != nil {
+		return "", "", time.Time{}, err
+	}
+	claims := new(oidcClaims)
+	if err := decodeJWTPart(parts[1], claims); err != nil {
+		return "", "", time.Time{}, err
+	}
+	if err := decodeJWTPart(parts[1], &claims.claims); err != nil {
+		return "", "", time.Time{}, err
+	}
+	now := v.now()
+	switch {
+	case claims.Issuer != v.conf.Issuer:
+		return "", "", time.Time{}, fmt.Errorf("Token issued by %q", claims.Issuer)
+	case !claims.hasAudience(v.conf.Audience):
+		return "", "", time.Time{}, errors.New("Token issued for another audience")
+	case claims.Expires == 0 || now.Add(-oidcLeeway).Unix() >= claims.Expires:
+		return "", "", time.Time{}, errors.New("Token expired")
+	case now.Add(oidcLeeway).Unix() < claims.NotBefore:
+		return "", "", time.Time{}, errors.New("Token not valid yet")
+	}
+	for _, value := range claims.claimValues(v.conf.RolesClaim) {
+		if r, ok := v.conf.Roles[value]; ok && adminRoleRanks[r] > adminRoleRanks[role] {
+			role = r
+		}
+	}
+	if role == "" {
+		return claims.Subject, "", time.Time{}, fmt.Errorf("%s has no role: %s doesn't include a group of oidc_roles", claims.Subject, v.conf.RolesClaim)
+	}
+	return claims.Subject, role, time.Unix(claims.Expires, 0), nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return errors.New("Malformed token")
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return errors.New("Malformed token")
+	}
+	return nil
+}
+
+// verifyJWTSignature checks the signature of signed (the header and claims) with the algorithm in the header, which must match the type of the key.
+func verifyJWTSignature(algorithm string, key crypto.PublicKey, signed string, signature []byte) error {
+	var hash crypto.Hash
+	switch algorithm {
+	case "RS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("Unsupported token algorithm %q", algorithm)
+	}
+	h := hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if algorithm[0] != 'R' || rsa.VerifyPKCS1v15(k, hash, digest, signature) != nil {
+			return errors.New("Invalid token signature")
+		}
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if algorithm[0] != 'E' || len(signature) != 2*size ||
+			!ecdsa.Verify(k, digest, new(big.Int).SetBytes(signature[:size]), new(big.Int).SetBytes(signature[size:])) {
+			return errors.New("Invalid token signature")
+		}
+	default:
+		return errors.New("Invalid token signature")
+	}
+	return nil
+}
+
+// key returns the signing key with the id kid, fetching the keys of the issuer if they are stale or kid is unknown (at most every oidcMinRefreshInterval).
+// The cached keys are kept if the issuer can't be reached.
+func (v *oidcVerifier) key(kid string) (crypto.PublicKey, error) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	now := v.now()
+	key, ok := v.cachedKey(kid)
+	if (!ok || now.Sub(v.fetched) >= oidcKeysRefreshInterval) && now.Sub(v.fetched) >= oidcMinRefreshInterval {
+		keys, err := v.fetchKeys()
+		if err != nil && !ok {
+			return nil, fmt.Errorf("Cannot fetch the keys of %s: %v", v.conf.Issuer, err)
+		}
+		if err == nil {
+			v.keys, v.fetched = keys, now
+			key, ok = v.cachedKey(kid)
+		}
+	}
+	if !ok {
+		return nil, fmt.Errorf("Unknown token key %q", kid)
+	}
+	return key, nil
+}
+
+// cachedKey returns the key with the id kid, or the only key if kid is "".
+func (v *oidcVerifier) cachedKey(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(v.keys) == 1 {
+		for _, key := range v.keys {
+			return key, true
+		}
+	}
+	key, ok := v.keys[kid]
+	return key, ok
+}
+
+func (v *oidcVerifier) get(url string, result interface{}) error {
+	resp, err := v.client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Unexpected status %s from %s", resp.Status, url)
+	}
+	return json.Unmarshal(body, result)
+}
+
+// fetchKeys fetches the signing keys of the issuer from the jwks_uri of its discovery document.
+func (v *oidcVerifier) fetchKeys() (map[string]crypto.PublicKey, error) {
+	var discovery struct {
+		Issuer  string `json:"issuer"`
+		JWKSURI string `json:"jwks_uri"`
+	}
+	if err := v.get(strings.TrimRight(v.conf.Issuer, "/")+"/.well-known/openid-configuration", &discovery); err != nil {
+		return nil, err
+	}
+	if discovery.Issuer != v.conf.Issuer {
+		return nil, fmt.Errorf("the discovery document is for the issuer %q", discovery.Issuer)
+	}
+	var jwks struct {
+		Keys []struct {
+			KeyType string `json:"kty"`
+			KeyID   string `json:"kid"`
+			Use     string `json:"use"`
+			N       string `json:"n"`
+			E       string `json:"e"`
+			Curve   string `json:"crv"`
+			X       string `json:"x"`
+			Y       string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := v.get(discovery.JWKSURI, &jwks); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range jwks.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		switch k.KeyType {
+		case "RSA":
+			n, errN := base64.RawURLEncoding.DecodeString(k.N)
+			e, errE := base64.RawURLEncoding.DecodeString(k.E)
+			if errN != nil || errE != nil || len(e) == 0 || len(e) > 4 {
+				return nil, fmt.Errorf("invalid RSA key %q", k.KeyID)
+			}
+			keys[k.KeyID] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case "EC":
+			var curve elliptic.Curve
+			switch k.Curve {
+			case "P-256":
+				curve = elliptic.P256()
+			case "P-384":
+				curve = elliptic.P384()
+			default:
+				continue
+			}
+			x, errX := base64.RawURLEncoding.DecodeString(k.X)
+			y, errY := base64.RawURLEncoding.DecodeString(k.Y)
+			if errX != nil || errY != nil {
+				return nil, fmt.Errorf("invalid EC key %q", k.KeyID)
+			}
+			key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+			if !curve.IsOnCurve(key.X, key.Y) {
+				return nil, fmt.Errorf("invalid EC key %q", k.KeyID)
+			}
+			keys[k.KeyID] = key
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("the issuer has no signing keys")
+	}
+	return keys, nil
+}
@@ -0,0 +1,183 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/uniqush/uniqush-push/testutil"
+)
+
+// testOIDCIssuer serves the discovery document and the keys of an issuer with an RSA and an ECDSA key.
+type testOIDCIssuer struct {
+	server   *httptest.Server
+	rsaKey   *rsa.PrivateKey
+	ecKey    *ecdsa.PrivateKey
+	requests int
+}
+
+func newTestOIDCIssuer(t *testing.T) *testOIDCIssuer {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer := &testOIDCIssuer{rsaKey: rsaKey, ecKey: ecKey}
+	b64 := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+	issuer.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		issuer.requests++
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(map[string]string{"issuer": issuer.server.URL, "jwks_uri": issuer.server.URL + "/keys"})
+		case "/keys":
+			json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{
+				{"kty": "RSA", "kid": "rsa", "use": "sig", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+				{"kty": "EC", "kid": "ec", "crv": "P-256", "x": b64(ecKey.X.Bytes()), "y": b64(ecKey.Y.Bytes())},
+			}})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	return issuer
+}
+
+// sign returns a JWT with claims, signed with the RSA key (RS256) or the ECDSA key (ES256).
+func (i *testOIDCIssuer) sign(t *testing.T, kid string, claims map[string]interface{}) string {
+	alg := map[string]string{"rsa": "RS256", "ec": "ES256"}[kid]
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	var signature []byte
+	if kid == "rsa" {
+		var err error
+		if signature, err = rsa.SignPKCS1v15(rand.Reader, i.rsaKey, crypto.SHA256, digest[:]); err != nil {
+			t.Fatal(err)
+		}
+	} else {
+		r, s, err := ecdsa.Sign(rand.Reader, i.ecKey, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature = make([]byte, 64)
+		copy(signature[32-len(r.Bytes()):32], r.Bytes())
+		copy(signature[64-len(s.Bytes()):], s.Bytes())
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestParseOIDCRoles(t *testing.T) {
+	roles, err := parseOIDCRoles("uniqush-admins=admin, sre=operator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectEquals(t, map[string]string{"uniqush-admins": "admin", "sre": "operator"}, roles, "expected the role of each group")
+	for _, invalid := range []string{"sre", "=admin", "sre=push"} {
+		if _, err := parseOIDCRoles(invalid); err == nil {
+			t.Errorf("expected %q to be invalid", invalid)
+		}
+	}
+}
+
+func TestOIDCVerifier(t *testing.T) {
+	issuer := newTestOIDCIssuer(t)
+	defer issuer.server.Close()
+	v := newOIDCVerifier(OIDCConfig{
+		Issuer:     issuer.server.URL,
+		Audience:   "uniqush",
+		RolesClaim: "realm_access.roles",
+		Roles:      map[string]string{"sre": "operator", "uniqush-admins": "admin"},
+	})
+	now := time.Unix(1500000000, 0)
+	v.now = func() time.Time { return now }
+	claims := func(changes map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"iss":          issuer.server.URL,
+			"sub":          "alice",
+			"aud":          []string{"other", "uniqush"},
+			"exp":          now.Add(time.Hour).Unix(),
+			"realm_access": map[string]interface{}{"roles": []string{"sre", "uniqush-admins"}},
+		}
+		for k, v := range changes {
+			c[k] = v
+		}
+		return c
+	}
+
+	for _, kid := range []string{"rsa", "ec"} {
+		subject, role, _, err := v.Verify(issuer.sign(t, kid, claims(nil)))
+		if err != nil {
+			t.Fatalf("expected the %s token to be valid, got %v", kid, err)
+		}
+		testutil.ExpectStringEquals(t, "alice", subject, "expected the subject of the token")
+		testutil.ExpectStringEquals(t, "admin", role, "expected the highest role of the groups of the token")
+	}
+	testutil.ExpectEquals(t, 2, issuer.requests, "expected the keys to be cached")
+
+	for name, changes := range map[string]map[string]interface{}{
+		"issuer":   {"iss": "https://evil.example.com"},
+		"audience": {"aud": "other"},
+		"expired":  {"exp": now.Add(-2 * time.Minute).Unix()},
+		"early":    {"nbf": now.Add(2 * time.Minute).Unix()},
+		"role":     {"realm_access": map[string]interface{}{"roles": []string{"developers"}}},
+	} {
+		if _, _, _, err := v.Verify(issuer.sign(t, "rsa", claims(changes))); err == nil {
+			t.Errorf("expected the token with the wrong %s to be rejected", name)
+		}
+	}
+	token := issuer.sign(t, "rsa", claims(nil))
+	if _, _, _, err := v.Verify(token[:len(token)-4] + "AAAA"); err == nil {
+		t.Error("expected tokens with invalid signatures to be rejected")
+	}
+	if _, _, _, err := v.Verify(issuer.sign(t, "unknown", claims(nil))); err == nil {
+		t.Error("expected tokens signed with unknown keys to be rejected")
+	}
+}
+
+func TestAdminHandlerOIDC(t *testing.T) {
+	issuer := newTestOIDCIssuer(t)
+	defer issuer.server.Close()
+	handler := newAdminHandler(AdminConfig{Addr: "localhost:0", Token: "secret", Profiling: true, OIDC: OIDCConfig{
+		Issuer:     issuer.server.URL,
+		Audience:   "uniqush",
+		RolesClaim: "groups",
+		Roles:      map[string]string{"support": "viewer"},
+	}}, nil, nil, nil, nil, nil, nil, nil, nil, nil)
+	token := issuer.sign(t, "ec", map[string]interface{}{"iss": issuer.server.URL, "sub": "bob", "aud": "uniqush", "exp": time.Now().Add(time.Hour).Unix(), "groups": "support"})
+	get := func(path, auth string) int {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("Authorization", auth)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+	testutil.ExpectEquals(t, http.StatusForbidden, get("/debug/pprof/", "Bearer "+token), "expected viewers not to capture profiles")
+	testutil.ExpectEquals(t, http.StatusUnauthorized, get("/debug/pprof/", "Bearer invalid"), "expected invalid tokens to be rejected")
+	testutil.ExpectEquals(t, http.StatusOK, get("/debug/pprof/", "Bearer secret"), "expected the static token to still be accepted")
+
+	req := httptest.NewRequest("GET", "/usage", nil)
+	if !adminRoleAllows("viewer", req) {
+		t.Error("expected viewers to read the usage of API keys")
+	}
+	req = httptest.NewRequest("POST", "/payloads", nil)
+	if adminRoleAllows("viewer", req) {
+		t.Error("expected viewers not to capture payloads")
+	}
+	req = httptest.NewRequest("POST", CreateAPIKeyURL, nil)
+	if adminRoleAllows("operator", req) {
+		t.Error("expected only admins to manage API keys")
+	}
+}
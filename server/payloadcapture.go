@@ -0,0 +1,242 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/uniqush/uniqush-push/push"
+)
+
+// payloadCaptureSize is the number of captured payloads kept for each service. Older ones are overwritten.
+const payloadCaptureSize = 100
+
+// redactedValue replaces the values of fields of captured payloads which look like secrets.
+const redactedValue = "[redacted]"
+
+// CapturedPayload is a sampled payload sent to a push service provider, returned by /payloads on the admin listener.
+type CapturedPayload struct {
+	// Date is the unix timestamp of the result.
+	Date                int64  `json:"date"`
+	RequestID           string `json:"requestId"`
+	Service             string `json:"service"`
+	PushServiceProvider string `json:"pushServiceProvider"`
+	DeliveryPoint       string `json:"deliveryPoint"`
+	// Payload is the payload serialized by the push service type, with placeholders for the delivery point (as in /previewpush) and secrets redacted.
+	Payload interface{} `json:"payload"`
+	// Result is "success", or the reason of the failure, as in the result label of uniqush_pushes_total (e.g. bad_notification).
+	Result   string `json:"result"`
+	ErrorMsg string `json:"errorMsg,omitempty"`
+}
+
+type capturedPayloads struct {
+	payloads []CapturedPayload
+	// next is the index of payloads to overwrite once it is full.
+	next int
+}
+
+// payloadCapture samples the payloads sent to push service providers for the services which are being debugged, without logging every payload.
+// Sampling is enabled for a service with /payloads on the admin listener, and lasts until uniqush-push is restarted.
+type payloadCapture struct {
+	// preview serializes a notification like the push service type does, e.g. PushServiceManager.Preview.
+	preview func(pushServiceType string, notif *push.Notification) ([]byte, push.Error)
+	mutex   sync.Mutex
+	// percents are the percentages of pushes to capture, by service.
+	percents map[string]float64
+	captured map[string]*capturedPayloads
+	random   func() float64
+	now      func() time.Time
+}
+
+func newPayloadCapture(psm *push.PushServiceManager) *payloadCapture {
+	return &payloadCapture{
+		preview:  psm.Preview,
+		percents: make(map[string]float64),
+		captured: make(map[string]*capturedPayloads),
+		random:   rand.Float64,
+		now:      time.Now,
+	}
+}
+
+// SetPercent captures percent of the pushes to delivery points of service. 0 stops capturing them, but keeps the payloads captured so far.
+func (c *payloadCapture) SetPercent(service string, percent float64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if percent <= 0 {
+		delete(c.percents, service)
+		return
+	}
+	c.percents[service] = percent
+}
+
+// Percents returns the percentage of pushes captured for each service being debugged.
+func (c *payloadCapture) Percents() map[string]float64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	percents := make(map[string]float64, len(c.percents))
+	for service, percent := range c.percents {
+		percents[service] = percent
+	}
+	return percents
+}
+
+// capture samples the payload of the result of a push to a delivery point of service, if service is being debugged.
+func (c *payloadCapture) capture(reqID, service string, res *push.Result, notif *push.Notification) {
+	if c == nil || res.Provider == nil {
+		return
+	}
+	c.mutex.Lock()
+	percent := c.percents[service]
+	c.mutex.Unlock()
+	if percent <= 0 || c.random()*100 >= percent {
+		return
+	}
+	content := res.Content
+	if content == nil {
+		content = notif
+	}
+	if content == nil {
+		return
+	}
+	captured := CapturedPayload{
+		Date:                c.now().Unix(),
+		RequestID:           reqID,
+		Service:             service,
+		PushServiceProvider: res.Provider.Name(),
+		DeliveryPoint:       getDeliveryPointNameOrUnknown(res.Destination),
+		Result:              "success",
+	}
+	if res.Err != nil {
+		captured.Result = pushResultLabel(res.Err)
+		captured.ErrorMsg = redactedError(res.Err)
+	}
+	data, err := c.preview(res.Provider.PushServiceName(), content)
+	if err != nil {
+		captured.Payload = fmt.Sprintf("Cannot serialize payload: %v", err)
+	} else {
+		captured.Payload = redactPayload(apiBytesToObject(data))
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	ring, ok := c.captured[service]
+	if !ok {
+		ring = &capturedPayloads{}
+		c.captured[service] = ring
+	}
+	if len(ring.payloads) < payloadCaptureSize {
+		ring.payloads = append(ring.payloads, captured)
+	} else {
+		ring.payloads[ring.next] = captured
+	}
+	ring.next = (ring.next + 1) % payloadCaptureSize
+}
+
+// Payloads returns the payloads captured for service, newest first.
+func (c *payloadCapture) Payloads(service string) []CapturedPayload {
+	payloads := []CapturedPayload{}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	ring, ok := c.captured[service]
+	if !ok {
+		return payloads
+	}
+	n := len(ring.payloads)
+	for i := 1; i <= n; i++ {
+		payloads = append(payloads, ring.payloads[(ring.next-i+n)%n])
+	}
+	return payloads
+}
+
+// isSecretPayloadField returns true if the field of a payload looks like it contains a secret.
+// Unlike isSecretField, it doesn't match every name containing "key", since payloads have fields like collapse_key.
+func isSecretPayloadField(name string) bool {
+	name = strings.ToLower(name)
+	if name == "key" || strings.HasSuffix(name, "api_key") || strings.HasSuffix(name, "apikey") {
+		return true
+	}
+	for _, s := range []string{"secret", "token", "password", "credential", "authorization"} {
+		if strings.Contains(name, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactPayload replaces the values of the fields of a decoded JSON payload which look like secrets, recursively.
+func redactPayload(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for name, value := range v {
+			if isSecretPayloadField(name) {
+				v[name] = redactedValue
+			} else {
+				v[name] = redactPayload(value)
+			}
+		}
+	case []interface{}:
+		for i, value := range v {
+			v[i] = redactPayload(value)
+		}
+	}
+	return v
+}
+
+// servePayloads handles /payloads on the admin listener. POST with service and percent sets the percentage of pushes captured for a service (0 to stop).
+// GET with service lists the payloads captured for it, and GET without service lists the percentages of the services being debugged.
+func servePayloads(w http.ResponseWriter, r *http.Request, c *payloadCapture) {
+	service := r.FormValue("service")
+	var response interface{}
+	switch {
+	case r.Method == "POST":
+		if err := validateService(service); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		percent, err := strconv.ParseFloat(r.FormValue("percent"), 64)
+		if err != nil || percent < 0 || percent > 100 {
+			http.Error(w, fmt.Sprintf("Invalid percent %q: must be between 0 and 100", r.FormValue("percent")), http.StatusBadRequest)
+			return
+		}
+		c.SetPercent(service, percent)
+		fmt.Fprintf(w, "Capturing %v%% of the payloads of %s\n", percent, service)
+		return
+	case service != "":
+		response = struct {
+			Service  string            `json:"service"`
+			Percent  float64           `json:"percent"`
+			Payloads []CapturedPayload `json:"payloads"`
+		}{service, c.Percents()[service], c.Payloads(service)}
+	default:
+		response = struct {
+			Percents map[string]float64 `json:"percents"`
+		}{c.Percents()}
+	}
+	data, err := json.Marshal(response)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, "%s\r\n", data)
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/uniqush/uniqush-push/push"
+	"github.com/uniqush/uniqush-push/testutil"
+)
+
+func newTestPayloadCapture(t *testing.T) (*payloadCapture, *push.PushServiceProvider) {
+	psm := push.GetPushServiceManager()
+	psm.ClearAllPushServiceTypesForUnitTest()
+	if err := psm.RegisterPushServiceType(newBenchPushServiceType(0)); err != nil {
+		t.Fatal(err)
+	}
+	psp, err := psm.BuildPushServiceProviderFromMap(map[string]string{"service": "srv", "pushservicetype": benchPushServiceName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newPayloadCapture(psm)
+	c.now = func() time.Time { return time.Unix(1500000000, 0) }
+	return c, psp
+}
+
+func TestPayloadCaptureSampling(t *testing.T) {
+	c, psp := newTestPayloadCapture(t)
+	notif := push.NewEmptyNotification()
+	notif.Data["msg"] = "hello"
+	notif.Data["auth_token"] = "hunter2"
+	random := 0.5
+	c.random = func() float64 { return random }
+
+	c.capture("req1", "srv", &push.Result{Provider: psp}, notif)
+	testutil.ExpectEquals(t, 0, len(c.Payloads("srv")), "expected nothing to be captured unless the service is being debugged")
+
+	c.SetPercent("srv", 10)
+	c.capture("req2", "srv", &push.Result{Provider: psp}, notif)
+	testutil.ExpectEquals(t, 0, len(c.Payloads("srv")), "expected pushes outside of the sample not to be captured")
+	random = 0.05
+	c.capture("req3", "srv", &push.Result{Provider: psp, Err: push.NewBadNotificationWithDetails("too large")}, notif)
+	c.capture("req4", "other", &push.Result{Provider: psp}, notif)
+
+	payloads := c.Payloads("srv")
+	testutil.ExpectEquals(t, 1, len(payloads), "expected the sampled push to be captured")
+	testutil.ExpectStringEquals(t, "req3", payloads[0].RequestID, "unexpected request id")
+	testutil.ExpectStringEquals(t, "bad_notification", payloads[0].Result, "expected the result of the push")
+	testutil.ExpectEquals(t, map[string]interface{}{"msg": "hello", "auth_token": redactedValue}, payloads[0].Payload, "expected secrets to be redacted")
+	testutil.ExpectEquals(t, 0, len(c.Payloads("other")), "expected other services not to be captured")
+
+	for i := 0; i < payloadCaptureSize+1; i++ {
+		c.capture("last", "srv", &push.Result{Provider: psp}, notif)
+	}
+	testutil.ExpectEquals(t, payloadCaptureSize, len(c.Payloads("srv")), "expected the number of captured payloads to be bounded")
+
+	c.SetPercent("srv", 0)
+	testutil.ExpectEquals(t, map[string]float64{}, c.Percents(), "expected capturing to stop")
+	testutil.ExpectEquals(t, payloadCaptureSize, len(c.Payloads("srv")), "expected the captured payloads to be kept")
+}
+
+func TestRedactPayload(t *testing.T) {
+	var payload interface{}
+	json.Unmarshal([]byte(`{"collapse_key":"a","data":{"key":"b","items":[{"password":"c","id":1}]},"registration_ids":["PLACEHOLDER"]}`), &payload)
+	expected := map[string]interface{}{
+		"collapse_key":     "a",
+		"data":             map[string]interface{}{"key": redactedValue, "items": []interface{}{map[string]interface{}{"password": redactedValue, "id": 1.0}}},
+		"registration_ids": []interface{}{"PLACEHOLDER"},
+	}
+	testutil.ExpectEquals(t, expected, redactPayload(payload), "expected nested secrets to be redacted")
+}
+
+func TestAdminPayloads(t *testing.T) {
+	c, psp := newTestPayloadCapture(t)
+	c.random = func() float64 { return 0 }
+	handler := newAdminHandler(AdminConfig{Addr: "localhost:0", Token: "secret"}, nil, c, nil, nil, nil, nil, nil, nil, nil)
+	do := func(method, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+	testutil.ExpectEquals(t, http.StatusBadRequest, do("POST", "/payloads?service=srv&percent=101").Code, "expected invalid percentages to be rejected")
+	testutil.ExpectEquals(t, http.StatusOK, do("POST", "/payloads?service=srv&percent=5").Code, "expected the percentage to be set")
+	notif := push.NewEmptyNotification()
+	notif.Data["msg"] = "hello"
+	c.capture("req", "srv", &push.Result{Provider: psp}, notif)
+
+	var listed struct {
+		Percent  float64           `json:"percent"`
+		Payloads []CapturedPayload `json:"payloads"`
+	}
+	if err := json.Unmarshal(do("GET", "/payloads?service=srv").Body.Bytes(), &listed); err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectEquals(t, 5.0, listed.Percent, "unexpected percentage")
+	testutil.ExpectEquals(t, 1, len(listed.Payloads), "expected the captured payload")
+
+	var percents struct {
+		Percents map[string]float64 `json:"percents"`
+	}
+	if err := json.Unmarshal(do("GET", "/payloads").Body.Bytes(), &percents); err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectEquals(t, map[string]float64{"srv": 5}, percents.Percents, "expected the services being debugged")
+}
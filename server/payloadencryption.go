@@ -0,0 +1,112 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/uniqush/uniqush-push/push"
+)
+
+const (
+	// payloadEncryptionField is the field of encrypted notifications with the encrypted fields, which apps decrypt with the private key of their encryption_key.
+	payloadEncryptionField = "uniqush_encrypted"
+	// payloadEncryptionInfo is the HKDF info of the key encrypting notifications, which identifies the scheme.
+	payloadEncryptionInfo = "uniqush-push payload encryption v1"
+)
+
+// payloadClearFields are sent unencrypted, since push services need them to deliver notifications.
+// The other fields are encrypted, including msg and title, so apps display encrypted notifications themselves.
+var payloadClearFields = map[string]bool{
+	"msggroup":          true,
+	"collapse_key":      true,
+	"ttl":               true,
+	"expiry":            true,
+	"id":                true,
+	"badge":             true,
+	"sound":             true,
+	"content-available": true,
+}
+
+// encryptNotification returns a copy of notif whose fields (except payloadClearFields and the "uniqush." parameters) are replaced by
+// payloadEncryptionField, encrypted for the encryption_key of a delivery point with ECIES:
+// the base64url encoded (without padding) ephemeral P-256 public key (65 bytes), AES-256-GCM nonce (12 bytes) and the encrypted JSON object of the fields.
+// The AES key is HKDF-SHA256 of the x coordinate of the ECDH shared secret, with the ephemeral public key as the salt and payloadEncryptionInfo as the info.
+// The raw payloads of uniqush.payload.* and uniqush.notification.* can't be encrypted, so they are rejected.
+func encryptNotification(notif *push.Notification, encryptionKey string) (*push.Notification, error) {
+	key, err := push.ParseEncryptionKey(encryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	encrypted := push.NewEmptyNotification()
+	fields := make(map[string]string)
+	for k, v := range notif.Data {
+		switch {
+		case strings.HasPrefix(k, "uniqush.payload.") || strings.HasPrefix(k, "uniqush.notification."):
+			return nil, fmt.Errorf("%s can't be encrypted for delivery points with an encryption_key", k)
+		case strings.HasPrefix(k, "uniqush.") || payloadClearFields[k]:
+			encrypted.Data[k] = v
+		default:
+			fields[k] = v
+		}
+	}
+	plaintext, err := json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+	ephemeral, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	ephemeralPublic := elliptic.Marshal(elliptic.P256(), ephemeral.X, ephemeral.Y)
+	gcm, err := payloadEncryptionCipher(key, ephemeral.D.Bytes(), ephemeralPublic)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	blob := append(append(ephemeralPublic, nonce...), gcm.Seal(nil, nonce, plaintext, nil)...)
+	encrypted.Data[payloadEncryptionField] = base64.RawURLEncoding.EncodeToString(blob)
+	return encrypted, nil
+}
+
+// payloadEncryptionCipher returns the AES-256-GCM cipher of the ECDH shared secret of public and private, salted with ephemeralPublic.
+func payloadEncryptionCipher(public *ecdsa.PublicKey, private []byte, ephemeralPublic []byte) (cipher.AEAD, error) {
+	x, _ := public.Curve.ScalarMult(public.X, public.Y, private)
+	shared := make([]byte, 32)
+	xBytes := x.Bytes()
+	copy(shared[32-len(xBytes):], xBytes)
+	// HKDF-SHA256 (RFC 5869), whose first block is the 32 byte key.
+	prk := hmacSHA256(ephemeralPublic, string(shared))
+	aesKey := hmacSHA256(prk, payloadEncryptionInfo+"\x01")
+	block, err := aes.NewCipher(aesKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+
+	"github.com/uniqush/uniqush-push/push"
+	"github.com/uniqush/uniqush-push/testutil"
+)
+
+// decryptTestNotification decrypts payloadEncryptionField like an app would, with the private key of its encryption_key.
+func decryptTestNotification(t *testing.T, private *ecdsa.PrivateKey, notif *push.Notification) map[string]string {
+	blob, err := base64.RawURLEncoding.DecodeString(notif.Data[payloadEncryptionField])
+	if err != nil {
+		t.Fatal(err)
+	}
+	x, y := elliptic.Unmarshal(elliptic.P256(), blob[:65])
+	gcm, err := payloadEncryptionCipher(&ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, private.D.Bytes(), blob[:65])
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext, err := gcm.Open(nil, blob[65:65+gcm.NonceSize()], blob[65+gcm.NonceSize():], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]string
+	if err := json.Unmarshal(plaintext, &fields); err != nil {
+		t.Fatal(err)
+	}
+	return fields
+}
+
+func TestEncryptNotification(t *testing.T) {
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := base64.StdEncoding.EncodeToString(elliptic.Marshal(elliptic.P256(), private.X, private.Y))
+	notif := &push.Notification{Data: map[string]string{"msg": "Your code is 123456", "order": "42", "ttl": "60", "uniqush.http2": "1"}}
+
+	encrypted, err := encryptNotification(notif, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectEquals(t, 3, len(encrypted.Data), "expected the content to be replaced by the encrypted field")
+	testutil.ExpectStringEquals(t, "60", encrypted.Data["ttl"], "expected the fields needed by push services to be sent unencrypted")
+	testutil.ExpectStringEquals(t, "1", encrypted.Data["uniqush.http2"], "expected the parameters of uniqush to be kept")
+	testutil.ExpectEquals(t, map[string]string{"msg": "Your code is 123456", "order": "42"}, decryptTestNotification(t, private, encrypted), "expected the app to decrypt the content")
+	testutil.ExpectStringEquals(t, "Your code is 123456", notif.Data["msg"], "expected the notification not to be modified")
+
+	if _, err := encryptNotification(&push.Notification{Data: map[string]string{"uniqush.payload.gcm": "{}"}}, key); err == nil {
+		t.Error("expected raw payloads not to be sent unencrypted")
+	}
+	if _, err := encryptNotification(notif, "AAAA"); err == nil {
+		t.Error("expected invalid keys to be rejected")
+	}
+}
+
+func TestSubscribeWithEncryptionKey(t *testing.T) {
+	newFailureTestPeers(t)
+	psm := push.GetPushServiceManager()
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := base64.RawURLEncoding.EncodeToString(elliptic.Marshal(elliptic.P256(), private.X, private.Y))
+	kv := map[string]string{"service": "myservice", "subscriber": "user1", "pushservicetype": benchPushServiceName, "token": "token1", push.EncryptionKey: key}
+	dp, err := psm.BuildDeliveryPointFromMap(kv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectStringEquals(t, key, dp.VolatileData[push.EncryptionKey], "expected the key to be stored with the delivery point")
+	kv[push.EncryptionKey] = base64.StdEncoding.EncodeToString([]byte("not a key"))
+	if _, err := psm.BuildDeliveryPointFromMap(kv); err == nil {
+		t.Error("expected invalid keys to be rejected when subscribing")
+	}
+}
@@ -0,0 +1,209 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/uniqush/goconf/conf"
+	"github.com/uniqush/uniqush-push/metrics"
+	"github.com/uniqush/uniqush-push/push"
+)
+
+// payloadPolicyViolations counts the pushes and broadcasts rejected by the payload policy of their service, by rule (size, key, value or category).
+var payloadPolicyViolations = metrics.DefaultRegistry.NewCounterVec("uniqush_payload_policy_violations_total",
+	"Pushes and broadcasts rejected by the payload policy of [PayloadPolicy], by service and rule.", "service", "rule")
+
+const (
+	defaultPayloadCategoryKey = "category"
+	// payloadPolicySectionPrefix is the prefix of config sections with the payload policy of a single service.
+	payloadPolicySectionPrefix = "PayloadPolicy."
+)
+
+// PayloadPolicy restricts the parameters of the pushes of a service, so that teams don't accidentally send PII or oversized payloads.
+// The zero value allows every payload.
+type PayloadPolicy struct {
+	// MaxSize is the maximum total length of the names and values of the parameters of a push. 0 is unlimited.
+	MaxSize int
+	// ForbiddenKeys are patterns (of path.Match, e.g. *_email) of the names of parameters which can't be sent.
+	ForbiddenKeys []string
+	// ForbiddenValues rejects pushes with a parameter whose value it matches (e.g. email addresses or phone numbers). If nil, values aren't checked.
+	ForbiddenValues *regexp.Regexp
+	// CategoryKey is the parameter with the category of a push.
+	CategoryKey string
+	// Categories are the allowed values of CategoryKey. If it isn't empty, every push must have one of them.
+	Categories []string
+}
+
+// payloadPolicyError is the rule of a policy which a payload breaks, and why.
+type payloadPolicyError struct {
+	rule   string
+	reason string
+}
+
+func (e *payloadPolicyError) Error() string {
+	return "Payload policy violation: " + e.reason
+}
+
+// Check returns an error if the parameters of a push (and any parameters set for each delivery point) break the policy.
+// The values of parameters aren't included in errors, since they may be the PII which was rejected.
+func (p PayloadPolicy) Check(notif *push.Notification, perdp map[string][]string) error {
+	size := 0
+	check := func(k, v string) error {
+		for _, pattern := range p.ForbiddenKeys {
+			if matched, _ := path.Match(pattern, k); matched {
+				return &payloadPolicyError{rule: "key", reason: fmt.Sprintf("the parameter %s is forbidden", k)}
+			}
+		}
+		if p.ForbiddenValues != nil && p.ForbiddenValues.MatchString(v) {
+			return &payloadPolicyError{rule: "value", reason: fmt.Sprintf("the value of %s matches forbidden_values", k)}
+		}
+		return nil
+	}
+	for k, v := range notif.Data {
+		if err := check(k, v); err != nil {
+			return err
+		}
+		if _, ok := perdp[k]; !ok {
+			size += len(k) + len(v)
+		}
+	}
+	for k, values := range perdp {
+		longest := 0
+		for _, v := range values {
+			if err := check(k, v); err != nil {
+				return err
+			}
+			if len(v) > longest {
+				longest = len(v)
+			}
+		}
+		size += len(k) + longest
+	}
+	if p.MaxSize > 0 && size > p.MaxSize {
+		return &payloadPolicyError{rule: "size", reason: fmt.Sprintf("the payload is %d bytes, more than max_size=%d", size, p.MaxSize)}
+	}
+	if len(p.Categories) > 0 {
+		category := notif.Data[p.CategoryKey]
+		for _, c := range p.Categories {
+			if c == category {
+				return nil
+			}
+		}
+		if category == "" {
+			return &payloadPolicyError{rule: "category", reason: fmt.Sprintf("the parameter %s is required (one of %s)", p.CategoryKey, strings.Join(p.Categories, ", "))}
+		}
+		return &payloadPolicyError{rule: "category", reason: fmt.Sprintf("%s=%s isn't one of %s", p.CategoryKey, category, strings.Join(p.Categories, ", "))}
+	}
+	return nil
+}
+
+// PayloadPolicies contains the payload policy of each service, from the [PayloadPolicy] and [PayloadPolicy.<service>] sections of uniqush.conf.
+type PayloadPolicies struct {
+	Default PayloadPolicy
+	// ByService is keyed by the service name, which is case sensitive (see serviceSections).
+	ByService map[string]PayloadPolicy
+}
+
+// ForService returns the payload policy of the given service.
+func (p *PayloadPolicies) ForService(service string) PayloadPolicy {
+	if p == nil {
+		return PayloadPolicy{}
+	}
+	if policy, ok := p.ByService[service]; ok {
+		return policy
+	}
+	return p.Default
+}
+
+// Check returns an error if the parameters of a push to service break its policy, and counts the violation.
+func (p *PayloadPolicies) Check(service string, notif *push.Notification, perdp map[string][]string) error {
+	err := p.ForService(service).Check(notif, perdp)
+	if e, ok := err.(*payloadPolicyError); ok {
+		payloadPolicyViolations.Inc(service, e.rule)
+	}
+	return err
+}
+
+// LoadPayloadPolicies returns a representation of the [PayloadPolicy] section and [PayloadPolicy.<service>] sections from uniqush.conf.
+// Service sections inherit any settings they don't override from [PayloadPolicy].
+func LoadPayloadPolicies(c *conf.ConfigFile) (*PayloadPolicies, error) {
+	policies := &PayloadPolicies{ByService: make(map[string]PayloadPolicy)}
+	var err error
+	policies.Default, err = loadPayloadPolicy(c, "PayloadPolicy", PayloadPolicy{CategoryKey: defaultPayloadCategoryKey})
+	if err != nil {
+		return nil, err
+	}
+	sections, err := serviceSections(c, payloadPolicySectionPrefix)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range sections {
+		policies.ByService[s.service], err = loadPayloadPolicy(c, s.section, policies.Default)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return policies, nil
+}
+
+func loadPayloadPolicy(c *conf.ConfigFile, section string, defaults PayloadPolicy) (PayloadPolicy, error) {
+	p := defaults
+	if maxSize, err := c.GetInt(section, "max_size"); err == nil {
+		if maxSize < 0 {
+			return p, fmt.Errorf("[%s] max_size must not be negative, got %d", section, maxSize)
+		}
+		p.MaxSize = maxSize
+	}
+	if keys, err := c.GetString(section, "forbidden_keys"); err == nil {
+		p.ForbiddenKeys = nil
+		for _, key := range strings.Split(keys, ",") {
+			key = strings.TrimSpace(key)
+			if key == "" {
+				continue
+			}
+			if _, err := path.Match(key, ""); err != nil {
+				return p, fmt.Errorf("[%s] forbidden_keys: invalid pattern %q", section, key)
+			}
+			p.ForbiddenKeys = append(p.ForbiddenKeys, key)
+		}
+	}
+	if values, err := c.GetString(section, "forbidden_values"); err == nil {
+		p.ForbiddenValues = nil
+		if values != "" {
+			if p.ForbiddenValues, err = regexp.Compile(values); err != nil {
+				return p, fmt.Errorf("[%s] forbidden_values: %v", section, err)
+			}
+		}
+	}
+	if key, err := c.GetString(section, "category_key"); err == nil && key != "" {
+		p.CategoryKey = key
+	}
+	if categories, err := c.GetString(section, "categories"); err == nil {
+		p.Categories = nil
+		for _, category := range strings.Split(categories, ",") {
+			if category = strings.TrimSpace(category); category != "" {
+				p.Categories = append(p.Categories, category)
+			}
+		}
+	}
+	return p, nil
+}
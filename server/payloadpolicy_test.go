@@ -0,0 +1,66 @@
+package server
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/uniqush/goconf/conf"
+	"github.com/uniqush/uniqush-push/push"
+	"github.com/uniqush/uniqush-push/testutil"
+)
+
+func TestPayloadPolicyCheck(t *testing.T) {
+	policy := PayloadPolicy{
+		MaxSize:         40,
+		ForbiddenKeys:   []string{"email", "*_ssn"},
+		ForbiddenValues: regexp.MustCompile(`[^@ ]+@[^@ ]+\.[a-z]+`),
+		CategoryKey:     "category",
+		Categories:      []string{"marketing", "transactional"},
+	}
+	notif := func(data map[string]string) *push.Notification { return &push.Notification{Data: data} }
+	if err := policy.Check(notif(map[string]string{"msg": "Sale", "category": "marketing"}), nil); err != nil {
+		t.Errorf("expected the push to be allowed, got %v", err)
+	}
+	for name, data := range map[string]map[string]string{
+		"forbidden key":     {"msg": "Sale", "category": "marketing", "user_ssn": "x"},
+		"forbidden value":   {"msg": "Hi bob@example.com", "category": "marketing"},
+		"missing category":  {"msg": "Sale"},
+		"unknown category":  {"msg": "Sale", "category": "other"},
+		"too large payload": {"msg": strings.Repeat("x", 30), "category": "marketing"},
+	} {
+		if err := policy.Check(notif(data), nil); err == nil {
+			t.Errorf("expected the push with a %s to be rejected", name)
+		}
+	}
+	err := policy.Check(notif(map[string]string{"category": "marketing"}), map[string][]string{"msg": {"Hi", "Hi bob@example.com"}})
+	if err == nil {
+		t.Fatal("expected the parameters of each delivery point to be checked")
+	}
+	testutil.ExpectEquals(t, false, strings.Contains(err.Error(), "bob@example.com"), "expected the forbidden value not to be in the error")
+	if err := (PayloadPolicy{}).Check(notif(map[string]string{"email": strings.Repeat("x", 5000)}), nil); err != nil {
+		t.Errorf("expected the zero policy to allow every payload, got %v", err)
+	}
+}
+
+func TestLoadPayloadPoliciesForService(t *testing.T) {
+	c := conf.NewConfigFile()
+	c.AddOption("PayloadPolicy", "forbidden_keys", "email, phone")
+	c.AddOption("PayloadPolicy.MyService", "service", "MyService")
+	c.AddOption("PayloadPolicy.MyService", "max_size", "1024")
+	c.AddOption("PayloadPolicy.MyService", "categories", "alerts")
+	policies, err := LoadPayloadPolicies(c)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	testutil.ExpectEquals(t, PayloadPolicy{ForbiddenKeys: []string{"email", "phone"}, CategoryKey: "category"}, policies.ForService("otherservice"), "expected the [PayloadPolicy] section to be used by default")
+	testutil.ExpectEquals(t, PayloadPolicy{MaxSize: 1024, ForbiddenKeys: []string{"email", "phone"}, CategoryKey: "category", Categories: []string{"alerts"}}, policies.ForService("MyService"),
+		"expected the [PayloadPolicy.<service>] section to override [PayloadPolicy]")
+
+	c.AddOption("PayloadPolicy", "forbidden_values", "(")
+	if _, err := LoadPayloadPolicies(c); err == nil {
+		t.Error("expected invalid regular expressions to be rejected")
+	}
+	var disabled *PayloadPolicies
+	testutil.ExpectEquals(t, nil, disabled.Check("myservice", &push.Notification{Data: map[string]string{"email": "x"}}, nil), "expected every payload to be allowed without policies")
+}
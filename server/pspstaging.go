@@ -0,0 +1,462 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/uniqush/log"
+	"github.com/uniqush/uniqush-push/db"
+	"github.com/uniqush/uniqush-push/push"
+)
+
+// Paths of the endpoints which stage new credentials for push service providers, and promote or roll them back.
+const (
+	StagePushServiceProviderURL          = "/stagepsp"
+	QueryStagedPushServiceProvidersURL   = "/stagedpsps"
+	SetStagedPercentURL                  = "/setstagedpercent"
+	PromoteStagedPushServiceProviderURL  = "/promotepsp"
+	RollbackStagedPushServiceProviderURL = "/rollbackpsp"
+)
+
+// Actions of audit records of staged credentials.
+const (
+	AuditStagePSP         = "stagepsp"
+	AuditSetStagedPercent = "setstagedpercent"
+	AuditPromotePSP       = "promotepsp"
+	AuditRollbackPSP      = "rollbackpsp"
+)
+
+// stagingRefreshInterval is how often each instance reloads the staged credentials, to apply the changes made through other instances.
+const stagingRefreshInterval = 5 * time.Second
+
+// stagingState is how much traffic goes through the staged credentials of a push service provider. It is shared by the instances using the same database.
+type stagingState struct {
+	Service string `json:"service"`
+	// Percent is the percentage of delivery points (always the same ones for a given percentage) pushed to with the staged credentials.
+	Percent int `json:"percent"`
+	// Staged is the unix timestamp when the credentials were staged.
+	Staged int64 `json:"staged"`
+}
+
+// StagingResults counts the results of the pushes sent by this instance with one of the credentials of a push service provider, since they were staged.
+type StagingResults struct {
+	Accepted int64 `json:"accepted"`
+	// Failed counts the errors caused by the push service provider (e.g. rejected credentials), rather than by delivery points or payloads.
+	Failed      int64 `json:"failed"`
+	OtherErrors int64 `json:"otherErrors"`
+}
+
+func (r *StagingResults) record(err push.Error) {
+	switch {
+	case err == nil:
+		atomic.AddInt64(&r.Accepted, 1)
+	case isFailoverError(err):
+		atomic.AddInt64(&r.Failed, 1)
+	default:
+		atomic.AddInt64(&r.OtherErrors, 1)
+	}
+}
+
+func (r *StagingResults) snapshot() StagingResults {
+	return StagingResults{
+		Accepted:    atomic.LoadInt64(&r.Accepted),
+		Failed:      atomic.LoadInt64(&r.Failed),
+		OtherErrors: atomic.LoadInt64(&r.OtherErrors),
+	}
+}
+
+// StagedPushServiceProvider describes the staged credentials of a push service provider, for /stagedpsps.
+type StagedPushServiceProvider struct {
+	PushServiceProvider string `json:"pushServiceProvider"`
+	Service             string `json:"service"`
+	Percent             int    `json:"percent"`
+	Staged              int64  `json:"staged"`
+	// StagedResults and LiveResults are the results of the pushes sent by the instance responding with the staged and the current credentials.
+	StagedResults StagingResults `json:"stagedResults"`
+	LiveResults   StagingResults `json:"liveResults"`
+}
+
+// stagedPSP is a push service provider with staged credentials, and the results of both credentials.
+type stagedPSP struct {
+	psp   *push.PushServiceProvider
+	state stagingState
+	// staged and live are kept when the staging is reloaded, and reset when credentials are staged again.
+	staged *StagingResults
+	live   *StagingResults
+}
+
+// pspStaging sends part of the pushes of push service providers with staged credentials (e.g. a new APNs key), so that new credentials can be
+// checked with real traffic before being promoted to replace the current ones, or rolled back. Each delivery point always uses the same credentials
+// for a given percentage, so raising the percentage only moves more delivery points to the staged credentials.
+type pspStaging struct {
+	db     db.PushDatabase
+	logger log.Logger
+
+	mutex    sync.RWMutex
+	staged   map[string]*stagedPSP
+	stopChan chan struct{}
+	now      func() time.Time
+}
+
+func newPSPStaging(database db.PushDatabase, logger log.Logger) *pspStaging {
+	return &pspStaging{
+		db:       database,
+		logger:   logger,
+		staged:   make(map[string]*stagedPSP),
+		stopChan: make(chan struct{}),
+		now:      time.Now,
+	}
+}
+
+// Run loads the staged credentials, then reloads them every refresh interval until Stop is called.
+func (s *pspStaging) Run() {
+	s.refresh()
+	go func() {
+		ticker := time.NewTicker(stagingRefreshInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.stopChan:
+				return
+			case <-ticker.C:
+				s.refresh()
+			}
+		}
+	}()
+}
+
+// Stop stops reloading the staged credentials.
+func (s *pspStaging) Stop() {
+	if s == nil {
+		return
+	}
+	close(s.stopChan)
+}
+
+func (s *pspStaging) refresh() {
+	saved, err := s.db.GetStagedPushServiceProviders()
+	if err != nil {
+		s.logger.Errorf("Cannot load the staged credentials of push service providers: %v", err)
+		return
+	}
+	staged := make(map[string]*stagedPSP, len(saved))
+	for name, entry := range saved {
+		var state stagingState
+		if err := json.Unmarshal(entry.State, &state); err != nil {
+			s.logger.Errorf("PushServiceProvider=%v Invalid staging: %v", name, err)
+			continue
+		}
+		redaction.addPushServiceProvider(entry.PushServiceProvider)
+		staged[name] = &stagedPSP{psp: entry.PushServiceProvider, state: state}
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for name, p := range staged {
+		if old, ok := s.staged[name]; ok && old.state.Staged == p.state.Staged {
+			p.staged, p.live = old.staged, old.live
+		} else {
+			p.staged, p.live = new(StagingResults), new(StagingResults)
+		}
+	}
+	s.staged = staged
+}
+
+// route returns the push service provider with the staged credentials of psp if dp is pushed to with them, and whether psp has staged credentials.
+func (s *pspStaging) route(psp *push.PushServiceProvider, dp *push.DeliveryPoint) (staged *push.PushServiceProvider, tracked bool) {
+	if s == nil {
+		return nil, false
+	}
+	s.mutex.RLock()
+	p, ok := s.staged[psp.Name()]
+	s.mutex.RUnlock()
+	if !ok {
+		return nil, false
+	}
+	if p.state.Percent > 0 && p.psp.PushServiceName() == dp.PushServiceName() && stagingBucket(dp.Name()) < p.state.Percent {
+		return p.psp, true
+	}
+	return nil, true
+}
+
+// stagingBucket returns the bucket (0 to 99) of a delivery point. Delivery points in the buckets below the percentage use the staged credentials.
+func stagingBucket(dpName string) int {
+	h := fnv.New32a()
+	h.Write([]byte(dpName))
+	return int(h.Sum32() % 100)
+}
+
+// observe returns a channel with the results of in, which are counted as results of the staged (or current) credentials of the push service provider pspName.
+func (s *pspStaging) observe(pspName string, staged bool, in <-chan *push.Result) <-chan *push.Result {
+	s.mutex.RLock()
+	p, ok := s.staged[pspName]
+	s.mutex.RUnlock()
+	if !ok {
+		return in
+	}
+	results := p.live
+	if staged {
+		results = p.staged
+	}
+	out := make(chan *push.Result)
+	go func() {
+		for res := range in {
+			results.record(res.Err)
+			out <- res
+		}
+		close(out)
+	}()
+	return out
+}
+
+// Stage saves psp as the staged credentials of the push service provider with the same name, which must be a push service provider of service,
+// and sends percent of the pushes with them.
+func (s *pspStaging) Stage(service string, psp *push.PushServiceProvider, percent int) error {
+	name := psp.Name()
+	ok, err := s.ofService(service, name)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("no push service provider of service %s has the fields of %s: only credentials can be staged", service, name)
+	}
+	return s.save(psp, stagingState{Service: service, Percent: percent, Staged: s.now().Unix()})
+}
+
+// ofService returns true if pspName is one of the push service providers of service.
+// The service of the staged credentials isn't enough, since the names of push service providers don't always include their service,
+// and the API keys of tenants are only checked against the service of the request.
+func (s *pspStaging) ofService(service, pspName string) (bool, error) {
+	names, err := s.db.GetPushServiceProvidersByService(service)
+	if err != nil {
+		return false, err
+	}
+	for _, name := range names {
+		if name == pspName {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// SetPercent changes the percentage of the pushes sent with the staged credentials of the push service provider pspName of service.
+func (s *pspStaging) SetPercent(service, pspName string, percent int) error {
+	p, err := s.get(service, pspName)
+	if err != nil {
+		return err
+	}
+	state := p.state
+	state.Percent = percent
+	return s.save(p.psp, state)
+}
+
+// Promote replaces the credentials of the push service provider pspName of service with its staged credentials, and returns it.
+func (s *pspStaging) Promote(service, pspName string) (*push.PushServiceProvider, error) {
+	p, err := s.get(service, pspName)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.db.ModifyPushServiceProvider(p.psp); err != nil {
+		return nil, err
+	}
+	if err := s.remove(pspName); err != nil {
+		return nil, err
+	}
+	return p.psp, nil
+}
+
+// Rollback removes the staged credentials of the push service provider pspName of service, and returns them.
+func (s *pspStaging) Rollback(service, pspName string) (*push.PushServiceProvider, error) {
+	p, err := s.get(service, pspName)
+	if err != nil {
+		return nil, err
+	}
+	return p.psp, s.remove(pspName)
+}
+
+// List returns the push service providers of service (or of every service if service is "") with staged credentials, by name.
+func (s *pspStaging) List(service string) []StagedPushServiceProvider {
+	list := []StagedPushServiceProvider{}
+	if s == nil {
+		return list
+	}
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	for name, p := range s.staged {
+		if service != "" && p.state.Service != service {
+			continue
+		}
+		list = append(list, StagedPushServiceProvider{
+			PushServiceProvider: name,
+			Service:             p.state.Service,
+			Percent:             p.state.Percent,
+			Staged:              p.state.Staged,
+			StagedResults:       p.staged.snapshot(),
+			LiveResults:         p.live.snapshot(),
+		})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].PushServiceProvider < list[j].PushServiceProvider })
+	return list
+}
+
+// get returns the staging of the push service provider pspName of service, reloading the staged credentials first in case another instance changed them.
+func (s *pspStaging) get(service, pspName string) (*stagedPSP, error) {
+	ofService, err := s.ofService(service, pspName)
+	if err != nil {
+		return nil, err
+	}
+	s.refresh()
+	s.mutex.RLock()
+	p, ok := s.staged[pspName]
+	s.mutex.RUnlock()
+	if !ofService || !ok || p.state.Service != service {
+		return nil, fmt.Errorf("the push service provider %s of service %s has no staged credentials", pspName, service)
+	}
+	return p, nil
+}
+
+func (s *pspStaging) save(psp *push.PushServiceProvider, state stagingState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if err := s.db.SetStagedPushServiceProvider(psp, data); err != nil {
+		return err
+	}
+	redaction.addPushServiceProvider(psp)
+	s.refresh()
+	return nil
+}
+
+func (s *pspStaging) remove(pspName string) error {
+	if err := s.db.RemoveStagedPushServiceProvider(pspName); err != nil {
+		return err
+	}
+	s.refresh()
+	return nil
+}
+
+// getStagingPercent returns the percent parameter, 0 if it isn't set.
+func getStagingPercent(kv map[string]string) (int, error) {
+	v, ok := kv["percent"]
+	if !ok {
+		return 0, nil
+	}
+	percent, err := strconv.Atoi(v)
+	if err != nil || percent < 0 || percent > 100 {
+		return 0, fmt.Errorf("invalid percent %q: must be between 0 and 100", v)
+	}
+	return percent, nil
+}
+
+// stagePushServiceProvider stages the credentials in the parameters (which are the same as /addpsp) for the push service provider with the same other fields,
+// and sends percent (0 by default) of its pushes with them. Unless validate=0, the push service must accept the credentials.
+func (api *RestAPI) stagePushServiceProvider(kv map[string]string, logger log.Logger, remoteAddr, apiKey string) APIResponseDetails {
+	percent, err := getStagingPercent(kv)
+	if err != nil {
+		return APIResponseDetails{From: &remoteAddr, Code: UNIQUSH_ERROR_GENERIC, ErrorMsg: strPtrOfErr(err)}
+	}
+	delete(kv, "percent")
+	validate := kv["validate"] != "0"
+	delete(kv, "validate")
+	psp, err := api.psm.BuildPushServiceProviderFromMap(kv)
+	if err != nil {
+		logger.Errorf("From=%v Cannot build push service provider: %v", remoteAddr, err)
+		return APIResponseDetails{From: &remoteAddr, Code: UNIQUSH_ERROR_BUILD_PUSH_SERVICE_PROVIDER, ErrorMsg: strPtrOfErr(err)}
+	}
+	service, err := getServiceFromMap(kv)
+	if err != nil {
+		return APIResponseDetails{From: &remoteAddr, Service: &service, Code: UNIQUSH_ERROR_CANNOT_GET_SERVICE, ErrorMsg: strPtrOfErr(err)}
+	}
+	pspName := psp.Name()
+	if validate {
+		if err := api.validateCredentials(psp); err != nil {
+			logger.Errorf("From=%v Service=%v PushServiceProvider=%v Invalid staged credentials: %v", remoteAddr, service, pspName, err)
+			return APIResponseDetails{From: &remoteAddr, Service: &service, PushServiceProvider: &pspName, Code: UNIQUSH_ERROR_INVALID_CREDENTIALS, ErrorMsg: strPtrOfErr(err)}
+		}
+	}
+	record := AuditRecord{Action: AuditStagePSP, From: remoteAddr, APIKey: apiKey, Service: service, PushServiceProvider: pspName}
+	if psps, err := api.backend.db.GetPushServiceProviders([]string{pspName}); err == nil && psps[pspName] != nil {
+		record.Changes = diffFields(encodePSPForAPI(psps[pspName]), encodePSPForAPI(psp))
+	}
+	err = api.backend.staging.Stage(service, psp, percent)
+	return api.stagingResponse(record, err, logger, fmt.Sprintf("Staged credentials for %d%% of the pushes", percent))
+}
+
+// changeStaging sets the percentage of the pushes sent with the staged credentials of the push service provider named by pushserviceprovider
+// (/setstagedpercent), promotes them to replace its credentials (/promotepsp), or rolls them back (/rollbackpsp).
+func (api *RestAPI) changeStaging(action string, kv map[string]string, logger log.Logger, remoteAddr, apiKey string) APIResponseDetails {
+	service, err := getServiceFromMap(kv)
+	if err != nil {
+		return APIResponseDetails{From: &remoteAddr, Service: &service, Code: UNIQUSH_ERROR_CANNOT_GET_SERVICE, ErrorMsg: strPtrOfErr(err)}
+	}
+	pspName := kv["pushserviceprovider"]
+	record := AuditRecord{Action: action, From: remoteAddr, APIKey: apiKey, Service: service, PushServiceProvider: pspName}
+	switch action {
+	case AuditSetStagedPercent:
+		percent, err := getStagingPercent(kv)
+		if err == nil {
+			err = api.backend.staging.SetPercent(service, pspName, percent)
+		}
+		return api.stagingResponse(record, err, logger, fmt.Sprintf("Sending %d%% of the pushes with the staged credentials", percent))
+	case AuditPromotePSP:
+		promoted, err := api.backend.staging.Promote(service, pspName)
+		if err == nil {
+			record.Changes = diffFields(nil, encodePSPForAPI(promoted))
+		}
+		return api.stagingResponse(record, err, logger, "Promoted the staged credentials")
+	default:
+		_, err := api.backend.staging.Rollback(service, pspName)
+		return api.stagingResponse(record, err, logger, "Rolled back the staged credentials")
+	}
+}
+
+// stagingResponse records a change of staged credentials in the audit log, logs it, and returns its response.
+func (api *RestAPI) stagingResponse(record AuditRecord, err error, logger log.Logger, success string) APIResponseDetails {
+	details := APIResponseDetails{From: &record.From, Service: &record.Service, PushServiceProvider: &record.PushServiceProvider, Code: UNIQUSH_SUCCESS}
+	record.Code = UNIQUSH_SUCCESS
+	if err != nil {
+		errorMsg := redactedError(err)
+		details.Code, details.ErrorMsg = UNIQUSH_ERROR_GENERIC, &errorMsg
+		record.Code, record.ErrorMsg = UNIQUSH_ERROR_GENERIC, errorMsg
+		logger.Errorf("From=%v Service=%v PushServiceProvider=%v Action=%v Failed: %v", record.From, record.Service, record.PushServiceProvider, record.Action, errorMsg)
+	} else {
+		logger.Infof("From=%v Service=%v PushServiceProvider=%v Action=%v %v", record.From, record.Service, record.PushServiceProvider, record.Action, success)
+	}
+	api.backend.audit.add(record)
+	return details
+}
+
+// queryStagedPushServiceProviders returns the push service providers of service (or of every service) with staged credentials, and the results of both credentials.
+func (api *RestAPI) queryStagedPushServiceProviders(service string) []byte {
+	type responseType struct {
+		PushServiceProviders []StagedPushServiceProvider `json:"pushServiceProviders"`
+		Code                 string                      `json:"code"`
+	}
+	json, err := json.Marshal(responseType{PushServiceProviders: api.backend.staging.List(service), Code: UNIQUSH_SUCCESS})
+	if err != nil {
+		return []byte("Failed to serialize response")
+	}
+	return json
+}
@@ -0,0 +1,225 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/uniqush/log"
+	"github.com/uniqush/uniqush-push/db"
+	"github.com/uniqush/uniqush-push/push"
+	"github.com/uniqush/uniqush-push/testutil"
+)
+
+// stagingDatabase keeps the push service providers and their staged credentials in memory.
+type stagingDatabase struct {
+	db.PushDatabase
+	psps   map[string]*push.PushServiceProvider
+	staged map[string]db.StagedPushServiceProvider
+}
+
+func (d *stagingDatabase) GetPushServiceProviders(names []string) (map[string]*push.PushServiceProvider, error) {
+	psps := make(map[string]*push.PushServiceProvider)
+	for _, name := range names {
+		if psp, ok := d.psps[name]; ok {
+			psps[name] = psp
+		}
+	}
+	return psps, nil
+}
+
+func (d *stagingDatabase) GetPushServiceProvidersByService(service string) ([]string, error) {
+	var names []string
+	for name, psp := range d.psps {
+		if psp.FixedData["service"] == service {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+func (d *stagingDatabase) ModifyPushServiceProvider(psp *push.PushServiceProvider) error {
+	d.psps[psp.Name()] = psp
+	return nil
+}
+
+func (d *stagingDatabase) SetStagedPushServiceProvider(psp *push.PushServiceProvider, state []byte) error {
+	d.staged[psp.Name()] = db.StagedPushServiceProvider{PushServiceProvider: psp, State: state}
+	return nil
+}
+
+func (d *stagingDatabase) GetStagedPushServiceProviders() (map[string]db.StagedPushServiceProvider, error) {
+	staged := make(map[string]db.StagedPushServiceProvider, len(d.staged))
+	for name, entry := range d.staged {
+		staged[name] = entry
+	}
+	return staged, nil
+}
+
+func (d *stagingDatabase) RemoveStagedPushServiceProvider(name string) error {
+	delete(d.staged, name)
+	return nil
+}
+
+func newStagingTestPSP(t *testing.T, key string) *push.PushServiceProvider {
+	return newStagingTestPSPOfService(t, "myservice", key)
+}
+
+func newStagingTestPSPOfService(t *testing.T, service, key string) *push.PushServiceProvider {
+	psm := push.GetPushServiceManager()
+	psp, err := psm.BuildPushServiceProviderFromMap(map[string]string{"service": service, "pushservicetype": benchPushServiceName})
+	if err != nil {
+		t.Fatalf("Cannot build the push service provider: %v", err)
+	}
+	psp.VolatileData["key"] = key
+	return psp
+}
+
+func newStagingTestDeliveryPoint(t *testing.T, token string) *push.DeliveryPoint {
+	dp, err := push.GetPushServiceManager().BuildDeliveryPointFromMap(map[string]string{"service": "myservice", "subscriber": "sub", "pushservicetype": benchPushServiceName, "token": token})
+	if err != nil {
+		t.Fatalf("Cannot build the delivery point: %v", err)
+	}
+	return dp
+}
+
+func newTestPSPStaging(t *testing.T) (*pspStaging, *stagingDatabase, *push.PushServiceProvider) {
+	psm := push.GetPushServiceManager()
+	psm.ClearAllPushServiceTypesForUnitTest()
+	psm.RegisterPushServiceType(newBenchPushServiceType(0))
+	live := newStagingTestPSP(t, "old")
+	database := &stagingDatabase{
+		psps:   map[string]*push.PushServiceProvider{live.Name(): live},
+		staged: make(map[string]db.StagedPushServiceProvider),
+	}
+	staging := newPSPStaging(database, log.NewLogger(ioutil.Discard, "", log.LOGLEVEL_SILENT))
+	staging.now = func() time.Time { return time.Unix(1500000000, 0) }
+	return staging, database, live
+}
+
+func TestPSPStagingRoute(t *testing.T) {
+	staging, _, live := newTestPSPStaging(t)
+	dp := newStagingTestDeliveryPoint(t, "token")
+	_, tracked := staging.route(live, dp)
+	testutil.ExpectEquals(t, false, tracked, "expected push service providers without staged credentials to be left alone")
+
+	if err := staging.Stage("myservice", newStagingTestPSP(t, "new"), 0); err != nil {
+		t.Fatalf("Unexpected error staging the credentials: %v", err)
+	}
+	staged, tracked := staging.route(live, dp)
+	testutil.ExpectEquals(t, true, tracked, "expected the results of the current credentials to be counted")
+	testutil.ExpectEquals(t, (*push.PushServiceProvider)(nil), staged, "expected no delivery point to use the staged credentials at 0%")
+
+	if err := staging.SetPercent("myservice", live.Name(), 100); err != nil {
+		t.Fatalf("Unexpected error setting the percentage: %v", err)
+	}
+	staged, _ = staging.route(live, dp)
+	testutil.ExpectStringEquals(t, "new", staged.VolatileData["key"], "expected every delivery point to use the staged credentials at 100%")
+
+	var nilStaging *pspStaging
+	_, tracked = nilStaging.route(live, dp)
+	testutil.ExpectEquals(t, false, tracked, "expected a nil staging to route nothing")
+}
+
+func TestPSPStagingRequiresLivePSP(t *testing.T) {
+	staging, database, live := newTestPSPStaging(t)
+	delete(database.psps, live.Name())
+	if err := staging.Stage("myservice", newStagingTestPSP(t, "new"), 10); err == nil {
+		t.Fatal("Expected credentials of an unknown push service provider not to be staged")
+	}
+	if err := staging.SetPercent("myservice", live.Name(), 10); err == nil {
+		t.Fatal("Expected the percentage of unstaged credentials not to be set")
+	}
+}
+
+func TestPSPStagingObserve(t *testing.T) {
+	staging, _, live := newTestPSPStaging(t)
+	if err := staging.Stage("myservice", newStagingTestPSP(t, "new"), 50); err != nil {
+		t.Fatalf("Unexpected error staging the credentials: %v", err)
+	}
+	in := make(chan *push.Result, 3)
+	for _, err := range []push.Error{nil, push.NewBadDeliveryPointWithDetails(nil, "bad"), nil} {
+		res := push.NewResult()
+		res.Err = err
+		in <- res
+	}
+	close(in)
+	count := 0
+	for range staging.observe(live.Name(), true, in) {
+		count++
+	}
+	testutil.ExpectEquals(t, 3, count, "expected every result to be forwarded")
+	list := staging.List("myservice")
+	testutil.ExpectEquals(t, 1, len(list), "expected the staged credentials to be listed")
+	testutil.ExpectEquals(t, StagingResults{Accepted: 2, OtherErrors: 1}, list[0].StagedResults, "expected the results of the staged credentials to be counted")
+	testutil.ExpectEquals(t, StagingResults{}, list[0].LiveResults, "expected the results of the current credentials to be separate")
+	testutil.ExpectEquals(t, 50, list[0].Percent, "expected the percentage to be listed")
+	testutil.ExpectEquals(t, 0, len(staging.List("otherservice")), "expected the list to be filtered by service")
+
+	staging.refresh()
+	testutil.ExpectEquals(t, int64(2), staging.List("")[0].StagedResults.Accepted, "expected the results to be kept when reloading")
+}
+
+func TestPSPStagingPromoteAndRollback(t *testing.T) {
+	staging, database, live := newTestPSPStaging(t)
+	if err := staging.Stage("myservice", newStagingTestPSP(t, "new"), 10); err != nil {
+		t.Fatalf("Unexpected error staging the credentials: %v", err)
+	}
+	if _, err := staging.Promote("otherservice", live.Name()); err == nil {
+		t.Fatal("Expected credentials staged for another service not to be promoted")
+	}
+	if _, err := staging.Promote("myservice", live.Name()); err != nil {
+		t.Fatalf("Unexpected error promoting the credentials: %v", err)
+	}
+	testutil.ExpectStringEquals(t, "new", database.psps[live.Name()].VolatileData["key"], "expected the staged credentials to replace the current ones")
+	testutil.ExpectEquals(t, 0, len(database.staged), "expected the promoted credentials to be unstaged")
+
+	if err := staging.Stage("myservice", newStagingTestPSP(t, "newer"), 10); err != nil {
+		t.Fatalf("Unexpected error staging the credentials: %v", err)
+	}
+	if _, err := staging.Rollback("myservice", live.Name()); err != nil {
+		t.Fatalf("Unexpected error rolling back the credentials: %v", err)
+	}
+	testutil.ExpectStringEquals(t, "new", database.psps[live.Name()].VolatileData["key"], "expected a rollback to keep the current credentials")
+	testutil.ExpectEquals(t, 0, len(staging.List("")), "expected the rolled back credentials to be unstaged")
+}
+
+func TestGetStagingPercent(t *testing.T) {
+	percent, err := getStagingPercent(map[string]string{})
+	testutil.ExpectEquals(t, 0, percent, "expected 0% by default")
+	testutil.ExpectEquals(t, nil, err, "expected the percentage to be optional")
+	percent, _ = getStagingPercent(map[string]string{"percent": "25"})
+	testutil.ExpectEquals(t, 25, percent, "expected the percentage to be parsed")
+	for _, v := range []string{"-1", "101", "x"} {
+		if _, err := getStagingPercent(map[string]string{"percent": v}); err == nil {
+			t.Errorf("Expected percent=%s to be rejected", v)
+		}
+	}
+}
+
+func TestPSPStagingRequiresPSPOfService(t *testing.T) {
+	staging, database, live := newTestPSPStaging(t)
+	other := newStagingTestPSPOfService(t, "otherservice", "other")
+	database.psps[other.Name()] = other
+
+	if err := staging.Stage("otherservice", newStagingTestPSP(t, "new"), 100); err == nil {
+		t.Fatal("Expected credentials of a push service provider of another service not to be staged")
+	}
+	testutil.ExpectEquals(t, 0, len(database.staged), "expected nothing to be staged")
+
+	// Credentials staged for the push service provider, but as if they were of another service (e.g. before the push service provider was checked).
+	state, _ := json.Marshal(stagingState{Service: "otherservice", Percent: 100})
+	database.staged[live.Name()] = db.StagedPushServiceProvider{PushServiceProvider: newStagingTestPSP(t, "new"), State: state}
+	if err := staging.SetPercent("otherservice", live.Name(), 50); err == nil {
+		t.Error("Expected the percentage of a push service provider of another service not to be set")
+	}
+	if _, err := staging.Promote("otherservice", live.Name()); err == nil {
+		t.Error("Expected the credentials of a push service provider of another service not to be promoted")
+	}
+	if _, err := staging.Rollback("otherservice", live.Name()); err == nil {
+		t.Error("Expected the credentials of a push service provider of another service not to be rolled back")
+	}
+	testutil.ExpectStringEquals(t, "old", database.psps[live.Name()].VolatileData["key"], "expected the credentials of the push service provider to be left alone")
+	testutil.ExpectEquals(t, 1, len(database.staged), "expected the staged credentials to be left alone")
+}
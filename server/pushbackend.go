@@ -0,0 +1,989 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/uniqush/log"
+	"github.com/uniqush/uniqush-push/db"
+	"github.com/uniqush/uniqush-push/push"
+	"github.com/uniqush/uniqush-push/tracing"
+)
+
+// pairsBatchSize is the number of subscriptions of a push whose push service providers are fetched from the database together.
+const pairsBatchSize = 50
+
+// PushBackEnd contains the data structures associated with sending pushes, managing subscriptions, and logging the results.
+type PushBackEnd struct {
+	psm     *push.PushServiceManager
+	db      db.PushDatabase
+	loggers []log.Logger
+	errChan chan push.Error
+	// jobs prevents pushes with a job id from being sent more than once by instances sharing the database. If nil, job ids are ignored.
+	jobs *jobRunner
+	// diagnostics is the self-check run at startup. If nil, /diagnostics has no report.
+	diagnostics *diagnostics
+	// maintenance holds the pushes of services in maintenance mode instead of sending them. If nil, pushes are never held.
+	maintenance *maintenanceMode
+	// staging sends part of the pushes of push service providers with staged credentials with them. If nil, credentials can't be staged.
+	staging *pspStaging
+	// journal writes the changes to subscriptions to a file before saving them, so that they can be replayed. If nil, changes aren't journaled.
+	journal *operationJournal
+	// features enables subsystems for some services while they are rolled out. If nil, every feature flag is disabled.
+	features *featureFlags
+	// cluster elects the instance running the jobs which only need to run once, and splits broadcasts and reconciliations between instances. If nil, this instance runs all of them.
+	cluster *cluster
+	// breaker sends pushes straight to the fallback of push service providers which keep failing. If nil, pushes only fail over after failing.
+	breaker *pspCircuitBreaker
+	// retryPolicies contains the retry policy of each service. If nil, the default retry policy is used.
+	retryPolicies *RetryPolicies
+	// retries are the retries of failed pushes waiting for their interval, which are sent right away by Finalize.
+	retries pendingRetries
+	// payloadPolicies restricts the parameters of the pushes of each service. If nil, every payload is allowed.
+	payloadPolicies *PayloadPolicies
+	// secrets resolves the secret references (vault://, awssm://) of push service providers before pushing. If nil, references are sent as is.
+	secrets *secretResolver
+	// quarantine stops sending payloads which push services keep rejecting. If nil, payloads are never quarantined.
+	quarantine *payloadQuarantine
+	// history saves the results of pushes to each subscriber. If nil, results aren't saved.
+	history *deliveryHistory
+	// inbox saves pushes to the inboxes of subscribers, as the inbox push service type. If nil, the inbox push service type isn't registered.
+	inbox *inbox
+	// analytics counts the results of pushes by service and hour. If nil, results aren't counted.
+	analytics *analytics
+	// events exports the results of pushes and engagement to external analytics (e.g. kafka or S3), and to tail. If nil, events are disabled.
+	events *eventExporter
+	// tail streams the events to the clients of /events on the admin listener.
+	tail *eventTail
+	// usage counts the requests and accepted notifications of each API key by day. If nil, usage isn't metered.
+	usage *usageMeter
+	// audit records administrative operations, such as changes to push service providers. If nil, they aren't recorded.
+	audit *auditLog
+	// apiKeys checks the API keys of requests, if they are enabled. If nil, every request is allowed.
+	apiKeys *apiKeyStore
+	// subscribeAbuse blocks addresses and device tokens subscribing too many subscribers. If nil, subscribes aren't checked.
+	subscribeAbuse *subscribeAbuseDetector
+	// clientCerts authorizes requests with the scopes of the SANs of their client certificates instead of API keys. If nil, only API keys are checked.
+	clientCerts *clientCertIdentities
+	// network rejects requests from addresses outside of the networks allowed for their endpoint. If nil, every address is allowed.
+	network *networkPolicy
+	// limiter rejects requests exceeding the rate limits of their address, API key or endpoint. If nil, requests aren't limited.
+	limiter *rateLimiter
+	// unsubscribeTokens issues and verifies the tokens with which end users remove their delivery points. If nil, tokens are disabled.
+	unsubscribeTokens *unsubscribeTokens
+	// signer verifies the HMAC signatures of requests. If nil, requests don't need to be signed.
+	signer *requestSigner
+	// tenants are the tenants owning services, whose quotas are enforced. If nil, services don't belong to tenants.
+	tenants *tenantStore
+	// slo alerts when the error rate of a push service provider is too high. If nil, error rates aren't tracked.
+	slo *pspSLO
+	// churn alerts when the unsubscribes of a service are far above their trailing baseline. If nil, subscriptions aren't tracked.
+	churn *churnDetector
+	// dashboard keeps the push rates and recent failures shown by /dashboard. If nil, they aren't kept.
+	dashboard *dashboardStats
+	// failures groups the failures of the last hour by cause for /failures. If nil, they aren't grouped.
+	failures *failureReport
+	// captures samples the payloads of the services being debugged with /payloads on the admin listener. If nil, payloads aren't captured.
+	captures *payloadCapture
+	// broadcasts sends pushes to every subscriber of a service matching a pattern in batches, and can resume them after a restart.
+	broadcasts *broadcaster
+	// load counts the pushes in progress, to reject new pushes when too many are queued. If nil, pushes are never rejected.
+	load *backpressure
+	// webhooks sends lifecycle events (e.g. invalidated tokens) to the webhooks of services. If nil, no webhooks are configured.
+	webhooks *webhookNotifier
+	// unsubscribes stages unsubscribes until they are confirmed or time out. If nil, unsubscribes are committed right away.
+	unsubscribes *unsubscribeStager
+	// canary periodically pushes to the canary subscriber of every service and alerts when a push service provider keeps failing. If nil, no canary pushes are sent.
+	canary *canary
+	// reconciler flags delivery points which their push services no longer recognize.
+	reconciler *reconciler
+	// replication logs changes to subscriptions for other regions, and applies theirs. If nil, subscriptions aren't replicated.
+	replication *replicator
+}
+
+// Finalize will save all subscriptions (and perform other cleanup) as part of the push service shutting down.
+// It waits until the deadline for broadcasts to save their checkpoint, for pending retries to be sent and for queued delivery records to be saved.
+func (backend *PushBackEnd) Finalize(deadline time.Time) {
+	logger := backend.loggers[LoggerWeb]
+	if backend.broadcasts != nil && !backend.broadcasts.Stop(deadline) {
+		logger.Warnf("Stopping: broadcasts didn't save their checkpoint before the deadline, their last batch will be sent again")
+	}
+	if !backend.retries.Flush(deadline) {
+		logger.Warnf("Stopping: some retries of failed pushes weren't sent before the deadline")
+	}
+	if backend.unsubscribes != nil {
+		backend.unsubscribes.Stop()
+	}
+	backend.canary.Stop()
+	if backend.reconciler != nil {
+		backend.reconciler.Stop()
+	}
+	if backend.replication != nil {
+		backend.replication.Stop()
+	}
+	backend.cluster.Stop()
+	backend.maintenance.Stop()
+	backend.staging.Stop()
+	backend.features.Stop()
+	if !backend.history.Flush(deadline) {
+		logger.Warnf("Stopping: some delivery records weren't saved before the deadline")
+	}
+	backend.analytics.Flush()
+	if !backend.events.Flush(deadline) {
+		logger.Warnf("Stopping: some events weren't exported before the deadline")
+	}
+	backend.events.Close()
+	backend.usage.Flush()
+	if !backend.webhooks.Flush(deadline) {
+		logger.Warnf("Stopping: some webhooks weren't sent before the deadline")
+	}
+	// TODO: Add an option to prevent calling SAVE in implementations such as redis.
+	// Users may want this if saving is time-consuming or already configured to happen periodically.
+	if err := backend.db.FlushCache(); err != nil {
+		logger.Errorf("Stopping: failed to flush the database: %v", err)
+	}
+	close(backend.errChan)
+	backend.psm.Finalize()
+	if err := backend.journal.Close(); err != nil {
+		logger.Errorf("Stopping: failed to close the journal: %v", err)
+	}
+}
+
+// NewPushBackEnd creates and sets up the only instance of the push implementation.
+func NewPushBackEnd(psm *push.PushServiceManager, database db.PushDatabase, loggers []log.Logger) *PushBackEnd {
+	ret := new(PushBackEnd)
+	ret.psm = psm
+	ret.db = database
+	ret.loggers = loggers
+	ret.errChan = make(chan push.Error)
+	go ret.processError()
+	psm.SetErrorReportChan(ret.errChan)
+	return ret
+}
+
+// AddPushServiceProvider is used by /addpsp to add a push service provider (for a service+push type) to the database.
+func (backend *PushBackEnd) AddPushServiceProvider(service string, psp *push.PushServiceProvider) error {
+	redaction.addPushServiceProvider(psp)
+	return backend.db.AddPushServiceProviderToService(service, psp)
+}
+
+// AddFallbackPushServiceProvider is used by /addpsp with fallback=1 to add the push service provider to fail over to, for the service's push service provider of the same push type.
+// Returns the name of the push service provider it is a fallback for.
+func (backend *PushBackEnd) AddFallbackPushServiceProvider(service string, psp *push.PushServiceProvider) (string, error) {
+	redaction.addPushServiceProvider(psp)
+	return backend.db.AddFallbackPushServiceProviderToService(service, psp)
+}
+
+// RemoveFallbackPushServiceProvider is used by /rmpsp with fallback=1 to remove a fallback push service provider.
+func (backend *PushBackEnd) RemoveFallbackPushServiceProvider(service string, psp *push.PushServiceProvider) error {
+	return backend.db.RemoveFallbackPushServiceProviderFromService(service, psp)
+}
+
+// ValidateCredentials asks the push service of psp (after resolving its secrets) whether it accepts the credentials of psp.
+// supported is false if the push service type can't check credentials.
+func (backend *PushBackEnd) ValidateCredentials(psp *push.PushServiceProvider) (supported bool, err error) {
+	resolved, err := backend.secrets.Resolve(psp)
+	if err != nil {
+		return true, err
+	}
+	return backend.psm.ValidateCredentials(resolved)
+}
+
+// RemovePushServiceProvider is used by /rmpsp to remove a push service provider (for a service+push type) from the database.
+func (backend *PushBackEnd) RemovePushServiceProvider(service string, psp *push.PushServiceProvider) error {
+	return backend.db.RemovePushServiceProviderFromService(service, psp)
+}
+
+// GetPushServiceProviderConfigs lists all known push service providers for /psps.
+func (backend *PushBackEnd) GetPushServiceProviderConfigs() ([]*push.PushServiceProvider, error) {
+	return backend.db.GetPushServiceProviderConfigs()
+}
+
+// Subscribe adds a new delivery point (subscription) for a service+subscriber to the database.
+func (backend *PushBackEnd) Subscribe(service, sub string, dp *push.DeliveryPoint) (*push.PushServiceProvider, error) {
+	if err := backend.tenants.addSubscriber(service, sub); err != nil {
+		return nil, err
+	}
+	if err := backend.journal.Record(ReplicationSubscribe, service, sub, dp); err != nil {
+		return nil, err
+	}
+	psp, err := backend.db.AddDeliveryPointToService(service, sub, dp)
+	if err == nil {
+		backend.unsubscribes.CancelForDeliveryPoint(service, sub, dp.Name())
+		backend.replication.Record(ReplicationSubscribe, service, sub, dp)
+		backend.churn.record(service, false)
+		backend.webhooks.Emit(WebhookEvent{Type: WebhookDeliveryPointAdded, Service: service, Subscriber: sub, DeliveryPoint: dp.Name(), PushServiceProvider: getProviderNameOrUnknown(psp)})
+	}
+	return psp, err
+}
+
+// Unsubscribe removes a delivery point (subscription) for a service+subscriber from the database.
+func (backend *PushBackEnd) Unsubscribe(service, sub string, dp *push.DeliveryPoint) error {
+	if err := backend.journal.Record(ReplicationUnsubscribe, service, sub, dp); err != nil {
+		return err
+	}
+	err := backend.db.RemoveDeliveryPointFromService(service, sub, dp)
+	if err == nil {
+		backend.tenants.removeSubscriber(service, sub)
+		backend.replication.Record(ReplicationUnsubscribe, service, sub, dp)
+		backend.churn.record(service, true)
+		backend.webhooks.Emit(WebhookEvent{Type: WebhookDeliveryPointRemoved, Service: service, Subscriber: sub, DeliveryPoint: dp.Name()})
+	}
+	return err
+}
+
+// removeInvalidatedDeliveryPoint removes a delivery point which the push service says is no longer valid, and notifies the service's webhook.
+func (backend *PushBackEnd) removeInvalidatedDeliveryPoint(reqID, service, sub string, provider *push.PushServiceProvider, dp *push.DeliveryPoint, code string) error {
+	if err := backend.journal.Record(ReplicationUnsubscribe, service, sub, dp); err != nil {
+		return err
+	}
+	err := backend.db.RemoveDeliveryPointFromService(service, sub, dp)
+	if err == nil {
+		backend.tenants.removeSubscriber(service, sub)
+		backend.replication.Record(ReplicationUnsubscribe, service, sub, dp)
+		backend.churn.record(service, true)
+		backend.webhooks.Emit(WebhookEvent{Type: WebhookTokenInvalidated, Service: service, Subscriber: sub, DeliveryPoint: dp.Name(), PushServiceProvider: provider.Name(), RequestID: reqID, Code: code})
+	}
+	return err
+}
+
+func (backend *PushBackEnd) processError() {
+	for err := range backend.errChan {
+		rid := randomUniqID()
+		nullHandler := &NullAPIResponseHandler{}
+		e := backend.fixError(rid, "", err, backend.loggers[LoggerPush], retryState{}, nullHandler)
+		if e != nil {
+			switch e0 := e.(type) {
+			case *push.InfoReport:
+				backend.loggers[LoggerPush].Infof("%v", e0)
+			default: // Includes *ErrorReport
+				backend.loggers[LoggerPush].Errorf("Error: %v", e0)
+			}
+		}
+	}
+}
+
+func (backend *PushBackEnd) fixError(
+	reqID string,
+	remoteAddr string,
+	event error,
+	logger log.Logger,
+	retry retryState,
+	handler APIResponseHandler,
+) error {
+	if event == nil {
+		return nil
+	}
+	switch err := event.(type) {
+	case *push.RetryError:
+		backend.fixRetryError(err, reqID, remoteAddr, logger, retry, handler)
+		return nil
+	case *push.PushServiceProviderUpdate:
+		backend.fixPushServiceProviderUpdate(err, reqID, remoteAddr, logger, handler)
+		return nil
+	case *push.DeliveryPointUpdate:
+		backend.fixDeliveryPointUpdate(err, reqID, remoteAddr, logger, handler)
+		return nil
+	case *push.InvalidRegistrationUpdate:
+		backend.fixInvalidRegistrationUpdate(err, reqID, remoteAddr, logger, handler)
+		return nil
+	case *push.UnsubscribeUpdate:
+		backend.fixUnsubscribeUpdate(err, reqID, remoteAddr, logger, handler)
+		return nil
+	default:
+		return err
+	}
+}
+
+// retryPolicyOf returns the retry policy for a push to the given service.
+func (backend *PushBackEnd) retryPolicyOf(service string, retry retryState) *RetryPolicy {
+	if retry.policy != nil {
+		return retry.policy
+	}
+	policy := backend.retryPolicies.ForService(service)
+	return &policy
+}
+
+// fixRetryError will retry sending the push with longer and longer intervals, and give up after the maximum number of attempts of the retry policy.
+func (backend *PushBackEnd) fixRetryError(
+	err *push.RetryError,
+	reqID string,
+	remoteAddr string,
+	logger log.Logger,
+	retry retryState,
+	handler APIResponseHandler,
+) {
+	if err.Provider == nil || err.Destination == nil || err.Content == nil {
+		return
+	}
+	var service string
+	var sub string
+	var ok bool
+
+	if service, ok = err.Provider.FixedData["service"]; !ok {
+		return
+	}
+
+	if sub, ok = err.Destination.FixedData["subscriber"]; !ok {
+		return
+	}
+	policy := backend.retryPolicyOf(service, retry)
+	attempt := retry.attempt
+	if attempt < 1 {
+		attempt = 1
+	}
+	class := RetryOnRetry
+	if _, isConnectionError := err.Reason.(*push.ConnectionError); isConnectionError {
+		class = RetryOnConnection
+	}
+	providerName := err.Provider.Name()
+	destinationName := err.Destination.Name()
+	if !policy.ShouldRetry(class, attempt) {
+		if backend.failover(reqID, remoteAddr, service, err.Provider, err.Destination, err.Content, logger, retry, handler) {
+			return
+		}
+		logger.Errorf("RequestID=%v Service=%v Subscriber=%v PushServiceProvider=%v DeliveryPoint=%v Failed after retry", reqID, service, sub, providerName, destinationName)
+		backend.webhooks.Emit(WebhookEvent{Type: WebhookPushFailedPermanently, Service: service, Subscriber: sub, DeliveryPoint: destinationName, PushServiceProvider: providerName, RequestID: reqID, Code: UNIQUSH_ERROR_FAILED_RETRY, ErrorMsg: redactedError(err)})
+		handler.AddDetailsToHandler(APIResponseDetails{RequestID: &reqID, From: &remoteAddr, Service: &service, Subscriber: &sub, PushServiceProvider: &providerName, DeliveryPoint: &destinationName, Code: UNIQUSH_ERROR_FAILED_RETRY})
+		return
+	}
+	after := policy.Interval(attempt)
+	logger.Infof("RequestID=%v Service=%v Subscriber=%v PushServiceProvider=%v DeliveryPoint=%v Attempt=%v Retry after %v", reqID, service, sub, providerName, destinationName, attempt, after)
+	backend.retries.schedule(after, func() {
+		subs := make([]string, 1)
+		subs[0] = sub
+		backend.pushImpl(retry.context(), reqID, remoteAddr, service, subs, nil, err.Content, nil, backend.loggers[LoggerPush], err.Provider, err.Destination, retryState{policy: policy, attempt: attempt + 1}, handler)
+	})
+}
+
+// failSecretResolution reports a connection error for every delivery point of psp, whose secrets couldn't be resolved, and closes resChan
+// like push services do once they are done.
+func failSecretResolution(psp *push.PushServiceProvider, dpQueue <-chan *push.DeliveryPoint, resChan chan<- *push.Result, notif *push.Notification, err error) {
+	for dp := range dpQueue {
+		resChan <- &push.Result{Provider: psp, Destination: dp, Content: notif, Err: push.NewConnectionError(err)}
+	}
+	close(resChan)
+}
+
+func (backend *PushBackEnd) fixPushServiceProviderUpdate(
+	err *push.PushServiceProviderUpdate,
+	reqID string,
+	remoteAddr string,
+	logger log.Logger,
+	handler APIResponseHandler,
+) {
+	if err.Provider == nil {
+		return
+	}
+	var service string
+	var ok bool
+
+	if service, ok = err.Provider.FixedData["service"]; !ok {
+		return
+	}
+	psp := backend.secrets.Unresolve(err.Provider)
+	e := backend.db.ModifyPushServiceProvider(psp)
+	pspName := psp.Name()
+	if e != nil {
+		logger.Errorf("RequestID=%v Service=%v PushServiceProvider=%v Update Failed: %v", reqID, service, pspName, e)
+		handler.AddDetailsToHandler(APIResponseDetails{RequestID: &reqID, From: &remoteAddr, Service: &service, PushServiceProvider: &pspName, Code: UNIQUSH_ERROR_UPDATE_PUSH_SERVICE_PROVIDER, ErrorMsg: strPtrOfErr(e)})
+	} else {
+		logger.Infof("RequestID=%v Service=%v PushServiceProvider=%v Update Success", reqID, service, pspName)
+		handler.AddDetailsToHandler(APIResponseDetails{RequestID: &reqID, From: &remoteAddr, Service: &service, PushServiceProvider: &pspName, Code: UNIQUSH_SUCCESS})
+	}
+}
+
+func (backend *PushBackEnd) fixDeliveryPointUpdate(
+	err *push.DeliveryPointUpdate,
+	reqID string,
+	remoteAddr string,
+	logger log.Logger,
+	handler APIResponseHandler,
+) {
+	if err.Destination == nil {
+		return
+	}
+	var service string
+	var sub string
+	var ok bool
+
+	if sub, ok = err.Destination.FixedData["subscriber"]; !ok {
+		return
+	}
+
+	if service, ok = err.Destination.FixedData["service"]; !ok {
+		service = ""
+	}
+	dp := err.Destination
+	e := backend.journal.Record(JournalModify, service, sub, dp)
+	if e == nil {
+		e = backend.db.ModifyDeliveryPoint(dp)
+	}
+	dpName := dp.Name()
+	if e != nil {
+		logger.Errorf("Subscriber=%v DeliveryPoint=%v Update Failed: %v", sub, dpName, e)
+		handler.AddDetailsToHandler(APIResponseDetails{RequestID: &reqID, From: &remoteAddr, Subscriber: &sub, Service: &service, DeliveryPoint: &dpName, Code: UNIQUSH_ERROR_UPDATE_DELIVERY_POINT, ErrorMsg: strPtrOfErr(e)})
+	} else {
+		logger.Infof("Service=%v Subscriber=%v DeliveryPoint=%v Update Success", service, sub, dpName)
+		handler.AddDetailsToHandler(APIResponseDetails{RequestID: &reqID, From: &remoteAddr, Subscriber: &sub, Service: &service, DeliveryPoint: &dpName, Code: UNIQUSH_SUCCESS, ModifiedDp: true})
+	}
+}
+
+func (backend *PushBackEnd) fixInvalidRegistrationUpdate(
+	err *push.InvalidRegistrationUpdate,
+	reqID string,
+	remoteAddr string,
+	logger log.Logger,
+	handler APIResponseHandler,
+) {
+	if err.Provider == nil || err.Destination == nil {
+		return
+	}
+
+	var service string
+	var sub string
+	var ok bool
+
+	if service, ok = err.Provider.FixedData["service"]; !ok {
+		return
+	}
+	if sub, ok = err.Destination.FixedData["subscriber"]; !ok {
+		return
+	}
+	dp := err.Destination
+	e := backend.removeInvalidatedDeliveryPoint(reqID, service, sub, err.Provider, dp, UNIQUSH_REMOVE_INVALID_REG)
+	dpName := dp.Name()
+	if e != nil {
+		logger.Errorf("Service=%v Subscriber=%v DeliveryPoint=%v Removing invalid reg failed: %v", service, sub, dpName, e)
+		handler.AddDetailsToHandler(APIResponseDetails{RequestID: &reqID, From: &remoteAddr, Service: &service, Subscriber: &sub, DeliveryPoint: &dpName, Code: UNIQUSH_REMOVE_INVALID_REG, ErrorMsg: strPtrOfErr(e)})
+	} else {
+		logger.Infof("Service=%v Subscriber=%v DeliveryPoint=%v Invalid registration removed", service, sub, dpName)
+		handler.AddDetailsToHandler(APIResponseDetails{RequestID: &reqID, From: &remoteAddr, Service: &service, Subscriber: &sub, DeliveryPoint: &dpName, Code: UNIQUSH_REMOVE_INVALID_REG})
+	}
+}
+
+func (backend *PushBackEnd) fixUnsubscribeUpdate(
+	err *push.UnsubscribeUpdate,
+	reqID string,
+	remoteAddr string,
+	logger log.Logger,
+	handler APIResponseHandler,
+) {
+	if err.Provider == nil || err.Destination == nil {
+		return
+	}
+	var service string
+	var sub string
+	var ok bool
+
+	if service, ok = err.Provider.FixedData["service"]; !ok {
+		return
+	}
+	if sub, ok = err.Destination.FixedData["subscriber"]; !ok {
+		return
+	}
+	dp := err.Destination
+	e := backend.removeInvalidatedDeliveryPoint(reqID, service, sub, err.Provider, dp, UNIQUSH_UPDATE_UNSUBSCRIBE)
+	dpName := dp.Name()
+	if e != nil {
+		logger.Errorf("Service=%v Subscriber=%v DeliveryPoint=%v Unsubscribe failed: %v", service, sub, dpName, e)
+		handler.AddDetailsToHandler(APIResponseDetails{RequestID: &reqID, From: &remoteAddr, Service: &service, Subscriber: &sub, DeliveryPoint: &dpName, Code: UNIQUSH_UPDATE_UNSUBSCRIBE, ErrorMsg: strPtrOfErr(e)})
+	} else {
+		logger.Infof("Service=%v Subscriber=%v DeliveryPoint=%v Unsubscribe success", service, sub, dpName)
+		handler.AddDetailsToHandler(APIResponseDetails{RequestID: &reqID, From: &remoteAddr, Service: &service, Subscriber: &sub, DeliveryPoint: &dpName, Code: UNIQUSH_UPDATE_UNSUBSCRIBE})
+	}
+}
+
+func getDeliveryPointNameOrUnknown(dp *push.DeliveryPoint) string {
+	if dp != nil {
+		return dp.Name()
+	}
+	return "Unknown"
+}
+
+func getProviderNameOrUnknown(provider *push.PushServiceProvider) string {
+	if provider != nil {
+		return provider.Name()
+	}
+	return "Unknown"
+}
+
+func (backend *PushBackEnd) collectResult(
+	reqID string,
+	remoteAddr string,
+	service string,
+	resChan <-chan *push.Result,
+	notif *push.Notification,
+	quarantined *quarantinedPayloads,
+	logger log.Logger,
+	retry retryState,
+	handler APIResponseHandler,
+) {
+	for res := range resChan {
+		backend.collectOneResult(reqID, remoteAddr, service, res, notif, quarantined, logger, retry, handler)
+		res.Release()
+	}
+}
+
+// collectOneResult logs and responds with the result of a push to one delivery point, and fixes errors (e.g. by retrying).
+func (backend *PushBackEnd) collectOneResult(
+	reqID string,
+	remoteAddr string,
+	service string,
+	res *push.Result,
+	notif *push.Notification,
+	quarantined *quarantinedPayloads,
+	logger log.Logger,
+	retry retryState,
+	handler APIResponseHandler,
+) {
+	// Errors of push services can include the credentials of the push service provider, which may have been added by another instance.
+	redaction.addPushServiceProvider(res.Provider)
+	recordPushResult(service, res)
+	backend.analytics.record(service, notificationCampaign(notif), res.Err)
+	backend.events.delivery(reqID, service, res, notif)
+	backend.dashboard.record(reqID, service, res)
+	backend.failures.record(reqID, service, res)
+	backend.captures.capture(reqID, service, res, notif)
+	if res.Provider != nil {
+		backend.slo.record(service, res.Provider.Name(), res.Err)
+	}
+	var sub string
+	ok := false
+	if res.Destination != nil {
+		sub, ok = res.Destination.FixedData["subscriber"]
+	}
+	if res.Provider != nil && res.Destination != nil {
+		if !ok {
+			destinationName := res.Destination.Name()
+			logger.Errorf("RequestID=%v Subscriber=%v DeliveryPoint=%v Bad Delivery Point: No subscriber", reqID, sub, destinationName)
+			handler.AddDetailsToHandler(APIResponseDetails{RequestID: &reqID, From: &remoteAddr, Service: &service, Subscriber: &sub, DeliveryPoint: &destinationName, Code: UNIQUSH_ERROR_BAD_DELIVERY_POINT})
+			return
+		}
+	}
+	var subRepr string
+	if ok {
+		subRepr = sub
+	} else {
+		subRepr = "Unknown"
+	}
+	if res.Err == nil {
+		dpName := getDeliveryPointNameOrUnknown(res.Destination)
+		pspName := getProviderNameOrUnknown(res.Provider)
+		backend.breaker.RecordSuccess(pspName)
+		msgID := res.MsgID
+		logger.Infof("RequestID=%v Service=%v Subscriber=%v PushServiceProvider=%v DeliveryPoint=%v MsgID=%v Success!", reqID, service, subRepr, pspName, dpName, msgID)
+		handler.AddDetailsToHandler(APIResponseDetails{RequestID: &reqID, From: &remoteAddr, Service: &service, Subscriber: &sub, PushServiceProvider: &pspName, DeliveryPoint: &dpName, MessageID: &msgID, Code: UNIQUSH_SUCCESS})
+		return
+	}
+	if ctxErr := retry.context().Err(); ctxErr != nil && !isPushUpdate(res.Err) {
+		// The push service request was canceled (or would be retried) after the deadline of the push, so it isn't the push service's fault.
+		dpName := getDeliveryPointNameOrUnknown(res.Destination)
+		pspName := getProviderNameOrUnknown(res.Provider)
+		logger.Errorf("RequestID=%v Service=%v Subscriber=%v PushServiceProvider=%v DeliveryPoint=%v Failed: %v: %v", reqID, service, subRepr, pspName, dpName, ctxErr, res.Err)
+		handler.AddDetailsToHandler(APIResponseDetails{RequestID: &reqID, From: &remoteAddr, Service: &service, Subscriber: &sub, PushServiceProvider: &pspName, DeliveryPoint: &dpName, Code: UNIQUSH_ERROR_DEADLINE_EXCEEDED, ErrorMsg: strPtrOfErr(res.Err)})
+		return
+	}
+	if _, isBadNotification := res.Err.(*push.BadNotification); isBadNotification && res.Provider != nil {
+		content := res.Content
+		if content == nil {
+			content = notif
+		}
+		if backend.quarantine.RecordFailure(reqID, service, res.Provider.PushServiceName(), content, res.Err) {
+			quarantined.Add(payloadFingerprint(res.Provider.PushServiceName(), content))
+		}
+	}
+	if isFailoverError(res.Err) && res.Provider != nil {
+		backend.breaker.RecordFailure(res.Provider.Name())
+		content := res.Content
+		if content == nil {
+			content = notif
+		}
+		if backend.failover(reqID, remoteAddr, service, res.Provider, res.Destination, content, logger, retry, handler) {
+			return
+		}
+		// Connection errors are reported without retrying, unless the retry policy says otherwise.
+		if connectionErr, ok := res.Err.(*push.ConnectionError); ok && res.Destination != nil && backend.retryPolicyOf(service, retry).RetryOn[RetryOnConnection] {
+			res.Err = push.NewRetryErrorWithReason(res.Provider, res.Destination, content, 0, connectionErr)
+		}
+	}
+	err := backend.fixError(reqID, remoteAddr, res.Err, logger, retry, handler)
+	if err != nil {
+		dpName := getDeliveryPointNameOrUnknown(res.Destination)
+		pspName := getProviderNameOrUnknown(res.Provider)
+		logger.Errorf("RequestID=%v Service=%v Subscriber=%v PushServiceProvider=%v DeliveryPoint=%v Failed: %v", reqID, service, subRepr, pspName, dpName, err)
+		backend.webhooks.Emit(WebhookEvent{Type: WebhookPushFailedPermanently, Service: service, Subscriber: sub, DeliveryPoint: dpName, PushServiceProvider: pspName, RequestID: reqID, Code: UNIQUSH_ERROR_GENERIC, ErrorMsg: redactedError(err)})
+		handler.AddDetailsToHandler(APIResponseDetails{RequestID: &reqID, From: &remoteAddr, Service: &service, Subscriber: &sub, PushServiceProvider: &pspName, DeliveryPoint: &dpName, Code: UNIQUSH_ERROR_GENERIC, ErrorMsg: strPtrOfErr(err)})
+	}
+}
+
+// isPushUpdate returns true if err asks for the subscription or push service provider to be updated, which is done even after the deadline of the push.
+func isPushUpdate(err error) bool {
+	switch err.(type) {
+	case *push.PushServiceProviderUpdate, *push.DeliveryPointUpdate, *push.InvalidRegistrationUpdate, *push.UnsubscribeUpdate:
+		return true
+	}
+	return false
+}
+
+// NumberOfDeliveryPoints returns the number of delivery points for a given service+subscriber.
+func (backend *PushBackEnd) NumberOfDeliveryPoints(service, sub string, logger log.Logger) int {
+	pspDpList, err := backend.db.GetPushServiceProviderDeliveryPointPairs(service, sub, nil)
+	if err != nil {
+		logger.Errorf("Query=NumberOfDeliveryPoints Service=%v Subscriber=%v Failed: Database Error %v", service, sub, err)
+		return 0
+	}
+	return len(pspDpList)
+}
+
+// ScanSubscribers returns a batch of the subscribers of a service matching pattern, starting at cursor (0 for the first batch). The returned cursor is 0 after the last batch.
+func (backend *PushBackEnd) ScanSubscribers(service, pattern string, cursor uint64, count int64) ([]string, uint64, error) {
+	return backend.db.ScanSubscribersOfService(service, pattern, cursor, count)
+}
+
+// DeliveryPointNamesOfSubscribers returns the names of the delivery points of each of the subscribers of a service.
+func (backend *PushBackEnd) DeliveryPointNamesOfSubscribers(service string, subs []string) (map[string][]string, error) {
+	pairs, errs := backend.db.GetPushServiceProviderDeliveryPointPairsOfSubscribers(context.Background(), service, subs, nil)
+	names := make(map[string][]string, len(subs))
+	for _, sub := range subs {
+		if err := errs[sub]; err != nil {
+			return nil, fmt.Errorf("Could not list the delivery points of subscriber %s: %v", sub, err)
+		}
+		for _, pair := range pairs[sub] {
+			names[sub] = append(names[sub], pair.DeliveryPoint.Name())
+		}
+	}
+	return names, nil
+}
+
+// Subscriptions returns the subscriptions for a subscriber name and a list of services.
+func (backend *PushBackEnd) Subscriptions(services []string, subscriber string, logger log.Logger, fetchIds bool) []map[string]string {
+	emptyResult := []map[string]string{}
+
+	log := func(msg string, err error) {
+		if nil == err {
+			logger.Infof("Service=%v Subscriber=%v %s", services, subscriber, msg)
+		} else {
+			logger.Errorf("Service=%v Subscriber=%v %s %v", services, subscriber, msg, err)
+		}
+	}
+
+	if len(subscriber) == 0 {
+		log("", errors.New("NoSubscriber"))
+		return emptyResult
+	}
+
+	subscriptions, err := backend.db.GetSubscriptions(services, subscriber, logger)
+	if err != nil {
+		log("", err)
+		return emptyResult
+	}
+	if !fetchIds {
+		for _, v := range subscriptions {
+			delete(v, db.DeliveryPointID)
+		}
+	}
+
+	return subscriptions
+}
+
+// RebuildServiceSet is necessary for querying the list of services (for installations predating 2.2.0)
+func (backend *PushBackEnd) RebuildServiceSet() error {
+	return backend.db.RebuildServiceSet()
+}
+
+// Push will send a push notification to the given subscriber(s) of a push service.
+// If retryPolicy is nil, failed pushes are retried according to the retry policy of the service.
+// The spans of the push are children of the span of ctx, if it is traced.
+func (backend *PushBackEnd) Push(ctx context.Context, reqID string, remoteAddr string, service string, subs []string, dpNamesRequested []string, notif *push.Notification, perdp map[string][]string, retryPolicy *RetryPolicy, logger log.Logger, handler APIResponseHandler) {
+	backend.load.begin()
+	defer backend.load.end()
+	defer backend.tenants.beginPush(service)()
+	start := time.Now()
+	ctx, span := tracing.Start(ctx, "push", tracing.KindInternal)
+	span.SetAttribute("uniqush.request_id", reqID)
+	span.SetAttribute("uniqush.service", service)
+	span.SetAttribute("uniqush.subscribers", len(subs))
+	backend.pushImpl(ctx, reqID, remoteAddr, service, subs, dpNamesRequested, notif, perdp, logger, nil, nil, retryState{policy: retryPolicy}, handler)
+	span.Finish()
+	logger.Infof("RequestID=%v Service=%v NrSubscribers=%v Latency=%v Finished", reqID, service, len(subs), time.Since(start))
+}
+
+// RetryPolicyFromRequest returns the retry policy of the service, with any overrides from the uniqush.retry.* parameters of kv (which are removed from kv).
+func (backend *PushBackEnd) RetryPolicyFromRequest(service string, kv map[string]string) (RetryPolicy, error) {
+	return backend.retryPolicies.retryPolicyFromRequest(service, kv)
+}
+
+// PushJob is like Push, but will only send the push if no instance sharing this database has already sent a push to the same service with the same jobID.
+// If the lease of the job is lost while it is being sent, the rest of the push is canceled, since another instance may claim and send it.
+// Returns false if the job was already claimed.
+func (backend *PushBackEnd) PushJob(ctx context.Context, jobID string, reqID string, remoteAddr string, service string, subs []string, dpNamesRequested []string, notif *push.Notification, perdp map[string][]string, retryPolicy *RetryPolicy, logger log.Logger, handler APIResponseHandler) (bool, error) {
+	send := func(lost <-chan struct{}) {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		go func() {
+			select {
+			case <-lost:
+				logger.Warnf("RequestID=%v Service=%v JobID=%v Lost the lease of the job, canceling the push", reqID, service, jobID)
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		backend.Push(ctx, reqID, remoteAddr, service, subs, dpNamesRequested, notif, perdp, retryPolicy, logger, handler)
+	}
+	if backend.jobs == nil {
+		send(nil)
+		return true, nil
+	}
+	return backend.jobs.RunOnce(service, jobID, send)
+}
+
+// pushImpl will fetch subscriptions and send push notifications using the corresponding service.
+// It will retry pushes if they fail (May be through sending an RetryError, or it may be within the psp implementation).
+func (backend *PushBackEnd) pushImpl(
+	ctx context.Context,
+	reqID string,
+	remoteAddr string,
+	service string,
+	subs []string,
+	dpNamesRequested []string,
+	notif *push.Notification,
+	perdp map[string][]string,
+	logger log.Logger,
+	provider *push.PushServiceProvider,
+	dest *push.DeliveryPoint,
+	retry retryState,
+	handler APIResponseHandler,
+) {
+	// dpChanMap maps a PushServiceProvider(by name) to a list of delivery points to send data to (from various subscriptions).
+	// If there are multiple subscriptions, lazily adding to a channel is probably faster than passing a list,
+	// because you'd need to fetch all subscriptions from the DB before starting to push otherwise.
+	dpChanMap := make(map[string]chan *push.DeliveryPoint)
+	// wg is used to wait for all pushes and push responses to complete before returning.
+	wg := new(sync.WaitGroup)
+	// Results are collected with retry, so retries made because of them are part of the same trace.
+	retry.ctx = ctx
+	// fallbacks caches the fallbacks of push service providers with an open circuit breaker.
+	fallbacks := make(map[string]*push.PushServiceProvider)
+	// fingerprints maps a PushServiceProvider(by name) to the fingerprint of the payload sent to it, if payloads can be quarantined.
+	fingerprints := make(map[string]string)
+	quarantined := newQuarantinedPayloads()
+
+	// batchPairs and batchErrs hold the pairs of the current batch of subscriptions, whose push service providers are fetched together.
+	var batchPairs map[string][]db.PushServiceProviderDeliveryPointPair
+	var batchErrs map[string]error
+
+	// Loop over all subscriptions, fetching the list of corresponding delivery points to send to from the db, starting to push and send pushes.
+	for i, sub := range subs {
+		// Once the deadline of the push passed, the remaining subscribers aren't looked up or pushed to.
+		if err := ctx.Err(); err != nil {
+			logger.Errorf("RequestID=%v Service=%v Subscriber=%v Failed: %v", reqID, service, sub, err)
+			handler.AddDetailsToHandler(APIResponseDetails{RequestID: &reqID, From: &remoteAddr, Service: &service, Subscriber: &sub, Code: UNIQUSH_ERROR_DEADLINE_EXCEEDED, ErrorMsg: strPtrOfErr(err)})
+			continue
+		}
+		dpidx := 0
+		var pspDpList []db.PushServiceProviderDeliveryPointPair
+		if provider != nil && dest != nil {
+			// Note: subs always has length 1 when dest != nil
+			pspDpList = make([]db.PushServiceProviderDeliveryPointPair, 1)
+			pspDpList[0].PushServiceProvider = provider
+			pspDpList[0].DeliveryPoint = dest
+		} else {
+			if i%pairsBatchSize == 0 {
+				end := i + pairsBatchSize
+				if end > len(subs) {
+					end = len(subs)
+				}
+				batchPairs, batchErrs = backend.db.GetPushServiceProviderDeliveryPointPairsOfSubscribers(ctx, service, subs[i:end], dpNamesRequested)
+			}
+			pspDpList = batchPairs[sub]
+			if err := batchErrs[sub]; err != nil {
+				code := UNIQUSH_ERROR_DATABASE
+				if err == ctx.Err() {
+					code = UNIQUSH_ERROR_DEADLINE_EXCEEDED
+				}
+				logger.Errorf("RequestID=%v Service=%v Subscriber=%v Failed: Database Error: %v", reqID, service, sub, err)
+				handler.AddDetailsToHandler(APIResponseDetails{RequestID: &reqID, From: &remoteAddr, Service: &service, Subscriber: &sub, Code: code, ErrorMsg: strPtrOfErr(err)})
+				continue
+			}
+		}
+
+		if len(pspDpList) == 0 {
+			logger.Errorf("RequestID=%v Service=%v Subscriber=%v Failed: No device", reqID, service, sub)
+			handler.AddDetailsToHandler(APIResponseDetails{RequestID: &reqID, From: &remoteAddr, Service: &service, Subscriber: &sub, Code: UNIQUSH_ERROR_NO_DEVICE})
+			continue
+		}
+
+		for _, pair := range pspDpList {
+			psp := pair.PushServiceProvider
+			dp := pair.DeliveryPoint
+			if psp == nil {
+				logger.Errorf("RequestID=%v Service=%v Subscriber=%v Failed once: nil Push Service Provider", reqID, service, sub)
+				handler.AddDetailsToHandler(APIResponseDetails{RequestID: &reqID, From: &remoteAddr, Service: &service, Subscriber: &sub, Code: UNIQUSH_ERROR_NO_PUSH_SERVICE_PROVIDER})
+				continue
+			}
+			if dp == nil {
+				logger.Errorf("RequestID=%v Service=%v Subscriber=%v Failed once: nil Delivery Point", reqID, service, sub)
+				handler.AddDetailsToHandler(APIResponseDetails{RequestID: &reqID, From: &remoteAddr, Service: &service, Subscriber: &sub, Code: UNIQUSH_ERROR_NO_DELIVERY_POINT})
+				continue
+			}
+			if provider == nil && backend.breaker.IsOpen(psp.Name()) {
+				fallback, ok := fallbacks[psp.Name()]
+				if !ok {
+					fallback = backend.fallbackFor(psp, dp, logger)
+					fallbacks[psp.Name()] = fallback
+				}
+				if fallback != nil && fallback.PushServiceName() == dp.PushServiceName() {
+					psp = fallback
+				}
+			}
+			// A share of the delivery points of a push service provider with staged credentials is pushed to with them.
+			var stagedPSP *push.PushServiceProvider
+			tracked := false
+			if provider == nil {
+				stagedPSP, tracked = backend.staging.route(psp, dp)
+			}
+			// Delivery points with an encryption key get their own queue, since their notifications are encrypted for them.
+			queueName := psp.Name()
+			if stagedPSP != nil {
+				psp = stagedPSP
+				queueName += "\x00staged"
+			}
+			encryptionKey := dp.VolatileData[push.EncryptionKey]
+			if encryptionKey != "" {
+				queueName += "\x00" + dp.Name()
+			}
+			var dpQueue chan *push.DeliveryPoint
+			var ok bool
+			if dpQueue, ok = dpChanMap[queueName]; !ok {
+				note := notif
+				if len(perdp) > 0 {
+					note = notif.Clone()
+					for k, v := range perdp {
+						value := v[dpidx%len(v)]
+						note.Data[k] = value
+					}
+					dpidx++
+				}
+				if backend.quarantine != nil {
+					fingerprint := payloadFingerprint(psp.PushServiceName(), note)
+					fingerprints[queueName] = fingerprint
+					if backend.quarantine.IsQuarantined(fingerprint) {
+						quarantined.Add(fingerprint)
+					}
+				}
+				if encryptionKey != "" {
+					encrypted, err := encryptNotification(note, encryptionKey)
+					if err != nil {
+						pspName := psp.Name()
+						dpName := dp.Name()
+						logger.Errorf("RequestID=%v Service=%v Subscriber=%v PushServiceProvider=%v DeliveryPoint=%v Failed: Cannot encrypt the payload: %v", reqID, service, sub, pspName, dpName, err)
+						handler.AddDetailsToHandler(APIResponseDetails{RequestID: &reqID, From: &remoteAddr, Service: &service, Subscriber: &sub, PushServiceProvider: &pspName, DeliveryPoint: &dpName, Code: UNIQUSH_ERROR_CANNOT_ENCRYPT, ErrorMsg: strPtrOfErr(err)})
+						continue
+					}
+					note = encrypted
+				}
+				dpQueue = make(chan *push.DeliveryPoint)
+				dpChanMap[queueName] = dpQueue
+				resChan := make(chan *push.Result)
+				results := (<-chan *push.Result)(resChan)
+				if tracked {
+					results = backend.staging.observe(psp.Name(), stagedPSP != nil, resChan)
+				}
+				wg.Add(1)
+				// Make the pushservicemanager send to (each delivery point of) the PSP asyncronously
+				_, sendSpan := tracing.Start(ctx, "send "+psp.PushServiceName(), tracing.KindClient)
+				sendSpan.SetAttribute("uniqush.push_service_provider", psp.Name())
+				go func() {
+					// Sends wait while the tenant of the service is sending to as many push service providers as its max_connections.
+					throttled, release := backend.tenants.throttleConnections(service, dpQueue)
+					resolved, err := backend.secrets.Resolve(psp)
+					if err != nil {
+						sendSpan.SetError(err)
+						failSecretResolution(psp, throttled, resChan, note, err)
+					} else {
+						backend.psm.PushContext(ctx, resolved, throttled, resChan, note)
+					}
+					release()
+					sendSpan.Finish()
+					wg.Done()
+				}()
+				wg.Add(1)
+				// Wait for the response from the PSP asynchronously
+				go func() {
+					// Note: if this is a retry, retry.attempt will increase, and fixError will account for that when deciding to retry
+					backend.collectResult(reqID, remoteAddr, service, results, note, quarantined, logger, retry, handler)
+					wg.Done()
+				}()
+			}
+
+			if fingerprint, ok := fingerprints[queueName]; ok && quarantined.Contains(fingerprint) {
+				pspName := psp.Name()
+				dpName := dp.Name()
+				logger.Errorf("RequestID=%v Service=%v Subscriber=%v PushServiceProvider=%v DeliveryPoint=%v Payload=%v Failed: Quarantined payload", reqID, service, sub, pspName, dpName, fingerprint)
+				handler.AddDetailsToHandler(APIResponseDetails{RequestID: &reqID, From: &remoteAddr, Service: &service, Subscriber: &sub, PushServiceProvider: &pspName, DeliveryPoint: &dpName, Code: UNIQUSH_ERROR_QUARANTINED_PAYLOAD})
+				continue
+			}
+
+			if err := ctx.Err(); err != nil {
+				pspName := psp.Name()
+				dpName := dp.Name()
+				logger.Errorf("RequestID=%v Service=%v Subscriber=%v PushServiceProvider=%v DeliveryPoint=%v Failed: %v", reqID, service, sub, pspName, dpName, err)
+				handler.AddDetailsToHandler(APIResponseDetails{RequestID: &reqID, From: &remoteAddr, Service: &service, Subscriber: &sub, PushServiceProvider: &pspName, DeliveryPoint: &dpName, Code: UNIQUSH_ERROR_DEADLINE_EXCEEDED, ErrorMsg: strPtrOfErr(err)})
+				continue
+			}
+
+			// Add this delivery point to the group for that psp.Name()
+			dpQueue <- dp
+		}
+	}
+	// Signal that there are no more delivery points so that goroutines can stop reading the next delivery point.
+	for _, dpch := range dpChanMap {
+		close(dpch)
+	}
+	// Wait for every goroutine started by this method to finish.
+	wg.Wait()
+}
+
+// Overloaded returns true (and how long clients should wait before retrying) if too many pushes are queued to accept new ones.
+func (backend *PushBackEnd) Overloaded() (time.Duration, bool) {
+	return backend.load.Overloaded()
+}
+
+// retryAfter returns how long clients should wait before retrying rejected pushes.
+func (backend *PushBackEnd) retryAfter() time.Duration {
+	if backend.load == nil {
+		return defaultBackpressureRetryAfter
+	}
+	return backend.load.conf.RetryAfter
+}
+
+// QueueDepths returns the current depths of the internal queues, for /queue.
+func (backend *PushBackEnd) QueueDepths() QueueDepths {
+	return backend.load.Depths()
+}
+
+// Preview will return the payload data (usually JSON) that would be sent to the given push service type for the given API params.
+func (backend *PushBackEnd) Preview(pushServiceType string, notif *push.Notification) ([]byte, push.Error) {
+	return backend.psm.Preview(pushServiceType, notif)
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/uniqush/goconf/conf"
+	"github.com/uniqush/log"
+	"github.com/uniqush/uniqush-push/push"
+	"github.com/uniqush/uniqush-push/testutil"
+	"github.com/uniqush/uniqush-push/tracing"
+)
+
+func TestLoadRequestTimeout(t *testing.T) {
+	c := conf.NewConfigFile()
+	timeout, err := LoadRequestTimeout(c)
+	testutil.ExpectEquals(t, nil, err, "unexpected error")
+	testutil.ExpectEquals(t, time.Duration(0), timeout, "expected pushes not to time out by default")
+	c.AddOption("WebFrontend", "request_timeout", "10")
+	timeout, err = LoadRequestTimeout(c)
+	testutil.ExpectEquals(t, nil, err, "unexpected error")
+	testutil.ExpectEquals(t, 10*time.Second, timeout, "unexpected timeout")
+	c.AddOption("WebFrontend", "request_timeout", "-1")
+	if _, err = LoadRequestTimeout(c); err == nil {
+		t.Errorf("expected negative timeouts to be rejected")
+	}
+}
+
+func TestPushContext(t *testing.T) {
+	api := newHealthTestAPI(nil)
+	sc := tracing.SpanContext{TraceID: [16]byte{1}, SpanID: [8]byte{2}, Sampled: true}
+	requestCtx, cancel := context.WithCancel(tracing.ContextWithSpanContext(context.Background(), sc))
+	cancel()
+
+	ctx := api.pushContext(requestCtx)
+	testutil.ExpectEquals(t, nil, ctx.Err(), "expected pushes not to be canceled when the client disconnects")
+	testutil.ExpectEquals(t, sc, tracing.SpanContextFromContext(ctx), "expected the span of the request")
+	_, hasDeadline := ctx.Deadline()
+	testutil.ExpectEquals(t, false, hasDeadline, "expected no deadline without a request_timeout")
+
+	api.requestTimeout = 20 * time.Millisecond
+	ctx = api.pushContext(requestCtx)
+	<-ctx.Done()
+	testutil.ExpectEquals(t, context.DeadlineExceeded, ctx.Err(), "expected the push to time out")
+}
+
+func TestPushDeadlineExceeded(t *testing.T) {
+	logger := log.NewLogger(ioutil.Discard, "", log.LOGLEVEL_SILENT)
+	backend := &PushBackEnd{}
+	handler := newPushResponseHandler(logger)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	notif := push.NewEmptyNotification()
+	notif.Data["msg"] = "hello"
+	backend.pushImpl(ctx, "req1", "10.0.0.1", "myservice", []string{"user1", "user2"}, nil, notif, nil, logger, nil, nil, retryState{}, handler)
+	testutil.ExpectEquals(t, 2, handler.response.FailureCount, "expected every subscriber to fail")
+	for _, details := range handler.response.FailureDetails {
+		testutil.ExpectStringEquals(t, UNIQUSH_ERROR_DEADLINE_EXCEEDED, details.Code, "unexpected code of "+*details.Subscriber)
+	}
+}
+
+func TestCollectResultReleasesResults(t *testing.T) {
+	psp, dp := newFailureTestPeers(t)
+	logger := log.NewLogger(ioutil.Discard, "", log.LOGLEVEL_SILENT)
+	backend := &PushBackEnd{}
+	handler := newPushResponseHandler(logger)
+
+	resChan := make(chan *push.Result, 1)
+	res := push.NewResult()
+	res.Provider = psp
+	res.Destination = dp
+	res.MsgID = "msgid"
+	resChan <- res
+	close(resChan)
+	backend.collectResult("req1", "10.0.0.1", "myservice", resChan, push.NewEmptyNotification(), nil, logger, retryState{}, handler)
+
+	testutil.ExpectEquals(t, 1, handler.response.SuccessCount, "expected the result to be reported")
+	details := handler.response.SuccessDetails[0]
+	testutil.ExpectStringEquals(t, "msgid", *details.MessageID, "expected the reported message id to outlive the result")
+	testutil.ExpectStringEquals(t, "user1", *details.Subscriber, "expected the reported subscriber to outlive the result")
+	testutil.ExpectEquals(t, push.Result{}, *res, "expected the result to be released once it was reported")
+}
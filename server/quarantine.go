@@ -0,0 +1,208 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/uniqush/log"
+	"github.com/uniqush/uniqush-push/db"
+	"github.com/uniqush/uniqush-push/push"
+)
+
+const (
+	defaultQuarantineThreshold = 3
+	defaultQuarantineWindow    = 1 * time.Hour
+	defaultQuarantineDuration  = 24 * time.Hour
+)
+
+// QuarantineConfig is a representation of the settings in the [Quarantine] section of uniqush.conf.
+type QuarantineConfig struct {
+	// Threshold is the number of times push services may reject a payload within Window before it is quarantined. 0 disables quarantining payloads.
+	Threshold int
+	Window    time.Duration
+	// Duration is how long a payload stays quarantined, unless released with /rmquarantine.
+	Duration time.Duration
+}
+
+// QuarantineRecord describes a payload which was quarantined because push services kept rejecting it.
+type QuarantineRecord struct {
+	ID              string `json:"id"`
+	Service         string `json:"service"`
+	PushServiceType string `json:"pushServiceType"`
+	RequestID       string `json:"requestId"`
+	Error           string `json:"error"`
+	Failures        int64  `json:"failures"`
+	QuarantinedAt   int64  `json:"quarantinedAt"`
+	ExpiresAt       int64  `json:"expiresAt"`
+	// Payload is the parameters of the push, with secrets redacted (see redactedPayload). Records are returned by /quarantine, so they never hold the raw payload.
+	Payload map[string]string `json:"payload"`
+}
+
+// payloadFingerprint identifies the payload sent for notif to a push service type. Pushes with the same parameters have the same fingerprint.
+func payloadFingerprint(pushServiceType string, notif *push.Notification) string {
+	// json.Marshal sorts map keys, so this is deterministic.
+	b, _ := json.Marshal(notif.Data)
+	return fmt.Sprintf("%s:%x", pushServiceType, sha1.Sum(b))
+}
+
+// redactedPayload returns a copy of the parameters of a push with the values of the parameters which look like secrets redacted, as for /payloads,
+// and any secrets of push service providers (e.g. api keys pasted into a parameter) masked as in the logs.
+// The uniqush.payload.* parameters are JSON, so secrets are redacted from the fields of their objects instead, if they are valid JSON.
+func redactedPayload(data map[string]string) map[string]string {
+	payload := make(map[string]string, len(data))
+	for name, value := range data {
+		if isSecretPayloadField(name) {
+			payload[name] = redactedValue
+			continue
+		}
+		if strings.HasPrefix(name, "uniqush.payload.") {
+			var v interface{}
+			if err := json.Unmarshal([]byte(value), &v); err == nil {
+				if b, err := json.Marshal(redactPayload(v)); err == nil {
+					value = string(b)
+				}
+			}
+		}
+		payload[name] = redaction.Redact(value)
+	}
+	return payload
+}
+
+// payloadQuarantine stops uniqush-push from sending payloads which push services keep rejecting (e.g. because they're too large) to the remaining delivery points.
+type payloadQuarantine struct {
+	db     db.PushDatabase
+	conf   QuarantineConfig
+	logger log.Logger
+}
+
+func newPayloadQuarantine(database db.PushDatabase, conf QuarantineConfig, logger log.Logger) *payloadQuarantine {
+	if conf.Threshold <= 0 {
+		return nil
+	}
+	return &payloadQuarantine{db: database, conf: conf, logger: logger}
+}
+
+// IsQuarantined returns true if the payload with the given fingerprint is quarantined.
+func (q *payloadQuarantine) IsQuarantined(fingerprint string) bool {
+	if q == nil {
+		return false
+	}
+	record, err := q.db.GetQuarantinedPayload(fingerprint)
+	if err != nil {
+		// Fail open, this is only an optimization.
+		q.logger.Errorf("Payload=%v Cannot check quarantine: %v", fingerprint, err)
+		return false
+	}
+	return record != nil
+}
+
+// RecordFailure counts a rejection of the payload by a push service, and quarantines the payload once the threshold is reached.
+// Returns true if the payload was quarantined.
+func (q *payloadQuarantine) RecordFailure(reqID string, service string, pushServiceType string, notif *push.Notification, reason error) bool {
+	if q == nil || notif == nil {
+		return false
+	}
+	fingerprint := payloadFingerprint(pushServiceType, notif)
+	failures, err := q.db.IncrPayloadFailures(fingerprint, q.conf.Window)
+	if err != nil {
+		q.logger.Errorf("RequestID=%v Service=%v Payload=%v Cannot count failure: %v", reqID, service, fingerprint, err)
+		return false
+	}
+	if failures < int64(q.conf.Threshold) {
+		return false
+	}
+	now := time.Now()
+	record := QuarantineRecord{
+		ID:              fingerprint,
+		Service:         service,
+		PushServiceType: pushServiceType,
+		RequestID:       reqID,
+		Error:           reason.Error(),
+		Failures:        failures,
+		QuarantinedAt:   now.Unix(),
+		ExpiresAt:       now.Add(q.conf.Duration).Unix(),
+		Payload:         redactedPayload(notif.Data),
+	}
+	b, err := json.Marshal(record)
+	if err == nil {
+		err = q.db.QuarantinePayload(fingerprint, b, q.conf.Duration)
+	}
+	if err != nil {
+		q.logger.Errorf("RequestID=%v Service=%v Payload=%v Cannot quarantine: %v", reqID, service, fingerprint, err)
+		return false
+	}
+	q.logger.Warnf("RequestID=%v Service=%v PushServiceType=%v Payload=%v Failures=%v Quarantined: %v", reqID, service, pushServiceType, fingerprint, failures, reason)
+	return true
+}
+
+// List returns the records of all quarantined payloads.
+func (q *payloadQuarantine) List() ([]QuarantineRecord, error) {
+	records := []QuarantineRecord{}
+	if q == nil {
+		return records, nil
+	}
+	data, err := q.db.GetQuarantinedPayloads()
+	if err != nil {
+		return nil, err
+	}
+	for fingerprint, b := range data {
+		var record QuarantineRecord
+		if err := json.Unmarshal(b, &record); err != nil {
+			q.logger.Errorf("Payload=%v Invalid quarantine record: %v", fingerprint, err)
+			continue
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// Release lets the payload with the given fingerprint be sent again.
+func (q *payloadQuarantine) Release(fingerprint string) error {
+	if q == nil {
+		return fmt.Errorf("Payload quarantine is disabled")
+	}
+	return q.db.ReleaseQuarantinedPayload(fingerprint)
+}
+
+// quarantinedPayloads is the set of fingerprints of payloads found to be quarantined while sending one push.
+type quarantinedPayloads struct {
+	mutex        sync.Mutex
+	fingerprints map[string]bool
+}
+
+func newQuarantinedPayloads() *quarantinedPayloads {
+	return &quarantinedPayloads{fingerprints: make(map[string]bool)}
+}
+
+func (s *quarantinedPayloads) Add(fingerprint string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.fingerprints[fingerprint] = true
+}
+
+func (s *quarantinedPayloads) Contains(fingerprint string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.fingerprints[fingerprint]
+}
@@ -0,0 +1,43 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/uniqush/uniqush-push/push"
+	"github.com/uniqush/uniqush-push/testutil"
+)
+
+func TestPayloadFingerprint(t *testing.T) {
+	a := push.NewEmptyNotification()
+	a.Data["msg"] = "hello"
+	a.Data["badge"] = "1"
+	b := push.NewEmptyNotification()
+	b.Data["badge"] = "1"
+	b.Data["msg"] = "hello"
+
+	testutil.ExpectStringEquals(t, payloadFingerprint("apns", a), payloadFingerprint("apns", b), "expected the same payload to have the same fingerprint")
+	if payloadFingerprint("apns", a) == payloadFingerprint("fcm", a) {
+		t.Errorf("expected fingerprints to depend on the push service type")
+	}
+	b.Data["msg"] = "bye"
+	if payloadFingerprint("apns", a) == payloadFingerprint("apns", b) {
+		t.Errorf("expected different payloads to have different fingerprints")
+	}
+}
+
+func TestRedactedPayload(t *testing.T) {
+	data := map[string]string{
+		"msg":                  "hello",
+		"auth_token":           "t0ken",
+		"uniqush.payload.apns": `{"aps":{"alert":"hi"},"secret":"s3cret"}`,
+		"uniqush.payload.gcm":  "not json",
+	}
+	expected := map[string]string{
+		"msg":                  "hello",
+		"auth_token":           redactedValue,
+		"uniqush.payload.apns": `{"aps":{"alert":"hi"},"secret":"[redacted]"}`,
+		"uniqush.payload.gcm":  "not json",
+	}
+	testutil.ExpectEquals(t, expected, redactedPayload(data), "expected secrets to be redacted from quarantined payloads")
+	testutil.ExpectStringEquals(t, "t0ken", data["auth_token"], "expected the parameters of the push not to be modified")
+}
@@ -0,0 +1,258 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/uniqush/uniqush-push/metrics"
+)
+
+// rateLimitedRequests counts the requests rejected by each kind of limit (ip, key or endpoint).
+var rateLimitedRequests = metrics.DefaultRegistry.NewCounterVec("uniqush_rate_limited_requests_total",
+	"Requests to the API rejected with HTTP 429 by the rate limits of [RateLimit], by limit and path.", "limit", "path")
+
+// Kinds of rate limits, which are the limit label of uniqush_rate_limited_requests_total.
+const (
+	rateLimitIP       = "ip"
+	rateLimitKey      = "key"
+	rateLimitEndpoint = "endpoint"
+)
+
+// unlimitedPaths aren't rate limited, so that load balancers and orchestrators can always check uniqush-push.
+var unlimitedPaths = map[string]bool{
+	VersionInfoURL: true,
+	HealthzURL:     true,
+	ReadyzURL:      true,
+}
+
+// rateLimitSweepInterval is how often the buckets which are full again are removed, so that clients which stopped sending requests don't use memory.
+const rateLimitSweepInterval = time.Minute
+
+// RateLimit is a token bucket: Rate requests per second are allowed, with bursts of up to Burst requests. A Rate of 0 is unlimited.
+type RateLimit struct {
+	Rate  float64
+	Burst float64
+}
+
+// parseRateLimit parses "<rate>" or "<rate>:<burst>". The burst defaults to the rate (and to at least 1 request).
+func parseRateLimit(s string) (RateLimit, error) {
+	parts := strings.SplitN(strings.TrimSpace(s), ":", 2)
+	rate, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil || rate < 0 || math.IsInf(rate, 0) {
+		return RateLimit{}, fmt.Errorf("invalid rate %q: must be a non-negative number of requests per second", parts[0])
+	}
+	limit := RateLimit{Rate: rate, Burst: math.Max(rate, 1)}
+	if len(parts) == 2 {
+		burst, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil || burst < 1 || math.IsInf(burst, 0) {
+			return RateLimit{}, fmt.Errorf("invalid burst %q: must be at least 1", parts[1])
+		}
+		limit.Burst = burst
+	}
+	return limit, nil
+}
+
+// parseRateLimits parses a comma separated list of "<name>:<rate>[:<burst>]" (e.g. "/push:50:100,/subscribe:20").
+func parseRateLimits(s string) (map[string]RateLimit, error) {
+	limits := make(map[string]RateLimit)
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		i := strings.IndexByte(entry, ':')
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid limit %q: must be <name>:<rate>[:<burst>]", entry)
+		}
+		limit, err := parseRateLimit(entry[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", entry[:i], err)
+		}
+		limits[entry[:i]] = limit
+	}
+	return limits, nil
+}
+
+// RateLimitConfig is a representation of the settings in the [RateLimit] section of uniqush.conf.
+type RateLimitConfig struct {
+	// PerIP limits the requests of each source address.
+	PerIP RateLimit
+	// PerKey limits the requests of each API key, unless the key is in Keys.
+	PerKey RateLimit
+	// Keys overrides PerKey for API keys, by id.
+	Keys map[string]RateLimit
+	// Endpoints limits the requests of each API key (or source address, for requests without a key) to an endpoint, by path.
+	Endpoints map[string]RateLimit
+}
+
+// enabled returns true if any limit is set.
+func (c RateLimitConfig) enabled() bool {
+	return c.PerIP.Rate != 0 || c.PerKey.Rate != 0 || len(c.Keys) != 0 || len(c.Endpoints) != 0
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take refills the bucket since its last request, and takes a token if there is one. Otherwise, it returns how long until there is one.
+func (b *tokenBucket) take(limit RateLimit, now time.Time) (time.Duration, bool) {
+	b.tokens = math.Min(limit.Burst, b.tokens+now.Sub(b.last).Seconds()*limit.Rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0, true
+	}
+	return time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second)), false
+}
+
+// rateLimiter rejects requests exceeding the rate limits of their source address, API key or endpoint, to protect the database and push services
+// from clients sending too many requests. The endpoints in unlimitedPaths (e.g. /healthz) aren't limited.
+type rateLimiter struct {
+	mutex   sync.Mutex
+	conf    RateLimitConfig
+	buckets map[string]*tokenBucket
+	// limits are the limits of the buckets, for sweeping them.
+	limits map[string]RateLimit
+	now    func() time.Time
+}
+
+// newRateLimiter returns nil if no limit is set.
+func newRateLimiter(conf RateLimitConfig) *rateLimiter {
+	if !conf.enabled() {
+		return nil
+	}
+	l := &rateLimiter{
+		conf:    conf,
+		buckets: make(map[string]*tokenBucket),
+		limits:  make(map[string]RateLimit),
+		now:     time.Now,
+	}
+	go l.run()
+	return l
+}
+
+func (l *rateLimiter) run() {
+	for range time.Tick(rateLimitSweepInterval) {
+		l.sweep()
+	}
+}
+
+// sweep removes the buckets which are full, which are the same as buckets which don't exist.
+func (l *rateLimiter) sweep() {
+	now := l.now()
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for name, b := range l.buckets {
+		limit := l.limits[name]
+		if b.tokens+now.Sub(b.last).Seconds()*limit.Rate >= limit.Burst {
+			delete(l.buckets, name)
+			delete(l.limits, name)
+		}
+	}
+}
+
+// config returns the limits, which SetConfig can change.
+func (l *rateLimiter) config() RateLimitConfig {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.conf
+}
+
+// SetConfig changes the limits, e.g. when the config file is reloaded. The buckets are reset, so every client starts with a full burst.
+func (l *rateLimiter) SetConfig(conf RateLimitConfig) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.conf = conf
+	l.buckets = make(map[string]*tokenBucket)
+	l.limits = make(map[string]RateLimit)
+}
+
+func (l *rateLimiter) take(name string, limit RateLimit) (time.Duration, bool) {
+	if limit.Rate == 0 {
+		return 0, true
+	}
+	now := l.now()
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	b, ok := l.buckets[name]
+	if !ok {
+		b = &tokenBucket{tokens: limit.Burst, last: now}
+		l.buckets[name] = b
+		l.limits[name] = limit
+	}
+	return b.take(limit, now)
+}
+
+// allowAddress checks the limit of the source address of a request to path. It is checked before API keys, so that invalid keys are limited as well.
+// Clients of unix sockets share one address (unixSocketClientAddr) and are on the same host, so they aren't limited by address.
+// If the request is rejected, it returns how long until it would be allowed.
+func (l *rateLimiter) allowAddress(path, remoteAddr string) (time.Duration, bool) {
+	if l == nil || unlimitedPaths[path] || isUnixSocketAddr(remoteAddr) {
+		return 0, true
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	retryAfter, ok := l.take(rateLimitIP+":"+host, l.config().PerIP)
+	if !ok {
+		rateLimitedRequests.Inc(rateLimitIP, path)
+	}
+	return retryAfter, ok
+}
+
+// allowKey checks the limits of the API key (whose id is "" if API keys are disabled) and endpoint of a request to path.
+// Without an API key, the limit of the endpoint applies to the source address, so it doesn't apply to clients of unix sockets.
+// If the request is rejected, it returns how long until it would be allowed.
+func (l *rateLimiter) allowKey(path, keyID, remoteAddr string) (time.Duration, bool) {
+	if l == nil || unlimitedPaths[path] {
+		return 0, true
+	}
+	conf := l.config()
+	client := remoteAddr
+	if keyID != "" {
+		client = keyID
+		limit, ok := conf.Keys[keyID]
+		if !ok {
+			limit = conf.PerKey
+		}
+		if retryAfter, ok := l.take(rateLimitKey+":"+keyID, limit); !ok {
+			rateLimitedRequests.Inc(rateLimitKey, path)
+			return retryAfter, false
+		}
+	} else if isUnixSocketAddr(remoteAddr) {
+		return 0, true
+	} else if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		client = host
+	}
+	if limit, ok := conf.Endpoints[path]; ok {
+		if retryAfter, ok := l.take(rateLimitEndpoint+":"+path+":"+client, limit); !ok {
+			rateLimitedRequests.Inc(rateLimitEndpoint, path)
+			return retryAfter, false
+		}
+	}
+	return 0, true
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/uniqush/uniqush-push/testutil"
+)
+
+func TestParseRateLimits(t *testing.T) {
+	limit, err := parseRateLimit("0.5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectEquals(t, RateLimit{Rate: 0.5, Burst: 1}, limit, "expected the burst to be at least one request")
+	limits, err := parseRateLimits("/push:50:100, /subscribe:20")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectEquals(t, map[string]RateLimit{"/push": {Rate: 50, Burst: 100}, "/subscribe": {Rate: 20, Burst: 20}}, limits, "expected the limit of each endpoint")
+	for _, invalid := range []string{"/push", "/push:-1", "/push:10:0", ":10"} {
+		if _, err := parseRateLimits(invalid); err == nil {
+			t.Errorf("expected %q to be invalid", invalid)
+		}
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	l := &rateLimiter{
+		conf: RateLimitConfig{
+			PerIP:     RateLimit{Rate: 10, Burst: 3},
+			PerKey:    RateLimit{Rate: 1, Burst: 2},
+			Keys:      map[string]RateLimit{"batch": {Rate: 100, Burst: 100}},
+			Endpoints: map[string]RateLimit{BroadcastURL: {Rate: 1, Burst: 1}},
+		},
+		buckets: make(map[string]*tokenBucket),
+		limits:  make(map[string]RateLimit),
+	}
+	now := time.Unix(1500000000, 0)
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if _, ok := l.allowAddress(PushNotificationURL, "10.0.0.1:4000"); !ok {
+			t.Fatalf("expected request %d to be within the burst", i)
+		}
+	}
+	retryAfter, ok := l.allowAddress(PushNotificationURL, "10.0.0.1:5000")
+	testutil.ExpectEquals(t, false, ok, "expected requests exceeding the burst of the address to be rejected")
+	testutil.ExpectEquals(t, 100*time.Millisecond, retryAfter, "expected the time until the next token")
+	_, ok = l.allowAddress(PushNotificationURL, "10.0.0.2:4000")
+	testutil.ExpectEquals(t, true, ok, "expected other addresses to have their own bucket")
+	_, ok = l.allowAddress(HealthzURL, "10.0.0.1:4000")
+	testutil.ExpectEquals(t, true, ok, "expected public endpoints not to be limited")
+	now = now.Add(100 * time.Millisecond)
+	_, ok = l.allowAddress(PushNotificationURL, "10.0.0.1:4000")
+	testutil.ExpectEquals(t, true, ok, "expected the bucket to be refilled")
+
+	l.allowKey(PushNotificationURL, "app", "10.0.0.1:4000")
+	l.allowKey(PushNotificationURL, "app", "10.0.0.1:4000")
+	_, ok = l.allowKey(PushNotificationURL, "app", "10.0.0.3:4000")
+	testutil.ExpectEquals(t, false, ok, "expected the limit of the key to apply from any address")
+	for i := 0; i < 10; i++ {
+		if _, ok := l.allowKey(PushNotificationURL, "batch", "10.0.0.1:4000"); !ok {
+			t.Fatal("expected the limit of the key to be overridden")
+		}
+	}
+
+	_, ok = l.allowKey(BroadcastURL, "", "10.0.0.1:4000")
+	testutil.ExpectEquals(t, true, ok, "expected the first broadcast to be allowed")
+	_, ok = l.allowKey(BroadcastURL, "", "10.0.0.1:5000")
+	testutil.ExpectEquals(t, false, ok, "expected the endpoint to be limited by address without an API key")
+	_, ok = l.allowKey(BroadcastURL, "batch", "10.0.0.1:4000")
+	testutil.ExpectEquals(t, true, ok, "expected the endpoint to be limited for each client")
+
+	for i := 0; i < 5; i++ {
+		if _, ok := l.allowAddress(PushNotificationURL, unixSocketClientAddr); !ok {
+			t.Fatal("expected clients of unix sockets not to be limited by address")
+		}
+		if _, ok := l.allowKey(BroadcastURL, "", unixSocketClientAddr); !ok {
+			t.Fatal("expected the endpoints not to be limited by address for clients of unix sockets")
+		}
+	}
+
+	now = now.Add(time.Hour)
+	l.sweep()
+	testutil.ExpectEquals(t, 0, len(l.buckets), "expected full buckets to be removed")
+
+	var disabled *rateLimiter
+	_, ok = disabled.allowKey(BroadcastURL, "app", "10.0.0.1:4000")
+	testutil.ExpectEquals(t, true, ok, "expected requests not to be limited without a limiter")
+}
+
+func TestRateLimitedRequest(t *testing.T) {
+	api := newHealthTestAPI(nil)
+	api.backend.limiter = newRateLimiter(RateLimitConfig{PerIP: RateLimit{Rate: 0.5, Burst: 1}})
+	r := httptest.NewRequest("POST", PushNotificationURL, nil)
+	api.backend.limiter.allowAddress(r.URL.Path, r.RemoteAddr)
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, r)
+	testutil.ExpectEquals(t, http.StatusTooManyRequests, w.Code, "expected requests exceeding the limit to be rejected")
+	testutil.ExpectStringEquals(t, "2", w.Header().Get("Retry-After"), "expected the time until the next request is allowed")
+}
@@ -0,0 +1,269 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/uniqush/log"
+	"github.com/uniqush/uniqush-push/db"
+	"github.com/uniqush/uniqush-push/push"
+)
+
+const (
+	reconcileLeasePrefix                = "reconcile:"
+	defaultReconcileRequestsPerSecond   = 10
+	defaultReconcileSubscriberBatchSize = 500
+)
+
+// ReconcileConfig is a representation of the [Reconcile] section of uniqush.conf.
+type ReconcileConfig struct {
+	// Interval is how often every service is reconciled with its push services. If 0, services are only reconciled by /reconcile.
+	Interval time.Duration
+	// RequestsPerSecond limits how fast delivery points are looked up, so that reconciliation doesn't hit the push services' rate limits.
+	RequestsPerSecond int
+	// RemoveUnrecognized removes flagged delivery points (with a token_invalidated webhook) instead of only flagging them.
+	RemoveUnrecognized bool
+}
+
+// FlaggedDeliveryPoint is a delivery point which its push service no longer recognizes.
+type FlaggedDeliveryPoint struct {
+	Service             string `json:"service"`
+	Subscriber          string `json:"subscriber"`
+	DeliveryPoint       string `json:"deliveryPoint"`
+	PushServiceProvider string `json:"pushServiceProvider"`
+	// Flagged is the unix timestamp of the reconciliation which flagged the delivery point.
+	Flagged int64 `json:"flagged"`
+}
+
+// reconciler looks up the delivery points of a service with their push services (where the push service has an API for it, e.g. FCM's Instance ID API),
+// and flags the ones which the push service no longer recognizes, so that subscriptions which were never unsubscribed can be cleaned up.
+type reconciler struct {
+	backend  *PushBackEnd
+	db       db.PushDatabase
+	psm      *push.PushServiceManager
+	jobs     *jobRunner
+	conf     ReconcileConfig
+	logger   log.Logger
+	stopChan chan struct{}
+}
+
+// reconcileStats counts the delivery points looked up by a reconciliation of a service.
+type reconcileStats struct {
+	checked     int
+	flagged     int
+	unsupported int
+	failed      int
+}
+
+func newReconciler(backend *PushBackEnd, database db.PushDatabase, psm *push.PushServiceManager, jobs *jobRunner, conf ReconcileConfig, logger log.Logger) *reconciler {
+	return &reconciler{
+		backend:  backend,
+		db:       database,
+		psm:      psm,
+		jobs:     jobs,
+		conf:     conf,
+		logger:   logger,
+		stopChan: make(chan struct{}),
+	}
+}
+
+// Start reconciles a service in the background. Nothing is done if the service is already being reconciled by this or another instance.
+func (rc *reconciler) Start(service string) {
+	go func() {
+		if _, err := rc.Reconcile(service); err != nil {
+			rc.logger.Errorf("Service=%v Cannot reconcile: %v", service, err)
+		}
+	}()
+}
+
+// Reconcile looks up every delivery point of the service, unless another instance is reconciling it.
+// Flags are removed from delivery points which are recognized again or were removed.
+func (rc *reconciler) Reconcile(service string) (bool, error) {
+	return rc.jobs.RunExclusive(reconcileLeasePrefix+service, func(lost <-chan struct{}) {
+		rc.reconcile(service, lost)
+	})
+}
+
+// Flagged returns the flagged delivery points of a service, sorted by subscriber.
+func (rc *reconciler) Flagged(service string) ([]FlaggedDeliveryPoint, error) {
+	all, err := rc.db.GetFlaggedDeliveryPoints(service)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]FlaggedDeliveryPoint, 0, len(all))
+	for dpName, data := range all {
+		var flagged FlaggedDeliveryPoint
+		if err := json.Unmarshal(data, &flagged); err != nil {
+			rc.logger.Errorf("Service=%v DeliveryPoint=%v Invalid flagged delivery point: %v", service, dpName, err)
+			continue
+		}
+		list = append(list, flagged)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Subscriber != list[j].Subscriber {
+			return list[i].Subscriber < list[j].Subscriber
+		}
+		return list[i].DeliveryPoint < list[j].DeliveryPoint
+	})
+	return list, nil
+}
+
+// Run reconciles every service assigned to this instance by the cluster every interval, until Stop is called.
+func (rc *reconciler) Run() {
+	ticker := time.NewTicker(rc.conf.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-rc.stopChan:
+			return
+		case <-ticker.C:
+			rc.reconcileAll()
+		}
+	}
+}
+
+// Stop stops reconciling. A reconciliation in progress stops before its next lookup.
+func (rc *reconciler) Stop() {
+	close(rc.stopChan)
+}
+
+func (rc *reconciler) reconcileAll() {
+	psps, err := rc.db.GetPushServiceProviderConfigs()
+	if err != nil {
+		rc.logger.Errorf("Cannot list services to reconcile: %v", err)
+		return
+	}
+	services := make(map[string]bool)
+	for _, psp := range psps {
+		services[psp.FixedData["service"]] = true
+	}
+	for service := range services {
+		if !rc.backend.cluster.Owns(reconcileLeasePrefix + service) {
+			continue
+		}
+		if _, err := rc.Reconcile(service); err != nil {
+			rc.logger.Errorf("Service=%v Cannot reconcile: %v", service, err)
+		}
+	}
+}
+
+func (rc *reconciler) reconcile(service string, lost <-chan struct{}) {
+	previouslyFlagged, err := rc.db.GetFlaggedDeliveryPoints(service)
+	if err != nil {
+		rc.logger.Errorf("Service=%v Cannot list flagged delivery points: %v", service, err)
+		return
+	}
+	rc.logger.Infof("Service=%v Start reconciling", service)
+	start := time.Now()
+	var stats reconcileStats
+	throttle := time.NewTicker(time.Second / time.Duration(rc.conf.RequestsPerSecond))
+	defer throttle.Stop()
+
+	var cursor uint64
+	for {
+		subs, next, err := rc.db.ScanSubscribersOfService(service, "*", cursor, defaultReconcileSubscriberBatchSize)
+		if err != nil {
+			rc.logger.Errorf("Service=%v Cannot list subscribers: %v", service, err)
+			return
+		}
+		for _, sub := range subs {
+			pairs, err := rc.db.GetPushServiceProviderDeliveryPointPairs(service, sub, nil)
+			if err != nil {
+				rc.logger.Errorf("Service=%v Subscriber=%v Cannot list delivery points: %v", service, sub, err)
+				stats.failed++
+				continue
+			}
+			for _, pair := range pairs {
+				select {
+				case <-lost:
+					rc.logger.Warnf("Service=%v Stopping: lost lease", service)
+					return
+				case <-rc.stopChan:
+					rc.logger.Infof("Service=%v Stopping: shutting down", service)
+					return
+				case <-throttle.C:
+				}
+				if rc.check(service, sub, pair, start, &stats) {
+					delete(previouslyFlagged, pair.DeliveryPoint.Name())
+				}
+			}
+		}
+		if next == 0 {
+			break
+		}
+		cursor = next
+	}
+
+	// Delivery points which are recognized again, or which were removed, are no longer flagged.
+	stale := make([]string, 0, len(previouslyFlagged))
+	for dpName := range previouslyFlagged {
+		stale = append(stale, dpName)
+	}
+	if err := rc.db.UnflagDeliveryPoints(service, stale); err != nil {
+		rc.logger.Errorf("Service=%v Cannot unflag delivery points: %v", service, err)
+	}
+	rc.logger.Infof("Service=%v Checked=%v Flagged=%v Unsupported=%v Failed=%v Unflagged=%v Duration=%v Done reconciling",
+		service, stats.checked, stats.flagged, stats.unsupported, stats.failed, len(stale), time.Since(start))
+}
+
+// check looks up a delivery point with its push service, and flags it if it isn't recognized.
+// Returns true if the delivery point is still flagged.
+func (rc *reconciler) check(service, sub string, pair db.PushServiceProviderDeliveryPointPair, start time.Time, stats *reconcileStats) bool {
+	psp, dp := pair.PushServiceProvider, pair.DeliveryPoint
+	valid, supported, err := rc.psm.VerifyDeliveryPoint(psp, dp)
+	if !supported {
+		stats.unsupported++
+		return false
+	}
+	if err != nil {
+		// Keep any previous flag, since the delivery point couldn't be checked.
+		rc.logger.Errorf("Service=%v Subscriber=%v DeliveryPoint=%v Cannot verify delivery point: %v", service, sub, dp.Name(), err)
+		stats.failed++
+		return true
+	}
+	stats.checked++
+	if valid {
+		return false
+	}
+	stats.flagged++
+	if rc.conf.RemoveUnrecognized {
+		rc.logger.Infof("Service=%v Subscriber=%v PushServiceProvider=%v DeliveryPoint=%v Removing unrecognized delivery point", service, sub, psp.Name(), dp.Name())
+		if err := rc.backend.removeInvalidatedDeliveryPoint("", service, sub, psp, dp, UNIQUSH_REMOVE_INVALID_REG); err != nil {
+			rc.logger.Errorf("Service=%v Subscriber=%v DeliveryPoint=%v Cannot remove unrecognized delivery point: %v", service, sub, dp.Name(), err)
+		}
+		return false
+	}
+	rc.logger.Infof("Service=%v Subscriber=%v PushServiceProvider=%v DeliveryPoint=%v Flagging unrecognized delivery point", service, sub, psp.Name(), dp.Name())
+	data, err := json.Marshal(FlaggedDeliveryPoint{
+		Service:             service,
+		Subscriber:          sub,
+		DeliveryPoint:       dp.Name(),
+		PushServiceProvider: psp.Name(),
+		Flagged:             start.Unix(),
+	})
+	if err == nil {
+		err = rc.db.FlagDeliveryPoint(service, dp.Name(), data)
+	}
+	if err != nil {
+		rc.logger.Errorf("Service=%v Subscriber=%v DeliveryPoint=%v Cannot flag delivery point: %v", service, sub, dp.Name(), err)
+	}
+	return true
+}
@@ -0,0 +1,209 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/uniqush/goconf/conf"
+	"github.com/uniqush/uniqush-push/push"
+	"github.com/uniqush/uniqush-push/tracing"
+)
+
+const (
+	defaultRedactionVisibleChars = 6
+	// minRedactedSecretLength is the length below which credentials of push service providers aren't redacted, so that short values (e.g. "1") don't redact unrelated text.
+	minRedactedSecretLength = 8
+)
+
+// deviceTokenPattern matches device tokens: APNs device tokens are 64 hex digits, and FCM, GCM and ADM registration ids are long runs
+// of base64url characters, colons and dots. Names of delivery points are hashes of the tokens (e.g. apns:<40 hex digits>), so they aren't redacted.
+var deviceTokenPattern = regexp.MustCompile(`[A-Za-z0-9_\-:.]{100,}|\b[0-9A-Fa-f]{64,}\b`)
+
+// RedactionConfig is a representation of the settings in the [Redaction] section of uniqush.conf.
+type RedactionConfig struct {
+	// VisibleChars is the number of characters at the end of redacted tokens and credentials which are left visible, to correlate log lines. 0 redacts them completely.
+	VisibleChars int
+}
+
+// LoadRedactionConfig returns a representation of the settings in the [Redaction] section from uniqush.conf.
+func LoadRedactionConfig(cf *conf.ConfigFile) (RedactionConfig, error) {
+	c := RedactionConfig{VisibleChars: defaultRedactionVisibleChars}
+	if visibleChars, err := cf.GetInt("Redaction", "visible_chars"); err == nil {
+		if visibleChars < 0 || visibleChars > 16 {
+			return c, fmt.Errorf("[Redaction] visible_chars must be between 0 and 16, got %d", visibleChars)
+		}
+		c.VisibleChars = visibleChars
+	}
+	return c, nil
+}
+
+// redactor removes device tokens and the credentials of push service providers from text which leaves uniqush-push:
+// log lines, the errors of spans, and the error messages of API responses and webhooks.
+type redactor struct {
+	mutex        sync.RWMutex
+	visibleChars int
+	// providers are the names of the push service providers whose credentials were added.
+	providers map[string]bool
+	secrets   map[string]bool
+	// replacer replaces every secret with its mask. It is nil if there are no secrets.
+	replacer *strings.Replacer
+}
+
+// redaction is the redactor of every logger, span and response. Its settings are loaded with the loggers.
+var redaction = newRedactor(defaultRedactionVisibleChars)
+
+func newRedactor(visibleChars int) *redactor {
+	return &redactor{visibleChars: visibleChars, providers: make(map[string]bool), secrets: make(map[string]bool)}
+}
+
+func (r *redactor) configure(conf RedactionConfig) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.visibleChars = conf.VisibleChars
+	r.buildReplacer()
+}
+
+// mask returns the replacement of a secret: "[redacted]", followed by its last few characters if VisibleChars isn't 0
+// and the secret is long enough for the rest of it to stay hidden.
+func (r *redactor) mask(secret string) string {
+	if r.visibleChars == 0 || len(secret) <= 2*r.visibleChars {
+		return redactedValue
+	}
+	return "[redacted:" + secret[len(secret)-r.visibleChars:] + "]"
+}
+
+// addPushServiceProvider adds the credentials of a push service provider (e.g. its apikey or clientsecret) to the redacted secrets.
+func (r *redactor) addPushServiceProvider(psp *push.PushServiceProvider) {
+	if psp == nil {
+		return
+	}
+	name := psp.Name()
+	r.mutex.RLock()
+	known := r.providers[name]
+	r.mutex.RUnlock()
+	if known {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.providers[name] = true
+	for _, data := range []map[string]string{psp.FixedData, psp.VolatileData} {
+		for field, value := range data {
+			if isSecretField(field) {
+				r.addSecretLocked(value)
+			}
+		}
+	}
+	r.buildReplacer()
+}
+
+// addSecret adds a credential which isn't stored in a push service provider (e.g. one fetched from a secrets backend) to the redacted secrets.
+func (r *redactor) addSecret(secret string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.addSecretLocked(secret) {
+		r.buildReplacer()
+	}
+}
+
+// addSecretLocked returns true if secret wasn't redacted yet. r.mutex must be held.
+func (r *redactor) addSecretLocked(secret string) bool {
+	if len(secret) < minRedactedSecretLength || r.secrets[secret] {
+		return false
+	}
+	r.secrets[secret] = true
+	// Secrets such as private keys span several lines, which are escaped in JSON log lines.
+	if escaped, err := json.Marshal(secret); err == nil {
+		r.secrets[string(escaped[1:len(escaped)-1])] = true
+	}
+	return true
+}
+
+func (r *redactor) buildReplacer() {
+	if len(r.secrets) == 0 {
+		r.replacer = nil
+		return
+	}
+	// Longer secrets are replaced first, in case a secret contains another one.
+	secrets := make([]string, 0, len(r.secrets))
+	for secret := range r.secrets {
+		secrets = append(secrets, secret)
+	}
+	sort.Slice(secrets, func(i, j int) bool { return len(secrets[i]) > len(secrets[j]) })
+	pairs := make([]string, 0, 2*len(secrets))
+	for _, secret := range secrets {
+		pairs = append(pairs, secret, r.mask(secret))
+	}
+	r.replacer = strings.NewReplacer(pairs...)
+}
+
+// Redact returns s with the credentials of push service providers and anything which looks like a device token masked.
+func (r *redactor) Redact(s string) string {
+	r.mutex.RLock()
+	replacer := r.replacer
+	r.mutex.RUnlock()
+	if replacer != nil {
+		s = replacer.Replace(s)
+	}
+	return deviceTokenPattern.ReplaceAllStringFunc(s, func(token string) string {
+		r.mutex.RLock()
+		defer r.mutex.RUnlock()
+		return r.mask(token)
+	})
+}
+
+// redactingWriter redacts each log line before writing it. Loggers write each line with a single call to Write.
+type redactingWriter struct {
+	w        io.Writer
+	redactor *redactor
+}
+
+func (w *redactingWriter) Write(p []byte) (int, error) {
+	if _, err := w.w.Write([]byte(w.redactor.Redact(string(p)))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// redactingExporter redacts the errors and string attributes of spans before passing them to the exporter.
+type redactingExporter struct {
+	exporter tracing.Exporter
+	redactor *redactor
+}
+
+func (e *redactingExporter) Export(s *tracing.Span) {
+	s.Err = e.redactor.Redact(s.Err)
+	for i, a := range s.Attributes {
+		if value, ok := a.Value.(string); ok {
+			s.Attributes[i].Value = e.redactor.Redact(value)
+		}
+	}
+	e.exporter.Export(s)
+}
+
+// redactedError returns the message of err with device tokens and credentials masked, for responses, webhooks and reports.
+func redactedError(err error) string {
+	return redaction.Redact(err.Error())
+}
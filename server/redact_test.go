@@ -0,0 +1,68 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/uniqush/uniqush-push/testutil"
+	"github.com/uniqush/uniqush-push/tracing"
+)
+
+func TestRedactDeviceTokens(t *testing.T) {
+	r := newRedactor(6)
+	apnsToken := strings.Repeat("0123456789abcdef", 4)
+	fcmToken := "dQw4w9WgXcQ:APA91b" + strings.Repeat("Hk3-_x9Zq2", 14)
+	dpName := "apns:0123456789abcdef0123456789abcdef01234567"
+	in := "DeliveryPoint=" + dpName + " Token=" + apnsToken + " RegID=" + fcmToken + " RequestID=abc"
+	expected := "DeliveryPoint=" + dpName + " Token=[redacted:abcdef] RegID=[redacted:_x9Zq2] RequestID=abc"
+	testutil.ExpectStringEquals(t, expected, r.Redact(in), "expected device tokens to be masked, and names of delivery points to be kept")
+
+	r.configure(RedactionConfig{VisibleChars: 0})
+	testutil.ExpectStringEquals(t, "Token=[redacted]", r.Redact("Token="+apnsToken), "expected visible_chars=0 to mask tokens completely")
+}
+
+func TestRedactPushServiceProviderCredentials(t *testing.T) {
+	psp, _ := newFailureTestPeers(t)
+	psp.VolatileData["apikey"] = "AIzaSyExampleServerKey123456"
+	psp.VolatileData["clientsecret"] = "line1\nline2-of-a-private-key"
+	psp.VolatileData["short"] = "1"
+	r := newRedactor(6)
+	r.addPushServiceProvider(psp)
+	r.addPushServiceProvider(nil)
+
+	testutil.ExpectStringEquals(t, "Unauthorized: key=[redacted:123456]", r.Redact("Unauthorized: key=AIzaSyExampleServerKey123456"), "expected the apikey to be masked")
+	testutil.ExpectStringEquals(t, `{"msg":"bad key [redacted:te-key]"}`, r.Redact(`{"msg":"bad key line1\nline2-of-a-private-key"}`), "expected secrets to be masked in JSON log lines")
+	testutil.ExpectStringEquals(t, "short=1", r.Redact("short=1"), "expected fields which aren't credentials not to be masked")
+
+	var buf bytes.Buffer
+	w := &redactingWriter{w: &buf, redactor: r}
+	line := "[Push] Failed: AIzaSyExampleServerKey123456\n"
+	n, err := w.Write([]byte(line))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectEquals(t, len(line), n, "expected the length of the unredacted line to be returned")
+	testutil.ExpectStringEquals(t, "[Push] Failed: [redacted:123456]\n", buf.String(), "expected log lines to be redacted")
+}
+
+type recordingSpanExporter struct {
+	spans []*tracing.Span
+}
+
+func (e *recordingSpanExporter) Export(s *tracing.Span) {
+	e.spans = append(e.spans, s)
+}
+
+func TestRedactingExporter(t *testing.T) {
+	recorder := &recordingSpanExporter{}
+	apnsToken := strings.Repeat("fedcba9876543210", 4)
+	e := &redactingExporter{exporter: recorder, redactor: newRedactor(6)}
+	span := &tracing.Span{Attributes: []tracing.Attribute{{Key: "token", Value: apnsToken}, {Key: "delivery_points", Value: 3}}}
+	span.SetError(errors.New("bad token " + apnsToken))
+	e.Export(span)
+	testutil.ExpectEquals(t, 1, len(recorder.spans), "expected the span to be exported")
+	testutil.ExpectStringEquals(t, "bad token [redacted:543210]", span.Err, "expected the error of the span to be redacted")
+	testutil.ExpectEquals(t, []tracing.Attribute{{Key: "token", Value: "[redacted:543210]"}, {Key: "delivery_points", Value: 3}}, span.Attributes, "expected string attributes to be redacted")
+}
@@ -0,0 +1,95 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package server
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/uniqush/log"
+	"github.com/uniqush/uniqush-push/push"
+)
+
+// RefreshDeliveryPointURL updates the token and last_seen of a delivery point which is already subscribed, for client SDKs which refresh
+// their subscription whenever the app is launched. It is cheaper than /subscribe, which rebuilds the delivery point and its subscriptions.
+const RefreshDeliveryPointURL = "/refresh"
+
+// refreshDeliveryPoint sets the last_seen of the delivery point named delivery_point_id of the subscriber of the service, and its token if it is in kv
+// (the new devtoken or regid of the app, or token for sns), with a single write. The name of the delivery point doesn't change with its token.
+func (api *RestAPI) refreshDeliveryPoint(kv map[string]string, logger log.Logger, remoteAddr string) APIResponseDetails {
+	service, err := getServiceFromMap(kv)
+	if err == nil {
+		err = validateService(service)
+	}
+	if err != nil {
+		logger.Errorf("From=%v Cannot get service name: %v; %v", remoteAddr, service, err)
+		return APIResponseDetails{From: &remoteAddr, Service: &service, Code: UNIQUSH_ERROR_CANNOT_GET_SERVICE, ErrorMsg: strPtrOfErr(err)}
+	}
+	subscriber := kv["subscriber"]
+	if subscriber == "" {
+		err = errors.New("subscriber is required")
+	} else {
+		err = validateSubscribers([]string{subscriber})
+	}
+	if err != nil {
+		return APIResponseDetails{From: &remoteAddr, Service: &service, Code: UNIQUSH_ERROR_CANNOT_GET_SUBSCRIBER, ErrorMsg: strPtrOfErr(err)}
+	}
+	dpName := kv["delivery_point_id"]
+	if dpName == "" {
+		errorMsg := "delivery_point_id is required"
+		return APIResponseDetails{From: &remoteAddr, Service: &service, Subscriber: &subscriber, Code: UNIQUSH_ERROR_CANNOT_GET_DELIVERY_POINT_ID, ErrorMsg: &errorMsg}
+	}
+
+	pairs, err := api.backend.db.GetPushServiceProviderDeliveryPointPairs(service, subscriber, []string{dpName})
+	if err != nil {
+		logger.Errorf("From=%v Service=%v Subscriber=%v DeliveryPoint=%v Failed: %v", remoteAddr, service, subscriber, dpName, err)
+		return APIResponseDetails{From: &remoteAddr, Service: &service, Subscriber: &subscriber, DeliveryPoint: &dpName, Code: UNIQUSH_ERROR_DATABASE, ErrorMsg: strPtrOfErr(err)}
+	}
+	if len(pairs) == 0 || pairs[0].DeliveryPoint == nil {
+		errorMsg := "The subscriber of the service has no such delivery point"
+		return APIResponseDetails{From: &remoteAddr, Service: &service, Subscriber: &subscriber, DeliveryPoint: &dpName, Code: UNIQUSH_ERROR_NO_DELIVERY_POINT, ErrorMsg: &errorMsg}
+	}
+	// The delivery point may be shared by the caches and pushes in progress, so a copy is changed.
+	psm := push.GetPushServiceManager()
+	dp, err := psm.BuildDeliveryPointFromBytes(pairs[0].DeliveryPoint.Marshal())
+	if err != nil {
+		return APIResponseDetails{From: &remoteAddr, Service: &service, Subscriber: &subscriber, DeliveryPoint: &dpName, Code: UNIQUSH_ERROR_GENERIC, ErrorMsg: strPtrOfErr(err)}
+	}
+	if token, ok := kv["token"]; ok {
+		supported, err := psm.RefreshToken(dp, token)
+		if err == nil && !supported {
+			err = errors.New("The push service type of the delivery point can't refresh tokens")
+		}
+		if err != nil {
+			logger.Warnf("From=%v Service=%v Subscriber=%v DeliveryPoint=%v Cannot refresh token: %v", remoteAddr, service, subscriber, dpName, err)
+			return APIResponseDetails{From: &remoteAddr, Service: &service, Subscriber: &subscriber, DeliveryPoint: &dpName, Code: UNIQUSH_ERROR_BAD_DELIVERY_POINT, ErrorMsg: strPtrOfErr(err)}
+		}
+	}
+	dp.VolatileData[push.LastSeen] = strconv.FormatInt(time.Now().Unix(), 10)
+
+	err = api.backend.journal.Record(JournalModify, service, subscriber, dp)
+	if err == nil {
+		err = api.backend.db.ModifyDeliveryPoint(dp)
+	}
+	if err != nil {
+		logger.Errorf("From=%v Service=%v Subscriber=%v DeliveryPoint=%v Refresh Failed: %v", remoteAddr, service, subscriber, dpName, err)
+		return APIResponseDetails{From: &remoteAddr, Service: &service, Subscriber: &subscriber, DeliveryPoint: &dpName, Code: UNIQUSH_ERROR_UPDATE_DELIVERY_POINT, ErrorMsg: strPtrOfErr(err)}
+	}
+	logger.Debugf("From=%v Service=%v Subscriber=%v DeliveryPoint=%v Refreshed", remoteAddr, service, subscriber, dpName)
+	return APIResponseDetails{From: &remoteAddr, Service: &service, Subscriber: &subscriber, DeliveryPoint: &dpName, Code: UNIQUSH_SUCCESS}
+}
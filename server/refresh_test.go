@@ -0,0 +1,76 @@
+package server
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/uniqush/uniqush-push/db"
+	"github.com/uniqush/uniqush-push/push"
+	"github.com/uniqush/uniqush-push/testutil"
+)
+
+// refreshTestPushServiceType is the bench push service type, with tokens which can be refreshed.
+type refreshTestPushServiceType struct {
+	*benchPushServiceType
+}
+
+func (pst refreshTestPushServiceType) RefreshToken(dp *push.DeliveryPoint, token string) error {
+	dp.VolatileData["token"] = token
+	return nil
+}
+
+// refreshDatabase has a single delivery point, and records the delivery points which are modified. Other methods aren't implemented.
+type refreshDatabase struct {
+	db.PushDatabase
+	dp       *push.DeliveryPoint
+	modified []*push.DeliveryPoint
+}
+
+func (d *refreshDatabase) GetPushServiceProviderDeliveryPointPairs(service string, subscriber string, dpNamesRequested []string) ([]db.PushServiceProviderDeliveryPointPair, error) {
+	if service != "myservice" || subscriber != "user1" || len(dpNamesRequested) != 1 || dpNamesRequested[0] != d.dp.Name() {
+		return nil, nil
+	}
+	return []db.PushServiceProviderDeliveryPointPair{{DeliveryPoint: d.dp}}, nil
+}
+
+func (d *refreshDatabase) ModifyDeliveryPoint(dp *push.DeliveryPoint) error {
+	d.modified = append(d.modified, dp)
+	return nil
+}
+
+func TestRefreshDeliveryPoint(t *testing.T) {
+	_, dp := newFailureTestPeers(t)
+	database := &refreshDatabase{dp: dp}
+	api := newHealthTestAPI(database)
+	logger := api.loggers[LoggerSub]
+
+	details := api.refreshDeliveryPoint(map[string]string{"service": "myservice", "subscriber": "user1", "delivery_point_id": "bench:other"}, logger, "10.0.0.1")
+	testutil.ExpectStringEquals(t, UNIQUSH_ERROR_NO_DELIVERY_POINT, details.Code, "expected unknown delivery points to be rejected")
+	details = api.refreshDeliveryPoint(map[string]string{"service": "myservice", "subscriber": "user1", "delivery_point_id": dp.Name(), "token": "token2"}, logger, "10.0.0.1")
+	testutil.ExpectStringEquals(t, UNIQUSH_ERROR_BAD_DELIVERY_POINT, details.Code, "expected tokens to be refreshed only by push service types which support it")
+
+	start := time.Now().Unix()
+	details = api.refreshDeliveryPoint(map[string]string{"service": "myservice", "subscriber": "user1", "delivery_point_id": dp.Name()}, logger, "10.0.0.1")
+	testutil.ExpectStringEquals(t, UNIQUSH_SUCCESS, details.Code, "expected the delivery point to be refreshed")
+	testutil.ExpectEquals(t, 1, len(database.modified), "expected a single write")
+	lastSeen, _ := strconv.ParseInt(database.modified[0].VolatileData[push.LastSeen], 10, 64)
+	testutil.ExpectEquals(t, true, lastSeen >= start, "expected last_seen to be set")
+	testutil.ExpectEquals(t, 0, len(dp.VolatileData), "expected the delivery point of the database to be copied")
+
+	psm := push.GetPushServiceManager()
+	psm.ClearAllPushServiceTypesForUnitTest()
+	if err := psm.RegisterPushServiceType(refreshTestPushServiceType{newBenchPushServiceType(0)}); err != nil {
+		t.Fatal(err)
+	}
+	dp, err := psm.BuildDeliveryPointFromMap(map[string]string{"service": "myservice", "subscriber": "user1", "pushservicetype": benchPushServiceName, "token": "token1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	database.dp = dp
+	details = api.refreshDeliveryPoint(map[string]string{"service": "myservice", "subscriber": "user1", "delivery_point_id": dp.Name(), "token": "token2"}, logger, "10.0.0.1")
+	testutil.ExpectStringEquals(t, UNIQUSH_SUCCESS, details.Code, "expected the token to be refreshed")
+	refreshed := database.modified[1]
+	testutil.ExpectStringEquals(t, "token2", refreshed.VolatileData["token"], "expected the new token")
+	testutil.ExpectStringEquals(t, dp.Name(), refreshed.Name(), "expected the name of the delivery point not to change")
+}
@@ -0,0 +1,102 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/uniqush/log"
+	"github.com/uniqush/uniqush-push/db"
+	"github.com/uniqush/uniqush-push/push"
+)
+
+// ReloadConfigURL re-reads uniqush.conf on the admin listener, like SIGHUP.
+const ReloadConfigURL = "/reload"
+
+// configReloader applies the settings of uniqush.conf which can change without restarting uniqush-push:
+// the levels of the loggers, the rate limits of [RateLimit], the sizes of the caches of [Database],
+// and the number of workers of the push services (e.g. [APNS] workers).
+// Other settings (e.g. addresses, databases and TLS) still require a restart.
+type configReloader struct {
+	mutex   sync.Mutex
+	path    string
+	loggers []log.Logger
+	limiter *rateLimiter
+	db      db.PushDatabase
+	psm     *push.PushServiceManager
+}
+
+func newConfigReloader(path string, loggers []log.Logger, limiter *rateLimiter, database db.PushDatabase, psm *push.PushServiceManager) *configReloader {
+	return &configReloader{path: path, loggers: loggers, limiter: limiter, db: database, psm: psm}
+}
+
+// Reload re-reads the config file and applies it. Nothing is changed if the config file can't be read or is invalid.
+func (r *configReloader) Reload() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	logger := r.loggers[LoggerWeb]
+	c, err := OpenConfig(r.path)
+	if err != nil {
+		logger.Errorf("ReloadConfig Failed \"%v\"", err)
+		return err
+	}
+	rateLimitConf, err := LoadRateLimitConfig(c)
+	if err != nil {
+		logger.Errorf("ReloadConfig Failed \"%v\"", err)
+		return err
+	}
+	dbconf, err := LoadDatabaseConfig(c)
+	if err != nil {
+		logger.Errorf("ReloadConfig Failed \"%v\"", err)
+		return err
+	}
+
+	for i, section := range loggerSections {
+		level, warningMsg := loadLogLevel(c, section)
+		if warningMsg != "" {
+			logger.Warn(warningMsg)
+		}
+		r.loggers[i].SetLogLevel(level)
+	}
+	if r.limiter != nil {
+		r.limiter.SetConfig(rateLimitConf)
+	} else if rateLimitConf.enabled() {
+		logger.Warn("[RateLimit] was disabled when uniqush-push started, so it can only be enabled by restarting")
+	}
+	resized := r.db.ResizeCaches(dbconf.CacheSize, dbconf.CacheMaxBytes)
+	if r.psm != nil {
+		r.psm.ReloadConfigFile(c)
+	}
+	logger.Infof("ReloadConfig %s RateLimit=%v CacheSize=%d CacheMaxBytes=%d CacheResized=%v", r.path, r.limiter != nil, dbconf.CacheSize, dbconf.CacheMaxBytes, resized)
+	return nil
+}
+
+// serveReload handles ReloadConfigURL.
+func (r *configReloader) serveReload(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(w, "The config file must be reloaded with POST", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.Reload(); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to reload the config file: %v", err), http.StatusBadRequest)
+		return
+	}
+	fmt.Fprintln(w, "Reloaded the config file")
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/uniqush/log"
+	"github.com/uniqush/uniqush-push/db"
+	"github.com/uniqush/uniqush-push/testutil"
+)
+
+// resizeTestDatabase records the limits of the caches set by configReloader.
+type resizeTestDatabase struct {
+	db.PushDatabase
+	maxEntries int
+	maxBytes   int64
+}
+
+func (d *resizeTestDatabase) ResizeCaches(maxEntries int, maxBytes int64) bool {
+	d.maxEntries, d.maxBytes = maxEntries, maxBytes
+	return true
+}
+
+func TestConfigReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "uniqush-reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "uniqush.conf")
+	write := func(s string) {
+		if err := ioutil.WriteFile(path, []byte(s), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var buf bytes.Buffer
+	loggers := make([]log.Logger, NumberOfLoggers)
+	for i := range loggers {
+		loggers[i] = newJSONLogger(&buf, loggerSections[i], log.LOGLEVEL_INFO)
+	}
+	limiter := newRateLimiter(RateLimitConfig{PerIP: RateLimit{Rate: 1, Burst: 1}})
+	database := &resizeTestDatabase{}
+	reloader := newConfigReloader(path, loggers, limiter, database, nil)
+
+	write("[Push]\nloglevel=debug\n[RateLimit]\nper_ip=5:10\n[Database]\ncache=on\ncachesize=100\ncache_max_bytes=2048\n")
+	if err := reloader.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	loggers[LoggerPush].Debugf("visible")
+	loggers[LoggerSub].Debugf("hidden")
+	testutil.ExpectEquals(t, true, bytes.Contains(buf.Bytes(), []byte("visible")), "expected the level of [Push] to be reloaded")
+	testutil.ExpectEquals(t, false, bytes.Contains(buf.Bytes(), []byte("hidden")), "expected the other loggers to stay at the default level")
+	testutil.ExpectEquals(t, RateLimit{Rate: 5, Burst: 10}, limiter.config().PerIP, "expected the rate limits to be reloaded")
+	testutil.ExpectEquals(t, 100, database.maxEntries, "expected the cache size to be reloaded")
+	testutil.ExpectEquals(t, int64(2048), database.maxBytes, "expected the cache byte limit to be reloaded")
+
+	write("[RateLimit]\nper_ip=fast\n")
+	if err := reloader.Reload(); err == nil {
+		t.Error("expected an invalid config file to be rejected")
+	}
+	testutil.ExpectEquals(t, RateLimit{Rate: 5, Burst: 10}, limiter.config().PerIP, "expected an invalid config file not to change anything")
+
+	handler := newAdminHandler(AdminConfig{Addr: "localhost:0", Token: "secret"}, loggers, nil, nil, nil, nil, reloader, nil, nil, nil)
+	write("[RateLimit]\nper_ip=2\n")
+	req := httptest.NewRequest("POST", ReloadConfigURL, nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	testutil.ExpectEquals(t, http.StatusOK, w.Code, "expected the config file to be reloaded on the admin listener")
+	testutil.ExpectEquals(t, 2.0, limiter.config().PerIP.Rate, "expected /reload to reload the rate limits")
+}
@@ -0,0 +1,287 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/uniqush/goconf/conf"
+	"github.com/uniqush/log"
+	"github.com/uniqush/uniqush-push/db"
+	"github.com/uniqush/uniqush-push/push"
+)
+
+// Operations of replication events
+const (
+	ReplicationSubscribe   = "subscribe"
+	ReplicationUnsubscribe = "unsubscribe"
+)
+
+const (
+	replicationSectionPrefix     = "Replication."
+	replicationLeasePrefix       = "replication:"
+	defaultReplicationLogLength  = 1000000
+	defaultReplicationBatchSize  = 100
+	defaultReplicationPollPeriod = time.Second
+)
+
+// ReplicationConfig is a representation of the [Replication] and [Replication.<peer>] sections of uniqush.conf.
+type ReplicationConfig struct {
+	// Region is the name of this region. If it is empty, replication is disabled.
+	Region string
+	// LogLength is roughly how many changes are kept in this region's replication log, for peer regions which are behind.
+	LogLength int64
+	// PollPeriod is how often the replication logs of peer regions are checked for new changes.
+	PollPeriod time.Duration
+	// Peers are the databases of the other regions, by region name.
+	Peers map[string]*db.DatabaseConfig
+}
+
+// LoadReplicationConfig returns a representation of the [Replication] section, and of a [Replication.<peer>] section
+// (with the same settings as [Database]) for the database of each peer region.
+func LoadReplicationConfig(c *conf.ConfigFile) (*ReplicationConfig, error) {
+	config := &ReplicationConfig{
+		LogLength:  defaultReplicationLogLength,
+		PollPeriod: defaultReplicationPollPeriod,
+		Peers:      make(map[string]*db.DatabaseConfig),
+	}
+	if region, err := c.GetString("Replication", "region"); err == nil {
+		config.Region = strings.TrimSpace(region)
+	}
+	if length, err := c.GetInt("Replication", "log_length"); err == nil {
+		if length <= 0 {
+			return nil, fmt.Errorf("[Replication] log_length must be positive, got %d", length)
+		}
+		config.LogLength = int64(length)
+	}
+	if period, err := c.GetInt("Replication", "poll_period"); err == nil {
+		if period <= 0 {
+			return nil, fmt.Errorf("[Replication] poll_period must be positive, got %d", period)
+		}
+		config.PollPeriod = time.Duration(period) * time.Second
+	}
+	for _, section := range c.GetSections() {
+		// goconf lowercases section names, so match the prefix case insensitively. The name of the peer region is the lowercase rest of the section name.
+		if !strings.HasPrefix(strings.ToLower(section), strings.ToLower(replicationSectionPrefix)) {
+			continue
+		}
+		peer := section[len(replicationSectionPrefix):]
+		if config.Region == "" {
+			return nil, fmt.Errorf("[%s]: [Replication] region must be set to replicate with peer regions", section)
+		}
+		if strings.EqualFold(peer, config.Region) {
+			return nil, fmt.Errorf("[%s]: a region can't be its own peer", section)
+		}
+		peerConfig, err := loadDatabaseConfigFromSection(c, section)
+		if err != nil {
+			return nil, fmt.Errorf("[%s]: %v", section, err)
+		}
+		config.Peers[peer] = peerConfig
+	}
+	return config, nil
+}
+
+// ReplicationEvent is a change to the subscriptions of a region, which is applied by the other regions.
+type ReplicationEvent struct {
+	Op         string `json:"op"`
+	Service    string `json:"service"`
+	Subscriber string `json:"subscriber"`
+	// DeliveryPoint is the serialized delivery point, as saved in the database.
+	DeliveryPoint string `json:"deliveryPoint"`
+	// Clock orders changes to the same delivery point. The latest change wins.
+	Clock  string `json:"clock"`
+	Region string `json:"region"`
+}
+
+// replicationClock returns a clock which orders changes by time, then by region. Clocks are compared as strings.
+func replicationClock(t time.Time, region string) string {
+	return fmt.Sprintf("%020d:%s", t.UnixNano(), region)
+}
+
+// replicator makes the subscriptions of several regions (each with their own database) converge, so that any region can serve pushes during an outage of another.
+// Each region logs the changes made to its subscriptions, and applies the changes logged by its peers.
+// Changes to the same delivery point are resolved by the latest clock (last writer wins), so regions converge whatever order the changes are applied in.
+// Push service providers aren't replicated, and must be added to every region.
+type replicator struct {
+	db   db.PushDatabase
+	psm  *push.PushServiceManager
+	jobs *jobRunner
+	conf *ReplicationConfig
+	// residency pins services to backends of [DataResidency]. Their subscriptions aren't replicated, so that they stay in their backend.
+	residency *DataResidencyConfig
+	peers     map[string]db.PushDatabase
+	logger    log.Logger
+	stopChan  chan struct{}
+}
+
+func newReplicator(database db.PushDatabase, psm *push.PushServiceManager, jobs *jobRunner, conf *ReplicationConfig, residency *DataResidencyConfig, logger log.Logger) (*replicator, error) {
+	if conf.Region == "" {
+		return nil, nil
+	}
+	rp := &replicator{
+		db:        database,
+		psm:       psm,
+		jobs:      jobs,
+		conf:      conf,
+		residency: residency,
+		peers:     make(map[string]db.PushDatabase, len(conf.Peers)),
+		logger:    logger,
+		stopChan:  make(chan struct{}),
+	}
+	for peer, peerConfig := range conf.Peers {
+		peerDB, err := db.NewPushDatabaseWithoutCache(peerConfig)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot connect to the database of region %s: %v", peer, err)
+		}
+		rp.peers[peer] = peerDB
+	}
+	return rp, nil
+}
+
+// Record logs a change to the subscriptions of this region, for the peer regions to apply.
+func (rp *replicator) Record(op, service, sub string, dp *push.DeliveryPoint) {
+	if rp == nil || rp.residency.Pinned(service) {
+		return
+	}
+	event := ReplicationEvent{
+		Op:            op,
+		Service:       service,
+		Subscriber:    sub,
+		DeliveryPoint: string(dp.Marshal()),
+		Clock:         replicationClock(time.Now(), rp.conf.Region),
+		Region:        rp.conf.Region,
+	}
+	if _, err := rp.db.SetReplicationClockIfNewer(service, sub, dp.Name(), event.Clock); err != nil {
+		rp.logger.Errorf("Service=%v Subscriber=%v DeliveryPoint=%v Cannot save replication clock: %v", service, sub, dp.Name(), err)
+	}
+	data, err := json.Marshal(event)
+	if err == nil {
+		err = rp.db.AddReplicationEvent(data, rp.conf.LogLength)
+	}
+	if err != nil {
+		rp.logger.Errorf("Service=%v Subscriber=%v DeliveryPoint=%v Op=%v Cannot log change for peer regions: %v", service, sub, dp.Name(), op, err)
+	}
+}
+
+// Run applies the changes logged by each peer region, until Stop is called.
+// Only one instance of this region applies the changes of a peer at a time.
+func (rp *replicator) Run() {
+	for peer, peerDB := range rp.peers {
+		go rp.follow(peer, peerDB)
+	}
+}
+
+// Stop stops applying the changes of peer regions. Changes are still logged for peer regions.
+func (rp *replicator) Stop() {
+	close(rp.stopChan)
+}
+
+func (rp *replicator) follow(peer string, peerDB db.PushDatabase) {
+	ticker := time.NewTicker(rp.conf.PollPeriod)
+	defer ticker.Stop()
+	for {
+		_, err := rp.jobs.RunExclusive(replicationLeasePrefix+peer, func(lost <-chan struct{}) {
+			for {
+				select {
+				case <-lost:
+					return
+				case <-rp.stopChan:
+					return
+				default:
+				}
+				n, err := rp.pull(peer, peerDB)
+				if err != nil {
+					rp.logger.Errorf("Peer=%v Cannot apply changes: %v", peer, err)
+					return
+				}
+				if n == 0 {
+					return
+				}
+			}
+		})
+		if err != nil {
+			rp.logger.Errorf("Peer=%v Cannot claim replication: %v", peer, err)
+		}
+		select {
+		case <-rp.stopChan:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// pull applies the next batch of changes logged by a peer region, and returns the number of changes in the batch.
+func (rp *replicator) pull(peer string, peerDB db.PushDatabase) (int, error) {
+	offset, err := rp.db.GetReplicationOffset(peer)
+	if err != nil {
+		return 0, err
+	}
+	if offset == "" {
+		offset = "0"
+	}
+	ids, events, err := peerDB.GetReplicationEvents(offset, defaultReplicationBatchSize)
+	if err != nil || len(ids) == 0 {
+		return 0, err
+	}
+	for i, data := range events {
+		var event ReplicationEvent
+		if err := json.Unmarshal(data, &event); err != nil {
+			rp.logger.Errorf("Peer=%v EventID=%v Invalid replication event: %v", peer, ids[i], err)
+			continue
+		}
+		if err := rp.apply(&event); err != nil {
+			// The change can't be applied later either (e.g. the push service provider only exists in the peer region), so skip it.
+			rp.logger.Errorf("Peer=%v EventID=%v Service=%v Subscriber=%v Op=%v Cannot apply change: %v", peer, ids[i], event.Service, event.Subscriber, event.Op, err)
+		}
+	}
+	if err := rp.db.SetReplicationOffset(peer, ids[len(ids)-1]); err != nil {
+		return 0, err
+	}
+	return len(ids), nil
+}
+
+// apply applies a change logged by a peer region, unless this region has a later change to the same delivery point.
+// The change isn't logged again, since each region only logs its own changes.
+func (rp *replicator) apply(event *ReplicationEvent) error {
+	if rp.residency.Pinned(event.Service) {
+		return fmt.Errorf("Service %s is pinned to a backend of [DataResidency], so its changes aren't applied from region %s", event.Service, event.Region)
+	}
+	dp, err := rp.psm.BuildDeliveryPointFromBytes([]byte(event.DeliveryPoint))
+	if err != nil {
+		return err
+	}
+	newer, err := rp.db.SetReplicationClockIfNewer(event.Service, event.Subscriber, dp.Name(), event.Clock)
+	if err != nil || !newer {
+		return err
+	}
+	switch event.Op {
+	case ReplicationSubscribe:
+		_, err = rp.db.AddDeliveryPointToService(event.Service, event.Subscriber, dp)
+	case ReplicationUnsubscribe:
+		err = rp.db.RemoveDeliveryPointFromService(event.Service, event.Subscriber, dp)
+	default:
+		err = fmt.Errorf("Unknown operation %q", event.Op)
+	}
+	if err == nil {
+		rp.logger.Debugf("Region=%v Service=%v Subscriber=%v DeliveryPoint=%v Op=%v Applied", event.Region, event.Service, event.Subscriber, dp.Name(), event.Op)
+	}
+	return err
+}
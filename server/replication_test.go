@@ -0,0 +1,63 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/uniqush/goconf/conf"
+	"github.com/uniqush/uniqush-push/testutil"
+)
+
+func TestReplicationClockOrdering(t *testing.T) {
+	earlier := replicationClock(time.Unix(999, 0), "us-east")
+	later := replicationClock(time.Unix(1000, 0), "eu-west")
+	if !(earlier < later) {
+		t.Errorf("expected %q to be ordered before %q", earlier, later)
+	}
+	// Changes made at the same time are ordered by region, so that every region picks the same winner.
+	if !(replicationClock(time.Unix(1000, 0), "eu-west") < replicationClock(time.Unix(1000, 0), "us-east")) {
+		t.Errorf("expected clocks of the same time to be ordered by region")
+	}
+}
+
+func TestLoadReplicationConfigWithPeers(t *testing.T) {
+	c := conf.NewConfigFile()
+	c.AddOption("Replication", "region", "us-east")
+	c.AddOption("Replication.eu-west", "host", "redis.eu-west")
+	c.AddOption("Replication.eu-west", "port", "6380")
+	config, err := LoadReplicationConfig(c)
+	if err != nil {
+		t.Fatalf("Failed to load replication config: %v", err)
+	}
+	testutil.ExpectStringEquals(t, "us-east", config.Region, "unexpected region")
+	if len(config.Peers) != 1 {
+		t.Fatalf("expected 1 peer, got %v", config.Peers)
+	}
+	for peer, peerConfig := range config.Peers {
+		testutil.ExpectStringEquals(t, "eu-west", peer, "unexpected peer region")
+		testutil.ExpectStringEquals(t, "redis.eu-west", peerConfig.Host, "unexpected peer host")
+		testutil.ExpectEquals(t, 6380, peerConfig.Port, "unexpected peer port")
+	}
+
+	c.AddOption("Replication.US-East", "host", "localhost")
+	if _, err := LoadReplicationConfig(c); err == nil {
+		t.Errorf("expected an error when a region is its own peer")
+	}
+}
@@ -0,0 +1,1804 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/uniqush/log"
+	"github.com/uniqush/uniqush-push/db"
+	"github.com/uniqush/uniqush-push/metrics"
+	"github.com/uniqush/uniqush-push/push"
+	"github.com/uniqush/uniqush-push/tracing"
+)
+
+// RestAPI implements uniqush's REST API (/push, /subscribe, /addpsp, etc).
+type RestAPI struct {
+	psm       *push.PushServiceManager
+	loggers   []log.Logger
+	backend   *PushBackEnd
+	version   string
+	waitGroup *sync.WaitGroup
+	stopChan  chan<- bool
+	// shutdownTimeout is how long to wait for requests in progress (and queued results) to finish when stopping.
+	shutdownTimeout time.Duration
+	// stopMutex protects stopping, so that no request is added to waitGroup after stop starts waiting for it.
+	stopMutex sync.Mutex
+	stopping  bool
+	// ingester receives push requests from sources other than the REST API. If nil, no ingestion adapters are configured.
+	ingester *ingester
+	// metrics are collected from the backend for /metrics, along with metrics.DefaultRegistry.
+	metrics *metrics.Registry
+	// listeners serve the API, and can be added and removed on the admin listener. If nil, Run creates them.
+	listeners *listenerSet
+	// upstreamCompat responds like the upstream uniqush-push (compat=upstream in [WebFrontend]), for clients written against it.
+	upstreamCompat bool
+	// requestTimeout is how long a push can take (request_timeout in [WebFrontend]), 0 if it isn't limited.
+	requestTimeout time.Duration
+}
+
+func randomUniqID() string {
+	var d [16]byte
+	io.ReadFull(rand.Reader, d[:])
+	return fmt.Sprintf("%x-%v", time.Now().Unix(), base64.URLEncoding.EncodeToString(d[:]))
+}
+
+// NewRestAPI constructs the data structures for the singleton REST API of uniqush-push
+func NewRestAPI(psm *push.PushServiceManager, loggers []log.Logger, version string, backend *PushBackEnd) *RestAPI {
+	ret := new(RestAPI)
+	ret.psm = psm
+	ret.loggers = loggers
+	ret.version = version
+	ret.backend = backend
+	ret.waitGroup = new(sync.WaitGroup)
+	ret.shutdownTimeout = defaultShutdownTimeout
+	ret.metrics = newBackendMetrics(backend)
+	return ret
+}
+
+// Constants for the paths of the REST API
+const (
+	AddPushServiceProviderToServiceURL      = "/addpsp"
+	RemovePushServiceProviderFromServiceURL = "/rmpsp"
+	AddDeliveryPointToServiceURL            = "/subscribe"
+	RemoveDeliveryPointFromServiceURL       = "/unsubscribe"
+	PushNotificationURL                     = "/push"
+	PreviewPushNotificationURL              = "/previewpush"
+	StopProgramURL                          = "/stop"
+	VersionInfoURL                          = "/version"
+	QueryNumberOfDeliveryPointsURL          = "/nrdp"
+	QuerySubscriptionsURL                   = "/subscriptions"
+	QueryPushServiceProviders               = "/psps"
+	RebuildServiceSetURL                    = "/rebuildserviceset"
+	QueryQuarantineURL                      = "/quarantine"
+	ReleaseQuarantineURL                    = "/rmquarantine"
+	QueryDeliveriesURL                      = "/deliveries"
+	QueryInboxURL                           = "/inbox"
+	RemoveInboxMessagesURL                  = "/rminbox"
+	BroadcastURL                            = "/broadcast"
+	QueryBroadcastsURL                      = "/broadcasts"
+	PauseBroadcastURL                       = "/pausebroadcast"
+	ResumeBroadcastURL                      = "/resumebroadcast"
+	CancelBroadcastURL                      = "/cancelbroadcast"
+	QueryQueueURL                           = "/queue"
+	QueryCacheURL                           = "/cache"
+	QueryStagedUnsubscribesURL              = "/stagedunsubscribes"
+	ConfirmUnsubscribeURL                   = "/confirmunsubscribe"
+	CancelUnsubscribeURL                    = "/cancelunsubscribe"
+	ReconcileURL                            = "/reconcile"
+	QueryFlaggedDeliveryPointsURL           = "/flagged"
+	QuerySubscribersURL                     = "/subscribers"
+	MetricsURL                              = "/metrics"
+	HealthzURL                              = "/healthz"
+	ReadyzURL                               = "/readyz"
+	QueryAnalyticsURL                       = "/analytics"
+	QueryAuditURL                           = "/audit"
+	DashboardURL                            = "/dashboard"
+	TrackOpenURL                            = "/track/open"
+	TrackClickURL                           = "/track/click"
+	QueryFailuresURL                        = "/failures"
+	QueryCanaryURL                          = "/canary"
+	QueryClusterURL                         = "/cluster"
+	UnsubscribeTokenURL                     = "/unsubscribetoken"
+	UnsubscribeWithTokenURL                 = "/unsubscribe/token"
+	QuerySubscribeAbuseURL                  = "/subscribeabuse"
+	ReviewSubscribeAbuseURL                 = "/reviewsubscribeabuse"
+)
+
+// TODO: Switch to the stricter regex in a subsequent release.
+// uniqush.org didn't really document the accepted characters, so it's possible some clients used invalid characters.
+// Don't allow backticks.
+// TODO: Log an error if they're used.
+// var validServicePattern *regexp.Regexp = regexp.MustCompile(`^[a-zA-Z.0-9_@-]+$`)
+// var validSubscriberPattern *regexp.Regexp = regexp.MustCompile(`^[a-zA-Z.0-9_@-]+$`)
+
+var validServicePattern = regexp.MustCompile(`^[a-zA-Z.0-9_@\[\]^\\\\-]+$`)
+var validSubscriberPattern = regexp.MustCompile(`^[a-zA-Z.0-9_@-\[\]^\\\\-]+$`)
+
+func validateSubscribers(subs []string) error {
+	for _, sub := range subs {
+		if !validSubscriberPattern.MatchString(sub) {
+			return fmt.Errorf("invalid subscriber name: %q. Accepted characters: a-z, A-Z, 0-9, -, _, @ or .", sub) // nolint: golint
+		}
+	}
+	return nil
+}
+
+func validateService(service string) error {
+	if !validServicePattern.MatchString(service) {
+		return fmt.Errorf("invalid service name: %q. Accepted characters: a-z, A-Z, 0-9, -, _, @ or .", service) // nolint: golint
+	}
+	return nil
+}
+
+func getSubscribersFromMap(kv map[string]string, validate bool) (subs []string, err error) {
+	var v string
+	var ok bool
+	if v, ok = kv["subscriber"]; !ok {
+		if v, ok = kv["subscribers"]; !ok {
+			err = fmt.Errorf("NoSubscriber")
+			return
+		}
+	}
+	s := strings.Split(v, ",")
+	subs = make([]string, 0, len(s))
+	for _, sub := range s {
+		if len(sub) > 0 {
+			subs = append(subs, sub)
+		}
+	}
+	if validate {
+		err = validateSubscribers(subs)
+		if err != nil {
+			subs = nil
+			return
+		}
+	}
+	return
+}
+
+// Get the optional delivery_point_ids from a map.
+func getDeliveryPointIdsFromMap(kv map[string]string) (deliveryPointNames []string, err error) {
+	var v string
+	var ok bool
+	if v, ok = kv["delivery_point_id"]; !ok {
+		return nil, nil
+	}
+	if len(v) == 0 {
+		return nil, fmt.Errorf("EmptyDeliveryPoints")
+	}
+	s := strings.Split(v, ",")
+	deliveryPointNames = make([]string, 0, len(s))
+	for _, dpName := range s {
+		if len(dpName) > 0 {
+			// TODO validate.
+			deliveryPointNames = append(deliveryPointNames, dpName)
+		}
+	}
+	if len(deliveryPointNames) == 0 {
+		return nil, fmt.Errorf("EmptyDeliveryPoints")
+	}
+	return
+}
+
+func getServiceFromMap(kv map[string]string) (service string, err error) {
+	var ok bool
+	if service, ok = kv["service"]; !ok {
+		err = fmt.Errorf("NoService")
+		return
+	}
+	err = validateService(service)
+	if err != nil {
+		service = ""
+		return
+	}
+	return
+}
+
+func (api *RestAPI) changePushServiceProvider(kv map[string]string, logger log.Logger, remoteAddr, apiKey string, add bool) APIResponseDetails {
+	// fallback=1 adds or removes the push service provider to fail over to, instead of the one used for subscriptions.
+	isFallback := kv["fallback"] == "1"
+	delete(kv, "fallback")
+	// validate=0 adds the push service provider without checking its credentials with the push service (e.g. when it is unreachable).
+	validate := kv["validate"] != "0"
+	delete(kv, "validate")
+	psp, err := api.psm.BuildPushServiceProviderFromMap(kv)
+	if err != nil {
+		logger.Errorf("From=%v Cannot build push service provider: %v", remoteAddr, err)
+		return APIResponseDetails{From: &remoteAddr, Code: UNIQUSH_ERROR_BUILD_PUSH_SERVICE_PROVIDER, ErrorMsg: strPtrOfErr(err)}
+	}
+	service, err := getServiceFromMap(kv)
+	if err != nil {
+		logger.Errorf("From=%v Cannot get service name: %v; %v", remoteAddr, service, err)
+		return APIResponseDetails{From: &remoteAddr, Service: &service, Code: UNIQUSH_ERROR_CANNOT_GET_SERVICE, ErrorMsg: strPtrOfErr(err)}
+	}
+	if add && validate {
+		if err := api.validateCredentials(psp); err != nil {
+			logger.Errorf("From=%v Service=%v PushServiceProvider=%v Invalid credentials: %v", remoteAddr, service, psp.Name(), err)
+			return APIResponseDetails{From: &remoteAddr, Service: &service, Code: UNIQUSH_ERROR_INVALID_CREDENTIALS, ErrorMsg: strPtrOfErr(err)}
+		}
+	}
+	if isFallback {
+		return api.changeFallbackPushServiceProvider(service, psp, logger, remoteAddr, apiKey, add)
+	}
+	record := AuditRecord{Action: AuditAddPSP, From: remoteAddr, APIKey: apiKey, Service: service}
+	if !add {
+		record.Action = AuditRemovePSP
+	}
+	err = api.backend.audit.changePushServiceProvider(record, psp, add, func() error {
+		if add {
+			return api.backend.AddPushServiceProvider(service, psp)
+		}
+		return api.backend.RemovePushServiceProvider(service, psp)
+	})
+	if err != nil {
+		logger.Errorf("From=%v Failed: %v", remoteAddr, err)
+		return APIResponseDetails{From: &remoteAddr, Code: UNIQUSH_ERROR_GENERIC, ErrorMsg: strPtrOfErr(err)}
+	}
+	pspName := psp.Name()
+	logger.Infof("From=%v Service=%v PushServiceProvider=%v Success!", remoteAddr, service, pspName)
+	return APIResponseDetails{From: &remoteAddr, Service: &service, PushServiceProvider: &pspName, Code: UNIQUSH_SUCCESS}
+}
+
+// validateCredentials checks the credentials of a push service provider with its push service, if the push service type can check them.
+func (api *RestAPI) validateCredentials(psp *push.PushServiceProvider) error {
+	_, err := api.backend.ValidateCredentials(psp)
+	return err
+}
+
+func (api *RestAPI) changeFallbackPushServiceProvider(service string, psp *push.PushServiceProvider, logger log.Logger, remoteAddr, apiKey string, add bool) APIResponseDetails {
+	pspName := psp.Name()
+	record := AuditRecord{Action: AuditAddFallbackPSP, From: remoteAddr, APIKey: apiKey, Service: service}
+	if !add {
+		record.Action = AuditRemoveFallbackPSP
+		err := api.backend.audit.changePushServiceProvider(record, psp, add, func() error {
+			return api.backend.RemoveFallbackPushServiceProvider(service, psp)
+		})
+		if err != nil {
+			logger.Errorf("From=%v Service=%v Fallback=%v Failed: %v", remoteAddr, service, pspName, err)
+			return APIResponseDetails{From: &remoteAddr, Service: &service, Code: UNIQUSH_ERROR_GENERIC, ErrorMsg: strPtrOfErr(err)}
+		}
+		logger.Infof("From=%v Service=%v Fallback=%v Success!", remoteAddr, service, pspName)
+		return APIResponseDetails{From: &remoteAddr, Service: &service, PushServiceProvider: &pspName, Code: UNIQUSH_SUCCESS}
+	}
+	var primaryName string
+	err := api.backend.audit.changePushServiceProvider(record, psp, add, func() (err error) {
+		primaryName, err = api.backend.AddFallbackPushServiceProvider(service, psp)
+		return err
+	})
+	if err != nil {
+		logger.Errorf("From=%v Service=%v Fallback=%v Failed: %v", remoteAddr, service, pspName, err)
+		return APIResponseDetails{From: &remoteAddr, Service: &service, Code: UNIQUSH_ERROR_GENERIC, ErrorMsg: strPtrOfErr(err)}
+	}
+	logger.Infof("From=%v Service=%v PushServiceProvider=%v Fallback=%v Success!", remoteAddr, service, primaryName, pspName)
+	return APIResponseDetails{From: &remoteAddr, Service: &service, PushServiceProvider: &pspName, Code: UNIQUSH_SUCCESS}
+}
+
+func (api *RestAPI) changeSubscription(kv map[string]string, logger log.Logger, remoteAddr string, issub bool) APIResponseDetails {
+	dp, err := api.psm.BuildDeliveryPointFromMap(kv)
+	if err != nil {
+		logger.Errorf("Cannot build delivery point: %v", err)
+		return APIResponseDetails{From: &remoteAddr, Code: UNIQUSH_ERROR_BUILD_DELIVERY_POINT, ErrorMsg: strPtrOfErr(err)}
+	}
+	service, err := getServiceFromMap(kv)
+	if err != nil {
+		logger.Errorf("From=%v Cannot get service name: %v; %v", remoteAddr, service, err)
+		return APIResponseDetails{From: &remoteAddr, Service: &service, Code: UNIQUSH_ERROR_CANNOT_GET_SERVICE, ErrorMsg: strPtrOfErr(err)}
+	}
+	subs, err := getSubscribersFromMap(kv, true)
+	if err != nil {
+		logger.Errorf("From=%v Service=%v Cannot get subscriber: %v", remoteAddr, service, err)
+		return APIResponseDetails{From: &remoteAddr, Service: &service, Code: UNIQUSH_ERROR_CANNOT_GET_SUBSCRIBER, ErrorMsg: strPtrOfErr(err)}
+	}
+
+	dpName := dp.Name()
+	if issub {
+		if err := api.backend.subscribeAbuse.Allow(service, subs[0], dp, remoteAddr); err != nil {
+			logger.Warnf("From=%v Service=%v Subscriber=%v DeliveryPoint=%v Rejected: %v", remoteAddr, service, subs[0], dpName, err)
+			return APIResponseDetails{From: &remoteAddr, Service: &service, Subscriber: &subs[0], Code: UNIQUSH_ERROR_SUBSCRIBE_BLOCKED, ErrorMsg: strPtrOfErr(err)}
+		}
+	}
+	if !issub && api.backend.unsubscribes != nil {
+		staged, err := api.backend.unsubscribes.Stage(service, subs[0], dpName, remoteAddr)
+		if err != nil {
+			logger.Errorf("From=%v Service=%v Subscriber=%v DeliveryPoint=%v Cannot stage unsubscribe: %v", remoteAddr, service, subs[0], dpName, err)
+			return APIResponseDetails{From: &remoteAddr, Service: &service, Code: UNIQUSH_ERROR_DATABASE, ErrorMsg: strPtrOfErr(err)}
+		}
+		logger.Infof("From=%v Service=%v Subscriber=%v DeliveryPoint=%v StagedUnsubscribe=%v Staged until %v", remoteAddr, service, subs[0], dpName, staged.ID, time.Unix(staged.Deadline, 0))
+		return APIResponseDetails{RequestID: &staged.ID, From: &remoteAddr, Service: &service, Subscriber: &subs[0], DeliveryPoint: &dpName, Code: UNIQUSH_UNSUBSCRIBE_STAGED}
+	}
+
+	var psp *push.PushServiceProvider
+	if issub {
+		psp, err = api.backend.Subscribe(service, subs[0], dp)
+	} else {
+		err = api.backend.Unsubscribe(service, subs[0], dp)
+	}
+	if err != nil {
+		logger.Errorf("From=%v Failed: %v", remoteAddr, err)
+		return APIResponseDetails{From: &remoteAddr, Code: tenantErrorCode(err), ErrorMsg: strPtrOfErr(err)}
+	}
+	if psp == nil {
+		logger.Infof("From=%v Service=%v Subscriber=%v DeliveryPoint=%v Success!", remoteAddr, service, subs[0], dpName)
+		return APIResponseDetails{From: &remoteAddr, Service: &service, Subscriber: &subs[0], DeliveryPoint: &dpName, Code: UNIQUSH_SUCCESS}
+	}
+	pspName := psp.Name()
+	logger.Infof("From=%v Service=%v Subscriber=%v PushServiceProvider=%v DeliveryPoint=%v Success!", remoteAddr, service, subs[0], pspName, dpName)
+	return APIResponseDetails{From: &remoteAddr, Service: &service, Subscriber: &subs[0], DeliveryPoint: &dpName, PushServiceProvider: &pspName, Code: UNIQUSH_SUCCESS}
+}
+
+func (api *RestAPI) buildNotificationFromKV(reqID string, kv map[string]string, logger log.Logger, remoteAddr string, service string, subs []string) (notif *push.Notification, details *APIResponseDetails, err error) {
+	notif = push.NewEmptyNotification()
+
+	for k, v := range kv {
+		if len(v) <= 0 {
+			continue
+		}
+		switch k {
+		case "subscriber":
+		case "subscribers":
+		case "service":
+			// three keys need to be ignored
+		case campaignKey:
+			if err := validateCampaign(v); err != nil {
+				logger.Errorf("RequestID=%v From=%v Service=%v %v", reqID, remoteAddr, service, err)
+				details = &APIResponseDetails{RequestID: &reqID, From: &remoteAddr, Service: &service, Code: UNIQUSH_ERROR_GENERIC, ErrorMsg: strPtrOfErr(err)}
+				return nil, details, err
+			}
+			notif.Data[k] = v
+		case "badge":
+			if v != "" {
+				var e error
+				_, e = strconv.Atoi(v)
+				if e == nil {
+					notif.Data["badge"] = v
+				} else {
+					notif.Data["badge"] = "0"
+				}
+			}
+		default:
+			notif.Data[k] = v
+		}
+	}
+
+	if notif.IsEmpty() {
+		logger.Errorf("RequestID=%v From=%v Service=%v NrSubscribers=%v Subscribers=\"%+v\" EmptyNotification", reqID, remoteAddr, service, len(subs), subs)
+		details = &APIResponseDetails{RequestID: &reqID, From: &remoteAddr, Service: &service, Code: UNIQUSH_ERROR_EMPTY_NOTIFICATION}
+		return nil, details, errors.New("empty notification")
+	}
+	return notif, nil, nil
+}
+
+func (api *RestAPI) pushNotification(ctx context.Context, reqID string, kv map[string]string, perdp map[string][]string, logger log.Logger, remoteAddr string, handler APIResponseHandler) {
+	service, err := getServiceFromMap(kv)
+	if err != nil {
+		logger.Errorf("RequestID=%v From=%v Cannot get service name: %v; %v", reqID, remoteAddr, service, err)
+		handler.AddDetailsToHandler(APIResponseDetails{RequestID: &reqID, From: &remoteAddr, Service: &service, Code: UNIQUSH_ERROR_CANNOT_GET_SERVICE})
+		return
+	}
+	// Pushes held during maintenance mode are saved with the parameters they had before being parsed, to be parsed again when they're sent.
+	var heldParams map[string]string
+	if api.backend.maintenance.Holds(service) {
+		heldParams = make(map[string]string, len(kv))
+		for k, v := range kv {
+			heldParams[k] = v
+		}
+	}
+	subs, err := getSubscribersFromMap(kv, false)
+	if err != nil {
+		logger.Errorf("RequestID=%v From=%v Service=%v Cannot get subscriber: %v", reqID, remoteAddr, service, err)
+		handler.AddDetailsToHandler(APIResponseDetails{RequestID: &reqID, From: &remoteAddr, Service: &service, Code: UNIQUSH_ERROR_CANNOT_GET_SUBSCRIBER})
+		return
+	}
+	if len(subs) == 0 {
+		logger.Errorf("RequestID=%v From=%v Service=%v NoSubscriber", reqID, remoteAddr, service)
+		handler.AddDetailsToHandler(APIResponseDetails{RequestID: &reqID, From: &remoteAddr, Service: &service, Code: UNIQUSH_ERROR_NO_SUBSCRIBER})
+		return
+	}
+	dpIds, err := getDeliveryPointIdsFromMap(kv)
+	if err != nil {
+		logger.Errorf("RequestID=%v From=%v Service=%v Cannot get delivery point ids: %v", reqID, remoteAddr, service, err)
+		handler.AddDetailsToHandler(APIResponseDetails{RequestID: &reqID, From: &remoteAddr, Service: &service, Code: UNIQUSH_ERROR_CANNOT_GET_DELIVERY_POINT_ID})
+		return
+	}
+	if len(subs) == 0 {
+		logger.Errorf("RequestID=%v From=%v Service=%v NoSubscriber", reqID, remoteAddr, service)
+		handler.AddDetailsToHandler(APIResponseDetails{RequestID: &reqID, From: &remoteAddr, Service: &service, Code: UNIQUSH_ERROR_NO_SUBSCRIBER})
+		return
+	}
+
+	// uniqush.job_id is used by clients that schedule the same push on multiple uniqush-push instances, it isn't part of the payload.
+	jobID, hasJobID := kv["uniqush.job_id"]
+	delete(kv, "uniqush.job_id")
+
+	retryPolicy, err := api.backend.RetryPolicyFromRequest(service, kv)
+	if err != nil {
+		logger.Errorf("RequestID=%v From=%v Service=%v Invalid retry policy: %v", reqID, remoteAddr, service, err)
+		handler.AddDetailsToHandler(APIResponseDetails{RequestID: &reqID, From: &remoteAddr, Service: &service, Code: UNIQUSH_ERROR_BAD_RETRY_POLICY, ErrorMsg: strPtrOfErr(err)})
+		return
+	}
+
+	notif, details, err := api.buildNotificationFromKV(reqID, kv, logger, remoteAddr, service, subs)
+	if err != nil {
+		handler.AddDetailsToHandler(*details)
+		return
+	}
+	if err := api.backend.payloadPolicies.Check(service, notif, perdp); err != nil {
+		logger.Errorf("RequestID=%v From=%v Service=%v %v", reqID, remoteAddr, service, err)
+		handler.AddDetailsToHandler(APIResponseDetails{RequestID: &reqID, From: &remoteAddr, Service: &service, Code: UNIQUSH_ERROR_PAYLOAD_POLICY, ErrorMsg: strPtrOfErr(err)})
+		return
+	}
+
+	if heldParams != nil {
+		api.holdPush(reqID, remoteAddr, service, heldParams, perdp, logger, handler)
+		return
+	}
+
+	if !hasJobID || jobID == "" {
+		logger.Infof("RequestID=%v From=%v Service=%v NrSubscribers=%v Subscribers=\"%+v\"", reqID, remoteAddr, service, len(subs), subs)
+		api.backend.Push(ctx, reqID, remoteAddr, service, subs, dpIds, notif, perdp, &retryPolicy, logger, handler)
+		return
+	}
+
+	logger.Infof("RequestID=%v From=%v Service=%v JobID=%v NrSubscribers=%v Subscribers=\"%+v\"", reqID, remoteAddr, service, jobID, len(subs), subs)
+	ran, err := api.backend.PushJob(ctx, jobID, reqID, remoteAddr, service, subs, dpIds, notif, perdp, &retryPolicy, logger, handler)
+	if err != nil {
+		logger.Errorf("RequestID=%v From=%v Service=%v JobID=%v Cannot claim job: %v", reqID, remoteAddr, service, jobID, err)
+		handler.AddDetailsToHandler(APIResponseDetails{RequestID: &reqID, From: &remoteAddr, Service: &service, Code: UNIQUSH_ERROR_DATABASE, ErrorMsg: strPtrOfErr(err)})
+		return
+	}
+	if !ran {
+		logger.Infof("RequestID=%v From=%v Service=%v JobID=%v JobAlreadyClaimed", reqID, remoteAddr, service, jobID)
+		handler.AddDetailsToHandler(APIResponseDetails{RequestID: &reqID, From: &remoteAddr, Service: &service, Code: UNIQUSH_JOB_ALREADY_CLAIMED})
+	}
+}
+
+// broadcast starts pushing to every subscriber of a service matching the subscriber pattern (by default, "*").
+// The response contains the id of the broadcast (as the requestId), which can be used to check its progress with /broadcasts.
+func (api *RestAPI) broadcast(kv map[string]string, logger log.Logger, remoteAddr, apiKey string) APIResponseDetails {
+	service, err := getServiceFromMap(kv)
+	if err == nil {
+		err = validateService(service)
+	}
+	if err != nil {
+		logger.Errorf("From=%v Cannot get service name: %v; %v", remoteAddr, service, err)
+		return APIResponseDetails{From: &remoteAddr, Service: &service, Code: UNIQUSH_ERROR_CANNOT_GET_SERVICE, ErrorMsg: strPtrOfErr(err)}
+	}
+	pattern := kv["subscriber"]
+	if pattern == "" {
+		pattern = "*"
+	}
+	if literal := strings.Replace(pattern, "*", "", -1); literal != "" {
+		if err := validateSubscribers([]string{literal}); err != nil {
+			logger.Errorf("From=%v Service=%v Invalid subscriber pattern: %v", remoteAddr, service, err)
+			return APIResponseDetails{From: &remoteAddr, Service: &service, Code: UNIQUSH_ERROR_CANNOT_GET_SUBSCRIBER, ErrorMsg: strPtrOfErr(err)}
+		}
+	}
+	delete(kv, "subscribers")
+	var spread time.Duration
+	if value, ok := kv["uniqush.spread"]; ok {
+		delete(kv, "uniqush.spread")
+		seconds, err := strconv.Atoi(value)
+		if err == nil && (seconds < 0 || time.Duration(seconds)*time.Second > maxBroadcastSpread) {
+			err = fmt.Errorf("must be between 0 and %d seconds", int(maxBroadcastSpread/time.Second))
+		}
+		if err != nil {
+			logger.Errorf("From=%v Service=%v Invalid uniqush.spread %q: %v", remoteAddr, service, value, err)
+			errorMsg := fmt.Sprintf("Invalid uniqush.spread %q: %v", value, err)
+			return APIResponseDetails{From: &remoteAddr, Service: &service, Code: UNIQUSH_ERROR_GENERIC, ErrorMsg: &errorMsg}
+		}
+		spread = time.Duration(seconds) * time.Second
+	}
+	retryPolicy, err := api.backend.RetryPolicyFromRequest(service, kv)
+	if err != nil {
+		logger.Errorf("From=%v Service=%v Invalid retry policy: %v", remoteAddr, service, err)
+		return APIResponseDetails{From: &remoteAddr, Service: &service, Code: UNIQUSH_ERROR_BAD_RETRY_POLICY, ErrorMsg: strPtrOfErr(err)}
+	}
+	if err := api.backend.tenants.pushQuotaExhausted(service); err != nil {
+		logger.Errorf("From=%v Service=%v Cannot broadcast: %v", remoteAddr, service, err)
+		return APIResponseDetails{From: &remoteAddr, Service: &service, Code: tenantErrorCode(err), ErrorMsg: strPtrOfErr(err)}
+	}
+	rid := randomUniqID()
+	notif, details, err := api.buildNotificationFromKV(rid, kv, logger, remoteAddr, service, []string{pattern})
+	if err != nil {
+		return *details
+	}
+	if err := api.backend.payloadPolicies.Check(service, notif, nil); err != nil {
+		logger.Errorf("From=%v Service=%v Cannot broadcast: %v", remoteAddr, service, err)
+		return APIResponseDetails{From: &remoteAddr, Service: &service, Code: UNIQUSH_ERROR_PAYLOAD_POLICY, ErrorMsg: strPtrOfErr(err)}
+	}
+	b, err := api.backend.broadcasts.Start(service, pattern, notif, &retryPolicy, spread, apiKey)
+	if err != nil {
+		logger.Errorf("From=%v Service=%v Subscribers=%v Cannot start broadcast: %v", remoteAddr, service, pattern, err)
+		return APIResponseDetails{From: &remoteAddr, Service: &service, Code: UNIQUSH_ERROR_DATABASE, ErrorMsg: strPtrOfErr(err)}
+	}
+	logger.Infof("From=%v Service=%v Subscribers=%v BroadcastID=%v Started", remoteAddr, service, pattern, b.ID)
+	return APIResponseDetails{RequestID: &b.ID, From: &remoteAddr, Service: &service, Subscriber: &pattern, Code: UNIQUSH_SUCCESS}
+}
+
+// controlBroadcast is used by /pausebroadcast, /resumebroadcast and /cancelbroadcast to change the state of a broadcast.
+// Pausing and cancelling take effect after the batch being sent.
+func (api *RestAPI) controlBroadcast(kv map[string]string, logger log.Logger, remoteAddr string, control func(id string) (*Broadcast, error), action string) APIResponseDetails {
+	id := kv["id"]
+	if id == "" {
+		errorMsg := "Must specify the id of a broadcast"
+		return APIResponseDetails{From: &remoteAddr, Code: UNIQUSH_ERROR_GENERIC, ErrorMsg: &errorMsg}
+	}
+	b, err := control(id)
+	if err != nil {
+		logger.Errorf("From=%v BroadcastID=%v Cannot %s broadcast: %v", remoteAddr, id, action, err)
+		return APIResponseDetails{RequestID: &id, From: &remoteAddr, Code: UNIQUSH_ERROR_GENERIC, ErrorMsg: strPtrOfErr(err)}
+	}
+	logger.Infof("From=%v BroadcastID=%v Service=%v Cursor=%v NrSubscribers=%v Requested %s", remoteAddr, id, b.Service, b.Cursor, b.NrSubscribers, action)
+	return APIResponseDetails{RequestID: &id, From: &remoteAddr, Service: &b.Service, Subscriber: &b.Subscribers, Code: UNIQUSH_SUCCESS}
+}
+
+// queryBroadcasts returns the progress of the broadcast with the given id, or of every active broadcast if id is empty.
+func (api *RestAPI) queryBroadcasts(id string, logger log.Logger) []byte {
+	type responseType struct {
+		Broadcasts   []*Broadcast `json:"broadcasts"`
+		ErrorMessage *string      `json:"errorMsg,omitempty"`
+		Code         string       `json:"code"`
+	}
+	var r responseType
+	var err error
+	if id == "" {
+		r.Broadcasts, err = api.backend.broadcasts.Active()
+	} else {
+		var b *Broadcast
+		b, err = api.backend.broadcasts.Get(id)
+		r.Broadcasts = []*Broadcast{}
+		if b != nil {
+			r.Broadcasts = append(r.Broadcasts, b)
+		}
+	}
+	if err != nil {
+		errorMsg := redactedError(err)
+		logger.Errorf("Error querying broadcasts in /broadcasts: %v", err)
+		r.Code = UNIQUSH_ERROR_DATABASE
+		r.ErrorMessage = &errorMsg
+	} else {
+		r.Code = UNIQUSH_SUCCESS
+	}
+	json, err := json.Marshal(r)
+	if err != nil {
+		return []byte("Failed to serialize response")
+	}
+	return json
+}
+
+// preview takes key-value pairs (pushservicetype, plus data for building the payload), a logger, and logging data.
+func (api *RestAPI) preview(reqID string, kv map[string]string, logger log.Logger, remoteAddr string) PreviewAPIResponseDetails {
+	pushServiceType, ok := kv["pushservicetype"]
+	if !ok || pushServiceType == "" {
+		msg := "Must specify a known pushservicetype"
+		return PreviewAPIResponseDetails{Code: UNIQUSH_ERROR_NO_PUSH_SERVICE_TYPE, ErrorMsg: &msg}
+	}
+	delete(kv, "pushservicetype") // Some modules don't filter this out.
+	notif, details, err := api.buildNotificationFromKV(reqID, kv, logger, remoteAddr, "placeholderservice", []string{})
+	if err != nil {
+		return PreviewAPIResponseDetails{
+			Code:     details.Code,
+			ErrorMsg: details.ErrorMsg,
+		}
+	}
+
+	data, err := api.backend.Preview(pushServiceType, notif)
+	if err != nil {
+		errmsg := redactedError(err)
+		return PreviewAPIResponseDetails{Code: UNIQUSH_ERROR_GENERIC, ErrorMsg: &errmsg}
+	}
+	return PreviewAPIResponseDetails{Code: UNIQUSH_SUCCESS, Payload: apiBytesToObject(data)}
+}
+
+func apiBytesToObject(data []byte) interface{} {
+	// currently, all types are JSON. In the future, there may be non-JSON payloads in a protocol.
+	// Either return a string or an object (to be converted to JSON again by the API)
+	var obj interface{}
+	err := json.Unmarshal(data, &obj)
+	if err != nil || obj == nil {
+		return string(data)
+	}
+	return obj
+}
+
+// beginRequest records that a request which changes data or sends pushes started, so that stop waits for it.
+// Returns false if the request must be rejected because uniqush-push is stopping. Otherwise, endRequest must be called when it finishes.
+func (api *RestAPI) beginRequest() bool {
+	api.stopMutex.Lock()
+	defer api.stopMutex.Unlock()
+	if api.stopping {
+		return false
+	}
+	api.waitGroup.Add(1)
+	return true
+}
+
+func (api *RestAPI) endRequest() {
+	api.waitGroup.Done()
+}
+
+// stop stops accepting new requests which change data or send pushes, and waits (until the shutdown_timeout) for the ones in progress to finish before exiting.
+func (api *RestAPI) stop(w io.Writer, remoteAddr string) {
+	api.stopMutex.Lock()
+	if api.stopping {
+		api.stopMutex.Unlock()
+		if w != nil {
+			fmt.Fprintf(w, "Stopping\r\n")
+		}
+		return
+	}
+	api.stopping = true
+	api.stopMutex.Unlock()
+	api.ingester.Stop()
+
+	logger := api.loggers[LoggerWeb]
+	logger.Infof("Stopping: requested by %v, Timeout=%v", remoteAddr, api.shutdownTimeout)
+	deadline := time.Now().Add(api.shutdownTimeout)
+	if !waitGroupUntil(api.waitGroup, deadline) {
+		logger.Warnf("Stopping: requests in progress didn't finish before the deadline")
+	}
+	api.backend.Finalize(deadline)
+	logger.Infof("stopped by %v", remoteAddr)
+	if w != nil {
+		fmt.Fprintf(w, "Stopped\r\n")
+	}
+	api.stopChan <- true
+}
+
+func (api *RestAPI) numberOfDeliveryPoints(kv map[string][]string, logger log.Logger) int {
+	ret := 0
+	ss, ok := kv["service"]
+	if !ok {
+		return ret
+	}
+	if len(ss) == 0 {
+		return ret
+	}
+	service := ss[0]
+	subs, ok := kv["subscriber"]
+	if !ok {
+		return ret
+	}
+	if len(subs) == 0 {
+		return ret
+	}
+	sub := subs[0]
+	ret = api.backend.NumberOfDeliveryPoints(service, sub, logger)
+	return ret
+}
+
+func (api *RestAPI) querySubscriptions(kv map[string][]string, logger log.Logger) []byte {
+	// "subscriber" is a required parameter
+	subscriberParam, ok := kv["subscriber"]
+	if !ok || len(subscriberParam) == 0 {
+		logger.Errorf("Query=Subscriptions NoSubscriber %v", kv)
+		return []byte("[]")
+	}
+	var services []string
+	// "services" is an optional parameter that can have one or more services passed in the form of a CSV
+	servicesParam, ok := kv["services"]
+	if ok && len(servicesParam) > 0 {
+		services = strings.Split(servicesParam[0], ",")
+	}
+	includeDPIds := false
+	if v, ok := kv["include_delivery_point_ids"]; ok && len(v) > 0 && v[0] == "1" {
+		includeDPIds = true
+	}
+	subscriptions := api.backend.Subscriptions(services, subscriberParam[0], logger, includeDPIds)
+	json, err := json.Marshal(subscriptions)
+	if err != nil {
+		logger.Errorf("Service=%v Subscriber=%v %s", services, subscriberParam[0], err)
+		return []byte("[]")
+	}
+
+	return json
+}
+
+// subscriberListBatchSize is the number of subscribers /subscribers fetches from the database at a time.
+const subscriberListBatchSize = 1000
+
+// listedSubscriber is an item of the response of /subscribers.
+type listedSubscriber struct {
+	Subscriber     string   `json:"subscriber"`
+	DeliveryPoints []string `json:"deliveryPoints,omitempty"`
+}
+
+// querySubscribers streams the subscribers of a service matching the "subscriber" pattern (by default, "*") to w, a batch at a time,
+// so that services with millions of subscribers can be listed without building the whole response in memory.
+// With include_delivery_points=1, the names of the delivery points of each subscriber are included.
+// Since subscribers are listed with a redis SCAN, a subscriber may be listed more than once.
+func (api *RestAPI) querySubscribers(w io.Writer, kv map[string][]string, logger log.Logger) {
+	var service, pattern string
+	if v := kv["service"]; len(v) > 0 {
+		service = v[0]
+	}
+	if v := kv["subscriber"]; len(v) > 0 && v[0] != "" {
+		pattern = v[0]
+	} else {
+		pattern = "*"
+	}
+	includeDPs := false
+	if v, ok := kv["include_delivery_points"]; ok && len(v) > 0 && v[0] == "1" {
+		includeDPs = true
+	}
+
+	stream := newJSONListStream(w, "subscribers")
+	if err := validateService(service); err != nil {
+		stream.Close(UNIQUSH_ERROR_CANNOT_GET_SERVICE, err)
+		return
+	}
+	if literal := strings.Replace(pattern, "*", "", -1); literal != "" {
+		if err := validateSubscribers([]string{literal}); err != nil {
+			stream.Close(UNIQUSH_ERROR_CANNOT_GET_SUBSCRIBER, err)
+			return
+		}
+	}
+	var cursor uint64
+	for {
+		subs, next, err := api.backend.ScanSubscribers(service, pattern, cursor, subscriberListBatchSize)
+		if err != nil {
+			logger.Errorf("Service=%v Error listing subscribers in /subscribers: %v", service, err)
+			stream.Close(UNIQUSH_ERROR_DATABASE, err)
+			return
+		}
+		var dpNames map[string][]string
+		if includeDPs {
+			dpNames, err = api.backend.DeliveryPointNamesOfSubscribers(service, subs)
+			if err != nil {
+				logger.Errorf("Service=%v Error listing delivery points in /subscribers: %v", service, err)
+				stream.Close(UNIQUSH_ERROR_DATABASE, err)
+				return
+			}
+		}
+		for _, sub := range subs {
+			if err := stream.Add(listedSubscriber{Subscriber: sub, DeliveryPoints: dpNames[sub]}); err != nil {
+				logger.Errorf("Service=%v Stopped listing subscribers in /subscribers: %v", service, err)
+				return
+			}
+		}
+		stream.Flush()
+		cursor = next
+		if cursor == 0 {
+			break
+		}
+	}
+	if err := stream.Close(UNIQUSH_SUCCESS, nil); err != nil {
+		logger.Errorf("Service=%v Failed to write the end of /subscribers: %v", service, err)
+	}
+}
+
+func encodePSPForAPI(psp *push.PushServiceProvider) map[string]string {
+	result := make(map[string]string)
+	for key, value := range psp.VolatileData {
+		result[key] = value
+	}
+	for key, value := range psp.FixedData {
+		result[key] = value
+	}
+	return result
+}
+
+// queryPSPs returns JSON describing the set of all PSPs stored in Uniqush. This API is intended for debugging/verifying that uniqush is set up properly.
+func (api *RestAPI) queryPSPs(logger log.Logger) []byte {
+	psps, err := api.backend.GetPushServiceProviderConfigs()
+	type responseType struct {
+		Services     map[string][]map[string]string `json:"services"`
+		ErrorMessage *string                        `json:"errorMsg,omitempty"`
+		Code         string                         `json:"code"`
+	}
+	var r responseType
+	r.Services = make(map[string][]map[string]string)
+	for _, psp := range psps {
+		data := encodePSPForAPI(psp)
+		service := data["service"]
+		r.Services[service] = append(r.Services[service], data)
+	}
+	if err != nil {
+		errorMsg := redactedError(err)
+		logger.Errorf("Error querying PSPs in /psps: %v", err)
+		r.Code = UNIQUSH_ERROR_DATABASE
+		r.ErrorMessage = &errorMsg
+	} else {
+		r.Code = UNIQUSH_SUCCESS
+	}
+	json, err := json.Marshal(r)
+	if err != nil {
+		return []byte("Failed to serialize response")
+	}
+	return json
+}
+
+// rebuildServiceSet is used to make sure that the /subscriptions and /psps APIs work properly, on uniqush setups created before those APIs existed.
+func (api *RestAPI) rebuildServiceSet(logger log.Logger, remoteAddr, apiKey string) []byte {
+	err := api.backend.RebuildServiceSet()
+	var details APIResponseDetails
+	record := AuditRecord{Action: AuditRebuildServiceSet, From: remoteAddr, APIKey: apiKey}
+	if err != nil {
+		logger.Errorf("Error in /rebuildserviceset: %v", err)
+		errorMsg := redactedError(err)
+		details = APIResponseDetails{
+			Code:     UNIQUSH_ERROR_GENERIC,
+			ErrorMsg: &errorMsg,
+		}
+		record.Code = UNIQUSH_ERROR_GENERIC
+		record.ErrorMsg = errorMsg
+	} else {
+		details = APIResponseDetails{Code: UNIQUSH_SUCCESS}
+		record.Code = UNIQUSH_SUCCESS
+	}
+	api.backend.audit.add(record)
+	json, err := json.Marshal(details)
+	if err != nil {
+		return []byte("Failed to encode response")
+	}
+	return json
+}
+
+// queryQuarantine lists the payloads which aren't being sent because push services kept rejecting them.
+func (api *RestAPI) queryQuarantine(logger log.Logger) []byte {
+	type responseType struct {
+		Payloads     []QuarantineRecord `json:"payloads"`
+		ErrorMessage *string            `json:"errorMsg,omitempty"`
+		Code         string             `json:"code"`
+	}
+	var r responseType
+	records, err := api.backend.quarantine.List()
+	if err != nil {
+		errorMsg := redactedError(err)
+		logger.Errorf("Error querying quarantined payloads in /quarantine: %v", err)
+		r.Code = UNIQUSH_ERROR_DATABASE
+		r.ErrorMessage = &errorMsg
+	} else {
+		r.Payloads = records
+		r.Code = UNIQUSH_SUCCESS
+	}
+	json, err := json.Marshal(r)
+	if err != nil {
+		return []byte("Failed to serialize response")
+	}
+	return json
+}
+
+// queryDeliveries lists the results of recent pushes to a service+subscriber, optionally limited to a single push request_id.
+func (api *RestAPI) queryDeliveries(kv map[string][]string, logger log.Logger) []byte {
+	type responseType struct {
+		Deliveries   []DeliveryRecord `json:"deliveries"`
+		ErrorMessage *string          `json:"errorMsg,omitempty"`
+		Code         string           `json:"code"`
+	}
+	var r responseType
+	first := func(key string) string {
+		if v, ok := kv[key]; ok && len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}
+	service := first("service")
+	subscriber := first("subscriber")
+	if service == "" {
+		r.Code = UNIQUSH_ERROR_CANNOT_GET_SERVICE
+	} else if subscriber == "" {
+		r.Code = UNIQUSH_ERROR_NO_SUBSCRIBER
+	} else if records, err := api.backend.history.Records(service, subscriber, first("request_id")); err != nil {
+		errorMsg := redactedError(err)
+		logger.Errorf("Service=%v Subscriber=%v Error querying deliveries in /deliveries: %v", service, subscriber, err)
+		r.Code = UNIQUSH_ERROR_DATABASE
+		r.ErrorMessage = &errorMsg
+	} else {
+		r.Deliveries = records
+		r.Code = UNIQUSH_SUCCESS
+	}
+	json, err := json.Marshal(r)
+	if err != nil {
+		return []byte("Failed to serialize response")
+	}
+	return json
+}
+
+// queryInbox lists the messages in the inbox of a service+subscriber, newest first, for the app to show in its message center.
+func (api *RestAPI) queryInbox(service, subscriber string, logger log.Logger) []byte {
+	type responseType struct {
+		Messages     []InboxMessage `json:"messages"`
+		ErrorMessage *string        `json:"errorMsg,omitempty"`
+		Code         string         `json:"code"`
+	}
+	var r responseType
+	if service == "" {
+		r.Code = UNIQUSH_ERROR_CANNOT_GET_SERVICE
+	} else if subscriber == "" {
+		r.Code = UNIQUSH_ERROR_NO_SUBSCRIBER
+	} else if messages, err := api.backend.inbox.Messages(service, subscriber); err != nil {
+		errorMsg := redactedError(err)
+		logger.Errorf("Service=%v Subscriber=%v Error querying the inbox in /inbox: %v", service, subscriber, err)
+		r.Code = UNIQUSH_ERROR_DATABASE
+		r.ErrorMessage = &errorMsg
+	} else {
+		r.Messages = messages
+		r.Code = UNIQUSH_SUCCESS
+	}
+	json, err := json.Marshal(r)
+	if err != nil {
+		return []byte("Failed to serialize response")
+	}
+	return json
+}
+
+// removeInboxMessages removes the messages with the comma separated ids in id from the inbox of a service+subscriber, e.g. once they were read.
+func (api *RestAPI) removeInboxMessages(kv map[string]string, logger log.Logger, remoteAddr string) APIResponseDetails {
+	service, subscriber := kv["service"], kv["subscriber"]
+	if service == "" {
+		return APIResponseDetails{From: &remoteAddr, Code: UNIQUSH_ERROR_CANNOT_GET_SERVICE}
+	}
+	if subscriber == "" {
+		return APIResponseDetails{From: &remoteAddr, Service: &service, Code: UNIQUSH_ERROR_NO_SUBSCRIBER}
+	}
+	if kv["id"] == "" {
+		errorMsg := "Must specify the ids of the messages to remove"
+		return APIResponseDetails{From: &remoteAddr, Service: &service, Subscriber: &subscriber, Code: UNIQUSH_ERROR_GENERIC, ErrorMsg: &errorMsg}
+	}
+	removed, err := api.backend.inbox.Remove(service, subscriber, strings.Split(kv["id"], ","))
+	if err != nil {
+		logger.Errorf("From=%v Service=%v Subscriber=%v Error removing inbox messages in /rminbox: %v", remoteAddr, service, subscriber, err)
+		return APIResponseDetails{From: &remoteAddr, Service: &service, Subscriber: &subscriber, Code: UNIQUSH_ERROR_DATABASE, ErrorMsg: strPtrOfErr(err)}
+	}
+	logger.Infof("From=%v Service=%v Subscriber=%v Removed %d inbox messages", remoteAddr, service, subscriber, removed)
+	return APIResponseDetails{From: &remoteAddr, Service: &service, Subscriber: &subscriber, Code: UNIQUSH_SUCCESS}
+}
+
+// queryAnalytics returns the hourly counts of the results of pushes to a service between the from and to parameters, and their totals.
+func (api *RestAPI) queryAnalytics(kv map[string][]string, logger log.Logger) []byte {
+	type responseType struct {
+		Service      string            `json:"service,omitempty"`
+		Campaign     string            `json:"campaign,omitempty"`
+		From         int64             `json:"from,omitempty"`
+		To           int64             `json:"to,omitempty"`
+		Buckets      []AnalyticsBucket `json:"buckets,omitempty"`
+		Total        *AnalyticsBucket  `json:"total,omitempty"`
+		ErrorMessage *string           `json:"errorMsg,omitempty"`
+		Code         string            `json:"code"`
+	}
+	var r responseType
+	first := func(key string) string {
+		if v, ok := kv[key]; ok && len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}
+	service := first("service")
+	campaign := first("campaign")
+	from, to, err := analyticsRange(first("from"), first("to"), time.Now())
+	if err == nil && campaign != "" {
+		err = validateCampaign(campaign)
+	}
+	if service == "" {
+		r.Code = UNIQUSH_ERROR_CANNOT_GET_SERVICE
+	} else if err != nil {
+		errorMsg := redactedError(err)
+		r.Code = UNIQUSH_ERROR_GENERIC
+		r.ErrorMessage = &errorMsg
+	} else if buckets, err := api.backend.analytics.Query(service, campaign, from, to); err != nil {
+		errorMsg := redactedError(err)
+		logger.Errorf("Service=%v Error querying analytics in /analytics: %v", service, err)
+		r.Code = UNIQUSH_ERROR_DATABASE
+		r.ErrorMessage = &errorMsg
+	} else {
+		total := AnalyticsBucket{Failures: map[string]int64{}}
+		for _, bucket := range buckets {
+			total.add(bucket)
+		}
+		r.Service = service
+		r.Campaign = campaign
+		r.From = from.Unix()
+		r.To = to.Unix()
+		r.Buckets = buckets
+		r.Total = &total
+		r.Code = UNIQUSH_SUCCESS
+	}
+	json, err := json.Marshal(r)
+	if err != nil {
+		return []byte("Failed to serialize response")
+	}
+	return json
+}
+
+// trackNotification counts a notification which a client SDK reported as opened or clicked (counter is analyticsOpened or analyticsClicked).
+// id is the notification ID (the requestId of the /push, or the ID of the broadcast), and campaign is the uniqush.campaign of the push, if any.
+func (api *RestAPI) trackNotification(kv map[string]string, logger log.Logger, remoteAddr string, counter string) APIResponseDetails {
+	service, err := getServiceFromMap(kv)
+	if err != nil {
+		logger.Errorf("From=%v Cannot get service name: %v; %v", remoteAddr, service, err)
+		return APIResponseDetails{From: &remoteAddr, Service: &service, Code: UNIQUSH_ERROR_CANNOT_GET_SERVICE, ErrorMsg: strPtrOfErr(err)}
+	}
+	id := kv["id"]
+	if id == "" {
+		errorMsg := "id is required"
+		return APIResponseDetails{From: &remoteAddr, Service: &service, Code: UNIQUSH_ERROR_GENERIC, ErrorMsg: &errorMsg}
+	}
+	campaign := kv["campaign"]
+	if campaign != "" {
+		if err := validateCampaign(campaign); err != nil {
+			logger.Errorf("From=%v Service=%v NotificationID=%v %v", remoteAddr, service, id, err)
+			return APIResponseDetails{RequestID: &id, From: &remoteAddr, Service: &service, Code: UNIQUSH_ERROR_GENERIC, ErrorMsg: strPtrOfErr(err)}
+		}
+	}
+	api.backend.analytics.track(service, campaign, counter)
+	// The names of the analytics counters of engagement are the types of the exported events.
+	api.backend.events.engagement(counter, service, campaign, id)
+	logger.Debugf("From=%v Service=%v NotificationID=%v Campaign=%v Tracked %v", remoteAddr, service, id, campaign, counter)
+	return APIResponseDetails{RequestID: &id, From: &remoteAddr, Service: &service, Code: UNIQUSH_SUCCESS}
+}
+
+// queryAudit lists the records of administrative operations, newest first, optionally filtered by service, action, api_key (fingerprint) and since.
+func (api *RestAPI) queryAudit(kv map[string][]string, logger log.Logger) []byte {
+	type responseType struct {
+		Records      []AuditRecord `json:"records"`
+		ErrorMessage *string       `json:"errorMsg,omitempty"`
+		Code         string        `json:"code"`
+	}
+	var r responseType
+	first := func(key string) string {
+		if v, ok := kv[key]; ok && len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}
+	filter := auditFilter{service: first("service"), action: first("action"), apiKey: first("api_key"), limit: defaultAuditQueryLimit}
+	var err error
+	if since := first("since"); since != "" {
+		var t time.Time
+		if t, err = parseAnalyticsTime(since); err == nil {
+			filter.since = t.Unix()
+		}
+	}
+	if limit := first("limit"); limit != "" && err == nil {
+		if filter.limit, err = strconv.Atoi(limit); err == nil && (filter.limit <= 0 || filter.limit > maxAuditQueryLimit) {
+			err = fmt.Errorf("limit must be between 1 and %d", maxAuditQueryLimit)
+		}
+	}
+	if err != nil {
+		errorMsg := redactedError(err)
+		r.Code = UNIQUSH_ERROR_GENERIC
+		r.ErrorMessage = &errorMsg
+	} else if records, err := api.backend.audit.Records(filter); err != nil {
+		errorMsg := redactedError(err)
+		logger.Errorf("Error querying the audit log in /audit: %v", err)
+		r.Code = UNIQUSH_ERROR_DATABASE
+		r.ErrorMessage = &errorMsg
+	} else {
+		r.Records = records
+		r.Code = UNIQUSH_SUCCESS
+	}
+	json, err := json.Marshal(r)
+	if err != nil {
+		return []byte("Failed to serialize response")
+	}
+	return json
+}
+
+// releaseQuarantine allows a quarantined payload to be sent again (e.g. after the push service's limits changed).
+func (api *RestAPI) releaseQuarantine(id string, logger log.Logger, remoteAddr string) []byte {
+	var details APIResponseDetails
+	if id == "" {
+		errorMsg := "Must specify the id of a quarantined payload"
+		details = APIResponseDetails{From: &remoteAddr, Code: UNIQUSH_ERROR_GENERIC, ErrorMsg: &errorMsg}
+	} else if err := api.backend.quarantine.Release(id); err != nil {
+		logger.Errorf("From=%v Payload=%v Error in /rmquarantine: %v", remoteAddr, id, err)
+		details = APIResponseDetails{From: &remoteAddr, Code: UNIQUSH_ERROR_GENERIC, ErrorMsg: strPtrOfErr(err)}
+	} else {
+		logger.Infof("From=%v Payload=%v Released from quarantine", remoteAddr, id)
+		details = APIResponseDetails{From: &remoteAddr, Code: UNIQUSH_SUCCESS}
+	}
+	json, err := json.Marshal(details)
+	if err != nil {
+		return []byte("Failed to encode response")
+	}
+	return json
+}
+
+// querySubscribeAbuse lists the addresses and device tokens blocked from subscribing (or allowed after a review), for /subscribeabuse.
+func (api *RestAPI) querySubscribeAbuse() []byte {
+	type responseType struct {
+		Sources []SubscribeAbuseRecord `json:"sources"`
+		Code    string                 `json:"code"`
+	}
+	json, err := json.Marshal(responseType{Sources: api.backend.subscribeAbuse.List(), Code: UNIQUSH_SUCCESS})
+	if err != nil {
+		return []byte("Failed to serialize response")
+	}
+	return json
+}
+
+// reviewSubscribeAbuse allows (action=allow) a source blocked from subscribing, or confirms that it is blocked (action=block).
+func (api *RestAPI) reviewSubscribeAbuse(kv map[string]string, logger log.Logger, remoteAddr, apiKey string) APIResponseDetails {
+	id := kv["id"]
+	if id == "" {
+		errorMsg := "Must specify the id of a blocked source"
+		return APIResponseDetails{From: &remoteAddr, Code: UNIQUSH_ERROR_GENERIC, ErrorMsg: &errorMsg}
+	}
+	record, err := api.backend.subscribeAbuse.Review(id, kv["action"], apiKey)
+	if err != nil {
+		logger.Errorf("From=%v SubscribeAbuse=%v Cannot review: %v", remoteAddr, id, err)
+		return APIResponseDetails{RequestID: &id, From: &remoteAddr, Code: UNIQUSH_ERROR_GENERIC, ErrorMsg: strPtrOfErr(err)}
+	}
+	logger.Infof("From=%v APIKey=%v SubscribeAbuse=%v Service=%v Status=%v Until=%v Reviewed", remoteAddr, apiKey, id, record.Service, record.Status, time.Unix(record.ExpiresAt, 0))
+	return APIResponseDetails{RequestID: &id, From: &remoteAddr, Service: &record.Service, Code: UNIQUSH_SUCCESS}
+}
+
+// reconcile starts looking up the delivery points of a service with their push services in the background, to flag the ones which are no longer recognized.
+func (api *RestAPI) reconcile(kv map[string]string, logger log.Logger, remoteAddr, apiKey string) APIResponseDetails {
+	service, err := getServiceFromMap(kv)
+	if err != nil {
+		logger.Errorf("From=%v Cannot get service name: %v; %v", remoteAddr, service, err)
+		return APIResponseDetails{From: &remoteAddr, Service: &service, Code: UNIQUSH_ERROR_CANNOT_GET_SERVICE, ErrorMsg: strPtrOfErr(err)}
+	}
+	api.backend.reconciler.Start(service)
+	api.backend.audit.add(AuditRecord{Action: AuditReconcile, From: remoteAddr, APIKey: apiKey, Service: service, Code: UNIQUSH_SUCCESS})
+	logger.Infof("From=%v Service=%v Started reconciling", remoteAddr, service)
+	return APIResponseDetails{From: &remoteAddr, Service: &service, Code: UNIQUSH_SUCCESS}
+}
+
+// queryFlaggedDeliveryPoints lists the delivery points of a service which their push services no longer recognized when the service was last reconciled.
+func (api *RestAPI) queryFlaggedDeliveryPoints(service string, logger log.Logger) []byte {
+	type responseType struct {
+		DeliveryPoints []FlaggedDeliveryPoint `json:"deliveryPoints"`
+		ErrorMessage   *string                `json:"errorMsg,omitempty"`
+		Code           string                 `json:"code"`
+	}
+	var r responseType
+	if service == "" {
+		r.Code = UNIQUSH_ERROR_CANNOT_GET_SERVICE
+	} else if list, err := api.backend.reconciler.Flagged(service); err != nil {
+		errorMsg := redactedError(err)
+		logger.Errorf("Service=%v Error querying flagged delivery points in /flagged: %v", service, err)
+		r.Code = UNIQUSH_ERROR_DATABASE
+		r.ErrorMessage = &errorMsg
+	} else {
+		r.DeliveryPoints = list
+		r.Code = UNIQUSH_SUCCESS
+	}
+	json, err := json.Marshal(r)
+	if err != nil {
+		return []byte("Failed to serialize response")
+	}
+	return json
+}
+
+// queryStagedUnsubscribes lists the unsubscribes which haven't been confirmed, cancelled or committed yet, optionally limited to a single service.
+func (api *RestAPI) queryStagedUnsubscribes(service string, logger log.Logger) []byte {
+	type responseType struct {
+		Unsubscribes []StagedUnsubscribe `json:"unsubscribes"`
+		ErrorMessage *string             `json:"errorMsg,omitempty"`
+		Code         string              `json:"code"`
+	}
+	var r responseType
+	list, err := api.backend.unsubscribes.List(service)
+	if err != nil {
+		errorMsg := redactedError(err)
+		logger.Errorf("Service=%v Error querying staged unsubscribes in /stagedunsubscribes: %v", service, err)
+		r.Code = UNIQUSH_ERROR_DATABASE
+		r.ErrorMessage = &errorMsg
+	} else {
+		r.Unsubscribes = list
+		r.Code = UNIQUSH_SUCCESS
+	}
+	json, err := json.Marshal(r)
+	if err != nil {
+		return []byte("Failed to serialize response")
+	}
+	return json
+}
+
+// resolveStagedUnsubscribe is used by /confirmunsubscribe (to commit a staged unsubscribe now) and /cancelunsubscribe (to keep the delivery point subscribed).
+func (api *RestAPI) resolveStagedUnsubscribe(kv map[string]string, logger log.Logger, remoteAddr string, confirm bool) APIResponseDetails {
+	id := kv["id"]
+	if id == "" {
+		errorMsg := "Must specify the id of a staged unsubscribe"
+		return APIResponseDetails{From: &remoteAddr, Code: UNIQUSH_ERROR_GENERIC, ErrorMsg: &errorMsg}
+	}
+	var found bool
+	var err error
+	if confirm {
+		found, err = api.backend.unsubscribes.Confirm(id)
+	} else {
+		found, err = api.backend.unsubscribes.Cancel(id)
+	}
+	if err != nil {
+		logger.Errorf("From=%v StagedUnsubscribe=%v Failed: %v", remoteAddr, id, err)
+		return APIResponseDetails{RequestID: &id, From: &remoteAddr, Code: UNIQUSH_ERROR_DATABASE, ErrorMsg: strPtrOfErr(err)}
+	}
+	if !found {
+		errorMsg := "No such staged unsubscribe, it may have already been committed or cancelled"
+		return APIResponseDetails{RequestID: &id, From: &remoteAddr, Code: UNIQUSH_ERROR_GENERIC, ErrorMsg: &errorMsg}
+	}
+	if confirm {
+		logger.Infof("From=%v StagedUnsubscribe=%v Confirmed", remoteAddr, id)
+	} else {
+		logger.Infof("From=%v StagedUnsubscribe=%v Cancelled", remoteAddr, id)
+	}
+	return APIResponseDetails{RequestID: &id, From: &remoteAddr, Code: UNIQUSH_SUCCESS}
+}
+
+// maxCacheHotKeys is the most hot keys of each cache /cache returns.
+const maxCacheHotKeys = 1000
+
+// queryCache returns the counters and estimated memory usage of the database's in-memory caches, for monitoring and sizing the caches.
+// If top is set, the top most hit keys of each cache are included.
+func (api *RestAPI) queryCache(top string) []byte {
+	type responseType struct {
+		Caches       []db.CacheStats `json:"caches"`
+		ErrorMessage *string         `json:"errorMsg,omitempty"`
+		Code         string          `json:"code"`
+	}
+	var r responseType
+	hotKeys := 0
+	if top != "" {
+		var err error
+		hotKeys, err = strconv.Atoi(top)
+		if err == nil && (hotKeys < 0 || hotKeys > maxCacheHotKeys) {
+			err = fmt.Errorf("must be between 0 and %d", maxCacheHotKeys)
+		}
+		if err != nil {
+			errorMsg := fmt.Sprintf("Invalid top %q: %v", top, err)
+			r.ErrorMessage = &errorMsg
+			r.Code = UNIQUSH_ERROR_GENERIC
+		}
+	}
+	if r.ErrorMessage == nil {
+		r.Caches = api.backend.db.CacheStats(hotKeys)
+		r.Code = UNIQUSH_SUCCESS
+	}
+	if r.Caches == nil {
+		r.Caches = []db.CacheStats{}
+	}
+	json, err := json.Marshal(r)
+	if err != nil {
+		return []byte("Failed to serialize response")
+	}
+	return json
+}
+
+// writeMetrics writes the counters and histograms of uniqush-push in the Prometheus text format, for monitoring.
+func (api *RestAPI) writeMetrics(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", metrics.ContentType)
+	if err := metrics.DefaultRegistry.Write(w); err != nil {
+		api.loggers[LoggerWeb].Errorf("Failed to write metrics: %v", err)
+		return
+	}
+	if err := api.metrics.Write(w); err != nil {
+		api.loggers[LoggerWeb].Errorf("Failed to write metrics: %v", err)
+	}
+}
+
+// queryQueue returns the depths of the internal queues, so that clients can throttle themselves before pushes are rejected.
+func (api *RestAPI) queryQueue() []byte {
+	type responseType struct {
+		QueueDepths
+		Code string `json:"code"`
+	}
+	r := responseType{QueueDepths: api.backend.QueueDepths(), Code: UNIQUSH_SUCCESS}
+	json, err := json.Marshal(r)
+	if err != nil {
+		return []byte("Failed to serialize response")
+	}
+	return json
+}
+
+// reject responds with an HTTP error status and the given code, without processing the request.
+// If retryAfter isn't 0, it is sent in a Retry-After header, so that clients slow down instead of timing out. err is the reason, if there is one worth explaining.
+// In upstream compatibility mode, the endpoints of upstream respond with status 200 and the failure in their usual response instead.
+func (api *RestAPI) reject(w http.ResponseWriter, r *http.Request, status int, code string, retryAfter time.Duration, err error) {
+	remoteAddr := r.RemoteAddr
+	details := APIResponseDetails{From: &remoteAddr, Code: code, ErrorMsg: strPtrOfErr(err)}
+	if api.upstreamCompat && api.rejectUpstream(w, r.URL.Path, details, retryAfter) {
+		return
+	}
+	bytes, err := json.Marshal(details)
+	if err != nil {
+		bytes = []byte("Failed to encode response")
+	}
+	if retryAfter > 0 {
+		seconds := int64((retryAfter + time.Second - 1) / time.Second)
+		w.Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+	}
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "%s\r\n", bytes)
+}
+
+func parseKV(form url.Values) (kv map[string]string, perdp map[string][]string) {
+	kv = make(map[string]string, len(form))
+	perdp = make(map[string][]string, 3)
+	perdpPrefix := "uniqush.perdp."
+	for k, v := range form {
+		if len(k) > len(perdpPrefix) {
+			if k[:len(perdpPrefix)] == perdpPrefix {
+				key := k[len(perdpPrefix):]
+				perdp[key] = v
+				continue
+			}
+		}
+		if len(v) > 0 {
+			kv[k] = v[0]
+		}
+	}
+	return kv, perdp
+}
+
+func (api *RestAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	start := time.Now()
+	defer func() {
+		apiRequestDuration.Observe(time.Since(start).Seconds(), r.URL.Path)
+	}()
+	// Callers can send a traceparent header, so that the push is part of their own trace.
+	ctx, span := tracing.Start(tracing.Extract(r.Context(), r.Header), r.URL.Path, tracing.KindServer)
+	span.SetAttribute("http.method", r.Method)
+	defer span.Finish()
+	remoteAddr := r.RemoteAddr
+	if err := api.backend.network.allows(r.URL.Path, remoteAddr); err != nil {
+		api.loggers[LoggerWeb].Warnf("From=%v URL=%v Rejected: %v", remoteAddr, r.URL.Path, err)
+		api.reject(w, r, http.StatusForbidden, UNIQUSH_ERROR_ADDRESS_NOT_ALLOWED, 0, err)
+		return
+	}
+	if retryAfter, ok := api.backend.limiter.allowAddress(r.URL.Path, remoteAddr); !ok {
+		api.loggers[LoggerWeb].Warnf("From=%v URL=%v Rejected: rate limit of the address exceeded", remoteAddr, r.URL.Path)
+		api.reject(w, r, http.StatusTooManyRequests, UNIQUSH_ERROR_RATE_LIMITED, retryAfter, nil)
+		return
+	}
+	if status, err := api.backend.signer.verify(r); status != http.StatusOK {
+		api.loggers[LoggerWeb].Warnf("From=%v URL=%v Rejected unsigned request: %v", remoteAddr, r.URL.Path, err)
+		code := UNIQUSH_ERROR_BAD_SIGNATURE
+		if status == http.StatusServiceUnavailable {
+			code = UNIQUSH_ERROR_DATABASE
+		}
+		api.reject(w, r, status, code, 0, err)
+		return
+	}
+	key, status, code := api.authorize(r)
+	if status != http.StatusOK {
+		api.loggers[LoggerWeb].Warnf("From=%v URL=%v APIKey=%v Rejected: %v", remoteAddr, r.URL.Path, auditAPIKey(r), code)
+		if status == http.StatusUnauthorized {
+			w.Header().Set("WWW-Authenticate", apiKeyAuthRealm)
+		}
+		api.reject(w, r, status, code, 0, nil)
+		return
+	}
+	if key != nil && key.Tenant != "" {
+		if status, err := api.authorizeTenant(r, key.Tenant); status != http.StatusOK {
+			api.loggers[LoggerWeb].Warnf("From=%v URL=%v APIKey=%v Tenant=%v Rejected: %v", remoteAddr, r.URL.Path, key.ID, key.Tenant, err)
+			code := UNIQUSH_ERROR_FORBIDDEN
+			if status == http.StatusServiceUnavailable {
+				code = UNIQUSH_ERROR_DATABASE
+			}
+			api.reject(w, r, status, code, 0, err)
+			return
+		}
+	}
+	keyID := ""
+	if key != nil {
+		keyID = key.ID
+	}
+	if retryAfter, ok := api.backend.limiter.allowKey(r.URL.Path, keyID, remoteAddr); !ok {
+		api.loggers[LoggerWeb].Warnf("From=%v URL=%v APIKey=%v Rejected: rate limit exceeded", remoteAddr, r.URL.Path, keyID)
+		api.reject(w, r, http.StatusTooManyRequests, UNIQUSH_ERROR_RATE_LIMITED, retryAfter, nil)
+		return
+	}
+	api.backend.usage.record(auditAPIKey(r), usageRequests, 1)
+
+	switch r.URL.Path {
+	case QuerySubscriptionsURL:
+		r.ParseForm()
+		n := api.querySubscriptions(r.Form, api.loggers[LoggerSubscriptions])
+		fmt.Fprintf(w, "%s\r\n", n)
+		return
+	case QueryPushServiceProviders:
+		n := api.queryPSPs(api.loggers[LoggerPSPs])
+		fmt.Fprintf(w, "%s\r\n", n)
+		return
+	case RebuildServiceSetURL:
+		n := api.rebuildServiceSet(api.loggers[LoggerServices], remoteAddr, auditAPIKey(r))
+		fmt.Fprintf(w, "%s\r\n", n)
+		return
+	case QueryQuarantineURL:
+		n := api.queryQuarantine(api.loggers[LoggerQuarantine])
+		fmt.Fprintf(w, "%s\r\n", n)
+		return
+	case QueryBroadcastsURL:
+		r.ParseForm()
+		n := api.queryBroadcasts(r.Form.Get("id"), api.loggers[LoggerBroadcast])
+		fmt.Fprintf(w, "%s\r\n", n)
+		return
+	case QueryDeliveriesURL:
+		r.ParseForm()
+		n := api.queryDeliveries(r.Form, api.loggers[LoggerDeliveryHistory])
+		fmt.Fprintf(w, "%s\r\n", n)
+		return
+	case QueryInboxURL:
+		r.ParseForm()
+		n := api.queryInbox(r.Form.Get("service"), r.Form.Get("subscriber"), api.loggers[LoggerPush])
+		fmt.Fprintf(w, "%s\r\n", n)
+		return
+	case QueryAnalyticsURL:
+		r.ParseForm()
+		n := api.queryAnalytics(r.Form, api.loggers[LoggerAnalytics])
+		fmt.Fprintf(w, "%s\r\n", n)
+		return
+	case DashboardURL:
+		api.queryDashboard(w, r)
+		return
+	case QueryFailuresURL:
+		r.ParseForm()
+		n := api.queryFailureReport(r.Form)
+		fmt.Fprintf(w, "%s\r\n", n)
+		return
+	case QueryCanaryURL:
+		r.ParseForm()
+		n := api.queryCanary(r.Form)
+		fmt.Fprintf(w, "%s\r\n", n)
+		return
+	case UnsubscribeTokenURL:
+		r.ParseForm()
+		n := api.issueUnsubscribeTokens(r.Form, api.loggers[LoggerUnsub])
+		fmt.Fprintf(w, "%s\r\n", n)
+		return
+	case QueryAPIKeysURL, CreateAPIKeyURL, RotateAPIKeyURL, RevokeAPIKeyURL:
+		serveAPIKeys(w, r, api.backend.apiKeys, remoteAddr)
+		return
+	case QueryTenantsURL, SetTenantURL, RemoveTenantURL:
+		serveTenants(w, r, api.backend.tenants, remoteAddr)
+		return
+	case QueryAuditURL:
+		r.ParseForm()
+		n := api.queryAudit(r.Form, api.loggers[LoggerAudit])
+		fmt.Fprintf(w, "%s\r\n", n)
+		return
+	case QueryQueueURL:
+		n := api.queryQueue()
+		fmt.Fprintf(w, "%s\r\n", n)
+		return
+	case QueryClusterURL:
+		n := api.queryCluster()
+		fmt.Fprintf(w, "%s\r\n", n)
+		return
+	case QueryStagedPushServiceProvidersURL:
+		r.ParseForm()
+		n := api.queryStagedPushServiceProviders(r.Form.Get("service"))
+		fmt.Fprintf(w, "%s\r\n", n)
+		return
+	case DiagnosticsURL:
+		r.ParseForm()
+		n := api.queryDiagnostics(r.Form.Get("refresh") == "1")
+		fmt.Fprintf(w, "%s\r\n", n)
+		return
+	case MetricsURL:
+		api.writeMetrics(w)
+		return
+	case HealthzURL:
+		fmt.Fprintf(w, "%s\r\n", api.healthz())
+		return
+	case ReadyzURL:
+		api.readyz(w)
+		return
+	case QueryCacheURL:
+		r.ParseForm()
+		n := api.queryCache(r.Form.Get("top"))
+		fmt.Fprintf(w, "%s\r\n", n)
+		return
+	case QuerySubscribersURL:
+		r.ParseForm()
+		api.querySubscribers(w, r.Form, api.loggers[LoggerSubscriptions])
+		return
+	case QueryFlaggedDeliveryPointsURL:
+		r.ParseForm()
+		n := api.queryFlaggedDeliveryPoints(r.Form.Get("service"), api.loggers[LoggerReconcile])
+		fmt.Fprintf(w, "%s\r\n", n)
+		return
+	case QuerySubscribeAbuseURL:
+		n := api.querySubscribeAbuse()
+		fmt.Fprintf(w, "%s\r\n", n)
+		return
+	case QueryStagedUnsubscribesURL:
+		r.ParseForm()
+		n := api.queryStagedUnsubscribes(r.Form.Get("service"), api.loggers[LoggerUnsub])
+		fmt.Fprintf(w, "%s\r\n", n)
+		return
+	case ReleaseQuarantineURL:
+		r.ParseForm()
+		n := api.releaseQuarantine(r.Form.Get("id"), api.loggers[LoggerQuarantine], remoteAddr)
+		fmt.Fprintf(w, "%s\r\n", n)
+		return
+	case QueryNumberOfDeliveryPointsURL:
+		r.ParseForm()
+		n := api.numberOfDeliveryPoints(r.Form, api.loggers[LoggerWeb])
+		fmt.Fprintf(w, "%v\r\n", n)
+		return
+	case PreviewPushNotificationURL:
+		r.ParseForm()
+		kv, _ := parseKV(r.Form)
+		rid := randomUniqID()
+		details := api.preview(rid, kv, api.loggers[LoggerPreview], remoteAddr)
+		bytes, err := json.Marshal(details)
+		if err != nil {
+			fmt.Fprintf(w, "%s\r\n", redactedError(err))
+			return
+		}
+		fmt.Fprintf(w, "%s\r\n", string(bytes))
+		return
+	case VersionInfoURL:
+		fmt.Fprintf(w, "%v\r\n", api.version)
+		api.loggers[LoggerWeb].Infof("Checked version from %v", remoteAddr)
+		return
+	case StopProgramURL:
+		api.stop(w, remoteAddr)
+		return
+	}
+	switch r.URL.Path {
+	case PushNotificationURL, BroadcastURL:
+		if retryAfter, overloaded := api.backend.Overloaded(); overloaded {
+			api.loggers[LoggerWeb].Warnf("From=%v URL=%v Overloaded: RetryAfter=%v", remoteAddr, r.URL.Path, retryAfter)
+			api.reject(w, r, http.StatusTooManyRequests, UNIQUSH_ERROR_OVERLOADED, retryAfter, nil)
+			return
+		}
+	}
+	r.ParseForm()
+	kv, perdp := parseKV(r.Form)
+
+	if !api.beginRequest() {
+		api.loggers[LoggerWeb].Warnf("From=%v URL=%v Rejected: shutting down", remoteAddr, r.URL.Path)
+		api.reject(w, r, http.StatusServiceUnavailable, UNIQUSH_ERROR_SHUTTING_DOWN, 0, nil)
+		return
+	}
+	defer api.endRequest()
+	if r.URL.Path == PushNotificationURL {
+		if err := api.backend.tenants.queueFull(kv["service"]); err != nil {
+			api.loggers[LoggerWeb].Warnf("From=%v URL=%v Service=%v Rejected: %v", remoteAddr, r.URL.Path, kv["service"], err)
+			if err == errTenantQueueFull {
+				api.reject(w, r, http.StatusTooManyRequests, UNIQUSH_ERROR_OVERLOADED, api.backend.retryAfter(), err)
+			} else {
+				api.reject(w, r, http.StatusServiceUnavailable, UNIQUSH_ERROR_DATABASE, 0, nil)
+			}
+			return
+		}
+		if err := api.reservePushes(kv); err != nil {
+			api.loggers[LoggerWeb].Warnf("From=%v URL=%v Service=%v Rejected: %v", remoteAddr, r.URL.Path, kv["service"], err)
+			if err == errTenantQuotaExceeded {
+				api.reject(w, r, http.StatusTooManyRequests, UNIQUSH_ERROR_QUOTA_EXCEEDED, 0, err)
+			} else {
+				api.reject(w, r, http.StatusServiceUnavailable, UNIQUSH_ERROR_DATABASE, 0, nil)
+			}
+			return
+		}
+	}
+	var handler APIResponseHandler
+	var details APIResponseDetails
+	switch r.URL.Path {
+	case AddPushServiceProviderToServiceURL:
+		handler = newSimpleResponseHandler(api.loggers[LoggerAddPSP], "AddPushServiceProvider")
+		details = api.changePushServiceProvider(kv, api.loggers[LoggerAddPSP], remoteAddr, auditAPIKey(r), true)
+		handler.AddDetailsToHandler(details)
+	case RemovePushServiceProviderFromServiceURL:
+		handler = newSimpleResponseHandler(api.loggers[LoggerRemovePSP], "RemovePushServiceProvider")
+		details = api.changePushServiceProvider(kv, api.loggers[LoggerRemovePSP], remoteAddr, auditAPIKey(r), false)
+		handler.AddDetailsToHandler(details)
+	case AddDeliveryPointToServiceURL:
+		handler = newSimpleResponseHandler(api.loggers[LoggerSub], "Subscribe")
+		details = api.changeSubscription(kv, api.loggers[LoggerSub], remoteAddr, true)
+		handler.AddDetailsToHandler(details)
+	case RemoveDeliveryPointFromServiceURL:
+		handler = newSimpleResponseHandler(api.loggers[LoggerUnsub], "Unsubscribe")
+		details = api.changeSubscription(kv, api.loggers[LoggerUnsub], remoteAddr, false)
+		if api.upstreamCompat && details.Code == UNIQUSH_UNSUBSCRIBE_STAGED {
+			// Upstream removes delivery points right away, so its clients only know UNIQUSH_SUCCESS.
+			details.Code = UNIQUSH_SUCCESS
+		}
+		handler.AddDetailsToHandler(details)
+	case RefreshDeliveryPointURL:
+		handler = newSimpleResponseHandler(api.loggers[LoggerSub], "Refresh")
+		details = api.refreshDeliveryPoint(kv, api.loggers[LoggerSub], remoteAddr)
+		handler.AddDetailsToHandler(details)
+	case UnsubscribeWithTokenURL:
+		handler = newSimpleResponseHandler(api.loggers[LoggerUnsub], "UnsubscribeWithToken")
+		details = api.unsubscribeWithToken(kv, api.loggers[LoggerUnsub], remoteAddr)
+		handler.AddDetailsToHandler(details)
+	case RemoveInboxMessagesURL:
+		handler = newSimpleResponseHandler(api.loggers[LoggerPush], "RemoveInboxMessages")
+		details = api.removeInboxMessages(kv, api.loggers[LoggerPush], remoteAddr)
+		handler.AddDetailsToHandler(details)
+	case ReviewSubscribeAbuseURL:
+		handler = newSimpleResponseHandler(api.loggers[LoggerSub], "ReviewSubscribeAbuse")
+		details = api.reviewSubscribeAbuse(kv, api.loggers[LoggerSub], remoteAddr, auditAPIKey(r))
+		handler.AddDetailsToHandler(details)
+	case ConfirmUnsubscribeURL:
+		handler = newSimpleResponseHandler(api.loggers[LoggerUnsub], "ConfirmUnsubscribe")
+		details = api.resolveStagedUnsubscribe(kv, api.loggers[LoggerUnsub], remoteAddr, true)
+		handler.AddDetailsToHandler(details)
+	case CancelUnsubscribeURL:
+		handler = newSimpleResponseHandler(api.loggers[LoggerUnsub], "CancelUnsubscribe")
+		details = api.resolveStagedUnsubscribe(kv, api.loggers[LoggerUnsub], remoteAddr, false)
+		handler.AddDetailsToHandler(details)
+	case PushNotificationURL:
+		handler = api.backend.usage.Wrap(auditAPIKey(r), api.backend.history.Wrap(newPushResponseHandler(api.loggers[LoggerPush])))
+		rid := randomUniqID()
+		api.pushNotification(api.pushContext(ctx), rid, kv, perdp, api.loggers[LoggerPush], remoteAddr, handler)
+	case StagePushServiceProviderURL:
+		handler = newSimpleResponseHandler(api.loggers[LoggerAddPSP], "StagePushServiceProvider")
+		details = api.stagePushServiceProvider(kv, api.loggers[LoggerAddPSP], remoteAddr, auditAPIKey(r))
+		handler.AddDetailsToHandler(details)
+	case SetStagedPercentURL:
+		handler = newSimpleResponseHandler(api.loggers[LoggerAddPSP], "SetStagedPercent")
+		details = api.changeStaging(AuditSetStagedPercent, kv, api.loggers[LoggerAddPSP], remoteAddr, auditAPIKey(r))
+		handler.AddDetailsToHandler(details)
+	case PromoteStagedPushServiceProviderURL:
+		handler = newSimpleResponseHandler(api.loggers[LoggerAddPSP], "PromotePushServiceProvider")
+		details = api.changeStaging(AuditPromotePSP, kv, api.loggers[LoggerAddPSP], remoteAddr, auditAPIKey(r))
+		handler.AddDetailsToHandler(details)
+	case RollbackStagedPushServiceProviderURL:
+		handler = newSimpleResponseHandler(api.loggers[LoggerAddPSP], "RollbackPushServiceProvider")
+		details = api.changeStaging(AuditRollbackPSP, kv, api.loggers[LoggerAddPSP], remoteAddr, auditAPIKey(r))
+		handler.AddDetailsToHandler(details)
+	case TestPushURL:
+		n := api.testPush(ctx, kv, api.loggers[LoggerPush], remoteAddr)
+		fmt.Fprintf(w, "%s\r\n", n)
+	case ReconcileURL:
+		handler = newSimpleResponseHandler(api.loggers[LoggerReconcile], "Reconcile")
+		details = api.reconcile(kv, api.loggers[LoggerReconcile], remoteAddr, auditAPIKey(r))
+		handler.AddDetailsToHandler(details)
+	case BroadcastURL:
+		handler = newSimpleResponseHandler(api.loggers[LoggerBroadcast], "Broadcast")
+		details = api.broadcast(kv, api.loggers[LoggerBroadcast], remoteAddr, auditAPIKey(r))
+		handler.AddDetailsToHandler(details)
+	case PauseBroadcastURL:
+		handler = newSimpleResponseHandler(api.loggers[LoggerBroadcast], "PauseBroadcast")
+		details = api.controlBroadcast(kv, api.loggers[LoggerBroadcast], remoteAddr, api.backend.broadcasts.Pause, "pause")
+		handler.AddDetailsToHandler(details)
+	case ResumeBroadcastURL:
+		handler = newSimpleResponseHandler(api.loggers[LoggerBroadcast], "ResumeBroadcast")
+		details = api.controlBroadcast(kv, api.loggers[LoggerBroadcast], remoteAddr, api.backend.broadcasts.Resume, "resume")
+		handler.AddDetailsToHandler(details)
+	case CancelBroadcastURL:
+		handler = newSimpleResponseHandler(api.loggers[LoggerBroadcast], "CancelBroadcast")
+		details = api.controlBroadcast(kv, api.loggers[LoggerBroadcast], remoteAddr, api.backend.broadcasts.Cancel, "cancel")
+		handler.AddDetailsToHandler(details)
+	case TrackOpenURL:
+		handler = newSimpleResponseHandler(api.loggers[LoggerAnalytics], "TrackOpen")
+		details = api.trackNotification(kv, api.loggers[LoggerAnalytics], remoteAddr, analyticsOpened)
+		handler.AddDetailsToHandler(details)
+	case TrackClickURL:
+		handler = newSimpleResponseHandler(api.loggers[LoggerAnalytics], "TrackClick")
+		details = api.trackNotification(kv, api.loggers[LoggerAnalytics], remoteAddr, analyticsClicked)
+		handler.AddDetailsToHandler(details)
+	}
+	if handler != nil {
+		// Be consistent about ending responses in \r\n
+		_, err := fmt.Fprintf(w, "%s\r\n", string(handler.ToJSON()))
+		if err != nil {
+			api.loggers[LoggerWeb].Errorf("Failed to write http response: %v", err)
+		}
+	}
+}
+
+// pushContext returns the context of a push requested with the context ctx. It has the span of ctx, but isn't canceled when the client disconnects.
+// With a request_timeout, it is canceled once the timeout passes, even after the response was sent, so that no retry of the push is sent later.
+func (api *RestAPI) pushContext(ctx context.Context) context.Context {
+	ctx = tracing.ContextWithSpanContext(context.Background(), tracing.SpanContextFromContext(ctx))
+	if api.requestTimeout <= 0 {
+		return ctx
+	}
+	ctx, cancel := context.WithTimeout(ctx, api.requestTimeout)
+	go func() {
+		// The context ends at its deadline, even after the response was sent. cancel is only called afterwards, as WithTimeout requires.
+		<-ctx.Done()
+		cancel()
+	}()
+	return ctx
+}
+
+// Run will start the API service, listening for requests on the address addr, over TLS if tlsConfig isn't nil
+func (api *RestAPI) Run(addr string, tlsConfig *tls.Config, stopChan chan<- bool) {
+	api.loggers[LoggerWeb].Infof("[Start] %s TLS=%v", addr, tlsConfig != nil)
+	api.loggers[LoggerWeb].Debugf("[Version] %s", api.version)
+
+	api.stopChan = stopChan
+	if api.listeners == nil {
+		api.listeners = newListenerSet(api.newServeMux(), "", tlsConfig, api.shutdownTimeout, 0, api.loggers[LoggerWeb])
+	}
+	if _, err := api.listeners.Add(addr, tlsConfig != nil); err != nil {
+		api.loggers[LoggerWeb].Fatalf("HTTPServerError \"%v\"", err)
+	}
+}
+
+// newServeMux returns the handler of every path of the API.
+func (api *RestAPI) newServeMux() *http.ServeMux {
+	// The API has its own mux, so that the handlers net/http/pprof registers on http.DefaultServeMux aren't exposed (see admin.go).
+	mux := http.NewServeMux()
+	mux.Handle(StopProgramURL, api)
+	mux.Handle(VersionInfoURL, api)
+	mux.Handle(AddPushServiceProviderToServiceURL, api)
+	mux.Handle(AddDeliveryPointToServiceURL, api)
+	mux.Handle(RemoveDeliveryPointFromServiceURL, api)
+	mux.Handle(RefreshDeliveryPointURL, api)
+	mux.Handle(RemovePushServiceProviderFromServiceURL, api)
+	mux.Handle(PushNotificationURL, api)
+	mux.Handle(PreviewPushNotificationURL, api)
+	mux.Handle(TestPushURL, api)
+	mux.Handle(StagePushServiceProviderURL, api)
+	mux.Handle(QueryStagedPushServiceProvidersURL, api)
+	mux.Handle(SetStagedPercentURL, api)
+	mux.Handle(PromoteStagedPushServiceProviderURL, api)
+	mux.Handle(RollbackStagedPushServiceProviderURL, api)
+	mux.Handle(QueryNumberOfDeliveryPointsURL, api)
+	mux.Handle(QuerySubscriptionsURL, api)
+	mux.Handle(QueryPushServiceProviders, api)
+	mux.Handle(RebuildServiceSetURL, api)
+	mux.Handle(QueryQuarantineURL, api)
+	mux.Handle(ReleaseQuarantineURL, api)
+	mux.Handle(QueryDeliveriesURL, api)
+	mux.Handle(QueryInboxURL, api)
+	mux.Handle(RemoveInboxMessagesURL, api)
+	mux.Handle(BroadcastURL, api)
+	mux.Handle(QueryBroadcastsURL, api)
+	mux.Handle(PauseBroadcastURL, api)
+	mux.Handle(ResumeBroadcastURL, api)
+	mux.Handle(CancelBroadcastURL, api)
+	mux.Handle(QueryQueueURL, api)
+	mux.Handle(QueryCacheURL, api)
+	mux.Handle(QueryClusterURL, api)
+	mux.Handle(DiagnosticsURL, api)
+	mux.Handle(QueryStagedUnsubscribesURL, api)
+	mux.Handle(QuerySubscribeAbuseURL, api)
+	mux.Handle(ReviewSubscribeAbuseURL, api)
+	mux.Handle(ConfirmUnsubscribeURL, api)
+	mux.Handle(CancelUnsubscribeURL, api)
+	mux.Handle(ReconcileURL, api)
+	mux.Handle(QueryFlaggedDeliveryPointsURL, api)
+	mux.Handle(QuerySubscribersURL, api)
+	mux.Handle(MetricsURL, api)
+	mux.Handle(HealthzURL, api)
+	mux.Handle(ReadyzURL, api)
+	mux.Handle(QueryAnalyticsURL, api)
+	mux.Handle(QueryAuditURL, api)
+	mux.Handle(DashboardURL, api)
+	mux.Handle(TrackOpenURL, api)
+	mux.Handle(UnsubscribeTokenURL, api)
+	mux.Handle(UnsubscribeWithTokenURL, api)
+	mux.Handle(TrackClickURL, api)
+	mux.Handle(QueryFailuresURL, api)
+	mux.Handle(QueryCanaryURL, api)
+	mux.Handle(QueryAPIKeysURL, api)
+	mux.Handle(CreateAPIKeyURL, api)
+	mux.Handle(RotateAPIKeyURL, api)
+	mux.Handle(RevokeAPIKeyURL, api)
+	mux.Handle(QueryTenantsURL, api)
+	mux.Handle(SetTenantURL, api)
+	mux.Handle(RemoveTenantURL, api)
+	return mux
+}
@@ -0,0 +1,126 @@
+package server
+
+// These are constants with codes for a uniqush response type.
+// nolint: golint
+const (
+	/* Not errors */
+
+	UNIQUSH_SUCCESS            = "UNIQUSH_SUCCESS"
+	UNIQUSH_REMOVE_INVALID_REG = "UNIQUSH_REMOVE_INVALID_REG"
+	UNIQUSH_UPDATE_UNSUBSCRIBE = "UNIQUSH_UPDATE_UNSUBSCRIBE"
+	// UNIQUSH_JOB_ALREADY_CLAIMED means a push with the same uniqush.job_id was already sent by this or another instance.
+	UNIQUSH_JOB_ALREADY_CLAIMED = "UNIQUSH_JOB_ALREADY_CLAIMED"
+	// UNIQUSH_UNSUBSCRIBE_STAGED means the unsubscribe was staged, and is committed by /confirmunsubscribe or after [Unsubscribe] confirm_timeout.
+	UNIQUSH_UNSUBSCRIBE_STAGED = "UNIQUSH_UNSUBSCRIBE_STAGED"
+	// UNIQUSH_PUSH_HELD means the push wasn't sent yet because its service is in maintenance mode. It is sent once maintenance mode is turned off.
+	UNIQUSH_PUSH_HELD = "UNIQUSH_PUSH_HELD"
+
+	/* Errors */
+
+	UNIQUSH_ERROR_GENERIC            = "UNIQUSH_ERROR_GENERIC"
+	UNIQUSH_ERROR_EMPTY_NOTIFICATION = "UNIQUSH_ERROR_EMPTY_NOTIFICATION"
+	UNIQUSH_ERROR_DATABASE           = "UNIQUSH_ERROR_DATABASE"
+	UNIQUSH_ERROR_FAILED_RETRY       = "UNIQUSH_ERROR_FAILED_RETRY"
+	UNIQUSH_ERROR_BAD_RETRY_POLICY   = "UNIQUSH_ERROR_BAD_RETRY_POLICY"
+	// UNIQUSH_ERROR_QUARANTINED_PAYLOAD means the payload wasn't sent because push services kept rejecting it. See /quarantine.
+	UNIQUSH_ERROR_QUARANTINED_PAYLOAD = "UNIQUSH_ERROR_QUARANTINED_PAYLOAD"
+	// UNIQUSH_ERROR_OVERLOADED means the push was rejected (with HTTP 429) because too many pushes are queued. See /queue.
+	UNIQUSH_ERROR_OVERLOADED = "UNIQUSH_ERROR_OVERLOADED"
+	// UNIQUSH_ERROR_SHUTTING_DOWN means the request was rejected (with HTTP 503) because this instance is stopping. It should be sent to another instance.
+	UNIQUSH_ERROR_SHUTTING_DOWN = "UNIQUSH_ERROR_SHUTTING_DOWN"
+	// UNIQUSH_ERROR_UNAUTHORIZED means the request was rejected (with HTTP 401) because API keys are enabled, and it didn't have a valid one in its Authorization header.
+	UNIQUSH_ERROR_UNAUTHORIZED = "UNIQUSH_ERROR_UNAUTHORIZED"
+	// UNIQUSH_ERROR_FORBIDDEN means the request was rejected (with HTTP 403) because its API key doesn't have the scope of the endpoint.
+	UNIQUSH_ERROR_FORBIDDEN = "UNIQUSH_ERROR_FORBIDDEN"
+	// UNIQUSH_ERROR_ADDRESS_NOT_ALLOWED means the request was rejected (with HTTP 403) because [NetworkPolicy] doesn't allow its address to request the endpoint.
+	UNIQUSH_ERROR_ADDRESS_NOT_ALLOWED = "UNIQUSH_ERROR_ADDRESS_NOT_ALLOWED"
+	// UNIQUSH_ERROR_RATE_LIMITED means the request was rejected (with HTTP 429 and Retry-After) because its address, API key or endpoint exceeded a limit of [RateLimit].
+	UNIQUSH_ERROR_RATE_LIMITED = "UNIQUSH_ERROR_RATE_LIMITED"
+	// UNIQUSH_ERROR_BAD_UNSUBSCRIBE_TOKEN means the token of /unsubscribe/token was invalid or expired, or unsubscribe tokens are disabled.
+	UNIQUSH_ERROR_BAD_UNSUBSCRIBE_TOKEN = "UNIQUSH_ERROR_BAD_UNSUBSCRIBE_TOKEN"
+	// UNIQUSH_ERROR_CANNOT_ENCRYPT means the push wasn't sent to a delivery point with an encryption_key, because its payload couldn't be encrypted
+	// (e.g. it was a raw uniqush.payload.* payload).
+	UNIQUSH_ERROR_CANNOT_ENCRYPT = "UNIQUSH_ERROR_CANNOT_ENCRYPT"
+	// UNIQUSH_ERROR_PAYLOAD_POLICY means the push or broadcast wasn't sent because its parameters break the payload policy of the service (see [PayloadPolicy]).
+	UNIQUSH_ERROR_PAYLOAD_POLICY = "UNIQUSH_ERROR_PAYLOAD_POLICY"
+	// UNIQUSH_ERROR_SUBSCRIBE_BLOCKED means the subscribe was rejected because its address or device token subscribed too many subscribers (see [SubscribeAbuse]).
+	UNIQUSH_ERROR_SUBSCRIBE_BLOCKED = "UNIQUSH_ERROR_SUBSCRIBE_BLOCKED"
+	// UNIQUSH_ERROR_INVALID_CREDENTIALS means the push service provider wasn't added because the push service rejected its credentials
+	// (or they couldn't be checked). The error message describes the problem. Add validate=0 to skip the check.
+	UNIQUSH_ERROR_INVALID_CREDENTIALS = "UNIQUSH_ERROR_INVALID_CREDENTIALS"
+	// UNIQUSH_ERROR_BAD_SIGNATURE means the request was rejected (usually with HTTP 401) because request signing is enabled, and it wasn't signed,
+	// its signature or timestamp was invalid, or it was a replay. The errorMsg of the response says why.
+	UNIQUSH_ERROR_BAD_SIGNATURE = "UNIQUSH_ERROR_BAD_SIGNATURE"
+	// UNIQUSH_ERROR_QUOTA_EXCEEDED means the request would exceed the daily pushes (with HTTP 429 for /push) or the subscribers of the tenant of the service.
+	UNIQUSH_ERROR_QUOTA_EXCEEDED = "UNIQUSH_ERROR_QUOTA_EXCEEDED"
+	// UNIQUSH_ERROR_NOT_READY means this instance can't serve pushes (with HTTP 503 from /readyz). The checks of the response say why.
+	UNIQUSH_ERROR_NOT_READY = "UNIQUSH_ERROR_NOT_READY"
+	// UNIQUSH_ERROR_DEADLINE_EXCEEDED means the push to the subscriber or delivery point was abandoned because the request_timeout of [WebFrontend]
+	// (or the deadline of the context given to Server.Push) passed before it was sent.
+	UNIQUSH_ERROR_DEADLINE_EXCEEDED = "UNIQUSH_ERROR_DEADLINE_EXCEEDED"
+
+	UNIQUSH_ERROR_BUILD_PUSH_SERVICE_PROVIDER  = "UNIQUSH_ERROR_BUILD_PUSH_SERVICE_PROVIDER"
+	UNIQUSH_ERROR_UPDATE_PUSH_SERVICE_PROVIDER = "UNIQUSH_ERROR_UPDATE_PUSH_SERVICE_PROVIDER"
+
+	UNIQUSH_ERROR_BAD_DELIVERY_POINT    = "UNIQUSH_ERROR_BAD_DELIVERY_POINT"
+	UNIQUSH_ERROR_BUILD_DELIVERY_POINT  = "UNIQUSH_ERROR_BUILD_DELIVERY_POINT"
+	UNIQUSH_ERROR_UPDATE_DELIVERY_POINT = "UNIQUSH_ERROR_UPDATE_DELIVERY_POINT"
+
+	UNIQUSH_ERROR_CANNOT_GET_SERVICE           = "UNIQUSH_ERROR_CANNOT_GET_SERVICE"
+	UNIQUSH_ERROR_CANNOT_GET_SUBSCRIBER        = "UNIQUSH_ERROR_CANNOT_GET_SUBSCRIBER"
+	UNIQUSH_ERROR_CANNOT_GET_DELIVERY_POINT_ID = "UNIQUSH_ERROR_CANNOT_GET_DELIVERY_POINT_ID"
+
+	UNIQUSH_ERROR_NO_DEVICE                = "UNIQUSH_ERROR_NO_DEVICE"
+	UNIQUSH_ERROR_NO_DELIVERY_POINT        = "UNIQUSH_ERROR_NO_DELIVERY_POINT"
+	UNIQUSH_ERROR_NO_PUSH_SERVICE_PROVIDER = "UNIQUSH_ERROR_NO_PUSH_SERVICE_PROVIDER"
+	UNIQUSH_ERROR_NO_SUBSCRIBER            = "UNIQUSH_ERROR_NO_SUBSCRIBER"
+	UNIQUSH_ERROR_NO_PUSH_SERVICE_TYPE     = "UNIQUSH_ERROR_NO_PUSH_SERVICE_TYPE"
+)
+
+// APIResponseDetails is used to represent responses of various APIs. Different APIs use different subsets of fields.
+type APIResponseDetails struct {
+	RequestID           *string `json:"requestId,omitempty"`
+	Service             *string `json:"service,omitempty"`
+	From                *string `json:"from,omitempty"`
+	Subscriber          *string `json:"subscriber,omitempty"`
+	PushServiceProvider *string `json:"pushServiceProvider,omitempty"`
+	DeliveryPoint       *string `json:"deliveryPoint,omitempty"`
+	MessageID           *string `json:"messageId,omitempty"`
+	Code                string  `json:"code"`
+	ErrorMsg            *string `json:"errorMsg,omitempty"`
+	ModifiedDp          bool    `json:"modifiedDp,omitempty"`
+}
+
+// PreviewAPIResponseDetails respresents the response of /preview. It contains a representation of the payload that would be sent to externalpush services
+type PreviewAPIResponseDetails struct {
+	Code     string      `json:"code"`
+	Payload  interface{} `json:"payload,omitempty"`
+	ErrorMsg *string     `json:"errorMsg,omitempty"`
+}
+
+func strPtrOfErr(e error) *string {
+	if e == nil {
+		return nil
+	}
+	s := redactedError(e)
+	return &s
+}
+
+// APIResponseHandler is interface for collecting API responses
+type APIResponseHandler interface {
+	AddDetailsToHandler(v APIResponseDetails)
+	ToJSON() []byte
+}
+
+// NullAPIResponseHandler is an APIResponseHandler implementation that does nothing.
+type NullAPIResponseHandler struct{}
+
+var _ APIResponseHandler = &NullAPIResponseHandler{}
+
+// AddDetailsToHandler does nothing for NullAPIResponseHandler
+func (handler *NullAPIResponseHandler) AddDetailsToHandler(v APIResponseDetails) {}
+
+// ToJSON returns an empty list for NullAPIResponseHandler
+func (handler *NullAPIResponseHandler) ToJSON() []byte {
+	return []byte{}
+}
@@ -1,4 +1,4 @@
-package main
+package server
 
 import (
 	"encoding/json"
@@ -46,7 +46,7 @@ func newAPISimpleResponse(apiType string) APISimpleResponse {
 
 // AddDetailsToHandler will set the only response's status and details.
 func (handler *APISimpleResponseHandler) AddDetailsToHandler(v APIResponseDetails) {
-	if v.Code == UNIQUSH_SUCCESS {
+	if v.Code == UNIQUSH_SUCCESS || v.Code == UNIQUSH_UNSUBSCRIBE_STAGED {
 		handler.response.Status = StatusSuccess
 	} else {
 		handler.response.Status = StatusFailure
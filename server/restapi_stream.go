@@ -0,0 +1,68 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+)
+
+// jsonListStream writes a JSON object with a list of items, one item at a time, so that large lists aren't kept in memory.
+// The response is {"<field>":[...],"errorMsg":"...","code":"..."}, the same as other list APIs. The code comes last, since errors may happen after items were written.
+type jsonListStream struct {
+	w       io.Writer
+	flusher http.Flusher
+	n       int
+	err     error
+}
+
+func newJSONListStream(w io.Writer, field string) *jsonListStream {
+	s := &jsonListStream{w: w}
+	s.flusher, _ = w.(http.Flusher)
+	name, _ := json.Marshal(field)
+	s.write([]byte("{"))
+	s.write(name)
+	s.write([]byte(":["))
+	return s
+}
+
+func (s *jsonListStream) write(data []byte) {
+	if s.err == nil {
+		_, s.err = s.w.Write(data)
+	}
+}
+
+// Add writes an item of the list. It returns an error once writing to the client has failed (e.g. the client disconnected), to stop listing.
+func (s *jsonListStream) Add(item interface{}) error {
+	data, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	if s.n > 0 {
+		s.write([]byte(","))
+	}
+	s.write(data)
+	s.n++
+	return s.err
+}
+
+// Flush sends the items written so far to the client.
+func (s *jsonListStream) Flush() {
+	if s.flusher != nil && s.err == nil {
+		s.flusher.Flush()
+	}
+}
+
+// Close ends the list with the code of the response, and the error message if err isn't nil.
+func (s *jsonListStream) Close(code string, err error) error {
+	s.write([]byte("]"))
+	if err != nil {
+		errorMsg, _ := json.Marshal(err.Error())
+		s.write([]byte(`,"errorMsg":`))
+		s.write(errorMsg)
+	}
+	codeJSON, _ := json.Marshal(code)
+	s.write([]byte(`,"code":`))
+	s.write(codeJSON)
+	s.write([]byte("}\r\n"))
+	return s.err
+}
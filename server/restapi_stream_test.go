@@ -0,0 +1,44 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/uniqush/uniqush-push/testutil"
+)
+
+func TestJSONListStream(t *testing.T) {
+	var buf bytes.Buffer
+	stream := newJSONListStream(&buf, "subscribers")
+	for _, sub := range []string{"a", "b"} {
+		if err := stream.Add(listedSubscriber{Subscriber: sub, DeliveryPoints: []string{"apns:" + sub}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := stream.Close(UNIQUSH_SUCCESS, nil); err != nil {
+		t.Fatal(err)
+	}
+	var response struct {
+		Subscribers  []listedSubscriber `json:"subscribers"`
+		ErrorMessage *string            `json:"errorMsg"`
+		Code         string             `json:"code"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &response); err != nil {
+		t.Fatalf("Expected valid JSON, got %q: %v", buf.String(), err)
+	}
+	testutil.ExpectEquals(t, []listedSubscriber{{"a", []string{"apns:a"}}, {"b", []string{"apns:b"}}}, response.Subscribers, "unexpected subscribers")
+	testutil.ExpectStringEquals(t, UNIQUSH_SUCCESS, response.Code, "unexpected code")
+	if response.ErrorMessage != nil {
+		t.Errorf("Expected no error message, got %q", *response.ErrorMessage)
+	}
+}
+
+func TestJSONListStreamError(t *testing.T) {
+	var buf bytes.Buffer
+	stream := newJSONListStream(&buf, "subscribers")
+	stream.Add(listedSubscriber{Subscriber: "a"})
+	stream.Close(UNIQUSH_ERROR_DATABASE, errors.New("connection lost"))
+	testutil.ExpectStringEquals(t, `{"subscribers":[{"subscriber":"a"}],"errorMsg":"connection lost","code":"UNIQUSH_ERROR_DATABASE"}`+"\r\n", buf.String(), "unexpected response")
+}
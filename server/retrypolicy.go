@@ -0,0 +1,265 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/uniqush/goconf/conf"
+)
+
+// Classes of push errors which may be retried, for the retry_on setting of a RetryPolicy.
+const (
+	// RetryOnRetry is for errors where the push service asked uniqush-push to retry the push later (e.g. HTTP 5xx, Unavailable)
+	RetryOnRetry = "retry"
+	// RetryOnConnection is for errors connecting to the push service.
+	RetryOnConnection = "connection"
+)
+
+// retryRequestParamPrefix is the prefix of the /push parameters overriding the retry policy of the service for one push.
+const retryRequestParamPrefix = "uniqush.retry."
+
+// RetryPolicy controls how many times and how often uniqush-push will re-attempt sending a push to a delivery point.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of times a push will be sent to a delivery point, including the first attempt.
+	MaxAttempts int
+	// BackoffBase is the delay before the first retry. The delay doubles with each retry.
+	BackoffBase time.Duration
+	// MaxInterval is the largest delay between two attempts.
+	MaxInterval time.Duration
+	// RetryOn is the set of error classes (RetryOnRetry, RetryOnConnection) which will be retried.
+	RetryOn map[string]bool
+}
+
+// defaultRetryPolicy is equivalent to the behavior of uniqush-push before retry policies were configurable:
+// retry after 5, 10, 20 and 40 seconds when the push service asks to retry.
+func defaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts: 5,
+		BackoffBase: 5 * time.Second,
+		MaxInterval: 1 * time.Minute,
+		RetryOn:     map[string]bool{RetryOnRetry: true},
+	}
+}
+
+// Interval returns how long to wait before the next attempt, after the given number of attempts have failed.
+func (p *RetryPolicy) Interval(attempt int) time.Duration {
+	if attempt < 1 {
+		attempt = 1
+	}
+	interval := float64(p.BackoffBase) * math.Pow(2, float64(attempt-1))
+	if interval > float64(p.MaxInterval) {
+		return p.MaxInterval
+	}
+	return time.Duration(interval)
+}
+
+// ShouldRetry returns true if a push should be sent again, after the given number of attempts failed with an error of the given class.
+func (p *RetryPolicy) ShouldRetry(class string, attempt int) bool {
+	return p.RetryOn[class] && attempt < p.MaxAttempts
+}
+
+// withOverrides returns a copy of this policy, with any settings found by get (max_attempts, backoff_base, max_interval, retry_on) replacing the original values.
+// Durations are in seconds, and retry_on is a comma separated list of error classes (or "none").
+func (p RetryPolicy) withOverrides(get func(key string) (string, bool)) (RetryPolicy, error) {
+	getSeconds := func(key string, value *time.Duration) error {
+		s, ok := get(key)
+		if !ok {
+			return nil
+		}
+		seconds, err := strconv.ParseFloat(s, 64)
+		if err != nil || seconds <= 0 {
+			return fmt.Errorf("Invalid %s %q, expected a positive number of seconds", key, s)
+		}
+		*value = time.Duration(seconds * float64(time.Second))
+		return nil
+	}
+	if s, ok := get("max_attempts"); ok {
+		attempts, err := strconv.Atoi(s)
+		if err != nil || attempts < 1 {
+			return p, fmt.Errorf("Invalid max_attempts %q, expected a positive integer", s)
+		}
+		p.MaxAttempts = attempts
+	}
+	if err := getSeconds("backoff_base", &p.BackoffBase); err != nil {
+		return p, err
+	}
+	if err := getSeconds("max_interval", &p.MaxInterval); err != nil {
+		return p, err
+	}
+	if p.MaxInterval < p.BackoffBase {
+		return p, fmt.Errorf("max_interval (%v) must be at least backoff_base (%v)", p.MaxInterval, p.BackoffBase)
+	}
+	if s, ok := get("retry_on"); ok {
+		retryOn := make(map[string]bool)
+		for _, class := range strings.Split(s, ",") {
+			class = strings.TrimSpace(class)
+			switch class {
+			case RetryOnRetry, RetryOnConnection:
+				retryOn[class] = true
+			case "none", "":
+			default:
+				return p, fmt.Errorf("Invalid retry_on class %q, expected a comma separated list of %s and %s, or none", class, RetryOnRetry, RetryOnConnection)
+			}
+		}
+		p.RetryOn = retryOn
+	}
+	return p, nil
+}
+
+// RetryPolicies contains the retry policy of each service, from the [Retry] and [Retry.<service>] sections of uniqush.conf.
+type RetryPolicies struct {
+	Default RetryPolicy
+	// ByService is keyed by the service name, which is case sensitive (see serviceSections).
+	ByService map[string]RetryPolicy
+}
+
+// ForService returns the retry policy used for pushes to the given service.
+func (r *RetryPolicies) ForService(service string) RetryPolicy {
+	if r == nil {
+		return defaultRetryPolicy()
+	}
+	if p, ok := r.ByService[service]; ok {
+		return p
+	}
+	return r.Default
+}
+
+// retryPolicyFromRequest returns the retry policy of the service, overridden by any uniqush.retry.* parameters of a /push request.
+// Those parameters are removed from kv so that they won't be sent as part of the payload.
+func (r *RetryPolicies) retryPolicyFromRequest(service string, kv map[string]string) (RetryPolicy, error) {
+	params := make(map[string]string)
+	for k, v := range kv {
+		if strings.HasPrefix(k, retryRequestParamPrefix) {
+			params[strings.TrimPrefix(k, retryRequestParamPrefix)] = v
+			delete(kv, k)
+		}
+	}
+	return r.ForService(service).withOverrides(func(key string) (string, bool) {
+		v, ok := params[key]
+		return v, ok
+	})
+}
+
+// retrySectionPrefix is the prefix of config sections with the retry policy of a single service.
+const retrySectionPrefix = "Retry."
+
+// LoadRetryPolicies returns a representation of the [Retry] section and [Retry.<service>] sections from uniqush.conf.
+// A service section may set the exact name of its service with the service option. Service sections inherit any settings they don't override from [Retry].
+func LoadRetryPolicies(c *conf.ConfigFile) (*RetryPolicies, error) {
+	getFromSection := func(section string) func(key string) (string, bool) {
+		return func(key string) (string, bool) {
+			v, err := c.GetString(section, key)
+			if err != nil || v == "" {
+				return "", false
+			}
+			return v, true
+		}
+	}
+	policies := &RetryPolicies{ByService: make(map[string]RetryPolicy)}
+	var err error
+	policies.Default, err = defaultRetryPolicy().withOverrides(getFromSection("Retry"))
+	if err != nil {
+		return nil, fmt.Errorf("[Retry]: %v", err)
+	}
+	sections, err := serviceSections(c, retrySectionPrefix)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range sections {
+		policies.ByService[s.service], err = policies.Default.withOverrides(getFromSection(s.section))
+		if err != nil {
+			return nil, fmt.Errorf("[%s]: %v", s.section, err)
+		}
+	}
+	return policies, nil
+}
+
+// retryState tracks the retry policy and the number of attempts made to send a push to a delivery point.
+type retryState struct {
+	// policy overrides the retry policy of the service, if it isn't nil.
+	policy  *RetryPolicy
+	attempt int
+	// ctx is the context of the push whose results are being collected, so that retries and failovers are traced as part of it.
+	ctx context.Context
+}
+
+func (r retryState) context() context.Context {
+	if r.ctx == nil {
+		return context.Background()
+	}
+	return r.ctx
+}
+
+// pendingRetries tracks the retries waiting for their interval, so that they are sent when uniqush-push stops instead of being lost.
+// The zero value is ready to use.
+type pendingRetries struct {
+	pending int64
+	mutex   sync.Mutex
+	// flushed is closed by Flush, to send the pending retries without waiting for the rest of their interval.
+	flushed chan struct{}
+}
+
+func (r *pendingRetries) flushedChan() chan struct{} {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.flushed == nil {
+		r.flushed = make(chan struct{})
+	}
+	return r.flushed
+}
+
+// schedule calls retry once after has passed, or right away once Flush was called.
+func (r *pendingRetries) schedule(after time.Duration, retry func()) {
+	atomic.AddInt64(&r.pending, 1)
+	flushed := r.flushedChan()
+	go func() {
+		defer atomic.AddInt64(&r.pending, -1)
+		timer := time.NewTimer(after)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-flushed:
+		}
+		retry()
+	}()
+}
+
+// Flush sends the pending retries right away, and waits until the deadline for them to be sent.
+// Retries scheduled after that (e.g. because a retry failed again) are also sent right away, until their retry policy gives up.
+// Returns false if some retries weren't sent before the deadline.
+func (r *pendingRetries) Flush(deadline time.Time) bool {
+	flushed := r.flushedChan()
+	r.mutex.Lock()
+	select {
+	case <-flushed:
+	default:
+		close(flushed)
+	}
+	r.mutex.Unlock()
+	return waitUntil(deadline, func() bool {
+		return atomic.LoadInt64(&r.pending) == 0
+	})
+}
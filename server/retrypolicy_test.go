@@ -0,0 +1,92 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/uniqush/goconf/conf"
+	"github.com/uniqush/uniqush-push/testutil"
+)
+
+func TestRetryPolicyInterval(t *testing.T) {
+	policy := defaultRetryPolicy()
+	var intervals []time.Duration
+	for attempt := 1; policy.ShouldRetry(RetryOnRetry, attempt); attempt++ {
+		intervals = append(intervals, policy.Interval(attempt))
+	}
+	testutil.ExpectEquals(t, []time.Duration{5 * time.Second, 10 * time.Second, 20 * time.Second, 40 * time.Second}, intervals, "expected the default policy to match the previous hard coded retries")
+	testutil.ExpectEquals(t, false, policy.ShouldRetry(RetryOnConnection, 1), "expected connection errors not to be retried by default")
+
+	policy.MaxInterval = 15 * time.Second
+	testutil.ExpectEquals(t, 15*time.Second, policy.Interval(3), "expected the interval to be capped")
+}
+
+func TestRetryPolicyFromRequest(t *testing.T) {
+	kv := map[string]string{
+		"msg":                        "hello",
+		"uniqush.retry.max_attempts": "2",
+		"uniqush.retry.backoff_base": "0.5",
+		"uniqush.retry.retry_on":     "retry,connection",
+		"uniqush.retry.max_interval": "3",
+	}
+	var policies *RetryPolicies
+	policy, err := policies.retryPolicyFromRequest("myservice", kv)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := RetryPolicy{
+		MaxAttempts: 2,
+		BackoffBase: 500 * time.Millisecond,
+		MaxInterval: 3 * time.Second,
+		RetryOn:     map[string]bool{RetryOnRetry: true, RetryOnConnection: true},
+	}
+	testutil.ExpectEquals(t, expected, policy, "expected request parameters to override the policy")
+	testutil.ExpectEquals(t, map[string]string{"msg": "hello"}, kv, "expected retry parameters to be removed")
+
+	for _, params := range []map[string]string{
+		{"uniqush.retry.max_attempts": "0"},
+		{"uniqush.retry.backoff_base": "-1"},
+		{"uniqush.retry.backoff_base": "10", "uniqush.retry.max_interval": "5"},
+		{"uniqush.retry.retry_on": "timeout"},
+	} {
+		if _, err := policies.retryPolicyFromRequest("myservice", params); err == nil {
+			t.Errorf("Expected %v to be rejected", params)
+		}
+	}
+}
+
+func TestLoadRetryPoliciesForService(t *testing.T) {
+	c := conf.NewConfigFile()
+	c.AddOption("Retry", "max_attempts", "3")
+	c.AddOption("Retry.MyService", "service", "MyService")
+	c.AddOption("Retry.MyService", "max_attempts", "7")
+	c.AddOption("Retry.lowercase", "max_attempts", "4")
+	policies, err := LoadRetryPolicies(c)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	testutil.ExpectEquals(t, 3, policies.ForService("otherservice").MaxAttempts, "expected the [Retry] section to be used by default")
+	testutil.ExpectEquals(t, 7, policies.ForService("MyService").MaxAttempts, "expected the [Retry.<service>] section to be used for that service")
+	testutil.ExpectEquals(t, 3, policies.ForService("myservice").MaxAttempts, "expected service names to be case sensitive")
+	testutil.ExpectEquals(t, 4, policies.ForService("lowercase").MaxAttempts, "expected the section name to be used if service isn't set")
+
+	c.AddOption("Retry.other", "service", "MyService")
+	if _, err := LoadRetryPolicies(c); err == nil {
+		t.Error("Expected two sections for the same service to be rejected")
+	}
+}
+
+func TestPendingRetriesFlush(t *testing.T) {
+	var retries pendingRetries
+	sent := make(chan struct{}, 2)
+	retries.schedule(time.Hour, func() { sent <- struct{}{} })
+	retries.schedule(time.Hour, func() {
+		// A retry which fails again is also sent right away.
+		retries.schedule(time.Hour, func() { sent <- struct{}{} })
+	})
+	if !retries.Flush(time.Now().Add(5 * time.Second)) {
+		t.Fatal("Expected the pending retries to be sent when flushed")
+	}
+	testutil.ExpectEquals(t, 2, len(sent), "expected every pending retry to be sent")
+	testutil.ExpectEquals(t, true, retries.Flush(time.Now()), "expected flushing twice to be harmless")
+}
@@ -0,0 +1,391 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/uniqush/log"
+	"github.com/uniqush/uniqush-push/push"
+)
+
+const (
+	defaultSecretsRefreshInterval = 5 * time.Minute
+	// secretRetryInterval is how long a secret which failed to refresh keeps its previous value before it is fetched again.
+	secretRetryInterval = 30 * time.Second
+
+	vaultSecretScheme             = "vault://"
+	awsSecretsManagerSecretScheme = "awssm://"
+)
+
+// SecretsConfig is a representation of the settings in the [Secrets] section of uniqush.conf.
+type SecretsConfig struct {
+	// RefreshInterval is how long a fetched secret is used before it is fetched again, so that rotated secrets are picked up.
+	RefreshInterval time.Duration
+	// VaultAddr is the address of the Vault server resolving vault:// references (e.g. https://vault:8200).
+	VaultAddr string
+	// VaultToken is the token authenticating to Vault.
+	VaultToken string
+	// AWSRegion is the region of AWS Secrets Manager resolving awssm:// references.
+	AWSRegion string
+	// AWSEndpoint overrides the endpoint of AWS Secrets Manager (e.g. for a VPC endpoint).
+	AWSEndpoint string
+}
+
+// isSecretReference returns true if the value of a field of a push service provider is a reference to a secret,
+// rather than the credential itself.
+func isSecretReference(value string) bool {
+	return strings.HasPrefix(value, vaultSecretScheme) || strings.HasPrefix(value, awsSecretsManagerSecretScheme)
+}
+
+// splitSecretReference returns the path of a secret reference without its scheme, and the field after "#" ("" if there is none).
+func splitSecretReference(ref, scheme string) (path, field string) {
+	path = ref[len(scheme):]
+	if i := strings.LastIndex(path, "#"); i >= 0 {
+		return path[:i], path[i+1:]
+	}
+	return path, ""
+}
+
+// pspField is a field of the fixed or volatile data of a push service provider.
+type pspField struct {
+	volatile bool
+	name     string
+}
+
+type cachedSecret struct {
+	value   string
+	expires time.Time
+}
+
+// secretResolver replaces the secret references in push service providers (vault://<path>#<field> or awssm://<secret id>#<json key>)
+// with the secrets they refer to. Secrets are cached for RefreshInterval. If a secret can't be refreshed, its previous value is used until it can.
+type secretResolver struct {
+	conf   SecretsConfig
+	client *http.Client
+	logger log.Logger
+	mutex  sync.Mutex
+	cache  map[string]*cachedSecret
+	// references are the secret references of each push service provider which was resolved, by name, to be restored before it is saved.
+	references map[string]map[pspField]string
+	now        func() time.Time
+}
+
+func newSecretResolver(conf SecretsConfig, logger log.Logger) *secretResolver {
+	return &secretResolver{
+		conf:       conf,
+		client:     &http.Client{Timeout: 10 * time.Second},
+		logger:     logger,
+		cache:      make(map[string]*cachedSecret),
+		references: make(map[string]map[pspField]string),
+		now:        time.Now,
+	}
+}
+
+// Resolve returns psp if it has no secret references, or a copy of psp (with the same name) with its references replaced by the secrets.
+func (s *secretResolver) Resolve(psp *push.PushServiceProvider) (*push.PushServiceProvider, error) {
+	if s == nil {
+		return psp, nil
+	}
+	refs := make(map[pspField]string)
+	for field, value := range psp.FixedData {
+		if isSecretReference(value) {
+			refs[pspField{name: field}] = value
+		}
+	}
+	for field, value := range psp.VolatileData {
+		if isSecretReference(value) {
+			refs[pspField{volatile: true, name: field}] = value
+		}
+	}
+	if len(refs) == 0 {
+		return psp, nil
+	}
+	fixedData := copyStringMap(psp.FixedData)
+	volatileData := copyStringMap(psp.VolatileData)
+	for field, ref := range refs {
+		secret, err := s.secret(ref)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot resolve the %s of %s: %v", field.name, psp.Name(), err)
+		}
+		if field.volatile {
+			volatileData[field.name] = secret
+		} else {
+			fixedData[field.name] = secret
+		}
+	}
+	s.mutex.Lock()
+	s.references[psp.Name()] = refs
+	s.mutex.Unlock()
+	return psp.CloneWithData(fixedData, volatileData), nil
+}
+
+// Unresolve returns psp with the secrets resolved by Resolve replaced by their references again, so that secrets aren't saved to the database
+// when push services update a push service provider.
+func (s *secretResolver) Unresolve(psp *push.PushServiceProvider) *push.PushServiceProvider {
+	if s == nil {
+		return psp
+	}
+	s.mutex.Lock()
+	refs := s.references[psp.Name()]
+	s.mutex.Unlock()
+	if len(refs) == 0 {
+		return psp
+	}
+	fixedData := copyStringMap(psp.FixedData)
+	volatileData := copyStringMap(psp.VolatileData)
+	for field, ref := range refs {
+		if field.volatile {
+			volatileData[field.name] = ref
+		} else {
+			fixedData[field.name] = ref
+		}
+	}
+	return psp.CloneWithData(fixedData, volatileData)
+}
+
+// secret returns the secret a reference refers to, from the cache if it was fetched less than RefreshInterval ago.
+func (s *secretResolver) secret(ref string) (string, error) {
+	now := s.now()
+	s.mutex.Lock()
+	cached := s.cache[ref]
+	s.mutex.Unlock()
+	if cached != nil && now.Before(cached.expires) {
+		return cached.value, nil
+	}
+	value, err := s.fetch(ref)
+	if err != nil {
+		if cached == nil {
+			return "", err
+		}
+		s.logger.Errorf("Secret=%v Cannot refresh the secret, using its previous value: %v", ref, err)
+		s.mutex.Lock()
+		s.cache[ref] = &cachedSecret{value: cached.value, expires: now.Add(secretRetryInterval)}
+		s.mutex.Unlock()
+		return cached.value, nil
+	}
+	redaction.addSecret(value)
+	if cached != nil && cached.value != value {
+		s.logger.Infof("Secret=%v Rotated", ref)
+	}
+	s.mutex.Lock()
+	s.cache[ref] = &cachedSecret{value: value, expires: now.Add(s.conf.RefreshInterval)}
+	s.mutex.Unlock()
+	return value, nil
+}
+
+func (s *secretResolver) fetch(ref string) (string, error) {
+	switch {
+	case strings.HasPrefix(ref, vaultSecretScheme):
+		return s.fetchVault(splitSecretReference(ref, vaultSecretScheme))
+	case strings.HasPrefix(ref, awsSecretsManagerSecretScheme):
+		return s.fetchAWSSecretsManager(splitSecretReference(ref, awsSecretsManagerSecretScheme))
+	default:
+		return "", fmt.Errorf("unsupported secret reference %q", ref)
+	}
+}
+
+// fetchVault reads a field of a secret of a KV (version 1 or 2) secrets engine of Vault, e.g. "secret/data/uniqush/fcm" and "apikey".
+// The field may be omitted if the secret has a single field.
+func (s *secretResolver) fetchVault(path, field string) (string, error) {
+	if s.conf.VaultAddr == "" {
+		return "", fmt.Errorf("[Secrets] vault_addr is not set")
+	}
+	req, err := http.NewRequest("GET", strings.TrimRight(s.conf.VaultAddr, "/")+"/v1/"+strings.TrimLeft(path, "/"), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", s.conf.VaultToken)
+	body, err := s.do(req)
+	if err != nil {
+		return "", err
+	}
+	var secret struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &secret); err != nil {
+		return "", fmt.Errorf("invalid response from Vault: %v", err)
+	}
+	data := secret.Data
+	// Version 2 of the KV secrets engine nests the secret in data.data, next to its metadata.
+	if inner, ok := data["data"].(map[string]interface{}); ok {
+		if _, ok := data["metadata"]; ok {
+			data = inner
+		}
+	}
+	return selectSecretField(data, field)
+}
+
+// fetchAWSSecretsManager reads a secret of AWS Secrets Manager by name or ARN. If field isn't "", the secret is a JSON object and field is one of its keys.
+// Requests are signed with the credentials in AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN.
+func (s *secretResolver) fetchAWSSecretsManager(id, field string) (string, error) {
+	if s.conf.AWSRegion == "" {
+		return "", fmt.Errorf("[Secrets] aws_region is not set")
+	}
+	accessKey, secretKey := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if accessKey == "" || secretKey == "" {
+		return "", fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set")
+	}
+	endpoint := s.conf.AWSEndpoint
+	if endpoint == "" {
+		endpoint = "https://secretsmanager." + s.conf.AWSRegion + ".amazonaws.com/"
+	}
+	body, err := json.Marshal(map[string]string{"SecretId": id})
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "secretsmanager.GetSecretValue")
+	if token := os.Getenv("AWS_SESSION_TOKEN"); token != "" {
+		req.Header.Set("X-Amz-Security-Token", token)
+	}
+	signAWSRequest(req, body, s.conf.AWSRegion, "secretsmanager", accessKey, secretKey, s.now())
+	respBody, err := s.do(req)
+	if err != nil {
+		return "", err
+	}
+	var secret struct {
+		SecretString *string `json:"SecretString"`
+	}
+	if err := json.Unmarshal(respBody, &secret); err != nil {
+		return "", fmt.Errorf("invalid response from AWS Secrets Manager: %v", err)
+	}
+	if secret.SecretString == nil {
+		return "", fmt.Errorf("secret %s has no string value", id)
+	}
+	if field == "" {
+		return *secret.SecretString, nil
+	}
+	var data map[string]interface{}
+	if err := json.Unmarshal([]byte(*secret.SecretString), &data); err != nil {
+		return "", fmt.Errorf("secret %s is not a JSON object: %v", id, err)
+	}
+	return selectSecretField(data, field)
+}
+
+func (s *secretResolver) do(req *http.Request) ([]byte, error) {
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		// The body of errors describes the problem (e.g. permission denied) without including secrets.
+		return nil, fmt.Errorf("Unexpected status %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
+
+// selectSecretField returns the string value of field in data, or the only value of data if field is "".
+func selectSecretField(data map[string]interface{}, field string) (string, error) {
+	if field == "" {
+		if len(data) != 1 {
+			return "", fmt.Errorf("the secret has %d fields: select one with #<field>", len(data))
+		}
+		for field = range data {
+		}
+	}
+	value, ok := data[field].(string)
+	if !ok {
+		return "", fmt.Errorf("the secret has no string field %q", field)
+	}
+	return value, nil
+}
+
+func copyStringMap(m map[string]string) map[string]string {
+	c := make(map[string]string, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+// signAWSRequest adds the headers of AWS Signature Version 4 to req, whose body is body and whose query (if any) is already canonical.
+// The host, content-type and x-amz-* headers are signed.
+func signAWSRequest(req *http.Request, body []byte, region, service, accessKey, secretKey string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if name == "content-type" || strings.HasPrefix(name, "x-amz-") {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	bodyHash := sha256.Sum256(body)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(bodyHash[:]),
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	for _, part := range []string{region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+accessKey+"/"+scope+", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/uniqush/log"
+	"github.com/uniqush/uniqush-push/push"
+	"github.com/uniqush/uniqush-push/testutil"
+)
+
+func newTestSecretResolver(conf SecretsConfig) *secretResolver {
+	conf.RefreshInterval = time.Minute
+	return newSecretResolver(conf, log.NewLogger(ioutil.Discard, "", log.LOGLEVEL_SILENT))
+}
+
+// newSecretTestPSP returns a push service provider of the bench push service type whose apikey is ref.
+func newSecretTestPSP(t *testing.T, ref string) *push.PushServiceProvider {
+	psp, _ := newFailureTestPeers(t)
+	psp.FixedData["apikey"] = ref
+	return psp
+}
+
+func TestResolveVaultSecret(t *testing.T) {
+	status, apikey := http.StatusOK, "first-api-key"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/secret/data/uniqush/fcm" || r.Header.Get("X-Vault-Token") != "s.token" {
+			http.Error(w, `{"errors":["permission denied"]}`, http.StatusForbidden)
+			return
+		}
+		w.WriteHeader(status)
+		w.Write([]byte(`{"data":{"data":{"apikey":"` + apikey + `","projectid":"p"},"metadata":{"version":1}}}`))
+	}))
+	defer server.Close()
+	s := newTestSecretResolver(SecretsConfig{VaultAddr: server.URL, VaultToken: "s.token"})
+	now := time.Unix(1500000000, 0)
+	s.now = func() time.Time { return now }
+
+	psp := newSecretTestPSP(t, "vault://secret/data/uniqush/fcm#apikey")
+	resolved, err := s.Resolve(psp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectStringEquals(t, "first-api-key", resolved.FixedData["apikey"], "expected the secret")
+	testutil.ExpectStringEquals(t, psp.Name(), resolved.Name(), "expected the name of the push service provider")
+	testutil.ExpectStringEquals(t, "vault://secret/data/uniqush/fcm#apikey", psp.FixedData["apikey"], "expected the push service provider not to be modified")
+	testutil.ExpectStringEquals(t, "[redacted:pi-key]", redaction.Redact("first-api-key"), "expected fetched secrets to be redacted")
+
+	// Updates of resolved push service providers are saved with the reference.
+	resolved.VolatileData["addr"] = "example.com"
+	update := s.Unresolve(resolved)
+	testutil.ExpectStringEquals(t, "vault://secret/data/uniqush/fcm#apikey", update.FixedData["apikey"], "expected the reference to be restored")
+	testutil.ExpectStringEquals(t, "example.com", update.VolatileData["addr"], "expected the update to be kept")
+
+	apikey = "rotated-api-key"
+	resolved, _ = s.Resolve(psp)
+	testutil.ExpectStringEquals(t, "first-api-key", resolved.FixedData["apikey"], "expected the secret to be cached")
+	now = now.Add(2 * time.Minute)
+	resolved, _ = s.Resolve(psp)
+	testutil.ExpectStringEquals(t, "rotated-api-key", resolved.FixedData["apikey"], "expected rotated secrets to be fetched once the cache expires")
+
+	status = http.StatusInternalServerError
+	now = now.Add(2 * time.Minute)
+	resolved, err = s.Resolve(psp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectStringEquals(t, "rotated-api-key", resolved.FixedData["apikey"], "expected the previous secret to be used if it can't be refreshed")
+
+	if _, err := s.Resolve(newSecretTestPSP(t, "vault://secret/data/uniqush/fcm")); err == nil {
+		t.Error("expected secrets with several fields to require a field")
+	}
+	if _, err := s.Resolve(newSecretTestPSP(t, "vault://secret/data/other#apikey")); err == nil {
+		t.Error("expected secrets which can't be read to fail")
+	}
+	plain := newSecretTestPSP(t, "plain-api-key")
+	if resolved, _ := s.Resolve(plain); resolved != plain {
+		t.Error("expected push service providers without references to be used as is")
+	}
+}
+
+func TestResolveAWSSecretsManagerSecret(t *testing.T) {
+	os.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY")
+	defer os.Unsetenv("AWS_ACCESS_KEY_ID")
+	defer os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Header.Get("X-Amz-Target") != "secretsmanager.GetSecretValue" || string(body) != `{"SecretId":"uniqush/adm"}` ||
+			!strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20170714/us-east-1/secretsmanager/aws4_request, ") {
+			http.Error(w, `{"__type":"AccessDeniedException"}`, http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(`{"Name":"uniqush/adm","SecretString":"{\"clientsecret\":\"adm-client-secret\"}"}`))
+	}))
+	defer server.Close()
+	s := newTestSecretResolver(SecretsConfig{AWSRegion: "us-east-1", AWSEndpoint: server.URL})
+	s.now = func() time.Time { return time.Unix(1500000000, 0) }
+
+	resolved, err := s.Resolve(newSecretTestPSP(t, "awssm://uniqush/adm#clientsecret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectStringEquals(t, "adm-client-secret", resolved.FixedData["apikey"], "expected the key of the JSON secret")
+
+	s = newTestSecretResolver(SecretsConfig{})
+	if _, err := s.Resolve(newSecretTestPSP(t, "awssm://uniqush/adm#clientsecret")); err == nil {
+		t.Error("expected references to fail without a region")
+	}
+}
+
+// TestSignAWSRequest checks the signature of the example request of the AWS Signature Version 4 documentation.
+func TestSignAWSRequest(t *testing.T) {
+	req := httptest.NewRequest("GET", "https://iam.amazonaws.com/?Action=ListUsers&Version=2010-05-08", nil)
+	req.Header = http.Header{}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	signAWSRequest(req, nil, "us-east-1", "iam", "AKIDEXAMPLE", "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+	testutil.ExpectStringEquals(t,
+		"AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/iam/aws4_request, SignedHeaders=content-type;host;x-amz-date, Signature=5d672d79c15b13162d9279b0855cfba6789a8edb4c82c400e06b5924a6f2b5d7",
+		req.Header.Get("Authorization"), "expected the signature of the example")
+}
@@ -0,0 +1,307 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// Package server is the uniqush-push server: the REST API, the push backend and everything they use.
+//
+// The uniqush-push command runs it as a daemon with Run. Other Go programs can embed it instead:
+// New starts the backend from a config file, without listening on any address.
+// Its pushes, subscriptions and push service providers can then be managed with the methods of Server,
+// which take the same parameters as the endpoints of the REST API and return the same responses, or over HTTP with Handler.
+// The push service types (and ingest adapters and event sinks) that are used must be installed first, e.g. with srv.InstallAPNS().
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/uniqush/log"
+	"github.com/uniqush/uniqush-push/db"
+	"github.com/uniqush/uniqush-push/push"
+	"github.com/uniqush/uniqush-push/tracing"
+)
+
+// embeddedRemoteAddr is the address logged and audited for the requests made with the methods of Server.
+const embeddedRemoteAddr = "embedded"
+
+// Server is a uniqush-push server, started by New.
+type Server struct {
+	sc       *serverConfig
+	loggers  []log.Logger
+	backend  *PushBackEnd
+	rest     *RestAPI
+	reloader *configReloader
+	stopChan chan bool
+}
+
+// New loads the config file conf and starts the push backend of a uniqush-push server, without listening on any address.
+// version is returned by /version.
+// The server stops when Stop is called or /stop is requested; it isn't stopped by SIGTERM unless it is serving with Serve.
+func New(conf, version string) (*Server, error) {
+	c, err := OpenConfig(conf)
+	if err != nil {
+		return nil, err
+	}
+	sc, err := loadServerConfig(c)
+	if err != nil {
+		return nil, err
+	}
+	loggers, err := LoadLoggers(c)
+	if err != nil {
+		return nil, err
+	}
+	if sc.tracingConf.Endpoint != "" {
+		startTracing(sc.tracingConf, loggers[LoggerWeb])
+	}
+	psm := push.GetPushServiceManager()
+	psm.SetConfigFile(c)
+
+	sc.dbconf.SlowQueryLogger = loggers[LoggerDatabase]
+	database, err := newDataResidencyDatabase(sc.dbconf, sc.residencyConf, db.NewPushDatabase)
+	if err != nil {
+		return nil, err
+	}
+	if sc.dbconf.CachePreload {
+		start := time.Now()
+		if loaded, err := database.PreloadCache(); err != nil {
+			loggers[LoggerWeb].Errorf("Failed to preload the cache after %d entries: %v", loaded, err)
+		} else {
+			loggers[LoggerWeb].Infof("Preloaded %d cache entries in %v", loaded, time.Since(start))
+		}
+	}
+
+	if psps, err := database.GetPushServiceProviderConfigs(); err == nil {
+		for _, psp := range psps {
+			redaction.addPushServiceProvider(psp)
+		}
+	} else {
+		loggers[LoggerWeb].Errorf("Failed to load push service providers to redact their credentials: %v", err)
+	}
+
+	backend := NewPushBackEnd(psm, database, loggers)
+	backend.secrets = newSecretResolver(sc.secretsConf, loggers[LoggerPush])
+	// Check that this instance can work before it joins the cluster or accepts requests.
+	backend.diagnostics = newDiagnostics(database, sc.diagnosticsConf, loggers[LoggerWeb])
+	backend.diagnostics.validate = backend.ValidateCredentials
+	if err := backend.diagnostics.Run().Failed(sc.diagnosticsConf.Strict); err != nil {
+		return nil, err
+	}
+	backend.jobs = newJobRunner(database, sc.jobConf, loggers[LoggerPush])
+	backend.cluster = newCluster(database, backend.jobs, sc.clusterConf, loggers[LoggerWeb])
+	if backend.cluster != nil {
+		backend.cluster.Run()
+	}
+	backend.breaker = newPSPCircuitBreaker(sc.failoverConf)
+	backend.retryPolicies = sc.retryPolicies
+	backend.payloadPolicies = sc.payloadPolicies
+	backend.quarantine = newPayloadQuarantine(database, sc.quarantineConf, loggers[LoggerQuarantine])
+	backend.history = newDeliveryHistory(database, backend.cluster, sc.historyConf, loggers[LoggerDeliveryHistory])
+	backend.inbox = newInbox(database, sc.inboxConf)
+	if backend.inbox != nil {
+		if err := psm.RegisterPushServiceType(backend.inbox); err != nil {
+			return nil, err
+		}
+	}
+	backend.analytics = newAnalytics(database, sc.analyticsConf, loggers[LoggerAnalytics])
+	backend.tail = newEventTail()
+	backend.events, err = newEventExporter(sc.eventSinkConfs, backend.tail, loggers[LoggerEventSink])
+	if err != nil {
+		return nil, err
+	}
+	backend.usage = newUsageMeter(database, sc.usageConf, loggers[LoggerWeb])
+	backend.audit = newAuditLog(database, sc.auditConf, loggers[LoggerAudit])
+	backend.tenants = newTenantStore(database, sc.apiKeysConf.CacheTTL, backend.audit, loggers[LoggerWeb])
+	backend.apiKeys = newAPIKeyStore(database, sc.apiKeysConf, backend.tenants, backend.audit, loggers[LoggerWeb])
+	backend.clientCerts = newClientCertIdentities(sc.tlsConf)
+	backend.network = newNetworkPolicy(sc.networkConf)
+	backend.limiter = newRateLimiter(sc.rateLimitConf)
+	backend.unsubscribeTokens = newUnsubscribeTokens(sc.unsubscribeTokensConf)
+	backend.subscribeAbuse = newSubscribeAbuseDetector(sc.subscribeAbuseConf, loggers[LoggerSub])
+	backend.signer = newRequestSigner(database, sc.signingConf, loggers[LoggerWeb])
+	backend.load = newBackpressure(sc.backpressureConf, backend.history)
+	backend.webhooks = newWebhookNotifier(sc.webhookConfs, loggers[LoggerWebhooks])
+	backend.dashboard = newDashboardStats()
+	backend.failures = newFailureReport()
+	backend.captures = newPayloadCapture(psm)
+	backend.slo = newPSPSLO(sc.sloConf, backend.webhooks, loggers[LoggerSLO])
+	backend.churn = newChurnDetector(sc.churnConf, backend.webhooks, loggers[LoggerChurn])
+	backend.broadcasts = newBroadcaster(backend, database, backend.jobs, sc.jobConf.Retention, loggers[LoggerBroadcast])
+	go backend.broadcasts.Run(sc.jobConf.LeaseTTL)
+	backend.unsubscribes = newUnsubscribeStager(backend, database, sc.unsubscribeConf, loggers[LoggerUnsub])
+	if backend.unsubscribes != nil {
+		go backend.unsubscribes.Run(stagedUnsubscribeCheckInterval)
+	}
+	backend.canary = newCanary(backend, sc.canaryConf, backend.webhooks, loggers[LoggerCanary])
+	if backend.canary != nil {
+		go backend.canary.Run()
+	}
+	backend.reconciler = newReconciler(backend, database, psm, backend.jobs, sc.reconcileConf, loggers[LoggerReconcile])
+	if sc.reconcileConf.Interval > 0 {
+		go backend.reconciler.Run()
+	}
+	backend.journal, err = newOperationJournal(sc.journalConf, database)
+	if err != nil {
+		return nil, err
+	}
+	backend.replication, err = newReplicator(database, psm, backend.jobs, sc.replicationConf, sc.residencyConf, loggers[LoggerReplication])
+	if err != nil {
+		return nil, err
+	}
+	if backend.replication != nil {
+		backend.replication.Run()
+	}
+	// The channel is buffered so that stopping a server that isn't serving doesn't block.
+	stopChan := make(chan bool, 1)
+	rest := NewRestAPI(psm, loggers, version, backend)
+	rest.stopChan = stopChan
+	rest.shutdownTimeout = sc.shutdownTimeout
+	rest.upstreamCompat = sc.upstreamCompat
+	rest.requestTimeout = sc.requestTimeout
+	backend.maintenance = newMaintenanceMode(database, loggers[LoggerPush])
+	backend.maintenance.replay = rest.replayHeldPush
+	backend.maintenance.Run()
+	backend.staging = newPSPStaging(database, loggers[LoggerAddPSP])
+	backend.staging.Run()
+	backend.features = newFeatureFlags(database, loggers[LoggerWeb])
+	backend.features.Run()
+	if sc.statsdConf.Addr != "" {
+		if err := startStatsd(sc.statsdConf, rest.metrics, loggers[LoggerWeb]); err != nil {
+			return nil, err
+		}
+	}
+	rest.ingester, err = newIngester(rest, sc.ingestConfs, loggers[LoggerIngest])
+	if err != nil {
+		return nil, err
+	}
+	rest.ingester.Run()
+	return &Server{
+		sc:       sc,
+		loggers:  loggers,
+		backend:  backend,
+		rest:     rest,
+		reloader: newConfigReloader(conf, loggers, backend.limiter, database, psm),
+		stopChan: stopChan,
+	}, nil
+}
+
+// Serve listens on the addresses of the config file (and the admin listener, if enabled), and reloads the config file on SIGHUP.
+// It returns after the server is stopped with Stop, /stop or SIGTERM.
+func (s *Server) Serve() error {
+	go s.rest.signalSetup()
+	go s.reloader.reloadOnSignal()
+	tlsConfig, err := newServerTLSConfig(s.sc.tlsConf, s.loggers[LoggerWeb])
+	if err != nil {
+		return err
+	}
+	s.rest.listeners = newListenerSet(s.rest.newServeMux(), s.reloader.path, tlsConfig, s.sc.shutdownTimeout, s.sc.socketMode, s.loggers[LoggerWeb])
+	if s.sc.adminConf.Addr != "" {
+		backend := s.backend
+		go runAdmin(s.sc.adminConf, s.loggers, backend.captures, backend.usage, backend.apiKeys, backend.tail, s.reloader, s.rest.listeners, backend.maintenance, backend.features)
+	}
+	go s.rest.Run(s.sc.addr, tlsConfig, s.stopChan)
+	<-s.stopChan
+	return nil
+}
+
+// Handler returns the handler of every endpoint of the REST API, so that an embedding program can serve it on its own listener.
+// The network policy, API keys, rate limits and request signing of the config file apply to its requests.
+func (s *Server) Handler() http.Handler {
+	return s.rest.newServeMux()
+}
+
+// Stop waits for the requests in progress (until the shutdown_timeout of the config file) and stops the push backend.
+// Requests made after Stop fail with UNIQUSH_ERROR_SHUTTING_DOWN.
+func (s *Server) Stop() {
+	s.rest.stop(nil, embeddedRemoteAddr)
+}
+
+// AddPushServiceProvider adds a push service provider to a service, with the parameters of /addpsp.
+func (s *Server) AddPushServiceProvider(params url.Values) APIResponseDetails {
+	return s.change(params, LoggerAddPSP, func(kv map[string]string, logger log.Logger) APIResponseDetails {
+		return s.rest.changePushServiceProvider(kv, logger, embeddedRemoteAddr, "", true)
+	})
+}
+
+// RemovePushServiceProvider removes a push service provider from a service, with the parameters of /rmpsp.
+func (s *Server) RemovePushServiceProvider(params url.Values) APIResponseDetails {
+	return s.change(params, LoggerRemovePSP, func(kv map[string]string, logger log.Logger) APIResponseDetails {
+		return s.rest.changePushServiceProvider(kv, logger, embeddedRemoteAddr, "", false)
+	})
+}
+
+// Subscribe adds a delivery point to a subscriber of a service, with the parameters of /subscribe.
+func (s *Server) Subscribe(params url.Values) APIResponseDetails {
+	return s.change(params, LoggerSub, func(kv map[string]string, logger log.Logger) APIResponseDetails {
+		return s.rest.changeSubscription(kv, logger, embeddedRemoteAddr, true)
+	})
+}
+
+// Unsubscribe removes a delivery point from a subscriber of a service, with the parameters of /unsubscribe.
+func (s *Server) Unsubscribe(params url.Values) APIResponseDetails {
+	return s.change(params, LoggerUnsub, func(kv map[string]string, logger log.Logger) APIResponseDetails {
+		return s.rest.changeSubscription(kv, logger, embeddedRemoteAddr, false)
+	})
+}
+
+// change runs a request that modifies the subscriptions or push service providers, unless the server is stopping.
+func (s *Server) change(params url.Values, loggerIndex int, f func(kv map[string]string, logger log.Logger) APIResponseDetails) APIResponseDetails {
+	if !s.rest.beginRequest() {
+		return APIResponseDetails{Code: UNIQUSH_ERROR_SHUTTING_DOWN}
+	}
+	defer s.rest.endRequest()
+	kv, _ := parseKV(params)
+	return f(kv, s.loggers[loggerIndex])
+}
+
+// Push sends a push notification to subscribers of a service, with the parameters of /push, and returns the result for each delivery point.
+// The spans of the push are children of the span of ctx, if it is traced.
+// Like /push, it fails with UNIQUSH_ERROR_OVERLOADED when too many pushes are queued.
+func (s *Server) Push(ctx context.Context, params url.Values) APIPushResponse {
+	handler := newPushResponseHandler(s.loggers[LoggerPush])
+	if retryAfter, overloaded := s.backend.Overloaded(); overloaded {
+		errMsg := "overloaded, retry after " + retryAfter.String()
+		handler.AddDetailsToHandler(APIResponseDetails{Code: UNIQUSH_ERROR_OVERLOADED, ErrorMsg: &errMsg})
+		return handler.response
+	}
+	if !s.rest.beginRequest() {
+		handler.AddDetailsToHandler(APIResponseDetails{Code: UNIQUSH_ERROR_SHUTTING_DOWN})
+		return handler.response
+	}
+	defer s.rest.endRequest()
+	kv, perdp := parseKV(params)
+	if err := s.backend.tenants.queueFull(kv["service"]); err != nil {
+		code := UNIQUSH_ERROR_DATABASE
+		if err == errTenantQueueFull {
+			code = UNIQUSH_ERROR_OVERLOADED
+		}
+		handler.AddDetailsToHandler(APIResponseDetails{Code: code, ErrorMsg: strPtrOfErr(err)})
+		return handler.response
+	}
+	if err := s.rest.reservePushes(kv); err != nil {
+		code := UNIQUSH_ERROR_DATABASE
+		if err == errTenantQuotaExceeded {
+			code = UNIQUSH_ERROR_QUOTA_EXCEEDED
+		}
+		handler.AddDetailsToHandler(APIResponseDetails{Code: code, ErrorMsg: strPtrOfErr(err)})
+		return handler.response
+	}
+	ctx, span := tracing.Start(ctx, PushNotificationURL, tracing.KindServer)
+	defer span.Finish()
+	s.rest.pushNotification(ctx, randomUniqID(), kv, perdp, s.loggers[LoggerPush], embeddedRemoteAddr, s.backend.history.Wrap(handler))
+	return handler.response
+}
@@ -0,0 +1,40 @@
+package server
+
+import (
+	"context"
+	"net/url"
+	"sync"
+	"testing"
+
+	"github.com/uniqush/uniqush-push/push"
+	"github.com/uniqush/uniqush-push/testutil"
+)
+
+func newTestServer(t *testing.T) *Server {
+	newFailureTestPeers(t)
+	rest := newHealthTestAPI(nil)
+	rest.psm = push.GetPushServiceManager()
+	rest.waitGroup = new(sync.WaitGroup)
+	return &Server{loggers: rest.loggers, backend: rest.backend, rest: rest}
+}
+
+func TestServerSubscribe(t *testing.T) {
+	s := newTestServer(t)
+	params := url.Values{"subscriber": {"user1"}, "pushservicetype": {benchPushServiceName}, "token": {"token1"}}
+	details := s.Subscribe(params)
+	testutil.ExpectStringEquals(t, UNIQUSH_ERROR_BUILD_DELIVERY_POINT, details.Code, "expected the parameters of /subscribe to be required")
+	details = s.Unsubscribe(url.Values{"service": {"myservice"}, "subscriber": {"user1"}})
+	testutil.ExpectStringEquals(t, UNIQUSH_ERROR_BUILD_DELIVERY_POINT, details.Code, "expected the parameters of /unsubscribe to be required")
+}
+
+func TestServerStopping(t *testing.T) {
+	s := newTestServer(t)
+	s.rest.stopping = true
+	params := url.Values{"service": {"myservice"}, "subscriber": {"user1"}, "pushservicetype": {benchPushServiceName}, "token": {"token1"}}
+	testutil.ExpectStringEquals(t, UNIQUSH_ERROR_SHUTTING_DOWN, s.Subscribe(params).Code, "expected subscriptions to be rejected while stopping")
+	testutil.ExpectStringEquals(t, UNIQUSH_ERROR_SHUTTING_DOWN, s.AddPushServiceProvider(params).Code, "expected push service providers to be rejected while stopping")
+
+	response := s.Push(context.Background(), url.Values{"service": {"myservice"}, "subscriber": {"user1"}, "msg": {"hello"}})
+	testutil.ExpectEquals(t, 1, response.FailureCount, "expected the push to fail")
+	testutil.ExpectStringEquals(t, UNIQUSH_ERROR_SHUTTING_DOWN, response.FailureDetails[0].Code, "expected pushes to be rejected while stopping")
+}
@@ -0,0 +1,57 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	defaultShutdownTimeout = 30 * time.Second
+	// shutdownPollInterval is how often waitUntil checks its condition.
+	shutdownPollInterval = 10 * time.Millisecond
+)
+
+// waitUntil waits until done returns true, or until the deadline. Returns false if the deadline passed first.
+func waitUntil(deadline time.Time, done func() bool) bool {
+	for !done() {
+		if !time.Now().Before(deadline) {
+			return false
+		}
+		time.Sleep(shutdownPollInterval)
+	}
+	return true
+}
+
+// waitGroupUntil waits until the counter of wg is zero, or until the deadline. Returns false if the deadline passed first.
+func waitGroupUntil(wg *sync.WaitGroup, deadline time.Time) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
@@ -0,0 +1,43 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/uniqush/uniqush-push/testutil"
+)
+
+func TestWaitGroupUntil(t *testing.T) {
+	wg := new(sync.WaitGroup)
+	wg.Add(1)
+	testutil.ExpectEquals(t, false, waitGroupUntil(wg, time.Now().Add(20*time.Millisecond)), "expected the deadline to pass while waiting")
+	go wg.Done()
+	testutil.ExpectEquals(t, true, waitGroupUntil(wg, time.Now().Add(time.Second)), "expected the wait group to finish before the deadline")
+}
+
+func TestWaitUntil(t *testing.T) {
+	n := 0
+	testutil.ExpectEquals(t, true, waitUntil(time.Now().Add(time.Second), func() bool {
+		n++
+		return n == 3
+	}), "expected the condition to become true before the deadline")
+	testutil.ExpectEquals(t, false, waitUntil(time.Now().Add(20*time.Millisecond), func() bool { return false }), "expected the deadline to pass while waiting")
+}
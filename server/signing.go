@@ -0,0 +1,151 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/uniqush/log"
+	"github.com/uniqush/uniqush-push/db"
+)
+
+const (
+	defaultSigningMaxSkew = 5 * time.Minute
+	// maxSignedBodySize is the largest body of a signed request. The body is read into memory to be verified before the request is handled.
+	maxSignedBodySize = 10 << 20
+)
+
+// Headers of signed requests.
+const (
+	// SigningTimestampHeader is the unix timestamp at which the request was signed.
+	SigningTimestampHeader = "X-Uniqush-Timestamp"
+	// SigningSignatureHeader is "sha256=" followed by the hex encoded HMAC-SHA256 of the request, see signedRequestMessage.
+	SigningSignatureHeader = "X-Uniqush-Signature"
+	signaturePrefix        = "sha256="
+)
+
+// SigningConfig is a representation of the settings in the [Signing] section of uniqush.conf.
+type SigningConfig struct {
+	// Secrets are the keys of the HMAC. Requests signed with any of them are accepted, so that the secret can be rotated. Signing is disabled if there are none.
+	Secrets []string
+	// MaxSkew is how far the timestamp of a request can be from the time it is received. Signatures are remembered for twice MaxSkew to reject replays.
+	MaxSkew time.Duration
+}
+
+// requestSigner verifies the HMAC signatures of API requests, for deployments where requests aren't sent over TLS.
+type requestSigner struct {
+	db      db.PushDatabase
+	secrets [][]byte
+	maxSkew time.Duration
+	logger  log.Logger
+	now     func() time.Time
+}
+
+func newRequestSigner(database db.PushDatabase, conf SigningConfig, logger log.Logger) *requestSigner {
+	if len(conf.Secrets) == 0 {
+		return nil
+	}
+	s := &requestSigner{db: database, maxSkew: conf.MaxSkew, logger: logger, now: time.Now}
+	for _, secret := range conf.Secrets {
+		s.secrets = append(s.secrets, []byte(secret))
+	}
+	return s
+}
+
+// signedRequestMessage returns what is signed: the timestamp, method, path with the query string, and body, separated by newlines.
+func signedRequestMessage(timestamp, method, requestURI string, body []byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(timestamp)
+	buf.WriteByte('\n')
+	buf.WriteString(method)
+	buf.WriteByte('\n')
+	buf.WriteString(requestURI)
+	buf.WriteByte('\n')
+	buf.Write(body)
+	return buf.Bytes()
+}
+
+func signRequestMessage(secret, message []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(message)
+	return mac.Sum(nil)
+}
+
+// verify checks the signature and timestamp of r, and that the signature wasn't already used. The body of r is replaced
+// by a copy, so that it can still be read after being verified. Requests to public paths (e.g. /healthz) don't need to be signed.
+// It returns http.StatusOK, or the status and the reason to reject the request with.
+func (s *requestSigner) verify(r *http.Request) (int, error) {
+	if s == nil || publicAPIPaths[r.URL.Path] {
+		return http.StatusOK, nil
+	}
+	timestamp := r.Header.Get(SigningTimestampHeader)
+	signature := r.Header.Get(SigningSignatureHeader)
+	if timestamp == "" || !strings.HasPrefix(signature, signaturePrefix) {
+		return http.StatusUnauthorized, fmt.Errorf("Requests must be signed with the %s and %s headers", SigningTimestampHeader, SigningSignatureHeader)
+	}
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return http.StatusUnauthorized, fmt.Errorf("Invalid %s %q", SigningTimestampHeader, timestamp)
+	}
+	if skew := s.now().Sub(time.Unix(seconds, 0)); skew > s.maxSkew || skew < -s.maxSkew {
+		return http.StatusUnauthorized, fmt.Errorf("%s is more than %v away from the time of the server", SigningTimestampHeader, s.maxSkew)
+	}
+	mac, err := hex.DecodeString(signature[len(signaturePrefix):])
+	if err != nil {
+		return http.StatusUnauthorized, fmt.Errorf("Invalid %s", SigningSignatureHeader)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxSignedBodySize+1))
+	if err != nil {
+		return http.StatusBadRequest, fmt.Errorf("Cannot read the body: %v", err)
+	}
+	if len(body) > maxSignedBodySize {
+		return http.StatusRequestEntityTooLarge, fmt.Errorf("The body of signed requests must not be larger than %d bytes", maxSignedBodySize)
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	message := signedRequestMessage(timestamp, r.Method, r.URL.RequestURI(), body)
+	valid := false
+	for _, secret := range s.secrets {
+		if hmac.Equal(mac, signRequestMessage(secret, message)) {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		return http.StatusUnauthorized, fmt.Errorf("Invalid %s", SigningSignatureHeader)
+	}
+	// A replayed request has a timestamp within MaxSkew, so it must be received within twice MaxSkew of the original request.
+	claimed, err := s.db.ClaimRequestSignature(hex.EncodeToString(mac), 2*s.maxSkew)
+	if err != nil {
+		s.logger.Errorf("URL=%v Cannot check for replayed requests: %v", r.URL.Path, err)
+		return http.StatusServiceUnavailable, fmt.Errorf("Cannot check for replayed requests")
+	}
+	if !claimed {
+		return http.StatusUnauthorized, fmt.Errorf("The request was already received")
+	}
+	return http.StatusOK, nil
+}
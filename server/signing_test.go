@@ -0,0 +1,74 @@
+package server
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/uniqush/log"
+	"github.com/uniqush/uniqush-push/db"
+	"github.com/uniqush/uniqush-push/testutil"
+)
+
+// signatureDatabase remembers claimed signatures in memory. Other methods aren't implemented.
+type signatureDatabase struct {
+	db.PushDatabase
+	signatures map[string]bool
+}
+
+func (d *signatureDatabase) ClaimRequestSignature(signature string, ttl time.Duration) (bool, error) {
+	if d.signatures[signature] {
+		return false, nil
+	}
+	d.signatures[signature] = true
+	return true, nil
+}
+
+func newSignedRequest(secret string, timestamp int64, path, body string) *http.Request {
+	req := httptest.NewRequest("POST", path, strings.NewReader(body))
+	ts := strconv.FormatInt(timestamp, 10)
+	mac := signRequestMessage([]byte(secret), signedRequestMessage(ts, "POST", path, []byte(body)))
+	req.Header.Set(SigningTimestampHeader, ts)
+	req.Header.Set(SigningSignatureHeader, signaturePrefix+hex.EncodeToString(mac))
+	return req
+}
+
+func TestRequestSigner(t *testing.T) {
+	logger := log.NewLogger(ioutil.Discard, "", log.LOGLEVEL_SILENT)
+	s := newRequestSigner(&signatureDatabase{signatures: make(map[string]bool)}, SigningConfig{Secrets: []string{"new", "old"}, MaxSkew: time.Minute}, logger)
+	now := time.Unix(1500000000, 0)
+	s.now = func() time.Time { return now }
+	verify := func(req *http.Request) int {
+		status, _ := s.verify(req)
+		return status
+	}
+
+	req := newSignedRequest("old", now.Unix()-30, "/push?service=srv", "subscriber=user1&msg=hi")
+	testutil.ExpectEquals(t, http.StatusOK, verify(req), "expected requests signed with any of the secrets to be accepted")
+	body, _ := ioutil.ReadAll(req.Body)
+	testutil.ExpectStringEquals(t, "subscriber=user1&msg=hi", string(body), "expected the body to be readable after being verified")
+	testutil.ExpectEquals(t, http.StatusUnauthorized, verify(newSignedRequest("old", now.Unix()-30, "/push?service=srv", "subscriber=user1&msg=hi")), "expected replays to be rejected")
+
+	testutil.ExpectEquals(t, http.StatusUnauthorized, verify(httptest.NewRequest("POST", "/push", nil)), "expected unsigned requests to be rejected")
+	testutil.ExpectEquals(t, http.StatusOK, verify(httptest.NewRequest("GET", HealthzURL, nil)), "expected health checks not to be signed")
+	testutil.ExpectEquals(t, http.StatusUnauthorized, verify(newSignedRequest("other", now.Unix(), "/push", "msg=hi")), "expected unknown secrets to be rejected")
+	testutil.ExpectEquals(t, http.StatusUnauthorized, verify(newSignedRequest("new", now.Unix()-61, "/push", "msg=hi")), "expected stale timestamps to be rejected")
+	testutil.ExpectEquals(t, http.StatusUnauthorized, verify(newSignedRequest("new", now.Unix()+61, "/push", "msg=hi")), "expected timestamps in the future to be rejected")
+
+	tampered := newSignedRequest("new", now.Unix(), "/push", "msg=hi")
+	tampered.Body = ioutil.NopCloser(strings.NewReader("msg=bye"))
+	testutil.ExpectEquals(t, http.StatusUnauthorized, verify(tampered), "expected changed bodies to be rejected")
+	moved := newSignedRequest("new", now.Unix(), "/push", "msg=hi")
+	moved.URL.Path = "/broadcast"
+	testutil.ExpectEquals(t, http.StatusUnauthorized, verify(moved), "expected signatures of other endpoints to be rejected")
+
+	var disabled *requestSigner
+	testutil.ExpectEquals(t, disabled, newRequestSigner(nil, SigningConfig{MaxSkew: time.Minute}, logger), "expected signing to be disabled without secrets")
+	status, _ := disabled.verify(httptest.NewRequest("POST", "/push", nil))
+	testutil.ExpectEquals(t, http.StatusOK, status, "expected unsigned requests to be accepted when signing is disabled")
+}
@@ -0,0 +1,197 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package server
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/uniqush/log"
+	"github.com/uniqush/uniqush-push/push"
+)
+
+const (
+	defaultSLOWindow       = 10 * time.Minute
+	defaultSLOMinPushes    = 20
+	defaultSLOMaxErrorRate = 0.1
+	// sloSlots is the number of slots the window is divided into. The oldest slot is dropped as the window rolls forward.
+	sloSlots = 10
+)
+
+// SLOConfig is a representation of the settings in the [SLO] section of uniqush.conf.
+type SLOConfig struct {
+	// Window is the period over which the error rate of each push service provider is computed.
+	Window time.Duration
+	// MinPushes is the number of pushes to a push service provider during the window below which no alert is raised.
+	MinPushes int64
+	// MaxErrorRate is the error rate above which an alert is raised. 0 disables tracking.
+	MaxErrorRate float64
+}
+
+// PSPErrorRate is the number of pushes to a push service provider during the window, and how many of them failed because of the push service provider.
+type PSPErrorRate struct {
+	PushServiceProvider string  `json:"pushServiceProvider"`
+	Pushes              int64   `json:"pushes"`
+	Failures            int64   `json:"failures"`
+	ErrorRate           float64 `json:"errorRate"`
+	// Breached is true from the alert that the error rate exceeded MaxErrorRate until the error rate recovers.
+	Breached bool `json:"breached"`
+}
+
+// isSLOFailure returns true if the result of a push counts against the push service provider (e.g. an expired certificate, a revoked key, or an outage),
+// rather than against the delivery point or payload.
+func isSLOFailure(err push.Error) bool {
+	switch err.(type) {
+	case nil, *push.DeliveryPointUpdate, *push.PushServiceProviderUpdate, *push.UnsubscribeUpdate, *push.InvalidRegistrationUpdate,
+		*push.BadDeliveryPoint, *push.BadNotification:
+		return false
+	default:
+		return true
+	}
+}
+
+type sloSlot struct {
+	// index is the number of slot widths since the unix epoch at the start of the slot.
+	index    int64
+	pushes   int64
+	failures int64
+}
+
+type sloWindow struct {
+	slots    [sloSlots]sloSlot
+	breached bool
+	// lastError is the most recent failure, which is included in alerts since it often says what is wrong (e.g. "certificate has expired").
+	lastError string
+}
+
+// totals returns the number of pushes and failures in the slots which are still in the window ending in the slot current.
+func (w *sloWindow) totals(current int64) (pushes, failures int64) {
+	for _, slot := range w.slots {
+		if slot.index > current-sloSlots {
+			pushes += slot.pushes
+			failures += slot.failures
+		}
+	}
+	return
+}
+
+// pspSLO tracks the rolling error rate of each push service provider, and raises an alert (in the log and with the webhook of the service)
+// when it exceeds MaxErrorRate, as an early warning of expired certificates or revoked keys.
+// Alerts are cleared once the error rate falls below half of MaxErrorRate, so that they don't flap around the threshold.
+type pspSLO struct {
+	conf     SLOConfig
+	webhooks *webhookNotifier
+	logger   log.Logger
+	mutex    sync.Mutex
+	windows  map[string]*sloWindow
+	now      func() time.Time
+}
+
+func newPSPSLO(conf SLOConfig, webhooks *webhookNotifier, logger log.Logger) *pspSLO {
+	if conf.MaxErrorRate <= 0 {
+		return nil
+	}
+	return &pspSLO{
+		conf:     conf,
+		webhooks: webhooks,
+		logger:   logger,
+		windows:  make(map[string]*sloWindow),
+		now:      time.Now,
+	}
+}
+
+func (s *pspSLO) slotIndex() int64 {
+	return s.now().UnixNano() / int64(s.conf.Window/sloSlots)
+}
+
+// record counts the result of a push to the push service provider pspName, and raises or clears its alert.
+func (s *pspSLO) record(service, pspName string, err push.Error) {
+	if s == nil {
+		return
+	}
+	index := s.slotIndex()
+	s.mutex.Lock()
+	w, ok := s.windows[pspName]
+	if !ok {
+		w = &sloWindow{}
+		s.windows[pspName] = w
+	}
+	slot := &w.slots[index%sloSlots]
+	if slot.index != index {
+		*slot = sloSlot{index: index}
+	}
+	slot.pushes++
+	if isSLOFailure(err) {
+		slot.failures++
+		w.lastError = redactedError(err)
+	}
+	pushes, failures := w.totals(index)
+	rate := float64(failures) / float64(pushes)
+	eventType := ""
+	if !w.breached && pushes >= s.conf.MinPushes && rate > s.conf.MaxErrorRate {
+		w.breached = true
+		eventType = WebhookPSPErrorRateExceeded
+	} else if w.breached && rate < s.conf.MaxErrorRate/2 {
+		w.breached = false
+		eventType = WebhookPSPErrorRateRecovered
+	}
+	lastError := w.lastError
+	s.mutex.Unlock()
+
+	switch eventType {
+	case WebhookPSPErrorRateExceeded:
+		s.logger.Alertf("Service=%v PushServiceProvider=%v ErrorRate=%.3f Pushes=%v Failures=%v LastError=%q Error rate exceeded %v over the last %v", service, pspName, rate, pushes, failures, lastError, s.conf.MaxErrorRate, s.conf.Window)
+	case WebhookPSPErrorRateRecovered:
+		s.logger.Infof("Service=%v PushServiceProvider=%v ErrorRate=%.3f Pushes=%v Failures=%v Error rate recovered", service, pspName, rate, pushes, failures)
+	default:
+		return
+	}
+	s.webhooks.Emit(WebhookEvent{Type: eventType, Service: service, PushServiceProvider: pspName, ErrorMsg: lastError, ErrorRate: rate, NrPushes: pushes})
+}
+
+// Rates returns the error rate of each push service provider which had pushes during the window, sorted by name.
+func (s *pspSLO) Rates() []PSPErrorRate {
+	if s == nil {
+		return nil
+	}
+	index := s.slotIndex()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var rates []PSPErrorRate
+	for pspName, w := range s.windows {
+		pushes, failures := w.totals(index)
+		if pushes == 0 {
+			if !w.breached {
+				// Forget push service providers which are no longer used.
+				delete(s.windows, pspName)
+			}
+			continue
+		}
+		rates = append(rates, PSPErrorRate{
+			PushServiceProvider: pspName,
+			Pushes:              pushes,
+			Failures:            failures,
+			ErrorRate:           float64(failures) / float64(pushes),
+			Breached:            w.breached,
+		})
+	}
+	sort.Slice(rates, func(i, j int) bool {
+		return rates[i].PushServiceProvider < rates[j].PushServiceProvider
+	})
+	return rates
+}
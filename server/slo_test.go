@@ -0,0 +1,78 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/uniqush/log"
+	"github.com/uniqush/uniqush-push/push"
+	"github.com/uniqush/uniqush-push/testutil"
+)
+
+func TestPSPSLOAlerts(t *testing.T) {
+	events := make(chan WebhookEvent, 4)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event WebhookEvent
+		body, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(body, &event)
+		events <- event
+	}))
+	defer server.Close()
+	logger := log.NewLogger(ioutil.Discard, "", log.LOGLEVEL_SILENT)
+	webhooks := newWebhookNotifier(&WebhookConfigs{Default: WebhookConfig{URL: server.URL}, Timeout: time.Second, MaxAttempts: 1}, logger)
+
+	s := newPSPSLO(SLOConfig{Window: 10 * time.Second, MinPushes: 5, MaxErrorRate: 0.5}, webhooks, logger)
+	now := time.Unix(1500000000, 0)
+	s.now = func() time.Time { return now }
+	expired := push.NewError("certificate has expired")
+	for i := 0; i < 3; i++ {
+		s.record("myservice", "apns:a", expired)
+	}
+	s.record("myservice", "apns:a", push.NewBadDeliveryPointWithDetails(nil, "bad token"))
+	testutil.ExpectEquals(t, 0, len(events), "expected no alert with fewer than min_pushes pushes")
+	s.record("myservice", "apns:b", nil)
+
+	s.record("myservice", "apns:a", nil)
+	testutil.ExpectEquals(t, true, webhooks.Flush(time.Now().Add(5*time.Second)), "expected the alert to be sent")
+	event := <-events
+	testutil.ExpectStringEquals(t, WebhookPSPErrorRateExceeded, event.Type, "expected an alert")
+	testutil.ExpectStringEquals(t, "apns:a", event.PushServiceProvider, "expected the push service provider of the alert")
+	testutil.ExpectStringEquals(t, expired.Error(), event.ErrorMsg, "expected the last error in the alert")
+	testutil.ExpectEquals(t, 0.6, event.ErrorRate, "expected bad delivery points not to count as failures")
+	testutil.ExpectEquals(t, int64(5), event.NrPushes, "expected the number of pushes in the window")
+	expectedRates := []PSPErrorRate{
+		{PushServiceProvider: "apns:a", Pushes: 5, Failures: 3, ErrorRate: 0.6, Breached: true},
+		{PushServiceProvider: "apns:b", Pushes: 1},
+	}
+	testutil.ExpectEquals(t, expectedRates, s.Rates(), "expected the error rate of each push service provider")
+
+	s.record("myservice", "apns:a", expired)
+	testutil.ExpectEquals(t, 0, len(events), "expected a single alert while the error rate stays high")
+
+	now = now.Add(11 * time.Second)
+	s.record("myservice", "apns:a", nil)
+	testutil.ExpectEquals(t, true, webhooks.Flush(time.Now().Add(5*time.Second)), "expected the recovery to be sent")
+	event = <-events
+	testutil.ExpectStringEquals(t, WebhookPSPErrorRateRecovered, event.Type, "expected the alert to be cleared once the failures left the window")
+
+	now = now.Add(11 * time.Second)
+	testutil.ExpectEquals(t, 0, len(s.Rates()), "expected push service providers without recent pushes to be forgotten")
+	testutil.ExpectEquals(t, (*pspSLO)(nil), newPSPSLO(SLOConfig{}, nil, nil), "expected a max_error_rate of 0 to disable tracking")
+}
+
+func TestPSPSLOFailuresLeaveTheWindow(t *testing.T) {
+	s := newPSPSLO(SLOConfig{Window: 10 * time.Second, MinPushes: 10, MaxErrorRate: 0.5}, nil, log.NewLogger(ioutil.Discard, "", log.LOGLEVEL_SILENT))
+	now := time.Unix(1500000000, 0)
+	s.now = func() time.Time { return now }
+	s.record("myservice", "fcm:a", push.NewConnectionError(errors.New("connection reset")))
+	now = now.Add(5 * time.Second)
+	s.record("myservice", "fcm:a", nil)
+	testutil.ExpectEquals(t, 0.5, s.Rates()[0].ErrorRate, "expected both pushes in the window")
+	now = now.Add(6 * time.Second)
+	testutil.ExpectEquals(t, []PSPErrorRate{{PushServiceProvider: "fcm:a", Pushes: 1}}, s.Rates(), "expected the oldest slot to leave the window")
+}
@@ -0,0 +1,53 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package server
+
+import (
+	"time"
+
+	"github.com/uniqush/log"
+	"github.com/uniqush/uniqush-push/metrics"
+)
+
+// StatsdConfig is a representation of the settings in the [Statsd] section of uniqush.conf.
+type StatsdConfig struct {
+	// Addr is the UDP address of a statsd server or Datadog agent, e.g. localhost:8125. The exporter is disabled if it is "".
+	Addr string
+	// Prefix is prepended to the names of the metrics, e.g. "myapp.".
+	Prefix string
+	// Tags are added to every metric, e.g. env:production. They require DogStatsD.
+	Tags []string
+	// DogStatsD sends the labels of metrics (e.g. service) as DogStatsD tags, instead of appending their values to the names of the metrics.
+	DogStatsD bool
+	// FlushInterval is how often the metrics are sent.
+	FlushInterval time.Duration
+}
+
+const defaultStatsdFlushInterval = 10 * time.Second
+
+// startStatsd sends the metrics of /metrics (those of the process, and backendMetrics) to conf.Addr every conf.FlushInterval.
+func startStatsd(conf StatsdConfig, backendMetrics *metrics.Registry, logger log.Logger) error {
+	logger.Infof("[Statsd] Addr=%v Prefix=%v DogStatsD=%v", conf.Addr, conf.Prefix, conf.DogStatsD)
+	exporter, err := metrics.NewStatsdExporter(conf.Addr, conf.Prefix, conf.Tags, conf.DogStatsD, metrics.DefaultRegistry, backendMetrics)
+	if err != nil {
+		return err
+	}
+	go exporter.Run(conf.FlushInterval, func(err error) {
+		logger.Errorf("Addr=%v Failed to send metrics: %v", conf.Addr, err)
+	})
+	return nil
+}
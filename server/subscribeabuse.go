@@ -0,0 +1,281 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/uniqush/log"
+	"github.com/uniqush/uniqush-push/metrics"
+	"github.com/uniqush/uniqush-push/push"
+)
+
+// subscribeAbuseBlocks counts the sources (ip or token) blocked from subscribing.
+var subscribeAbuseBlocks = metrics.DefaultRegistry.NewCounterVec("uniqush_subscribe_abuse_blocks_total",
+	"Addresses and device tokens blocked from subscribing by [SubscribeAbuse], by kind (ip or token).", "kind")
+
+const (
+	defaultSubscribeAbuseWindow        = time.Hour
+	defaultSubscribeAbuseBlockDuration = 24 * time.Hour
+	// subscribeAbuseSampleSize is the number of subscribers kept in the records of blocked sources, for reviewing them.
+	subscribeAbuseSampleSize = 10
+)
+
+// Kinds of sources of subscribes which are blocked.
+const (
+	subscribeAbuseIP    = "ip"
+	subscribeAbuseToken = "token"
+)
+
+// Statuses of the records of the review queue of /subscribeabuse.
+const (
+	SubscribeAbuseBlocked   = "blocked"
+	SubscribeAbuseConfirmed = "confirmed"
+	SubscribeAbuseAllowed   = "allowed"
+)
+
+// SubscribeAbuseConfig is a representation of the settings in the [SubscribeAbuse] section of uniqush.conf.
+type SubscribeAbuseConfig struct {
+	// Window is the period in which the distinct subscribers of a source are counted.
+	Window time.Duration
+	// MaxSubscribersPerIP is the number of distinct subscribers an address may subscribe to a service within Window. 0 is unlimited.
+	MaxSubscribersPerIP int
+	// MaxSubscribersPerToken is the number of distinct subscribers a device token may be subscribed under within Window. 0 is unlimited.
+	MaxSubscribersPerToken int
+	// BlockDuration is how long sources are blocked (or allowed after a review).
+	BlockDuration time.Duration
+}
+
+// SubscribeAbuseRecord describes a source which exceeded a threshold of [SubscribeAbuse], in the review queue of /subscribeabuse.
+type SubscribeAbuseRecord struct {
+	ID      string `json:"id"`
+	Kind    string `json:"kind"`
+	Service string `json:"service"`
+	// Source is the address, or the push service type and a hash of the device token (tokens aren't listed, since they're credentials of devices).
+	Source      string   `json:"source"`
+	Subscribers int      `json:"subscribers"`
+	Sample      []string `json:"sample"`
+	Status      string   `json:"status"`
+	DetectedAt  int64    `json:"detectedAt"`
+	ExpiresAt   int64    `json:"expiresAt"`
+	ReviewedBy  string   `json:"reviewedBy,omitempty"`
+}
+
+// subscribeAbuseSource tracks when a source last subscribed each subscriber.
+type subscribeAbuseSource struct {
+	subscribers map[string]time.Time
+}
+
+// subscribeAbuseDetector blocks the sources of subscribes which look like abuse: an address subscribing many distinct (e.g. random) subscribers,
+// or a device token subscribed under many subscribers. Blocked sources are listed for review, and can be allowed or confirmed.
+// The counts and the review queue are kept in memory, so each instance of uniqush-push detects abuse separately.
+type subscribeAbuseDetector struct {
+	conf   SubscribeAbuseConfig
+	logger log.Logger
+	now    func() time.Time
+
+	mutex   sync.Mutex
+	sources map[string]*subscribeAbuseSource
+	// records are the blocked and allowed sources, by id.
+	records map[string]*SubscribeAbuseRecord
+}
+
+// newSubscribeAbuseDetector returns nil if there are no thresholds.
+func newSubscribeAbuseDetector(conf SubscribeAbuseConfig, logger log.Logger) *subscribeAbuseDetector {
+	if conf.MaxSubscribersPerIP <= 0 && conf.MaxSubscribersPerToken <= 0 {
+		return nil
+	}
+	d := &subscribeAbuseDetector{
+		conf:    conf,
+		logger:  logger,
+		now:     time.Now,
+		sources: make(map[string]*subscribeAbuseSource),
+		records: make(map[string]*SubscribeAbuseRecord),
+	}
+	go d.run()
+	return d
+}
+
+func (d *subscribeAbuseDetector) run() {
+	for range time.Tick(d.conf.Window / 10) {
+		d.sweep()
+	}
+}
+
+// sweep removes the subscribers older than the window, and the records which expired.
+func (d *subscribeAbuseDetector) sweep() {
+	now := d.now()
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for id, source := range d.sources {
+		d.expire(source, now)
+		if len(source.subscribers) == 0 {
+			delete(d.sources, id)
+		}
+	}
+	for id, record := range d.records {
+		if now.Unix() >= record.ExpiresAt {
+			delete(d.records, id)
+		}
+	}
+}
+
+func (d *subscribeAbuseDetector) expire(source *subscribeAbuseSource, now time.Time) {
+	for subscriber, at := range source.subscribers {
+		if now.Sub(at) >= d.conf.Window {
+			delete(source.subscribers, subscriber)
+		}
+	}
+}
+
+// subscribeAbuseID identifies a source of subscribes to a service.
+func subscribeAbuseID(kind, service, source string) string {
+	return fmt.Sprintf("%s:%x", kind, sha1.Sum([]byte(service+"\x00"+source)))
+}
+
+// deviceTokenSource identifies the device token of dp, which is its fixed data other than its subscriber.
+func deviceTokenSource(dp *push.DeliveryPoint) string {
+	data := make(map[string]string, len(dp.FixedData))
+	for k, v := range dp.FixedData {
+		if k != push.Subscriber {
+			data[k] = v
+		}
+	}
+	b, _ := json.Marshal(data)
+	return fmt.Sprintf("%s:%x", dp.PushServiceName(), sha1.Sum(b))
+}
+
+// Allow returns an error if the address or device token of a subscribe is blocked, or if the subscribe makes it exceed a threshold, which blocks it.
+// The addresses of clients of unix sockets aren't checked, since they all share unixSocketClientAddr.
+func (d *subscribeAbuseDetector) Allow(service, subscriber string, dp *push.DeliveryPoint, remoteAddr string) error {
+	if d == nil {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	now := d.now()
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if !isUnixSocketAddr(remoteAddr) {
+		if err := d.allow(subscribeAbuseIP, service, host, subscriber, d.conf.MaxSubscribersPerIP, now); err != nil {
+			return err
+		}
+	}
+	return d.allow(subscribeAbuseToken, service, deviceTokenSource(dp), subscriber, d.conf.MaxSubscribersPerToken, now)
+}
+
+func (d *subscribeAbuseDetector) allow(kind, service, source, subscriber string, max int, now time.Time) error {
+	if max <= 0 {
+		return nil
+	}
+	id := subscribeAbuseID(kind, service, source)
+	if record, ok := d.records[id]; ok && now.Unix() < record.ExpiresAt {
+		if record.Status == SubscribeAbuseAllowed {
+			return nil
+		}
+		return fmt.Errorf("Subscribes from this %s are blocked until %s (%s)", kind, time.Unix(record.ExpiresAt, 0).UTC().Format(time.RFC3339), id)
+	}
+	s, ok := d.sources[id]
+	if !ok {
+		s = &subscribeAbuseSource{subscribers: make(map[string]time.Time)}
+		d.sources[id] = s
+	}
+	s.subscribers[subscriber] = now
+	if len(s.subscribers) <= max {
+		return nil
+	}
+	d.expire(s, now)
+	if len(s.subscribers) <= max {
+		return nil
+	}
+	record := &SubscribeAbuseRecord{
+		ID:          id,
+		Kind:        kind,
+		Service:     service,
+		Source:      source,
+		Subscribers: len(s.subscribers),
+		Status:      SubscribeAbuseBlocked,
+		DetectedAt:  now.Unix(),
+		ExpiresAt:   now.Add(d.conf.BlockDuration).Unix(),
+	}
+	for sub := range s.subscribers {
+		record.Sample = append(record.Sample, sub)
+	}
+	sort.Strings(record.Sample)
+	if len(record.Sample) > subscribeAbuseSampleSize {
+		record.Sample = record.Sample[:subscribeAbuseSampleSize]
+	}
+	d.records[id] = record
+	delete(d.sources, id)
+	subscribeAbuseBlocks.Inc(kind)
+	d.logger.Warnf("Service=%v Source=%v Subscribers=%v Blocked %s until %v: more than %d subscribers within %v", service, source, record.Subscribers, id, time.Unix(record.ExpiresAt, 0), max, d.conf.Window)
+	return fmt.Errorf("Too many subscribers from this %s, subscribes are blocked until %s (%s)", kind, time.Unix(record.ExpiresAt, 0).UTC().Format(time.RFC3339), id)
+}
+
+// List returns the blocked and allowed sources, most recently detected first.
+func (d *subscribeAbuseDetector) List() []SubscribeAbuseRecord {
+	records := []SubscribeAbuseRecord{}
+	if d == nil {
+		return records
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for _, record := range d.records {
+		records = append(records, *record)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].DetectedAt != records[j].DetectedAt {
+			return records[i].DetectedAt > records[j].DetectedAt
+		}
+		return records[i].ID < records[j].ID
+	})
+	return records
+}
+
+// Review allows a blocked source to subscribe again (without being blocked for BlockDuration), or confirms that it is blocked for BlockDuration.
+func (d *subscribeAbuseDetector) Review(id, action, reviewer string) (*SubscribeAbuseRecord, error) {
+	if d == nil {
+		return nil, fmt.Errorf("Subscribe abuse detection is disabled")
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	record, ok := d.records[id]
+	if !ok {
+		return nil, fmt.Errorf("No blocked source with id %q", id)
+	}
+	switch action {
+	case "allow":
+		record.Status = SubscribeAbuseAllowed
+	case "block":
+		record.Status = SubscribeAbuseConfirmed
+	default:
+		return nil, fmt.Errorf("Unknown action %q: must be allow or block", action)
+	}
+	record.ExpiresAt = d.now().Add(d.conf.BlockDuration).Unix()
+	record.ReviewedBy = reviewer
+	result := *record
+	return &result, nil
+}
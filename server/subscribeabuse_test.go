@@ -0,0 +1,102 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/uniqush/log"
+	"github.com/uniqush/uniqush-push/push"
+	"github.com/uniqush/uniqush-push/testutil"
+)
+
+func newTestSubscribeAbuseDetector(conf SubscribeAbuseConfig) *subscribeAbuseDetector {
+	return &subscribeAbuseDetector{
+		conf:    conf,
+		logger:  log.NewLogger(ioutil.Discard, "", log.LOGLEVEL_SILENT),
+		now:     time.Now,
+		sources: make(map[string]*subscribeAbuseSource),
+		records: make(map[string]*SubscribeAbuseRecord),
+	}
+}
+
+func TestSubscribeAbuseByAddress(t *testing.T) {
+	newFailureTestPeers(t)
+	psm := push.GetPushServiceManager()
+	d := newTestSubscribeAbuseDetector(SubscribeAbuseConfig{Window: time.Hour, MaxSubscribersPerIP: 3, BlockDuration: time.Hour})
+	now := time.Unix(1500000000, 0)
+	d.now = func() time.Time { return now }
+	subscribe := func(subscriber, token, remoteAddr string) error {
+		dp, err := psm.BuildDeliveryPointFromMap(map[string]string{"service": "myservice", "subscriber": subscriber, "pushservicetype": benchPushServiceName, "token": token})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d.Allow("myservice", subscriber, dp, remoteAddr)
+	}
+	for i := 0; i < 3; i++ {
+		if err := subscribe(fmt.Sprintf("user%d", i), fmt.Sprintf("token%d", i), "10.0.0.1:4000"); err != nil {
+			t.Fatalf("expected subscribe %d to be allowed, got %v", i, err)
+		}
+	}
+	testutil.ExpectEquals(t, nil, subscribe("user0", "token0", "10.0.0.1:5000"), "expected subscribing the same subscriber again not to count")
+	if err := subscribe("user3", "token3", "10.0.0.1:4000"); err == nil {
+		t.Fatal("expected the address to be blocked after too many subscribers")
+	}
+	if err := subscribe("user0", "token0", "10.0.0.1:4000"); err == nil {
+		t.Error("expected every subscribe from a blocked address to be rejected")
+	}
+	testutil.ExpectEquals(t, nil, subscribe("user4", "token4", "10.0.0.2:4000"), "expected other addresses to be allowed")
+	for i := 0; i < 5; i++ {
+		if err := subscribe(fmt.Sprintf("unixuser%d", i), fmt.Sprintf("unixtoken%d", i), unixSocketClientAddr); err != nil {
+			t.Fatalf("expected clients of unix sockets not to be blocked by address, got %v", err)
+		}
+	}
+
+	records := d.List()
+	testutil.ExpectEquals(t, 1, len(records), "expected the address to be queued for review")
+	testutil.ExpectEquals(t, SubscribeAbuseRecord{
+		ID:          records[0].ID,
+		Kind:        "ip",
+		Service:     "myservice",
+		Source:      "10.0.0.1",
+		Subscribers: 4,
+		Sample:      []string{"user0", "user1", "user2", "user3"},
+		Status:      SubscribeAbuseBlocked,
+		DetectedAt:  now.Unix(),
+		ExpiresAt:   now.Add(time.Hour).Unix(),
+	}, records[0], "expected the blocked address")
+
+	if _, err := d.Review(records[0].ID, "ignore", "key1"); err == nil {
+		t.Error("expected unknown actions to be rejected")
+	}
+	record, err := d.Review(records[0].ID, "allow", "key1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectStringEquals(t, SubscribeAbuseAllowed, record.Status, "expected the address to be allowed")
+	testutil.ExpectEquals(t, nil, subscribe("user5", "token5", "10.0.0.1:4000"), "expected allowed addresses not to be blocked again")
+
+	now = now.Add(2 * time.Hour)
+	d.sweep()
+	testutil.ExpectEquals(t, 0, len(d.List()), "expected expired records to be removed")
+}
+
+func TestSubscribeAbuseByToken(t *testing.T) {
+	newFailureTestPeers(t)
+	psm := push.GetPushServiceManager()
+	d := newTestSubscribeAbuseDetector(SubscribeAbuseConfig{Window: time.Hour, MaxSubscribersPerToken: 2, BlockDuration: time.Hour})
+	for i := 0; i < 3; i++ {
+		dp, err := psm.BuildDeliveryPointFromMap(map[string]string{"service": "myservice", "subscriber": fmt.Sprintf("user%d", i), "pushservicetype": benchPushServiceName, "token": "token1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = d.Allow("myservice", dp.FixedData[push.Subscriber], dp, fmt.Sprintf("10.0.0.%d:4000", i))
+		testutil.ExpectEquals(t, i == 2, err != nil, fmt.Sprintf("expected only the third subscriber of the token to be rejected, got %v", err))
+	}
+	testutil.ExpectStringEquals(t, "token", d.List()[0].Kind, "expected the token to be blocked")
+
+	var disabled *subscribeAbuseDetector
+	testutil.ExpectEquals(t, nil, disabled.Allow("myservice", "user1", nil, "10.0.0.1:4000"), "expected every subscribe to be allowed without thresholds")
+	testutil.ExpectEquals(t, (*subscribeAbuseDetector)(nil), newSubscribeAbuseDetector(SubscribeAbuseConfig{Window: time.Hour}, nil), "expected detection to be disabled without thresholds")
+}
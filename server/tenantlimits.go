@@ -0,0 +1,172 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package server
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/uniqush/uniqush-push/push"
+)
+
+// tenantQueuePollInterval is how often broadcasts of a tenant with too many queued pushes check whether they can send their next batch.
+const tenantQueuePollInterval = 100 * time.Millisecond
+
+// errTenantQueueFull is returned when a tenant already has as many pushes in progress on this instance as its max_queued_pushes.
+var errTenantQueueFull = errors.New("The tenant of the service has too many pushes in progress")
+
+// tenantLimits counts the pushes in progress and the push service providers being sent to for each tenant on this instance,
+// so that a tenant sending many pushes at once can't use all of the capacity of the instance.
+type tenantLimits struct {
+	mutex sync.Mutex
+	// released is signalled when a push service provider is no longer being sent to, for sends waiting for a connection.
+	released *sync.Cond
+	// queued and connections are by tenant id.
+	queued      map[string]int64
+	connections map[string]int64
+}
+
+func newTenantLimits() *tenantLimits {
+	l := &tenantLimits{
+		queued:      make(map[string]int64),
+		connections: make(map[string]int64),
+	}
+	l.released = sync.NewCond(&l.mutex)
+	return l
+}
+
+// usage returns the pushes in progress and the push service providers being sent to by the tenant id on this instance.
+func (l *tenantLimits) usage(id string) (queued, connections int64) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.queued[id], l.connections[id]
+}
+
+// queueFull returns errTenantQueueFull if the tenant of service can't queue more pushes on this instance.
+func (s *tenantStore) queueFull(service string) error {
+	t, err := s.ForService(service)
+	if err != nil || t == nil || t.MaxQueuedPushes <= 0 {
+		return err
+	}
+	if queued, _ := s.limits.usage(t.ID); queued >= t.MaxQueuedPushes {
+		return errTenantQueueFull
+	}
+	return nil
+}
+
+// beginPush counts a push to service as in progress for its tenant. The returned function must be called once the push is done.
+func (s *tenantStore) beginPush(service string) (end func()) {
+	t, err := s.ForService(service)
+	if err != nil || t == nil {
+		return func() {}
+	}
+	l := s.limits
+	l.mutex.Lock()
+	l.queued[t.ID]++
+	l.mutex.Unlock()
+	return func() {
+		l.mutex.Lock()
+		if l.queued[t.ID]--; l.queued[t.ID] <= 0 {
+			delete(l.queued, t.ID)
+		}
+		l.mutex.Unlock()
+	}
+}
+
+// waitForQueue waits until the tenant of service can queue more pushes on this instance, so that broadcasts slow down instead of failing.
+// Returns false if lost or stopping was closed first.
+func (s *tenantStore) waitForQueue(service string, lost, stopping <-chan struct{}) bool {
+	for s.queueFull(service) == errTenantQueueFull {
+		select {
+		case <-lost:
+			return false
+		case <-stopping:
+			return false
+		case <-time.After(tenantQueuePollInterval):
+		}
+	}
+	return true
+}
+
+// throttleConnections waits until the tenant of service has fewer push service providers being sent to than its max_connections,
+// and returns the delivery points of in to send once it does. release must be called once the push service provider is no longer being sent to.
+// While waiting, the delivery points of in are buffered, so that the request sending them can go on sending to other push service providers
+// (which would otherwise never finish and release their connections).
+func (s *tenantStore) throttleConnections(service string, in <-chan *push.DeliveryPoint) (out <-chan *push.DeliveryPoint, release func()) {
+	t, err := s.ForService(service)
+	if err != nil || t == nil || t.MaxConnections <= 0 {
+		return in, func() {}
+	}
+	l := s.limits
+	acquired := make(chan struct{})
+	go func() {
+		l.mutex.Lock()
+		for l.connections[t.ID] >= t.MaxConnections {
+			l.released.Wait()
+		}
+		l.connections[t.ID]++
+		l.mutex.Unlock()
+		close(acquired)
+	}()
+	throttled := make(chan *push.DeliveryPoint)
+	go func() {
+		var buffered []*push.DeliveryPoint
+		pending := in
+	waiting:
+		for {
+			select {
+			case dp, ok := <-pending:
+				if !ok {
+					// Receiving from a nil channel blocks, so only the connection is waited for.
+					pending = nil
+					continue
+				}
+				buffered = append(buffered, dp)
+			case <-acquired:
+				break waiting
+			}
+		}
+		for _, dp := range buffered {
+			throttled <- dp
+		}
+		if pending != nil {
+			for dp := range pending {
+				throttled <- dp
+			}
+		}
+		close(throttled)
+	}()
+	return throttled, func() {
+		l.mutex.Lock()
+		if l.connections[t.ID]--; l.connections[t.ID] <= 0 {
+			delete(l.connections, t.ID)
+		}
+		l.mutex.Unlock()
+		l.released.Broadcast()
+	}
+}
+
+// broadcastTooLarge returns an error if a broadcast to n subscribers of service is larger than the max_broadcast_size of its tenant.
+func (s *tenantStore) broadcastTooLarge(service string, n int64) error {
+	t, err := s.ForService(service)
+	if err != nil || t == nil || t.MaxBroadcastSize <= 0 || n <= t.MaxBroadcastSize {
+		return err
+	}
+	return fmt.Errorf("The broadcast has %d subscribers, more than the %d allowed for the tenant %s", n, t.MaxBroadcastSize, t.ID)
+}
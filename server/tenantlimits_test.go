@@ -0,0 +1,104 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/uniqush/uniqush-push/push"
+	"github.com/uniqush/uniqush-push/testutil"
+)
+
+func TestTenantQueueLimit(t *testing.T) {
+	s, _ := newTestTenantStore()
+	if err := s.Set(Tenant{ID: "payments", Services: []string{"checkout"}, MaxQueuedPushes: 2}, AuditRecord{}); err != nil {
+		t.Fatal(err)
+	}
+	end1 := s.beginPush("checkout")
+	testutil.ExpectEquals(t, nil, s.queueFull("checkout"), "expected pushes within the limit to be allowed")
+	end2 := s.beginPush("checkout")
+	testutil.ExpectEquals(t, errTenantQueueFull, s.queueFull("checkout"), "expected pushes past the limit to be rejected")
+	testutil.ExpectEquals(t, nil, s.queueFull("news"), "expected services without a tenant to be unlimited")
+
+	stop := make(chan struct{})
+	close(stop)
+	testutil.ExpectEquals(t, false, s.waitForQueue("checkout", nil, stop), "expected waiting broadcasts to stop")
+
+	end1()
+	testutil.ExpectEquals(t, true, s.waitForQueue("checkout", nil, nil), "expected broadcasts to go on once pushes finish")
+	queued, _ := s.limits.usage("payments")
+	testutil.ExpectEquals(t, int64(1), queued, "expected finished pushes not to be counted")
+	end2()
+	tenants, err := s.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectEquals(t, int64(0), tenants[0].QueuedPushes, "expected the pushes in progress to be listed")
+
+	var disabled *tenantStore
+	disabled.beginPush("checkout")()
+	testutil.ExpectEquals(t, nil, disabled.queueFull("checkout"), "expected no limits without a store")
+}
+
+func TestTenantConnectionLimit(t *testing.T) {
+	s, _ := newTestTenantStore()
+	if err := s.Set(Tenant{ID: "payments", Services: []string{"checkout"}, MaxConnections: 1}, AuditRecord{}); err != nil {
+		t.Fatal(err)
+	}
+	first := make(chan *push.DeliveryPoint)
+	out1, release1 := s.throttleConnections("checkout", first)
+	second := make(chan *push.DeliveryPoint)
+	out2, release2 := s.throttleConnections("checkout", second)
+
+	dp := push.NewEmptyDeliveryPoint()
+	go func() { first <- dp }()
+	select {
+	case <-out1:
+	case <-time.After(time.Second):
+		t.Fatal("expected the first push service provider to be sent to")
+	}
+	// The delivery points of the waiting send are buffered, so the request sending them isn't blocked.
+	second <- dp
+	close(second)
+	select {
+	case <-out2:
+		t.Fatal("expected the second push service provider to wait for a connection")
+	case <-time.After(50 * time.Millisecond):
+	}
+	_, connections := s.limits.usage("payments")
+	testutil.ExpectEquals(t, int64(1), connections, "expected the connection to be counted")
+
+	close(first)
+	release1()
+	select {
+	case got := <-out2:
+		testutil.ExpectEquals(t, dp, got, "expected the buffered delivery point to be sent")
+	case <-time.After(time.Second):
+		t.Fatal("expected the second push service provider to be sent to once a connection is released")
+	}
+	if _, ok := <-out2; ok {
+		t.Error("expected the throttled queue to be closed")
+	}
+	release2()
+	_, connections = s.limits.usage("payments")
+	testutil.ExpectEquals(t, int64(0), connections, "expected released connections not to be counted")
+
+	unlimited := make(chan *push.DeliveryPoint)
+	out, release := s.throttleConnections("news", unlimited)
+	testutil.ExpectEquals(t, (<-chan *push.DeliveryPoint)(unlimited), out, "expected services without a limit not to be throttled")
+	release()
+}
+
+func TestTenantBroadcastSizeLimit(t *testing.T) {
+	s, _ := newTestTenantStore()
+	if err := s.Set(Tenant{ID: "payments", Services: []string{"checkout"}, MaxBroadcastSize: 100}, AuditRecord{}); err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectEquals(t, nil, s.broadcastTooLarge("checkout", 100), "expected broadcasts within the limit to be allowed")
+	if err := s.broadcastTooLarge("checkout", 101); err == nil {
+		t.Error("expected broadcasts past the limit to be rejected")
+	}
+	testutil.ExpectEquals(t, nil, s.broadcastTooLarge("news", 1000000), "expected services without a tenant to be unlimited")
+	if err := s.Set(Tenant{ID: "growth", MaxConnections: -1}, AuditRecord{}); err == nil {
+		t.Error("expected negative limits to be rejected")
+	}
+}
@@ -0,0 +1,541 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/uniqush/log"
+	"github.com/uniqush/uniqush-push/db"
+)
+
+// Paths of the endpoints which manage tenants. Like the endpoints managing API keys, they require an admin key which doesn't belong to a tenant,
+// and are also served by the admin listener.
+const (
+	QueryTenantsURL = "/tenants"
+	SetTenantURL    = "/settenant"
+	RemoveTenantURL = "/rmtenant"
+)
+
+// Actions of audit records of tenants.
+const (
+	AuditSetTenant    = "settenant"
+	AuditRemoveTenant = "rmtenant"
+)
+
+// tenantPushesTTL is how long the daily push counters of tenants are kept.
+const tenantPushesTTL = 48 * time.Hour
+
+// Parameters naming the services of a request, for tenantEndpoints.
+const (
+	tenantParamService   = "service"
+	tenantParamServices  = "services"
+	tenantParamBroadcast = "broadcast"
+	tenantParamNone      = ""
+)
+
+// tenantEndpoints are the endpoints which the API keys of tenants can use (within their scopes), and how the services of their requests are named:
+// by the service parameter, the comma separated services parameter (all of the tenant's services if it is empty), or the service of the broadcast
+// with the id parameter. Other endpoints (e.g. /psps, /audit and /stop) are global, so they can only be used by keys which don't belong to a tenant.
+var tenantEndpoints = map[string]string{
+	PushNotificationURL:                     tenantParamService,
+	PreviewPushNotificationURL:              tenantParamNone,
+	TestPushURL:                             tenantParamService,
+	StagePushServiceProviderURL:             tenantParamService,
+	QueryStagedPushServiceProvidersURL:      tenantParamService,
+	SetStagedPercentURL:                     tenantParamService,
+	PromoteStagedPushServiceProviderURL:     tenantParamService,
+	RollbackStagedPushServiceProviderURL:    tenantParamService,
+	BroadcastURL:                            tenantParamService,
+	QueryBroadcastsURL:                      tenantParamBroadcast,
+	PauseBroadcastURL:                       tenantParamBroadcast,
+	ResumeBroadcastURL:                      tenantParamBroadcast,
+	CancelBroadcastURL:                      tenantParamBroadcast,
+	AddDeliveryPointToServiceURL:            tenantParamService,
+	RemoveDeliveryPointFromServiceURL:       tenantParamService,
+	RefreshDeliveryPointURL:                 tenantParamService,
+	AddPushServiceProviderToServiceURL:      tenantParamService,
+	RemovePushServiceProviderFromServiceURL: tenantParamService,
+	QueryNumberOfDeliveryPointsURL:          tenantParamService,
+	QuerySubscriptionsURL:                   tenantParamServices,
+	QuerySubscribersURL:                     tenantParamService,
+	QueryDeliveriesURL:                      tenantParamService,
+	QueryInboxURL:                           tenantParamService,
+	RemoveInboxMessagesURL:                  tenantParamService,
+	QueryAnalyticsURL:                       tenantParamService,
+	QueryFailuresURL:                        tenantParamService,
+	QueryCanaryURL:                          tenantParamService,
+	QueryFlaggedDeliveryPointsURL:           tenantParamService,
+	QueryStagedUnsubscribesURL:              tenantParamService,
+	ReconcileURL:                            tenantParamService,
+	TrackOpenURL:                            tenantParamService,
+	TrackClickURL:                           tenantParamService,
+	UnsubscribeTokenURL:                     tenantParamService,
+}
+
+// errTenantQuotaExceeded is returned when a push would exceed the daily pushes of a tenant.
+var errTenantQuotaExceeded = errors.New("The tenant of the service exceeded its quota")
+
+// tenantErrorCode returns the code of the response to a request which failed with err: UNIQUSH_ERROR_QUOTA_EXCEEDED if it exceeded the quota of a tenant.
+func tenantErrorCode(err error) string {
+	if err == errTenantQuotaExceeded {
+		return UNIQUSH_ERROR_QUOTA_EXCEEDED
+	}
+	return UNIQUSH_ERROR_GENERIC
+}
+
+// Tenant is a team sharing uniqush-push with others: its API keys can only use its own services, within its quotas.
+type Tenant struct {
+	ID       string   `json:"id"`
+	Services []string `json:"services"`
+	// MaxSubscribers is the most subscribers the services of the tenant can have in total. 0 is unlimited.
+	MaxSubscribers int64 `json:"maxSubscribers,omitempty"`
+	// MaxPushesPerDay is the most pushes (one per subscriber of /push, and the subscribers of broadcasts) the tenant can send per UTC day. 0 is unlimited.
+	MaxPushesPerDay int64 `json:"maxPushesPerDay,omitempty"`
+	// MaxQueuedPushes is the most pushes of the tenant in progress at once on each instance. Past it, /push is rejected and broadcasts wait. 0 is unlimited.
+	MaxQueuedPushes int64 `json:"maxQueuedPushes,omitempty"`
+	// MaxConnections is the most push service providers of the tenant sent to at once on each instance. Other sends wait. 0 is unlimited.
+	MaxConnections int64 `json:"maxConnections,omitempty"`
+	// MaxBroadcastSize is the most subscribers a broadcast of the tenant can push to. Larger broadcasts are cancelled before sending. 0 is unlimited.
+	MaxBroadcastSize int64 `json:"maxBroadcastSize,omitempty"`
+}
+
+func (t *Tenant) owns(service string) bool {
+	for _, s := range t.Services {
+		if s == service {
+			return true
+		}
+	}
+	return false
+}
+
+// TenantUsage is a tenant along with how much of its quotas it used, for /tenants.
+type TenantUsage struct {
+	Tenant
+	Subscribers int64 `json:"subscribers"`
+	PushesToday int64 `json:"pushesToday"`
+	// QueuedPushes and Connections are the pushes in progress and the push service providers being sent to on the instance responding.
+	QueuedPushes int64 `json:"queuedPushes"`
+	Connections  int64 `json:"connections"`
+}
+
+// tenantStore saves tenants and enforces their quotas. Tenants are cached for cacheTTL, so changes made by another instance apply within cacheTTL.
+type tenantStore struct {
+	db       db.PushDatabase
+	cacheTTL time.Duration
+	audit    *auditLog
+	logger   log.Logger
+	mutex    sync.Mutex
+	// byID and byService are nil until the tenants are loaded, and loaded again after expires.
+	byID      map[string]*Tenant
+	byService map[string]*Tenant
+	expires   time.Time
+	now       func() time.Time
+	// limits enforces the max_queued_pushes and max_connections of tenants on this instance.
+	limits *tenantLimits
+}
+
+func newTenantStore(database db.PushDatabase, cacheTTL time.Duration, audit *auditLog, logger log.Logger) *tenantStore {
+	return &tenantStore{db: database, cacheTTL: cacheTTL, audit: audit, logger: logger, now: time.Now, limits: newTenantLimits()}
+}
+
+// load returns the tenants by id and by service, reading them from the database if the cache expired.
+func (s *tenantStore) load() (map[string]*Tenant, map[string]*Tenant, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.byID != nil && s.now().Before(s.expires) {
+		return s.byID, s.byService, nil
+	}
+	records, err := s.db.GetTenants()
+	if err != nil {
+		return nil, nil, err
+	}
+	byID := make(map[string]*Tenant, len(records))
+	byService := make(map[string]*Tenant)
+	for id, b := range records {
+		t := new(Tenant)
+		if err := json.Unmarshal(b, t); err != nil {
+			s.logger.Errorf("Tenant=%v Ignoring invalid tenant: %v", id, err)
+			continue
+		}
+		byID[id] = t
+		for _, service := range t.Services {
+			byService[service] = t
+		}
+	}
+	s.byID, s.byService, s.expires = byID, byService, s.now().Add(s.cacheTTL)
+	return byID, byService, nil
+}
+
+// invalidate makes the next lookup read the tenants from the database, after this instance changed them.
+func (s *tenantStore) invalidate() {
+	s.mutex.Lock()
+	s.byID = nil
+	s.mutex.Unlock()
+}
+
+// Get returns the tenant with the given id, or nil if there is none.
+func (s *tenantStore) Get(id string) (*Tenant, error) {
+	if s == nil {
+		return nil, nil
+	}
+	byID, _, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	return byID[id], nil
+}
+
+// ForService returns the tenant owning service, or nil if it doesn't belong to a tenant.
+func (s *tenantStore) ForService(service string) (*Tenant, error) {
+	if s == nil {
+		return nil, nil
+	}
+	_, byService, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	return byService[service], nil
+}
+
+func (s *tenantStore) day() int64 {
+	return s.now().Unix() / 86400 * 86400
+}
+
+// reservePushes counts n pushes to service against the daily quota of its tenant, if it has one.
+// Returns errTenantQuotaExceeded (without counting them) if they would exceed it.
+func (s *tenantStore) reservePushes(service string, n int64) error {
+	t, err := s.ForService(service)
+	if err != nil || t == nil || t.MaxPushesPerDay <= 0 {
+		return err
+	}
+	total, err := s.db.IncrTenantPushes(t.ID, s.day(), n, tenantPushesTTL)
+	if err != nil {
+		return err
+	}
+	if total > t.MaxPushesPerDay {
+		if _, err := s.db.IncrTenantPushes(t.ID, s.day(), -n, tenantPushesTTL); err != nil {
+			s.logger.Errorf("Tenant=%v Cannot uncount %d rejected pushes: %v", t.ID, n, err)
+		}
+		return errTenantQuotaExceeded
+	}
+	return nil
+}
+
+// pushQuotaExhausted returns errTenantQuotaExceeded if the tenant of service already sent its daily pushes, so that it can't start broadcasts.
+func (s *tenantStore) pushQuotaExhausted(service string) error {
+	t, err := s.ForService(service)
+	if err != nil || t == nil || t.MaxPushesPerDay <= 0 {
+		return err
+	}
+	total, err := s.db.IncrTenantPushes(t.ID, s.day(), 0, tenantPushesTTL)
+	if err != nil {
+		return err
+	}
+	if total >= t.MaxPushesPerDay {
+		return errTenantQuotaExceeded
+	}
+	return nil
+}
+
+// countPushes counts n pushes to service against the daily quota of its tenant without enforcing it, for broadcasts which already started.
+func (s *tenantStore) countPushes(service string, n int64) {
+	t, err := s.ForService(service)
+	if err == nil && t != nil && t.MaxPushesPerDay > 0 {
+		_, err = s.db.IncrTenantPushes(t.ID, s.day(), n, tenantPushesTTL)
+	}
+	if err != nil {
+		s.logger.Errorf("Service=%v Cannot count %d pushes of the tenant: %v", service, n, err)
+	}
+}
+
+// addSubscriber counts a subscriber of service against the quota of its tenant. Returns errTenantQuotaExceeded if the tenant has too many subscribers.
+func (s *tenantStore) addSubscriber(service, subscriber string) error {
+	t, err := s.ForService(service)
+	if err != nil || t == nil {
+		return err
+	}
+	added, err := s.db.AddTenantSubscriber(t.ID, service+":"+subscriber, t.MaxSubscribers)
+	if err != nil {
+		return err
+	}
+	if !added {
+		return errTenantQuotaExceeded
+	}
+	return nil
+}
+
+// removeSubscriber stops counting a subscriber of service against the quota of its tenant, if it has no delivery points left.
+func (s *tenantStore) removeSubscriber(service, subscriber string) {
+	t, err := s.ForService(service)
+	if err != nil || t == nil {
+		return
+	}
+	pairs, err := s.db.GetPushServiceProviderDeliveryPointPairs(service, subscriber, nil)
+	if err == nil && len(pairs) == 0 {
+		err = s.db.RemoveTenantSubscriber(t.ID, service+":"+subscriber)
+	}
+	if err != nil {
+		s.logger.Errorf("Service=%v Subscriber=%v Cannot uncount the subscriber of the tenant: %v", service, subscriber, err)
+	}
+}
+
+// List returns every tenant and its usage, by id.
+func (s *tenantStore) List() ([]TenantUsage, error) {
+	records, err := s.db.GetTenants()
+	if err != nil {
+		return nil, err
+	}
+	tenants := make([]TenantUsage, 0, len(records))
+	for id, b := range records {
+		var usage TenantUsage
+		if err := json.Unmarshal(b, &usage.Tenant); err != nil {
+			s.logger.Errorf("Tenant=%v Ignoring invalid tenant: %v", id, err)
+			continue
+		}
+		if usage.Subscribers, err = s.db.CountTenantSubscribers(id); err != nil {
+			return nil, err
+		}
+		if usage.PushesToday, err = s.db.IncrTenantPushes(id, s.day(), 0, tenantPushesTTL); err != nil {
+			return nil, err
+		}
+		usage.QueuedPushes, usage.Connections = s.limits.usage(id)
+		tenants = append(tenants, usage)
+	}
+	sort.Slice(tenants, func(i, j int) bool { return tenants[i].ID < tenants[j].ID })
+	return tenants, nil
+}
+
+// Set creates or replaces a tenant. A service can only belong to one tenant.
+func (s *tenantStore) Set(t Tenant, record AuditRecord) error {
+	err := s.set(t)
+	record.Action = AuditSetTenant
+	record.Changes = map[string]AuditChange{
+		"id":               {New: t.ID},
+		"services":         {New: strings.Join(t.Services, ",")},
+		"maxSubscribers":   {New: strconv.FormatInt(t.MaxSubscribers, 10)},
+		"maxPushesPerDay":  {New: strconv.FormatInt(t.MaxPushesPerDay, 10)},
+		"maxQueuedPushes":  {New: strconv.FormatInt(t.MaxQueuedPushes, 10)},
+		"maxConnections":   {New: strconv.FormatInt(t.MaxConnections, 10)},
+		"maxBroadcastSize": {New: strconv.FormatInt(t.MaxBroadcastSize, 10)},
+	}
+	s.addAuditRecord(record, err)
+	return err
+}
+
+func (s *tenantStore) set(t Tenant) error {
+	if !validServicePattern.MatchString(t.ID) {
+		return fmt.Errorf("invalid tenant id %q", t.ID)
+	}
+	if t.MaxSubscribers < 0 || t.MaxPushesPerDay < 0 || t.MaxQueuedPushes < 0 || t.MaxConnections < 0 || t.MaxBroadcastSize < 0 {
+		return fmt.Errorf("Quotas and limits must not be negative")
+	}
+	s.invalidate()
+	_, byService, err := s.load()
+	if err != nil {
+		return err
+	}
+	for _, service := range t.Services {
+		if err := validateService(service); err != nil {
+			return err
+		}
+		if owner, ok := byService[service]; ok && owner.ID != t.ID {
+			return fmt.Errorf("Service %q already belongs to tenant %q", service, owner.ID)
+		}
+	}
+	b, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	if err := s.db.SetTenant(t.ID, b); err != nil {
+		return err
+	}
+	s.invalidate()
+	if err := s.db.SetTenantServices(t.ID, t.Services); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Remove removes a tenant. Its services remain, but can only be used by keys which don't belong to a tenant.
+// If shred is true, the data key of the tenant is deleted first ("crypto-shredding"), so that the delivery points of its services
+// can no longer be read, and no delivery points can be saved for its services until they belong to another tenant.
+func (s *tenantStore) Remove(id string, shred bool, record AuditRecord) error {
+	t, err := s.Get(id)
+	if err == nil && t == nil {
+		err = fmt.Errorf("Unknown tenant %q", id)
+	}
+	if err == nil {
+		if shred {
+			err = s.db.ShredTenantDataKey(id)
+		} else {
+			err = s.db.SetTenantServices(id, nil)
+		}
+	}
+	if err == nil {
+		err = s.db.RemoveTenant(id)
+		s.invalidate()
+	}
+	record.Action = AuditRemoveTenant
+	record.Changes = map[string]AuditChange{"id": {Old: id}}
+	if shred {
+		record.Changes["shred"] = AuditChange{New: "true"}
+		if err == nil {
+			s.logger.Infof("Tenant=%v Shredded the data key of the tenant", id)
+		}
+	}
+	s.addAuditRecord(record, err)
+	return err
+}
+
+func (s *tenantStore) addAuditRecord(record AuditRecord, err error) {
+	record.Code = UNIQUSH_SUCCESS
+	if err != nil {
+		record.Code = UNIQUSH_ERROR_GENERIC
+		record.ErrorMsg = err.Error()
+	}
+	s.audit.add(record)
+}
+
+// serveTenants handles the endpoints managing tenants, for the API and the admin listener.
+func serveTenants(w http.ResponseWriter, r *http.Request, s *tenantStore, remoteAddr string) {
+	type responseType struct {
+		Tenants      []TenantUsage `json:"tenants"`
+		ErrorMessage *string       `json:"errorMsg,omitempty"`
+		Code         string        `json:"code"`
+	}
+	r.ParseForm()
+	record := AuditRecord{From: remoteAddr, APIKey: auditAPIKey(r)}
+	resp := responseType{Tenants: []TenantUsage{}}
+	var err error
+	switch {
+	case s == nil:
+		err = fmt.Errorf("Tenants are not configured")
+	case r.URL.Path == QueryTenantsURL:
+		resp.Tenants, err = s.List()
+	case r.URL.Path == SetTenantURL:
+		t := Tenant{ID: r.Form.Get("id")}
+		for _, service := range strings.Split(r.Form.Get("services"), ",") {
+			if service = strings.TrimSpace(service); service != "" {
+				t.Services = append(t.Services, service)
+			}
+		}
+		for param, quota := range map[string]*int64{
+			"max_subscribers":    &t.MaxSubscribers,
+			"max_pushes_per_day": &t.MaxPushesPerDay,
+			"max_queued_pushes":  &t.MaxQueuedPushes,
+			"max_connections":    &t.MaxConnections,
+			"max_broadcast_size": &t.MaxBroadcastSize,
+		} {
+			if value := r.Form.Get(param); value != "" && err == nil {
+				if *quota, err = strconv.ParseInt(value, 10, 64); err != nil {
+					err = fmt.Errorf("Invalid %s %q", param, value)
+				}
+			}
+		}
+		if err == nil {
+			err = s.Set(t, record)
+		}
+		if err == nil {
+			resp.Tenants = append(resp.Tenants, TenantUsage{Tenant: t})
+		}
+	case r.URL.Path == RemoveTenantURL:
+		err = s.Remove(r.Form.Get("id"), r.Form.Get("shred") == "1", record)
+	}
+	if err != nil {
+		errorMsg := redactedError(err)
+		if s != nil {
+			s.logger.Errorf("From=%v URL=%v %v", remoteAddr, r.URL.Path, err)
+		}
+		resp.Code = UNIQUSH_ERROR_GENERIC
+		resp.ErrorMessage = &errorMsg
+	} else {
+		resp.Code = UNIQUSH_SUCCESS
+		if r.URL.Path != QueryTenantsURL {
+			s.logger.Infof("From=%v URL=%v Tenant=%v", remoteAddr, r.URL.Path, r.Form.Get("id"))
+		}
+	}
+	b, err := json.Marshal(resp)
+	if err != nil {
+		b = []byte("Failed to serialize response")
+	}
+	fmt.Fprintf(w, "%s\r\n", b)
+}
+
+// reservePushes counts the pushes of a /push request against the daily quota of the tenant of its service.
+// Each subscriber parameter counts as one push, even if it is a pattern matching several subscribers.
+func (api *RestAPI) reservePushes(kv map[string]string) error {
+	subs, err := getSubscribersFromMap(kv, false)
+	if err != nil {
+		// pushNotification responds with the error.
+		return nil
+	}
+	return api.backend.tenants.reservePushes(kv["service"], int64(len(subs)))
+}
+
+// authorizeTenant checks that a request with an API key of tenantID only uses the tenant's services.
+// If the services parameter of /subscriptions is empty, it is set to the services of the tenant.
+// It returns http.StatusOK, or the status and the reason to reject the request with.
+func (api *RestAPI) authorizeTenant(r *http.Request, tenantID string) (int, error) {
+	t, err := api.backend.tenants.Get(tenantID)
+	if err != nil {
+		api.loggers[LoggerWeb].Errorf("URL=%v Tenant=%v Cannot load the tenant: %v", r.URL.Path, tenantID, err)
+		return http.StatusServiceUnavailable, fmt.Errorf("Cannot load the tenant")
+	}
+	if t == nil {
+		return http.StatusForbidden, fmt.Errorf("Unknown tenant %q", tenantID)
+	}
+	param, ok := tenantEndpoints[r.URL.Path]
+	if !ok {
+		return http.StatusForbidden, fmt.Errorf("%s can't be used by the API keys of tenants", r.URL.Path)
+	}
+	r.ParseForm()
+	var services []string
+	switch param {
+	case tenantParamService:
+		services = []string{r.Form.Get("service")}
+	case tenantParamServices:
+		if r.Form.Get("services") == "" {
+			r.Form.Set("services", strings.Join(t.Services, ","))
+		}
+		services = strings.Split(r.Form.Get("services"), ",")
+	case tenantParamBroadcast:
+		b, err := api.backend.broadcasts.Get(r.Form.Get("id"))
+		if err != nil {
+			return http.StatusServiceUnavailable, fmt.Errorf("Cannot load the broadcast")
+		}
+		if b == nil {
+			return http.StatusForbidden, fmt.Errorf("Must specify the id of a broadcast of the tenant")
+		}
+		services = []string{b.Service}
+	}
+	for _, service := range services {
+		if !t.owns(service) {
+			return http.StatusForbidden, fmt.Errorf("Service %q doesn't belong to tenant %q", service, tenantID)
+		}
+	}
+	return http.StatusOK, nil
+}
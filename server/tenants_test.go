@@ -0,0 +1,224 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/uniqush/log"
+	"github.com/uniqush/uniqush-push/db"
+	"github.com/uniqush/uniqush-push/testutil"
+)
+
+// tenantDatabase keeps tenants, their usage and the audit log in memory. Subscribers have no delivery points. Other methods aren't implemented.
+type tenantDatabase struct {
+	auditDatabase
+	tenants     map[string][]byte
+	pushes      map[string]int64
+	subscribers map[string]map[string]bool
+	// dataKeys are the services encrypted with the data key of each tenant.
+	dataKeys map[string][]string
+}
+
+func newTenantDatabase() *tenantDatabase {
+	return &tenantDatabase{tenants: make(map[string][]byte), pushes: make(map[string]int64), subscribers: make(map[string]map[string]bool), dataKeys: make(map[string][]string)}
+}
+
+func (d *tenantDatabase) SetTenant(id string, tenant []byte) error {
+	d.tenants[id] = tenant
+	return nil
+}
+
+func (d *tenantDatabase) RemoveTenant(id string) error {
+	delete(d.tenants, id)
+	delete(d.subscribers, id)
+	return nil
+}
+
+func (d *tenantDatabase) SetTenantServices(tenant string, services []string) error {
+	if len(services) > 0 {
+		d.dataKeys[tenant] = services
+	}
+	return nil
+}
+
+func (d *tenantDatabase) ShredTenantDataKey(tenant string) error {
+	if _, ok := d.dataKeys[tenant]; !ok {
+		return fmt.Errorf("the tenant has no data key")
+	}
+	delete(d.dataKeys, tenant)
+	return nil
+}
+
+func (d *tenantDatabase) GetTenants() (map[string][]byte, error) {
+	return d.tenants, nil
+}
+
+func (d *tenantDatabase) IncrTenantPushes(tenant string, day int64, n int64, ttl time.Duration) (int64, error) {
+	d.pushes[tenant] += n
+	return d.pushes[tenant], nil
+}
+
+func (d *tenantDatabase) AddTenantSubscriber(tenant, subscriber string, max int64) (bool, error) {
+	if d.subscribers[tenant] == nil {
+		d.subscribers[tenant] = make(map[string]bool)
+	}
+	if !d.subscribers[tenant][subscriber] && max > 0 && int64(len(d.subscribers[tenant])) >= max {
+		return false, nil
+	}
+	d.subscribers[tenant][subscriber] = true
+	return true, nil
+}
+
+func (d *tenantDatabase) RemoveTenantSubscriber(tenant, subscriber string) error {
+	delete(d.subscribers[tenant], subscriber)
+	return nil
+}
+
+func (d *tenantDatabase) CountTenantSubscribers(tenant string) (int64, error) {
+	return int64(len(d.subscribers[tenant])), nil
+}
+
+func (d *tenantDatabase) GetPushServiceProviderDeliveryPointPairs(service string, subscriber string, dpNamesRequested []string) ([]db.PushServiceProviderDeliveryPointPair, error) {
+	return nil, nil
+}
+
+func newTestTenantStore() (*tenantStore, *tenantDatabase) {
+	database := newTenantDatabase()
+	logger := log.NewLogger(ioutil.Discard, "", log.LOGLEVEL_SILENT)
+	return newTenantStore(database, time.Minute, newAuditLog(database, AuditConfig{MaxRecords: 10}, logger), logger), database
+}
+
+func TestSetTenant(t *testing.T) {
+	s, database := newTestTenantStore()
+	if err := s.Set(Tenant{ID: "payments", Services: []string{"checkout", "wallet"}, MaxSubscribers: 10}, AuditRecord{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set(Tenant{ID: "growth", Services: []string{"wallet"}}, AuditRecord{}); err == nil {
+		t.Error("expected a service not to belong to two tenants")
+	}
+	if err := s.Set(Tenant{ID: "growth", MaxPushesPerDay: -1}, AuditRecord{}); err == nil {
+		t.Error("expected negative quotas to be rejected")
+	}
+	testutil.ExpectEquals(t, 3, len(database.records), "expected every change to be audited")
+
+	owner, err := s.ForService("wallet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectStringEquals(t, "payments", owner.ID, "expected the tenant of the service")
+	if owner, _ := s.ForService("news"); owner != nil {
+		t.Errorf("expected services without a tenant to have no owner, got %v", owner)
+	}
+
+	// Moving a service to another tenant is allowed once its previous tenant no longer owns it.
+	if err := s.Set(Tenant{ID: "payments", Services: []string{"checkout"}}, AuditRecord{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set(Tenant{ID: "growth", Services: []string{"wallet"}}, AuditRecord{}); err != nil {
+		t.Fatal(err)
+	}
+	tenants, err := s.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectEquals(t, 2, len(tenants), "expected both tenants")
+	testutil.ExpectStringEquals(t, "growth", tenants[0].ID, "expected tenants to be sorted by id")
+
+	if err := s.Remove("growth", false, AuditRecord{}); err != nil {
+		t.Fatal(err)
+	}
+	if owner, _ := s.ForService("wallet"); owner != nil {
+		t.Errorf("expected the services of removed tenants to have no owner, got %v", owner)
+	}
+	if err := s.Remove("growth", false, AuditRecord{}); err == nil {
+		t.Error("expected removing an unknown tenant to fail")
+	}
+}
+
+func TestShredTenant(t *testing.T) {
+	s, database := newTestTenantStore()
+	if err := s.Set(Tenant{ID: "payments", Services: []string{"checkout"}}, AuditRecord{}); err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectEquals(t, []string{"checkout"}, database.dataKeys["payments"], "expected the services of the tenant to be encrypted with its data key")
+	if err := s.Remove("payments", true, AuditRecord{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := database.dataKeys["payments"]; ok {
+		t.Error("expected the data key of the tenant to be shredded")
+	}
+	testutil.ExpectEquals(t, 0, len(database.tenants), "expected the tenant to be removed")
+	var record AuditRecord
+	if err := json.Unmarshal(database.records[0], &record); err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectStringEquals(t, "true", record.Changes["shred"].New, "expected shredding to be audited")
+
+	// The tenant isn't removed if its data key can't be shredded.
+	if err := s.Set(Tenant{ID: "growth"}, AuditRecord{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Remove("growth", true, AuditRecord{}); err == nil {
+		t.Error("expected tenants without a data key not to be shredded")
+	}
+	testutil.ExpectEquals(t, 1, len(database.tenants), "expected the tenant to be kept")
+}
+
+func TestTenantQuotas(t *testing.T) {
+	s, database := newTestTenantStore()
+	if err := s.Set(Tenant{ID: "payments", Services: []string{"checkout"}, MaxSubscribers: 2, MaxPushesPerDay: 10}, AuditRecord{}); err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectEquals(t, nil, s.reservePushes("checkout", 8), "expected pushes within the quota to be allowed")
+	testutil.ExpectEquals(t, errTenantQuotaExceeded, s.reservePushes("checkout", 3), "expected pushes exceeding the quota to be rejected")
+	testutil.ExpectEquals(t, int64(8), database.pushes["payments"], "expected rejected pushes not to be counted")
+	testutil.ExpectEquals(t, nil, s.pushQuotaExhausted("checkout"), "expected broadcasts to be allowed while pushes remain")
+	s.countPushes("checkout", 5)
+	testutil.ExpectEquals(t, errTenantQuotaExceeded, s.pushQuotaExhausted("checkout"), "expected broadcasts to be rejected once the quota is used")
+	testutil.ExpectEquals(t, nil, s.reservePushes("news", 1000), "expected services without a tenant to be unlimited")
+
+	testutil.ExpectEquals(t, nil, s.addSubscriber("checkout", "alice"), "expected subscribers within the quota to be allowed")
+	testutil.ExpectEquals(t, nil, s.addSubscriber("checkout", "bob"), "expected subscribers within the quota to be allowed")
+	testutil.ExpectEquals(t, nil, s.addSubscriber("checkout", "alice"), "expected existing subscribers to be allowed")
+	testutil.ExpectEquals(t, errTenantQuotaExceeded, s.addSubscriber("checkout", "carol"), "expected subscribers exceeding the quota to be rejected")
+	s.removeSubscriber("checkout", "bob")
+	testutil.ExpectEquals(t, nil, s.addSubscriber("checkout", "carol"), "expected removed subscribers not to be counted")
+
+	var disabled *tenantStore
+	testutil.ExpectEquals(t, nil, disabled.reservePushes("checkout", 1000), "expected no quotas without a store")
+	testutil.ExpectEquals(t, nil, disabled.addSubscriber("checkout", "dave"), "expected no quotas without a store")
+}
+
+func TestAuthorizeTenant(t *testing.T) {
+	s, _ := newTestTenantStore()
+	if err := s.Set(Tenant{ID: "payments", Services: []string{"checkout", "wallet"}}, AuditRecord{}); err != nil {
+		t.Fatal(err)
+	}
+	api := newHealthTestAPI(nil)
+	api.backend.tenants = s
+	authorize := func(method, target, tenant string) (int, *http.Request) {
+		r := httptest.NewRequest(method, target, nil)
+		status, _ := api.authorizeTenant(r, tenant)
+		return status, r
+	}
+
+	status, _ := authorize("POST", "/push?service=checkout&subscriber=alice", "payments")
+	testutil.ExpectEquals(t, http.StatusOK, status, "expected tenants to push to their services")
+	status, _ = authorize("POST", "/push?service=news&subscriber=alice", "payments")
+	testutil.ExpectEquals(t, http.StatusForbidden, status, "expected tenants not to push to other services")
+	status, _ = authorize("GET", "/psps", "payments")
+	testutil.ExpectEquals(t, http.StatusForbidden, status, "expected tenants not to use global endpoints")
+	status, _ = authorize("GET", "/nrdp?service=checkout&subscriber=alice", "growth")
+	testutil.ExpectEquals(t, http.StatusForbidden, status, "expected the keys of unknown tenants to be rejected")
+
+	status, r := authorize("GET", "/subscriptions?subscriber=alice", "payments")
+	testutil.ExpectEquals(t, http.StatusOK, status, "expected tenants to query subscriptions")
+	testutil.ExpectStringEquals(t, "checkout,wallet", r.Form.Get("services"), "expected subscriptions to be limited to the services of the tenant")
+	status, _ = authorize("GET", "/subscriptions?subscriber=alice&services=checkout,news", "payments")
+	testutil.ExpectEquals(t, http.StatusForbidden, status, "expected tenants not to query the subscriptions of other services")
+}
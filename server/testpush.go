@@ -0,0 +1,130 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/uniqush/log"
+)
+
+// TestPushURL sends a test push to a delivery point (or to the canary subscriber), and responds with the result of each push service provider.
+const TestPushURL = "/testpush"
+
+// defaultTestPushMessage is the msg of test pushes which don't have a payload.
+const defaultTestPushMessage = "uniqush-push test push"
+
+// testPushResponseHandler collects the result of the push to each delivery point of a test push.
+type testPushResponseHandler struct {
+	mutex   sync.Mutex
+	results []APIResponseDetails
+}
+
+var _ APIResponseHandler = &testPushResponseHandler{}
+
+func (h *testPushResponseHandler) AddDetailsToHandler(v APIResponseDetails) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.results = append(h.results, v)
+}
+
+func (h *testPushResponseHandler) ToJSON() []byte {
+	return nil
+}
+
+// testPush sends a push to the subscriber of a service (the [Canary] subscriber by default), optionally only to the delivery points in delivery_point_id,
+// so that operators can check that a push service provider works right after adding it.
+// The push is sent once (without retries), even in maintenance mode. The response has the message id assigned by the push service,
+// or the error it returned, for each delivery point. The payload is msg=uniqush-push test push, unless the request has payload parameters like /push.
+func (api *RestAPI) testPush(ctx context.Context, kv map[string]string, logger log.Logger, remoteAddr string) []byte {
+	type responseType struct {
+		RequestID  string               `json:"requestId"`
+		Service    string               `json:"service"`
+		Subscriber string               `json:"subscriber"`
+		Results    []APIResponseDetails `json:"results"`
+		// Duration is how long the push took, in milliseconds.
+		Duration int64   `json:"duration"`
+		Code     string  `json:"code"`
+		ErrorMsg *string `json:"errorMsg,omitempty"`
+	}
+	reqID := randomUniqID()
+	r := responseType{RequestID: reqID, Results: []APIResponseDetails{}}
+	marshal := func() []byte {
+		json, err := json.Marshal(r)
+		if err != nil {
+			return []byte("Failed to serialize response")
+		}
+		return json
+	}
+
+	service, err := getServiceFromMap(kv)
+	if err == nil {
+		err = validateService(service)
+	}
+	r.Service = service
+	if err != nil {
+		r.Code, r.ErrorMsg = UNIQUSH_ERROR_CANNOT_GET_SERVICE, strPtrOfErr(err)
+		return marshal()
+	}
+	subscriber := kv["subscriber"]
+	if subscriber == "" {
+		subscriber = defaultCanarySubscriber
+		if api.backend.canary != nil {
+			subscriber = api.backend.canary.conf.Subscriber
+		}
+	}
+	r.Subscriber = subscriber
+	if err := validateSubscribers([]string{subscriber}); err != nil {
+		r.Code, r.ErrorMsg = UNIQUSH_ERROR_CANNOT_GET_SUBSCRIBER, strPtrOfErr(err)
+		return marshal()
+	}
+	dpIds, err := getDeliveryPointIdsFromMap(kv)
+	if err != nil {
+		r.Code, r.ErrorMsg = UNIQUSH_ERROR_CANNOT_GET_DELIVERY_POINT_ID, strPtrOfErr(err)
+		return marshal()
+	}
+	delete(kv, "delivery_point_id")
+	if kv["msg"] == "" {
+		kv["msg"] = defaultTestPushMessage
+	}
+	notif, details, err := api.buildNotificationFromKV(reqID, kv, logger, remoteAddr, service, []string{subscriber})
+	if err != nil {
+		r.Code, r.ErrorMsg = details.Code, details.ErrorMsg
+		return marshal()
+	}
+
+	logger.Infof("RequestID=%v From=%v Service=%v Subscriber=%v DeliveryPoints=%q Test push", reqID, remoteAddr, service, subscriber, dpIds)
+	handler := &testPushResponseHandler{}
+	start := time.Now()
+	api.backend.Push(ctx, reqID, remoteAddr, service, []string{subscriber}, dpIds, notif, nil, &RetryPolicy{MaxAttempts: 1}, logger, handler)
+	r.Duration = int64(time.Since(start) / time.Millisecond)
+	r.Code = UNIQUSH_SUCCESS
+	for _, result := range handler.results {
+		// Updates of delivery points are reported along with the result of the push.
+		if result.ModifiedDp {
+			continue
+		}
+		r.Results = append(r.Results, result)
+		if r.Code == UNIQUSH_SUCCESS && result.Code != UNIQUSH_SUCCESS {
+			r.Code, r.ErrorMsg = result.Code, result.ErrorMsg
+		}
+	}
+	return marshal()
+}
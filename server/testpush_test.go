@@ -0,0 +1,46 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/uniqush/uniqush-push/testutil"
+)
+
+func serveTestPush(api *RestAPI, params url.Values) map[string]interface{} {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", TestPushURL, strings.NewReader(params.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	api.ServeHTTP(w, r)
+	var body map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &body)
+	return body
+}
+
+func TestTestPushValidation(t *testing.T) {
+	api := newHealthTestAPI(&pingDatabase{})
+	api.waitGroup = new(sync.WaitGroup)
+	body := serveTestPush(api, url.Values{})
+	testutil.ExpectStringEquals(t, UNIQUSH_ERROR_CANNOT_GET_SERVICE, body["code"].(string), "expected the service to be required")
+
+	body = serveTestPush(api, url.Values{"service": {"myservice"}, "subscriber": {"bad subscriber"}})
+	testutil.ExpectStringEquals(t, UNIQUSH_ERROR_CANNOT_GET_SUBSCRIBER, body["code"].(string), "expected the subscriber to be validated")
+	testutil.ExpectStringEquals(t, "bad subscriber", body["subscriber"].(string), "expected the subscriber in the response")
+
+	body = serveTestPush(api, url.Values{"service": {"myservice"}, "delivery_point_id": {","}})
+	testutil.ExpectStringEquals(t, defaultCanarySubscriber, body["subscriber"].(string), "expected the canary subscriber by default")
+	testutil.ExpectStringEquals(t, UNIQUSH_ERROR_CANNOT_GET_DELIVERY_POINT_ID, body["code"].(string), "expected the delivery points to be validated")
+}
+
+func TestTestPushResponseHandler(t *testing.T) {
+	h := &testPushResponseHandler{}
+	dp, messageID := "fcm:1", "m1"
+	h.AddDetailsToHandler(APIResponseDetails{DeliveryPoint: &dp, Code: UNIQUSH_SUCCESS, ModifiedDp: true})
+	h.AddDetailsToHandler(APIResponseDetails{DeliveryPoint: &dp, Code: UNIQUSH_SUCCESS, MessageID: &messageID})
+	testutil.ExpectEquals(t, 2, len(h.results), "expected every result to be collected")
+	testutil.ExpectEquals(t, []byte(nil), h.ToJSON(), "expected /testpush to write its own response")
+}
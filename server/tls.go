@@ -0,0 +1,302 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/uniqush/log"
+)
+
+const defaultTLSReloadInterval = 10 * time.Second
+
+// tlsVersions are the accepted values of tls_min_version.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// TLSConfig is a representation of the TLS settings in the [WebFrontend] and [Admin] sections of uniqush.conf.
+type TLSConfig struct {
+	// CertFile and KeyFile are the paths of the PEM encoded certificate (with its chain) and private key. TLS is disabled if they are "".
+	CertFile string
+	KeyFile  string
+	// MinVersion is the oldest accepted version of TLS, e.g. tls.VersionTLS12.
+	MinVersion uint16
+	// CipherSuites are the accepted cipher suites of TLS 1.2 and older. The defaults of Go are used if there are none. TLS 1.3 suites aren't configurable.
+	CipherSuites []uint16
+	// ReloadInterval is how often the certificate and key files are checked for changes.
+	ReloadInterval time.Duration
+	// ClientCAFile is the path of the PEM encoded certificates of the CAs which sign client certificates. Client certificates aren't requested if it is "".
+	ClientCAFile string
+	// ClientAuth is tls.RequireAndVerifyClientCert if every client must have a certificate, or tls.VerifyClientCertIfGiven.
+	ClientAuth tls.ClientAuthType
+	// ClientScopes are the scopes of API keys granted to the client certificates with each subject alternative name, see clientCertIdentities.
+	ClientScopes map[string][]string
+}
+
+// Enabled returns true if the API is served over TLS.
+func (c TLSConfig) Enabled() bool {
+	return c.CertFile != ""
+}
+
+// parseCipherSuites parses a comma separated list of the names of cipher suites (e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256).
+// Insecure suites aren't accepted.
+func parseCipherSuites(s string) ([]uint16, error) {
+	ids := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		ids[suite.Name] = suite.ID
+	}
+	var suites []uint16
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		id, ok := ids[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure cipher suite %q", name)
+		}
+		suites = append(suites, id)
+	}
+	return suites, nil
+}
+
+// certReloader serves the certificate from CertFile and KeyFile, and loads them again when either changes,
+// so that renewed certificates are used without restarting uniqush-push.
+type certReloader struct {
+	conf    TLSConfig
+	logger  log.Logger
+	mutex   sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+// newCertReloader loads the certificate, returning an error if it can't be loaded.
+func newCertReloader(conf TLSConfig, logger log.Logger) (*certReloader, error) {
+	r := &certReloader{conf: conf, logger: logger}
+	if _, err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// lastModified returns the latest modification time of the certificate and key files.
+func (r *certReloader) lastModified() (time.Time, error) {
+	var latest time.Time
+	for _, path := range []string{r.conf.CertFile, r.conf.KeyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return latest, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// reload loads the certificate if the files changed since it was last loaded. Returns true if it was loaded.
+// If the new files can't be loaded (e.g. only one of them was replaced yet), the previous certificate is kept.
+func (r *certReloader) reload() (bool, error) {
+	modTime, err := r.lastModified()
+	if err != nil {
+		return false, err
+	}
+	r.mutex.RLock()
+	unchanged := r.cert != nil && modTime.Equal(r.modTime)
+	r.mutex.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+	cert, err := tls.LoadX509KeyPair(r.conf.CertFile, r.conf.KeyFile)
+	if err != nil {
+		return false, fmt.Errorf("cannot load the TLS certificate %s and key %s: %v", r.conf.CertFile, r.conf.KeyFile, err)
+	}
+	r.mutex.Lock()
+	r.cert = &cert
+	r.modTime = modTime
+	r.mutex.Unlock()
+	return true, nil
+}
+
+// run checks for changes to the certificate every ReloadInterval.
+func (r *certReloader) run() {
+	for range time.Tick(r.conf.ReloadInterval) {
+		reloaded, err := r.reload()
+		if err != nil {
+			r.logger.Errorf("[TLS] Keeping the previous certificate: %v", err)
+		} else if reloaded {
+			r.logger.Infof("[TLS] Reloaded the certificate %s", r.conf.CertFile)
+		}
+	}
+}
+
+// GetCertificate returns the current certificate, for tls.Config.
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.cert, nil
+}
+
+// newServerTLSConfig returns the TLS configuration of a listener, whose certificate is reloaded when it changes, or nil if TLS is disabled.
+// If ClientCAFile is set, client certificates are verified with its CAs.
+func newServerTLSConfig(conf TLSConfig, logger log.Logger) (*tls.Config, error) {
+	if !conf.Enabled() {
+		return nil, nil
+	}
+	reloader, err := newCertReloader(conf, logger)
+	if err != nil {
+		return nil, err
+	}
+	go reloader.run()
+	config := &tls.Config{
+		MinVersion:     conf.MinVersion,
+		CipherSuites:   conf.CipherSuites,
+		GetCertificate: reloader.GetCertificate,
+	}
+	if conf.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(conf.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate in %s", conf.ClientCAFile)
+		}
+		config.ClientAuth = conf.ClientAuth
+	}
+	return config, nil
+}
+
+// parseClientScopes parses a comma separated list of "<subject alternative name>=<scope>+<scope>..."
+// (e.g. "spiffe://example.org/app=push+subscribe,*.ops.example.org=admin").
+func parseClientScopes(s string) (map[string][]string, error) {
+	clientScopes := make(map[string][]string)
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		i := strings.LastIndexByte(entry, '=')
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid entry %q: must be <subject alternative name>=<scope>+<scope>", entry)
+		}
+		scopes, err := parseAPIKeyScopes(strings.Replace(entry[i+1:], "+", ",", -1))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", entry[:i], err)
+		}
+		clientScopes[entry[:i]] = scopes
+	}
+	return clientScopes, nil
+}
+
+// clientCertIdentities authorizes the requests of clients with a verified certificate with the scopes of the subject alternative names (SANs)
+// of the certificate, instead of an API key, for internal callers on zero-trust networks. SANs are URIs (e.g. SPIFFE ids), DNS names, email addresses or IPs.
+// Patterns match SANs exactly, except for "*." followed by a domain, which matches the DNS names one level below the domain.
+type clientCertIdentities struct {
+	scopes map[string][]string
+}
+
+// newClientCertIdentities returns nil if no SAN is mapped to scopes.
+func newClientCertIdentities(conf TLSConfig) *clientCertIdentities {
+	if len(conf.ClientScopes) == 0 {
+		return nil
+	}
+	return &clientCertIdentities{scopes: conf.ClientScopes}
+}
+
+// matchSAN returns true if a subject alternative name matches a pattern of ClientScopes.
+func matchSAN(pattern, name string) bool {
+	if strings.HasPrefix(pattern, "*.") {
+		prefix := strings.TrimSuffix(name, pattern[1:])
+		return prefix != name && prefix != "" && !strings.Contains(prefix, ".")
+	}
+	return pattern == name
+}
+
+// certificateSANs returns the subject alternative names of a certificate.
+func certificateSANs(cert *x509.Certificate) []string {
+	var names []string
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+	names = append(names, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+	return names
+}
+
+// identify returns a key with the scopes of every SAN of the verified client certificate of r, identified by "cert:" and the first matching SAN,
+// or nil if r has no such certificate or none of its SANs are mapped to scopes.
+func (c *clientCertIdentities) identify(r *http.Request) *APIKey {
+	if c == nil || r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	var key *APIKey
+	seen := make(map[string]bool)
+	for _, name := range certificateSANs(r.TLS.VerifiedChains[0][0]) {
+		for pattern, scopes := range c.scopes {
+			if !matchSAN(pattern, name) {
+				continue
+			}
+			if key == nil {
+				key = &APIKey{ID: "cert:" + name, Name: name}
+			}
+			for _, scope := range scopes {
+				if !seen[scope] {
+					seen[scope] = true
+					key.Scopes = append(key.Scopes, scope)
+				}
+			}
+		}
+	}
+	if key != nil {
+		sort.Strings(key.Scopes)
+	}
+	return key
+}
+
+// adminCredential returns the credential of the verified client certificate of r, with the highest role (viewer, operator or admin) among the scopes of its SANs,
+// for the admin listener. The role is "" if r has no such certificate or none of its SANs are mapped to roles.
+func (c *clientCertIdentities) adminCredential(r *http.Request) adminCredential {
+	key := c.identify(r)
+	if key == nil {
+		return adminCredential{}
+	}
+	cred := adminCredential{subject: key.ID, expires: r.TLS.VerifiedChains[0][0].NotAfter}
+	for _, scope := range key.Scopes {
+		if adminRoleRanks[scope] > adminRoleRanks[cred.role] {
+			cred.role = scope
+		}
+	}
+	return cred
+}
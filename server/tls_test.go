@@ -0,0 +1,164 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/uniqush/log"
+	"github.com/uniqush/uniqush-push/testutil"
+)
+
+// writeTestCertificate writes a self-signed certificate for commonName and its key to certFile and keyFile.
+func writeTestCertificate(t *testing.T, commonName, certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func commonNameOf(t *testing.T, r *certReloader) string {
+	cert, err := r.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed.Subject.CommonName
+}
+
+func TestCertReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "uniqush-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeTestCertificate(t, "first", certFile, keyFile)
+
+	logger := log.NewLogger(ioutil.Discard, "", log.LOGLEVEL_SILENT)
+	r, err := newCertReloader(TLSConfig{CertFile: certFile, KeyFile: keyFile}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectStringEquals(t, "first", commonNameOf(t, r), "expected the certificate to be loaded")
+	reloaded, err := r.reload()
+	testutil.ExpectEquals(t, false, reloaded, "expected unchanged files not to be loaded again")
+
+	// A certificate whose key doesn't match yet is rejected, and the previous one kept.
+	otherCert, otherKey := filepath.Join(dir, "other.pem"), filepath.Join(dir, "otherkey.pem")
+	writeTestCertificate(t, "second", otherCert, otherKey)
+	later := time.Now().Add(time.Minute)
+	certPEM, _ := ioutil.ReadFile(otherCert)
+	ioutil.WriteFile(certFile, certPEM, 0600)
+	os.Chtimes(certFile, later, later)
+	if _, err := r.reload(); err == nil {
+		t.Error("expected a certificate which doesn't match the key to be rejected")
+	}
+	testutil.ExpectStringEquals(t, "first", commonNameOf(t, r), "expected the previous certificate to be kept")
+
+	keyPEM, _ := ioutil.ReadFile(otherKey)
+	ioutil.WriteFile(keyFile, keyPEM, 0600)
+	os.Chtimes(keyFile, later, later)
+	if reloaded, err = r.reload(); err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectEquals(t, true, reloaded, "expected the renewed certificate to be loaded")
+	testutil.ExpectStringEquals(t, "second", commonNameOf(t, r), "expected the renewed certificate to be served")
+
+	if _, err := newCertReloader(TLSConfig{CertFile: filepath.Join(dir, "missing.pem"), KeyFile: keyFile}, logger); err == nil {
+		t.Error("expected missing certificates to be rejected at startup")
+	}
+}
+
+func TestParseCipherSuites(t *testing.T) {
+	suites, err := parseCipherSuites("TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectEquals(t, []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384}, suites, "expected the suites to be parsed in order")
+	if _, err := parseCipherSuites("TLS_RSA_WITH_RC4_128_SHA"); err == nil {
+		t.Error("expected insecure cipher suites to be rejected")
+	}
+}
+
+func TestParseClientScopes(t *testing.T) {
+	scopes, err := parseClientScopes("spiffe://example.org/app=push+subscribe, *.ops.example.org=admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectEquals(t, map[string][]string{"spiffe://example.org/app": {"push", "subscribe"}, "*.ops.example.org": {"admin"}}, scopes, "expected the scopes of each name")
+	for _, invalid := range []string{"app.example.org", "=push", "app.example.org=root"} {
+		if _, err := parseClientScopes(invalid); err == nil {
+			t.Errorf("expected %q to be invalid", invalid)
+		}
+	}
+}
+
+func TestMatchSAN(t *testing.T) {
+	testutil.ExpectEquals(t, true, matchSAN("app.example.org", "app.example.org"), "expected names to match exactly")
+	testutil.ExpectEquals(t, true, matchSAN("*.example.org", "app.example.org"), "expected wildcards to match one level")
+	testutil.ExpectEquals(t, false, matchSAN("*.example.org", "a.b.example.org"), "expected wildcards to match only one level")
+	testutil.ExpectEquals(t, false, matchSAN("*.example.org", "example.org"), "expected wildcards not to match the domain")
+	testutil.ExpectEquals(t, false, matchSAN("*.example.org", "appexample.org"), "expected wildcards to match labels")
+}
+
+func TestClientCertIdentities(t *testing.T) {
+	app, _ := url.Parse("spiffe://example.org/app")
+	cert := &x509.Certificate{URIs: []*url.URL{app}, DNSNames: []string{"app.ops.example.org"}}
+	identities := newClientCertIdentities(TLSConfig{ClientScopes: map[string][]string{
+		"spiffe://example.org/app": {"push"},
+		"*.ops.example.org":        {"subscribe", "push"},
+	}})
+	r := httptest.NewRequest("POST", PushNotificationURL, nil)
+	testutil.ExpectEquals(t, (*APIKey)(nil), identities.identify(r), "expected requests without a certificate not to be identified")
+	r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+	testutil.ExpectEquals(t, &APIKey{ID: "cert:spiffe://example.org/app", Name: "spiffe://example.org/app", Scopes: []string{"push", "subscribe"}}, identities.identify(r),
+		"expected the scopes of every name of the certificate")
+
+	api := newHealthTestAPI(nil)
+	api.backend.clientCerts = identities
+	_, status, _ := api.authorize(r)
+	testutil.ExpectEquals(t, http.StatusOK, status, "expected the certificate to be authorized to push")
+	r = httptest.NewRequest("POST", StopProgramURL, nil)
+	r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+	_, status, _ = api.authorize(r)
+	testutil.ExpectEquals(t, http.StatusForbidden, status, "expected the certificate not to be authorized for admin endpoints")
+
+	testutil.ExpectEquals(t, (*clientCertIdentities)(nil), newClientCertIdentities(TLSConfig{}), "expected identities to be disabled without scopes")
+}
@@ -0,0 +1,52 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"time"
+
+	"github.com/uniqush/log"
+	"github.com/uniqush/uniqush-push/tracing"
+)
+
+// TracingConfig is a representation of the settings in the [Tracing] section of uniqush.conf.
+type TracingConfig struct {
+	// Endpoint is the OTLP/HTTP traces endpoint of an OpenTelemetry collector, e.g. http://localhost:4318/v1/traces. Tracing is disabled if it is "".
+	Endpoint string
+	// SampleRatio is the fraction of pushes which are traced, unless the caller sent a traceparent header.
+	SampleRatio float64
+	// ServiceName is the service.name of the spans.
+	ServiceName string
+	// FlushInterval is how often spans are sent to the collector.
+	FlushInterval time.Duration
+}
+
+const (
+	defaultTracingSampleRatio   = 1.0
+	defaultTracingServiceName   = "uniqush-push"
+	defaultTracingFlushInterval = 5 * time.Second
+)
+
+// startTracing sends the spans of API requests, pushes, database lookups and sends to push services to conf.Endpoint.
+func startTracing(conf TracingConfig, logger log.Logger) {
+	logger.Infof("[Tracing] Endpoint=%v SampleRatio=%v", conf.Endpoint, conf.SampleRatio)
+	exporter := tracing.NewOTLPExporter(conf.Endpoint, conf.ServiceName, conf.FlushInterval, func(err error) {
+		logger.Errorf("Endpoint=%v Failed to export spans: %v", conf.Endpoint, err)
+	})
+	tracing.Configure(&redactingExporter{exporter: exporter, redactor: redaction}, conf.SampleRatio)
+}
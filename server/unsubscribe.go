@@ -0,0 +1,235 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/uniqush/log"
+	"github.com/uniqush/uniqush-push/db"
+)
+
+const (
+	defaultUnsubscribeConfirmTimeout = time.Hour
+	// stagedUnsubscribeCheckInterval is how often staged unsubscribes are checked for expired confirmation timeouts.
+	stagedUnsubscribeCheckInterval = time.Minute
+)
+
+// UnsubscribeConfig is a representation of the settings in the [Unsubscribe] section of uniqush.conf.
+type UnsubscribeConfig struct {
+	// Staged makes /unsubscribe stage unsubscribes, which are only committed by /confirmunsubscribe or after ConfirmTimeout.
+	Staged bool
+	// ConfirmTimeout is how long a staged unsubscribe waits for a confirmation or cancellation before it is committed.
+	ConfirmTimeout time.Duration
+}
+
+// StagedUnsubscribe is an unsubscribe which hasn't been committed yet. The delivery point keeps receiving pushes until then.
+type StagedUnsubscribe struct {
+	ID            string `json:"id"`
+	Service       string `json:"service"`
+	Subscriber    string `json:"subscriber"`
+	DeliveryPoint string `json:"deliveryPoint"`
+	From          string `json:"from"`
+	// Created is the unix timestamp of the /unsubscribe request.
+	Created int64 `json:"created"`
+	// Deadline is the unix timestamp after which the unsubscribe is committed if it wasn't confirmed or cancelled.
+	Deadline int64 `json:"deadline"`
+}
+
+// stagedUnsubscribeID is the id of the staged unsubscribe of a delivery point. There is at most one per service+subscriber+delivery point,
+// so that subscribing the delivery point again cancels it.
+func stagedUnsubscribeID(service, subscriber, dpName string) string {
+	return fmt.Sprintf("%s:%s:%s", service, subscriber, dpName)
+}
+
+// unsubscribeStager stages unsubscribes instead of removing delivery points right away,
+// to protect against buggy clients which mistakenly unsubscribe many delivery points (e.g. on app startup).
+type unsubscribeStager struct {
+	backend  *PushBackEnd
+	db       db.PushDatabase
+	conf     UnsubscribeConfig
+	logger   log.Logger
+	stopChan chan struct{}
+}
+
+func newUnsubscribeStager(backend *PushBackEnd, database db.PushDatabase, conf UnsubscribeConfig, logger log.Logger) *unsubscribeStager {
+	if !conf.Staged {
+		return nil
+	}
+	return &unsubscribeStager{
+		backend:  backend,
+		db:       database,
+		conf:     conf,
+		logger:   logger,
+		stopChan: make(chan struct{}),
+	}
+}
+
+// Stage saves an unsubscribe to be committed after the confirmation timeout.
+func (s *unsubscribeStager) Stage(service, subscriber, dpName, remoteAddr string) (*StagedUnsubscribe, error) {
+	now := time.Now()
+	staged := &StagedUnsubscribe{
+		ID:            stagedUnsubscribeID(service, subscriber, dpName),
+		Service:       service,
+		Subscriber:    subscriber,
+		DeliveryPoint: dpName,
+		From:          remoteAddr,
+		Created:       now.Unix(),
+		Deadline:      now.Add(s.conf.ConfirmTimeout).Unix(),
+	}
+	data, err := json.Marshal(staged)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.db.StageUnsubscribe(staged.ID, data); err != nil {
+		return nil, err
+	}
+	return staged, nil
+}
+
+// Confirm commits a staged unsubscribe now. Returns false if it doesn't exist (e.g. it was already committed or cancelled).
+func (s *unsubscribeStager) Confirm(id string) (bool, error) {
+	staged, err := s.get(id)
+	if err != nil || staged == nil {
+		return false, err
+	}
+	return s.commit(staged)
+}
+
+// Cancel drops a staged unsubscribe, so that the delivery point stays subscribed. Returns false if it doesn't exist.
+func (s *unsubscribeStager) Cancel(id string) (bool, error) {
+	if s == nil {
+		return false, nil
+	}
+	return s.db.RemoveStagedUnsubscribe(id)
+}
+
+// CancelForDeliveryPoint drops the staged unsubscribe of a delivery point which is subscribed again.
+func (s *unsubscribeStager) CancelForDeliveryPoint(service, subscriber, dpName string) {
+	if s == nil {
+		return
+	}
+	cancelled, err := s.Cancel(stagedUnsubscribeID(service, subscriber, dpName))
+	if err != nil {
+		s.logger.Errorf("Service=%v Subscriber=%v DeliveryPoint=%v Cannot cancel staged unsubscribe: %v", service, subscriber, dpName, err)
+	} else if cancelled {
+		s.logger.Infof("Service=%v Subscriber=%v DeliveryPoint=%v Cancelled staged unsubscribe: subscribed again", service, subscriber, dpName)
+	}
+}
+
+// List returns the staged unsubscribes of a service (or of every service, if service is empty), oldest first.
+func (s *unsubscribeStager) List(service string) ([]StagedUnsubscribe, error) {
+	list := []StagedUnsubscribe{}
+	if s == nil {
+		return list, nil
+	}
+	all, err := s.db.GetStagedUnsubscribes()
+	if err != nil {
+		return nil, err
+	}
+	for id, data := range all {
+		var staged StagedUnsubscribe
+		if err := json.Unmarshal(data, &staged); err != nil {
+			s.logger.Errorf("StagedUnsubscribe=%v Invalid staged unsubscribe: %v", id, err)
+			continue
+		}
+		if service == "" || staged.Service == service {
+			list = append(list, staged)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Created < list[j].Created })
+	return list, nil
+}
+
+// Run commits staged unsubscribes whose confirmation timeout passed every interval (if this instance is the leader of the cluster), until Stop is called.
+func (s *unsubscribeStager) Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stopChan:
+			return
+		case <-ticker.C:
+			if s.backend.cluster.IsLeader() {
+				s.commitExpired(time.Now())
+			}
+		}
+	}
+}
+
+// Stop stops committing staged unsubscribes. They are committed by other instances, or after a restart.
+func (s *unsubscribeStager) Stop() {
+	close(s.stopChan)
+}
+
+func (s *unsubscribeStager) commitExpired(now time.Time) {
+	list, err := s.List("")
+	if err != nil {
+		s.logger.Errorf("Cannot list staged unsubscribes: %v", err)
+		return
+	}
+	for i := range list {
+		if list[i].Deadline > now.Unix() {
+			continue
+		}
+		if _, err := s.commit(&list[i]); err != nil {
+			s.logger.Errorf("StagedUnsubscribe=%v Cannot commit staged unsubscribe: %v", list[i].ID, err)
+		}
+	}
+}
+
+func (s *unsubscribeStager) get(id string) (*StagedUnsubscribe, error) {
+	if s == nil {
+		return nil, nil
+	}
+	data, err := s.db.GetStagedUnsubscribe(id)
+	if err != nil || data == nil {
+		return nil, err
+	}
+	staged := new(StagedUnsubscribe)
+	if err := json.Unmarshal(data, staged); err != nil {
+		return nil, fmt.Errorf("Invalid staged unsubscribe %s: %v", id, err)
+	}
+	return staged, nil
+}
+
+// commit removes the delivery point of a staged unsubscribe, and then the staged unsubscribe, so that it is committed again later if removing the delivery point fails.
+// Removing a delivery point twice is harmless, so if two instances commit the same staged unsubscribe, only the one which removes the staged unsubscribe returns true.
+func (s *unsubscribeStager) commit(staged *StagedUnsubscribe) (bool, error) {
+	pairs, err := s.db.GetPushServiceProviderDeliveryPointPairs(staged.Service, staged.Subscriber, []string{staged.DeliveryPoint})
+	if err != nil {
+		return false, err
+	}
+	for _, pair := range pairs {
+		if pair.DeliveryPoint == nil {
+			continue
+		}
+		if err := s.backend.Unsubscribe(staged.Service, staged.Subscriber, pair.DeliveryPoint); err != nil {
+			return false, err
+		}
+	}
+	removed, err := s.db.RemoveStagedUnsubscribe(staged.ID)
+	if err != nil || !removed {
+		return false, err
+	}
+	s.logger.Infof("Service=%v Subscriber=%v DeliveryPoint=%v From=%v Committed staged unsubscribe", staged.Service, staged.Subscriber, staged.DeliveryPoint, staged.From)
+	return true, nil
+}
@@ -0,0 +1,177 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"errors"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/uniqush/log"
+	"github.com/uniqush/uniqush-push/db"
+	"github.com/uniqush/uniqush-push/push"
+	"github.com/uniqush/uniqush-push/testutil"
+)
+
+// stagedUnsubscribeDatabase keeps staged unsubscribes in memory, has a single delivery point, and records the delivery points which are removed.
+// Other methods aren't implemented.
+type stagedUnsubscribeDatabase struct {
+	db.PushDatabase
+	dp      *push.DeliveryPoint
+	staged  map[string][]byte
+	removed []string
+	// removeErr is returned by RemoveDeliveryPointFromService, if it isn't nil.
+	removeErr error
+}
+
+func (d *stagedUnsubscribeDatabase) StageUnsubscribe(id string, data []byte) error {
+	d.staged[id] = data
+	return nil
+}
+
+func (d *stagedUnsubscribeDatabase) GetStagedUnsubscribe(id string) ([]byte, error) {
+	return d.staged[id], nil
+}
+
+func (d *stagedUnsubscribeDatabase) GetStagedUnsubscribes() (map[string][]byte, error) {
+	staged := make(map[string][]byte, len(d.staged))
+	for id, data := range d.staged {
+		staged[id] = data
+	}
+	return staged, nil
+}
+
+func (d *stagedUnsubscribeDatabase) RemoveStagedUnsubscribe(id string) (bool, error) {
+	_, ok := d.staged[id]
+	delete(d.staged, id)
+	return ok, nil
+}
+
+func (d *stagedUnsubscribeDatabase) GetPushServiceProviderDeliveryPointPairs(service string, subscriber string, dpNamesRequested []string) ([]db.PushServiceProviderDeliveryPointPair, error) {
+	return []db.PushServiceProviderDeliveryPointPair{{DeliveryPoint: d.dp}}, nil
+}
+
+func (d *stagedUnsubscribeDatabase) AddDeliveryPointToService(service string, subscriber string, dp *push.DeliveryPoint) (*push.PushServiceProvider, error) {
+	return nil, nil
+}
+
+func (d *stagedUnsubscribeDatabase) RemoveDeliveryPointFromService(service string, subscriber string, dp *push.DeliveryPoint) error {
+	if d.removeErr != nil {
+		return d.removeErr
+	}
+	d.removed = append(d.removed, service+":"+subscriber+":"+dp.Name())
+	return nil
+}
+
+func newTestUnsubscribeStager(t *testing.T) (*unsubscribeStager, *stagedUnsubscribeDatabase) {
+	_, dp := newFailureTestPeers(t)
+	database := &stagedUnsubscribeDatabase{dp: dp, staged: make(map[string][]byte)}
+	backend := &PushBackEnd{db: database}
+	backend.unsubscribes = newUnsubscribeStager(backend, database, UnsubscribeConfig{Staged: true, ConfirmTimeout: time.Hour}, log.NewLogger(ioutil.Discard, "", log.LOGLEVEL_SILENT))
+	return backend.unsubscribes, database
+}
+
+func TestUnsubscribeStagerDisabled(t *testing.T) {
+	s := newUnsubscribeStager(nil, nil, UnsubscribeConfig{Staged: false}, nil)
+	if s != nil {
+		t.Fatalf("expected no stager when staged=off")
+	}
+	// A disabled stager has nothing to confirm, cancel or list.
+	confirmed, err := s.Confirm("srv:sub:dp")
+	testutil.ExpectEquals(t, false, confirmed, "expected nothing to confirm")
+	testutil.ExpectEquals(t, nil, err, "unexpected error")
+	cancelled, err := s.Cancel("srv:sub:dp")
+	testutil.ExpectEquals(t, false, cancelled, "expected nothing to cancel")
+	testutil.ExpectEquals(t, nil, err, "unexpected error")
+	list, err := s.List("")
+	testutil.ExpectEquals(t, []StagedUnsubscribe{}, list, "expected no staged unsubscribes")
+	testutil.ExpectEquals(t, nil, err, "unexpected error")
+	s.CancelForDeliveryPoint("srv", "sub", "dp")
+}
+
+func TestStagedUnsubscribeID(t *testing.T) {
+	testutil.ExpectStringEquals(t, "srv:sub:apns:0123", stagedUnsubscribeID("srv", "sub", "apns:0123"), "unexpected staged unsubscribe id")
+}
+
+func TestUnsubscribeStagerConfirm(t *testing.T) {
+	s, database := newTestUnsubscribeStager(t)
+	staged, err := s.Stage("myservice", "user1", database.dp.Name(), "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, err := s.List("myservice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectEquals(t, []StagedUnsubscribe{*staged}, list, "expected the staged unsubscribe to be listed")
+	testutil.ExpectEquals(t, 0, len(database.removed), "expected the delivery point to stay subscribed until the unsubscribe is confirmed")
+
+	confirmed, err := s.Confirm(staged.ID)
+	testutil.ExpectEquals(t, true, confirmed, "expected the staged unsubscribe to be confirmed")
+	testutil.ExpectEquals(t, nil, err, "unexpected error")
+	testutil.ExpectEquals(t, []string{"myservice:user1:" + database.dp.Name()}, database.removed, "expected the delivery point to be removed")
+	confirmed, err = s.Confirm(staged.ID)
+	testutil.ExpectEquals(t, false, confirmed, "expected an unsubscribe to be committed once")
+	testutil.ExpectEquals(t, nil, err, "unexpected error")
+}
+
+func TestUnsubscribeStagerCancel(t *testing.T) {
+	s, database := newTestUnsubscribeStager(t)
+	staged, err := s.Stage("myservice", "user1", database.dp.Name(), "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancelled, err := s.Cancel(staged.ID)
+	testutil.ExpectEquals(t, true, cancelled, "expected the staged unsubscribe to be cancelled")
+	testutil.ExpectEquals(t, nil, err, "unexpected error")
+	confirmed, _ := s.Confirm(staged.ID)
+	testutil.ExpectEquals(t, false, confirmed, "expected a cancelled unsubscribe not to be confirmed")
+	testutil.ExpectEquals(t, 0, len(database.removed), "expected the delivery point to stay subscribed")
+}
+
+func TestUnsubscribeStagerCancelOnResubscribe(t *testing.T) {
+	s, database := newTestUnsubscribeStager(t)
+	if _, err := s.Stage("myservice", "user1", database.dp.Name(), "127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.backend.Subscribe("myservice", "user1", database.dp); err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectEquals(t, 0, len(database.staged), "expected subscribing again to cancel the staged unsubscribe")
+	s.commitExpired(time.Now().Add(2 * time.Hour))
+	testutil.ExpectEquals(t, 0, len(database.removed), "expected the delivery point to stay subscribed")
+}
+
+func TestUnsubscribeStagerCommitExpired(t *testing.T) {
+	s, database := newTestUnsubscribeStager(t)
+	if _, err := s.Stage("myservice", "user1", database.dp.Name(), "127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	s.commitExpired(time.Now())
+	testutil.ExpectEquals(t, 0, len(database.removed), "expected unsubscribes to be committed only after the confirmation timeout")
+
+	database.removeErr = errors.New("database unavailable")
+	s.commitExpired(time.Now().Add(2 * time.Hour))
+	testutil.ExpectEquals(t, 1, len(database.staged), "expected the unsubscribe to stay staged if the delivery point couldn't be removed")
+
+	database.removeErr = nil
+	s.commitExpired(time.Now().Add(2 * time.Hour))
+	testutil.ExpectEquals(t, []string{"myservice:user1:" + database.dp.Name()}, database.removed, "expected the unsubscribe to be committed after the confirmation timeout")
+	testutil.ExpectEquals(t, 0, len(database.staged), "expected the committed unsubscribe to be removed")
+}
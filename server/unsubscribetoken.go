@@ -0,0 +1,212 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/uniqush/log"
+)
+
+const defaultUnsubscribeTokenTTL = 30 * 24 * time.Hour
+
+// UnsubscribeTokensConfig is a representation of the settings in the [UnsubscribeTokens] section of uniqush.conf.
+type UnsubscribeTokensConfig struct {
+	// Secrets are the keys of the HMAC of tokens. Tokens are signed with the first one, and tokens signed with any of them are accepted,
+	// so that the secret can be rotated. Tokens are disabled if there are none.
+	Secrets []string
+	// TTL is how long tokens are valid after they are issued.
+	TTL time.Duration
+}
+
+// unsubscribeTokenClaims are the delivery point which an unsubscribe token removes, and when the token expires.
+type unsubscribeTokenClaims struct {
+	Service       string `json:"s"`
+	Subscriber    string `json:"u"`
+	DeliveryPoint string `json:"d"`
+	Expires       int64  `json:"e"`
+}
+
+var errInvalidUnsubscribeToken = errors.New("Invalid unsubscribe token")
+
+// unsubscribeTokens issues and verifies unsubscribe tokens, which app servers embed in notifications so that end users can remove
+// their own delivery point with UnsubscribeWithTokenURL, without an API key. A token is the base64 encoded claims and their HMAC-SHA256, separated by ".".
+type unsubscribeTokens struct {
+	secrets [][]byte
+	ttl     time.Duration
+	now     func() time.Time
+}
+
+// newUnsubscribeTokens returns nil if there are no secrets.
+func newUnsubscribeTokens(conf UnsubscribeTokensConfig) *unsubscribeTokens {
+	if len(conf.Secrets) == 0 {
+		return nil
+	}
+	t := &unsubscribeTokens{ttl: conf.TTL, now: time.Now}
+	for _, secret := range conf.Secrets {
+		t.secrets = append(t.secrets, []byte(secret))
+	}
+	return t
+}
+
+func signUnsubscribeToken(secret []byte, claims string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(claims))
+	return mac.Sum(nil)
+}
+
+// Issue returns a token removing a delivery point of a subscriber of service, and when it expires.
+func (t *unsubscribeTokens) Issue(service, subscriber, dpName string) (string, time.Time, error) {
+	expires := t.now().Add(t.ttl)
+	data, err := json.Marshal(unsubscribeTokenClaims{Service: service, Subscriber: subscriber, DeliveryPoint: dpName, Expires: expires.Unix()})
+	if err != nil {
+		return "", expires, err
+	}
+	claims := base64.RawURLEncoding.EncodeToString(data)
+	return claims + "." + base64.RawURLEncoding.EncodeToString(signUnsubscribeToken(t.secrets[0], claims)), expires, nil
+}
+
+// Verify returns the claims of a token signed with one of the secrets which hasn't expired.
+func (t *unsubscribeTokens) Verify(token string) (*unsubscribeTokenClaims, error) {
+	i := strings.IndexByte(token, '.')
+	if i < 0 {
+		return nil, errInvalidUnsubscribeToken
+	}
+	claims := token[:i]
+	mac, err := base64.RawURLEncoding.DecodeString(token[i+1:])
+	if err != nil {
+		return nil, errInvalidUnsubscribeToken
+	}
+	valid := false
+	for _, secret := range t.secrets {
+		if hmac.Equal(mac, signUnsubscribeToken(secret, claims)) {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		return nil, errInvalidUnsubscribeToken
+	}
+	data, err := base64.RawURLEncoding.DecodeString(claims)
+	if err != nil {
+		return nil, errInvalidUnsubscribeToken
+	}
+	c := new(unsubscribeTokenClaims)
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, errInvalidUnsubscribeToken
+	}
+	if t.now().Unix() >= c.Expires {
+		return nil, errors.New("The unsubscribe token expired")
+	}
+	return c, nil
+}
+
+// issueUnsubscribeTokens returns an unsubscribe token for each delivery point of a subscriber of a service
+// (or only for the comma separated delivery_points), by delivery point.
+func (api *RestAPI) issueUnsubscribeTokens(kv url.Values, logger log.Logger) []byte {
+	type responseType struct {
+		Tokens       map[string]string `json:"tokens"`
+		Expires      int64             `json:"expires,omitempty"`
+		ErrorMessage *string           `json:"errorMsg,omitempty"`
+		Code         string            `json:"code"`
+	}
+	r := responseType{Tokens: map[string]string{}, Code: UNIQUSH_SUCCESS}
+	err := func() error {
+		tokens := api.backend.unsubscribeTokens
+		if tokens == nil {
+			r.Code = UNIQUSH_ERROR_GENERIC
+			return errors.New("Unsubscribe tokens are disabled: set secrets in [UnsubscribeTokens]")
+		}
+		service, subscriber := kv.Get("service"), kv.Get("subscriber")
+		if service == "" || subscriber == "" {
+			r.Code = UNIQUSH_ERROR_GENERIC
+			return errors.New("service and subscriber are required")
+		}
+		var dpNames []string
+		if s := kv.Get("delivery_points"); s != "" {
+			dpNames = strings.Split(s, ",")
+		}
+		pairs, err := api.backend.db.GetPushServiceProviderDeliveryPointPairs(service, subscriber, dpNames)
+		if err != nil {
+			r.Code = UNIQUSH_ERROR_DATABASE
+			return err
+		}
+		for _, pair := range pairs {
+			if pair.DeliveryPoint == nil {
+				continue
+			}
+			dpName := pair.DeliveryPoint.Name()
+			token, expires, err := tokens.Issue(service, subscriber, dpName)
+			if err != nil {
+				r.Code = UNIQUSH_ERROR_GENERIC
+				return err
+			}
+			r.Tokens[dpName] = token
+			r.Expires = expires.Unix()
+		}
+		return nil
+	}()
+	if err != nil {
+		logger.Errorf("Service=%v Subscriber=%v Cannot issue unsubscribe tokens: %v", kv.Get("service"), kv.Get("subscriber"), err)
+		r.ErrorMessage = strPtrOfErr(err)
+	}
+	json, err := json.Marshal(r)
+	if err != nil {
+		return []byte("Failed to serialize response")
+	}
+	return json
+}
+
+// unsubscribeWithToken removes the delivery point of the unsubscribe token in kv. Unlike /unsubscribe, the removal isn't staged, since end users ask for it.
+func (api *RestAPI) unsubscribeWithToken(kv map[string]string, logger log.Logger, remoteAddr string) APIResponseDetails {
+	tokens := api.backend.unsubscribeTokens
+	if tokens == nil {
+		errorMsg := "Unsubscribe tokens are disabled"
+		return APIResponseDetails{From: &remoteAddr, Code: UNIQUSH_ERROR_BAD_UNSUBSCRIBE_TOKEN, ErrorMsg: &errorMsg}
+	}
+	claims, err := tokens.Verify(kv["token"])
+	if err != nil {
+		logger.Warnf("From=%v Rejected unsubscribe token: %v", remoteAddr, err)
+		return APIResponseDetails{From: &remoteAddr, Code: UNIQUSH_ERROR_BAD_UNSUBSCRIBE_TOKEN, ErrorMsg: strPtrOfErr(err)}
+	}
+	service, dpName := claims.Service, claims.DeliveryPoint
+	pairs, err := api.backend.db.GetPushServiceProviderDeliveryPointPairs(claims.Service, claims.Subscriber, []string{claims.DeliveryPoint})
+	if err != nil {
+		logger.Errorf("From=%v Service=%v DeliveryPoint=%v Failed: %v", remoteAddr, service, dpName, err)
+		return APIResponseDetails{From: &remoteAddr, Service: &service, DeliveryPoint: &dpName, Code: UNIQUSH_ERROR_DATABASE, ErrorMsg: strPtrOfErr(err)}
+	}
+	for _, pair := range pairs {
+		if pair.DeliveryPoint == nil {
+			continue
+		}
+		if err := api.backend.Unsubscribe(claims.Service, claims.Subscriber, pair.DeliveryPoint); err != nil {
+			logger.Errorf("From=%v Service=%v DeliveryPoint=%v Failed: %v", remoteAddr, service, dpName, err)
+			return APIResponseDetails{From: &remoteAddr, Service: &service, DeliveryPoint: &dpName, Code: UNIQUSH_ERROR_DATABASE, ErrorMsg: strPtrOfErr(err)}
+		}
+	}
+	api.backend.unsubscribes.CancelForDeliveryPoint(claims.Service, claims.Subscriber, claims.DeliveryPoint)
+	logger.Infof("From=%v Service=%v Subscriber=%v DeliveryPoint=%v Unsubscribed with token", remoteAddr, service, claims.Subscriber, dpName)
+	return APIResponseDetails{From: &remoteAddr, Service: &service, DeliveryPoint: &dpName, Code: UNIQUSH_SUCCESS}
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"encoding/json"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/uniqush/uniqush-push/db"
+	"github.com/uniqush/uniqush-push/push"
+	"github.com/uniqush/uniqush-push/testutil"
+)
+
+// unsubscribeTokenDatabase has a single delivery point, and records the delivery points which are removed. Other methods aren't implemented.
+type unsubscribeTokenDatabase struct {
+	db.PushDatabase
+	dp      *push.DeliveryPoint
+	removed []string
+}
+
+func (d *unsubscribeTokenDatabase) GetPushServiceProviderDeliveryPointPairs(service string, subscriber string, dpNamesRequested []string) ([]db.PushServiceProviderDeliveryPointPair, error) {
+	if service != "myservice" || subscriber != "user1" {
+		return nil, nil
+	}
+	return []db.PushServiceProviderDeliveryPointPair{{DeliveryPoint: d.dp}}, nil
+}
+
+func (d *unsubscribeTokenDatabase) RemoveDeliveryPointFromService(service string, subscriber string, dp *push.DeliveryPoint) error {
+	d.removed = append(d.removed, service+":"+subscriber+":"+dp.Name())
+	return nil
+}
+
+func TestUnsubscribeTokens(t *testing.T) {
+	tokens := newUnsubscribeTokens(UnsubscribeTokensConfig{Secrets: []string{"new-secret", "old-secret"}, TTL: time.Hour})
+	now := time.Unix(1500000000, 0)
+	tokens.now = func() time.Time { return now }
+	token, expires, err := tokens.Issue("myservice", "user1", "bench:0123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectEquals(t, now.Add(time.Hour), expires, "expected the token to expire after the ttl")
+	claims, err := tokens.Verify(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectEquals(t, unsubscribeTokenClaims{Service: "myservice", Subscriber: "user1", DeliveryPoint: "bench:0123", Expires: expires.Unix()}, *claims, "expected the claims of the token")
+
+	old := newUnsubscribeTokens(UnsubscribeTokensConfig{Secrets: []string{"old-secret"}, TTL: time.Hour})
+	oldToken, _, _ := old.Issue("myservice", "user1", "bench:0123")
+	if _, err := tokens.Verify(oldToken); err != nil {
+		t.Errorf("expected tokens signed with previous secrets to be valid, got %v", err)
+	}
+	other := newUnsubscribeTokens(UnsubscribeTokensConfig{Secrets: []string{"other-secret"}, TTL: time.Hour})
+	otherToken, _, _ := other.Issue("myservice", "user1", "bench:0123")
+	forged, _, _ := tokens.Issue("myservice", "user2", "bench:0123")
+	for _, invalid := range []string{"", "abc", otherToken, forged[:strings.IndexByte(forged, '.')] + token[strings.IndexByte(token, '.'):]} {
+		if _, err := tokens.Verify(invalid); err == nil {
+			t.Errorf("expected %q to be invalid", invalid)
+		}
+	}
+	now = now.Add(time.Hour)
+	if _, err := tokens.Verify(token); err == nil {
+		t.Error("expected expired tokens to be invalid")
+	}
+	testutil.ExpectEquals(t, true, newUnsubscribeTokens(UnsubscribeTokensConfig{TTL: time.Hour}) == nil, "expected tokens to be disabled without secrets")
+}
+
+func TestUnsubscribeWithToken(t *testing.T) {
+	_, dp := newFailureTestPeers(t)
+	database := &unsubscribeTokenDatabase{dp: dp}
+	api := newHealthTestAPI(database)
+	api.backend.unsubscribeTokens = newUnsubscribeTokens(UnsubscribeTokensConfig{Secrets: []string{"secret"}, TTL: time.Hour})
+
+	var issued struct {
+		Tokens map[string]string `json:"tokens"`
+		Code   string            `json:"code"`
+	}
+	if err := json.Unmarshal(api.issueUnsubscribeTokens(url.Values{"service": {"myservice"}, "subscriber": {"user1"}}, api.loggers[LoggerUnsub]), &issued); err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectStringEquals(t, UNIQUSH_SUCCESS, issued.Code, "expected tokens to be issued")
+	token, ok := issued.Tokens[dp.Name()]
+	if !ok {
+		t.Fatalf("expected a token for %s, got %v", dp.Name(), issued.Tokens)
+	}
+
+	details := api.unsubscribeWithToken(map[string]string{"token": "invalid"}, api.loggers[LoggerUnsub], "10.0.0.1")
+	testutil.ExpectStringEquals(t, UNIQUSH_ERROR_BAD_UNSUBSCRIBE_TOKEN, details.Code, "expected invalid tokens to be rejected")
+	details = api.unsubscribeWithToken(map[string]string{"token": token}, api.loggers[LoggerUnsub], "10.0.0.1")
+	testutil.ExpectStringEquals(t, UNIQUSH_SUCCESS, details.Code, "expected the delivery point to be removed")
+	testutil.ExpectEquals(t, []string{"myservice:user1:" + dp.Name()}, database.removed, "expected only the delivery point of the token to be removed")
+}
@@ -0,0 +1,284 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/uniqush/log"
+	"github.com/uniqush/uniqush-push/db"
+)
+
+const (
+	defaultUsageRetention     = 400 * 24 * time.Hour
+	defaultUsageFlushInterval = 10 * time.Second
+	// defaultUsageRange is the period reported by /usage if from isn't given.
+	defaultUsageRange = 30 * 24 * time.Hour
+	// maxUsageRange is the longest period which can be reported by /usage at once.
+	maxUsageRange = 366 * 24 * time.Hour
+	// usageAnonymous is the API key of requests without an Authorization header.
+	usageAnonymous = "anonymous"
+)
+
+// Names of the usage counters of each API key and day. They are saved as the name of the counter, ":", and the API key (e.g. requests:sha256:0123456789abcdef).
+const (
+	usageRequests      = "requests"
+	usageNotifications = "notifications"
+)
+
+// UsageConfig is a representation of the settings in the [Usage] section of uniqush.conf.
+type UsageConfig struct {
+	// Retention is how long the daily counters are kept. 0 disables usage metering.
+	Retention time.Duration
+	// FlushInterval is how often the counters are added to the database.
+	FlushInterval time.Duration
+}
+
+// UsageDay is the usage of an API key during a day (UTC).
+type UsageDay struct {
+	// Day is the unix timestamp of the start of the day. It is omitted from totals.
+	Day int64 `json:"day,omitempty"`
+	// Requests is the number of API requests.
+	Requests int64 `json:"requests"`
+	// Notifications is the number of notifications which push services accepted, from /push and /broadcast.
+	Notifications int64 `json:"notifications"`
+}
+
+// APIKeyUsage is the usage of an API key during the period of a report, in total and by day.
+type APIKeyUsage struct {
+	// APIKey is the fingerprint of the credentials in the Authorization header (see auditAPIKey), or "anonymous".
+	APIKey string     `json:"apiKey"`
+	Total  UsageDay   `json:"total"`
+	Days   []UsageDay `json:"days"`
+}
+
+// usageMeter counts the requests and notifications of each API key by day, and adds the counts to the database every FlushInterval,
+// so that the database isn't written to for every request.
+type usageMeter struct {
+	db     db.PushDatabase
+	conf   UsageConfig
+	logger log.Logger
+	mutex  sync.Mutex
+	// counts are keyed by the unix timestamp of the start of the day, then by counter name and API key.
+	counts map[int64]map[string]int64
+	now    func() time.Time
+}
+
+func newUsageMeter(database db.PushDatabase, conf UsageConfig, logger log.Logger) *usageMeter {
+	if conf.Retention <= 0 {
+		return nil
+	}
+	u := &usageMeter{
+		db:     database,
+		conf:   conf,
+		logger: logger,
+		counts: make(map[int64]map[string]int64),
+		now:    time.Now,
+	}
+	go u.run()
+	return u
+}
+
+func (u *usageMeter) run() {
+	for range time.Tick(u.conf.FlushInterval) {
+		u.Flush()
+	}
+}
+
+// record adds n to the counter of apiKey (a fingerprint from auditAPIKey, or "" without credentials).
+func (u *usageMeter) record(apiKey, counter string, n int64) {
+	if u == nil || n == 0 {
+		return
+	}
+	if apiKey == "" {
+		apiKey = usageAnonymous
+	}
+	day := u.now().Unix() / 86400 * 86400
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	counts, ok := u.counts[day]
+	if !ok {
+		counts = make(map[string]int64)
+		u.counts[day] = counts
+	}
+	counts[counter+":"+apiKey] += n
+}
+
+// Flush adds the counts since the last flush to the database. Counts which can't be saved are logged and dropped,
+// since adding them again could count some of them twice.
+func (u *usageMeter) Flush() {
+	if u == nil {
+		return
+	}
+	u.mutex.Lock()
+	pending := u.counts
+	u.counts = make(map[int64]map[string]int64)
+	u.mutex.Unlock()
+	for day, counts := range pending {
+		if err := u.db.IncrUsageCounts(day, counts, u.conf.Retention); err != nil {
+			u.logger.Errorf("Day=%v Cannot save usage %v: %v", day, counts, err)
+		}
+	}
+}
+
+// Report returns the usage of each API key (or only of apiKey, if it isn't "") during the days between from and to (inclusive),
+// most notifications first. The counts of the current day don't include the requests since the last flush.
+func (u *usageMeter) Report(apiKey string, from, to time.Time) ([]APIKeyUsage, error) {
+	report := []APIKeyUsage{}
+	if u == nil {
+		return report, nil
+	}
+	var days []int64
+	for day := from.Unix() / 86400 * 86400; day <= to.Unix(); day += 86400 {
+		days = append(days, day)
+	}
+	if len(days) == 0 {
+		return report, nil
+	}
+	counts, err := u.db.GetUsageCounts(days)
+	if err != nil {
+		return nil, err
+	}
+	byKey := make(map[string]*APIKeyUsage)
+	for i, day := range days {
+		usageOfDay := make(map[string]*UsageDay)
+		for name, n := range counts[i] {
+			parts := strings.SplitN(name, ":", 2)
+			if len(parts) != 2 || (apiKey != "" && parts[1] != apiKey) {
+				continue
+			}
+			d, ok := usageOfDay[parts[1]]
+			if !ok {
+				d = &UsageDay{Day: day}
+				usageOfDay[parts[1]] = d
+			}
+			switch parts[0] {
+			case usageRequests:
+				d.Requests = n
+			case usageNotifications:
+				d.Notifications = n
+			}
+		}
+		for key, d := range usageOfDay {
+			usage, ok := byKey[key]
+			if !ok {
+				usage = &APIKeyUsage{APIKey: key}
+				byKey[key] = usage
+			}
+			usage.Total.Requests += d.Requests
+			usage.Total.Notifications += d.Notifications
+			usage.Days = append(usage.Days, *d)
+		}
+	}
+	for _, usage := range byKey {
+		report = append(report, *usage)
+	}
+	sort.Slice(report, func(i, j int) bool {
+		if report[i].Total.Notifications != report[j].Total.Notifications {
+			return report[i].Total.Notifications > report[j].Total.Notifications
+		}
+		if report[i].Total.Requests != report[j].Total.Requests {
+			return report[i].Total.Requests > report[j].Total.Requests
+		}
+		return report[i].APIKey < report[j].APIKey
+	})
+	return report, nil
+}
+
+// Wrap returns a response handler which counts the notifications accepted by push services as usage of apiKey, in addition to passing the results on to handler.
+func (u *usageMeter) Wrap(apiKey string, handler APIResponseHandler) APIResponseHandler {
+	if u == nil {
+		return handler
+	}
+	return &usageResponseHandler{handler: handler, usage: u, apiKey: apiKey}
+}
+
+type usageResponseHandler struct {
+	handler APIResponseHandler
+	usage   *usageMeter
+	apiKey  string
+}
+
+var _ APIResponseHandler = &usageResponseHandler{}
+
+// AddDetailsToHandler counts the result if it is an accepted notification, then passes it on to the wrapped handler.
+func (handler *usageResponseHandler) AddDetailsToHandler(v APIResponseDetails) {
+	if v.Code == UNIQUSH_SUCCESS && v.MessageID != nil {
+		handler.usage.record(handler.apiKey, usageNotifications, 1)
+	}
+	handler.handler.AddDetailsToHandler(v)
+}
+
+// ToJSON returns the response of the wrapped handler.
+func (handler *usageResponseHandler) ToJSON() []byte {
+	return handler.handler.ToJSON()
+}
+
+// usageRange returns the period reported by the from and to parameters of /usage (unix timestamps or RFC 3339 dates).
+// to defaults to now, and from to 30 days before to.
+func usageRange(fromParam, toParam string, now time.Time) (from, to time.Time, err error) {
+	to = now
+	if toParam != "" {
+		if to, err = parseAnalyticsTime(toParam); err != nil {
+			return
+		}
+	}
+	from = to.Add(-defaultUsageRange)
+	if fromParam != "" {
+		if from, err = parseAnalyticsTime(fromParam); err != nil {
+			return
+		}
+	}
+	if from.After(to) {
+		err = fmt.Errorf("from must not be after to")
+	} else if to.Sub(from) > maxUsageRange {
+		err = fmt.Errorf("Cannot report more than %v at once", maxUsageRange)
+	}
+	return
+}
+
+// serveUsage responds to /usage on the admin listener with the usage of each API key between from and to, or only of api_key if it is given.
+func serveUsage(w http.ResponseWriter, r *http.Request, u *usageMeter) {
+	from, to, err := usageRange(r.FormValue("from"), r.FormValue("to"), time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	report, err := u.Report(r.FormValue("api_key"), from, to)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Cannot load usage: %v", err), http.StatusInternalServerError)
+		return
+	}
+	data, err := json.Marshal(struct {
+		From  int64         `json:"from"`
+		To    int64         `json:"to"`
+		Usage []APIKeyUsage `json:"usage"`
+	}{from.Unix(), to.Unix(), report})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, "%s\r\n", data)
+}
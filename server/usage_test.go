@@ -0,0 +1,132 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/uniqush/log"
+	"github.com/uniqush/uniqush-push/db"
+	"github.com/uniqush/uniqush-push/testutil"
+)
+
+// usageDatabase keeps the usage counts in memory. Other methods aren't implemented.
+type usageDatabase struct {
+	db.PushDatabase
+	counts map[int64]map[string]int64
+}
+
+func (d *usageDatabase) IncrUsageCounts(day int64, counts map[string]int64, retention time.Duration) error {
+	if d.counts[day] == nil {
+		d.counts[day] = make(map[string]int64)
+	}
+	for name, n := range counts {
+		d.counts[day][name] += n
+	}
+	return nil
+}
+
+func (d *usageDatabase) GetUsageCounts(days []int64) ([]map[string]int64, error) {
+	ret := make([]map[string]int64, len(days))
+	for i, day := range days {
+		ret[i] = d.counts[day]
+	}
+	return ret, nil
+}
+
+func newTestUsageMeter() *usageMeter {
+	return &usageMeter{
+		db:     &usageDatabase{counts: make(map[int64]map[string]int64)},
+		conf:   UsageConfig{Retention: 24 * time.Hour},
+		logger: log.NewLogger(ioutil.Discard, "", log.LOGLEVEL_SILENT),
+		counts: make(map[int64]map[string]int64),
+	}
+}
+
+func TestUsageMeter(t *testing.T) {
+	u := newTestUsageMeter()
+	now := time.Unix(1500000000, 0)
+	u.now = func() time.Time { return now }
+	day := int64(1500000000 / 86400 * 86400)
+
+	messageID := "msg"
+	handler := u.Wrap("sha256:aaaa", &NullAPIResponseHandler{})
+	handler.AddDetailsToHandler(APIResponseDetails{Code: UNIQUSH_SUCCESS, MessageID: &messageID})
+	handler.AddDetailsToHandler(APIResponseDetails{Code: UNIQUSH_SUCCESS})
+	handler.AddDetailsToHandler(APIResponseDetails{Code: UNIQUSH_ERROR_GENERIC, MessageID: &messageID})
+	u.record("sha256:aaaa", usageRequests, 1)
+	u.record("", usageRequests, 1)
+	u.Flush()
+	now = now.Add(24 * time.Hour)
+	u.record("sha256:aaaa", usageRequests, 1)
+	u.Wrap("sha256:aaaa", &NullAPIResponseHandler{}).AddDetailsToHandler(APIResponseDetails{Code: UNIQUSH_SUCCESS, MessageID: &messageID})
+	u.Flush()
+
+	report, err := u.Report("", time.Unix(day, 0), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []APIKeyUsage{
+		{
+			APIKey: "sha256:aaaa",
+			Total:  UsageDay{Requests: 2, Notifications: 2},
+			Days: []UsageDay{
+				{Day: day, Requests: 1, Notifications: 1},
+				{Day: day + 86400, Requests: 1, Notifications: 1},
+			},
+		},
+		{
+			APIKey: usageAnonymous,
+			Total:  UsageDay{Requests: 1},
+			Days:   []UsageDay{{Day: day, Requests: 1}},
+		},
+	}
+	testutil.ExpectEquals(t, expected, report, "expected the usage of each API key, most notifications first")
+
+	report, err = u.Report(usageAnonymous, time.Unix(day+86400, 0), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectEquals(t, []APIKeyUsage{}, report, "expected the report to be limited to api_key and the period")
+
+	var disabled *usageMeter
+	disabled.record("sha256:aaaa", usageRequests, 1)
+	disabled.Flush()
+	report, err = disabled.Report("", time.Unix(day, 0), now)
+	testutil.ExpectEquals(t, 0, len(report), "expected no usage when metering is disabled")
+	testutil.ExpectEquals(t, nil, err, "expected no error when metering is disabled")
+}
+
+func TestAdminUsage(t *testing.T) {
+	u := newTestUsageMeter()
+	u.now = func() time.Time { return time.Unix(1500000000, 0) }
+	u.record("sha256:aaaa", usageRequests, 3)
+	u.Flush()
+	handler := newAdminHandler(AdminConfig{Addr: "localhost:0", Token: "secret"}, nil, nil, u, nil, nil, nil, nil, nil, nil)
+	get := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+	testutil.ExpectEquals(t, http.StatusBadRequest, get("/usage?from=1500000000&to=1400000000").Code, "expected from to be before to")
+	testutil.ExpectEquals(t, http.StatusBadRequest, get("/usage?from=1400000000&to=1500000000").Code, "expected long periods to be rejected")
+
+	w := get("/usage?from=1499990000&to=1500000000&api_key=sha256:aaaa")
+	testutil.ExpectEquals(t, http.StatusOK, w.Code, "unexpected status")
+	var response struct {
+		From  int64         `json:"from"`
+		To    int64         `json:"to"`
+		Usage []APIKeyUsage `json:"usage"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("invalid response %s: %v", w.Body.String(), err)
+	}
+	testutil.ExpectEquals(t, int64(1499990000), response.From, "expected the period of the report")
+	testutil.ExpectEquals(t, 1, len(response.Usage), "expected the usage of the API key")
+	testutil.ExpectEquals(t, int64(3), response.Usage[0].Total.Requests, "expected the requests of the API key")
+}
@@ -0,0 +1,332 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/uniqush/goconf/conf"
+	"github.com/uniqush/log"
+)
+
+// Webhook* are the types of events sent to webhooks.
+const (
+	WebhookDeliveryPointAdded    = "delivery_point_added"
+	WebhookDeliveryPointRemoved  = "delivery_point_removed"
+	WebhookTokenInvalidated      = "token_invalidated"
+	WebhookPushFailedPermanently = "push_failed_permanently"
+	WebhookBroadcastCompleted    = "broadcast_completed"
+	WebhookPSPErrorRateExceeded  = "psp_error_rate_exceeded"
+	WebhookPSPErrorRateRecovered = "psp_error_rate_recovered"
+	WebhookChurnAnomalyDetected  = "churn_anomaly_detected"
+	WebhookChurnAnomalyRecovered = "churn_anomaly_recovered"
+	WebhookCanaryFailed          = "canary_failed"
+	WebhookCanaryRecovered       = "canary_recovered"
+)
+
+const (
+	// webhookSectionPrefix is the prefix of config sections with the webhook settings of a single service.
+	webhookSectionPrefix = "Webhooks."
+
+	defaultWebhookTimeout     = 10 * time.Second
+	defaultWebhookMaxAttempts = 3
+	// webhookRetryInterval is the delay before the first retry of a webhook. It doubles with each retry.
+	webhookRetryInterval = time.Second
+	// webhookQueueSize is the number of events which may be waiting to be sent before new events are dropped.
+	webhookQueueSize = 4096
+	// webhookWorkers is the number of webhooks sent at once.
+	webhookWorkers = 4
+
+	// WebhookSignatureHeader contains "sha256=" followed by the hex HMAC-SHA256 of the timestamp, ".", and the body, keyed with a secret.
+	// There is a comma separated signature for each secret, so that receivers can accept any of them while the secret is rotated.
+	WebhookSignatureHeader = "X-Uniqush-Signature"
+	// WebhookTimestampHeader contains the unix timestamp of the request, so that receivers can reject replayed requests.
+	WebhookTimestampHeader = "X-Uniqush-Timestamp"
+	// WebhookEventHeader contains the type of the event.
+	WebhookEventHeader = "X-Uniqush-Event"
+)
+
+var allWebhookEvents = []string{WebhookDeliveryPointAdded, WebhookDeliveryPointRemoved, WebhookTokenInvalidated, WebhookPushFailedPermanently, WebhookBroadcastCompleted,
+	WebhookPSPErrorRateExceeded, WebhookPSPErrorRateRecovered, WebhookChurnAnomalyDetected, WebhookChurnAnomalyRecovered, WebhookCanaryFailed, WebhookCanaryRecovered}
+
+// WebhookConfig is the webhook of a service.
+type WebhookConfig struct {
+	// URL receives the events as JSON POST requests. If empty, no events are sent.
+	URL string
+	// Secrets are used to sign requests, each request having a signature for every secret. If empty, requests aren't signed.
+	Secrets []string
+	// Events are the types of events to send. If nil, every event is sent.
+	Events map[string]bool
+}
+
+func (c WebhookConfig) wants(eventType string) bool {
+	return c.URL != "" && (c.Events == nil || c.Events[eventType])
+}
+
+// WebhookConfigs is a representation of the [Webhooks] section and [Webhooks.<service>] sections of uniqush.conf.
+type WebhookConfigs struct {
+	Default WebhookConfig
+	// ByService is keyed by the service name, which is case sensitive (see serviceSections).
+	ByService   map[string]WebhookConfig
+	Timeout     time.Duration
+	MaxAttempts int
+}
+
+// ForService returns the webhook of a service.
+func (c *WebhookConfigs) ForService(service string) WebhookConfig {
+	if conf, ok := c.ByService[service]; ok {
+		return conf
+	}
+	return c.Default
+}
+
+// LoadWebhookConfigs returns a representation of the [Webhooks] section and [Webhooks.<service>] sections of uniqush.conf.
+// A service section may set the exact name of its service with the service option. Service sections inherit any settings they don't override from [Webhooks].
+// timeout is in seconds.
+func LoadWebhookConfigs(c *conf.ConfigFile) (*WebhookConfigs, error) {
+	configs := &WebhookConfigs{
+		ByService:   make(map[string]WebhookConfig),
+		Timeout:     defaultWebhookTimeout,
+		MaxAttempts: defaultWebhookMaxAttempts,
+	}
+	if timeout, err := c.GetInt("Webhooks", "timeout"); err == nil {
+		if timeout <= 0 {
+			return nil, fmt.Errorf("[Webhooks] timeout must be positive, got %d", timeout)
+		}
+		configs.Timeout = time.Duration(timeout) * time.Second
+	}
+	if maxAttempts, err := c.GetInt("Webhooks", "max_attempts"); err == nil {
+		if maxAttempts <= 0 {
+			return nil, fmt.Errorf("[Webhooks] max_attempts must be positive, got %d", maxAttempts)
+		}
+		configs.MaxAttempts = maxAttempts
+	}
+	var err error
+	configs.Default, err = loadWebhookConfig(c, "Webhooks", WebhookConfig{})
+	if err != nil {
+		return nil, err
+	}
+	sections, err := serviceSections(c, webhookSectionPrefix)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range sections {
+		configs.ByService[s.service], err = loadWebhookConfig(c, s.section, configs.Default)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return configs, nil
+}
+
+func loadWebhookConfig(c *conf.ConfigFile, section string, defaults WebhookConfig) (WebhookConfig, error) {
+	config := defaults
+	if url, err := c.GetString(section, "url"); err == nil {
+		config.URL = url
+	}
+	if secrets, err := c.GetString(section, "secret"); err == nil {
+		config.Secrets = nil
+		for _, secret := range strings.Split(secrets, ",") {
+			if secret = strings.TrimSpace(secret); secret != "" {
+				config.Secrets = append(config.Secrets, secret)
+			}
+		}
+	}
+	if events, err := c.GetString(section, "events"); err == nil && events != "" {
+		config.Events = make(map[string]bool)
+		for _, event := range strings.Split(events, ",") {
+			event = strings.TrimSpace(event)
+			known := false
+			for _, e := range allWebhookEvents {
+				known = known || e == event
+			}
+			if !known {
+				return config, fmt.Errorf("[%s] unknown event %q in events. Supported events: %s", section, event, strings.Join(allWebhookEvents, ", "))
+			}
+			config.Events[event] = true
+		}
+	}
+	return config, nil
+}
+
+// WebhookEvent is the body of a webhook request. Fields which don't apply to the type of event are omitted.
+type WebhookEvent struct {
+	ID                  string `json:"id"`
+	Type                string `json:"type"`
+	Service             string `json:"service"`
+	Subscriber          string `json:"subscriber,omitempty"`
+	DeliveryPoint       string `json:"deliveryPoint,omitempty"`
+	PushServiceProvider string `json:"pushServiceProvider,omitempty"`
+	// RequestID is the id of the push request, or the id of the broadcast.
+	RequestID     string `json:"requestId,omitempty"`
+	Code          string `json:"code,omitempty"`
+	ErrorMsg      string `json:"errorMsg,omitempty"`
+	NrSubscribers int64  `json:"nrSubscribers,omitempty"`
+	// ErrorRate is the error rate of the push service provider over NrPushes pushes during the [SLO] window.
+	ErrorRate float64 `json:"errorRate,omitempty"`
+	NrPushes  int64   `json:"nrPushes,omitempty"`
+	// NrUnsubscribes and NrSubscribes are the number of unsubscribes and subscribes of the service during the current [Churn] window,
+	// and BaselineUnsubscribes is the average number of unsubscribes per window before it.
+	NrUnsubscribes       int64   `json:"nrUnsubscribes,omitempty"`
+	NrSubscribes         int64   `json:"nrSubscribes,omitempty"`
+	BaselineUnsubscribes float64 `json:"baselineUnsubscribes,omitempty"`
+	// NrFailures is the number of consecutive canary pushes through the push service provider which failed (see [Canary]).
+	NrFailures int64 `json:"nrFailures,omitempty"`
+	// Date is the unix timestamp of the event.
+	Date int64 `json:"date"`
+}
+
+type webhookRequest struct {
+	config WebhookConfig
+	event  WebhookEvent
+}
+
+// webhookNotifier sends events to the webhooks of services in the background, so that application backends can keep their own state in sync.
+type webhookNotifier struct {
+	configs *WebhookConfigs
+	client  *http.Client
+	logger  log.Logger
+	queue   chan webhookRequest
+	// pending is the number of events which were queued but haven't been sent (or given up on) yet.
+	pending int64
+}
+
+func newWebhookNotifier(configs *WebhookConfigs, logger log.Logger) *webhookNotifier {
+	enabled := configs.Default.URL != ""
+	for _, c := range configs.ByService {
+		enabled = enabled || c.URL != ""
+	}
+	if !enabled {
+		return nil
+	}
+	n := &webhookNotifier{
+		configs: configs,
+		client:  &http.Client{Timeout: configs.Timeout},
+		logger:  logger,
+		queue:   make(chan webhookRequest, webhookQueueSize),
+	}
+	for i := 0; i < webhookWorkers; i++ {
+		go n.run()
+	}
+	return n
+}
+
+// Emit queues an event to be sent to the webhook of its service, if that webhook wants this type of event.
+func (n *webhookNotifier) Emit(event WebhookEvent) {
+	if n == nil {
+		return
+	}
+	config := n.configs.ForService(event.Service)
+	if !config.wants(event.Type) {
+		return
+	}
+	event.ID = randomUniqID()
+	event.Date = time.Now().Unix()
+	atomic.AddInt64(&n.pending, 1)
+	select {
+	case n.queue <- webhookRequest{config: config, event: event}:
+	default:
+		atomic.AddInt64(&n.pending, -1)
+		n.logger.Warnf("Service=%v Event=%v Dropped webhook: queue is full", event.Service, event.Type)
+	}
+}
+
+// Flush waits until every queued event is sent, or until the deadline. Returns false if some events weren't sent in time.
+func (n *webhookNotifier) Flush(deadline time.Time) bool {
+	if n == nil {
+		return true
+	}
+	return waitUntil(deadline, func() bool {
+		return atomic.LoadInt64(&n.pending) == 0
+	})
+}
+
+func (n *webhookNotifier) run() {
+	for req := range n.queue {
+		interval := webhookRetryInterval
+		for attempt := 1; ; attempt++ {
+			err := n.send(req.config, req.event)
+			if err == nil {
+				n.logger.Debugf("Service=%v Event=%v EventID=%v Sent webhook", req.event.Service, req.event.Type, req.event.ID)
+				break
+			}
+			if attempt >= n.configs.MaxAttempts {
+				n.logger.Errorf("Service=%v Event=%v EventID=%v Attempts=%v Failed to send webhook: %v", req.event.Service, req.event.Type, req.event.ID, attempt, err)
+				break
+			}
+			time.Sleep(interval)
+			interval *= 2
+		}
+		atomic.AddInt64(&n.pending, -1)
+	}
+}
+
+func (n *webhookNotifier) send(config WebhookConfig, event WebhookEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", config.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(event.Date, 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookEventHeader, event.Type)
+	req.Header.Set(WebhookTimestampHeader, timestamp)
+	if len(config.Secrets) > 0 {
+		req.Header.Set(WebhookSignatureHeader, webhookSignatures(config.Secrets, timestamp, body))
+	}
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("Unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// webhookSignatures returns the value of the X-Uniqush-Signature header of a webhook request: the comma separated signatures of every secret.
+func webhookSignatures(secrets []string, timestamp string, body []byte) string {
+	signatures := make([]string, len(secrets))
+	for i, secret := range secrets {
+		signatures[i] = signWebhook(secret, timestamp, body)
+	}
+	return strings.Join(signatures, ",")
+}
+
+// signWebhook returns the signature of a webhook request with a single secret.
+func signWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,87 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/uniqush/goconf/conf"
+	"github.com/uniqush/log"
+	"github.com/uniqush/uniqush-push/testutil"
+)
+
+func TestLoadWebhookConfigs(t *testing.T) {
+	c := conf.NewConfigFile()
+	c.AddOption("Webhooks", "url", "https://example.com/hook")
+	c.AddOption("Webhooks", "secret", "s3cret")
+	c.AddOption("Webhooks.MyService", "service", "MyService")
+	c.AddOption("Webhooks.MyService", "events", "token_invalidated, broadcast_completed")
+	c.AddOption("Webhooks.Rotated", "secret", "n3w, s3cret")
+	configs, err := LoadWebhookConfigs(c)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	testutil.ExpectEquals(t, WebhookConfig{URL: "https://example.com/hook", Secrets: []string{"s3cret"}}, configs.ForService("other"), "expected the [Webhooks] section to be used by default")
+	testutil.ExpectEquals(t, []string{"n3w", "s3cret"}, configs.ForService("rotated").Secrets, "expected a secret for each comma separated value")
+	expected := WebhookConfig{URL: "https://example.com/hook", Secrets: []string{"s3cret"}, Events: map[string]bool{WebhookTokenInvalidated: true, WebhookBroadcastCompleted: true}}
+	testutil.ExpectEquals(t, expected, configs.ForService("MyService"), "expected [Webhooks.<service>] to inherit from [Webhooks]")
+	testutil.ExpectEquals(t, false, configs.ForService("MyService").wants(WebhookDeliveryPointAdded), "expected unlisted events not to be sent")
+	testutil.ExpectEquals(t, configs.Default, configs.ForService("myservice"), "expected service names to be case sensitive")
+
+	c.AddOption("Webhooks", "events", "push_sent")
+	if _, err := LoadWebhookConfigs(c); err == nil {
+		t.Errorf("Expected an unknown event to be rejected")
+	}
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	received := make(chan *http.Request, 1)
+	bodies := make(chan []byte, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received <- r
+		bodies <- body
+	}))
+	defer server.Close()
+
+	configs := &WebhookConfigs{Default: WebhookConfig{URL: server.URL, Secrets: []string{"n3w", "s3cret"}}, Timeout: time.Second, MaxAttempts: 1}
+	n := newWebhookNotifier(configs, log.NewLogger(ioutil.Discard, "", log.LOGLEVEL_SILENT))
+	n.Emit(WebhookEvent{Type: WebhookTokenInvalidated, Service: "myservice", Subscriber: "user1", DeliveryPoint: "fcm:abc"})
+	testutil.ExpectEquals(t, true, n.Flush(time.Now().Add(5*time.Second)), "expected the webhook to be sent")
+
+	r := <-received
+	body := <-bodies
+	testutil.ExpectStringEquals(t, WebhookTokenInvalidated, r.Header.Get(WebhookEventHeader), "expected the event type header")
+	timestamp := r.Header.Get(WebhookTimestampHeader)
+	expectedSignature := signWebhook("n3w", timestamp, body) + "," + signWebhook("s3cret", timestamp, body)
+	testutil.ExpectStringEquals(t, expectedSignature, r.Header.Get(WebhookSignatureHeader), "expected the request to be signed with every secret")
+	var event WebhookEvent
+	if err := json.Unmarshal(body, &event); err != nil {
+		t.Fatalf("Invalid body %s: %v", body, err)
+	}
+	testutil.ExpectStringEquals(t, "fcm:abc", event.DeliveryPoint, "expected the event in the body")
+
+	var disabled *webhookNotifier
+	disabled.Emit(WebhookEvent{Type: WebhookTokenInvalidated})
+	testutil.ExpectEquals(t, (*webhookNotifier)(nil), newWebhookNotifier(&WebhookConfigs{}, nil), "expected webhooks without a url to be disabled")
+}
@@ -19,6 +19,7 @@ package srv
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -50,6 +51,8 @@ type pspLockRequest struct {
 
 type admPushService struct {
 	pspLock chan *pspLockRequest
+	// workers sends the pushes to each delivery point, so that large pushes don't start a goroutine for each of them.
+	workers *push.WorkerPool
 }
 
 var _ push.PushServiceType = &admPushService{}
@@ -57,6 +60,7 @@ var _ push.PushServiceType = &admPushService{}
 func newADMPushService() *admPushService {
 	ret := new(admPushService)
 	ret.pspLock = make(chan *pspLockRequest)
+	ret.workers = push.NewWorkerPool(push.DefaultPushWorkers)
 	go admPspLocker(ret.pspLock)
 	return ret
 }
@@ -77,6 +81,7 @@ func (adm *admPushService) Name() string {
 func (adm *admPushService) SetErrorReportChan(errChan chan<- push.Error) {
 }
 func (adm *admPushService) SetPushServiceConfig(c *push.PushServiceConfig) {
+	adm.workers = push.NewWorkerPoolFromConfig(c)
 }
 
 func (adm *admPushService) BuildPushServiceProviderFromMap(kv map[string]string, psp *push.PushServiceProvider) error {
@@ -116,6 +121,15 @@ func (adm *admPushService) BuildDeliveryPointFromMap(kv map[string]string, dp *p
 	return nil
 }
 
+// RefreshToken sets the registration id which dp is pushed to.
+func (adm *admPushService) RefreshToken(dp *push.DeliveryPoint, token string) error {
+	if token == "" {
+		return errors.New("NoRegId")
+	}
+	dp.VolatileData["regid"] = token
+	return nil
+}
+
 func admPspLocker(lockChan <-chan *pspLockRequest) {
 	pspLockMap := make(map[string]*push.PushServiceProvider, 10)
 	for req := range lockChan {
@@ -190,15 +204,17 @@ func requestToken(psp *push.PushServiceProvider) push.Error {
 	form.Set("client_secret", cserect)
 	req, err := http.NewRequest("POST", admTokenURL, bytes.NewBufferString(form.Encode()))
 	if err != nil {
-		return push.NewErrorf("NewRequest error: %v", err)
+		return push.WrapError("NewRequest error", err)
 	}
 	defer req.Body.Close()
 	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
 
 	client := &http.Client{}
+	start := time.Now()
 	resp, err := client.Do(req)
+	push.ObserveRequest("adm", req, start, resp, err)
 	if err != nil {
-		return push.NewErrorf("Do error: %v", err)
+		return push.WrapError("Do error", err)
 	}
 
 	defer resp.Body.Close()
@@ -289,7 +305,11 @@ func admURL(dp *push.DeliveryPoint) (url string, err push.Error) {
 		err = push.NewError("nil dp")
 		return
 	}
-	if regid, ok := dp.FixedData["regid"]; ok {
+	regid, ok := dp.VolatileData["regid"]
+	if !ok {
+		regid, ok = dp.FixedData["regid"]
+	}
+	if ok {
 		url = fmt.Sprintf("%v%v/messages", admServiceURL, regid)
 	} else {
 		err = push.NewBadDeliveryPointWithDetails(dp, "empty delivery point")
@@ -327,16 +347,23 @@ type admPushFailResponse struct {
 	Reason string `json:"reason"`
 }
 
-func admSinglePush(psp *push.PushServiceProvider, dp *push.DeliveryPoint, data []byte, notif *push.Notification) (string, push.Error) {
+// admSinglePush sends data to dp. The request is canceled when ctx is done.
+func admSinglePush(ctx context.Context, psp *push.PushServiceProvider, dp *push.DeliveryPoint, data []byte, notif *push.Notification) (string, push.Error) {
 	client := &http.Client{}
 	req, err := admNewRequest(psp, dp, data)
 	if err != nil {
 		return "", err
 	}
 	defer req.Body.Close()
+	req = req.WithContext(ctx)
+	start := time.Now()
 	resp, httpErr := client.Do(req)
+	push.ObserveRequest("adm", req, start, resp, httpErr)
 	if httpErr != nil {
-		return "", push.NewErrorf("Failed to send adm push: %v", httpErr.Error())
+		if ctx.Err() != nil {
+			return "", push.WrapError("Canceled sending to adm", ctx.Err())
+		}
+		return "", push.WrapError("Failed to send adm push", httpErr)
 	}
 	defer resp.Body.Close()
 
@@ -360,7 +387,7 @@ func admSinglePush(psp *push.PushServiceProvider, dp *push.DeliveryPoint, data [
 
 		body, ioErr := ioutil.ReadAll(resp.Body)
 		if ioErr != nil {
-			return "", push.NewErrorf("Failed to read adm response: %v", err)
+			return "", push.WrapError("Failed to read adm response", ioErr)
 		}
 
 		var fail admPushFailResponse
@@ -388,6 +415,21 @@ func admSinglePush(psp *push.PushServiceProvider, dp *push.DeliveryPoint, data [
 	return id, nil
 }
 
+// ReloadPushServiceConfig resizes the pool of workers sending pushes to push_workers.
+func (adm *admPushService) ReloadPushServiceConfig(c *push.PushServiceConfig) {
+	adm.workers.Resize(push.PushWorkersFromConfig(c))
+}
+
+// ValidateCredentials requests an access token with the client id and secret of psp, returning an error if ADM rejects them.
+func (adm *admPushService) ValidateCredentials(psp *push.PushServiceProvider) error {
+	switch err := requestToken(psp).(type) {
+	case nil, *push.PushServiceProviderUpdate:
+		return nil
+	default:
+		return err
+	}
+}
+
 func (adm *admPushService) lockPsp(psp *push.PushServiceProvider) (*push.PushServiceProvider, push.Error) {
 	respCh := make(chan *pspLockResponse)
 	req := &pspLockRequest{
@@ -410,7 +452,7 @@ func (adm *admPushService) notifToJSON(notif *push.Notification) ([]byte, push.E
 
 	data, jsonErr := json.Marshal(msg)
 	if jsonErr != nil {
-		return nil, push.NewErrorf("Failed to marshal message: %v", jsonErr)
+		return nil, push.WrapError("Failed to marshal message", jsonErr)
 	}
 	return data, nil
 }
@@ -420,13 +462,18 @@ func (adm *admPushService) Preview(notif *push.Notification) ([]byte, push.Error
 }
 
 func (adm *admPushService) Push(psp *push.PushServiceProvider, dpQueue <-chan *push.DeliveryPoint, resQueue chan<- *push.Result, notif *push.Notification) {
+	adm.PushContext(context.Background(), psp, dpQueue, resQueue, notif)
+}
+
+// PushContext is Push, with the requests to ADM canceled when ctx is done.
+func (adm *admPushService) PushContext(ctx context.Context, psp *push.PushServiceProvider, dpQueue <-chan *push.DeliveryPoint, resQueue chan<- *push.Result, notif *push.Notification) {
 	defer close(resQueue)
 	defer func() {
 		for range dpQueue {
 		}
 	}()
 
-	res := new(push.Result)
+	res := push.NewResult()
 	res.Content = notif
 	res.Provider = psp
 
@@ -438,6 +485,10 @@ func (adm *admPushService) Push(psp *push.PushServiceProvider, dpQueue <-chan *p
 		if _, ok := err.(*push.PushServiceProviderUpdate); !ok {
 			return
 		}
+		// The result now belongs to the receiver, which may release it.
+		res = push.NewResult()
+		res.Content = notif
+		res.Provider = psp
 	}
 	data, err := adm.notifToJSON(notif)
 
@@ -452,15 +503,16 @@ func (adm *admPushService) Push(psp *push.PushServiceProvider, dpQueue <-chan *p
 
 	for dp := range dpQueue {
 		wg.Add(1)
-		res := new(push.Result)
+		res := push.NewResult()
 		res.Content = notif
 		res.Provider = psp
 		res.Destination = dp
-		go func(dp *push.DeliveryPoint) {
-			res.MsgID, res.Err = admSinglePush(psp, dp, data, notif)
+		dp := dp
+		adm.workers.Go(func() {
+			res.MsgID, res.Err = admSinglePush(ctx, psp, dp, data, notif)
 			resQueue <- res
 			wg.Done()
-		}(dp)
+		})
 	}
 	wg.Wait()
 }
@@ -50,6 +50,8 @@ type BinaryPushRequestProcessor struct {
 	poolSize   int
 	reqLock    sync.RWMutex
 	finished   bool
+	// workers sends the payloads of a request to each device token, so that large requests don't start a goroutine for each of them.
+	workers *push.WorkerPool
 
 	// connManagerMaker is called to create a ConnManager for a given push.PushServiceProvider
 	connManagerMaker func(psp *push.PushServiceProvider, resultChan chan<- *common.APNSResult) ConnManager
@@ -68,6 +70,7 @@ func NewRequestProcessor(poolSize int) *BinaryPushRequestProcessor {
 		connManagerMaker: newAPNSConnManager,
 		feedbackChecker:  feedbackChecker,
 		poolSize:         poolSize,
+		workers:          push.NewWorkerPool(push.DefaultPushWorkers),
 		finished:         false,
 	}
 	ret.wgFinalize.Add(1)
@@ -115,6 +118,12 @@ func (prp *BinaryPushRequestProcessor) SetPushServiceConfig(c *push.PushServiceC
 		}
 		prp.poolSize = poolSize
 	}
+	prp.workers = push.NewWorkerPoolFromConfig(c)
+}
+
+// ReloadPushServiceConfig resizes the pool of workers to push_workers. The pool of connections (pool_size) isn't resized.
+func (prp *BinaryPushRequestProcessor) ReloadPushServiceConfig(c *push.PushServiceConfig) {
+	prp.workers.Resize(push.PushWorkersFromConfig(c))
 }
 
 // AddRequest will asynchronously send the requested pushes to the external push service.
@@ -295,10 +304,11 @@ func (prp *BinaryPushRequestProcessor) multiPush(req *common.PushRequest, worker
 
 	for i, token := range req.Devtokens {
 		mid := req.GetID(i)
-		go func(mid uint32, token []byte) {
+		token := token
+		prp.workers.Go(func() {
 			prp.singlePush(req.Payload, token, req.Expiry, mid, workerpool, req.ErrChan)
 			wg.Done()
-		}(mid, token)
+		})
 	}
 	wg.Wait()
 }
@@ -389,7 +399,10 @@ func (prp *BinaryPushRequestProcessor) pushWorkerGroup(psp *push.PushServiceProv
 			}
 
 			for _, dp := range req.DPList {
-				if key, ok := dp.FixedData["devtoken"]; ok {
+				// Feedback has the token which was pushed to, which was refreshed if it is in the volatile data.
+				if key, ok := dp.VolatileData["devtoken"]; ok {
+					dpCache.Set(key, dp)
+				} else if key, ok := dp.FixedData["devtoken"]; ok {
 					dpCache.Set(key, dp)
 				}
 			}
@@ -18,6 +18,8 @@
 package common
 
 import (
+	"context"
+
 	"github.com/uniqush/uniqush-push/push"
 )
 
@@ -52,6 +54,10 @@ type PushRequest struct {
 	DPList  []*push.DeliveryPoint
 	ErrChan chan<- push.Error
 	ResChan chan<- *APNSResult
+
+	// Context cancels the HTTP/2 requests of the push when it is done. It is nil if they can't be canceled.
+	// The binary API writes to a shared connection, so a push sent with it can't be canceled once it was added.
+	Context context.Context
 }
 
 // GetID determines the message id associated with a given dev token's index. This is used by the binary protocol.
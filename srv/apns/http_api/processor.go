@@ -33,6 +33,8 @@ type HTTPPushRequestProcessor struct {
 	clients       map[string]HTTPClient
 	clientsLock   sync.RWMutex
 	clientFactory ClientFactory // can be overridden by test
+	// workers sends the requests to each device token, so that large requests don't start a goroutine for each of them.
+	workers *push.WorkerPool
 }
 
 // NewRequestProcessor returns a new HTTPPushProcessor using net/http DefaultClient connection pool
@@ -40,6 +42,7 @@ func NewRequestProcessor() common.PushRequestProcessor {
 	return &HTTPPushRequestProcessor{
 		clients:       make(map[string]HTTPClient),
 		clientFactory: defaultClientFactory,
+		workers:       push.NewWorkerPool(push.DefaultPushWorkers),
 	}
 }
 
@@ -139,8 +142,15 @@ func (prp *HTTPPushRequestProcessor) Finalize() {
 // SetErrorReportChan will set the report chan used for asynchronous feedback that is not associated with a request. (not needed when using APNs's HTTP/2 API, but needed for the binary API)
 func (prp *HTTPPushRequestProcessor) SetErrorReportChan(errChan chan<- push.Error) {}
 
-// SetPushServiceConfig is called during initialization to provide the unserialized contents of uniqush.conf. (does nothing for cloud messaging)
-func (prp *HTTPPushRequestProcessor) SetPushServiceConfig(c *push.PushServiceConfig) {}
+// SetPushServiceConfig is called during initialization to provide the unserialized contents of uniqush.conf.
+func (prp *HTTPPushRequestProcessor) SetPushServiceConfig(c *push.PushServiceConfig) {
+	prp.workers = push.NewWorkerPoolFromConfig(c)
+}
+
+// ReloadPushServiceConfig resizes the pool of workers to push_workers.
+func (prp *HTTPPushRequestProcessor) ReloadPushServiceConfig(c *push.PushServiceConfig) {
+	prp.workers.Resize(push.PushWorkersFromConfig(c))
+}
 
 // sendRequests will send a push to one or more device tokens. It will send the response over ResChan or ErrChan.
 func (prp *HTTPPushRequestProcessor) sendRequests(request *common.PushRequest) {
@@ -192,8 +202,13 @@ func (prp *HTTPPushRequestProcessor) sendRequests(request *common.PushRequest) {
 			continue
 		}
 		httpRequest.Header = header
+		if request.Context != nil {
+			httpRequest = httpRequest.WithContext(request.Context)
+		}
 
-		go prp.sendRequest(wg, client, httpRequest, msgID, request.ErrChan, request.ResChan)
+		prp.workers.Go(func() {
+			prp.sendRequest(wg, client, httpRequest, msgID, request.ErrChan, request.ResChan)
+		})
 	}
 
 	wg.Wait()
@@ -202,8 +217,14 @@ func (prp *HTTPPushRequestProcessor) sendRequests(request *common.PushRequest) {
 func (prp *HTTPPushRequestProcessor) sendRequest(wg *sync.WaitGroup, client HTTPClient, request *http.Request, messageID uint32, errChan chan<- push.Error, resChan chan<- *common.APNSResult) {
 	defer wg.Done()
 
+	start := time.Now()
 	response, err := client.Do(request)
+	push.ObserveRequest("apns", request, start, response, err)
 	if err != nil {
+		if ctxErr := request.Context().Err(); ctxErr != nil {
+			errChan <- push.WrapError("Canceled sending to APNS", ctxErr)
+			return
+		}
 		errChan <- push.NewConnectionError(err)
 		return
 	}
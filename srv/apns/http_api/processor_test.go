@@ -2,6 +2,7 @@ package http_api // nolint: golint
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -258,6 +259,27 @@ func TestAddRequestPushFailConnectionError(t *testing.T) {
 	}
 }
 
+func TestAddRequestPushCanceled(t *testing.T) {
+	requestProcessor := newHTTPRequestProcessor()
+
+	request, errChan, _ := newPushRequest()
+	ctx, cancel := context.WithCancel(context.Background())
+	request.Context = ctx
+	mockAPNSRequest(requestProcessor, func(r *http.Request) (*http.Response, *mockResponse, error) {
+		cancel()
+		<-r.Context().Done()
+		return nil, nil, r.Context().Err()
+	})
+
+	requestProcessor.AddRequest(request)
+
+	err := <-errChan
+	report, ok := err.(*push.ErrorReport)
+	if !ok || report.Unwrap() != context.Canceled {
+		t.Fatal("Expected the request to be canceled, got", err)
+	}
+}
+
 func newMockJSONResponse(r *http.Request, status int, responseData *APNSErrorResponse) (*http.Response, *mockResponse, error) {
 	responseBytes, err := json.Marshal(responseData)
 	if err != nil {
@@ -99,7 +99,7 @@ func toAPNSPayload(n *push.Notification) ([]byte, push.Error) {
 	payload["aps"] = aps
 	j, err := util.MarshalJSONUnescaped(payload)
 	if err != nil {
-		return nil, push.NewErrorf("Failed to convert notification data to JSON: %v", err)
+		return nil, push.WrapError("Failed to convert notification data to JSON", err)
 	}
 	return j, nil
 }
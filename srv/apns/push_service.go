@@ -30,7 +30,10 @@
 package apns
 
 import (
+	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -152,6 +155,50 @@ func (ps *pushService) buildBinaryPushServiceProviderFromMap(kv map[string]strin
 	return nil
 }
 
+// ReloadPushServiceConfig passes the reloaded config to the request processors which can apply it (e.g. to resize their pools of workers).
+func (ps *pushService) ReloadPushServiceConfig(c *push.PushServiceConfig) {
+	for _, processor := range []common.PushRequestProcessor{ps.binaryRequestProcessor, ps.httpRequestProcessor} {
+		if reloader, ok := processor.(push.ConfigReloader); ok {
+			reloader.ReloadPushServiceConfig(c)
+		}
+	}
+}
+
+// oidUserID is the subject attribute of APNs certificates with the bundle id of the app (their topic).
+var oidUserID = asn1.ObjectIdentifier{0, 9, 2342, 19200300, 100, 1, 1}
+
+// ValidateCredentials returns an error if the certificate of psp isn't valid now, or if it isn't the certificate of the bundleid of psp.
+// APNs only checks certificates when connecting, so they are checked locally rather than with a push.
+func (ps *pushService) ValidateCredentials(psp *push.PushServiceProvider) error {
+	pair, err := tls.LoadX509KeyPair(psp.FixedData["cert"], psp.FixedData["key"])
+	if err != nil {
+		return fmt.Errorf("Cannot load the certificate and private key: %v", err)
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("Cannot parse the certificate: %v", err)
+	}
+	now := time.Now()
+	if now.Before(cert.NotBefore) {
+		return fmt.Errorf("The certificate %q isn't valid until %s", cert.Subject.CommonName, cert.NotBefore.UTC().Format(time.RFC3339))
+	}
+	if now.After(cert.NotAfter) {
+		return fmt.Errorf("The certificate %q expired at %s: renew it in the Apple developer account", cert.Subject.CommonName, cert.NotAfter.UTC().Format(time.RFC3339))
+	}
+	bundleid := psp.VolatileData["bundleid"]
+	if bundleid == "" {
+		return nil
+	}
+	for _, name := range cert.Subject.Names {
+		if name.Type.Equal(oidUserID) {
+			if topic, ok := name.Value.(string); ok && topic != bundleid {
+				return fmt.Errorf("The certificate %q is for the topic %s, not the bundleid %s", cert.Subject.CommonName, topic, bundleid)
+			}
+		}
+	}
+	return nil
+}
+
 func (ps *pushService) BuildDeliveryPointFromMap(kv map[string]string, dp *push.DeliveryPoint) error {
 	dp.AddCommonData(kv)
 	if devtoken, ok := kv["devtoken"]; ok && len(devtoken) > 0 {
@@ -166,6 +213,27 @@ func (ps *pushService) BuildDeliveryPointFromMap(kv map[string]string, dp *push.
 	return nil
 }
 
+// RefreshToken sets the device token which dp is pushed to.
+func (ps *pushService) RefreshToken(dp *push.DeliveryPoint, token string) error {
+	if token == "" {
+		return errors.New("NoDevToken")
+	}
+	if _, err := hex.DecodeString(token); err != nil {
+		return fmt.Errorf("Invalid delivery point: bad device token. %v", err)
+	}
+	dp.VolatileData["devtoken"] = token
+	return nil
+}
+
+// devtoken returns the device token of dp, which was refreshed if it is in the volatile data of dp.
+func devtoken(dp *push.DeliveryPoint) (string, bool) {
+	if token, ok := dp.VolatileData["devtoken"]; ok {
+		return token, true
+	}
+	token, ok := dp.FixedData["devtoken"]
+	return token, ok
+}
+
 func apnsresToError(apnsres *common.APNSResult, psp *push.PushServiceProvider, dp *push.DeliveryPoint) push.Error {
 	// TODO: If necessary, update this to account for HTTP2 result codes?
 	var err push.Error
@@ -231,12 +299,18 @@ func (ps *pushService) Preview(notif *push.Notification) ([]byte, push.Error) {
 // Push will read all of the delivery points to send to from dpQueue and send responses on resQueue before closing the channel. If the notification data is invalid,
 // it will send only one response.
 func (ps *pushService) Push(psp *push.PushServiceProvider, dpQueue <-chan *push.DeliveryPoint, resQueue chan<- *push.Result, notif *push.Notification) {
+	ps.PushContext(context.Background(), psp, dpQueue, resQueue, notif)
+}
+
+// PushContext is Push, but the push isn't sent if ctx is done once the delivery points were read, and the HTTP/2 requests to APNS are canceled when ctx is done.
+func (ps *pushService) PushContext(ctx context.Context, psp *push.PushServiceProvider, dpQueue <-chan *push.DeliveryPoint, resQueue chan<- *push.Result, notif *push.Notification) {
 	defer close(resQueue)
 	// Profiling
 	// ps.updateCheckPoint("")
 	var err push.Error
 	req := new(common.PushRequest)
 	req.PSP = psp
+	req.Context = ctx
 	req.Payload, err = toAPNSPayload(notif)
 
 	var requestProcessor common.PushRequestProcessor
@@ -266,10 +340,10 @@ func (ps *pushService) Push(psp *push.PushServiceProvider, dpQueue <-chan *push.
 			for range dpQueue {
 			}
 		}()
-		res := new(push.Result)
+		res := push.NewResult()
 		res.Provider = psp
 		res.Content = notif
-		res.Err = push.NewErrorf("Failed to create push: %v", err)
+		res.Err = push.WrapError("Failed to create push", err)
 		resQueue <- res
 		return
 	}
@@ -299,17 +373,17 @@ func (ps *pushService) Push(psp *push.PushServiceProvider, dpQueue <-chan *push.
 	dpList := make([]*push.DeliveryPoint, 0, 10)
 
 	for dp := range dpQueue {
-		res := new(push.Result)
+		res := push.NewResult()
 		res.Destination = dp
 		res.Provider = psp
 		res.Content = notif
-		devtoken, ok := dp.FixedData["devtoken"]
+		token, ok := devtoken(dp)
 		if !ok {
 			res.Err = push.NewBadDeliveryPointWithDetails(dp, "NoDevtoken")
 			resQueue <- res
 			continue
 		}
-		btoken, err := hex.DecodeString(devtoken)
+		btoken, err := hex.DecodeString(token)
 		if err != nil {
 			res.Err = push.NewBadDeliveryPointWithDetails(dp, err.Error())
 			resQueue <- res
@@ -320,6 +394,18 @@ func (ps *pushService) Push(psp *push.PushServiceProvider, dpQueue <-chan *push.
 		dpList = append(dpList, dp)
 	}
 
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		for _, dp := range dpList {
+			res := push.NewResult()
+			res.Provider = psp
+			res.Content = notif
+			res.Destination = dp
+			res.Err = push.WrapError("Canceled sending to APNS", ctxErr)
+			resQueue <- res
+		}
+		return
+	}
+
 	n := len(req.Devtokens)
 	lastID := ps.getMessageIds(n)
 	req.MaxMsgID = lastID
@@ -338,11 +424,11 @@ func (ps *pushService) Push(psp *push.PushServiceProvider, dpQueue <-chan *push.
 	// errChan closed means the message(s) is/are sent successfully to the APNs.
 	// However, we may have not yet receieved responses from APNS - those are sent on resChan
 	for err = range errChan {
-		res := new(push.Result)
+		res := push.NewResult()
 		res.Provider = psp
 		res.Content = notif
 		if _, ok := err.(*push.ErrorReport); ok {
-			res.Err = push.NewErrorf("Failed to send payload to APNS: %v", err)
+			res.Err = push.WrapError("Failed to send payload to APNS", err)
 		} else {
 			res.Err = err
 		}
@@ -357,7 +443,7 @@ func (ps *pushService) Push(psp *push.PushServiceProvider, dpQueue <-chan *push.
 
 	for i, dp := range dpList {
 		if dp != nil {
-			r := new(push.Result)
+			r := push.NewResult()
 			r.Provider = psp
 			r.Content = notif
 			r.Destination = dp
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/hex"
 	"fmt"
+	"strings"
 	"sync"
 	"testing"
 
@@ -412,6 +413,16 @@ func expectMapEquals(t *testing.T, expected map[string]string, actual map[string
 	}
 }
 
+func TestValidateCredentials(t *testing.T) {
+	psp, _, service, _ := commonAPNSMocks(APNSSuccess)
+	// The test certificate expired in 2022.
+	err := service.ValidateCredentials(psp)
+	if err == nil || !strings.Contains(err.Error(), "expired") {
+		t.Errorf("Expected the expired certificate to be rejected, got %v", err)
+	}
+	service.Finalize()
+}
+
 func TestBuildPushServiceProviderFromMap(t *testing.T) {
 	service, _, _ := newPushServiceWithErrorChannel(APNSSuccess)
 
@@ -0,0 +1,289 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+/*
+ * This contains the chat push service type, which posts pushes to the incoming webhooks of Slack or Microsoft Teams channels,
+ * so that one push can reach both the devices of an on-call team and their ops channel.
+ */
+
+package srv
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/uniqush/uniqush-push/push"
+	cm "github.com/uniqush/uniqush-push/srv/cloud_messaging"
+)
+
+const (
+	// chatRawPayloadKey is the key of a push request whose value is the JSON body posted to the webhooks as is, e.g. Slack blocks or a Teams card.
+	chatRawPayloadKey = "uniqush.payload.chat"
+	chatFormatSlack   = "slack"
+	chatFormatTeams   = "teams"
+	// chatMaxResponseBytes is how much of the response of a webhook is read, to report why a message was rejected.
+	chatMaxResponseBytes = 4096
+)
+
+// defaultChatWebhookHosts are the hosts of the incoming webhooks of Slack and Microsoft Teams. A leading "*." matches any subdomain.
+var defaultChatWebhookHosts = []string{"hooks.slack.com", "*.webhook.office.com"}
+
+type chatPushService struct {
+	client cm.HTTPClient
+	// workers posts the pushes to each webhook, so that large pushes don't start a goroutine for each of them.
+	workers *push.WorkerPool
+
+	// webhookHosts are the hosts webhooks can be on: defaultChatWebhookHosts and webhook_hosts of [chat].
+	// Since anyone who can subscribe chooses the URL of a webhook, other hosts (e.g. of the internal network) are rejected.
+	webhookHosts []string
+	mutex        sync.RWMutex
+}
+
+var _ push.PushServiceType = &chatPushService{}
+
+func newChatPushService() *chatPushService {
+	return &chatPushService{
+		client: &http.Client{
+			Timeout: 30 * time.Second,
+			// Webhooks don't redirect, and following a redirect would post to a host which wasn't checked.
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		},
+		workers:      push.NewWorkerPool(push.DefaultPushWorkers),
+		webhookHosts: defaultChatWebhookHosts,
+	}
+}
+
+// InstallChat registers the only instance of the chat push service. It is called only once.
+func InstallChat() {
+	psm := push.GetPushServiceManager()
+	err := psm.RegisterPushServiceType(newChatPushService())
+	if err != nil {
+		panic(fmt.Sprintf("Failed to install chat module: %v", err))
+	}
+}
+
+func (chat *chatPushService) Finalize() {}
+func (chat *chatPushService) Name() string {
+	return "chat"
+}
+func (chat *chatPushService) SetErrorReportChan(errChan chan<- push.Error) {
+}
+func (chat *chatPushService) SetPushServiceConfig(c *push.PushServiceConfig) {
+	chat.workers = push.NewWorkerPoolFromConfig(c)
+	chat.loadWebhookHosts(c)
+}
+
+// ReloadPushServiceConfig resizes the pool of workers sending pushes to push_workers, and reloads webhook_hosts.
+func (chat *chatPushService) ReloadPushServiceConfig(c *push.PushServiceConfig) {
+	chat.workers.Resize(push.PushWorkersFromConfig(c))
+	chat.loadWebhookHosts(c)
+}
+
+// loadWebhookHosts allows the comma separated hosts of webhook_hosts (e.g. chat.example.com or *.example.com) along with the default ones.
+func (chat *chatPushService) loadWebhookHosts(c *push.PushServiceConfig) {
+	configured, _ := c.GetString("webhook_hosts")
+	chat.setWebhookHosts(configured)
+}
+
+func (chat *chatPushService) setWebhookHosts(configured string) {
+	hosts := append([]string(nil), defaultChatWebhookHosts...)
+	for _, host := range strings.Split(configured, ",") {
+		if host = strings.ToLower(strings.TrimSpace(host)); host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+	chat.mutex.Lock()
+	chat.webhookHosts = hosts
+	chat.mutex.Unlock()
+}
+
+// allowsWebhook returns true if webhook is an https URL on one of the webhook hosts.
+func (chat *chatPushService) allowsWebhook(webhook string) bool {
+	u, err := url.Parse(webhook)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	chat.mutex.RLock()
+	defer chat.mutex.RUnlock()
+	for _, allowed := range chat.webhookHosts {
+		if host == allowed || (strings.HasPrefix(allowed, "*.") && strings.HasSuffix(host, allowed[1:])) {
+			return true
+		}
+	}
+	return false
+}
+
+func (chat *chatPushService) BuildPushServiceProviderFromMap(kv map[string]string, psp *push.PushServiceProvider) error {
+	if service, ok := kv["service"]; ok && len(service) > 0 {
+		psp.FixedData["service"] = service
+	} else {
+		return errors.New("NoService")
+	}
+	return nil
+}
+
+// BuildDeliveryPointFromMap builds the delivery point of the incoming webhook of a channel (webhook),
+// whose messages are formatted for Slack or Microsoft Teams (format=slack, the default, or format=teams).
+func (chat *chatPushService) BuildDeliveryPointFromMap(kv map[string]string, dp *push.DeliveryPoint) error {
+	err := dp.AddCommonData(kv)
+	if err != nil {
+		return err
+	}
+	webhook, ok := kv["webhook"]
+	if !ok || len(webhook) == 0 {
+		return errors.New("NoWebhook")
+	}
+	if !chat.allowsWebhook(webhook) {
+		return errors.New("InvalidWebhook: webhooks must be https URLs on hooks.slack.com, *.webhook.office.com or a host of webhook_hosts in [chat]")
+	}
+	dp.FixedData["webhook"] = webhook
+	format := kv["format"]
+	switch format {
+	case "":
+		format = chatFormatSlack
+	case chatFormatSlack, chatFormatTeams:
+	default:
+		return fmt.Errorf("InvalidFormat: %q", format)
+	}
+	dp.FixedData["format"] = format
+	return nil
+}
+
+// chatMessage returns the body posted to a webhook of format for notif: the payload of uniqush.payload.chat if set,
+// or a message with the msg (and title, if set) of the push.
+func chatMessage(notif *push.Notification, format string) ([]byte, push.Error) {
+	if raw, ok := notif.Data[chatRawPayloadKey]; ok {
+		if !json.Valid([]byte(raw)) {
+			return nil, push.NewBadNotificationWithDetails("invalid " + chatRawPayloadKey)
+		}
+		return []byte(raw), nil
+	}
+	text, title := notif.Data["msg"], notif.Data["title"]
+	if text == "" {
+		return nil, push.NewBadNotificationWithDetails("empty notification")
+	}
+	var message interface{}
+	if format == chatFormatTeams {
+		card := map[string]string{
+			"@type":    "MessageCard",
+			"@context": "https://schema.org/extensions",
+			"summary":  text,
+			"text":     text,
+		}
+		if title != "" {
+			card["summary"], card["title"] = title, title
+		}
+		message = card
+	} else {
+		if title != "" {
+			text = "*" + title + "*\n" + text
+		}
+		message = map[string]string{"text": text}
+	}
+	b, err := json.Marshal(message)
+	if err != nil {
+		return nil, push.WrapError("Failed to encode the message", err)
+	}
+	return b, nil
+}
+
+func (chat *chatPushService) Preview(notif *push.Notification) ([]byte, push.Error) {
+	return chatMessage(notif, chatFormatSlack)
+}
+
+func (chat *chatPushService) Push(psp *push.PushServiceProvider, dpQueue <-chan *push.DeliveryPoint, resQueue chan<- *push.Result, notif *push.Notification) {
+	chat.PushContext(context.Background(), psp, dpQueue, resQueue, notif)
+}
+
+// PushContext is Push, with the requests to the webhooks canceled when ctx is done.
+func (chat *chatPushService) PushContext(ctx context.Context, psp *push.PushServiceProvider, dpQueue <-chan *push.DeliveryPoint, resQueue chan<- *push.Result, notif *push.Notification) {
+	defer close(resQueue)
+	wg := sync.WaitGroup{}
+	for dp := range dpQueue {
+		wg.Add(1)
+		dp := dp
+		chat.workers.Go(func() {
+			defer wg.Done()
+			res := push.NewResult()
+			res.Content = notif
+			res.Provider = psp
+			res.Destination = dp
+			if message, err := chatMessage(notif, dp.FixedData["format"]); err != nil {
+				res.Err = err
+			} else {
+				res.Err = chat.post(ctx, psp, dp, message, notif)
+			}
+			resQueue <- res
+		})
+	}
+	wg.Wait()
+}
+
+// post sends a message to the webhook of dp, mapping the errors of Slack and Teams to errors of pushes.
+// The webhook is checked again, since webhook_hosts may have changed since dp was subscribed.
+func (chat *chatPushService) post(ctx context.Context, psp *push.PushServiceProvider, dp *push.DeliveryPoint, message []byte, notif *push.Notification) push.Error {
+	if !chat.allowsWebhook(dp.FixedData["webhook"]) {
+		return push.NewBadDeliveryPointWithDetails(dp, "InvalidWebhook")
+	}
+	req, err := http.NewRequest("POST", dp.FixedData["webhook"], bytes.NewReader(message))
+	if err != nil {
+		return push.NewBadDeliveryPointWithDetails(dp, "InvalidWebhook")
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+
+	start := time.Now()
+	resp, err := chat.client.Do(req)
+	// The format rather than the host of the webhook, which users choose.
+	push.ObserveRequestTo("chat", dp.FixedData["format"], start, resp, err)
+	if err != nil {
+		if urlErr, ok := err.(*url.Error); ok {
+			// The URL of the webhook is its credential, so it isn't included in the error.
+			err = urlErr.Err
+		}
+		return push.WrapError("Failed to post to the webhook", err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, chatMaxResponseBytes))
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusForbidden, resp.StatusCode == http.StatusNotFound, resp.StatusCode == http.StatusGone:
+		// The webhook was revoked, or its channel was deleted or archived.
+		return push.NewInvalidRegistrationUpdate(psp, dp)
+	case resp.StatusCode == http.StatusBadRequest, resp.StatusCode == http.StatusRequestEntityTooLarge:
+		return push.NewBadNotificationWithDetails(fmt.Sprintf("%d: %s", resp.StatusCode, strings.TrimSpace(string(body))))
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		retryAfter := time.Minute
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+			retryAfter = time.Duration(seconds) * time.Second
+		}
+		return push.NewRetryError(psp, dp, notif, retryAfter)
+	}
+	return push.NewErrorf("%d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+}
@@ -0,0 +1,147 @@
+package srv
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/uniqush/uniqush-push/push"
+	"github.com/uniqush/uniqush-push/testutil"
+)
+
+// mockChatWebhooks records the messages posted to the webhooks of channels, responding with the status of the path of the webhook (200 by default).
+type mockChatWebhooks struct {
+	mutex    sync.Mutex
+	messages map[string][]byte
+	statuses map[string]int
+}
+
+func (m *mockChatWebhooks) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if status, ok := m.statuses[r.URL.Path]; ok {
+		if status == http.StatusTooManyRequests {
+			w.Header().Set("Retry-After", "30")
+		}
+		w.WriteHeader(status)
+		w.Write([]byte("channel_not_found"))
+		return
+	}
+	m.messages[r.URL.Path] = body
+	w.Write([]byte("ok"))
+}
+
+func newChatDeliveryPoint(t *testing.T, chat *chatPushService, webhook, format string) *push.DeliveryPoint {
+	dp := push.NewEmptyDeliveryPoint()
+	if err := chat.BuildDeliveryPointFromMap(map[string]string{"service": "myservice", "subscriber": "ops", "webhook": webhook, "format": format}, dp); err != nil {
+		t.Fatal(err)
+	}
+	return dp
+}
+
+func chatPush(ctx context.Context, chat *chatPushService, dps []*push.DeliveryPoint, data map[string]string) map[string]*push.Result {
+	dpQueue := make(chan *push.DeliveryPoint, len(dps))
+	resQueue := make(chan *push.Result, len(dps))
+	for _, dp := range dps {
+		dpQueue <- dp
+	}
+	close(dpQueue)
+	notif := push.NewEmptyNotification()
+	notif.Data = data
+	chat.PushContext(ctx, push.NewEmptyPushServiceProvider(), dpQueue, resQueue, notif)
+	results := make(map[string]*push.Result)
+	for res := range resQueue {
+		results[res.Destination.FixedData["webhook"]] = res
+	}
+	return results
+}
+
+func TestChatPush(t *testing.T) {
+	mock := &mockChatWebhooks{messages: make(map[string][]byte), statuses: map[string]int{"/archived": http.StatusGone, "/throttled": http.StatusTooManyRequests, "/invalid": http.StatusBadRequest}}
+	server := httptest.NewTLSServer(mock)
+	defer server.Close()
+	chat := newChatPushService()
+	chat.client = server.Client()
+	chat.setWebhookHosts("127.0.0.1")
+	var dps []*push.DeliveryPoint
+	for _, path := range []string{"/slack", "/archived", "/throttled", "/invalid"} {
+		dps = append(dps, newChatDeliveryPoint(t, chat, server.URL+path, ""))
+	}
+	dps = append(dps, newChatDeliveryPoint(t, chat, server.URL+"/teams", "teams"))
+
+	results := chatPush(context.Background(), chat, dps, map[string]string{"msg": "Disk full on db1", "title": "Alert"})
+	testutil.ExpectEquals(t, nil, results[server.URL+"/slack"].Err, "unexpected error")
+	testutil.ExpectStringEquals(t, `{"text":"*Alert*\nDisk full on db1"}`, string(mock.messages["/slack"]), "unexpected Slack message")
+	var card map[string]string
+	json.Unmarshal(mock.messages["/teams"], &card)
+	testutil.ExpectStringEquals(t, "MessageCard", card["@type"], "expected a Teams card")
+	testutil.ExpectStringEquals(t, "Alert", card["title"], "unexpected title")
+	testutil.ExpectStringEquals(t, "Disk full on db1", card["text"], "unexpected text")
+	if _, ok := results[server.URL+"/archived"].Err.(*push.InvalidRegistrationUpdate); !ok {
+		t.Errorf("expected the webhook of an archived channel to be removed, got %v", results[server.URL+"/archived"].Err)
+	}
+	if err, ok := results[server.URL+"/throttled"].Err.(*push.RetryError); !ok {
+		t.Errorf("expected a throttled push to be retried, got %v", results[server.URL+"/throttled"].Err)
+	} else {
+		testutil.ExpectEquals(t, "30s", err.After.String(), "expected Retry-After to be used")
+	}
+	if _, ok := results[server.URL+"/invalid"].Err.(*push.BadNotification); !ok {
+		t.Errorf("expected a rejected message to be a bad notification, got %v", results[server.URL+"/invalid"].Err)
+	}
+
+	results = chatPush(context.Background(), chat, dps[:1], map[string]string{"msg": "ignored", chatRawPayloadKey: `{"blocks":[]}`})
+	testutil.ExpectEquals(t, nil, results[server.URL+"/slack"].Err, "unexpected error")
+	testutil.ExpectStringEquals(t, `{"blocks":[]}`, string(mock.messages["/slack"]), "expected uniqush.payload.chat to be posted as is")
+	results = chatPush(context.Background(), chat, dps[:1], map[string]string{"title": "Alert"})
+	if _, ok := results[server.URL+"/slack"].Err.(*push.BadNotification); !ok {
+		t.Errorf("expected a push without msg to be rejected, got %v", results[server.URL+"/slack"].Err)
+	}
+}
+
+func TestChatPushContextCanceled(t *testing.T) {
+	chat := newChatPushService()
+	dp := newChatDeliveryPoint(t, chat, "https://hooks.slack.com/services/T0/B0/secret", "")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	res := chatPush(ctx, chat, []*push.DeliveryPoint{dp}, map[string]string{"msg": "hello"})[dp.FixedData["webhook"]]
+	if res.Err == nil {
+		t.Fatal("expected the push to fail")
+	}
+	if strings.Contains(res.Err.Error(), "secret") {
+		t.Errorf("expected the URL of the webhook not to be in the error, got %v", res.Err)
+	}
+}
+
+func TestChatBuildDeliveryPoint(t *testing.T) {
+	chat := newChatPushService()
+	for _, kv := range []map[string]string{
+		{"service": "myservice", "subscriber": "ops"},
+		{"service": "myservice", "subscriber": "ops", "webhook": "hooks.slack.com/services/T0/B0/secret"},
+		{"service": "myservice", "subscriber": "ops", "webhook": "https://hooks.slack.com/services/T0/B0/secret", "format": "irc"},
+		{"service": "myservice", "subscriber": "ops", "webhook": "http://hooks.slack.com/services/T0/B0/secret"},
+		{"service": "myservice", "subscriber": "ops", "webhook": "https://169.254.169.254/latest/meta-data/"},
+		{"service": "myservice", "subscriber": "ops", "webhook": "https://webhook.office.com.example.org/webhookb2/secret"},
+		{"service": "myservice", "subscriber": "ops", "webhook": "https://chat.example.com/hooks/secret"},
+	} {
+		if err := chat.BuildDeliveryPointFromMap(kv, push.NewEmptyDeliveryPoint()); err == nil {
+			t.Errorf("expected %v to be rejected", kv)
+		}
+	}
+	dp := newChatDeliveryPoint(t, chat, "https://hooks.slack.com/services/T0/B0/secret", "")
+	testutil.ExpectStringEquals(t, chatFormatSlack, dp.FixedData["format"], "expected Slack to be the default format")
+	newChatDeliveryPoint(t, chat, "https://contoso.webhook.office.com/webhookb2/secret", "teams")
+
+	chat.setWebhookHosts("chat.example.com")
+	dp = newChatDeliveryPoint(t, chat, "https://chat.example.com/hooks/secret", "")
+	chat.setWebhookHosts("")
+	res := chatPush(context.Background(), chat, []*push.DeliveryPoint{dp}, map[string]string{"msg": "hello"})[dp.FixedData["webhook"]]
+	if _, ok := res.Err.(*push.BadDeliveryPoint); !ok {
+		t.Errorf("expected a webhook on a host which is no longer allowed not to be posted to, got %v", res.Err)
+	}
+}
@@ -23,6 +23,7 @@ package cloud_messaging // nolint: golint
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"errors"
@@ -30,6 +31,7 @@ import (
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
@@ -38,6 +40,9 @@ import (
 	"github.com/uniqush/uniqush-push/util"
 )
 
+// instanceIDInfoURL is the endpoint of the Instance ID API, used to look up whether GCM/FCM still recognizes a registration id.
+const instanceIDInfoURL = "https://iid.googleapis.com/iid/info/"
+
 // HTTPClient is a mockable interface for the parts of http.Client used by the GCM and FCM modules.
 type HTTPClient interface {
 	Do(*http.Request) (*http.Response, error)
@@ -61,8 +66,21 @@ type PushServiceBase struct {
 	serviceURL string
 	// const: "gcm" or "fcm", for API requests to uniqush and API responses, as well as logging.
 	pushServiceName string
+	// batchSize is the maximum number of delivery points sent in one request (batch_size in the config file).
+	batchSize int
+	// batchDelay is how long the first delivery point of a batch waits for more delivery points, before the batch is sent (batch_delay_ms in the config file).
+	batchDelay time.Duration
 }
 
+const (
+	// maxBatchSize is the maximum number of registration ids GCM and FCM accept in one request.
+	maxBatchSize = 1000
+	// DefaultBatchSize is the number of delivery points sent in one request, unless batch_size is set.
+	DefaultBatchSize = 500
+	// DefaultBatchDelay is how long delivery points wait for a batch to fill up, unless batch_delay_ms is set.
+	DefaultBatchDelay = 50 * time.Millisecond
+)
+
 // Finalize will close all open HTTPS connections to GCM/FCM.
 func (psb *PushServiceBase) Finalize() {
 	if client, isClient := psb.client.(*http.Client); isClient {
@@ -101,6 +119,8 @@ func MakePushServiceBase(initialism string, rawPayloadKey string, rawNotificatio
 		rawNotificationKey: rawNotificationKey,
 		serviceURL:         serviceURL,
 		pushServiceName:    pushServiceName,
+		batchSize:          DefaultBatchSize,
+		batchDelay:         DefaultBatchDelay,
 	}
 }
 
@@ -252,7 +272,7 @@ func (psb *PushServiceBase) ToCMPayload(notif *push.Notification, regIds []strin
 
 	jpayload, e0 := payload.MarshalSafe()
 	if e0 != nil {
-		return nil, push.NewErrorf("Error converting payload to JSON: %v", e0)
+		return nil, push.WrapError("Error converting payload to JSON", e0)
 	}
 	return jpayload, nil
 }
@@ -268,7 +288,7 @@ func extractRegIds(dpList []*push.DeliveryPoint) []string {
 
 func sendErrToEachDP(psp *push.PushServiceProvider, dpList []*push.DeliveryPoint, resQueue chan<- *push.Result, notif *push.Notification, err push.Error) {
 	for _, dp := range dpList {
-		res := new(push.Result)
+		res := push.NewResult()
 		res.Provider = psp
 		res.Content = notif
 
@@ -278,7 +298,7 @@ func sendErrToEachDP(psp *push.PushServiceProvider, dpList []*push.DeliveryPoint
 	}
 }
 
-func (psb *PushServiceBase) multicast(psp *push.PushServiceProvider, dpList []*push.DeliveryPoint, resQueue chan<- *push.Result, notif *push.Notification) {
+func (psb *PushServiceBase) multicast(ctx context.Context, psp *push.PushServiceProvider, dpList []*push.DeliveryPoint, resQueue chan<- *push.Result, notif *push.Notification) {
 	if len(dpList) == 0 {
 		return
 	}
@@ -296,10 +316,11 @@ func (psb *PushServiceBase) multicast(psp *push.PushServiceProvider, dpList []*p
 		defer req.Body.Close()
 	}
 	if e1 != nil {
-		httpErr := push.NewErrorf("Error constructing HTTP request: %v", e1)
+		httpErr := push.WrapError("Error constructing HTTP request", e1)
 		sendErrToEachDP(psp, dpList, resQueue, notif, httpErr)
 		return
 	}
+	req = req.WithContext(ctx)
 
 	apikey := psp.VolatileData["apikey"]
 
@@ -307,19 +328,23 @@ func (psb *PushServiceBase) multicast(psp *push.PushServiceProvider, dpList []*p
 	req.Header.Set("Content-Type", "application/json")
 
 	// Perform a request, using a connection from the connection pool of a shared http.Client instance.
+	start := time.Now()
 	r, e2 := psb.client.Do(req)
+	push.ObserveRequest(psb.pushServiceName, req, start, r, e2)
 	if r != nil {
 		defer r.Body.Close()
 	}
 	// TODO: Move this into two steps: sending and processing result
 	if e2 != nil {
 		for _, dp := range dpList {
-			res := new(push.Result)
+			res := push.NewResult()
 			res.Provider = psp
 			res.Content = notif
 
 			res.Destination = dp
-			if err, ok := e2.(net.Error); ok {
+			if ctx.Err() != nil {
+				res.Err = push.WrapError(fmt.Sprintf("Canceled sending to %s", psb.pushServiceName), ctx.Err())
+			} else if err, ok := e2.(net.Error); ok {
 				// Temporary error. Try to recover
 				if err.Temporary() {
 					after := 3 * time.Second
@@ -331,7 +356,7 @@ func (psb *PushServiceBase) multicast(psp *push.PushServiceProvider, dpList []*p
 				res.Err = push.NewRetryErrorWithReason(psp, dp, notif, after, err)
 
 			} else {
-				res.Err = push.NewErrorf("Unrecoverable HTTP error sending to %s: %v", psb.pushServiceName, e2)
+				res.Err = push.WrapError(fmt.Sprintf("Unrecoverable HTTP error sending to %s", psb.pushServiceName), e2)
 			}
 			resQueue <- res
 		}
@@ -341,7 +366,7 @@ func (psb *PushServiceBase) multicast(psp *push.PushServiceProvider, dpList []*p
 	newAuthToken := r.Header.Get("Update-Client-Auth")
 	if newAuthToken != "" && apikey != newAuthToken {
 		psp.VolatileData["apikey"] = newAuthToken
-		res := new(push.Result)
+		res := push.NewResult()
 		res.Provider = psp
 		res.Content = notif
 		res.Err = push.NewPushServiceProviderUpdate(psp)
@@ -353,7 +378,7 @@ func (psb *PushServiceBase) multicast(psp *push.PushServiceProvider, dpList []*p
 		/* TODO extract the retry after field */
 		after := 0 * time.Second
 		for _, dp := range dpList {
-			res := new(push.Result)
+			res := push.NewResult()
 			res.Provider = psp
 			res.Content = notif
 			res.Destination = dp
@@ -364,7 +389,7 @@ func (psb *PushServiceBase) multicast(psp *push.PushServiceProvider, dpList []*p
 		return
 	case 401:
 		err := push.NewBadPushServiceProviderWithDetails(psp, fmt.Sprintf("push service credentials rejected by %s", psb.initialism))
-		res := new(push.Result)
+		res := push.NewResult()
 		res.Provider = psp
 		res.Content = notif
 		res.Err = err
@@ -372,7 +397,7 @@ func (psb *PushServiceBase) multicast(psp *push.PushServiceProvider, dpList []*p
 		return
 	case 400:
 		err := push.NewBadNotificationWithDetails(fmt.Sprintf("push notification payload rejected by %s", psb.initialism))
-		res := new(push.Result)
+		res := push.NewResult()
 		res.Provider = psp
 		res.Content = notif
 		res.Err = err
@@ -382,10 +407,10 @@ func (psb *PushServiceBase) multicast(psp *push.PushServiceProvider, dpList []*p
 
 	contents, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		res := new(push.Result)
+		res := push.NewResult()
 		res.Provider = psp
 		res.Content = notif
-		res.Err = push.NewErrorf("Failed to read %s response: %v", psb.initialism, err)
+		res.Err = push.WrapError(fmt.Sprintf("Failed to read %s response", psb.initialism), err)
 		resQueue <- res
 		return
 	}
@@ -394,10 +419,10 @@ func (psb *PushServiceBase) multicast(psp *push.PushServiceProvider, dpList []*p
 	err = json.Unmarshal(contents, &result)
 
 	if err != nil {
-		res := new(push.Result)
+		res := push.NewResult()
 		res.Provider = psp
 		res.Content = notif
-		res.Err = push.NewErrorf("Failed to decode %s response: %v", psb.initialism, err)
+		res.Err = push.WrapError(fmt.Sprintf("Failed to decode %s response", psb.initialism), err)
 		resQueue <- res
 		return
 	}
@@ -415,27 +440,27 @@ func (psb *PushServiceBase) handleCMMulticastResults(psp *push.PushServiceProvid
 			switch errmsg {
 			case "Unavailable":
 				after, _ := time.ParseDuration("2s")
-				res := new(push.Result)
+				res := push.NewResult()
 				res.Provider = psp
 				res.Content = notif
 				res.Destination = dp
 				res.Err = push.NewRetryError(psp, dp, notif, after)
 				resQueue <- res
 			case "NotRegistered":
-				res := new(push.Result)
+				res := push.NewResult()
 				res.Provider = psp
 				res.Err = push.NewUnsubscribeUpdate(psp, dp)
 				res.Content = notif
 				res.Destination = dp
 				resQueue <- res
 			case "InvalidRegistration":
-				res := new(push.Result)
+				res := push.NewResult()
 				res.Err = push.NewInvalidRegistrationUpdate(psp, dp)
 				res.Content = notif
 				res.Destination = dp
 				resQueue <- res
 			default:
-				res := new(push.Result)
+				res := push.NewResult()
 				res.Err = push.NewErrorf("FCMError: %v", errmsg)
 				res.Provider = psp
 				res.Content = notif
@@ -445,7 +470,7 @@ func (psb *PushServiceBase) handleCMMulticastResults(psp *push.PushServiceProvid
 		}
 		if newregid, ok := r["registration_id"]; ok {
 			dp.VolatileData["regid"] = newregid
-			res := new(push.Result)
+			res := push.NewResult()
 			res.Err = push.NewDeliveryPointUpdate(dp)
 			res.Provider = psp
 			res.Content = notif
@@ -453,7 +478,7 @@ func (psb *PushServiceBase) handleCMMulticastResults(psp *push.PushServiceProvid
 			resQueue <- res
 		}
 		if msgid, ok := r["message_id"]; ok {
-			res := new(push.Result)
+			res := push.NewResult()
 			res.Provider = psp
 			res.Content = notif
 			res.Destination = dp
@@ -464,47 +489,167 @@ func (psb *PushServiceBase) handleCMMulticastResults(psp *push.PushServiceProvid
 }
 
 // Push sends a push notification to 1 or more delivery points in dpQueue asynchronously, and sends results on resQueue.
+// Delivery points are sent in batches of up to batchSize, and a batch is sent once its first delivery point has waited for batchDelay,
+// so that large pushes are sent while the remaining delivery points are still being fetched, without sending a request per delivery point.
 func (psb *PushServiceBase) Push(psp *push.PushServiceProvider, dpQueue <-chan *push.DeliveryPoint, resQueue chan<- *push.Result, notif *push.Notification) {
+	psb.PushContext(context.Background(), psp, dpQueue, resQueue, notif)
+}
 
-	maxNrDst := 1000
-	dpList := make([]*push.DeliveryPoint, 0, maxNrDst)
-	for dp := range dpQueue {
-		if psp.PushServiceName() != dp.PushServiceName() || psp.PushServiceName() != psb.pushServiceName {
-			res := new(push.Result)
-			res.Provider = psp
-			res.Destination = dp
-			res.Content = notif
-			res.Err = push.NewIncompatibleError()
-			resQueue <- res
-			continue
-		}
-		if _, ok := dp.VolatileData["regid"]; ok {
-			dpList = append(dpList, dp)
-		} else if regid, ok := dp.FixedData["regid"]; ok {
-			dp.VolatileData["regid"] = regid
-			dpList = append(dpList, dp)
-		} else {
-			res := new(push.Result)
-			res.Provider = psp
-			res.Destination = dp
-			res.Content = notif
-			res.Err = push.NewBadDeliveryPointWithDetails(dp, fmt.Sprintf("uniqush delivery point for %s is missing regid", psb.initialism))
-			resQueue <- res
-			continue
+// PushContext is Push, with the requests to GCM/FCM canceled when ctx is done.
+func (psb *PushServiceBase) PushContext(ctx context.Context, psp *push.PushServiceProvider, dpQueue <-chan *push.DeliveryPoint, resQueue chan<- *push.Result, notif *push.Notification) {
+	// Batches are sent one at a time, while the next batch is being filled.
+	batches := make(chan []*push.DeliveryPoint, 1)
+	sent := make(chan struct{})
+	go func() {
+		for dpList := range batches {
+			psb.multicast(ctx, psp, dpList, resQueue, notif)
 		}
+		close(sent)
+	}()
+
+	var dpList []*push.DeliveryPoint
+	var deadline <-chan time.Time
+	sendBatch := func() {
+		batches <- dpList
+		dpList = nil
+		deadline = nil
+	}
+	for dpQueue != nil {
+		select {
+		case <-deadline:
+			sendBatch()
+		case dp, ok := <-dpQueue:
+			if !ok {
+				dpQueue = nil
+				continue
+			}
+			if psp.PushServiceName() != dp.PushServiceName() || psp.PushServiceName() != psb.pushServiceName {
+				res := push.NewResult()
+				res.Provider = psp
+				res.Destination = dp
+				res.Content = notif
+				res.Err = push.NewIncompatibleError()
+				resQueue <- res
+				continue
+			}
+			if _, ok := dp.VolatileData["regid"]; ok {
+				dpList = append(dpList, dp)
+			} else if regid, ok := dp.FixedData["regid"]; ok {
+				dp.VolatileData["regid"] = regid
+				dpList = append(dpList, dp)
+			} else {
+				res := push.NewResult()
+				res.Provider = psp
+				res.Destination = dp
+				res.Content = notif
+				res.Err = push.NewBadDeliveryPointWithDetails(dp, fmt.Sprintf("uniqush delivery point for %s is missing regid", psb.initialism))
+				resQueue <- res
+				continue
+			}
 
-		if len(dpList) >= maxNrDst {
-			psb.multicast(psp, dpList, resQueue, notif)
-			dpList = dpList[:0]
+			if len(dpList) >= psb.batchSize {
+				sendBatch()
+			} else if len(dpList) == 1 {
+				deadline = time.After(psb.batchDelay)
+			}
 		}
 	}
 	if len(dpList) > 0 {
-		psb.multicast(psp, dpList, resQueue, notif)
+		sendBatch()
 	}
+	close(batches)
+	<-sent
 
 	close(resQueue)
 }
 
+// RefreshToken sets the registration id which dp is pushed to, like a canonical registration id returned by GCM/FCM.
+func (psb *PushServiceBase) RefreshToken(dp *push.DeliveryPoint, token string) error {
+	if token == "" {
+		return errors.New("NoRegId")
+	}
+	dp.VolatileData["regid"] = token
+	return nil
+}
+
+// VerifyDeliveryPoint looks up the registration id of dp with the Instance ID API.
+// Returns false if GCM/FCM no longer recognizes it (e.g. the app was uninstalled, or the token expired).
+func (psb *PushServiceBase) VerifyDeliveryPoint(psp *push.PushServiceProvider, dp *push.DeliveryPoint) (bool, error) {
+	regid, ok := dp.VolatileData["regid"]
+	if !ok {
+		regid = dp.FixedData["regid"]
+	}
+	if regid == "" {
+		return false, fmt.Errorf("uniqush delivery point for %s is missing regid", psb.initialism)
+	}
+	req, err := http.NewRequest("GET", instanceIDInfoURL+url.PathEscape(regid), nil)
+	if err != nil {
+		return false, fmt.Errorf("Error constructing HTTP request: %v", err)
+	}
+	req.Header.Set("Authorization", "key="+psp.VolatileData["apikey"])
+
+	start := time.Now()
+	r, err := psb.client.Do(req)
+	push.ObserveRequest(psb.pushServiceName, req, start, r, err)
+	if r != nil {
+		defer r.Body.Close()
+	}
+	if err != nil {
+		return false, fmt.Errorf("Error looking up %s registration id: %v", psb.initialism, err)
+	}
+	switch r.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusBadRequest, http.StatusNotFound:
+		// The Instance ID API responds with {"error":"InvalidToken"} or "No information found about this instance id."
+		return false, nil
+	default:
+		body, _ := ioutil.ReadAll(r.Body)
+		return false, fmt.Errorf("Unexpected HTTP status %d looking up %s registration id: %s", r.StatusCode, psb.initialism, strings.TrimSpace(string(body)))
+	}
+}
+
+// credentialCheckRegID is the registration id of the dry run push validating credentials. GCM/FCM reject it, but only after accepting the apikey.
+const credentialCheckRegID = "uniqush-credential-check"
+
+// ValidateCredentials sends a dry run push (which isn't delivered) to a placeholder registration id,
+// returning an error if GCM/FCM rejects the apikey of psp.
+func (psb *PushServiceBase) ValidateCredentials(psp *push.PushServiceProvider) error {
+	apikey := psp.VolatileData["apikey"]
+	if apikey == "" {
+		return fmt.Errorf("The %s push service provider has no apikey", psb.initialism)
+	}
+	body, err := json.Marshal(map[string]interface{}{"registration_ids": []string{credentialCheckRegID}, "dry_run": true})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", psb.serviceURL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("Error constructing HTTP request: %v", err)
+	}
+	req.Header.Set("Authorization", "key="+apikey)
+	req.Header.Set("Content-Type", "application/json")
+
+	start := time.Now()
+	r, err := psb.client.Do(req)
+	push.ObserveRequest(psb.pushServiceName, req, start, r, err)
+	if r != nil {
+		defer r.Body.Close()
+	}
+	if err != nil {
+		return fmt.Errorf("Cannot reach %s to validate the apikey: %v", psb.initialism, err)
+	}
+	switch r.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return fmt.Errorf("%s rejected the apikey (HTTP %d): check that it is the server key of the project of the app", psb.initialism, r.StatusCode)
+	default:
+		contents, _ := ioutil.ReadAll(r.Body)
+		return fmt.Errorf("Unexpected HTTP status %d validating the apikey with %s: %s", r.StatusCode, psb.initialism, strings.TrimSpace(string(contents)))
+	}
+}
+
 // Preview will return the JSON payload that this will push to GCM/FCM for previewing (with a placeholder reg ids)
 func (psb *PushServiceBase) Preview(notif *push.Notification) ([]byte, push.Error) {
 	return psb.ToCMPayload(notif, []string{"placeholderRegId"})
@@ -514,6 +659,15 @@ func (psb *PushServiceBase) Preview(notif *push.Notification) ([]byte, push.Erro
 func (psb *PushServiceBase) SetErrorReportChan(errChan chan<- push.Error) {
 }
 
-// SetPushServiceConfig is called during initialization to provide the unserialized contents of uniqush.conf. (does nothing for cloud messaging)
+// SetPushServiceConfig is called during initialization to provide the unserialized contents of uniqush.conf.
 func (psb *PushServiceBase) SetPushServiceConfig(c *push.PushServiceConfig) {
+	if batchSize, err := c.GetInt("batch_size"); err == nil && batchSize > 0 {
+		if batchSize > maxBatchSize {
+			batchSize = maxBatchSize
+		}
+		psb.batchSize = batchSize
+	}
+	if delay, err := c.GetInt("batch_delay_ms"); err == nil && delay >= 0 {
+		psb.batchDelay = time.Duration(delay) * time.Millisecond
+	}
 }
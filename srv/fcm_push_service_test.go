@@ -4,9 +4,12 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
+	"github.com/uniqush/goconf/conf"
 	"github.com/uniqush/uniqush-push/push"
 	"github.com/uniqush/uniqush-push/testutil"
 )
@@ -174,6 +177,47 @@ func TestFCMPushSingleError(t *testing.T) {
 	assertExpectedFCMRequest(t, fcmMockResponse.request, expectedRegID, expectedPayload)
 }
 
+// TestFCMPushBatches tests that delivery points are sent in batches of batch_size, and that a batch is sent after batch_delay_ms.
+func TestFCMPushBatches(t *testing.T) {
+	notif := push.NewEmptyNotification()
+	notif.Data = map[string]string{"msg": "hello"}
+	mockHTTPResponse := []byte(`{"multicast_id":777,"canonical_ids":0,"success":1,"failure":0,"results":[{"message_id":"UID12345"}]}`)
+	psp, mockCMHTTPClient, service, _ := commonFCMMocks(200, mockHTTPResponse, map[string]string{}, nil)
+	c := conf.NewConfigFile()
+	c.AddOption("fcm", "batch_size", "2")
+	c.AddOption("fcm", "batch_delay_ms", "10")
+	service.SetPushServiceConfig(push.NewPushServiceConfig(c, "fcm"))
+
+	psm := push.GetPushServiceManager()
+	dpQueue := make(chan *push.DeliveryPoint)
+	resQueue := make(chan *push.Result)
+	go func() {
+		for i := 0; i < 4; i++ {
+			if i == 3 {
+				// The third delivery point is sent on its own once it has waited for batch_delay_ms.
+				time.Sleep(100 * time.Millisecond)
+			}
+			dp, err := psm.BuildDeliveryPointFromMap(map[string]string{
+				"regid":           fmt.Sprintf("mockregid%d", i),
+				"subscriber":      "mocksubscriber",
+				"pushservicetype": "fcm",
+				"service":         FCMMockService,
+			})
+			if err != nil {
+				panic(err)
+			}
+			dpQueue <- dp
+		}
+		close(dpQueue)
+	}()
+	go service.Push(psp, dpQueue, resQueue, notif)
+	for range resQueue {
+	}
+	if len(mockCMHTTPClient.performed) != 3 {
+		t.Errorf("Unexpected number of http calls: want 3, got %d", len(mockCMHTTPClient.performed))
+	}
+}
+
 func assertExpectedFCMRequest(t *testing.T, request *http.Request, expectedRegID, expectedPayload string) {
 	actualURL := request.URL.String()
 	if actualURL != fcmServiceURL {
@@ -224,3 +268,71 @@ func TestFCMPreviewWithCommonParameters(t *testing.T) {
 	}
 	testutil.ExpectJSONIsEquivalent(t, []byte(expectedPayload), payload)
 }
+
+// TestFCMVerifyDeliveryPoint tests looking up registration ids with the Instance ID API, which is used to reconcile delivery points.
+func TestFCMVerifyDeliveryPoint(t *testing.T) {
+	for _, tc := range []struct {
+		status        int
+		body          string
+		expectedValid bool
+		expectError   bool
+	}{
+		{200, `{"application":"com.example","platform":"ANDROID"}`, true, false},
+		{400, `{"error":"InvalidToken"}`, false, false},
+		{404, `{"error":"No information found about this instance id."}`, false, false},
+		{401, `Unauthorized`, false, true},
+	} {
+		psp, mockCMHTTPClient, service, _ := commonFCMMocks(tc.status, []byte(tc.body), map[string]string{}, nil)
+		dp, err := push.GetPushServiceManager().BuildDeliveryPointFromMap(map[string]string{
+			"regid":           "mock/regid",
+			"subscriber":      "mocksubscriber",
+			"pushservicetype": "fcm",
+			"service":         FCMMockService,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		valid, err := service.VerifyDeliveryPoint(psp, dp)
+		if tc.expectError != (err != nil) {
+			t.Errorf("HTTP %d: unexpected error %v", tc.status, err)
+		}
+		if valid != tc.expectedValid {
+			t.Errorf("HTTP %d: expected valid=%v, got %v", tc.status, tc.expectedValid, valid)
+		}
+		if len(mockCMHTTPClient.performed) != 1 {
+			t.Fatalf("Expected 1 request, got %d", len(mockCMHTTPClient.performed))
+		}
+		request := mockCMHTTPClient.performed[0].request
+		testutil.ExpectStringEquals(t, "https://iid.googleapis.com/iid/info/mock%2Fregid", request.URL.String(), "unexpected Instance ID API URL")
+		testutil.ExpectStringEquals(t, "key="+FCMMockAPIKey, request.Header.Get("Authorization"), "unexpected Authorization header")
+		service.Finalize()
+	}
+}
+
+func TestFCMValidateCredentials(t *testing.T) {
+	for _, tc := range []struct {
+		status      int
+		body        string
+		expectError bool
+	}{
+		{200, `{"multicast_id":1,"success":0,"failure":1,"results":[{"error":"InvalidRegistration"}]}`, false},
+		{401, `Unauthorized`, true},
+		{500, `Internal Server Error`, true},
+	} {
+		psp, mockCMHTTPClient, service, _ := commonFCMMocks(tc.status, []byte(tc.body), map[string]string{}, nil)
+		err := service.ValidateCredentials(psp)
+		if tc.expectError != (err != nil) {
+			t.Errorf("HTTP %d: unexpected error %v", tc.status, err)
+		}
+		if len(mockCMHTTPClient.performed) != 1 {
+			t.Fatalf("Expected 1 request, got %d", len(mockCMHTTPClient.performed))
+		}
+		request := mockCMHTTPClient.performed[0].request
+		testutil.ExpectStringEquals(t, "key="+FCMMockAPIKey, request.Header.Get("Authorization"), "unexpected Authorization header")
+		body, _ := ioutil.ReadAll(request.Body)
+		if !strings.Contains(string(body), `"dry_run":true`) {
+			t.Errorf("Expected a dry run push, got %s", body)
+		}
+		service.Finalize()
+	}
+}
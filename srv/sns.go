@@ -0,0 +1,600 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+/*
+ * This contains the bridge to Amazon SNS, which publishes pushes to the platform endpoints of an SNS platform application.
+ * The endpoints are created from the tokens of the delivery points on demand, so that services can move their devices between
+ * pushing directly (apns, fcm, adm) and pushing through SNS gradually.
+ */
+
+package srv
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/uniqush/uniqush-push/push"
+	cm "github.com/uniqush/uniqush-push/srv/cloud_messaging"
+	"github.com/uniqush/uniqush-push/util"
+)
+
+const (
+	// snsServiceURL is the format of the URL of the SNS API of a region.
+	snsServiceURL string = "https://sns.%s.amazonaws.com/"
+	snsAPIVersion string = "2010-03-31"
+	// snsRawPayloadKey is the key of a push request whose value is the JSON message published to SNS, with a message for each platform.
+	snsRawPayloadKey = "uniqush.payload.sns"
+	// snsEndpointArn is the field of a delivery point with the ARN of its SNS platform endpoint, once it was created.
+	snsEndpointArn = "endpointarn"
+)
+
+// snsPlatforms are the platforms of SNS platform applications which can be pushed to.
+var snsPlatforms = map[string]bool{
+	"APNS":         true,
+	"APNS_SANDBOX": true,
+	"GCM":          true,
+	"ADM":          true,
+}
+
+// snsExistingEndpoint extracts the ARN of the endpoint which already has a token from the error of SNS creating another endpoint for it.
+var snsExistingEndpoint = regexp.MustCompile(`Endpoint (arn:[^ ]+) already exists`)
+
+type snsPushService struct {
+	client cm.HTTPClient
+	// serviceURL is the format of the URL of the SNS API of a region, overridden by tests.
+	serviceURL string
+	// workers sends the pushes to each delivery point, so that large pushes don't start a goroutine for each of them.
+	workers *push.WorkerPool
+}
+
+var _ push.PushServiceType = &snsPushService{}
+
+func newSNSPushService() *snsPushService {
+	return &snsPushService{
+		client:     &http.Client{Timeout: 30 * time.Second},
+		serviceURL: snsServiceURL,
+		workers:    push.NewWorkerPool(push.DefaultPushWorkers),
+	}
+}
+
+// InstallSNS registers the only instance of the SNS push service. It is called only once.
+func InstallSNS() {
+	psm := push.GetPushServiceManager()
+	err := psm.RegisterPushServiceType(newSNSPushService())
+	if err != nil {
+		panic(fmt.Sprintf("Failed to install SNS module: %v", err))
+	}
+}
+
+func (sns *snsPushService) Finalize() {}
+func (sns *snsPushService) Name() string {
+	return "sns"
+}
+func (sns *snsPushService) SetErrorReportChan(errChan chan<- push.Error) {
+}
+func (sns *snsPushService) SetPushServiceConfig(c *push.PushServiceConfig) {
+	sns.workers = push.NewWorkerPoolFromConfig(c)
+}
+
+// ReloadPushServiceConfig resizes the pool of workers sending pushes to push_workers.
+func (sns *snsPushService) ReloadPushServiceConfig(c *push.PushServiceConfig) {
+	sns.workers.Resize(push.PushWorkersFromConfig(c))
+}
+
+// parsePlatformApplicationArn returns the region and platform of the ARN of an SNS platform application,
+// e.g. arn:aws:sns:us-east-1:123456789012:app/GCM/myapp.
+func parsePlatformApplicationArn(arn string) (region string, platform string, err error) {
+	parts := strings.SplitN(arn, ":", 6)
+	if len(parts) != 6 || parts[0] != "arn" || parts[2] != "sns" || parts[3] == "" {
+		return "", "", fmt.Errorf("InvalidPlatformApplicationArn: %q", arn)
+	}
+	app := strings.Split(parts[5], "/")
+	if len(app) != 3 || app[0] != "app" {
+		return "", "", fmt.Errorf("InvalidPlatformApplicationArn: %q", arn)
+	}
+	if !snsPlatforms[app[1]] {
+		return "", "", fmt.Errorf("UnsupportedPlatform: %q", app[1])
+	}
+	return parts[3], app[1], nil
+}
+
+func (sns *snsPushService) BuildPushServiceProviderFromMap(kv map[string]string, psp *push.PushServiceProvider) error {
+	if service, ok := kv["service"]; ok && len(service) > 0 {
+		psp.FixedData["service"] = service
+	} else {
+		return errors.New("NoService")
+	}
+
+	if arn, ok := kv["platformapplicationarn"]; ok && len(arn) > 0 {
+		if _, _, err := parsePlatformApplicationArn(arn); err != nil {
+			return err
+		}
+		psp.FixedData["platformapplicationarn"] = arn
+	} else {
+		return errors.New("NoPlatformApplicationArn")
+	}
+
+	if accesskeyid, ok := kv["accesskeyid"]; ok && len(accesskeyid) > 0 {
+		psp.FixedData["accesskeyid"] = accesskeyid
+	} else {
+		return errors.New("NoAccessKeyID")
+	}
+
+	if secretaccesskey, ok := kv["secretaccesskey"]; ok && len(secretaccesskey) > 0 {
+		psp.VolatileData["secretaccesskey"] = secretaccesskey
+	} else {
+		return errors.New("NoSecretAccessKey")
+	}
+
+	return nil
+}
+
+// BuildDeliveryPointFromMap requires the token of the device on the platform of the SNS platform application (a devtoken or regid),
+// or the ARN of an SNS platform endpoint which was already created for it, e.g. by an app which used to register with SNS directly.
+func (sns *snsPushService) BuildDeliveryPointFromMap(kv map[string]string, dp *push.DeliveryPoint) error {
+	err := dp.AddCommonData(kv)
+	if err != nil {
+		return err
+	}
+
+	token := kv["token"]
+	arn := kv[snsEndpointArn]
+	switch {
+	case len(token) > 0:
+		dp.FixedData["token"] = token
+		if len(arn) > 0 {
+			dp.VolatileData[snsEndpointArn] = arn
+		}
+	case len(arn) > 0:
+		dp.FixedData[snsEndpointArn] = arn
+	default:
+		return errors.New("NoToken")
+	}
+
+	return nil
+}
+
+// RefreshToken sets the token of dp, whose endpoint is created again by the next push.
+// The token of a delivery point which was subscribed with only the ARN of its endpoint can't be refreshed.
+func (sns *snsPushService) RefreshToken(dp *push.DeliveryPoint, token string) error {
+	if token == "" {
+		return errors.New("NoToken")
+	}
+	if _, ok := dp.FixedData[snsEndpointArn]; ok {
+		return errors.New("The delivery point was subscribed with the endpointarn of its SNS endpoint, so its token can't be refreshed")
+	}
+	dp.VolatileData["token"] = token
+	delete(dp.VolatileData, snsEndpointArn)
+	return nil
+}
+
+// snsToken returns the token of dp, which was refreshed if it is in the volatile data of dp.
+func snsToken(dp *push.DeliveryPoint) string {
+	if token, ok := dp.VolatileData["token"]; ok {
+		return token
+	}
+	return dp.FixedData["token"]
+}
+
+// endpointArn returns the ARN of the SNS platform endpoint of dp, or "" if it wasn't created yet.
+func endpointArn(dp *push.DeliveryPoint) string {
+	if arn, ok := dp.FixedData[snsEndpointArn]; ok {
+		return arn
+	}
+	return dp.VolatileData[snsEndpointArn]
+}
+
+// signAWSRequest adds the headers of AWS Signature Version 4 to req, whose body is body and whose query (if any) is already canonical.
+// The host, content-type and x-amz-* headers are signed.
+func signAWSRequest(req *http.Request, body []byte, region, service, accessKey, secretKey string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if name == "content-type" || strings.HasPrefix(name, "x-amz-") {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	bodyHash := sha256.Sum256(body)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(bodyHash[:]),
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	for _, part := range []string{region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+accessKey+"/"+scope+", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// snsError is an error returned by the SNS API.
+type snsError struct {
+	StatusCode int
+	Code       string `xml:"Error>Code"`
+	Message    string `xml:"Error>Message"`
+}
+
+func (e *snsError) Error() string {
+	return fmt.Sprintf("%v: %v (%v)", e.StatusCode, e.Code, e.Message)
+}
+
+// call sends an action of the SNS API with the credentials of psp, and decodes the XML response into result.
+// It returns an *snsError if SNS rejected the action. The request is canceled when ctx is done.
+func (sns *snsPushService) call(ctx context.Context, psp *push.PushServiceProvider, action string, params url.Values, result interface{}) error {
+	region, _, err := parsePlatformApplicationArn(psp.FixedData["platformapplicationarn"])
+	if err != nil {
+		return err
+	}
+	serviceURL := fmt.Sprintf(sns.serviceURL, region)
+	if strings.HasPrefix(region, "cn-") {
+		// The regions of China are in another partition.
+		serviceURL = strings.Replace(serviceURL, ".amazonaws.com/", ".amazonaws.com.cn/", 1)
+	}
+	params.Set("Action", action)
+	params.Set("Version", snsAPIVersion)
+	body := []byte(params.Encode())
+	req, err := http.NewRequest("POST", serviceURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	signAWSRequest(req, body, region, "sns", psp.FixedData["accesskeyid"], psp.VolatileData["secretaccesskey"], time.Now())
+
+	start := time.Now()
+	resp, err := sns.client.Do(req)
+	push.ObserveRequest("sns", req, start, resp, err)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		fail := &snsError{StatusCode: resp.StatusCode}
+		if xml.Unmarshal(content, fail) != nil || fail.Code == "" {
+			fail.Code = http.StatusText(resp.StatusCode)
+			fail.Message = strings.TrimSpace(string(content))
+		}
+		return fail
+	}
+	return xml.Unmarshal(content, result)
+}
+
+// snsPushError maps the errors of the SNS API to errors of pushes.
+func snsPushError(psp *push.PushServiceProvider, dp *push.DeliveryPoint, notif *push.Notification, err error) push.Error {
+	fail, ok := err.(*snsError)
+	if !ok {
+		return push.WrapError("Failed to send SNS request", err)
+	}
+	switch fail.Code {
+	case "EndpointDisabled":
+		// The platform rejected the token of the endpoint, e.g. because the app was uninstalled.
+		return push.NewInvalidRegistrationUpdate(psp, dp)
+	case "AuthorizationError", "InvalidClientTokenId", "SignatureDoesNotMatch", "AccessDenied", "PlatformApplicationDisabled":
+		return push.NewBadPushServiceProviderWithDetails(psp, fail.Error())
+	case "Throttled", "ThrottlingException", "KMSThrottling":
+		return push.NewRetryError(psp, dp, notif, time.Minute)
+	}
+	if fail.StatusCode >= 500 {
+		return push.NewRetryError(psp, dp, notif, time.Minute)
+	}
+	return push.NewErrorf("%v", fail)
+}
+
+// createEndpoint creates the SNS platform endpoint of the token of dp, or finds the one which already exists.
+func (sns *snsPushService) createEndpoint(ctx context.Context, psp *push.PushServiceProvider, dp *push.DeliveryPoint) (string, error) {
+	params := url.Values{
+		"PlatformApplicationArn": {psp.FixedData["platformapplicationarn"]},
+		"Token":                  {snsToken(dp)},
+		"CustomUserData":         {dp.FixedData["subscriber"]},
+	}
+	var result struct {
+		EndpointArn string `xml:"CreatePlatformEndpointResult>EndpointArn"`
+	}
+	err := sns.call(ctx, psp, "CreatePlatformEndpoint", params, &result)
+	if fail, ok := err.(*snsError); ok && fail.Code == "InvalidParameter" {
+		// SNS refuses to create an endpoint for a token which has one with different attributes, but names the existing one.
+		if match := snsExistingEndpoint.FindStringSubmatch(fail.Message); match != nil {
+			return match[1], nil
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	return result.EndpointArn, nil
+}
+
+func (sns *snsPushService) publish(ctx context.Context, psp *push.PushServiceProvider, arn string, message []byte) (string, error) {
+	params := url.Values{
+		"TargetArn":        {arn},
+		"Message":          {string(message)},
+		"MessageStructure": {"json"},
+	}
+	var result struct {
+		MessageID string `xml:"PublishResult>MessageId"`
+	}
+	if err := sns.call(ctx, psp, "Publish", params, &result); err != nil {
+		return "", err
+	}
+	return result.MessageID, nil
+}
+
+// snsSinglePush publishes message to the endpoint of dp, creating it first if needed.
+// It returns true if the endpoint was created, in which case dp must be updated.
+func (sns *snsPushService) snsSinglePush(ctx context.Context, psp *push.PushServiceProvider, dp *push.DeliveryPoint, message []byte, notif *push.Notification) (string, bool, push.Error) {
+	created := false
+	arn := endpointArn(dp)
+	for attempt := 0; ; attempt++ {
+		if arn == "" {
+			var err error
+			if arn, err = sns.createEndpoint(ctx, psp, dp); err != nil {
+				return "", created, snsPushError(psp, dp, notif, err)
+			}
+			dp.VolatileData[snsEndpointArn] = arn
+			created = true
+		}
+		id, err := sns.publish(ctx, psp, arn, message)
+		if fail, ok := err.(*snsError); ok && fail.Code == "NotFound" && attempt == 0 && snsToken(dp) != "" {
+			// The endpoint was deleted, e.g. from the console, so create it again.
+			arn = ""
+			continue
+		}
+		if err != nil {
+			return "", created, snsPushError(psp, dp, notif, err)
+		}
+		return "sns:" + id, created, nil
+	}
+}
+
+// snsPlatformMessage returns the message of notif for a platform of SNS.
+// It is the payload of uniqush.payload.apns, uniqush.payload.fcm (or gcm) or uniqush.payload.adm if set, or is built from the other parameters.
+func snsPlatformMessage(notif *push.Notification, platform string) (string, push.Error) {
+	var message interface{}
+	switch platform {
+	case "APNS", "APNS_SANDBOX":
+		if raw, ok := notif.Data["uniqush.payload.apns"]; ok {
+			return raw, nil
+		}
+		message = snsAPNSMessage(notif)
+	case "GCM":
+		gcm := make(map[string]interface{})
+		if rawTTL, ok := notif.Data["ttl"]; ok {
+			if ttl, err := strconv.ParseUint(rawTTL, 10, 32); err == nil {
+				gcm["time_to_live"] = ttl
+			}
+		}
+		if msggroup, ok := notif.Data["msggroup"]; ok {
+			gcm["collapse_key"] = msggroup
+		}
+		for _, key := range []string{"uniqush.notification.fcm", "uniqush.notification.gcm"} {
+			if raw, ok := notif.Data[key]; ok {
+				gcm["notification"] = json.RawMessage(raw)
+				break
+			}
+		}
+		if raw, ok := notif.Data["uniqush.payload.fcm"]; ok {
+			gcm["data"] = json.RawMessage(raw)
+		} else if raw, ok := notif.Data["uniqush.payload.gcm"]; ok {
+			gcm["data"] = json.RawMessage(raw)
+		} else {
+			data := make(map[string]string, len(notif.Data))
+			for k, v := range notif.Data {
+				if k == "msggroup" || k == "ttl" || strings.HasPrefix(k, "uniqush.") {
+					continue
+				}
+				data[k] = v
+			}
+			gcm["data"] = data
+		}
+		message = gcm
+	case "ADM":
+		msg, err := notifToMessage(notif)
+		if err != nil {
+			return "", err
+		}
+		message = msg
+	}
+	b, err := util.MarshalJSONUnescaped(message)
+	if err != nil {
+		return "", push.NewBadNotificationWithDetails(fmt.Sprintf("invalid payload for %v: %v", platform, err))
+	}
+	return string(b), nil
+}
+
+// snsAPNSMessage builds an APNs payload from the parameters of notif, like the apns push service type.
+func snsAPNSMessage(notif *push.Notification) map[string]interface{} {
+	payload := make(map[string]interface{})
+	aps := make(map[string]interface{})
+	alert := make(map[string]interface{})
+	for k, v := range notif.Data {
+		switch k {
+		case "msg":
+			alert["body"] = v
+		case "title", "action-loc-key", "loc-key", "title-loc-key":
+			alert[k] = v
+		case "sound":
+			aps[k] = v
+		case "badge", "content-available":
+			if n, err := strconv.Atoi(v); err == nil {
+				aps[k] = n
+			}
+		case "img":
+			alert["launch-image"] = v
+		case "id", "expiry", "ttl", "msggroup", "loc-args", "title-loc-args":
+			continue
+		default:
+			if strings.HasPrefix(k, "uniqush.") {
+				continue
+			}
+			payload[k] = v
+		}
+	}
+	aps["alert"] = alert
+	payload["aps"] = aps
+	return payload
+}
+
+// snsMessage returns the JSON message published to SNS for notif, with the messages of the platforms.
+// uniqush.payload.sns replaces the whole message.
+func snsMessage(notif *push.Notification, platforms ...string) ([]byte, push.Error) {
+	if notif == nil || len(notif.Data) == 0 {
+		return nil, push.NewBadNotificationWithDetails("empty notification")
+	}
+	if raw, ok := notif.Data[snsRawPayloadKey]; ok {
+		var message map[string]string
+		if err := json.Unmarshal([]byte(raw), &message); err != nil {
+			return nil, push.NewBadNotificationWithDetails(fmt.Sprintf("invalid %v: %v", snsRawPayloadKey, err))
+		}
+		if _, ok := message["default"]; !ok {
+			return nil, push.NewBadNotificationWithDetails(fmt.Sprintf("%v has no default message", snsRawPayloadKey))
+		}
+		return []byte(raw), nil
+	}
+	message := map[string]string{"default": notif.Data["msg"]}
+	for _, platform := range platforms {
+		platformMessage, err := snsPlatformMessage(notif, platform)
+		if err != nil {
+			return nil, err
+		}
+		message[platform] = platformMessage
+	}
+	b, err := util.MarshalJSONUnescaped(message)
+	if err != nil {
+		return nil, push.WrapError("Failed to marshal message", err)
+	}
+	return b, nil
+}
+
+// Preview returns the message published to SNS, with the messages of the APNS, GCM and ADM platforms.
+func (sns *snsPushService) Preview(notif *push.Notification) ([]byte, push.Error) {
+	return snsMessage(notif, "APNS", "GCM", "ADM")
+}
+
+// ValidateCredentials reads the attributes of the platform application of psp, returning an error if SNS rejects the credentials.
+func (sns *snsPushService) ValidateCredentials(psp *push.PushServiceProvider) error {
+	var result struct{}
+	return sns.call(context.Background(), psp, "GetPlatformApplicationAttributes", url.Values{"PlatformApplicationArn": {psp.FixedData["platformapplicationarn"]}}, &result)
+}
+
+func (sns *snsPushService) Push(psp *push.PushServiceProvider, dpQueue <-chan *push.DeliveryPoint, resQueue chan<- *push.Result, notif *push.Notification) {
+	sns.PushContext(context.Background(), psp, dpQueue, resQueue, notif)
+}
+
+// PushContext is Push, with the requests to SNS canceled when ctx is done.
+func (sns *snsPushService) PushContext(ctx context.Context, psp *push.PushServiceProvider, dpQueue <-chan *push.DeliveryPoint, resQueue chan<- *push.Result, notif *push.Notification) {
+	defer close(resQueue)
+	defer func() {
+		for range dpQueue {
+		}
+	}()
+
+	_, platform, err := parsePlatformApplicationArn(psp.FixedData["platformapplicationarn"])
+	if err != nil {
+		res := push.NewResult()
+		res.Content = notif
+		res.Provider = psp
+		res.Err = push.NewBadPushServiceProviderWithDetails(psp, err.Error())
+		resQueue <- res
+		return
+	}
+	message, pushErr := snsMessage(notif, platform)
+	if pushErr != nil {
+		res := push.NewResult()
+		res.Content = notif
+		res.Provider = psp
+		res.Err = pushErr
+		resQueue <- res
+		return
+	}
+
+	wg := sync.WaitGroup{}
+
+	for dp := range dpQueue {
+		wg.Add(1)
+		dp := dp
+		sns.workers.Go(func() {
+			defer wg.Done()
+			msgID, created, err := sns.snsSinglePush(ctx, psp, dp, message, notif)
+			if created {
+				// Save the endpoint, so that it isn't created again by the next push.
+				update := push.NewResult()
+				update.Content = notif
+				update.Provider = psp
+				update.Destination = dp
+				update.Err = push.NewDeliveryPointUpdate(dp)
+				resQueue <- update
+			}
+			res := push.NewResult()
+			res.Content = notif
+			res.Provider = psp
+			res.Destination = dp
+			res.MsgID, res.Err = msgID, err
+			resQueue <- res
+		})
+	}
+	wg.Wait()
+}
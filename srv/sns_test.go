@@ -0,0 +1,225 @@
+package srv
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/uniqush/uniqush-push/push"
+	"github.com/uniqush/uniqush-push/testutil"
+)
+
+const snsMockPlatformApplicationArn = "arn:aws:sns:us-east-1:123456789012:app/GCM/myapp"
+
+// mockSNS serves the CreatePlatformEndpoint and Publish actions of the SNS API, failing publishes to the endpoints in errors.
+type mockSNS struct {
+	mutex   sync.Mutex
+	actions []string
+	errors  map[string]string
+}
+
+func (m *mockSNS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/") {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`<ErrorResponse><Error><Code>InvalidClientTokenId</Code><Message>unsigned</Message></Error></ErrorResponse>`))
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	action := r.Form.Get("Action")
+	m.actions = append(m.actions, action)
+	switch action {
+	case "CreatePlatformEndpoint":
+		fmt.Fprintf(w, `<CreatePlatformEndpointResponse><CreatePlatformEndpointResult><EndpointArn>arn:aws:sns:us-east-1:123456789012:endpoint/GCM/myapp/%s</EndpointArn></CreatePlatformEndpointResult></CreatePlatformEndpointResponse>`, r.Form.Get("Token"))
+	case "Publish":
+		if code, ok := m.errors[r.Form.Get("TargetArn")]; ok {
+			delete(m.errors, r.Form.Get("TargetArn"))
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `<ErrorResponse><Error><Code>%s</Code><Message>failed</Message></Error></ErrorResponse>`, code)
+			return
+		}
+		w.Write([]byte(`<PublishResponse><PublishResult><MessageId>m1</MessageId></PublishResult></PublishResponse>`))
+	}
+}
+
+func newMockSNSPushService(t *testing.T, mock *mockSNS) (*snsPushService, *push.PushServiceProvider, func()) {
+	server := httptest.NewServer(mock)
+	sns := newSNSPushService()
+	sns.serviceURL = server.URL + "/%s"
+	psp := push.NewEmptyPushServiceProvider()
+	err := sns.BuildPushServiceProviderFromMap(map[string]string{
+		"service":                "myservice",
+		"platformapplicationarn": snsMockPlatformApplicationArn,
+		"accesskeyid":            "AKIDEXAMPLE",
+		"secretaccesskey":        "secret",
+	}, psp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sns, psp, server.Close
+}
+
+func snsPush(sns *snsPushService, psp *push.PushServiceProvider, dp *push.DeliveryPoint, data map[string]string) []*push.Result {
+	dpQueue := make(chan *push.DeliveryPoint, 1)
+	resQueue := make(chan *push.Result, 10)
+	dpQueue <- dp
+	close(dpQueue)
+	notif := push.NewEmptyNotification()
+	notif.Data = data
+	sns.Push(psp, dpQueue, resQueue, notif)
+	var results []*push.Result
+	for res := range resQueue {
+		results = append(results, res)
+	}
+	return results
+}
+
+func newSNSDeliveryPoint(t *testing.T, sns *snsPushService, token string) *push.DeliveryPoint {
+	dp := push.NewEmptyDeliveryPoint()
+	if err := sns.BuildDeliveryPointFromMap(map[string]string{"service": "myservice", "subscriber": "alice", "token": token}, dp); err != nil {
+		t.Fatal(err)
+	}
+	return dp
+}
+
+func TestSNSPushCreatesEndpoints(t *testing.T) {
+	mock := &mockSNS{errors: map[string]string{}}
+	sns, psp, stop := newMockSNSPushService(t, mock)
+	defer stop()
+	dp := newSNSDeliveryPoint(t, sns, "t1")
+
+	results := snsPush(sns, psp, dp, map[string]string{"msg": "hello"})
+	testutil.ExpectEquals(t, 2, len(results), "expected an update of the delivery point and the result of the push")
+	if _, ok := results[0].Err.(*push.DeliveryPointUpdate); !ok {
+		t.Errorf("expected the delivery point to be updated, got %v", results[0].Err)
+	}
+	testutil.ExpectStringEquals(t, "arn:aws:sns:us-east-1:123456789012:endpoint/GCM/myapp/t1", dp.VolatileData["endpointarn"], "expected the endpoint to be saved")
+	testutil.ExpectEquals(t, nil, results[1].Err, "unexpected error")
+	testutil.ExpectStringEquals(t, "sns:m1", results[1].MsgID, "unexpected message id")
+
+	results = snsPush(sns, psp, dp, map[string]string{"msg": "hello"})
+	testutil.ExpectEquals(t, 1, len(results), "expected the endpoint to be reused")
+	testutil.ExpectEquals(t, []string{"CreatePlatformEndpoint", "Publish", "Publish"}, mock.actions, "unexpected actions")
+}
+
+func TestSNSPushErrors(t *testing.T) {
+	mock := &mockSNS{errors: map[string]string{
+		"arn:aws:sns:us-east-1:123456789012:endpoint/GCM/myapp/deleted":  "NotFound",
+		"arn:aws:sns:us-east-1:123456789012:endpoint/GCM/myapp/disabled": "EndpointDisabled",
+	}}
+	sns, psp, stop := newMockSNSPushService(t, mock)
+	defer stop()
+
+	dp := newSNSDeliveryPoint(t, sns, "t1")
+	dp.VolatileData["endpointarn"] = "arn:aws:sns:us-east-1:123456789012:endpoint/GCM/myapp/deleted"
+	results := snsPush(sns, psp, dp, map[string]string{"msg": "hello"})
+	testutil.ExpectEquals(t, 2, len(results), "expected the deleted endpoint to be created again")
+	testutil.ExpectEquals(t, nil, results[1].Err, "unexpected error")
+
+	dp = newSNSDeliveryPoint(t, sns, "disabled")
+	dp.VolatileData["endpointarn"] = "arn:aws:sns:us-east-1:123456789012:endpoint/GCM/myapp/disabled"
+	results = snsPush(sns, psp, dp, map[string]string{"msg": "hello"})
+	if _, ok := results[0].Err.(*push.InvalidRegistrationUpdate); !ok {
+		t.Errorf("expected a disabled endpoint to be an invalid registration, got %v", results[0].Err)
+	}
+
+	psp.FixedData["accesskeyid"] = "other"
+	if _, ok := sns.ValidateCredentials(psp).(*snsError); !ok {
+		t.Errorf("expected the credentials to be rejected")
+	}
+}
+
+func TestSNSPushContextCanceled(t *testing.T) {
+	mock := &mockSNS{errors: map[string]string{}}
+	sns, psp, stop := newMockSNSPushService(t, mock)
+	defer stop()
+	dp := newSNSDeliveryPoint(t, sns, "t1")
+	dp.VolatileData["endpointarn"] = "arn:aws:sns:us-east-1:123456789012:endpoint/GCM/myapp/t1"
+
+	dpQueue := make(chan *push.DeliveryPoint, 1)
+	resQueue := make(chan *push.Result, 10)
+	dpQueue <- dp
+	close(dpQueue)
+	notif := push.NewEmptyNotification()
+	notif.Data = map[string]string{"msg": "hello"}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	sns.PushContext(ctx, psp, dpQueue, resQueue, notif)
+	res := <-resQueue
+	if res.Err == nil {
+		t.Errorf("expected the push to fail")
+	}
+	testutil.ExpectEquals(t, 0, len(mock.actions), "expected no request to be sent")
+}
+
+func TestSNSMessage(t *testing.T) {
+	notif := push.NewEmptyNotification()
+	notif.Data = map[string]string{"msg": "hello", "msggroup": "g", "ttl": "60", "badge": "2", "uniqush.payload.adm": `{"a":"b"}`}
+	message, err := snsMessage(notif, "GCM", "APNS", "ADM")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectStringEquals(t,
+		`{"ADM":"{\"data\":{\"a\":\"b\"},\"consolidationKey\":\"g\",\"expiresAfter\":60}","APNS":"{\"aps\":{\"alert\":{\"body\":\"hello\"},\"badge\":2}}","GCM":"{\"collapse_key\":\"g\",\"data\":{\"badge\":\"2\",\"msg\":\"hello\"},\"time_to_live\":60}","default":"hello"}`,
+		strings.TrimSpace(string(message)), "unexpected message")
+
+	notif.Data = map[string]string{"uniqush.payload.sns": `{"default":"hi","GCM":"{}"}`}
+	message, err = snsMessage(notif, "GCM")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectStringEquals(t, `{"default":"hi","GCM":"{}"}`, string(message), "expected the raw message to be published")
+	notif.Data = map[string]string{"uniqush.payload.sns": `{"GCM":"{}"}`}
+	if _, err = snsMessage(notif, "GCM"); err == nil {
+		t.Errorf("expected a message without a default to be rejected")
+	}
+}
+
+func TestSNSBuildPushServiceProvider(t *testing.T) {
+	sns := newSNSPushService()
+	psp := push.NewEmptyPushServiceProvider()
+	err := sns.BuildPushServiceProviderFromMap(map[string]string{
+		"service":                "myservice",
+		"platformapplicationarn": "arn:aws:sns:us-east-1:123456789012:app/MPNS/myapp",
+		"accesskeyid":            "id",
+		"secretaccesskey":        "secret",
+	}, psp)
+	if err == nil || !strings.Contains(err.Error(), "UnsupportedPlatform") {
+		t.Errorf("expected the platform to be rejected, got %v", err)
+	}
+	region, platform, err := parsePlatformApplicationArn(snsMockPlatformApplicationArn)
+	testutil.ExpectEquals(t, nil, err, "unexpected error")
+	testutil.ExpectStringEquals(t, "us-east-1 GCM", region+" "+platform, "unexpected region and platform")
+}
+
+// TestSNSSignAWSRequest checks the signature of the example request of the AWS Signature Version 4 documentation.
+func TestSNSSignAWSRequest(t *testing.T) {
+	req := httptest.NewRequest("GET", "https://iam.amazonaws.com/?Action=ListUsers&Version=2010-05-08", nil)
+	req.Header = http.Header{}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	signAWSRequest(req, nil, "us-east-1", "iam", "AKIDEXAMPLE", "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+	testutil.ExpectStringEquals(t,
+		"AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/iam/aws4_request, SignedHeaders=content-type;host;x-amz-date, Signature=5d672d79c15b13162d9279b0855cfba6789a8edb4c82c400e06b5924a6f2b5d7",
+		req.Header.Get("Authorization"), "expected the signature of the example")
+}
+
+func TestSNSRefreshToken(t *testing.T) {
+	mock := &mockSNS{errors: map[string]string{}}
+	sns, psp, stop := newMockSNSPushService(t, mock)
+	defer stop()
+	dp := newSNSDeliveryPoint(t, sns, "t1")
+	snsPush(sns, psp, dp, map[string]string{"msg": "hello"})
+
+	if err := sns.RefreshToken(dp, "t2"); err != nil {
+		t.Fatal(err)
+	}
+	snsPush(sns, psp, dp, map[string]string{"msg": "hello"})
+	testutil.ExpectStringEquals(t, "arn:aws:sns:us-east-1:123456789012:endpoint/GCM/myapp/t2", dp.VolatileData["endpointarn"], "expected an endpoint to be created for the new token")
+	testutil.ExpectStringEquals(t, "t1", dp.FixedData["token"], "expected the name of the delivery point not to change")
+}
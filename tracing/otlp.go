@@ -0,0 +1,216 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package tracing
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// otlpBatchSize is the number of spans above which a batch is sent without waiting for the flush interval.
+	otlpBatchSize = 512
+	// otlpQueueSize is the number of finished spans which can wait to be sent. Spans are dropped when it is full, rather than slowing down pushes.
+	otlpQueueSize = 8192
+)
+
+// OTLPExporter sends spans in batches to an OpenTelemetry collector, with the JSON encoding of OTLP/HTTP.
+type OTLPExporter struct {
+	endpoint    string
+	serviceName string
+	client      *http.Client
+	interval    time.Duration
+	queue       chan *Span
+	dropped     int64
+	// errors receives the errors of sending batches, for the caller to log.
+	errors func(err error)
+}
+
+// NewOTLPExporter returns an exporter which posts spans to endpoint (e.g. "http://localhost:4318/v1/traces") every interval,
+// with serviceName as the service.name resource attribute. onError is called with the errors of sending batches.
+func NewOTLPExporter(endpoint, serviceName string, interval time.Duration, onError func(err error)) *OTLPExporter {
+	e := &OTLPExporter{
+		endpoint:    endpoint,
+		serviceName: serviceName,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		interval:    interval,
+		queue:       make(chan *Span, otlpQueueSize),
+		errors:      onError,
+	}
+	go e.run()
+	return e
+}
+
+// Export queues a finished span to be sent.
+func (e *OTLPExporter) Export(s *Span) {
+	select {
+	case e.queue <- s:
+	default:
+		atomic.AddInt64(&e.dropped, 1)
+	}
+}
+
+// Dropped returns the number of spans which were dropped because the queue was full.
+func (e *OTLPExporter) Dropped() int64 {
+	return atomic.LoadInt64(&e.dropped)
+}
+
+func (e *OTLPExporter) run() {
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+	var batch []*Span
+	for {
+		select {
+		case s := <-e.queue:
+			batch = append(batch, s)
+			if len(batch) < otlpBatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		if err := e.send(batch); err != nil && e.errors != nil {
+			e.errors(err)
+		}
+		batch = nil
+	}
+}
+
+func (e *OTLPExporter) send(batch []*Span) error {
+	body, err := json.Marshal(encodeOTLP(e.serviceName, batch))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("Unexpected status %s sending %d spans", resp.Status, len(batch))
+	}
+	return nil
+}
+
+// The types below are the subset of the OTLP trace request used by uniqush-push, in the JSON encoding
+// (IDs are hex strings, and 64 bit integers are decimal strings).
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpStatus struct {
+	// Code is 0 (unset) or 2 (error).
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+func otlpValue(v interface{}) map[string]interface{} {
+	switch v := v.(type) {
+	case string:
+		return map[string]interface{}{"stringValue": v}
+	case bool:
+		return map[string]interface{}{"boolValue": v}
+	case int:
+		return map[string]interface{}{"intValue": strconv.Itoa(v)}
+	case int64:
+		return map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+	case float64:
+		return map[string]interface{}{"doubleValue": v}
+	default:
+		return map[string]interface{}{"stringValue": fmt.Sprint(v)}
+	}
+}
+
+func encodeOTLP(serviceName string, batch []*Span) otlpRequest {
+	spans := make([]otlpSpan, len(batch))
+	for i, s := range batch {
+		s.mutex.Lock()
+		span := otlpSpan{
+			TraceID:           hex.EncodeToString(s.Context.TraceID[:]),
+			SpanID:            hex.EncodeToString(s.Context.SpanID[:]),
+			Name:              s.Name,
+			Kind:              s.Kind,
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+		}
+		if s.ParentID != [8]byte{} {
+			span.ParentSpanID = hex.EncodeToString(s.ParentID[:])
+		}
+		for _, a := range s.Attributes {
+			span.Attributes = append(span.Attributes, otlpKeyValue{Key: a.Key, Value: otlpValue(a.Value)})
+		}
+		if s.Err != "" {
+			span.Status = otlpStatus{Code: 2, Message: s.Err}
+		}
+		s.mutex.Unlock()
+		spans[i] = span
+	}
+	return otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: []otlpKeyValue{{Key: "service.name", Value: otlpValue(serviceName)}}},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: "github.com/uniqush/uniqush-push"}, Spans: spans}},
+	}}}
+}
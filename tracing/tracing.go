@@ -0,0 +1,240 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// Package tracing records the spans of pushes (API request, database lookups, sends to push service providers),
+// propagates them with the W3C traceparent header, and exports them to an OpenTelemetry collector.
+//
+// Tracing is disabled until Configure is called, in which case Start returns a nil *Span, whose methods do nothing.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Kinds of spans, as defined by OpenTelemetry.
+const (
+	KindInternal = 1
+	KindServer   = 2
+	KindClient   = 3
+)
+
+// TraceparentHeader is the W3C trace context header, e.g. "00-<trace id>-<parent span id>-01".
+const TraceparentHeader = "traceparent"
+
+// SpanContext identifies a span, and is what is propagated to child spans and other processes.
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Sampled bool
+}
+
+// IsValid returns true if sc has a trace ID and a span ID.
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != [16]byte{} && sc.SpanID != [8]byte{}
+}
+
+// Attribute is a key and a value (a string, bool, int, int64 or float64) describing a span.
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+// Span is an operation of a trace, e.g. the lookup of the delivery points of the subscribers of a push.
+type Span struct {
+	Context  SpanContext
+	ParentID [8]byte
+	Name     string
+	Kind     int
+	Start    time.Time
+	End      time.Time
+
+	// mutex guards Attributes, Err and ended, since spans can be annotated by several goroutines.
+	mutex      sync.Mutex
+	Attributes []Attribute
+	// Err is the error which made the operation fail, if any.
+	Err    string
+	ended  bool
+	tracer *tracer
+}
+
+// SetAttribute adds an attribute to the span.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	s.Attributes = append(s.Attributes, Attribute{Key: key, Value: value})
+	s.mutex.Unlock()
+}
+
+// SetError marks the span as failed, if err isn't nil.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mutex.Lock()
+	s.Err = err.Error()
+	s.mutex.Unlock()
+}
+
+// Finish ends the span and queues it to be exported. Calls after the first one do nothing.
+func (s *Span) Finish() {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	if s.ended {
+		s.mutex.Unlock()
+		return
+	}
+	s.ended = true
+	s.End = time.Now()
+	s.mutex.Unlock()
+	s.tracer.exporter.Export(s)
+}
+
+// Exporter sends finished spans to a tracing backend. Export must not block.
+type Exporter interface {
+	Export(s *Span)
+}
+
+type tracer struct {
+	exporter Exporter
+	// threshold is the sample ratio scaled to 2^63: root spans whose random trace ID is below it are sampled.
+	threshold uint64
+}
+
+// current is the *tracer configured by Configure, or nil if tracing is disabled.
+var current atomic.Value
+
+// Configure enables tracing. sampleRatio is the fraction of traces started by uniqush-push which are recorded;
+// traces started by callers (with a sampled traceparent header) are always recorded.
+func Configure(exporter Exporter, sampleRatio float64) {
+	if sampleRatio < 0 {
+		sampleRatio = 0
+	}
+	if sampleRatio > 1 {
+		sampleRatio = 1
+	}
+	current.Store(&tracer{exporter: exporter, threshold: uint64(sampleRatio * (1 << 63))})
+}
+
+// Disable disables tracing, e.g. after tests.
+func Disable() {
+	current.Store((*tracer)(nil))
+}
+
+func currentTracer() *tracer {
+	t, _ := current.Load().(*tracer)
+	return t
+}
+
+type spanContextKey struct{}
+
+// ContextWithSpanContext returns a copy of ctx in which spans are children of sc.
+func ContextWithSpanContext(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, spanContextKey{}, sc)
+}
+
+// SpanContextFromContext returns the span context of ctx. It isn't valid if ctx isn't traced.
+func SpanContextFromContext(ctx context.Context) SpanContext {
+	sc, _ := ctx.Value(spanContextKey{}).(SpanContext)
+	return sc
+}
+
+// Start starts a span which is a child of the span of ctx (or the root of a new trace), and returns a context for its children.
+// It returns a nil span if tracing is disabled or the trace isn't sampled.
+func Start(ctx context.Context, name string, kind int) (context.Context, *Span) {
+	t := currentTracer()
+	if t == nil {
+		return ctx, nil
+	}
+	parent := SpanContextFromContext(ctx)
+	sc := SpanContext{TraceID: parent.TraceID, Sampled: parent.Sampled}
+	if !parent.IsValid() {
+		rand.Read(sc.TraceID[:])
+		// Trace IDs are random, so their low 63 bits decide the sampling like a random number would.
+		sc.Sampled = binary.BigEndian.Uint64(sc.TraceID[8:])&(1<<63-1) < t.threshold
+	}
+	rand.Read(sc.SpanID[:])
+	ctx = ContextWithSpanContext(ctx, sc)
+	if !sc.Sampled {
+		return ctx, nil
+	}
+	return ctx, &Span{Context: sc, ParentID: parent.SpanID, Name: name, Kind: kind, Start: time.Now(), tracer: t}
+}
+
+// Extract returns a copy of ctx whose spans are children of the span in the traceparent header of h, if there is a valid one.
+func Extract(ctx context.Context, h http.Header) context.Context {
+	sc, err := ParseTraceparent(h.Get(TraceparentHeader))
+	if err != nil {
+		return ctx
+	}
+	return ContextWithSpanContext(ctx, sc)
+}
+
+// Inject sets the traceparent header of h to the span context of ctx, so that the receiver can continue the trace.
+func Inject(ctx context.Context, h http.Header) {
+	if sc := SpanContextFromContext(ctx); sc.IsValid() {
+		h.Set(TraceparentHeader, FormatTraceparent(sc))
+	}
+}
+
+// FormatTraceparent returns the traceparent header of sc.
+func FormatTraceparent(sc SpanContext) string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + hex.EncodeToString(sc.TraceID[:]) + "-" + hex.EncodeToString(sc.SpanID[:]) + "-" + flags
+}
+
+// ParseTraceparent parses a traceparent header (version 00, or a later version with the same prefix).
+func ParseTraceparent(s string) (SpanContext, error) {
+	var sc SpanContext
+	parts := strings.Split(strings.TrimSpace(s), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return sc, fmt.Errorf("invalid traceparent %q", s)
+	}
+	if len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, fmt.Errorf("invalid traceparent %q", s)
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return sc, fmt.Errorf("invalid trace id in traceparent %q", s)
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return sc, fmt.Errorf("invalid span id in traceparent %q", s)
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return sc, fmt.Errorf("invalid flags in traceparent %q", s)
+	}
+	if !sc.IsValid() {
+		return sc, fmt.Errorf("invalid traceparent %q", s)
+	}
+	sc.Sampled = flags[0]&1 == 1
+	return sc, nil
+}
@@ -0,0 +1,168 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/uniqush/uniqush-push/testutil"
+)
+
+// recordingExporter keeps the spans it is given.
+type recordingExporter struct {
+	mutex sync.Mutex
+	spans []*Span
+}
+
+func (e *recordingExporter) Export(s *Span) {
+	e.mutex.Lock()
+	e.spans = append(e.spans, s)
+	e.mutex.Unlock()
+}
+
+func TestStartWithoutConfigure(t *testing.T) {
+	Disable()
+	ctx, span := Start(context.Background(), "push", KindInternal)
+	if span != nil {
+		t.Fatalf("expected no span when tracing is disabled, got %v", span)
+	}
+	// Methods of nil spans do nothing.
+	span.SetAttribute("key", "value")
+	span.SetError(errors.New("error"))
+	span.Finish()
+	testutil.ExpectEquals(t, false, SpanContextFromContext(ctx).IsValid(), "expected ctx not to be traced")
+}
+
+func TestChildSpansAndPropagation(t *testing.T) {
+	exporter := &recordingExporter{}
+	Configure(exporter, 0)
+	defer Disable()
+
+	h := http.Header{}
+	h.Set(TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ctx, root := Start(Extract(context.Background(), h), "/push", KindServer)
+	if root == nil {
+		t.Fatal("expected a sampled traceparent to be traced even with a sample ratio of 0")
+	}
+	childCtx, child := Start(ctx, "db.GetPushServiceProviderDeliveryPointPairs", KindInternal)
+	child.SetError(errors.New("timeout"))
+	child.Finish()
+	child.Finish()
+	root.Finish()
+
+	testutil.ExpectEquals(t, 2, len(exporter.spans), "expected each span to be exported once")
+	testutil.ExpectStringEquals(t, "4bf92f3577b34da6a3ce929d0e0e4736", FormatTraceparent(child.Context)[3:35], "expected the trace id of the caller")
+	testutil.ExpectEquals(t, root.Context.SpanID, child.ParentID, "expected the child to be a child of the root")
+	testutil.ExpectStringEquals(t, "00f067aa0ba902b7", FormatTraceparent(SpanContext{TraceID: root.Context.TraceID, SpanID: root.ParentID})[36:52], "expected the root to be a child of the caller's span")
+	testutil.ExpectStringEquals(t, "timeout", child.Err, "expected the error of the child")
+
+	out := http.Header{}
+	Inject(childCtx, out)
+	testutil.ExpectStringEquals(t, FormatTraceparent(child.Context), out.Get(TraceparentHeader), "expected the span context to be injected")
+}
+
+func TestSampleRatio(t *testing.T) {
+	Configure(&recordingExporter{}, 0)
+	defer Disable()
+	ctx, span := Start(context.Background(), "push", KindInternal)
+	if span != nil {
+		t.Fatal("expected no span with a sample ratio of 0")
+	}
+	if _, child := Start(ctx, "db", KindInternal); child != nil {
+		t.Fatal("expected the children of unsampled spans not to be sampled")
+	}
+	testutil.ExpectEquals(t, false, SpanContextFromContext(ctx).Sampled, "expected the propagated context to be unsampled")
+
+	Configure(&recordingExporter{}, 1)
+	if _, span := Start(context.Background(), "push", KindInternal); span == nil {
+		t.Fatal("expected a span with a sample ratio of 1")
+	}
+}
+
+func TestParseTraceparent(t *testing.T) {
+	sc, err := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectEquals(t, false, sc.Sampled, "expected the sampled flag to be parsed")
+	testutil.ExpectStringEquals(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", FormatTraceparent(sc), "expected the header to round trip")
+
+	for _, invalid := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473z-00f067aa0ba902b7-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+	} {
+		if _, err := ParseTraceparent(invalid); err == nil {
+			t.Errorf("expected %q to be invalid", invalid)
+		}
+	}
+}
+
+func TestOTLPExporter(t *testing.T) {
+	bodies := make(chan []byte, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies <- body
+	}))
+	defer server.Close()
+
+	exporter := NewOTLPExporter(server.URL, "uniqush-push", 10*time.Millisecond, func(err error) {
+		t.Errorf("unexpected error: %v", err)
+	})
+	Configure(exporter, 1)
+	defer Disable()
+	_, span := Start(context.Background(), "send apns", KindClient)
+	span.SetAttribute("uniqush.push_service_provider", "apns:abc")
+	span.SetAttribute("uniqush.delivery_points", 3)
+	span.SetError(errors.New("connection refused"))
+	span.Finish()
+
+	var body []byte
+	select {
+	case body = <-bodies:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the span to be exported")
+	}
+	var req otlpRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		t.Fatalf("invalid request %s: %v", body, err)
+	}
+	testutil.ExpectEquals(t, 1, len(req.ResourceSpans), "expected one resource")
+	testutil.ExpectStringEquals(t, "uniqush-push", req.ResourceSpans[0].Resource.Attributes[0].Value["stringValue"].(string), "expected the service name")
+	spans := req.ResourceSpans[0].ScopeSpans[0].Spans
+	testutil.ExpectEquals(t, 1, len(spans), "expected one span")
+	got := spans[0]
+	testutil.ExpectStringEquals(t, "send apns", got.Name, "expected the name of the span")
+	testutil.ExpectEquals(t, KindClient, got.Kind, "expected the kind of the span")
+	testutil.ExpectEquals(t, 32, len(got.TraceID), "expected a hex trace id")
+	testutil.ExpectStringEquals(t, "", got.ParentSpanID, "expected a root span")
+	testutil.ExpectEquals(t, otlpStatus{Code: 2, Message: "connection refused"}, got.Status, "expected an error status")
+	testutil.ExpectStringEquals(t, "3", got.Attributes[1].Value["intValue"].(string), "expected integers to be encoded as strings")
+}